@@ -12,14 +12,23 @@ import (
 
 func main() {
 	var (
-		image        string
-		outputDir    string
-		name         string
-		sizeMiB      int
-		skipPull     bool
-		sbinInitPath string
-		logLevel     string
-		logFormat    string
+		image         string
+		outputDir     string
+		name          string
+		sizeMiB       int
+		skipPull      bool
+		sbinInitPath  string
+		initramfs     bool
+		kernelVersion string
+		strip         bool
+		pruneManifest string
+		proxy         string
+		rateLimitKiB  int64
+		registryConc  int
+		pullLockDir   string
+		pullRetries   int
+		logLevel      string
+		logFormat     string
 	)
 
 	flag.StringVar(&image, "image", "", "Docker/OCI image reference (required), e.g. nginx:alpine")
@@ -28,6 +37,15 @@ func main() {
 	flag.IntVar(&sizeMiB, "size-mib", 0, "ext4 image size in MiB (0 = auto)")
 	flag.BoolVar(&skipPull, "skip-pull", false, "Skip remote pull and reuse previously cached image blobs in output-dir/image-cache")
 	flag.StringVar(&sbinInitPath, "sbin-init", "./artifacts/sbin-init/sbin-init", "Path to sbin init binary to inject into rootfs")
+	flag.BoolVar(&initramfs, "initramfs", false, "Also build initrd.img with dracut, for kernels that load virtio drivers as modules")
+	flag.StringVar(&kernelVersion, "kernel-version", "", "Kernel version whose /lib/modules the initramfs is built from (required with -initramfs)")
+	flag.BoolVar(&strip, "strip", false, "Remove docs, man pages, locales and package manager caches from the rootfs")
+	flag.StringVar(&pruneManifest, "prune-manifest", "", "File of rootfs globs to remove after the layers are applied, one per line")
+	flag.StringVar(&proxy, "proxy", "", "Proxy for registry requests, e.g. http://proxy:3128 (default: HTTP_PROXY/HTTPS_PROXY/NO_PROXY)")
+	flag.Int64Var(&rateLimitKiB, "rate-limit-kib", 0, "Cap image download bandwidth in KiB/s (0 = unlimited)")
+	flag.IntVar(&registryConc, "registry-concurrency", 0, "Max concurrent blob downloads per registry across converters sharing -pull-lock-dir (0 = unlimited)")
+	flag.StringVar(&pullLockDir, "pull-lock-dir", "/run/mergen/converter", "Directory of the per-registry download slot locks")
+	flag.IntVar(&pullRetries, "pull-retries", 3, "Extra attempts for requests the registry keeps refusing with 429 Too Many Requests")
 	flag.StringVar(&logLevel, "log-level", "info", "Log level (debug|info|warn|error)")
 	flag.StringVar(&logFormat, "log-format", "console", "Log format (console|json|text)")
 	flag.Parse()
@@ -42,12 +60,23 @@ func main() {
 	runner := converter.NewRunner(logger)
 
 	result, err := runner.Run(context.Background(), converter.Options{
-		Image:        image,
-		OutputDir:    outputDir,
-		Name:         name,
-		SizeMiB:      sizeMiB,
-		SkipPull:     skipPull,
-		SbinInitPath: sbinInitPath,
+		Image:         image,
+		OutputDir:     outputDir,
+		Name:          name,
+		SizeMiB:       sizeMiB,
+		SkipPull:      skipPull,
+		SbinInitPath:  sbinInitPath,
+		Initramfs:     initramfs,
+		KernelVersion: kernelVersion,
+		Strip:         strip,
+		PruneManifest: pruneManifest,
+		Pull: converter.PullOptions{
+			Proxy:               proxy,
+			RateLimit:           rateLimitKiB << 10,
+			RegistryConcurrency: registryConc,
+			LockDir:             pullLockDir,
+			Retries:             pullRetries,
+		},
 	})
 	if err != nil {
 		logger.Error("conversion failed", "error", err)
@@ -60,7 +89,21 @@ func main() {
 	_, _ = fmt.Fprintf(os.Stdout, "rootfs dir: %s\n", result.RootFSDir)
 	_, _ = fmt.Fprintf(os.Stdout, "rootfs tar: %s\n", result.RootFSTarPath)
 	_, _ = fmt.Fprintf(os.Stdout, "rootfs ext4: %s\n", result.RootFSExt4Path)
+	if result.InitrdPath != "" {
+		_, _ = fmt.Fprintf(os.Stdout, "initrd: %s\n", result.InitrdPath)
+	}
+	if strip || pruneManifest != "" {
+		_, _ = fmt.Fprintf(os.Stdout, "stripped: %d entries, %d bytes saved\n", result.Strip.Removed, result.Strip.BytesSaved)
+	}
+	_, _ = fmt.Fprintf(os.Stdout, "layout: %d hardlinks, %d sparse files (%d bytes of holes)\n",
+		result.Layout.Hardlinks, result.Layout.SparseFiles, result.Layout.HoleBytes)
+	_, _ = fmt.Fprintf(os.Stdout, "file capabilities: %d preserved, %d restored, %d lost\n",
+		result.Capabilities.Preserved, len(result.Capabilities.Restored), len(result.Capabilities.Lost))
+	for _, lost := range result.Capabilities.Lost {
+		_, _ = fmt.Fprintf(os.Stdout, "  lost %s on %s: %s\n", lost.Attribute, lost.Path, lost.Reason)
+	}
 	_, _ = fmt.Fprintf(os.Stdout, "image metadata: %s\n", result.MetadataPath)
+	_, _ = fmt.Fprintf(os.Stdout, "required env: %s (%d variables)\n", result.RequiredEnvPath, len(result.RequiredEnv))
 	_, _ = fmt.Fprintf(os.Stdout, "suggested boot args: %s\n", result.SuggestedBootArgsPath)
 	_, _ = fmt.Fprintf(os.Stdout, "suggested VM request: %s\n", result.SuggestedVMPath)
 	if result.SuggestedHTTPPort > 0 {
@@ -2,35 +2,76 @@ package main
 
 import (
 	"context"
+	"encoding/json"
+	"flag"
+	"log/slog"
+	"net/http"
 	"os"
 	"os/signal"
 	"syscall"
+	"time"
 
+	"github.com/alperreha/mergen-fire/internal/config"
 	"github.com/alperreha/mergen-fire/internal/forwarder"
 	"github.com/alperreha/mergen-fire/internal/logging"
+	"github.com/alperreha/mergen-fire/internal/model"
+	"github.com/alperreha/mergen-fire/internal/store"
+	"github.com/alperreha/mergen-fire/pkg/client"
 )
 
 func main() {
-	cfg, err := forwarder.FromEnv()
+	configPath := flag.String("config", "", "YAML or TOML config file; env vars override it")
+	validateOnly := flag.Bool("validate-config", false, "validate the configuration and exit")
+	explain := flag.String("explain", "", "print how this TLS server name would be routed, as JSON, and exit")
+	flag.Parse()
+
+	cfg, err := forwarder.Load(*configPath)
 	if err != nil {
 		_, _ = os.Stderr.WriteString("forwarder config error: " + err.Error() + "\n")
 		os.Exit(1)
 	}
+	if *validateOnly {
+		_, _ = os.Stdout.WriteString("config ok\n")
+		return
+	}
+
+	logOut, closeLog, err := cfg.LogOutput.Open()
+	if err != nil {
+		_, _ = os.Stderr.WriteString("forwarder log output error: " + err.Error() + "\n")
+		os.Exit(1)
+	}
+	defer closeLog()
+	logLevels := logging.NewLevels(logging.ParseLevel(cfg.LogLevel), cfg.LogFormat, logOut)
+	logger := logLevels.Logger("forwarder")
+	var api *client.Client
+	if cfg.MergendURL != "" {
+		api = client.New(cfg.MergendURL)
+		if cfg.MergendToken != "" {
+			api.WithHeader("Authorization", "Bearer "+cfg.MergendToken)
+		}
+	}
+	dialer := forwarder.NewNetNSDialer(cfg.DialTimeout, cfg.NetNSRoot)
+	if *explain != "" {
+		// Keep stdout for the trace; resolver warnings go to stderr.
+		resolver := newResolver(cfg, api, slog.New(slog.NewTextHandler(os.Stderr, nil)))
+		encoder := json.NewEncoder(os.Stdout)
+		encoder.SetIndent("", "  ")
+		_ = encoder.Encode(forwarder.ExplainRoute(resolver, dialer, *explain))
+		return
+	}
+	resolver := newResolver(cfg, api, logLevels.Logger("resolver"))
 
-	logger := logging.New(cfg.LogLevel, cfg.LogFormat).With("component", "mergen-forwarder")
 	logger.Info(
 		"starting forwarder",
 		"configRoot", cfg.ConfigRoot,
+		"mergendURL", cfg.MergendURL,
 		"netnsRoot", cfg.NetNSRoot,
 		"httpsAddr", cfg.HTTPSAddr,
 		"domainPrefix", cfg.DomainPrefix,
 		"domainSuffix", cfg.DomainSuffix,
 	)
 
-	resolver := forwarder.NewResolver(cfg.ConfigRoot, cfg.DomainPrefix, cfg.DomainSuffix, cfg.ResolverCacheTTL, logger.With("component", "resolver"))
-	dialer := forwarder.NewNetNSDialer(cfg.DialTimeout, cfg.NetNSRoot)
-
-	server, err := forwarder.NewServer(cfg, resolver, dialer, logger.With("component", "server"))
+	server, err := forwarder.NewServer(cfg, resolver, dialer, logLevels.Logger("server"))
 	if err != nil {
 		logger.Error("forwarder server init failed", "error", err)
 		os.Exit(1)
@@ -38,6 +79,59 @@ func main() {
 
 	ctx, cancel := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
 	defer cancel()
+	if api != nil {
+		server.WithWaker(api, cfg.WakeTimeout)
+		go server.RunActivityReports(ctx, cfg.ActivityReport)
+	}
+
+	var events <-chan model.StoreEvent
+	if api != nil {
+		events, err = api.Watch(ctx)
+	} else {
+		events, err = store.NewFSStore(cfg.ConfigRoot, "", "", "").WithLogger(logLevels.Logger("store")).Watch(ctx)
+	}
+	if err != nil {
+		logger.Warn("store watch unavailable, relying on resolver cache ttl", "error", err)
+	} else {
+		go resolver.Follow(events)
+	}
+
+	if cfg.DebugAddr != "" {
+		debugServer := &http.Server{Addr: cfg.DebugAddr, Handler: server.DebugHandler(), ReadHeaderTimeout: 5 * time.Second}
+		go func() {
+			<-ctx.Done()
+			_ = debugServer.Close()
+		}()
+		go func() {
+			logger.Info("debug listener started", "debugAddr", cfg.DebugAddr)
+			if err := debugServer.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+				logger.Error("debug listener stopped", "debugAddr", cfg.DebugAddr, "error", err)
+			}
+		}()
+	}
+
+	configReloader := &reloader{path: *configPath, current: cfg, levels: logLevels, resolver: resolver, server: server, logger: logLevels.Logger("config")}
+	if *configPath != "" {
+		go config.WatchFile(ctx, *configPath, 5*time.Second, configReloader.Reload)
+	}
+	hangups := make(chan os.Signal, 1)
+	signal.Notify(hangups, syscall.SIGHUP)
+	if err := logLevels.Apply("", cfg.LogLevels); err != nil {
+		logger.Warn("ignoring log level overrides", "error", err)
+	}
+	go func() {
+		for range hangups {
+			configReloader.Reload()
+		}
+	}()
+	cycleLevels := make(chan os.Signal, 1)
+	signal.Notify(cycleLevels, syscall.SIGUSR1)
+	go func() {
+		for range cycleLevels {
+			level := logLevels.Cycle()
+			logger.Warn("default log level changed by SIGUSR1", "level", logging.LevelName(level))
+		}
+	}()
 
 	if err := server.Run(ctx); err != nil && err != context.Canceled {
 		logger.Error("forwarder stopped with error", "error", err)
@@ -45,3 +139,12 @@ func main() {
 	}
 	logger.Info("forwarder stopped")
 }
+
+// newResolver reads VMs from mergend when api is set, otherwise from the
+// config root.
+func newResolver(cfg forwarder.Config, api *client.Client, logger *slog.Logger) *forwarder.Resolver {
+	if api != nil {
+		return forwarder.NewAPIResolver(api, cfg.DomainPrefix, cfg.DomainSuffix, cfg.ResolverCacheTTL, logger)
+	}
+	return forwarder.NewResolver(cfg.ConfigRoot, cfg.DomainPrefix, cfg.DomainSuffix, cfg.ResolverCacheTTL, logger)
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"log/slog"
+	"sync"
+
+	"github.com/alperreha/mergen-fire/internal/config"
+	"github.com/alperreha/mergen-fire/internal/forwarder"
+	"github.com/alperreha/mergen-fire/internal/logging"
+)
+
+// reloadable lists the forwarder Config fields that can change without a
+// restart. New domains usually come with a new certificate, so both reload.
+var reloadable = map[string]bool{
+	"LogLevel":     true,
+	"LogLevels":    true,
+	"DomainPrefix": true,
+	"DomainSuffix": true,
+	"CertFile":     true,
+	"KeyFile":      true,
+}
+
+type reloader struct {
+	mu       sync.Mutex
+	path     string
+	current  forwarder.Config
+	levels   *logging.Levels
+	resolver *forwarder.Resolver
+	server   *forwarder.Server
+	logger   *slog.Logger
+}
+
+func (r *reloader) Reload() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	next, err := forwarder.Load(r.path)
+	if err != nil {
+		r.logger.Error("config reload failed, keeping current config", "path", r.path, "error", err)
+		return
+	}
+	applied, rejected := config.Diff(r.current, next, reloadable)
+	certChanged := false
+	for _, field := range applied {
+		switch field {
+		case "LogLevel", "LogLevels":
+			if err := r.levels.Apply(next.LogLevel, logging.OverrideChanges(r.current.LogLevels, next.LogLevels)); err != nil {
+				r.logger.Warn("log levels not applied", "error", err)
+				continue
+			}
+			r.current.LogLevel, r.current.LogLevels = next.LogLevel, next.LogLevels
+		case "DomainPrefix", "DomainSuffix":
+			r.resolver.SetDomains(next.DomainPrefix, next.DomainSuffix)
+			r.current.DomainPrefix, r.current.DomainSuffix = next.DomainPrefix, next.DomainSuffix
+		case "CertFile", "KeyFile":
+			certChanged = true
+		}
+	}
+	if certChanged {
+		if err := r.server.ReloadCertificate(next.CertFile, next.KeyFile); err != nil {
+			r.logger.Error("certificate reload failed, keeping current certificate", "error", err)
+		} else {
+			r.current.CertFile, r.current.KeyFile = next.CertFile, next.KeyFile
+		}
+	}
+	if len(rejected) > 0 {
+		r.logger.Warn("config changes need a restart and were not applied", "fields", rejected)
+	}
+	r.logger.Info("config reloaded", "path", r.path, "applied", applied)
+}
@@ -0,0 +1,215 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	"golang.org/x/sys/unix"
+)
+
+// coreDumpArg on the kernel command line enables core dump capture, as
+// comma-separated key=value pairs named like the coreDump section, e.g.
+// mergen.coredump=device=/dev/vdb,maxSizeMiB=64. Its fields override the
+// section's.
+const (
+	coreDumpArg        = "mergen.coredump"
+	coreDumpCommand    = "core-dump"
+	coreDumpConfigPath = "/run/mergen-coredump.json"
+	coreDumpDefaultDir = "/var/crash/mergen"
+)
+
+// coreDump is the "coreDump" section of image-meta.json ("CoreDump" in fly's
+// run.json). The kernel pipes each dump to this binary, which keeps at most
+// MaxSizeMiB of it in Dir and the newest MaxFiles dumps there. Device, when
+// set, is an ext4 block device such as the data disk mounted on Dir, so the
+// dumps outlive the VM's root filesystem.
+type coreDump struct {
+	Enabled    bool   `json:"enabled"`
+	Dir        string `json:"dir,omitempty"`
+	Device     string `json:"device,omitempty"`
+	MaxSizeMiB int    `json:"maxSizeMiB,omitempty"`
+	MaxFiles   int    `json:"maxFiles,omitempty"`
+}
+
+// withCmdline returns c with the fields given in cmdline's coreDumpArg
+// applied; the argument alone enables capture.
+func (c *coreDump) withCmdline(cmdline string) *coreDump {
+	value := cmdlineValue(cmdline, coreDumpArg)
+	if value == "" {
+		return c
+	}
+	out := coreDump{}
+	if c != nil {
+		out = *c
+	}
+	out.Enabled = true
+	for _, pair := range strings.Split(value, ",") {
+		key, raw, _ := strings.Cut(pair, "=")
+		switch strings.TrimSpace(key) {
+		case "dir":
+			out.Dir = raw
+		case "device":
+			out.Device = raw
+		case "maxSizeMiB":
+			out.MaxSizeMiB, _ = strconv.Atoi(raw)
+		case "maxFiles":
+			out.MaxFiles, _ = strconv.Atoi(raw)
+		}
+	}
+	return &out
+}
+
+func (c *coreDump) normalized() coreDump {
+	out := *c
+	if out.Dir == "" {
+		out.Dir = coreDumpDefaultDir
+	}
+	if out.MaxSizeMiB <= 0 {
+		out.MaxSizeMiB = 256
+	}
+	if out.MaxFiles <= 0 {
+		out.MaxFiles = 5
+	}
+	return out
+}
+
+// setupCoreDumps points kernel.core_pattern at this binary and lifts the
+// core size limit the workload inherits. Failures only lose crash dumps, so
+// they are logged and boot goes on.
+func setupCoreDumps(c *coreDump, logger *slog.Logger) {
+	if c == nil || !c.Enabled {
+		return
+	}
+	cfg := c.normalized()
+	if !filepath.IsAbs(cfg.Dir) {
+		logger.Warn("core dump dir must be absolute, capture disabled", "dir", cfg.Dir)
+		return
+	}
+	if err := os.MkdirAll(cfg.Dir, 0o700); err != nil {
+		logger.Warn("prepare core dump dir failed, capture disabled", "dir", cfg.Dir, "error", err)
+		return
+	}
+	if cfg.Device != "" {
+		if err := mountIfNeeded(cfg.Device, cfg.Dir, "ext4", uintptr(unix.MS_NOSUID|unix.MS_NODEV|unix.MS_NOEXEC|unix.MS_RELATIME), ""); err != nil {
+			logger.Warn("mount core dump device failed, capture disabled", "device", cfg.Device, "dir", cfg.Dir, "error", err)
+			return
+		}
+	}
+	body, err := json.Marshal(cfg)
+	if err == nil {
+		err = os.WriteFile(coreDumpConfigPath, body, 0o600)
+	}
+	if err != nil {
+		logger.Warn("write core dump config failed, capture disabled", "error", err)
+		return
+	}
+	self, err := os.Executable()
+	if err != nil {
+		logger.Warn("locate init binary failed, capture disabled", "error", err)
+		return
+	}
+	pattern := fmt.Sprintf("|%s %s %%P %%e %%t %%s", self, coreDumpCommand)
+	if err := os.WriteFile("/proc/sys/kernel/core_pattern", []byte(pattern), 0o644); err != nil {
+		logger.Warn("set core_pattern failed, capture disabled", "error", err)
+		return
+	}
+	limit := unix.Rlimit{Cur: unix.RLIM_INFINITY, Max: unix.RLIM_INFINITY}
+	if err := unix.Setrlimit(unix.RLIMIT_CORE, &limit); err != nil {
+		logger.Warn("raise core size limit failed", "error", err)
+	}
+	logger.Info("core dump capture enabled", "dir", cfg.Dir, "device", cfg.Device, "maxSizeMiB", cfg.MaxSizeMiB, "maxFiles", cfg.MaxFiles)
+}
+
+// handleCoreDump runs as the kernel's core_pattern helper with the dump on
+// stdin and pid, executable name, time and signal as args. Nothing reads
+// its output, so it only reports through the exit code.
+func handleCoreDump(args []string) int {
+	if len(args) != 4 {
+		return 2
+	}
+	body, err := os.ReadFile(coreDumpConfigPath)
+	if err != nil {
+		return 1
+	}
+	var cfg coreDump
+	if err := json.Unmarshal(body, &cfg); err != nil {
+		return 1
+	}
+	cfg = cfg.normalized()
+	name := fmt.Sprintf("core.%s.%s.%s.sig%s", sanitizeCoreName(args[1]), args[0], args[2], args[3])
+	if err := writeCoreDump(cfg, name, os.Stdin); err != nil {
+		return 1
+	}
+	pruneCoreDumps(cfg.Dir, cfg.MaxFiles)
+	return 0
+}
+
+// writeCoreDump keeps the first MaxSizeMiB of the dump and drains the rest,
+// since the kernel blocks the dying process until the pipe is read.
+func writeCoreDump(cfg coreDump, name string, dump io.Reader) error {
+	path := filepath.Join(cfg.Dir, name)
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0o600)
+	if err != nil {
+		return err
+	}
+	limit := int64(cfg.MaxSizeMiB) << 20
+	written, copyErr := io.CopyN(file, dump, limit)
+	closeErr := file.Close()
+	if copyErr != nil && !errors.Is(copyErr, io.EOF) {
+		return copyErr
+	}
+	if closeErr != nil {
+		return closeErr
+	}
+	if written == limit {
+		if dropped, _ := io.Copy(io.Discard, dump); dropped > 0 {
+			_ = os.Rename(path, path+".truncated")
+		}
+	}
+	return nil
+}
+
+// pruneCoreDumps removes all but the newest keep dumps in dir.
+func pruneCoreDumps(dir string, keep int) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return
+	}
+	type dump struct {
+		path    string
+		modTime int64
+	}
+	var dumps []dump
+	for _, entry := range entries {
+		if !entry.Type().IsRegular() || !strings.HasPrefix(entry.Name(), "core.") {
+			continue
+		}
+		info, err := entry.Info()
+		if err != nil {
+			continue
+		}
+		dumps = append(dumps, dump{path: filepath.Join(dir, entry.Name()), modTime: info.ModTime().UnixNano()})
+	}
+	sort.Slice(dumps, func(i, j int) bool { return dumps[i].modTime > dumps[j].modTime })
+	for idx := keep; idx < len(dumps); idx++ {
+		_ = os.Remove(dumps[idx].path)
+	}
+}
+
+func sanitizeCoreName(name string) string {
+	return strings.Map(func(r rune) rune {
+		switch {
+		case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z', r >= '0' && r <= '9', r == '-', r == '_':
+			return r
+		}
+		return '_'
+	}, name)
+}
@@ -0,0 +1,273 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io"
+	"log/slog"
+	"maps"
+	"os"
+	"os/exec"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+// execArg turns the exec agent off with mergen.exec=0.
+const (
+	execArg  = "mergen.exec"
+	execPort = 1028
+	// maxExecOutput bounds stdout and stderr each; the rest is dropped.
+	maxExecOutput      = 1 << 20
+	maxExecRequest     = 1 << 20
+	defaultExecTimeout = 60 * time.Second
+	// execDrainGrace is how long output is still read after the command
+	// exits, for children it left holding its stdout or stderr.
+	execDrainGrace = time.Second
+)
+
+// execRequest is one command sent by mergend, as a JSON line.
+type execRequest struct {
+	Argv      []string          `json:"argv"`
+	Env       map[string]string `json:"env,omitempty"`
+	WorkDir   string            `json:"workDir,omitempty"`
+	User      string            `json:"user,omitempty"`
+	Stdin     string            `json:"stdin,omitempty"`
+	TimeoutMs int64             `json:"timeoutMs,omitempty"`
+}
+
+// execResponse is sent back once the command exits. Error is set, and the
+// rest left empty, when it could not be started.
+type execResponse struct {
+	ExitCode  int    `json:"exitCode"`
+	Stdout    string `json:"stdout"`
+	Stderr    string `json:"stderr"`
+	Truncated bool   `json:"truncated,omitempty"`
+	TimedOut  bool   `json:"timedOut,omitempty"`
+	Error     string `json:"error,omitempty"`
+}
+
+// execChildren hands the exit codes of the commands the agent started to
+// it: as PID 1 the init reaps every child, so they cannot be waited for.
+type execChildren struct {
+	mu      sync.Mutex
+	waiting map[int]chan int
+}
+
+var guestExecs = &execChildren{waiting: map[int]chan int{}}
+
+// start starts cmd and returns where its exit code arrives. Holding the
+// lock across the start keeps a child that exits at once from being reaped
+// before it is known.
+func (c *execChildren) start(cmd *exec.Cmd) (<-chan int, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if err := cmd.Start(); err != nil {
+		return nil, err
+	}
+	exited := make(chan int, 1)
+	c.waiting[cmd.Process.Pid] = exited
+	return exited, nil
+}
+
+// exited delivers the exit code of a reaped child and reports whether it
+// was one of the agent's.
+func (c *execChildren) exited(pid, code int) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	exited, ok := c.waiting[pid]
+	if ok {
+		exited <- code
+		delete(c.waiting, pid)
+	}
+	return ok
+}
+
+// serveExec runs the commands mergend sends over vsock, one per
+// connection, as the workload's user and with its environment unless the
+// request names others. Without a vsock device, or with mergen.exec=0, it
+// returns at once.
+func serveExec(spec startSpec, logger *slog.Logger) {
+	cmdline, _ := os.ReadFile("/proc/cmdline")
+	if cmdlineValue(string(cmdline), execArg) == "0" {
+		logger.Info("exec agent disabled by kernel command line")
+		return
+	}
+	fd, err := unix.Socket(unix.AF_VSOCK, unix.SOCK_STREAM|unix.SOCK_CLOEXEC, 0)
+	if err == nil {
+		if err = unix.Bind(fd, &unix.SockaddrVM{CID: unix.VMADDR_CID_ANY, Port: execPort}); err == nil {
+			err = unix.Listen(fd, 16)
+		}
+		if err != nil {
+			unix.Close(fd)
+		}
+	}
+	if err != nil {
+		logger.Info("exec agent not started, no vsock", "error", err)
+		return
+	}
+	logger.Debug("exec agent listening", "port", execPort)
+	for {
+		connFD, _, err := unix.Accept4(fd, unix.SOCK_CLOEXEC)
+		if errors.Is(err, unix.EINTR) || errors.Is(err, unix.ECONNABORTED) {
+			continue
+		}
+		if err != nil {
+			logger.Warn("exec agent stopped", "error", err)
+			unix.Close(fd)
+			return
+		}
+		go handleExec(os.NewFile(uintptr(connFD), "vsock-exec"), spec, logger)
+	}
+}
+
+func handleExec(conn *os.File, spec startSpec, logger *slog.Logger) {
+	defer conn.Close()
+	var req execRequest
+	var resp execResponse
+	if err := json.NewDecoder(io.LimitReader(conn, maxExecRequest)).Decode(&req); err != nil {
+		resp.Error = "invalid exec request: " + err.Error()
+	} else {
+		resp = runExec(req, spec, guestExecs)
+		var command string
+		if len(req.Argv) > 0 {
+			command = req.Argv[0]
+		}
+		logger.Info("exec finished", "command", command, "exitCode", resp.ExitCode, "timedOut", resp.TimedOut, "error", resp.Error)
+	}
+	if err := json.NewEncoder(conn).Encode(resp); err != nil {
+		logger.Debug("sending exec result failed", "error", err)
+	}
+}
+
+// runExec runs req in its own process group, which is killed if it runs
+// past its timeout.
+func runExec(req execRequest, spec startSpec, children *execChildren) execResponse {
+	if len(req.Argv) == 0 || req.Argv[0] == "" {
+		return execResponse{Error: "argv is empty"}
+	}
+	userSpec := spec.User
+	if req.User != "" {
+		userSpec = req.User
+	}
+	uid, gid, home, err := resolveUser(userSpec)
+	if err != nil {
+		return execResponse{Error: err.Error()}
+	}
+	env := maps.Clone(spec.Env)
+	if env == nil {
+		env = map[string]string{}
+	}
+	if req.User != "" || strings.TrimSpace(env["HOME"]) == "" {
+		env["HOME"] = home
+	}
+	if strings.TrimSpace(env["PATH"]) == "" {
+		env["PATH"] = "/usr/local/sbin:/usr/local/bin:/usr/sbin:/usr/bin:/sbin:/bin"
+	}
+	maps.Copy(env, req.Env)
+	timeout := defaultExecTimeout
+	if req.TimeoutMs > 0 {
+		timeout = time.Duration(req.TimeoutMs) * time.Millisecond
+	}
+
+	cmd := exec.Command(req.Argv[0], req.Argv[1:]...)
+	cmd.Env = envMapToList(env)
+	cmd.Dir = spec.WorkingDir
+	if req.WorkDir != "" {
+		cmd.Dir = req.WorkDir
+	}
+	if req.Stdin != "" {
+		cmd.Stdin = strings.NewReader(req.Stdin)
+	}
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+	if int(uid) != os.Getuid() || int(gid) != os.Getgid() {
+		cmd.SysProcAttr.Credential = &syscall.Credential{Uid: uid, Gid: gid}
+	}
+	stdoutR, stdoutW, err := os.Pipe()
+	if err != nil {
+		return execResponse{Error: err.Error()}
+	}
+	stderrR, stderrW, err := os.Pipe()
+	if err != nil {
+		stdoutR.Close()
+		stdoutW.Close()
+		return execResponse{Error: err.Error()}
+	}
+	cmd.Stdout, cmd.Stderr = stdoutW, stderrW
+	exited, err := children.start(cmd)
+	stdoutW.Close()
+	stderrW.Close()
+	if err != nil {
+		stdoutR.Close()
+		stderrR.Close()
+		return execResponse{Error: err.Error()}
+	}
+	defer cmd.Process.Release()
+
+	stdout, stderr := &cappedBuffer{limit: maxExecOutput}, &cappedBuffer{limit: maxExecOutput}
+	var copies sync.WaitGroup
+	for _, stream := range []struct {
+		from *os.File
+		to   *cappedBuffer
+	}{{stdoutR, stdout}, {stderrR, stderr}} {
+		copies.Add(1)
+		go func() {
+			defer copies.Done()
+			_, _ = io.Copy(stream.to, stream.from)
+		}()
+	}
+
+	var resp execResponse
+	timer := time.NewTimer(timeout)
+	select {
+	case resp.ExitCode = <-exited:
+	case <-timer.C:
+		resp.TimedOut = true
+		_ = syscall.Kill(-cmd.Process.Pid, syscall.SIGKILL)
+		resp.ExitCode = <-exited
+	}
+	timer.Stop()
+
+	drained := make(chan struct{})
+	go func() {
+		copies.Wait()
+		close(drained)
+	}()
+	select {
+	case <-drained:
+	case <-time.After(execDrainGrace):
+	}
+	// Closing the read ends ends copies still blocked on a leftover child.
+	stdoutR.Close()
+	stderrR.Close()
+	<-drained
+
+	resp.Stdout, resp.Stderr = stdout.String(), stderr.String()
+	resp.Truncated = stdout.truncated || stderr.truncated
+	return resp
+}
+
+// cappedBuffer keeps the first limit bytes written to it.
+type cappedBuffer struct {
+	buf       bytes.Buffer
+	limit     int
+	truncated bool
+}
+
+func (b *cappedBuffer) Write(p []byte) (int, error) {
+	keep := p
+	if room := b.limit - b.buf.Len(); room < len(p) {
+		keep = p[:max(room, 0)]
+		b.truncated = true
+	}
+	b.buf.Write(keep)
+	return len(p), nil
+}
+
+func (b *cappedBuffer) String() string {
+	return b.buf.String()
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"os"
+	"strconv"
+	"strings"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+// growRootArg asks init to grow the root ext4 filesystem to the size of its
+// drive, which mergend extends when a VM is created with rootfsSizeMiB.
+const growRootArg = "mergen.growroot"
+
+// ext4ResizeFS is EXT4_IOC_RESIZE_FS, the online resize resize2fs uses on a
+// mounted filesystem; growing through it needs no tools in the image.
+const ext4ResizeFS = 0x40086610
+
+func growRootIfRequested(logger *slog.Logger) {
+	cmdline, err := os.ReadFile("/proc/cmdline")
+	if err != nil || cmdlineValue(string(cmdline), growRootArg) == "" {
+		return
+	}
+	blocks, err := growRootFS()
+	if err != nil {
+		logger.Warn("growing root filesystem failed", "error", err)
+		return
+	}
+	logger.Info("root filesystem grown to its drive", "blocks", blocks)
+}
+
+func growRootFS() (uint64, error) {
+	var st unix.Stat_t
+	if err := unix.Stat("/", &st); err != nil {
+		return 0, err
+	}
+	sizePath := fmt.Sprintf("/sys/dev/block/%d:%d/size", unix.Major(st.Dev), unix.Minor(st.Dev))
+	raw, err := os.ReadFile(sizePath)
+	if err != nil {
+		return 0, fmt.Errorf("read root device size: %w", err)
+	}
+	sectors, err := strconv.ParseUint(strings.TrimSpace(string(raw)), 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("parse %s: %w", sizePath, err)
+	}
+	var fs unix.Statfs_t
+	if err := unix.Statfs("/", &fs); err != nil {
+		return 0, err
+	}
+	if fs.Type != unix.EXT4_SUPER_MAGIC || fs.Bsize <= 0 {
+		return 0, fmt.Errorf("root is not ext4 (magic %#x)", fs.Type)
+	}
+	blocks := sectors * 512 / uint64(fs.Bsize)
+
+	root, err := os.Open("/")
+	if err != nil {
+		return 0, err
+	}
+	defer root.Close()
+	// The kernel returns at once when the filesystem already fills the drive.
+	if _, _, errno := unix.Syscall(unix.SYS_IOCTL, root.Fd(), ext4ResizeFS, uintptr(unsafe.Pointer(&blocks))); errno != 0 {
+		return 0, fmt.Errorf("resize to %d blocks: %w", blocks, errno)
+	}
+	return blocks, nil
+}
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"os"
+	"syscall"
+	"time"
+
+	"github.com/vishvananda/netlink"
+)
+
+const (
+	guestEnvArg  = "mergen.env"
+	guestEnvMMDS = "mmds"
+	mmdsAddress  = "169.254.169.254"
+	mmdsAttempts = 5
+)
+
+// loadGuestEnv returns the environment mergend passed for this VM, either
+// inline on the kernel command line or through the metadata service. It runs
+// after eth0 is up; failures are logged and leave the image env alone.
+func loadGuestEnv(logger *slog.Logger) map[string]string {
+	cmdline, err := os.ReadFile("/proc/cmdline")
+	if err != nil {
+		return nil
+	}
+	value := cmdlineValue(string(cmdline), guestEnvArg)
+	if value == "" {
+		return nil
+	}
+	var env map[string]string
+	if value == guestEnvMMDS {
+		env, err = fetchMMDSEnv("eth0")
+	} else {
+		env, err = decodeGuestEnv(value)
+	}
+	if err != nil {
+		logger.Warn("loading guest env failed", "mmds", value == guestEnvMMDS, "error", err)
+		return nil
+	}
+	logger.Info("guest env loaded", "vars", len(env))
+	return env
+}
+
+func decodeGuestEnv(value string) (map[string]string, error) {
+	raw, err := base64.RawURLEncoding.DecodeString(value)
+	if err != nil {
+		return nil, fmt.Errorf("decode %s: %w", guestEnvArg, err)
+	}
+	var env map[string]string
+	if err := json.Unmarshal(raw, &env); err != nil {
+		return nil, fmt.Errorf("parse %s: %w", guestEnvArg, err)
+	}
+	return env, nil
+}
+
+// fetchMMDSEnv reads mergen/env from the metadata service with the V2 token
+// flow. The kernel ip= setup has no route to the link-local MMDS address, so
+// one is added on iface first.
+func fetchMMDSEnv(iface string) (map[string]string, error) {
+	link, err := netlink.LinkByName(iface)
+	if err != nil {
+		return nil, err
+	}
+	route := &netlink.Route{
+		LinkIndex: link.Attrs().Index,
+		Dst:       &net.IPNet{IP: net.ParseIP(mmdsAddress).To4(), Mask: net.CIDRMask(32, 32)},
+		Scope:     netlink.SCOPE_LINK,
+	}
+	if err := netlink.RouteAdd(route); err != nil && !errors.Is(err, syscall.EEXIST) {
+		return nil, fmt.Errorf("add mmds route: %w", err)
+	}
+
+	client := &http.Client{Timeout: 2 * time.Second}
+	for attempt := 1; ; attempt++ {
+		env, err := getMMDSEnv(client)
+		if err == nil || attempt == mmdsAttempts {
+			return env, err
+		}
+		time.Sleep(time.Duration(attempt) * 200 * time.Millisecond)
+	}
+}
+
+func getMMDSEnv(client *http.Client) (map[string]string, error) {
+	req, _ := http.NewRequest(http.MethodPut, "http://"+mmdsAddress+"/latest/api/token", nil)
+	req.Header.Set("X-metadata-token-ttl-seconds", "60")
+	token, err := mmdsDo(client, req)
+	if err != nil {
+		return nil, fmt.Errorf("mmds token: %w", err)
+	}
+	req, _ = http.NewRequest(http.MethodGet, "http://"+mmdsAddress+"/mergen/env", nil)
+	req.Header.Set("X-metadata-token", string(token))
+	req.Header.Set("Accept", "application/json")
+	body, err := mmdsDo(client, req)
+	if err != nil {
+		return nil, fmt.Errorf("mmds mergen/env: %w", err)
+	}
+	var env map[string]string
+	if err := json.Unmarshal(body, &env); err != nil {
+		return nil, fmt.Errorf("parse mmds mergen/env: %w", err)
+	}
+	return env, nil
+}
+
+func mmdsDo(client *http.Client, req *http.Request) ([]byte, error) {
+	res, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+	body, err := io.ReadAll(io.LimitReader(res.Body, 1<<20))
+	if err != nil {
+		return nil, err
+	}
+	if res.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("status %d", res.StatusCode)
+	}
+	return body, nil
+}
@@ -0,0 +1,145 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"os"
+	"strings"
+
+	"golang.org/x/sys/unix"
+)
+
+// hardeningArg on the kernel command line turns on hardening options in
+// addition to the spec's hardening section, as a comma-separated list of
+// hardeningHidePID, hardeningSysRO and hardeningMinDev.
+const (
+	hardeningArg     = "mergen.hardening"
+	hardeningHidePID = "hidepid"
+	hardeningSysRO   = "sysro"
+	hardeningMinDev  = "mindev"
+)
+
+// hardening is the "hardening" section of image-meta.json ("Hardening" in
+// fly's run.json). It is applied after the spec's own mounts, so a minimal
+// /dev no longer needs the block devices they came from.
+type hardening struct {
+	// HidePID remounts /proc with hidepid=2: processes of other users are
+	// invisible to the workload.
+	HidePID bool `json:"hidePid"`
+	// ReadOnlySys remounts /sys read-only when the workload does not run
+	// as root; root could remount it back.
+	ReadOnlySys bool `json:"readOnlySys"`
+	// MinimalDev replaces the devtmpfs on /dev with a noexec tmpfs holding
+	// only the standard character devices, pts and a nodev, noexec shm.
+	MinimalDev bool `json:"minimalDev"`
+}
+
+// minimalDevNodes are the character devices a minimal /dev keeps.
+var minimalDevNodes = []struct {
+	name         string
+	mode         uint32
+	major, minor uint32
+}{
+	{"null", 0o666, 1, 3},
+	{"zero", 0o666, 1, 5},
+	{"full", 0o666, 1, 7},
+	{"random", 0o666, 1, 8},
+	{"urandom", 0o666, 1, 9},
+	{"tty", 0o666, 5, 0},
+	{"console", 0o600, 5, 1},
+}
+
+func (h *hardening) enabled() bool {
+	return h != nil && (h.HidePID || h.ReadOnlySys || h.MinimalDev)
+}
+
+// withCmdline returns h with the options named in cmdline's hardeningArg
+// added; unknown names are skipped.
+func (h *hardening) withCmdline(cmdline string) *hardening {
+	value := cmdlineValue(cmdline, hardeningArg)
+	if value == "" {
+		return h
+	}
+	out := hardening{}
+	if h != nil {
+		out = *h
+	}
+	for _, option := range strings.Split(value, ",") {
+		switch strings.TrimSpace(option) {
+		case hardeningHidePID:
+			out.HidePID = true
+		case hardeningSysRO:
+			out.ReadOnlySys = true
+		case hardeningMinDev:
+			out.MinimalDev = true
+		}
+	}
+	return &out
+}
+
+// applyHardening fails the boot rather than start a workload without a
+// protection the spec asked for.
+func applyHardening(h *hardening, userSpec string, logger *slog.Logger) error {
+	if !h.enabled() {
+		return nil
+	}
+	if h.HidePID {
+		if err := unix.Mount("proc", "/proc", "proc", uintptr(unix.MS_REMOUNT|unix.MS_NODEV|unix.MS_NOEXEC|unix.MS_NOSUID), "hidepid=2"); err != nil {
+			return fmt.Errorf("remount /proc with hidepid=2: %w", err)
+		}
+	}
+	if h.ReadOnlySys {
+		uid, _, _, err := resolveUser(userSpec)
+		if err != nil {
+			return err
+		}
+		if uid == 0 {
+			logger.Warn("workload runs as root, leaving /sys writable")
+		} else if err := unix.Mount("sysfs", "/sys", "sysfs", uintptr(unix.MS_REMOUNT|unix.MS_RDONLY|unix.MS_NODEV|unix.MS_NOEXEC|unix.MS_NOSUID), ""); err != nil {
+			return fmt.Errorf("remount /sys read-only: %w", err)
+		}
+	}
+	if h.MinimalDev {
+		if err := mountMinimalDev(); err != nil {
+			return err
+		}
+	}
+	logger.Info("hardening applied", "hidePid", h.HidePID, "readOnlySys", h.ReadOnlySys, "minimalDev", h.MinimalDev)
+	return nil
+}
+
+// mountMinimalDev mounts the new /dev over the devtmpfs rather than
+// unmounting it, since the workload's mounts may still hold its devices.
+func mountMinimalDev() error {
+	if err := unix.Mount("tmpfs", "/dev", "tmpfs", uintptr(unix.MS_NOSUID|unix.MS_NOEXEC), "mode=0755,size=64k"); err != nil {
+		return fmt.Errorf("mount minimal /dev: %w", err)
+	}
+	for _, node := range minimalDevNodes {
+		path := "/dev/" + node.name
+		if err := unix.Mknod(path, unix.S_IFCHR|node.mode, int(unix.Mkdev(node.major, node.minor))); err != nil {
+			return fmt.Errorf("create %s: %w", path, err)
+		}
+		// Mknod applies the umask.
+		if err := os.Chmod(path, os.FileMode(node.mode)); err != nil {
+			return fmt.Errorf("chmod %s: %w", path, err)
+		}
+	}
+	if err := os.MkdirAll("/dev/pts", 0o755); err != nil {
+		return fmt.Errorf("prepare /dev/pts: %w", err)
+	}
+	if err := unix.Mount("devpts", "/dev/pts", "devpts", uintptr(unix.MS_NOEXEC|unix.MS_NOSUID|unix.MS_NOATIME), "newinstance,mode=0620,gid=5,ptmxmode=666"); err != nil {
+		return fmt.Errorf("mount /dev/pts: %w", err)
+	}
+	if err := os.MkdirAll("/dev/shm", 0o1777); err != nil {
+		return fmt.Errorf("prepare /dev/shm: %w", err)
+	}
+	if err := unix.Mount("tmpfs", "/dev/shm", "tmpfs", uintptr(unix.MS_NOSUID|unix.MS_NODEV|unix.MS_NOEXEC), "mode=1777"); err != nil {
+		return fmt.Errorf("mount /dev/shm: %w", err)
+	}
+	_ = ensureSymlink("pts/ptmx", "/dev/ptmx")
+	_ = ensureSymlink("/proc/self/fd", "/dev/fd")
+	_ = ensureSymlink("/proc/self/fd/0", "/dev/stdin")
+	_ = ensureSymlink("/proc/self/fd/1", "/dev/stdout")
+	_ = ensureSymlink("/proc/self/fd/2", "/dev/stderr")
+	return nil
+}
@@ -0,0 +1,242 @@
+package main
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+
+	"golang.org/x/sys/unix"
+)
+
+// initOverrideArg on the kernel command line names a newer init binary to
+// run instead of this one, so init fixes reach existing images without
+// reconverting them. Its value is a path in the root filesystem, or
+// <device>:<path> for a path on an ext4 data disk, e.g.
+// mergen.init-override=/dev/vdb:/mergen/init. The binary needs a release
+// number in <path>.release, above initRelease, and an ed25519 signature over
+// both in <path>.sig by a key listed in initOverrideKeysPath of the image;
+// without them the image's own init carries on.
+const (
+	initOverrideArg      = "mergen.init-override"
+	initOverrideKeysPath = "/etc/mergen/init-override.pub"
+	// initRelease goes up with every init that may be shipped as an
+	// override, so a signed older one cannot be replayed.
+	initRelease = 1
+	// initOverrideEnv marks the re-executed init so it does not look for an
+	// override again.
+	initOverrideEnv   = "MERGEN_INIT_OVERRIDE"
+	initOverrideStage = "/dev/.mergen-init-override"
+	// maxInitOverrideSize bounds what is read into memory.
+	maxInitOverrideSize = 256 << 20
+)
+
+// reexecInitOverride replaces this process with the override binary when
+// one is requested and verified. It only returns when init carries on as
+// it is; a bad override is logged, never fatal, so a broken data disk
+// cannot keep the VM from booting.
+func reexecInitOverride(logger *slog.Logger) {
+	if source := os.Getenv(initOverrideEnv); source != "" {
+		_ = os.Unsetenv(initOverrideEnv)
+		logger.Info("running init override", "source", source)
+		return
+	}
+	if err := mountIfNeeded("proc", "/proc", "proc", uintptr(unix.MS_NODEV|unix.MS_NOEXEC|unix.MS_NOSUID), ""); err != nil {
+		logger.Warn("init override skipped: mount /proc failed", "error", err)
+		return
+	}
+	cmdline, err := os.ReadFile("/proc/cmdline")
+	if err != nil {
+		return
+	}
+	source := cmdlineValue(string(cmdline), initOverrideArg)
+	if source == "" {
+		return
+	}
+	override, err := readInitOverride(source)
+	if err != nil {
+		logger.Warn("init override skipped", "source", source, "error", err)
+		return
+	}
+	if current, err := os.ReadFile("/proc/self/exe"); err == nil && bytes.Equal(current, override.binary) {
+		logger.Info("init override matches the running init", "source", source)
+		return
+	}
+	keys, err := loadInitOverrideKeys(initOverrideKeysPath)
+	if err != nil {
+		logger.Warn("init override skipped", "source", source, "error", err)
+		return
+	}
+	if err := verifyInitOverride(override, keys, initRelease); err != nil {
+		logger.Error("init override rejected", "source", source, "release", override.release, "error", err)
+		return
+	}
+	binary := override.binary
+
+	fd, err := unix.MemfdCreate("mergen-init", unix.MFD_CLOEXEC)
+	if err != nil {
+		logger.Warn("init override skipped: memfd_create failed", "error", err)
+		return
+	}
+	memfd := os.NewFile(uintptr(fd), "mergen-init")
+	if _, err := memfd.Write(binary); err != nil {
+		_ = memfd.Close()
+		logger.Warn("init override skipped: write memfd failed", "error", err)
+		return
+	}
+	logger.Info("re-executing init override", "source", source, "release", override.release, "bytes", len(binary))
+	env := append(os.Environ(), initOverrideEnv+"="+source)
+	err = unix.Exec("/proc/self/fd/"+strconv.Itoa(fd), os.Args, env)
+	_ = memfd.Close()
+	logger.Error("init override exec failed, continuing with the image init", "source", source, "error", err)
+}
+
+type initOverride struct {
+	binary    []byte
+	signature []byte
+	release   uint64
+}
+
+// readInitOverride reads the binary, release and signature named by source,
+// mounting its device read-only for the duration when it has one.
+func readInitOverride(source string) (_ initOverride, err error) {
+	device, path, onDevice := strings.Cut(source, ":")
+	if !onDevice {
+		path = source
+	}
+	if !filepath.IsAbs(path) || (onDevice && !strings.HasPrefix(device, "/dev/")) {
+		return initOverride{}, fmt.Errorf("expected <path> or /dev/<device>:<path>, got %q", source)
+	}
+	root := "/"
+	if onDevice {
+		if err := mountIfNeeded("devtmpfs", "/dev", "devtmpfs", uintptr(unix.MS_NOSUID), "mode=0755"); err != nil {
+			return initOverride{}, fmt.Errorf("mount /dev: %w", err)
+		}
+		if err := os.MkdirAll(initOverrideStage, 0o700); err != nil {
+			return initOverride{}, err
+		}
+		defer os.Remove(initOverrideStage)
+		if err := unix.Mount(device, initOverrideStage, "ext4", uintptr(unix.MS_RDONLY|unix.MS_NOSUID|unix.MS_NODEV), ""); err != nil {
+			return initOverride{}, fmt.Errorf("mount %s: %w", device, err)
+		}
+		defer func() {
+			if unmountErr := unix.Unmount(initOverrideStage, 0); unmountErr != nil && err == nil {
+				err = fmt.Errorf("unmount %s: %w", device, unmountErr)
+			}
+		}()
+		root = initOverrideStage
+	}
+	binaryPath := filepath.Join(root, path)
+	var override initOverride
+	if override.binary, err = readLimited(binaryPath, maxInitOverrideSize); err != nil {
+		return initOverride{}, err
+	}
+	if override.signature, err = readLimited(binaryPath+".sig", 4096); err != nil {
+		return initOverride{}, fmt.Errorf("read signature: %w", err)
+	}
+	release, err := readLimited(binaryPath+".release", 64)
+	if err != nil {
+		return initOverride{}, fmt.Errorf("read release: %w", err)
+	}
+	if override.release, err = strconv.ParseUint(strings.TrimSpace(string(release)), 10, 64); err != nil {
+		return initOverride{}, fmt.Errorf("%s.release: expected a release number", binaryPath)
+	}
+	return override, nil
+}
+
+func readLimited(path string, limit int64) ([]byte, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+	if !info.Mode().IsRegular() || info.Size() > limit {
+		return nil, fmt.Errorf("%s is not a regular file of at most %d bytes", path, limit)
+	}
+	return os.ReadFile(path)
+}
+
+// loadInitOverrideKeys reads the trusted ed25519 public keys: PEM "PUBLIC
+// KEY" blocks as openssl writes them, or one base64 raw key per line.
+// Lines starting with # are comments.
+func loadInitOverrideKeys(path string) ([]ed25519.PublicKey, error) {
+	content, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, fmt.Errorf("image has no trusted keys in %s", path)
+	}
+	if err != nil {
+		return nil, err
+	}
+	var keys []ed25519.PublicKey
+	for rest := content; ; {
+		var block *pem.Block
+		block, rest = pem.Decode(rest)
+		if block == nil {
+			break
+		}
+		parsed, err := x509.ParsePKIXPublicKey(block.Bytes)
+		if err != nil {
+			return nil, fmt.Errorf("parse %s: %w", path, err)
+		}
+		key, ok := parsed.(ed25519.PublicKey)
+		if !ok {
+			return nil, fmt.Errorf("%s: only ed25519 keys are supported", path)
+		}
+		keys = append(keys, key)
+	}
+	if len(keys) > 0 {
+		return keys, nil
+	}
+	for _, line := range strings.Split(string(content), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		raw, err := base64.StdEncoding.DecodeString(line)
+		if err != nil || len(raw) != ed25519.PublicKeySize {
+			return nil, fmt.Errorf("%s: expected base64 ed25519 public keys", path)
+		}
+		keys = append(keys, ed25519.PublicKey(raw))
+	}
+	if len(keys) == 0 {
+		return nil, fmt.Errorf("%s lists no keys", path)
+	}
+	return keys, nil
+}
+
+// verifyInitOverride checks the override's signature against keys and that
+// it is newer than running. The signature covers initOverrideMessage and is
+// raw, as openssl pkeyutl -sign -rawin writes it, or base64.
+func verifyInitOverride(override initOverride, keys []ed25519.PublicKey, running uint64) error {
+	signature := override.signature
+	if len(signature) != ed25519.SignatureSize {
+		decoded, err := base64.StdEncoding.DecodeString(strings.TrimSpace(string(signature)))
+		if err != nil || len(decoded) != ed25519.SignatureSize {
+			return errors.New("signature is neither a raw nor a base64 ed25519 signature")
+		}
+		signature = decoded
+	}
+	message := initOverrideMessage(override.release, override.binary)
+	if !slices.ContainsFunc(keys, func(key ed25519.PublicKey) bool { return ed25519.Verify(key, message, signature) }) {
+		return errors.New("signature does not match any trusted key")
+	}
+	if override.release <= running {
+		return fmt.Errorf("release %d is not newer than the running init's %d", override.release, running)
+	}
+	return nil
+}
+
+// initOverrideMessage is what an override's signature covers: a header line
+// with its release, then the binary.
+func initOverrideMessage(release uint64, binary []byte) []byte {
+	header := fmt.Sprintf("mergen-init-override %d\n", release)
+	return append([]byte(header), binary...)
+}
@@ -26,6 +26,9 @@ const (
 )
 
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == coreDumpCommand {
+		os.Exit(handleCoreDump(os.Args[2:]))
+	}
 	logger := newLogger()
 	if os.Getpid() != 1 {
 		logger.Warn("mergen-init-snapshot is expected to run as PID 1", "pid", os.Getpid())
@@ -40,9 +43,15 @@ func main() {
 }
 
 func run(logger *slog.Logger) (int, error) {
+	reexecInitOverride(logger)
+	if err := setupOverlayRoot(logger); err != nil {
+		return 1, err
+	}
 	if err := setupBaseMounts(logger); err != nil {
 		return 1, err
 	}
+	growRootIfRequested(logger)
+	mountShares(logger)
 
 	spec, source, err := loadStartSpec()
 	if err != nil {
@@ -53,6 +62,20 @@ func run(logger *slog.Logger) (int, error) {
 	if err := applyRuntimeSetup(spec, logger); err != nil {
 		return 1, err
 	}
+	cmdline, _ := os.ReadFile("/proc/cmdline")
+	// Before hardening: a minimal /dev no longer has the dump device.
+	setupCoreDumps(spec.CoreDump.withCmdline(string(cmdline)), logger)
+	if err := applyHardening(spec.Hardening.withCmdline(string(cmdline)), spec.User, logger); err != nil {
+		return 1, err
+	}
+	if guestEnv := loadGuestEnv(logger); len(guestEnv) > 0 {
+		if spec.Env == nil {
+			spec.Env = make(map[string]string, len(guestEnv))
+		}
+		for k, v := range guestEnv {
+			spec.Env[k] = v
+		}
+	}
 
 	code, err := runAndSupervise(spec, logger)
 	if err != nil {
@@ -75,13 +98,16 @@ func newLogger() *slog.Logger {
 }
 
 type imageMeta struct {
-	Image      string   `json:"image"`
-	Entrypoint []string `json:"entrypoint"`
-	Cmd        []string `json:"cmd"`
-	StartCmd   []string `json:"startCmd"`
-	Env        []string `json:"env"`
-	WorkingDir string   `json:"workingDir"`
-	User       string   `json:"user"`
+	Image      string        `json:"image"`
+	Entrypoint []string      `json:"entrypoint"`
+	Cmd        []string      `json:"cmd"`
+	StartCmd   []string      `json:"startCmd"`
+	Env        []string      `json:"env"`
+	WorkingDir string        `json:"workingDir"`
+	User       string        `json:"user"`
+	Resolv     *flyEtcResolv `json:"resolv,omitempty"`
+	Hardening  *hardening    `json:"hardening,omitempty"`
+	CoreDump   *coreDump     `json:"coreDump,omitempty"`
 }
 
 type flyRunConfig struct {
@@ -97,6 +123,8 @@ type flyRunConfig struct {
 	EtcResolv    *flyEtcResolv     `json:"EtcResolv"`
 	EtcHosts     []flyEtcHost      `json:"EtcHosts"`
 	RootDevice   string            `json:"RootDevice"`
+	Hardening    *hardening        `json:"Hardening"`
+	CoreDump     *coreDump         `json:"CoreDump"`
 }
 
 type flyImageConfig struct {
@@ -126,6 +154,8 @@ type flyEtcHost struct {
 
 type flyEtcResolv struct {
 	Nameservers []string `json:"Nameservers"`
+	Search      []string `json:"Search"`
+	Options     []string `json:"Options"`
 }
 
 type startSpec struct {
@@ -138,6 +168,8 @@ type startSpec struct {
 	Mounts     []flyMount
 	EtcHosts   []flyEtcHost
 	EtcResolv  *flyEtcResolv
+	Hardening  *hardening
+	CoreDump   *coreDump
 }
 
 func loadStartSpec() (startSpec, string, error) {
@@ -204,6 +236,9 @@ func buildSpecFromMeta(meta imageMeta) startSpec {
 		Env:        parseEnvList(meta.Env),
 		User:       userSpec,
 		WorkingDir: strings.TrimSpace(meta.WorkingDir),
+		EtcResolv:  cloneEtcResolv(meta.Resolv),
+		Hardening:  meta.Hardening,
+		CoreDump:   meta.CoreDump,
 	}
 }
 
@@ -249,6 +284,8 @@ func buildSpecFromFlyConfig(cfg flyRunConfig) startSpec {
 		Mounts:     cloneMounts(cfg.Mounts),
 		EtcHosts:   cloneEtcHosts(cfg.EtcHosts),
 		EtcResolv:  cloneEtcResolv(cfg.EtcResolv),
+		Hardening:  cfg.Hardening,
+		CoreDump:   cfg.CoreDump,
 	}
 }
 
@@ -283,16 +320,7 @@ func resolveMetaPath(defaultPath string) string {
 }
 
 func metadataPathFromCmdline(cmdline string) string {
-	for _, field := range strings.Fields(cmdline) {
-		if !strings.HasPrefix(field, "mergen.meta=") {
-			continue
-		}
-		value := strings.TrimSpace(strings.TrimPrefix(field, "mergen.meta="))
-		if value != "" {
-			return value
-		}
-	}
-	return ""
+	return cmdlineValue(cmdline, "mergen.meta")
 }
 
 func applyRuntimeSetup(spec startSpec, logger *slog.Logger) error {
@@ -305,22 +333,15 @@ func applyRuntimeSetup(spec startSpec, logger *slog.Logger) error {
 		}
 	}
 
-	if spec.EtcResolv != nil && len(spec.EtcResolv.Nameservers) > 0 {
+	if spec.EtcResolv != nil {
 		if err := os.MkdirAll("/etc", 0o755); err != nil {
 			return fmt.Errorf("prepare /etc for resolv.conf: %w", err)
 		}
-		var b strings.Builder
-		for _, ns := range spec.EtcResolv.Nameservers {
-			ns = strings.TrimSpace(ns)
-			if ns == "" {
-				continue
-			}
-			b.WriteString("nameserver ")
-			b.WriteString(ns)
-			b.WriteString("\n")
-		}
-		if b.Len() > 0 {
-			if err := os.WriteFile("/etc/resolv.conf", []byte(b.String()), 0o644); err != nil {
+		existing, _ := os.ReadFile("/etc/resolv.conf")
+		if content := renderResolvConf(string(existing), spec.EtcResolv); content != "" {
+			// Images often ship resolv.conf as a symlink into /run.
+			_ = os.Remove("/etc/resolv.conf")
+			if err := os.WriteFile("/etc/resolv.conf", []byte(content), 0o644); err != nil {
 				return fmt.Errorf("write /etc/resolv.conf: %w", err)
 			}
 		}
@@ -587,6 +608,9 @@ func runAndSupervise(spec startSpec, logger *slog.Logger) (int, error) {
 
 	mainPID := cmd.Process.Pid
 	logger.Info("started main process", "pid", mainPID, "argv", strings.Join(startedArgv, " "))
+	// The workload runs in its own process group, led by mainPID.
+	go reportStats(mainPID, logger)
+	go serveExec(spec, logger)
 
 	sigCh := make(chan os.Signal, 64)
 	signal.Notify(
@@ -867,6 +891,9 @@ func reapChildren(mainPID int, logger *slog.Logger) (bool, int, error) {
 		if pid == mainPID {
 			return true, exitCode, nil
 		}
+		if guestExecs.exited(pid, exitCode) {
+			continue
+		}
 		logger.Debug("reaped child", "pid", pid, "exitCode", exitCode)
 	}
 }
@@ -927,7 +954,9 @@ func cloneEtcResolv(in *flyEtcResolv) *flyEtcResolv {
 	if in == nil {
 		return nil
 	}
-	out := &flyEtcResolv{Nameservers: make([]string, len(in.Nameservers))}
-	copy(out.Nameservers, in.Nameservers)
-	return out
+	return &flyEtcResolv{
+		Nameservers: cloneSlice(in.Nameservers),
+		Search:      cloneSlice(in.Search),
+		Options:     cloneSlice(in.Options),
+	}
 }
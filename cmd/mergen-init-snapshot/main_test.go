@@ -1,6 +1,23 @@
 package main
 
-import "testing"
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
 
 func TestMetadataPathFromCmdline(t *testing.T) {
 	cmdline := "console=ttyS0 root=/dev/vdb mergen.meta=/etc/mergen/image-meta.json panic=1"
@@ -10,6 +27,30 @@ func TestMetadataPathFromCmdline(t *testing.T) {
 	}
 }
 
+func TestCmdlineValueOverlay(t *testing.T) {
+	cmdline := "console=ttyS0 root=/dev/vda ro mergen.overlay=/dev/vdb mergen.overlay= panic=1"
+	if got := cmdlineValue(cmdline, overlayArg); got != "/dev/vdb" {
+		t.Fatalf("cmdlineValue(overlay) = %q, want /dev/vdb", got)
+	}
+	if got := cmdlineValue("console=ttyS0 mergen.overlayfs=x", overlayArg); got != "" {
+		t.Fatalf("cmdlineValue() matched a longer key: %q", got)
+	}
+}
+
+func TestDecodeGuestEnv(t *testing.T) {
+	// base64url of {"GREETING":"hello world","EMPTY":""}
+	env, err := decodeGuestEnv("eyJHUkVFVElORyI6ImhlbGxvIHdvcmxkIiwiRU1QVFkiOiIifQ")
+	if err != nil {
+		t.Fatalf("decodeGuestEnv() error = %v", err)
+	}
+	if env["GREETING"] != "hello world" || len(env) != 2 {
+		t.Fatalf("unexpected env: %#v", env)
+	}
+	if _, err := decodeGuestEnv("not base64!"); err == nil {
+		t.Fatalf("decodeGuestEnv() accepted an invalid value")
+	}
+}
+
 func TestParseEnvList(t *testing.T) {
 	env := parseEnvList([]string{"A=1", "B=", "INVALID", " =x", "C=hello=world"})
 	if env["A"] != "1" {
@@ -79,3 +120,267 @@ func TestShellQuoteEscapesSingleQuote(t *testing.T) {
 		t.Fatalf("shellQuote mismatch: got %q want %q", got, want)
 	}
 }
+
+func TestHardeningWithCmdline(t *testing.T) {
+	var spec *hardening
+	if spec.enabled() || spec.withCmdline("console=ttyS0") != nil {
+		t.Fatalf("nil hardening without the boot arg should stay off")
+	}
+	got := (&hardening{HidePID: true}).withCmdline("console=ttyS0 mergen.hardening=sysro,mindev,bogus panic=1")
+	if !got.HidePID || !got.ReadOnlySys || !got.MinimalDev || !got.enabled() {
+		t.Fatalf("withCmdline() = %+v, want all options on", got)
+	}
+}
+
+func TestCoreDumpWithCmdline(t *testing.T) {
+	got := (&coreDump{MaxFiles: 3}).withCmdline("console=ttyS0 mergen.coredump=device=/dev/vdb,maxSizeMiB=64 panic=1").normalized()
+	want := coreDump{Enabled: true, Dir: coreDumpDefaultDir, Device: "/dev/vdb", MaxSizeMiB: 64, MaxFiles: 3}
+	if got != want {
+		t.Fatalf("withCmdline() = %+v, want %+v", got, want)
+	}
+	var off *coreDump
+	if off.withCmdline("console=ttyS0") != nil {
+		t.Fatalf("withCmdline() enabled capture without the boot arg")
+	}
+}
+
+func TestWriteCoreDumpTruncatesAndPrunes(t *testing.T) {
+	dir := t.TempDir()
+	cfg := coreDump{Dir: dir, MaxSizeMiB: 1, MaxFiles: 2}
+	big := strings.NewReader(strings.Repeat("x", 1<<20+10))
+	if err := writeCoreDump(cfg, "core.app.1.100.sig11", big); err != nil {
+		t.Fatalf("writeCoreDump() error = %v", err)
+	}
+	info, err := os.Stat(filepath.Join(dir, "core.app.1.100.sig11.truncated"))
+	if err != nil || info.Size() != 1<<20 {
+		t.Fatalf("truncated dump = %v, %v; want 1 MiB", info, err)
+	}
+	for _, name := range []string{"core.app.2.200.sig6", "core.app.3.300.sig6"} {
+		// Keep modification times apart on coarse filesystem clocks.
+		time.Sleep(20 * time.Millisecond)
+		if err := writeCoreDump(cfg, name, strings.NewReader("core")); err != nil {
+			t.Fatalf("writeCoreDump() error = %v", err)
+		}
+	}
+	pruneCoreDumps(dir, cfg.MaxFiles)
+	entries, _ := os.ReadDir(dir)
+	if len(entries) != 2 || entries[0].Name() != "core.app.2.200.sig6" {
+		t.Fatalf("dumps after prune = %v, want the two newest", entries)
+	}
+}
+
+func TestRenderResolvConf(t *testing.T) {
+	existing := "# generated by the image\nnameserver 10.0.0.2\nsearch corp.example\noptions edns0\n"
+	got := renderResolvConf(existing, &flyEtcResolv{
+		Search:  []string{"default.svc.cluster.local", "svc.cluster.local", " "},
+		Options: []string{"ndots:5", "timeout:2", "attempts:3"},
+	})
+	want := "# generated by the image\nnameserver 10.0.0.2\n" +
+		"search default.svc.cluster.local svc.cluster.local\noptions ndots:5 timeout:2 attempts:3\n"
+	if got != want {
+		t.Fatalf("renderResolvConf() = %q, want %q", got, want)
+	}
+	got = renderResolvConf(existing, &flyEtcResolv{Nameservers: []string{"1.1.1.1"}})
+	if want := "# generated by the image\nsearch corp.example\noptions edns0\nnameserver 1.1.1.1\n"; got != want {
+		t.Fatalf("renderResolvConf() = %q, want %q", got, want)
+	}
+	if got := renderResolvConf(existing, &flyEtcResolv{}); got != "" {
+		t.Fatalf("renderResolvConf() with nothing set = %q, want empty", got)
+	}
+}
+
+func TestParseShares(t *testing.T) {
+	got := parseShares("src:/workspace,cache:/var/cache/app/:ro,bad,:/x,rel:data")
+	want := []share{
+		{tag: "src", path: "/workspace"},
+		{tag: "cache", path: "/var/cache/app", readOnly: true},
+	}
+	if len(got) != len(want) {
+		t.Fatalf("parseShares() = %+v, want %+v", got, want)
+	}
+	for idx := range want {
+		if got[idx] != want[idx] {
+			t.Fatalf("parseShares() = %+v, want %+v", got, want)
+		}
+	}
+	if got := parseShares(""); len(got) != 0 {
+		t.Fatalf("parseShares(\"\") = %+v, want none", got)
+	}
+}
+
+func TestInitOverrideVerification(t *testing.T) {
+	dir := t.TempDir()
+	public, private, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatalf("generate key: %v", err)
+	}
+	der, err := x509.MarshalPKIXPublicKey(public)
+	if err != nil {
+		t.Fatalf("marshal key: %v", err)
+	}
+	pemKeys := filepath.Join(dir, "pem.pub")
+	if err := os.WriteFile(pemKeys, pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der}), 0o644); err != nil {
+		t.Fatalf("write pem keys: %v", err)
+	}
+	otherPublic, _, _ := ed25519.GenerateKey(rand.Reader)
+	rawKeys := filepath.Join(dir, "raw.pub")
+	content := "# rotation: old key first\n" + base64.StdEncoding.EncodeToString(otherPublic) + "\n" + base64.StdEncoding.EncodeToString(public) + "\n"
+	if err := os.WriteFile(rawKeys, []byte(content), 0o644); err != nil {
+		t.Fatalf("write raw keys: %v", err)
+	}
+
+	binary := filepath.Join(dir, "init")
+	if err := os.WriteFile(binary, []byte("new init"), 0o755); err != nil {
+		t.Fatalf("write binary: %v", err)
+	}
+	if err := os.WriteFile(binary+".release", []byte("7\n"), 0o644); err != nil {
+		t.Fatalf("write release: %v", err)
+	}
+	signature := ed25519.Sign(private, initOverrideMessage(7, []byte("new init")))
+	if err := os.WriteFile(binary+".sig", signature, 0o644); err != nil {
+		t.Fatalf("write signature: %v", err)
+	}
+	override, err := readInitOverride(binary)
+	if err != nil || string(override.binary) != "new init" || override.release != 7 {
+		t.Fatalf("readInitOverride() = %q release %d, %v", override.binary, override.release, err)
+	}
+
+	for _, keysPath := range []string{pemKeys, rawKeys} {
+		keys, err := loadInitOverrideKeys(keysPath)
+		if err != nil {
+			t.Fatalf("loadInitOverrideKeys(%s) error = %v", keysPath, err)
+		}
+		if err := verifyInitOverride(override, keys, 6); err != nil {
+			t.Fatalf("raw signature with %s rejected: %v", keysPath, err)
+		}
+		encoded := override
+		encoded.signature = []byte(base64.StdEncoding.EncodeToString(signature) + "\n")
+		if err := verifyInitOverride(encoded, keys, 6); err != nil {
+			t.Fatalf("base64 signature with %s rejected: %v", keysPath, err)
+		}
+		tampered := override
+		tampered.binary = []byte("tampered")
+		if err := verifyInitOverride(tampered, keys, 6); err == nil {
+			t.Fatalf("tampered binary accepted with %s", keysPath)
+		}
+	}
+	keys, _ := loadInitOverrideKeys(pemKeys)
+	for _, running := range []uint64{7, 8} {
+		if err := verifyInitOverride(override, keys, running); err == nil || !strings.Contains(err.Error(), "not newer") {
+			t.Fatalf("release 7 over running release %d: error = %v, want downgrade refused", running, err)
+		}
+	}
+	bumped := override
+	bumped.release = 9
+	if err := verifyInitOverride(bumped, keys, 8); err == nil || !strings.Contains(err.Error(), "does not match") {
+		t.Fatalf("release raised without re-signing: error = %v, want signature mismatch", err)
+	}
+	if err := os.WriteFile(binary+".release", []byte("seven"), 0o644); err != nil {
+		t.Fatalf("write release: %v", err)
+	}
+	if _, err := readInitOverride(binary); err == nil {
+		t.Fatalf("malformed release accepted")
+	}
+	if _, err := loadInitOverrideKeys(filepath.Join(dir, "missing.pub")); err == nil {
+		t.Fatalf("missing key file accepted")
+	}
+	if _, err := readInitOverride("relative/init"); err == nil {
+		t.Fatalf("relative override path accepted")
+	}
+	if _, err := readInitOverride("vdb:/mergen/init"); err == nil {
+		t.Fatalf("override device outside /dev accepted")
+	}
+}
+
+func TestSampleGuest(t *testing.T) {
+	root := t.TempDir()
+	write := func(name, content string) {
+		t.Helper()
+		path := filepath.Join(root, name)
+		if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte(content), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	write("loadavg", "0.50 0.25 0.10 2/80 120\n")
+	write("uptime", "42.17 80.00\n")
+	write("meminfo", "MemTotal:         509000 kB\nMemFree:          100000 kB\nMemAvailable:     300000 kB\n")
+	stat := func(pid, comm string, pgid, rss int) string {
+		return fmt.Sprintf("%s (%s) S 1 %d %d 0 -1 4194560 100 0 0 0 1 2 0 0 20 0 1 0 50 1000000 %d 18446744073709551615\n", pid, comm, pgid, pgid, rss)
+	}
+	write("1/stat", stat("1", "init", 0, 500))
+	write("10/stat", stat("10", "my (app) worker", 10, 1000))
+	write("11/stat", stat("11", "sh", 10, 24))
+	write("self/stat", stat("1", "init", 0, 500))
+
+	sample, err := sampleGuest(root, 10)
+	if err != nil {
+		t.Fatalf("sampleGuest: %v", err)
+	}
+	pageKiB := int64(os.Getpagesize() / 1024)
+	if sample.Load != [3]float64{0.5, 0.25, 0.1} || sample.UptimeSeconds != 42.17 {
+		t.Fatalf("unexpected load or uptime: %+v", sample)
+	}
+	if sample.MemTotalKiB != 509000 || sample.MemAvailableKiB != 300000 {
+		t.Fatalf("unexpected memory: %+v", sample)
+	}
+	if sample.Processes != 3 || sample.WorkloadRSSKiB != 1024*pageKiB {
+		t.Fatalf("unexpected processes or rss: %+v", sample)
+	}
+}
+
+func TestRunExec(t *testing.T) {
+	// Stand in for the init's reaper, which hands exit codes to the agent.
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		for {
+			select {
+			case <-done:
+				return
+			case <-time.After(5 * time.Millisecond):
+				_, _, _ = reapChildren(-1, slog.New(slog.DiscardHandler))
+			}
+		}
+	}()
+	spec := startSpec{Env: map[string]string{"GREETING": "hello"}, WorkingDir: t.TempDir()}
+
+	resp := runExec(execRequest{
+		Argv:  []string{"/bin/sh", "-c", `read name; echo "$GREETING $name from $(pwd)"; echo oops >&2; exit 3`},
+		Stdin: "guest\n",
+	}, spec, guestExecs)
+	if resp.Error != "" || resp.ExitCode != 3 || resp.TimedOut {
+		t.Fatalf("unexpected result: %+v", resp)
+	}
+	if want := "hello guest from " + spec.WorkingDir + "\n"; resp.Stdout != want || resp.Stderr != "oops\n" {
+		t.Fatalf("stdout %q stderr %q, want %q and oops", resp.Stdout, resp.Stderr, want)
+	}
+
+	resp = runExec(execRequest{Argv: []string{"/bin/sh", "-c", "head -c 2000000 /dev/zero; sleep 30"}, TimeoutMs: 200}, spec, guestExecs)
+	if !resp.TimedOut || !resp.Truncated || resp.ExitCode != 128+int(syscall.SIGKILL) || len(resp.Stdout) != maxExecOutput {
+		t.Fatalf("expected a truncated, killed command, got exit %d timedOut %v truncated %v stdout %d bytes", resp.ExitCode, resp.TimedOut, resp.Truncated, len(resp.Stdout))
+	}
+
+	if resp := runExec(execRequest{Argv: []string{"/does/not/exist"}}, spec, guestExecs); resp.Error == "" {
+		t.Fatalf("expected a missing command to fail to start, got %+v", resp)
+	}
+
+	// An empty argv reaches the agent's connection handler, which runs in
+	// PID 1 and must answer rather than panic.
+	fds, err := unix.Socketpair(unix.AF_UNIX, unix.SOCK_STREAM|unix.SOCK_CLOEXEC, 0)
+	if err != nil {
+		t.Fatalf("socketpair: %v", err)
+	}
+	client := os.NewFile(uintptr(fds[0]), "client")
+	defer client.Close()
+	if _, err := client.WriteString(`{"argv":[]}` + "\n"); err != nil {
+		t.Fatalf("send request: %v", err)
+	}
+	handleExec(os.NewFile(uintptr(fds[1]), "agent"), spec, slog.New(slog.DiscardHandler))
+	var reply execResponse
+	if err := json.NewDecoder(client).Decode(&reply); err != nil || reply.Error != "argv is empty" {
+		t.Fatalf("empty argv: reply %+v, %v", reply, err)
+	}
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"os"
+	"strings"
+
+	"golang.org/x/sys/unix"
+)
+
+// overlayArg on the kernel command line turns a read-only root into a
+// writable one: an overlayfs with the root as lower layer becomes the new
+// root before anything else is mounted. Its value is the block device whose
+// upper/ and work/ directories keep the writes (mergend passes the data disk,
+// /dev/vdb), or "tmpfs" to keep them in memory until the VM stops.
+const (
+	overlayArg   = "mergen.overlay"
+	overlayTmpfs = "tmpfs"
+	overlayStage = "/run/mergen-overlay"
+)
+
+func setupOverlayRoot(logger *slog.Logger) error {
+	if err := mountIfNeeded("proc", "/proc", "proc", uintptr(unix.MS_NODEV|unix.MS_NOEXEC|unix.MS_NOSUID), ""); err != nil {
+		return fmt.Errorf("mount /proc: %w", err)
+	}
+	cmdline, err := os.ReadFile("/proc/cmdline")
+	if err != nil {
+		return fmt.Errorf("read /proc/cmdline: %w", err)
+	}
+	device := cmdlineValue(string(cmdline), overlayArg)
+	if device == "" {
+		return nil
+	}
+
+	if err := mountIfNeeded("devtmpfs", "/dev", "devtmpfs", uintptr(unix.MS_NOSUID), "mode=0755"); err != nil {
+		return fmt.Errorf("mount /dev: %w", err)
+	}
+	// The root is read-only, so the overlay is assembled on a tmpfs.
+	if err := mountIfNeeded("tmpfs", "/run", "tmpfs", uintptr(unix.MS_NOSUID|unix.MS_NODEV), "mode=0755"); err != nil {
+		return fmt.Errorf("mount /run: %w", err)
+	}
+	layers := overlayStage + "/layers"
+	newRoot := overlayStage + "/root"
+	for _, dir := range []string{layers, newRoot} {
+		if err := os.MkdirAll(dir, 0o755); err != nil {
+			return fmt.Errorf("prepare %s: %w", dir, err)
+		}
+	}
+	if device != overlayTmpfs {
+		if err := unix.Mount(device, layers, "ext4", uintptr(unix.MS_RELATIME), ""); err != nil {
+			return fmt.Errorf("mount overlay device %s: %w", device, err)
+		}
+	}
+	upper, work := layers+"/upper", layers+"/work"
+	if err := os.MkdirAll(upper, 0o755); err != nil {
+		return fmt.Errorf("prepare %s: %w", upper, err)
+	}
+	if err := os.MkdirAll(work, 0o700); err != nil {
+		return fmt.Errorf("prepare %s: %w", work, err)
+	}
+	options := fmt.Sprintf("lowerdir=/,upperdir=%s,workdir=%s", upper, work)
+	if err := unix.Mount("overlay", newRoot, "overlay", 0, options); err != nil {
+		return fmt.Errorf("mount overlay root: %w", err)
+	}
+
+	for _, mount := range []string{"/dev", "/proc"} {
+		if err := unix.Mount(mount, newRoot+mount, "", unix.MS_MOVE, ""); err != nil {
+			return fmt.Errorf("move %s into overlay root: %w", mount, err)
+		}
+	}
+	// Same switch as switch_root(8): move the new root over / and chroot
+	// into it. The staging tmpfs stays mounted underneath.
+	if err := os.Chdir(newRoot); err != nil {
+		return err
+	}
+	if err := unix.Mount(newRoot, "/", "", unix.MS_MOVE, ""); err != nil {
+		return fmt.Errorf("move overlay root to /: %w", err)
+	}
+	if err := unix.Chroot("."); err != nil {
+		return fmt.Errorf("chroot into overlay root: %w", err)
+	}
+	if err := os.Chdir("/"); err != nil {
+		return err
+	}
+	logger.Info("overlay root mounted", "device", device)
+	return nil
+}
+
+func cmdlineValue(cmdline, key string) string {
+	for _, field := range strings.Fields(cmdline) {
+		value, ok := strings.CutPrefix(field, key+"=")
+		if ok && strings.TrimSpace(value) != "" {
+			return strings.TrimSpace(value)
+		}
+	}
+	return ""
+}
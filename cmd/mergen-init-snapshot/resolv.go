@@ -0,0 +1,78 @@
+package main
+
+import (
+	"strings"
+)
+
+// renderResolvConf merges r into the image's existing resolv.conf: each of
+// nameservers, search domains and options that r sets replaces the
+// existing lines of that kind, and the rest are kept. Options are resolver
+// options in resolv.conf form, such as "ndots:5", "timeout:2" or
+// "attempts:3". It returns "" when r sets nothing.
+func renderResolvConf(existing string, r *flyEtcResolv) string {
+	if r == nil {
+		return ""
+	}
+	nameservers := resolvFields(r.Nameservers)
+	search := resolvFields(r.Search)
+	options := resolvFields(r.Options)
+	if len(nameservers) == 0 && len(search) == 0 && len(options) == 0 {
+		return ""
+	}
+
+	var kept []string
+	for _, line := range strings.Split(existing, "\n") {
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			continue
+		}
+		switch fields[0] {
+		case "nameserver":
+			if len(nameservers) == 0 {
+				kept = append(kept, line)
+			}
+		case "search", "domain":
+			// The last of search and domain wins, so a new search list
+			// drops both.
+			if len(search) == 0 {
+				kept = append(kept, line)
+			}
+		case "options":
+			if len(options) == 0 {
+				kept = append(kept, line)
+			}
+		default:
+			kept = append(kept, line)
+		}
+	}
+
+	var b strings.Builder
+	for _, line := range kept {
+		b.WriteString(line)
+		b.WriteString("\n")
+	}
+	for _, ns := range nameservers {
+		b.WriteString("nameserver " + ns + "\n")
+	}
+	if len(search) > 0 {
+		b.WriteString("search " + strings.Join(search, " ") + "\n")
+	}
+	if len(options) > 0 {
+		b.WriteString("options " + strings.Join(options, " ") + "\n")
+	}
+	return b.String()
+}
+
+// resolvFields drops empty entries and any with whitespace, which would
+// split into several resolv.conf tokens.
+func resolvFields(in []string) []string {
+	out := make([]string, 0, len(in))
+	for _, value := range in {
+		value = strings.TrimSpace(value)
+		if value == "" || strings.ContainsAny(value, " \t\n") {
+			continue
+		}
+		out = append(out, value)
+	}
+	return out
+}
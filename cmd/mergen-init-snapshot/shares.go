@@ -0,0 +1,64 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"os"
+	"path"
+	"strings"
+
+	"golang.org/x/sys/unix"
+)
+
+// sharesArg lists the virtio-fs shares mergend attached, as
+// tag:/guest/path[:ro] entries separated by commas.
+const sharesArg = "mergen.shares"
+
+type share struct {
+	tag      string
+	path     string
+	readOnly bool
+}
+
+// mountShares mounts every share at its guest path. A share that fails to
+// mount is logged and skipped, so the workload still starts.
+func mountShares(logger *slog.Logger) {
+	cmdline, err := os.ReadFile("/proc/cmdline")
+	if err != nil {
+		return
+	}
+	for _, sh := range parseShares(cmdlineValue(string(cmdline), sharesArg)) {
+		if err := mountShare(sh); err != nil {
+			logger.Warn("mounting shared dir failed", "tag", sh.tag, "path", sh.path, "error", err)
+			continue
+		}
+		logger.Info("shared dir mounted", "tag", sh.tag, "path", sh.path, "readOnly", sh.readOnly)
+	}
+}
+
+func parseShares(value string) []share {
+	var shares []share
+	for _, entry := range strings.Split(value, ",") {
+		fields := strings.Split(entry, ":")
+		if len(fields) < 2 || fields[0] == "" || !path.IsAbs(fields[1]) {
+			continue
+		}
+		sh := share{tag: fields[0], path: path.Clean(fields[1])}
+		if len(fields) > 2 && fields[2] == "ro" {
+			sh.readOnly = true
+		}
+		shares = append(shares, sh)
+	}
+	return shares
+}
+
+func mountShare(sh share) error {
+	if err := os.MkdirAll(sh.path, 0o755); err != nil {
+		return fmt.Errorf("prepare mount path: %w", err)
+	}
+	flags := uintptr(unix.MS_RELATIME)
+	if sh.readOnly {
+		flags |= unix.MS_RDONLY
+	}
+	return mountIfNeeded(sh.tag, sh.path, "virtiofs", flags, "")
+}
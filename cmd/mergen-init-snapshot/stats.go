@@ -0,0 +1,186 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+// statsArg sets how often the init samples the guest, in seconds, e.g.
+// mergen.stats=30; 0 turns sampling off.
+const (
+	statsArg             = "mergen.stats"
+	statsPort            = 1027
+	defaultStatsInterval = 15 * time.Second
+)
+
+// statsSample is one reading sent to mergend, as a JSON line with short
+// keys since it goes out every few seconds for the VM's whole life.
+type statsSample struct {
+	Load            [3]float64 `json:"l"`
+	MemTotalKiB     int64      `json:"mt"`
+	MemAvailableKiB int64      `json:"ma"`
+	WorkloadRSSKiB  int64      `json:"rss"`
+	Processes       int        `json:"p"`
+	UptimeSeconds   float64    `json:"up"`
+}
+
+// reportStats samples /proc each interval and sends the samples to the host
+// over vsock, for VMs whose image has no agent of its own. Without a vsock
+// device or a listener on the host samples are dropped; the connection is
+// retried with the next one.
+func reportStats(workloadPGID int, logger *slog.Logger) {
+	cmdline, _ := os.ReadFile("/proc/cmdline")
+	interval := defaultStatsInterval
+	if value := cmdlineValue(string(cmdline), statsArg); value != "" {
+		seconds, err := strconv.Atoi(value)
+		if err != nil || seconds < 0 {
+			logger.Warn("invalid stats interval, using the default", "value", value, "default", defaultStatsInterval)
+		} else {
+			interval = time.Duration(seconds) * time.Second
+		}
+	}
+	if interval == 0 {
+		return
+	}
+
+	var conn *os.File
+	warned := false
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for range ticker.C {
+		sample, err := sampleGuest("/proc", workloadPGID)
+		if err != nil {
+			logger.Debug("sampling guest stats failed", "error", err)
+			continue
+		}
+		line, _ := json.Marshal(sample)
+		if conn == nil {
+			if conn, err = dialHost(statsPort); err != nil {
+				if !warned {
+					logger.Info("guest stats not sent, host not reachable over vsock", "error", err)
+					warned = true
+				}
+				continue
+			}
+		}
+		if _, err := conn.Write(append(line, '\n')); err != nil {
+			logger.Debug("sending guest stats failed", "error", err)
+			conn.Close()
+			conn = nil
+		}
+	}
+}
+
+// dialHost connects to port of the host over vsock.
+func dialHost(port uint32) (*os.File, error) {
+	fd, err := unix.Socket(unix.AF_VSOCK, unix.SOCK_STREAM|unix.SOCK_CLOEXEC, 0)
+	if err != nil {
+		return nil, fmt.Errorf("vsock socket: %w", err)
+	}
+	if err := unix.Connect(fd, &unix.SockaddrVM{CID: unix.VMADDR_CID_HOST, Port: port}); err != nil {
+		unix.Close(fd)
+		return nil, fmt.Errorf("connect to host port %d: %w", port, err)
+	}
+	return os.NewFile(uintptr(fd), "vsock-host"), nil
+}
+
+// sampleGuest reads the load, memory and uptime of the guest and the RSS of
+// every process in the workload's process group below procRoot.
+func sampleGuest(procRoot string, workloadPGID int) (statsSample, error) {
+	var sample statsSample
+	raw, err := os.ReadFile(filepath.Join(procRoot, "loadavg"))
+	if err != nil {
+		return sample, err
+	}
+	fields := strings.Fields(string(raw))
+	if len(fields) < 3 {
+		return sample, fmt.Errorf("unexpected loadavg %q", raw)
+	}
+	for i := range sample.Load {
+		sample.Load[i], _ = strconv.ParseFloat(fields[i], 64)
+	}
+	if raw, err := os.ReadFile(filepath.Join(procRoot, "uptime")); err == nil {
+		if fields := strings.Fields(string(raw)); len(fields) > 0 {
+			sample.UptimeSeconds, _ = strconv.ParseFloat(fields[0], 64)
+		}
+	}
+	if sample.MemTotalKiB, sample.MemAvailableKiB, err = readMeminfo(filepath.Join(procRoot, "meminfo")); err != nil {
+		return sample, err
+	}
+
+	entries, err := os.ReadDir(procRoot)
+	if err != nil {
+		return sample, err
+	}
+	pageKiB := int64(os.Getpagesize() / 1024)
+	for _, entry := range entries {
+		if _, err := strconv.Atoi(entry.Name()); err != nil {
+			continue
+		}
+		pgid, rssPages, ok := readProcStat(filepath.Join(procRoot, entry.Name(), "stat"))
+		if !ok {
+			continue
+		}
+		sample.Processes++
+		if pgid == workloadPGID {
+			sample.WorkloadRSSKiB += rssPages * pageKiB
+		}
+	}
+	return sample, nil
+}
+
+func readMeminfo(path string) (total, available int64, err error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return 0, 0, err
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 2 {
+			continue
+		}
+		switch fields[0] {
+		case "MemTotal:":
+			total, _ = strconv.ParseInt(fields[1], 10, 64)
+		case "MemAvailable:":
+			available, _ = strconv.ParseInt(fields[1], 10, 64)
+		}
+	}
+	return total, available, scanner.Err()
+}
+
+// readProcStat returns the process group and resident pages from
+// /proc/<pid>/stat. The command name may hold spaces and parentheses, so
+// fields are counted from the last ')'.
+func readProcStat(path string) (pgid int, rssPages int64, ok bool) {
+	raw, err := os.ReadFile(path)
+	if err != nil {
+		return 0, 0, false
+	}
+	end := strings.LastIndexByte(string(raw), ')')
+	if end < 0 {
+		return 0, 0, false
+	}
+	// state ppid pgrp ... rss is the 22nd field after the name.
+	fields := strings.Fields(string(raw[end+1:]))
+	if len(fields) < 22 {
+		return 0, 0, false
+	}
+	pgid, errPGID := strconv.Atoi(fields[2])
+	rssPages, errRSS := strconv.ParseInt(fields[21], 10, 64)
+	if errPGID != nil || errRSS != nil {
+		return 0, 0, false
+	}
+	return pgid, rssPages, true
+}
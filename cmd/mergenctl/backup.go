@@ -0,0 +1,110 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+
+	"github.com/alperreha/mergen-fire/internal/config"
+	"github.com/alperreha/mergen-fire/internal/store"
+	"github.com/alperreha/mergen-fire/internal/systemd"
+)
+
+func runBackup(cfg config.Config, args []string) error {
+	flags := flag.NewFlagSet("backup", flag.ContinueOnError)
+	output := flags.String("file", "-", "Output archive path (- for stdout)")
+	includeData := flags.Bool("include-data", false, "Include hook history from the data root")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+
+	var w io.Writer = os.Stdout
+	if *output != "-" {
+		file, err := os.OpenFile(*output, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0o600)
+		if err != nil {
+			return err
+		}
+		defer file.Close()
+		w = file
+	}
+
+	fsStore := fsStoreFromConfig(cfg)
+	if cfg.StoreBackend == "sqlite" {
+		sqliteStore, err := store.NewSQLiteStore(cfg.SQLitePath, fsStore)
+		if err != nil {
+			return err
+		}
+		defer sqliteStore.Close()
+		return sqliteStore.Backup(w, *includeData)
+	}
+	return fsStore.Backup(w, *includeData)
+}
+
+func runRestore(cfg config.Config, args []string) error {
+	flags := flag.NewFlagSet("restore", flag.ContinueOnError)
+	input := flags.String("file", "", "Backup archive produced by POST /v1/backup or mergenctl backup (required)")
+	overwrite := flags.Bool("overwrite", false, "Replace VMs that already exist")
+	start := flags.Bool("start", false, "Start restored VMs through systemd")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if *input == "" {
+		return errors.New("-file is required")
+	}
+
+	file, err := os.Open(filepath.Clean(*input))
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	fsStore := fsStoreFromConfig(cfg)
+	if err := fsStore.EnsureBaseDirs(); err != nil {
+		return err
+	}
+	result, err := fsStore.Restore(file, store.RestoreOptions{Overwrite: *overwrite})
+	if err != nil {
+		return err
+	}
+
+	// Archives from older releases are upgraded right away so the forwarder
+	// never sees mixed-format directories.
+	if _, err := fsStore.MigrateSchema(""); err != nil {
+		return fmt.Errorf("migrate restored vms: %w", err)
+	}
+
+	if cfg.StoreBackend == "sqlite" {
+		sqliteStore, err := store.NewSQLiteStore(cfg.SQLitePath, fsStore)
+		if err != nil {
+			return err
+		}
+		defer sqliteStore.Close()
+		if _, err := sqliteStore.ImportFS(fsStore); err != nil {
+			return fmt.Errorf("register restored vms in sqlite: %w", err)
+		}
+	}
+
+	_, _ = fmt.Fprintf(os.Stdout, "backup schema version %d, created %s\n", result.Manifest.SchemaVersion, result.Manifest.CreatedAt.Format("2006-01-02 15:04:05Z07:00"))
+	for _, id := range result.Skipped {
+		_, _ = fmt.Fprintf(os.Stdout, "skipped %s (exists, use -overwrite)\n", id)
+	}
+	for _, id := range result.Restored {
+		_, _ = fmt.Fprintf(os.Stdout, "restored %s\n", id)
+	}
+
+	if *start && len(result.Restored) > 0 {
+		client := systemd.NewExecClient(cfg.SystemctlPath, cfg.UnitPrefix, cfg.CommandTimeout, slog.Default())
+		for _, id := range result.Restored {
+			if err := client.Start(context.Background(), id); err != nil {
+				return fmt.Errorf("start %s: %w", id, err)
+			}
+			_, _ = fmt.Fprintf(os.Stdout, "started %s\n", id)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,46 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+
+	"github.com/alperreha/mergen-fire/internal/config"
+	"github.com/alperreha/mergen-fire/internal/diagnostics"
+	"github.com/alperreha/mergen-fire/internal/model"
+)
+
+func runDoctor(cfg config.Config, args []string) error {
+	flags := flag.NewFlagSet("doctor", flag.ContinueOnError)
+	asJSON := flags.Bool("json", false, "Print the report as JSON")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+
+	report := diagnostics.NewChecker(cfg.UnitPrefix).Run()
+	if *asJSON {
+		encoder := json.NewEncoder(os.Stdout)
+		encoder.SetIndent("", "  ")
+		if err := encoder.Encode(report); err != nil {
+			return err
+		}
+	} else {
+		for _, check := range report.Checks {
+			_, _ = fmt.Fprintf(os.Stdout, "%-5s %-17s %s\n", check.Status, check.Name, check.Message)
+			if check.Remediation != "" {
+				_, _ = fmt.Fprintf(os.Stdout, "      %-17s fix: %s\n", "", check.Remediation)
+			}
+		}
+	}
+	if !report.OK {
+		failed := 0
+		for _, check := range report.Checks {
+			if check.Status == model.DiagnosticFail {
+				failed++
+			}
+		}
+		return fmt.Errorf("%d check(s) failed", failed)
+	}
+	return nil
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"sort"
+
+	"github.com/alperreha/mergen-fire/internal/config"
+	"github.com/alperreha/mergen-fire/internal/store"
+)
+
+type command struct {
+	summary string
+	run     func(cfg config.Config, args []string) error
+}
+
+var commands = map[string]command{
+	"backup":        {summary: "Write a tar.gz backup of all VM state", run: runBackup},
+	"restore":       {summary: "Restore VMs from a backup archive", run: runRestore},
+	"seal":          {summary: "Generate a host key or encrypt env/secret files with it", run: runSeal},
+	"migrate-store": {summary: "Import the filesystem VM layout into the SQLite or etcd store", run: runMigrateStore},
+	"doctor":        {summary: "Check host prerequisites for running VMs", run: runDoctor},
+	"network":       {summary: "Set up the host network VMs share (network init)", run: runNetwork},
+}
+
+func main() {
+	if len(os.Args) < 2 || os.Args[1] == "-h" || os.Args[1] == "--help" || os.Args[1] == "help" {
+		usage()
+		os.Exit(2)
+	}
+
+	cmd, ok := commands[os.Args[1]]
+	if !ok {
+		_, _ = fmt.Fprintf(os.Stderr, "error: unknown command %q\n\n", os.Args[1])
+		usage()
+		os.Exit(2)
+	}
+	if err := cmd.run(config.FromEnv(), os.Args[2:]); err != nil {
+		_, _ = fmt.Fprintf(os.Stderr, "error: %v\n", err)
+		os.Exit(1)
+	}
+}
+
+func usage() {
+	_, _ = fmt.Fprintln(os.Stderr, "usage: mergenctl <command> [flags]")
+	_, _ = fmt.Fprintln(os.Stderr, "\ncommands:")
+	names := make([]string, 0, len(commands))
+	for name := range commands {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		_, _ = fmt.Fprintf(os.Stderr, "  %-16s %s\n", name, commands[name].summary)
+	}
+	_, _ = fmt.Fprintln(os.Stderr, "\nPaths default to the daemon's MGR_* environment.")
+}
+
+func fsStoreFromConfig(cfg config.Config) *store.FSStore {
+	return store.NewFSStore(cfg.ConfigRoot, cfg.DataRoot, cfg.RunRoot, cfg.GlobalHooksDir)
+}
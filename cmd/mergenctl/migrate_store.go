@@ -0,0 +1,54 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+
+	"github.com/alperreha/mergen-fire/internal/config"
+	"github.com/alperreha/mergen-fire/internal/etcd"
+	"github.com/alperreha/mergen-fire/internal/store"
+)
+
+func runMigrateStore(cfg config.Config, args []string) error {
+	flags := flag.NewFlagSet("migrate-store", flag.ContinueOnError)
+	target := flags.String("to", "sqlite", "Target backend: sqlite or etcd")
+	sqlitePath := flags.String("sqlite-path", cfg.SQLitePath, "Target SQLite database file")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+
+	fsStore := fsStoreFromConfig(cfg)
+	switch *target {
+	case "sqlite":
+	case "etcd":
+		if len(cfg.EtcdEndpoints) == 0 {
+			return errors.New("MGR_ETCD_ENDPOINTS is required")
+		}
+		etcdStore := store.NewEtcdStore(etcd.NewClient(cfg.EtcdEndpoints, cfg.CommandTimeout), cfg.EtcdPrefix, fsStore)
+		imported, err := etcdStore.ImportFS(fsStore)
+		if err != nil {
+			return err
+		}
+		_, _ = fmt.Fprintf(os.Stdout, "imported %d vms into etcd under %s\n", imported, cfg.EtcdPrefix)
+		_, _ = fmt.Fprintln(os.Stdout, "set MGR_STORE_BACKEND=etcd and restart mergend to use it")
+		return nil
+	default:
+		return fmt.Errorf("unknown target backend %q", *target)
+	}
+
+	sqliteStore, err := store.NewSQLiteStore(*sqlitePath, fsStore)
+	if err != nil {
+		return err
+	}
+	defer sqliteStore.Close()
+
+	imported, err := sqliteStore.ImportFS(fsStore)
+	if err != nil {
+		return err
+	}
+	_, _ = fmt.Fprintf(os.Stdout, "imported %d vms into %s\n", imported, *sqlitePath)
+	_, _ = fmt.Fprintln(os.Stdout, "set MGR_STORE_BACKEND=sqlite and restart mergend to use it")
+	return nil
+}
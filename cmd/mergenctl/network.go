@@ -0,0 +1,43 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+
+	"github.com/alperreha/mergen-fire/internal/config"
+	"github.com/alperreha/mergen-fire/internal/network"
+)
+
+func runNetwork(cfg config.Config, args []string) error {
+	if len(args) == 0 || args[0] != "init" {
+		return fmt.Errorf("usage: mergenctl network init [--bridge name] [--guest-cidr cidr] [--json]")
+	}
+	flags := flag.NewFlagSet("network init", flag.ContinueOnError)
+	bridge := flags.String("bridge", cfg.Bridge, "Host bridge holding the guest CIDR's gateway")
+	guestCIDR := flags.String("guest-cidr", cfg.GuestCIDR, "Guest CIDR")
+	asJSON := flags.Bool("json", false, "Print the steps as JSON")
+	if err := flags.Parse(args[1:]); err != nil {
+		return err
+	}
+
+	steps, err := network.NewHostSetup(*bridge, *guestCIDR).Apply(context.Background())
+	if *asJSON {
+		encoder := json.NewEncoder(os.Stdout)
+		encoder.SetIndent("", "  ")
+		if encodeErr := encoder.Encode(steps); encodeErr != nil {
+			return encodeErr
+		}
+	} else {
+		for _, step := range steps {
+			status := "ok"
+			if step.Changed {
+				status = "fixed"
+			}
+			_, _ = fmt.Fprintf(os.Stdout, "%-5s %-10s %s\n", status, step.Name, step.Detail)
+		}
+	}
+	return err
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+
+	"github.com/alperreha/mergen-fire/internal/config"
+	"github.com/alperreha/mergen-fire/internal/sealing"
+)
+
+func runSeal(cfg config.Config, args []string) error {
+	flags := flag.NewFlagSet("seal", flag.ContinueOnError)
+	generateKey := flags.String("generate-key", "", "Write a new random host key to this path and exit")
+	file := flags.String("file", "", "Seal this file in place (e.g. the hook secrets file)")
+	env := flags.Bool("env", false, "Seal every plaintext VM env file")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+
+	if *generateKey != "" {
+		key, err := sealing.GenerateKey()
+		if err != nil {
+			return err
+		}
+		handle, err := os.OpenFile(*generateKey, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0o400)
+		if err != nil {
+			return err
+		}
+		if _, err := fmt.Fprintln(handle, key); err != nil {
+			_ = handle.Close()
+			return err
+		}
+		if err := handle.Close(); err != nil {
+			return err
+		}
+		_, _ = fmt.Fprintf(os.Stdout, "host key written to %s; set MGR_HOST_KEY_FILE=%s\n", *generateKey, *generateKey)
+		return nil
+	}
+	if *file == "" && !*env {
+		return errors.New("one of -generate-key, -file or -env is required")
+	}
+
+	sealer, err := sealing.Load(cfg.HostKeyFile, cfg.HostKeyCommand)
+	if err != nil {
+		return err
+	}
+	if sealer == nil {
+		return errors.New("MGR_HOST_KEY_FILE or MGR_HOST_KEY_COMMAND must be set")
+	}
+
+	if *file != "" {
+		if err := sealFile(sealer, *file); err != nil {
+			return err
+		}
+	}
+	if *env {
+		sealed, err := fsStoreFromConfig(cfg).WithSealer(sealer).SealEnvFiles()
+		for _, id := range sealed {
+			_, _ = fmt.Fprintf(os.Stdout, "sealed env of %s\n", id)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func sealFile(sealer *sealing.Sealer, path string) error {
+	info, err := os.Stat(path)
+	if err != nil {
+		return err
+	}
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	if sealing.IsSealed(content) {
+		_, _ = fmt.Fprintf(os.Stdout, "%s is already sealed\n", path)
+		return nil
+	}
+	sealed, err := sealer.Seal(content)
+	if err != nil {
+		return err
+	}
+	temp := path + ".sealing"
+	if err := os.WriteFile(temp, sealed, info.Mode().Perm()); err != nil {
+		return err
+	}
+	if err := os.Rename(temp, path); err != nil {
+		_ = os.Remove(temp)
+		return err
+	}
+	_, _ = fmt.Fprintf(os.Stdout, "sealed %s\n", path)
+	return nil
+}
@@ -2,10 +2,16 @@ package main
 
 import (
 	"context"
+	"crypto/tls"
+	"crypto/x509"
 	"errors"
+	"flag"
+	"fmt"
+	"net"
 	"net/http"
 	"os"
 	"os/signal"
+	"path/filepath"
 	"syscall"
 	"time"
 
@@ -13,63 +19,474 @@ import (
 	"github.com/labstack/echo/v4/middleware"
 
 	"github.com/alperreha/mergen-fire/internal/api"
+	"github.com/alperreha/mergen-fire/internal/audit"
+	"github.com/alperreha/mergen-fire/internal/certs"
+	"github.com/alperreha/mergen-fire/internal/chaos"
 	"github.com/alperreha/mergen-fire/internal/config"
+	"github.com/alperreha/mergen-fire/internal/diagnostics"
+	"github.com/alperreha/mergen-fire/internal/etcd"
+	"github.com/alperreha/mergen-fire/internal/firecracker"
+	"github.com/alperreha/mergen-fire/internal/forwarder"
 	"github.com/alperreha/mergen-fire/internal/hooks"
+	"github.com/alperreha/mergen-fire/internal/kernels"
+	"github.com/alperreha/mergen-fire/internal/lock"
 	"github.com/alperreha/mergen-fire/internal/logging"
+	"github.com/alperreha/mergen-fire/internal/logrotate"
 	"github.com/alperreha/mergen-fire/internal/manager"
+	"github.com/alperreha/mergen-fire/internal/model"
 	"github.com/alperreha/mergen-fire/internal/network"
+	"github.com/alperreha/mergen-fire/internal/redact"
+	"github.com/alperreha/mergen-fire/internal/sealing"
 	"github.com/alperreha/mergen-fire/internal/store"
 	"github.com/alperreha/mergen-fire/internal/systemd"
+	"github.com/alperreha/mergen-fire/internal/tracing"
+	"github.com/alperreha/mergen-fire/internal/usage"
 )
 
 func main() {
-	cfg := config.FromEnv()
-	logger := logging.New(cfg.LogLevel, cfg.LogFormat).With("component", "mergend")
-	logger.Info("bootstrapping daemon", "pid", os.Getpid(), "logLevel", cfg.LogLevel, "logFormat", cfg.LogFormat)
+	configPath := flag.String("config", "", "YAML or TOML config file; env vars override it")
+	validateOnly := flag.Bool("validate-config", false, "validate the configuration and exit")
+	flag.Parse()
+
+	cfg, err := config.Load(*configPath)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "config error: %v\n", err)
+		os.Exit(1)
+	}
+	if *validateOnly {
+		fmt.Println("config ok")
+		return
+	}
+	logOut, closeLog, err := cfg.LogOutput.Open()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "log output error: %v\n", err)
+		os.Exit(1)
+	}
+	defer closeLog()
+	logLevels := logging.NewLevels(logging.ParseLevel(cfg.LogLevel), cfg.LogFormat, logOut)
+	logger := logLevels.Logger("mergend")
+	logger.Info("bootstrapping daemon", "pid", os.Getpid(), "logLevel", cfg.LogLevel, "logFormat", cfg.LogFormat, "logFile", cfg.LogOutput.File)
+
+	sealer, err := sealing.Load(cfg.HostKeyFile, cfg.HostKeyCommand)
+	if err != nil {
+		logger.Error("failed to load host key", "error", err)
+		os.Exit(1)
+	}
+	logger.Info("env sealing", "enabled", sealer != nil)
+
+	var tracer *tracing.Tracer
+	if cfg.Tracing.Endpoint != "" {
+		tracer = tracing.New(tracing.Config{
+			Endpoint:    cfg.Tracing.Endpoint,
+			ServiceName: cfg.Tracing.ServiceName,
+			SampleRatio: cfg.Tracing.SampleRatio,
+			Headers:     cfg.Tracing.Headers,
+		}, logLevels.Logger("tracing"))
+		tracing.SetDefault(tracer)
+	}
+	logger.Info("tracing", "enabled", tracer != nil, "endpoint", cfg.Tracing.Endpoint)
 
 	fsStore := store.
 		NewFSStore(cfg.ConfigRoot, cfg.DataRoot, cfg.RunRoot, cfg.GlobalHooksDir).
-		WithLogger(logger.With("component", "store"))
+		WithLogger(logLevels.Logger("store")).
+		WithSealer(sealer)
 	if err := fsStore.EnsureBaseDirs(); err != nil {
 		logger.Error("failed to create base directories", "error", err)
 		os.Exit(1)
 	}
 
-	systemdClient := systemd.NewExecClient(cfg.SystemctlPath, cfg.UnitPrefix, cfg.CommandTimeout, logger.With("component", "systemd"))
-	hookRunner := hooks.NewRunner(logger.With("component", "hooks"))
+	var vmStore interface {
+		manager.Store
+		hooks.HistoryRecorder
+		MigrateSchema(backupDir string) (store.SchemaMigrationResult, error)
+	} = fsStore
+	var locker lock.Locker
+	switch cfg.StoreBackend {
+	case "fs", "":
+	case "sqlite":
+		sqliteStore, err := store.NewSQLiteStore(cfg.SQLitePath, fsStore)
+		if err != nil {
+			logger.Error("failed to open sqlite store", "path", cfg.SQLitePath, "error", err)
+			os.Exit(1)
+		}
+		defer sqliteStore.Close()
+		vmStore = sqliteStore.WithLogger(logLevels.Logger("store"))
+	case "etcd":
+		if len(cfg.EtcdEndpoints) == 0 {
+			logger.Error("MGR_ETCD_ENDPOINTS is required for the etcd store backend")
+			os.Exit(1)
+		}
+		etcdClient := etcd.NewClient(cfg.EtcdEndpoints, cfg.CommandTimeout).WithLogger(logLevels.Logger("etcd"))
+		vmStore = store.NewEtcdStore(etcdClient, cfg.EtcdPrefix, fsStore).WithLogger(logLevels.Logger("store"))
+		locker = lock.NewEtcdLocker(etcdClient, cfg.EtcdPrefix, cfg.EtcdLockTTL).WithLogger(logLevels.Logger("lock"))
+	default:
+		logger.Error("unknown store backend", "backend", cfg.StoreBackend)
+		os.Exit(1)
+	}
+	logger.Info("store backend selected", "backend", cfg.StoreBackend)
+	if report, err := vmStore.Fsck(false); err != nil {
+		logger.Error("store fsck failed", "error", err)
+		os.Exit(1)
+	} else {
+		for _, issue := range report.Issues {
+			logger.Warn("store fsck issue", "vmID", issue.VMID, "file", issue.File, "kind", issue.Kind, "message", issue.Message, "quarantined", issue.Quarantined)
+		}
+	}
+	if result, err := vmStore.MigrateSchema(filepath.Join(cfg.DataRoot, "backups")); err != nil {
+		logger.Error("store schema migration failed", "error", err, "backup", result.BackupPath)
+		os.Exit(1)
+	} else if len(result.Migrated) > 0 {
+		logger.Info("store schema migrated", "vms", len(result.Migrated), "schemaVersion", store.SchemaVersion, "backup", result.BackupPath)
+	}
+
+	host := model.HostInfo{Name: cfg.Host.Name, Labels: cfg.Host.Labels, URL: cfg.Host.AdvertiseURL}
+	var systemdClient systemd.Client = systemd.
+		NewExecClient(cfg.SystemctlPath, cfg.UnitPrefix, cfg.CommandTimeout, logLevels.Logger("systemd")).
+		WithUnitLookup(func(id string) string {
+			meta, err := vmStore.ReadMeta(id)
+			if err != nil {
+				return ""
+			}
+			return meta.Unit
+		})
+	var faults *chaos.Injector
+	if cfg.Chaos.Enabled {
+		faults = chaos.New(chaos.Config{
+			SystemdFailRate:      cfg.Chaos.SystemdFailRate,
+			FirecrackerDelay:     cfg.Chaos.FirecrackerDelay,
+			FirecrackerDelayRate: cfg.Chaos.FirecrackerDelayRate,
+			HookDropRate:         cfg.Chaos.HookDropRate,
+			Seed:                 cfg.Chaos.Seed,
+		}, logLevels.Logger("chaos"))
+		systemdClient = chaos.Systemd(systemdClient, faults)
+		logger.Warn(
+			"chaos fault injection enabled, do not run this in production",
+			"systemdFailRate", cfg.Chaos.SystemdFailRate,
+			"firecrackerDelay", cfg.Chaos.FirecrackerDelay.String(),
+			"firecrackerDelayRate", cfg.Chaos.FirecrackerDelayRate,
+			"hookDropRate", cfg.Chaos.HookDropRate,
+		)
+	}
+	breaker := manager.NewBreaker(manager.BreakerPolicy{
+		CreateFailures: cfg.Breaker.CreateFailures,
+		HookFailures:   cfg.Breaker.HookFailures,
+		HookWindow:     cfg.Breaker.HookWindow,
+		Cooldown:       cfg.Breaker.Cooldown,
+	}, logLevels.Logger("breaker"))
+	hookRunner := hooks.
+		NewRunner(logLevels.Logger("hooks")).
+		WithSecretsFile(cfg.HookSecretsFile).
+		WithSealer(sealer).
+		WithRecorder(vmStore).
+		WithWorkers(cfg.HookWorkers, cfg.HookQueueSize).
+		WithTimeouts(cfg.HookTimeout, cfg.HookTimeouts).
+		WithChaos(faults).
+		WithObserver(breaker)
+	if cfg.NetworkInit {
+		steps, err := network.NewHostSetup(cfg.Bridge, cfg.GuestCIDR).Apply(context.Background())
+		for _, step := range steps {
+			if step.Changed {
+				logger.Info("host network changed", "step", step.Name, "detail", step.Detail)
+			}
+		}
+		if err != nil {
+			logger.Error("host network init failed, VMs may have no connectivity", "bridge", cfg.Bridge, "guestCIDR", cfg.GuestCIDR, "error", err)
+		}
+	}
 	allocator := network.
 		NewAllocator(cfg.PortStart, cfg.PortEnd, cfg.GuestCIDR).
-		WithLogger(logger.With("component", "network"))
-	service := manager.NewService(fsStore, systemdClient, hookRunner, allocator, logger.With("component", "service"))
+		WithMACPrefix(cfg.GuestMACPrefix).
+		WithReservations(network.NewReservations(cfg.PortsFile).WithLogger(logLevels.Logger("network"))).
+		WithLogger(logLevels.Logger("network"))
+	var meter *usage.Meter
+	if cfg.Usage.Interval > 0 {
+		meter = usage.
+			NewMeter(vmStore, cfg.Usage.Dir, cfg.UnitPrefix).
+			WithInterval(cfg.Usage.Interval).
+			WithTenantTag(cfg.Usage.TenantTag).
+			WithLogger(logLevels.Logger("usage"))
+	}
+	service := manager.
+		NewService(vmStore, systemdClient, hookRunner, allocator, logLevels.Logger("service")).
+		WithLocker(locker).
+		WithNamer(network.NewNamer().WithNaming(cfg.TapPrefix, cfg.NetNSPrefix, cfg.NameIDChars)).
+		WithDeleteDrain(cfg.DeleteDrain).
+		WithRestartTimeout(cfg.RestartTimeout).
+		WithHypervisor(cfg.Hypervisor).
+		WithArtifactVerification(cfg.VerifyArtifacts).
+		WithLockWait(cfg.LockWait).
+		WithHost(host).
+		WithSnapshotter(firecracker.NewRawConfigurator(0).WithLogger(logLevels.Logger("firecracker")).WithChaos(faults)).
+		WithMigrationTimeout(cfg.MigrateTimeout).
+		WithKernels(kernels.NewCatalog(cfg.KernelsFile).WithLogger(logLevels.Logger("manager"))).
+		WithDiagnostics(diagnostics.NewChecker(cfg.UnitPrefix)).
+		WithUsage(meter).
+		WithJobs(cfg.Jobs.QueueSize, cfg.Jobs.Retention).
+		WithCapacity(manager.CapacityPolicy{
+			VCPUs:            cfg.Capacity.VCPUs,
+			MemMiB:           cfg.Capacity.MemMiB,
+			CPUOvercommit:    cfg.Capacity.CPUOvercommit,
+			MemoryOvercommit: cfg.Capacity.MemoryOvercommit,
+		}).
+		WithGuestDialer(forwarder.NewNetNSDialer(0, "")).
+		WithBreaker(breaker)
+
+	if cfg.Certs.ACMEDirectory != "" {
+		certDir := certs.NewDir(cfg.Certs.Dir)
+		accountKey, err := certs.LoadOrCreateKey(filepath.Join(cfg.Certs.Dir, "acme-account.key"))
+		if err != nil {
+			logger.Error("failed to load acme account key", "dir", cfg.Certs.Dir, "error", err)
+			os.Exit(1)
+		}
+		issuer := certs.
+			NewACME(cfg.Certs.ACMEDirectory, cfg.Certs.ACMEEmail, accountKey, certDir).
+			WithLogger(logLevels.Logger("certs"))
+		service.WithCertificates(issuer, certDir, time.Duration(cfg.Certs.RenewBeforeDays)*24*time.Hour)
+	}
+
+	var auditLog *audit.Log
+	if cfg.AuditFile != "" {
+		if auditLog, err = audit.Open(cfg.AuditFile); err != nil {
+			logger.Error("failed to open audit log", "file", cfg.AuditFile, "error", err)
+			os.Exit(1)
+		}
+	}
 
 	e := echo.New()
 	e.HideBanner = true
 	e.HidePort = true
 	e.Use(middleware.Recover())
-	e.Use(middleware.RequestID())
+	e.Use(api.RequestID())
+	e.Use(api.Tracing())
+	e.Use(api.AccessLog(logLevels.Logger("access"), redact.New(cfg.API.RedactAllow)))
+	e.Use(api.Audit(auditLog, logLevels.Logger("audit")))
+	e.Use(api.SecurityHeaders(cfg.API.HSTSMaxAge))
+	maintenance := api.NewMaintenance(cfg.ReadOnly)
+	e.Use(api.CORS(api.CORSConfig{
+		AllowOrigins: cfg.API.CORSOrigins,
+		AllowMethods: cfg.API.CORSMethods,
+		AllowHeaders: cfg.API.CORSHeaders,
+		MaxAge:       cfg.API.CORSMaxAge,
+	}))
+	apiTokens := api.NewTokens(authTokens(cfg))
+	if !apiTokens.Enabled() {
+		logger.Warn("api authentication is off; set MGR_API_TOKENS or MGR_API_TOKENS_FILE", "addr", cfg.HTTPAddr)
+	}
+	e.Use(api.Authenticate(apiTokens))
+	// Migrations stream the VM's disk images in the request body.
+	e.Use(api.BodyLimit(api.BodyLimits{
+		MaxBytes:   cfg.API.MaxBodyBytes,
+		MaxDepth:   cfg.API.MaxJSONDepth,
+		MaxEntries: cfg.API.MaxJSONEntries,
+		Exempt:     []string{"/v1/migrations"},
+	}))
+	e.Use(api.ReadOnly(maintenance))
+	// An upgrade ends event streams early so the old process can drain.
+	streamsCtx, endStreams := context.WithCancel(context.Background())
+	defer endStreams()
+	e.Use(api.EndStreams(streamsCtx))
 
 	e.GET("/healthz", func(c echo.Context) error {
 		logger.Debug("healthz requested", "remoteAddr", c.Request().RemoteAddr)
+		if state := service.BreakerState(); state.Tripped {
+			return c.JSON(200, map[string]any{"status": "degraded", "breaker": state})
+		}
 		return c.JSON(200, map[string]string{"status": "ok"})
 	})
-	api.Register(e, service, logger.With("component", "api"))
+	e.GET("/debug/hooks/queue", func(c echo.Context) error {
+		return c.JSON(200, hookRunner.Stats())
+	})
+	e.GET("/debug/locks", func(c echo.Context) error {
+		return c.JSON(200, service.LockStats())
+	})
+	if faults != nil {
+		e.GET("/debug/chaos", func(c echo.Context) error {
+			return c.JSON(200, faults.Stats())
+		})
+	}
+	api.Register(e, service, api.RedactionConfig{Allow: cfg.API.RedactAllow, RevealToken: cfg.API.RevealToken}, logLevels.Logger("api"))
+	configReloader := &reloader{
+		path:      *configPath,
+		current:   cfg,
+		levels:    logLevels,
+		allocator: allocator,
+		hooks:     hookRunner,
+		readOnly:  maintenance,
+		tokens:    apiTokens,
+		logger:    logLevels.Logger("config"),
+	}
+	api.RegisterAdmin(e, configReloader.Reload, logLevels, logLevels.Logger("api"))
+	api.RegisterMaintenance(e, maintenance, logLevels.Logger("api"))
+	api.RegisterAudit(e, auditLog)
+	api.RegisterOpenAPI(e)
+	// Every component logger exists by now, so overrides can be checked.
+	if err := logLevels.Apply("", cfg.LogLevels); err != nil {
+		logger.Warn("ignoring log level overrides", "error", err)
+	}
 
+	listener, inherited, err := listen(cfg.HTTPAddr)
+	if err != nil {
+		logger.Error("failed to listen", "addr", cfg.HTTPAddr, "error", err)
+		os.Exit(1)
+	}
+	if inherited != nil {
+		state := inherited.state
+		logger.Info("taking over from previous process", "pid", state.PID, "operations", len(state.Operations))
+		maintenance.Set(state.Maintenance.ReadOnly, state.Maintenance.Reason)
+		service.RestoreBreaker(state.Breaker)
+		overrides := make(map[string]string, len(state.LogLevels.Overrides))
+		for _, name := range state.LogLevels.Overrides {
+			overrides[name] = state.LogLevels.Components[name]
+		}
+		if err := logLevels.Apply(state.LogLevels.Default, overrides); err != nil {
+			logger.Warn("ignoring log levels of previous process", "error", err)
+		}
+		for _, op := range state.Operations {
+			logger.Info("operation still finishing in previous process", "vmID", op.VMID, "operation", op.Operation, "startedAt", op.StartedAt)
+		}
+	}
+	upgrades := &upgrader{
+		args:         os.Args,
+		listener:     listener,
+		readyTimeout: cfg.UpgradeReadyTimeout,
+		logger:       logger,
+		state: func() upgradeState {
+			return upgradeState{
+				PID:          os.Getpid(),
+				HandedOverAt: time.Now().UTC(),
+				Maintenance:  maintenance.State(),
+				Breaker:      service.BreakerState(),
+				LogLevels:    logLevels.Snapshot(),
+				Operations:   service.Operations(),
+			}
+		},
+	}
+	e.GET("/v1/admin/upgrade", func(c echo.Context) error {
+		status := model.UpgradeStatus{PID: os.Getpid(), Upgrading: upgrades.inProgress(), Operations: service.Operations()}
+		if inherited != nil {
+			status.Previous = &model.PreviousProcess{
+				PID:          inherited.state.PID,
+				Running:      processRunning(inherited.state.PID),
+				HandedOverAt: inherited.state.HandedOverAt,
+				Operations:   inherited.state.Operations,
+			}
+		}
+		return c.JSON(200, status)
+	})
+
+	// Requests derive from baseCtx so a shutdown can cancel them; background
+	// loops run on loopCtx, which an upgrade stops before draining requests.
+	baseCtx, cancelBase := context.WithCancel(context.Background())
+	defer cancelBase()
+	loopCtx, stopLoops := context.WithCancel(baseCtx)
+	defer stopLoops()
+	if registry, ok := vmStore.(*store.EtcdStore); ok {
+		if host.URL == "" {
+			logger.Warn("MGR_ADVERTISE_URL is empty, peers cannot forward vms scheduled onto this host", "host", host.Name)
+		}
+		if err := registry.RegisterHost(loopCtx, host, cfg.EtcdLockTTL); err != nil {
+			logger.Error("failed to register host", "host", host.Name, "error", err)
+			os.Exit(1)
+		}
+	}
 	server := &http.Server{
 		Addr:              cfg.HTTPAddr,
 		Handler:           e,
 		ReadHeaderTimeout: cfg.CommandTimeout,
+		BaseContext:       func(net.Listener) context.Context { return baseCtx },
+	}
+	if cfg.TLS.ClientCAFile != "" {
+		clientCAs, err := loadCertPool(cfg.TLS.ClientCAFile)
+		if err != nil {
+			logger.Error("failed to load client ca", "path", cfg.TLS.ClientCAFile, "error", err)
+			os.Exit(1)
+		}
+		server.TLSConfig = &tls.Config{ClientCAs: clientCAs, ClientAuth: tls.RequireAndVerifyClientCert}
+	}
+
+	logRotator := logrotate.
+		NewManager(vmStore, logrotate.Policy{
+			MaxSizeBytes: int64(cfg.LogRotate.MaxSizeMiB) << 20,
+			MaxAge:       time.Duration(cfg.LogRotate.MaxAgeDays) * 24 * time.Hour,
+			MaxFiles:     cfg.LogRotate.MaxFiles,
+			Compress:     cfg.LogRotate.Compress,
+		}).
+		WithInterval(cfg.LogRotate.Interval).
+		WithLogger(logLevels.Logger("logrotate"))
+	go logRotator.Run(loopCtx)
+	go service.WatchBootFiles(loopCtx, cfg.BootFileCheck)
+	go service.RunSchedules(loopCtx, cfg.ScheduleCheck)
+	go service.RunReconciler(loopCtx, cfg.ReconcileCheck)
+	go service.RunHealthProbes(loopCtx, cfg.HealthCheck)
+	go service.RunIdleStops(loopCtx, cfg.IdleCheck)
+	go service.RunGuestStats(loopCtx, cfg.GuestStatsCheck)
+	go service.RunVMMetrics(loopCtx, cfg.VMMetricsCheck)
+	go service.RunJobs(loopCtx, cfg.Jobs.Workers)
+	go service.WatchCertificates(loopCtx, cfg.Certs.CheckInterval)
+	if meter != nil {
+		go meter.Run(loopCtx)
 	}
 
+	if *configPath != "" {
+		go config.WatchFile(loopCtx, *configPath, 5*time.Second, configReloader.reloadLogged)
+	}
+	hangups := make(chan os.Signal, 1)
+	signal.Notify(hangups, syscall.SIGHUP)
+	go func() {
+		for range hangups {
+			configReloader.reloadLogged()
+		}
+	}()
+	cycleLevels := make(chan os.Signal, 1)
+	signal.Notify(cycleLevels, syscall.SIGUSR1)
+	go func() {
+		for range cycleLevels {
+			level := logLevels.Cycle()
+			logger.Warn("default log level changed by SIGUSR1", "level", logging.LevelName(level))
+		}
+	}()
+
+	handedOver := make(chan int, 1)
+	upgradeSignals := make(chan os.Signal, 1)
+	signal.Notify(upgradeSignals, syscall.SIGUSR2)
+	go func() {
+		for range upgradeSignals {
+			pid, err := upgrades.start()
+			if err != nil {
+				logger.Error("upgrade failed, keeping the running process", "error", err)
+				continue
+			}
+			signal.Stop(upgradeSignals)
+			handedOver <- pid
+			return
+		}
+	}()
+
 	serverErrCh := make(chan error, 1)
 	go func() {
-		logger.Info("daemon started", "addr", cfg.HTTPAddr)
-		if err := server.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+		logger.Info("daemon started", "addr", listener.Addr().String(), "tls", cfg.TLS.CertFile != "", "clientAuth", cfg.TLS.ClientCAFile != "")
+		var err error
+		if cfg.TLS.CertFile != "" {
+			err = server.ServeTLS(listener, cfg.TLS.CertFile, cfg.TLS.KeyFile)
+		} else {
+			err = server.Serve(listener)
+		}
+		if err != nil && !errors.Is(err, http.ErrServerClosed) {
 			serverErrCh <- err
 			return
 		}
 		serverErrCh <- nil
 	}()
 
+	if inherited != nil {
+		if err := inherited.signalReady(); err != nil {
+			logger.Error("failed to report ready to previous process", "pid", inherited.state.PID, "error", err)
+			os.Exit(1)
+		}
+	} else {
+		notifySystemd("READY=1")
+	}
+
 	ctx, cancel := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
 	defer cancel()
 
@@ -83,7 +500,36 @@ func main() {
 		return
 	case <-ctx.Done():
 		logger.Info("shutdown signal received")
+	case pid := <-handedOver:
+		// The new process serves the listener now. Stop the background work
+		// and new connections here, and let requests in flight finish.
+		logger.Info("handed over to new process, draining", "pid", pid, "operations", len(service.Operations()), "drainTimeout", cfg.UpgradeDrainTimeout.String())
+		stopLoops()
+		endStreams()
+		drainCtx, drainCancel := context.WithTimeout(context.Background(), cfg.UpgradeDrainTimeout)
+		go func() {
+			select {
+			case <-ctx.Done():
+				logger.Warn("shutdown signal received while draining, cancelling in-flight requests")
+				drainCancel()
+			case <-drainCtx.Done():
+			}
+		}()
+		err := server.Shutdown(drainCtx)
+		if err == nil {
+			// Jobs queued by the last requests fail once the loops stop;
+			// running ones are waited for like requests.
+			err = service.WaitJobs(drainCtx)
+		}
+		drainCancel()
+		if err == nil {
+			logger.Info("in-flight requests finished")
+			break
+		}
+		logger.Warn("in-flight requests did not finish, cancelling them", "error", err, "operations", service.Operations())
 	}
+	cancelBase()
+	endStreams()
 
 	shutdownTimeout := cfg.ShutdownTimeout
 	if shutdownTimeout <= 0 {
@@ -97,9 +543,31 @@ func main() {
 		os.Exit(1)
 	}
 
+	if err := service.WaitJobs(shutdownCtx); err != nil {
+		logger.Warn("jobs did not finish before shutdown", "error", err)
+	}
+	if err := hookRunner.Shutdown(shutdownCtx); err != nil {
+		logger.Warn("hook queue did not drain before shutdown", "error", err, "pending", hookRunner.Stats().Depth)
+	}
+	if err := tracer.Shutdown(shutdownCtx); err != nil {
+		logger.Warn("pending spans were not exported before shutdown", "error", err)
+	}
+
 	if err := <-serverErrCh; err != nil {
 		logger.Error("daemon stopped with error", "error", err)
 		os.Exit(1)
 	}
 	logger.Info("daemon stopped gracefully")
 }
+
+func loadCertPool(path string) (*x509.CertPool, error) {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(content) {
+		return nil, fmt.Errorf("no certificates found in %s", path)
+	}
+	return pool, nil
+}
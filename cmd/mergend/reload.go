@@ -0,0 +1,99 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/alperreha/mergen-fire/internal/api"
+	"github.com/alperreha/mergen-fire/internal/config"
+	"github.com/alperreha/mergen-fire/internal/hooks"
+	"github.com/alperreha/mergen-fire/internal/logging"
+	"github.com/alperreha/mergen-fire/internal/network"
+)
+
+// reloadable lists the Config fields that can change without a restart.
+var reloadable = map[string]bool{
+	"LogLevel":     true,
+	"LogLevels":    true,
+	"PortStart":    true,
+	"PortEnd":      true,
+	"HookTimeout":  true,
+	"HookTimeouts": true,
+	"ReadOnly":     true,
+	"Auth":         true,
+}
+
+type reloader struct {
+	mu        sync.Mutex
+	path      string
+	current   config.Config
+	levels    *logging.Levels
+	allocator *network.Allocator
+	hooks     *hooks.Runner
+	readOnly  *api.Maintenance
+	tokens    *api.Tokens
+	logger    *slog.Logger
+}
+
+// Reload re-reads the config file and environment, applies the reloadable
+// changes and logs the rest as requiring a restart. An invalid file changes
+// nothing.
+func (r *reloader) Reload(ctx context.Context) (config.ReloadResult, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	next, err := config.Load(r.path)
+	if err != nil {
+		r.logger.Error("config reload failed, keeping current config", "path", r.path, "error", err)
+		return config.ReloadResult{}, err
+	}
+	applied, rejected := config.Diff(r.current, next, reloadable)
+	result := config.ReloadResult{Path: r.path, ReloadedAt: time.Now().UTC(), Applied: applied, Rejected: rejected}
+
+	for _, field := range applied {
+		switch field {
+		case "LogLevel", "LogLevels":
+			if err := r.levels.Apply(next.LogLevel, logging.OverrideChanges(r.current.LogLevels, next.LogLevels)); err != nil {
+				r.logger.Warn("log levels not applied", "error", err)
+				continue
+			}
+			r.current.LogLevel, r.current.LogLevels = next.LogLevel, next.LogLevels
+		case "PortStart", "PortEnd":
+			r.current.PortStart, r.current.PortEnd = next.PortStart, next.PortEnd
+			r.allocator.SetPortRange(next.PortStart, next.PortEnd)
+		case "HookTimeout", "HookTimeouts":
+			r.current.HookTimeout, r.current.HookTimeouts = next.HookTimeout, next.HookTimeouts
+			r.hooks.WithTimeouts(next.HookTimeout, next.HookTimeouts)
+		case "ReadOnly":
+			r.current.ReadOnly = next.ReadOnly
+			r.readOnly.Set(next.ReadOnly, "")
+			r.logger.Warn("read-only mode changed by config", "readOnly", next.ReadOnly)
+		case "Auth":
+			r.current.Auth = next.Auth
+			r.tokens.Set(authTokens(r.current))
+			r.logger.Warn("api tokens changed by config", "tokens", len(next.Auth.Tokens))
+		}
+	}
+	if len(rejected) > 0 {
+		r.logger.Warn("config changes need a restart and were not applied", "fields", rejected)
+	}
+	r.logger.Info("config reloaded", "path", r.path, "applied", applied)
+	return result, nil
+}
+
+func (r *reloader) reloadLogged() {
+	_, _ = r.Reload(context.Background())
+}
+
+// authTokens returns the tokens Authenticate accepts. Once authentication is
+// on, the reveal token has to pass it too, so it counts as an admin token.
+func authTokens(cfg config.Config) []config.APIToken {
+	tokens := cfg.Auth.Tokens
+	if len(tokens) > 0 && cfg.API.RevealToken != "" {
+		tokens = append(slices.Clip(tokens), config.APIToken{Name: "reveal", Scope: config.ScopeAdmin, Secret: cfg.API.RevealToken})
+	}
+	return tokens
+}
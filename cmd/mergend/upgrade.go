@@ -0,0 +1,220 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/alperreha/mergen-fire/internal/logging"
+	"github.com/alperreha/mergen-fire/internal/model"
+)
+
+// On SIGUSR2 mergend starts the binary at its own path again and hands it
+// the listening socket and its runtime state through inherited descriptors.
+// The new process answers on the ready pipe once it serves; only then does
+// the old one stop accepting and drain its in-flight requests. VM locks are
+// flocks, so both processes can run operations side by side safely.
+const (
+	// upgradeEnv carries the PID of the process handing over.
+	upgradeEnv = "MERGEND_UPGRADE_FROM"
+	// Descriptors as numbered in the new process, after stdin/out/err.
+	upgradeListenerFD = 3
+	upgradeStateFD    = 4
+	upgradeReadyFD    = 5
+)
+
+// upgradeState is the runtime state that is not in the config or the
+// store, and so would otherwise be lost by an upgrade.
+type upgradeState struct {
+	PID          int                    `json:"pid"`
+	HandedOverAt time.Time              `json:"handedOverAt"`
+	Maintenance  model.MaintenanceState `json:"maintenance"`
+	Breaker      model.BreakerState     `json:"breaker"`
+	LogLevels    logging.LevelsSnapshot `json:"logLevels"`
+	Operations   []model.Operation      `json:"operations"`
+}
+
+// inheritance is what a new process received from the one it replaces.
+type inheritance struct {
+	state upgradeState
+	ready *os.File
+}
+
+// listen returns the socket handed over by an upgrading mergend, along
+// with its state, or a new listener on addr for a normal start.
+func listen(addr string) (net.Listener, *inheritance, error) {
+	if os.Getenv(upgradeEnv) == "" {
+		listener, err := net.Listen("tcp", addr)
+		return listener, nil, err
+	}
+	_ = os.Unsetenv(upgradeEnv)
+	listenerFile := os.NewFile(upgradeListenerFD, "listener")
+	stateFile := os.NewFile(upgradeStateFD, "upgrade-state")
+	ready := os.NewFile(upgradeReadyFD, "upgrade-ready")
+	defer listenerFile.Close()
+	defer stateFile.Close()
+
+	listener, err := net.FileListener(listenerFile)
+	if err != nil {
+		ready.Close()
+		return nil, nil, fmt.Errorf("inherit listener: %w", err)
+	}
+	var state upgradeState
+	if err := json.NewDecoder(stateFile).Decode(&state); err != nil {
+		listener.Close()
+		ready.Close()
+		return nil, nil, fmt.Errorf("read upgrade state: %w", err)
+	}
+	return listener, &inheritance{state: state, ready: ready}, nil
+}
+
+// signalReady tells the previous process that this one serves, and
+// systemd that this is the service's main process now.
+func (i *inheritance) signalReady() error {
+	notifySystemd(fmt.Sprintf("MAINPID=%d\nREADY=1", os.Getpid()))
+	_, err := i.ready.WriteString("ready\n")
+	if closeErr := i.ready.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+// upgrader starts the replacement process on SIGUSR2.
+type upgrader struct {
+	// args is the command line to start, normally mergend's own.
+	args         []string
+	listener     net.Listener
+	readyTimeout time.Duration
+	state        func() upgradeState
+	logger       *slog.Logger
+
+	mu        sync.Mutex
+	upgrading bool
+}
+
+// start launches the new binary and waits for it to report ready. On any
+// error the new process is killed and this one carries on serving.
+func (u *upgrader) start() (int, error) {
+	u.mu.Lock()
+	if u.upgrading {
+		u.mu.Unlock()
+		return 0, errors.New("an upgrade is already in progress")
+	}
+	u.upgrading = true
+	u.mu.Unlock()
+	defer func() {
+		u.mu.Lock()
+		u.upgrading = false
+		u.mu.Unlock()
+	}()
+
+	binary, err := exec.LookPath(u.args[0])
+	if err != nil {
+		return 0, fmt.Errorf("find mergend binary: %w", err)
+	}
+	filer, ok := u.listener.(interface{ File() (*os.File, error) })
+	if !ok {
+		return 0, fmt.Errorf("listener %T cannot be handed over", u.listener)
+	}
+	listenerFile, err := filer.File()
+	if err != nil {
+		return 0, fmt.Errorf("dup listener: %w", err)
+	}
+	defer listenerFile.Close()
+	stateRead, stateWrite, err := os.Pipe()
+	if err != nil {
+		return 0, err
+	}
+	defer stateWrite.Close()
+	readyRead, readyWrite, err := os.Pipe()
+	if err != nil {
+		stateRead.Close()
+		return 0, err
+	}
+	defer readyRead.Close()
+
+	cmd := exec.Command(binary, u.args[1:]...)
+	cmd.Stdin, cmd.Stdout, cmd.Stderr = os.Stdin, os.Stdout, os.Stderr
+	cmd.Env = append(os.Environ(), upgradeEnv+"="+strconv.Itoa(os.Getpid()))
+	cmd.ExtraFiles = []*os.File{listenerFile, stateRead, readyWrite}
+	err = cmd.Start()
+	stateRead.Close()
+	readyWrite.Close()
+	if err != nil {
+		return 0, fmt.Errorf("start %s: %w", binary, err)
+	}
+	pid := cmd.Process.Pid
+	u.logger.Info("upgrade started", "binary", binary, "pid", pid)
+
+	exited := make(chan error, 1)
+	go func() { exited <- cmd.Wait() }()
+	fail := func(err error) (int, error) {
+		_ = cmd.Process.Signal(syscall.SIGKILL)
+		return 0, err
+	}
+	if err := json.NewEncoder(stateWrite).Encode(u.state()); err != nil {
+		return fail(fmt.Errorf("hand over state: %w", err))
+	}
+	stateWrite.Close()
+
+	ready := make(chan error, 1)
+	go func() {
+		line, err := bufio.NewReader(readyRead).ReadString('\n')
+		if err == nil && strings.TrimSpace(line) != "ready" {
+			err = fmt.Errorf("unexpected ready message %q", line)
+		}
+		ready <- err
+	}()
+	timer := time.NewTimer(u.readyTimeout)
+	defer timer.Stop()
+	select {
+	case err := <-ready:
+		if err != nil {
+			return fail(fmt.Errorf("new process did not report ready: %w", err))
+		}
+		return pid, nil
+	case err := <-exited:
+		return 0, fmt.Errorf("new process exited before it was ready: %v", err)
+	case <-timer.C:
+		return fail(fmt.Errorf("new process not ready within %s", u.readyTimeout))
+	}
+}
+
+func (u *upgrader) inProgress() bool {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	return u.upgrading
+}
+
+// notifySystemd sends state to the service manager when mergend runs as a
+// Type=notify unit, and does nothing otherwise.
+func notifySystemd(state string) {
+	socket := os.Getenv("NOTIFY_SOCKET")
+	if socket == "" {
+		return
+	}
+	if strings.HasPrefix(socket, "@") {
+		socket = "\x00" + socket[1:]
+	}
+	conn, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: socket, Net: "unixgram"})
+	if err != nil {
+		return
+	}
+	defer conn.Close()
+	_, _ = conn.Write([]byte(state))
+}
+
+// processRunning reports whether pid is still alive.
+func processRunning(pid int) bool {
+	return pid > 0 && syscall.Kill(pid, 0) == nil
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/alperreha/mergen-fire/internal/model"
+)
+
+// TestUpgradeHelperProcess is the new mergend of TestUpgradeHandsOverListener.
+// It serves one request on the inherited listener, answering with the state
+// it was handed.
+func TestUpgradeHelperProcess(t *testing.T) {
+	if os.Getenv("MERGEND_UPGRADE_HELPER") != "1" {
+		t.Skip("helper process")
+	}
+	listener, inherited, err := listen("")
+	if err != nil || inherited == nil {
+		fmt.Fprintf(os.Stderr, "listen: %v %v\n", inherited, err)
+		os.Exit(2)
+	}
+	served := make(chan struct{})
+	server := &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		_ = json.NewEncoder(w).Encode(inherited.state)
+		close(served)
+	})}
+	go func() { _ = server.Serve(listener) }()
+	if err := inherited.signalReady(); err != nil {
+		os.Exit(3)
+	}
+	select {
+	case <-served:
+		time.Sleep(100 * time.Millisecond)
+	case <-time.After(10 * time.Second):
+	}
+	os.Exit(0)
+}
+
+func TestUpgradeHandsOverListener(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	defer listener.Close()
+	t.Setenv("MERGEND_UPGRADE_HELPER", "1")
+
+	started := time.Date(2026, 1, 2, 3, 4, 5, 0, time.UTC)
+	upgrades := &upgrader{
+		args:         []string{os.Args[0], "-test.run=^TestUpgradeHelperProcess$"},
+		listener:     listener,
+		readyTimeout: 10 * time.Second,
+		logger:       slog.New(slog.NewTextHandler(io.Discard, nil)),
+		state: func() upgradeState {
+			return upgradeState{
+				PID:         os.Getpid(),
+				Maintenance: model.MaintenanceState{ReadOnly: true, Reason: "upgrade test"},
+				Operations:  []model.Operation{{VMID: "vm-1", Operation: "delete", StartedAt: started}},
+			}
+		},
+	}
+	pid, err := upgrades.start()
+	if err != nil {
+		t.Fatalf("upgrade: %v", err)
+	}
+	if pid <= 0 || pid == os.Getpid() {
+		t.Fatalf("unexpected new process pid %d", pid)
+	}
+	// The old process stops accepting once the new one is ready.
+	addr := listener.Addr().String()
+	listener.Close()
+
+	resp, err := http.Get("http://" + addr)
+	if err != nil {
+		t.Fatalf("request to new process: %v", err)
+	}
+	defer resp.Body.Close()
+	var got upgradeState
+	if err := json.NewDecoder(resp.Body).Decode(&got); err != nil {
+		t.Fatalf("decode: %v", err)
+	}
+	if got.PID != os.Getpid() || !got.Maintenance.ReadOnly || len(got.Operations) != 1 || got.Operations[0].VMID != "vm-1" {
+		t.Fatalf("new process got unexpected state: %+v", got)
+	}
+}
+
+func TestUpgradeFailsWhenNewProcessExits(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	defer listener.Close()
+
+	upgrades := &upgrader{
+		args:         []string{"false"},
+		listener:     listener,
+		readyTimeout: 10 * time.Second,
+		logger:       slog.New(slog.NewTextHandler(io.Discard, nil)),
+		state:        func() upgradeState { return upgradeState{} },
+	}
+	if _, err := upgrades.start(); err == nil {
+		t.Fatalf("expected the upgrade to fail")
+	}
+	if upgrades.inProgress() {
+		t.Fatalf("a failed upgrade should allow another attempt")
+	}
+}
@@ -3,16 +3,18 @@ module github.com/alperreha/mergen-fire
 go 1.24.0
 
 require (
+	github.com/BurntSushi/toml v1.5.0
 	github.com/firecracker-microvm/firecracker-go-sdk v1.0.0
 	github.com/labstack/echo/v4 v4.13.3
+	github.com/mattn/go-sqlite3 v1.14.33
 	github.com/opencontainers/go-digest v1.0.0
 	go.podman.io/image/v5 v5.39.1
 	go.podman.io/storage v1.62.0
 	golang.org/x/sys v0.37.0
+	gopkg.in/yaml.v3 v3.0.1
 )
 
 require (
-	github.com/BurntSushi/toml v1.5.0 // indirect
 	github.com/PuerkitoBio/purell v1.1.1 // indirect
 	github.com/PuerkitoBio/urlesc v0.0.0-20170810143723-de5bf2ad4578 // indirect
 	github.com/asaskevich/govalidator v0.0.0-20210307081110-f21760c49a8d // indirect
@@ -65,7 +67,6 @@ require (
 	golang.org/x/net v0.45.0 // indirect
 	golang.org/x/text v0.30.0 // indirect
 	gopkg.in/yaml.v2 v2.4.0 // indirect
-	gopkg.in/yaml.v3 v3.0.1 // indirect
 )
 
 replace github.com/labstack/echo/v4 => ./third_party/echo
@@ -0,0 +1,207 @@
+package api
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"log/slog"
+	"net/http"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/labstack/echo/v4"
+
+	"github.com/alperreha/mergen-fire/internal/audit"
+	"github.com/alperreha/mergen-fire/internal/logging"
+	"github.com/alperreha/mergen-fire/internal/model"
+)
+
+// auditSkip lists the mutating routes left out of the audit log: the
+// forwarder's activity reports store nothing and come every few seconds.
+var auditSkip = []string{"/v1/vms/activity"}
+
+// auditCollections maps the routes a POST adds a member to, by their last
+// segment, to the action recorded.
+var auditCollections = map[string]string{
+	"vms":        "create",
+	"stacks":     "create",
+	"snapshots":  "create",
+	"templates":  "create",
+	"namespaces": "create",
+	"kernels":    "create",
+	"migrations": "receive",
+}
+
+// auditCreates are the routes whose response names the VM they made.
+var auditCreates = []string{"/v1/vms", "/v1/namespaces/:ns/vms", "/v1/vms/adopt", "/v1/migrations"}
+
+// maxAuditResponse is how much of a response is kept to find the id of a
+// VM it made.
+const maxAuditResponse = 4 << 10
+
+// Audit appends every mutating /v1 request to log once the handler returns,
+// including requests refused by authentication or read-only mode. Register
+// it before Authenticate, like AccessLog, so the entry names the token. A
+// failed append is logged; the request has been served by then. A nil log
+// records nothing.
+func Audit(log *audit.Log, logger *slog.Logger) echo.MiddlewareFunc {
+	if logger == nil {
+		logger = slog.Default()
+	}
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			req := c.Request()
+			switch req.Method {
+			case http.MethodGet, http.MethodHead, http.MethodOptions:
+				return next(c)
+			}
+			if log == nil || !strings.HasPrefix(req.URL.Path, "/v1/") || slices.Contains(auditSkip, c.Path()) {
+				return next(c)
+			}
+			started := time.Now().UTC()
+			payload := &digestWriter{hash: sha256.New()}
+			if req.Body != nil && req.Body != http.NoBody {
+				req.Body = struct {
+					io.Reader
+					io.Closer
+				}{io.TeeReader(req.Body, payload), req.Body}
+			}
+			response := &capturedResponse{ResponseWriter: c.Response().Writer}
+			c.Response().Writer = response
+			err := next(c)
+			c.Response().Writer = response.ResponseWriter
+
+			req = c.Request()
+			status := c.Response().Status
+			if err != nil && status == 0 {
+				status = http.StatusInternalServerError
+				var httpErr *echo.HTTPError
+				if errors.As(err, &httpErr) {
+					status = httpErr.Code
+				}
+			} else if status == 0 {
+				status = http.StatusOK
+			}
+			entry := model.AuditEntry{
+				At:         started,
+				RequestID:  logging.RequestID(req.Context()),
+				Token:      TokenName(req.Context()),
+				RemoteAddr: req.RemoteAddr,
+				Method:     req.Method,
+				Path:       req.URL.Path,
+				Route:      c.Path(),
+				Action:     auditAction(req.Method, c.Path()),
+				Namespace:  c.Param("ns"),
+			}
+			if strings.Contains(c.Path(), "/vms/:id") {
+				entry.VMID = c.Param("id")
+			} else if status < http.StatusMultipleChoices && slices.Contains(auditCreates, c.Path()) {
+				var created struct {
+					ID string `json:"id"`
+				}
+				if json.Unmarshal(response.body, &created) == nil {
+					entry.VMID = created.ID
+				}
+			}
+			if payload.n > 0 {
+				entry.PayloadDigest = "sha256:" + hex.EncodeToString(payload.hash.Sum(nil))
+				entry.PayloadBytes = payload.n
+			}
+			entry.Status = status
+			if appendErr := log.Append(entry); appendErr != nil {
+				logger.ErrorContext(req.Context(), "audit log write failed", "method", entry.Method, "path", entry.Path, "token", entry.Token, "error", appendErr)
+			}
+			return err
+		}
+	}
+}
+
+// auditAction names what a mutating route does: create, delete or update
+// for collections and members, otherwise the route's verb, such as start.
+func auditAction(method, route string) string {
+	switch method {
+	case http.MethodDelete:
+		return "delete"
+	case http.MethodPatch, http.MethodPut:
+		return "update"
+	}
+	last := route[strings.LastIndex(route, "/")+1:]
+	if _, verb, ok := strings.Cut(last, ":"); ok && verb != "" && !strings.HasPrefix(last, ":") {
+		return verb
+	}
+	if action, ok := auditCollections[last]; ok {
+		return action
+	}
+	return last
+}
+
+type digestWriter struct {
+	hash hash.Hash
+	n    int64
+}
+
+func (w *digestWriter) Write(p []byte) (int, error) {
+	w.n += int64(len(p))
+	return w.hash.Write(p)
+}
+
+// capturedResponse keeps the start of a response body.
+type capturedResponse struct {
+	http.ResponseWriter
+	body []byte
+}
+
+func (r *capturedResponse) Write(p []byte) (int, error) {
+	if room := maxAuditResponse - len(r.body); room > 0 {
+		r.body = append(r.body, p[:min(room, len(p))]...)
+	}
+	return r.ResponseWriter.Write(p)
+}
+
+func (r *capturedResponse) Flush() {
+	if flusher, ok := r.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+// RegisterAudit mounts GET /v1/audit, which lists the entries of log
+// newest first. Without a log it answers 404.
+func RegisterAudit(e *echo.Echo, log *audit.Log) {
+	e.GET("/v1/audit", func(c echo.Context) error {
+		if log == nil {
+			return c.JSON(http.StatusNotFound, errorResponse("not_found", errors.New("the audit log is off; set MGR_AUDIT_FILE")))
+		}
+		filter := model.AuditFilter{
+			VMID:      c.QueryParam("vm"),
+			Token:     c.QueryParam("token"),
+			Action:    c.QueryParam("action"),
+			Namespace: c.QueryParam("namespace"),
+		}
+		limit, err := parseInt(c.QueryParam("limit"))
+		if err != nil || limit < 0 || limit > audit.MaxLimit {
+			return c.JSON(http.StatusBadRequest, errorResponse("bad_request", fmt.Errorf("limit must be between 0 and %d", audit.MaxLimit)))
+		}
+		filter.Limit = limit
+		for name, at := range map[string]*time.Time{"since": &filter.Since, "until": &filter.Until} {
+			raw := c.QueryParam(name)
+			if raw == "" {
+				continue
+			}
+			parsed, err := time.Parse(time.RFC3339, raw)
+			if err != nil {
+				return c.JSON(http.StatusBadRequest, errorResponse("bad_request", fmt.Errorf("%s must be an RFC 3339 time: %w", name, err)))
+			}
+			*at = parsed
+		}
+		entries, err := log.Query(filter)
+		if err != nil {
+			return c.JSON(http.StatusInternalServerError, errorResponse("internal_error", err))
+		}
+		return c.JSON(http.StatusOK, map[string]any{"items": entries})
+	})
+}
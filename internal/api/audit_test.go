@@ -0,0 +1,120 @@
+package api
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/labstack/echo/v4"
+
+	"github.com/alperreha/mergen-fire/internal/audit"
+	"github.com/alperreha/mergen-fire/internal/config"
+	"github.com/alperreha/mergen-fire/internal/model"
+)
+
+func TestAudit(t *testing.T) {
+	log, err := audit.Open(filepath.Join(t.TempDir(), "audit", "audit.log"))
+	if err != nil {
+		t.Fatalf("open: %v", err)
+	}
+	e := echo.New()
+	e.Use(Audit(log, nil))
+	e.Use(Authenticate(NewTokens([]config.APIToken{
+		{Name: "dashboard", Scope: config.ScopeRead, Secret: "read-secret"},
+		{Name: "ops", Scope: config.ScopeAdmin, Secret: "admin-secret"},
+	})))
+	e.POST("/v1/vms", func(c echo.Context) error {
+		var req model.CreateVMRequest
+		if err := c.Bind(&req); err != nil {
+			return err
+		}
+		return c.JSON(http.StatusCreated, map[string]string{"id": "vm-1", "status": "created"})
+	})
+	ok := func(c echo.Context) error { return c.JSON(http.StatusOK, map[string]string{}) }
+	e.GET("/v1/vms", ok)
+	e.POST("/v1/vms/:id/stop", ok)
+	e.DELETE("/v1/vms/:id", ok)
+	e.POST("/v1/vms/activity", ok)
+	RegisterAudit(e, log)
+
+	serve := func(method, path, token, body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, path, strings.NewReader(body))
+		req.Header.Set("Authorization", "Bearer "+token)
+		req.Header.Set("Content-Type", "application/json")
+		rec := httptest.NewRecorder()
+		e.ServeHTTP(rec, req)
+		return rec
+	}
+	create := `{"rootfs":"/images/web.ext4","kernel":"/images/vmlinux"}`
+	serve(http.MethodPost, "/v1/vms", "admin-secret", create)
+	serve(http.MethodGet, "/v1/vms", "admin-secret", "")
+	serve(http.MethodPost, "/v1/vms/vm-1/stop", "dashboard-wrong", "")
+	serve(http.MethodPost, "/v1/vms/vm-1/stop", "read-secret", "")
+	serve(http.MethodPost, "/v1/vms/activity", "admin-secret", `{"ids":["vm-1"]}`)
+	serve(http.MethodDelete, "/v1/vms/vm-1", "admin-secret", "")
+
+	list := func(query, token string) (int, []model.AuditEntry) {
+		rec := serve(http.MethodGet, "/v1/audit"+query, token, "")
+		var out struct {
+			Items []model.AuditEntry `json:"items"`
+		}
+		_ = json.Unmarshal(rec.Body.Bytes(), &out)
+		return rec.Code, out.Items
+	}
+	if code, _ := list("", "read-secret"); code != http.StatusForbidden {
+		t.Fatalf("audit with a read token: got %d, want 403", code)
+	}
+	code, entries := list("?vm=vm-1", "admin-secret")
+	if code != http.StatusOK || len(entries) != 4 {
+		t.Fatalf("audit of vm-1: code %d entries %+v", code, entries)
+	}
+	sum := sha256.Sum256([]byte(create))
+	want := []struct {
+		action, token string
+		status        int
+	}{
+		{"delete", "ops", http.StatusOK},
+		{"stop", "dashboard", http.StatusForbidden},
+		{"stop", "", http.StatusUnauthorized},
+		{"create", "ops", http.StatusCreated},
+	}
+	for i, w := range want {
+		if got := entries[i]; got.Action != w.action || got.Token != w.token || got.Status != w.status {
+			t.Fatalf("entry %d = %s by %q status %d, want %s by %q status %d", i, got.Action, got.Token, got.Status, w.action, w.token, w.status)
+		}
+	}
+	if created := entries[3]; created.PayloadDigest != "sha256:"+hex.EncodeToString(sum[:]) || created.PayloadBytes != int64(len(create)) || created.Route != "/v1/vms" {
+		t.Fatalf("create entry %+v, want the body's digest", created)
+	}
+	if _, entries := list("?action=delete&limit=5", "admin-secret"); len(entries) != 1 {
+		t.Fatalf("audit of deletes: %+v", entries)
+	}
+	if code, _ := list("?since=yesterday", "admin-secret"); code != http.StatusBadRequest {
+		t.Fatalf("malformed since: got %d, want 400", code)
+	}
+}
+
+func TestAuditAction(t *testing.T) {
+	cases := map[string]string{
+		"POST /v1/vms":                      "create",
+		"POST /v1/namespaces/:ns/vms":       "create",
+		"POST /v1/vms:batch":                "batch",
+		"POST /v1/vms/:id/start":            "start",
+		"POST /v1/vms/:id/snapshots":        "create",
+		"POST /v1/migrations":               "receive",
+		"PATCH /v1/vms/:id":                 "update",
+		"DELETE /v1/vms/:id/snapshots/:sid": "delete",
+		"POST /v1/admin/breaker/reset":      "reset",
+	}
+	for route, want := range cases {
+		method, path, _ := strings.Cut(route, " ")
+		if got := auditAction(method, path); got != want {
+			t.Errorf("auditAction(%s) = %q, want %q", route, got, want)
+		}
+	}
+}
@@ -0,0 +1,132 @@
+package api
+
+import (
+	"context"
+	"crypto/subtle"
+	"errors"
+	"net/http"
+	"slices"
+	"strings"
+	"sync"
+
+	"github.com/labstack/echo/v4"
+
+	"github.com/alperreha/mergen-fire/internal/config"
+)
+
+// adminReads lists GET routes besides /v1/admin/ that need an admin token;
+// the console takes input, and the audit log names every token's calls.
+var adminReads = []string{"/v1/vms/:id/console", "/v1/namespaces/:ns/vms/:id/console", "/v1/audit"}
+
+// readWrites lists the POST routes a read token may use: the forwarder's
+// wake and activity reports, which only do what traffic through it would.
+var readWrites = []string{"/v1/vms/:id/wake", "/v1/vms/activity"}
+
+// Tokens holds the API tokens shared by the Authenticate middleware and
+// config reloads. Without tokens every request passes.
+type Tokens struct {
+	mu     sync.RWMutex
+	tokens []config.APIToken
+}
+
+func NewTokens(tokens []config.APIToken) *Tokens {
+	t := &Tokens{}
+	t.Set(tokens)
+	return t
+}
+
+func (t *Tokens) Set(tokens []config.APIToken) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.tokens = slices.Clone(tokens)
+}
+
+func (t *Tokens) Enabled() bool {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	return len(t.tokens) > 0
+}
+
+// lookup compares secret with every token in constant time, so the time
+// taken does not tell how much of it matched or which token it was.
+func (t *Tokens) lookup(secret string) (config.APIToken, bool, bool) {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	if len(t.tokens) == 0 {
+		return config.APIToken{}, false, false
+	}
+	var found config.APIToken
+	ok := false
+	for _, token := range t.tokens {
+		if subtle.ConstantTimeCompare([]byte(secret), []byte(token.Secret)) == 1 {
+			found, ok = token, true
+		}
+	}
+	return found, ok, true
+}
+
+type tokenNameKey struct{}
+
+// TokenName returns the name of the API token the request of ctx was
+// authenticated with, or "" when authentication is off.
+func TokenName(ctx context.Context) string {
+	name, _ := ctx.Value(tokenNameKey{}).(string)
+	return name
+}
+
+// Authenticate requires "Authorization: Bearer <token>" on /v1 once t holds
+// tokens: a missing or unknown token gets 401, a read token used for
+// anything but GET, HEAD and readWrites, or for adminReads or /v1/admin/,
+// gets 403, as does a namespace's token used outside
+// /v1/namespaces/<its namespace>. Other paths, such as /healthz, stay open. Register it after AccessLog so the
+// access line names the token.
+func Authenticate(t *Tokens) echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			req := c.Request()
+			if req.Method == http.MethodOptions || !strings.HasPrefix(req.URL.Path, "/v1/") {
+				return next(c)
+			}
+			secret, _ := strings.CutPrefix(req.Header.Get("Authorization"), "Bearer ")
+			token, ok, enabled := t.lookup(strings.TrimSpace(secret))
+			if !enabled {
+				return next(c)
+			}
+			if !ok {
+				c.Response().Header().Set("WWW-Authenticate", `Bearer realm="mergend"`)
+				return c.JSON(http.StatusUnauthorized, errorResponse("unauthorized", errors.New("a valid bearer token is required")))
+			}
+			c.SetRequest(req.WithContext(context.WithValue(req.Context(), tokenNameKey{}, token.Name)))
+			if token.Scope != config.ScopeAdmin && needsAdmin(req.Method, c.Path()) {
+				return c.JSON(http.StatusForbidden, errorResponse("forbidden", errors.New("token "+token.Name+" has read scope")))
+			}
+			if token.Namespace != "" && !inTokenNamespace(token.Namespace, req.Method, c) {
+				return c.JSON(http.StatusForbidden, errorResponse("forbidden", errors.New("token "+token.Name+" is limited to namespace "+token.Namespace)))
+			}
+			return next(c)
+		}
+	}
+}
+
+func needsAdmin(method, path string) bool {
+	if method != http.MethodGet && method != http.MethodHead {
+		return !(method == http.MethodPost && slices.Contains(readWrites, path))
+	}
+	return strings.HasPrefix(path, "/v1/admin/") || slices.Contains(adminReads, path)
+}
+
+// inTokenNamespace reports whether c is one of namespace's VM or operation
+// routes, or a read of the namespace itself; its quota stays for unscoped
+// admins to set.
+func inTokenNamespace(namespace, method string, c echo.Context) bool {
+	if c.Param("ns") != namespace {
+		return false
+	}
+	path := c.Path()
+	switch {
+	case strings.HasPrefix(path, "/v1/namespaces/:ns/vms"), strings.HasPrefix(path, "/v1/namespaces/:ns/operations"):
+		return true
+	default:
+		return path == "/v1/namespaces/:ns" && method == http.MethodGet
+	}
+}
@@ -0,0 +1,81 @@
+package api
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/labstack/echo/v4"
+
+	"github.com/alperreha/mergen-fire/internal/config"
+)
+
+func TestAuthenticate(t *testing.T) {
+	tokens := NewTokens(nil)
+	e := echo.New()
+	e.Use(Authenticate(tokens))
+	var seen string
+	ok := func(c echo.Context) error {
+		seen = TokenName(c.Request().Context())
+		return c.JSON(http.StatusOK, map[string]string{})
+	}
+	e.GET("/healthz", ok)
+	e.GET("/v1/vms", ok)
+	e.POST("/v1/vms", ok)
+	e.GET("/v1/vms/:id/console", ok)
+	e.GET("/v1/admin/maintenance", ok)
+	e.PUT("/v1/namespaces/:ns", ok)
+	e.POST("/v1/namespaces/:ns/vms", ok)
+
+	serve := func(method, path, token string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, path, nil)
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		rec := httptest.NewRecorder()
+		e.ServeHTTP(rec, req)
+		return rec
+	}
+
+	if rec := serve(http.MethodPost, "/v1/vms", ""); rec.Code != http.StatusOK {
+		t.Fatalf("without tokens: got %d", rec.Code)
+	}
+
+	tokens.Set([]config.APIToken{
+		{Name: "dashboard", Scope: config.ScopeRead, Secret: "read-secret"},
+		{Name: "ops", Scope: config.ScopeAdmin, Secret: "admin-secret"},
+		{Name: "team-a", Scope: config.ScopeAdmin, Namespace: "team-a", Secret: "team-secret"},
+	})
+	cases := []struct {
+		method string
+		path   string
+		token  string
+		want   int
+	}{
+		{method: http.MethodGet, path: "/healthz", want: http.StatusOK},
+		{method: http.MethodGet, path: "/v1/vms", want: http.StatusUnauthorized},
+		{method: http.MethodGet, path: "/v1/vms", token: "wrong", want: http.StatusUnauthorized},
+		{method: http.MethodGet, path: "/v1/vms", token: "read-secret", want: http.StatusOK},
+		{method: http.MethodPost, path: "/v1/vms", token: "read-secret", want: http.StatusForbidden},
+		{method: http.MethodGet, path: "/v1/vms/abc/console", token: "read-secret", want: http.StatusForbidden},
+		{method: http.MethodGet, path: "/v1/admin/maintenance", token: "read-secret", want: http.StatusForbidden},
+		{method: http.MethodPost, path: "/v1/vms", token: "admin-secret", want: http.StatusOK},
+		{method: http.MethodGet, path: "/v1/vms/abc/console", token: "admin-secret", want: http.StatusOK},
+		{method: http.MethodPost, path: "/v1/namespaces/team-a/vms", token: "team-secret", want: http.StatusOK},
+		{method: http.MethodPost, path: "/v1/namespaces/team-b/vms", token: "team-secret", want: http.StatusForbidden},
+		{method: http.MethodPut, path: "/v1/namespaces/team-a", token: "team-secret", want: http.StatusForbidden},
+		{method: http.MethodGet, path: "/v1/vms", token: "team-secret", want: http.StatusForbidden},
+	}
+	for _, tc := range cases {
+		rec := serve(tc.method, tc.path, tc.token)
+		if rec.Code != tc.want {
+			t.Fatalf("%s %s with %q: got %d, want %d", tc.method, tc.path, tc.token, rec.Code, tc.want)
+		}
+		if tc.want == http.StatusUnauthorized && rec.Header().Get("WWW-Authenticate") == "" {
+			t.Fatalf("%s %s: 401 without WWW-Authenticate", tc.method, tc.path)
+		}
+	}
+	if serve(http.MethodGet, "/v1/vms", "admin-secret"); seen != "ops" {
+		t.Fatalf("expected the token name in the context, got %q", seen)
+	}
+}
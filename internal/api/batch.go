@@ -0,0 +1,38 @@
+package api
+
+import (
+	"net/http"
+
+	"github.com/labstack/echo/v4"
+
+	"github.com/alperreha/mergen-fire/internal/model"
+)
+
+// batchVMs answers 200 whenever the request itself is valid; each VM's
+// outcome is in its result.
+func (h *Handler) batchVMs(c echo.Context) error {
+	h.logger.DebugContext(c.Request().Context(), "http batch vms", "method", c.Request().Method, "path", c.Request().URL.Path)
+	var req model.BatchVMRequest
+	if err := c.Bind(&req); err != nil {
+		h.logger.DebugContext(c.Request().Context(), "http batch vms bind failed", "error", err)
+		return c.JSON(http.StatusBadRequest, errorResponse("bad_request", err))
+	}
+	errs, err := h.service.BatchVMs(c.Request().Context(), req)
+	if err != nil {
+		return h.writeServiceError(c, err)
+	}
+	out := model.BatchVMResponse{Action: req.Action, Results: make([]model.BatchVMResult, len(req.IDs))}
+	for i, id := range req.IDs {
+		result := model.BatchVMResult{ID: id, Status: http.StatusOK}
+		if errs[i] != nil {
+			result.Status, result.Error = serviceErrorStatus(errs[i])
+			result.Message = errs[i].Error()
+			out.Failed++
+		} else {
+			out.Succeeded++
+		}
+		out.Results[i] = result
+	}
+	h.logger.InfoContext(c.Request().Context(), "http batch vms success", "action", req.Action, "succeeded", out.Succeeded, "failed", out.Failed)
+	return c.JSON(http.StatusOK, out)
+}
@@ -0,0 +1,58 @@
+package api_test
+
+import (
+	"encoding/json"
+	"net/http"
+	"testing"
+
+	"github.com/alperreha/mergen-fire/internal/model"
+	"github.com/alperreha/mergen-fire/internal/testsupport"
+)
+
+func TestBatchVMs(t *testing.T) {
+	env := testsupport.NewEnv(t)
+	first := env.CreateVM(t, env.Artifacts.CreateRequest())
+	second := env.CreateVM(t, env.Artifacts.CreateRequest())
+
+	batch := func(req model.BatchVMRequest) model.BatchVMResponse {
+		t.Helper()
+		status, body := env.Request(t, http.MethodPost, "/v1/vms:batch", req)
+		if status != http.StatusOK {
+			t.Fatalf("batch %s: status %d body %s", req.Action, status, body)
+		}
+		var out model.BatchVMResponse
+		if err := json.Unmarshal(body, &out); err != nil {
+			t.Fatalf("decode batch response: %v", err)
+		}
+		return out
+	}
+
+	out := batch(model.BatchVMRequest{Action: model.BatchStart, IDs: []string{first, "missing", second}})
+	if out.Succeeded != 2 || out.Failed != 1 || len(out.Results) != 3 {
+		t.Fatalf("unexpected start batch: %+v", out)
+	}
+	if out.Results[0].ID != first || out.Results[0].Status != http.StatusOK || out.Results[2].ID != second || out.Results[2].Status != http.StatusOK {
+		t.Fatalf("results out of order or failed: %+v", out.Results)
+	}
+	if missing := out.Results[1]; missing.Status != http.StatusNotFound || missing.Error != "not_found" || missing.Message == "" {
+		t.Fatalf("unexpected result for a missing vm: %+v", missing)
+	}
+
+	out = batch(model.BatchVMRequest{Action: model.BatchDelete, IDs: []string{first, second}})
+	if out.Succeeded != 2 || out.Failed != 0 {
+		t.Fatalf("unexpected delete batch: %+v", out)
+	}
+	if status, _ := env.Request(t, http.MethodGet, "/v1/vms/"+first, nil); status != http.StatusNotFound {
+		t.Fatalf("get deleted vm: status %d, want 404", status)
+	}
+
+	for _, req := range []model.BatchVMRequest{
+		{Action: "reboot", IDs: []string{first}},
+		{Action: model.BatchStop},
+		{Action: model.BatchStop, IDs: []string{first, first}},
+	} {
+		if status, body := env.Request(t, http.MethodPost, "/v1/vms:batch", req); status != http.StatusBadRequest {
+			t.Fatalf("batch %+v: status %d body %s, want 400", req, status, body)
+		}
+	}
+}
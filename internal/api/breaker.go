@@ -0,0 +1,26 @@
+package api
+
+import (
+	"net/http"
+	"strings"
+
+	"github.com/labstack/echo/v4"
+
+	"github.com/alperreha/mergen-fire/internal/model"
+)
+
+func (h *Handler) breakerState(c echo.Context) error {
+	return c.JSON(http.StatusOK, h.service.BreakerState())
+}
+
+func (h *Handler) resetBreaker(c echo.Context) error {
+	var req model.BreakerResetRequest
+	if c.Request().ContentLength != 0 {
+		if err := c.Bind(&req); err != nil {
+			return c.JSON(http.StatusBadRequest, errorResponse("bad_request", err))
+		}
+	}
+	state := h.service.ResetBreaker(strings.TrimSpace(req.Reason))
+	h.logger.WarnContext(c.Request().Context(), "automation circuit breaker reset via api", "reason", req.Reason)
+	return c.JSON(http.StatusOK, state)
+}
@@ -0,0 +1,70 @@
+package api
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+
+	"github.com/labstack/echo/v4"
+
+	"github.com/alperreha/mergen-fire/internal/manager"
+)
+
+// console attaches a WebSocket to the VM's serial console: serial output is
+// sent as binary messages, and every text or binary message received is
+// written to the guest as input.
+func (h *Handler) console(c echo.Context) error {
+	id := c.Param("id")
+	h.logger.DebugContext(c.Request().Context(), "http console", "vmID", id, "method", c.Request().Method, "path", c.Request().URL.Path, "remoteAddr", c.Request().RemoteAddr)
+	if err := checkWebSocket(c.Request()); err != nil {
+		return c.JSON(http.StatusBadRequest, errorResponse("bad_request", err))
+	}
+	ctx, cancel := context.WithCancel(c.Request().Context())
+	defer cancel()
+	session, err := h.service.OpenConsole(ctx, id)
+	if err != nil {
+		return h.writeServiceError(c, err)
+	}
+	defer session.Close()
+	ws, err := upgradeWebSocket(c)
+	if err != nil {
+		h.logger.WarnContext(ctx, "http console upgrade failed", "vmID", id, "error", err)
+		return nil
+	}
+	defer ws.Close()
+
+	go func() {
+		defer cancel()
+		for {
+			_, input, err := ws.ReadMessage()
+			if err != nil {
+				return
+			}
+			if _, err := session.Write(input); err != nil {
+				h.logger.DebugContext(ctx, "console input dropped", "vmID", id, "error", err)
+				if !errors.Is(err, manager.ErrConflict) {
+					return
+				}
+			}
+		}
+	}()
+
+	buf := make([]byte, 4096)
+	for {
+		n, err := session.Read(buf)
+		if n > 0 {
+			if err := ws.writeFrame(wsBinary, buf[:n]); err != nil {
+				break
+			}
+		}
+		if err != nil {
+			if !errors.Is(err, io.EOF) {
+				h.logger.WarnContext(ctx, "console output failed", "vmID", id, "error", err)
+			}
+			break
+		}
+	}
+	h.logger.DebugContext(c.Request().Context(), "http console detached", "vmID", id)
+	return nil
+}
@@ -0,0 +1,122 @@
+package api_test
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/alperreha/mergen-fire/internal/testsupport"
+)
+
+func TestConsoleWebSocket(t *testing.T) {
+	env := testsupport.NewEnv(t)
+	id := env.CreateVM(t, env.Artifacts.CreateRequest())
+	cfg, err := env.Store.ReadVMConfig(id)
+	if err != nil || cfg.Console == nil {
+		t.Fatalf("vm config has no console: %+v, %v", cfg.Console, err)
+	}
+	if err := os.MkdirAll(filepath.Dir(cfg.Console.OutputPath), 0o755); err != nil {
+		t.Fatalf("create logs dir: %v", err)
+	}
+	if err := os.WriteFile(cfg.Console.OutputPath, []byte("Kernel panic - not syncing\n"), 0o644); err != nil {
+		t.Fatalf("write serial log: %v", err)
+	}
+	// Play the VMM: hold the input FIFO open for reading.
+	if err := os.MkdirAll(filepath.Dir(cfg.Console.InputPath), 0o755); err != nil {
+		t.Fatalf("create run dir: %v", err)
+	}
+	if err := syscall.Mkfifo(cfg.Console.InputPath, 0o600); err != nil {
+		t.Fatalf("mkfifo: %v", err)
+	}
+	input, err := os.OpenFile(cfg.Console.InputPath, os.O_RDWR, 0)
+	if err != nil {
+		t.Fatalf("open fifo: %v", err)
+	}
+	defer input.Close()
+
+	if status, _ := env.Request(t, http.MethodGet, "/v1/vms/"+id+"/console", nil); status != http.StatusBadRequest {
+		t.Fatalf("plain GET: status %d, want 400", status)
+	}
+
+	server, _ := url.Parse(env.API.URL)
+	conn, err := net.Dial("tcp", server.Host)
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	defer conn.Close()
+	_ = conn.SetDeadline(time.Now().Add(10 * time.Second))
+	_, err = io.WriteString(conn, "GET /v1/vms/"+id+"/console HTTP/1.1\r\nHost: "+server.Host+"\r\n"+
+		"Connection: Upgrade\r\nUpgrade: websocket\r\nSec-WebSocket-Version: 13\r\n"+
+		"Sec-WebSocket-Key: dGhlIHNhbXBsZSBub25jZQ==\r\n\r\n")
+	if err != nil {
+		t.Fatalf("write handshake: %v", err)
+	}
+	reader := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(reader, nil)
+	if err != nil {
+		t.Fatalf("read handshake: %v", err)
+	}
+	if resp.StatusCode != http.StatusSwitchingProtocols || resp.Header.Get("Sec-WebSocket-Accept") != "s3pPLMBiTxaQ9kYGzzhZRbK+xOo=" {
+		t.Fatalf("handshake: status %d accept %q", resp.StatusCode, resp.Header.Get("Sec-WebSocket-Accept"))
+	}
+
+	readFrame := func() string {
+		t.Helper()
+		var head [2]byte
+		if _, err := io.ReadFull(reader, head[:]); err != nil {
+			t.Fatalf("read frame: %v", err)
+		}
+		payload := make([]byte, head[1]&0x7f)
+		if _, err := io.ReadFull(reader, payload); err != nil {
+			t.Fatalf("read payload: %v", err)
+		}
+		return string(payload)
+	}
+	if got := readFrame(); got != "Kernel panic - not syncing\n" {
+		t.Fatalf("backlog %q", got)
+	}
+
+	mask := [4]byte{1, 2, 3, 4}
+	frame := []byte{0x81, 0x80 | 7}
+	frame = append(frame, mask[:]...)
+	for i, b := range []byte("uptime\n") {
+		frame = append(frame, b^mask[i%4])
+	}
+	if _, err := conn.Write(frame); err != nil {
+		t.Fatalf("write input: %v", err)
+	}
+	got := make([]byte, 7)
+	_ = input.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := io.ReadFull(input, got); err != nil || string(got) != "uptime\n" {
+		t.Fatalf("guest input %q, err %v", got, err)
+	}
+
+	log, err := os.OpenFile(cfg.Console.OutputPath, os.O_APPEND|os.O_WRONLY, 0)
+	if err != nil {
+		t.Fatalf("open serial log: %v", err)
+	}
+	defer log.Close()
+	if _, err := log.WriteString(" 10:00:01 up 1 min\n"); err != nil {
+		t.Fatalf("append serial log: %v", err)
+	}
+	if got := readFrame(); !strings.Contains(got, "up 1 min") {
+		t.Fatalf("followed output %q", got)
+	}
+
+	closeFrame := append([]byte{0x88, 0x80}, mask[:]...)
+	if _, err := conn.Write(closeFrame); err != nil {
+		t.Fatalf("write close: %v", err)
+	}
+	var head [2]byte
+	if _, err := io.ReadFull(reader, head[:]); err != nil || head[0]&0x0f != 0x8 {
+		t.Fatalf("expected a close frame back, got %x, err %v", head, err)
+	}
+}
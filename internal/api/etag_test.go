@@ -0,0 +1,106 @@
+package api_test
+
+import (
+	"context"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/labstack/echo/v4"
+
+	"github.com/alperreha/mergen-fire/internal/api"
+	"github.com/alperreha/mergen-fire/internal/model"
+	"github.com/alperreha/mergen-fire/internal/testsupport"
+)
+
+func TestConditionalGetPerRepresentation(t *testing.T) {
+	env := testsupport.NewEnv(t)
+	req := env.Artifacts.CreateRequest()
+	req.Metadata = map[string]any{"dbPassword": "hunter2"}
+	id := env.CreateVM(t, req)
+
+	e := echo.New()
+	api.Register(e, env.Service, api.RedactionConfig{RevealToken: "let-me-see"}, slog.New(slog.NewTextHandler(io.Discard, nil)))
+	server := httptest.NewServer(e)
+	defer server.Close()
+
+	get := func(path string, reveal bool, ifNoneMatch string) (int, string, string) {
+		t.Helper()
+		if reveal {
+			path += sep(path) + "reveal=true"
+		}
+		r, err := http.NewRequest(http.MethodGet, server.URL+path, nil)
+		if err != nil {
+			t.Fatalf("build request: %v", err)
+		}
+		if reveal {
+			r.Header.Set("Authorization", "Bearer let-me-see")
+		}
+		if ifNoneMatch != "" {
+			r.Header.Set("If-None-Match", ifNoneMatch)
+		}
+		resp, err := server.Client().Do(r)
+		if err != nil {
+			t.Fatalf("GET %s: %v", path, err)
+		}
+		defer resp.Body.Close()
+		body, _ := io.ReadAll(resp.Body)
+		return resp.StatusCode, resp.Header.Get("ETag"), string(body)
+	}
+
+	for _, path := range []string{"/v1/vms/" + id, "/v1/vms", "/v1/vms?fields=tags"} {
+		status, redactedTag, body := get(path, false, "")
+		if status != http.StatusOK || redactedTag == "" || strings.Contains(body, "hunter2") {
+			t.Fatalf("%s redacted: status %d etag %q body %s", path, status, redactedTag, body)
+		}
+		status, revealedTag, body := get(path, true, "")
+		if status != http.StatusOK || revealedTag == "" {
+			t.Fatalf("%s revealed: status %d etag %q", path, status, revealedTag)
+		}
+		if !strings.Contains(path, "fields") && !strings.Contains(body, "hunter2") {
+			t.Fatalf("%s revealed: expected secret in body %s", path, body)
+		}
+		if redactedTag == revealedTag {
+			t.Fatalf("%s: redacted and revealed responses share etag %s", path, redactedTag)
+		}
+
+		if status, tag, body := get(path, false, redactedTag); status != http.StatusNotModified || tag != redactedTag || body != "" {
+			t.Fatalf("%s: expected 304 for matching etag, got %d %q %q", path, status, tag, body)
+		}
+		if status, _, _ := get(path, false, `W/`+redactedTag); status != http.StatusNotModified {
+			t.Fatalf("%s: expected weak match to give 304, got %d", path, status)
+		}
+		if status, _, _ := get(path, true, redactedTag); status != http.StatusOK {
+			t.Fatalf("%s: revealed request answered 304 for the redacted etag", path)
+		}
+		if status, _, _ := get(path, false, revealedTag); status != http.StatusOK {
+			t.Fatalf("%s: redacted request answered 304 for the revealed etag", path)
+		}
+	}
+
+	_, before, _ := get("/v1/vms", false, "")
+	_, fieldsTag, _ := get("/v1/vms?fields=tags", false, "")
+	if before == fieldsTag {
+		t.Fatal("fields selection does not change the list etag")
+	}
+	meta, err := env.Store.ReadMeta(id)
+	if err != nil {
+		t.Fatalf("read meta: %v", err)
+	}
+	if _, err := env.Service.UpdateVM(context.Background(), id, &meta.Revision, model.UpdateVMRequest{Tags: map[string]string{"team": "a"}}); err != nil {
+		t.Fatalf("update vm: %v", err)
+	}
+	if status, _, _ := get("/v1/vms", false, before); status != http.StatusOK {
+		t.Fatalf("expected 200 after update, got %d", status)
+	}
+}
+
+func sep(path string) string {
+	if strings.Contains(path, "?") {
+		return "&"
+	}
+	return "?"
+}
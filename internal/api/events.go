@@ -0,0 +1,89 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"slices"
+	"time"
+
+	"github.com/labstack/echo/v4"
+)
+
+const sseHeartbeatInterval = 15 * time.Second
+
+// streamRoutes are the route patterns EndStreams ends.
+var streamRoutes = []string{
+	"/v1/events",
+	"/v1/vms/:id/console",
+	"/v1/vms/:id/logs",
+	"/v1/namespaces/:ns/vms/:id/console",
+	"/v1/namespaces/:ns/vms/:id/logs",
+}
+
+// EndStreams ends the long-lived /v1/events streams, console sessions and
+// log streams once done is cancelled, leaving other requests running. An upgrade uses it
+// to let a draining process finish its operations while stream clients
+// reconnect to the new one.
+func EndStreams(done context.Context) echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			if !slices.Contains(streamRoutes, c.Path()) {
+				return next(c)
+			}
+			ctx, cancel := context.WithCancel(c.Request().Context())
+			defer cancel()
+			stop := context.AfterFunc(done, cancel)
+			defer stop()
+			c.SetRequest(c.Request().WithContext(ctx))
+			return next(c)
+		}
+	}
+}
+
+// events streams store changes as server-sent events until the client
+// disconnects or the daemon shuts down.
+func (h *Handler) events(c echo.Context) error {
+	ctx := c.Request().Context()
+	h.logger.DebugContext(c.Request().Context(), "http events stream opened", "remoteAddr", c.Request().RemoteAddr)
+
+	events, err := h.service.Watch(ctx)
+	if err != nil {
+		return h.writeServiceError(c, err)
+	}
+
+	res := c.Response()
+	res.Header().Set("Content-Type", "text/event-stream")
+	res.Header().Set("Cache-Control", "no-cache")
+	res.Header().Set("Connection", "keep-alive")
+	res.WriteHeader(http.StatusOK)
+	res.Flush()
+
+	heartbeat := time.NewTicker(sseHeartbeatInterval)
+	defer heartbeat.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			h.logger.DebugContext(c.Request().Context(), "http events stream closed", "remoteAddr", c.Request().RemoteAddr)
+			return nil
+		case <-heartbeat.C:
+			if _, err := fmt.Fprint(res, ": heartbeat\n\n"); err != nil {
+				return nil
+			}
+			res.Flush()
+		case event, ok := <-events:
+			if !ok {
+				return nil
+			}
+			data, err := json.Marshal(event)
+			if err != nil {
+				return err
+			}
+			if _, err := fmt.Fprintf(res, "event: %s\ndata: %s\n\n", event.Type, data); err != nil {
+				return nil
+			}
+			res.Flush()
+		}
+	}
+}
@@ -1,65 +1,229 @@
 package api
 
 import (
+	"bytes"
+	"context"
+	"encoding/json"
 	"errors"
+	"fmt"
 	"log/slog"
 	"net/http"
 	"strconv"
+	"strings"
+	"time"
 
 	"github.com/labstack/echo/v4"
 
+	"github.com/alperreha/mergen-fire/internal/config"
+	"github.com/alperreha/mergen-fire/internal/logging"
 	"github.com/alperreha/mergen-fire/internal/manager"
 	"github.com/alperreha/mergen-fire/internal/model"
+	"github.com/alperreha/mergen-fire/internal/redact"
 )
 
 type Handler struct {
-	service *manager.Service
-	logger  *slog.Logger
+	service     *manager.Service
+	redactor    *redact.Redactor
+	revealToken string
+	logger      *slog.Logger
 }
 
-func Register(e *echo.Echo, service *manager.Service, logger *slog.Logger) {
+func Register(e *echo.Echo, service *manager.Service, redaction RedactionConfig, logger *slog.Logger) {
 	if logger == nil {
 		logger = slog.Default()
 	}
-	handler := &Handler{service: service, logger: logger}
+	handler := &Handler{
+		service:     service,
+		redactor:    redact.New(redaction.Allow),
+		revealToken: redaction.RevealToken,
+		logger:      logger,
+	}
 
 	v1 := e.Group("/v1")
 	v1.POST("/vms", handler.createVM)
+	v1.POST("/vms/adopt", handler.adoptVM)
+	v1.POST("/vms:batch", handler.batchVMs)
 	v1.POST("/vms/:id/start", handler.startVM)
 	v1.POST("/vms/:id/stop", handler.stopVM)
+	v1.POST("/vms/:id/restart", handler.restartVM)
+	v1.POST("/vms/:id/wake", handler.wakeVM)
+	v1.POST("/vms/:id/exec", handler.execVM)
+	v1.POST("/vms/activity", handler.reportActivity)
+	v1.POST("/vms/:id/pause", handler.pauseVM)
+	v1.POST("/vms/:id/resume", handler.resumeVM)
+	v1.POST("/vms/:id/snapshots", handler.createSnapshot)
+	v1.GET("/vms/:id/snapshots", handler.listSnapshots)
+	v1.DELETE("/vms/:id/snapshots/:snapshot", handler.deleteSnapshot)
+	v1.POST("/vms/:id/restore", handler.restoreSnapshot)
 	v1.DELETE("/vms/:id", handler.deleteVM)
 	v1.GET("/vms/:id", handler.getVM)
+	v1.PATCH("/vms/:id", handler.updateVM)
+	v1.POST("/vms/:id/recreate", handler.recreateVM)
 	v1.GET("/vms", handler.listVMs)
+	v1.GET("/vms/:id/history", handler.stateHistory)
+	v1.GET("/vms/:id/stats", handler.guestStats)
+	v1.GET("/vms/:id/metrics", handler.vmMetrics)
+	v1.GET("/vms/:id/console", handler.console)
+	v1.GET("/vms/:id/logs", handler.vmLogs)
+	v1.GET("/vms/:id/hooks/history", handler.hookHistory)
+	v1.POST("/vms/:id/hooks/test", handler.testHook)
+	v1.POST("/vms/:id/verify", handler.verifyArtifacts)
+	v1.POST("/vms/:id/unlock", handler.unlockVM)
+	v1.POST("/vms/:id/migrate", handler.migrateVM)
+	v1.POST("/migrations", handler.receiveVM)
+	v1.POST("/stacks", handler.createStack)
+	v1.GET("/stacks", handler.listStacks)
+	v1.GET("/stacks/:name", handler.getStack)
+	v1.POST("/stacks/:name/start", handler.startStack)
+	v1.POST("/stacks/:name/stop", handler.stopStack)
+	v1.DELETE("/stacks/:name", handler.deleteStack)
+	v1.GET("/ports", handler.listPortReservations)
+	v1.POST("/ports/reserve", handler.reservePort)
+	v1.POST("/ports/release", handler.releasePort)
+	v1.GET("/namespaces", handler.listNamespaces)
+	v1.GET("/namespaces/:ns", handler.getNamespace)
+	v1.PUT("/namespaces/:ns", handler.putNamespace)
+	v1.DELETE("/namespaces/:ns", handler.deleteNamespace)
+	v1.GET("/namespaces/:ns/vms", handler.listVMs)
+	v1.POST("/namespaces/:ns/vms", handler.createVM)
+	v1.GET("/namespaces/:ns/vms/:id", handler.inNamespace(handler.getVM))
+	v1.PATCH("/namespaces/:ns/vms/:id", handler.inNamespace(handler.updateVM))
+	v1.DELETE("/namespaces/:ns/vms/:id", handler.inNamespace(handler.deleteVM))
+	v1.POST("/namespaces/:ns/vms/:id/start", handler.inNamespace(handler.startVM))
+	v1.POST("/namespaces/:ns/vms/:id/stop", handler.inNamespace(handler.stopVM))
+	v1.POST("/namespaces/:ns/vms/:id/restart", handler.inNamespace(handler.restartVM))
+	v1.POST("/namespaces/:ns/vms/:id/pause", handler.inNamespace(handler.pauseVM))
+	v1.POST("/namespaces/:ns/vms/:id/resume", handler.inNamespace(handler.resumeVM))
+	v1.POST("/namespaces/:ns/vms/:id/exec", handler.inNamespace(handler.execVM))
+	v1.GET("/namespaces/:ns/vms/:id/history", handler.inNamespace(handler.stateHistory))
+	v1.GET("/namespaces/:ns/vms/:id/stats", handler.inNamespace(handler.guestStats))
+	v1.GET("/namespaces/:ns/vms/:id/metrics", handler.inNamespace(handler.vmMetrics))
+	v1.GET("/namespaces/:ns/vms/:id/console", handler.inNamespace(handler.console))
+	v1.GET("/namespaces/:ns/vms/:id/logs", handler.inNamespace(handler.vmLogs))
+	v1.GET("/namespaces/:ns/operations", handler.listOperations)
+	v1.GET("/namespaces/:ns/operations/:id", handler.getOperation)
+	v1.GET("/operations", handler.listOperations)
+	v1.GET("/operations/:id", handler.getOperation)
+	v1.GET("/templates", handler.listTemplates)
+	v1.GET("/templates/:name", handler.getTemplate)
+	v1.PUT("/templates/:name", handler.putTemplate)
+	v1.DELETE("/templates/:name", handler.deleteTemplate)
+	v1.GET("/kernels", handler.listKernels)
+	v1.GET("/kernels/:name", handler.getKernel)
+	v1.PUT("/kernels/:name", handler.putKernel)
+	v1.DELETE("/kernels/:name", handler.deleteKernel)
+	v1.GET("/host/diagnostics", handler.hostDiagnostics)
+	v1.GET("/host/capacity", handler.hostCapacity)
+	v1.GET("/usage", handler.usage)
+	v1.GET("/metrics", handler.vmMetricsTotals)
+	v1.GET("/events", handler.events)
+	v1.POST("/backup", handler.backup)
+	v1.POST("/fsck", handler.fsck)
+	v1.GET("/admin/breaker", handler.breakerState)
+	v1.POST("/admin/breaker/reset", handler.resetBreaker)
+}
+
+// RegisterAdmin mounts endpoints that act on the daemon rather than on VMs.
+func RegisterAdmin(e *echo.Echo, reload func(context.Context) (config.ReloadResult, error), levels *logging.Levels, logger *slog.Logger) {
+	if logger == nil {
+		logger = slog.Default()
+	}
+	e.POST("/v1/admin/reload", func(c echo.Context) error {
+		logger.DebugContext(c.Request().Context(), "http config reload", "method", c.Request().Method, "path", c.Request().URL.Path)
+		result, err := reload(c.Request().Context())
+		if err != nil {
+			return c.JSON(http.StatusBadRequest, errorResponse("invalid_config", err))
+		}
+		logger.InfoContext(c.Request().Context(), "http config reload success", "applied", len(result.Applied), "rejected", len(result.Rejected))
+		return c.JSON(http.StatusOK, result)
+	})
+	e.GET("/v1/admin/loglevel", func(c echo.Context) error {
+		return c.JSON(http.StatusOK, levels.Snapshot())
+	})
+	e.PUT("/v1/admin/loglevel", func(c echo.Context) error {
+		var req model.LogLevelRequest
+		if err := c.Bind(&req); err != nil {
+			return c.JSON(http.StatusBadRequest, errorResponse("bad_request", err))
+		}
+		if err := levels.Apply(req.Level, req.Components); err != nil {
+			return c.JSON(http.StatusBadRequest, errorResponse("bad_request", err))
+		}
+		snapshot := levels.Snapshot()
+		logger.InfoContext(c.Request().Context(), "log levels changed", "default", snapshot.Default, "overrides", snapshot.Overrides)
+		return c.JSON(http.StatusOK, snapshot)
+	})
 }
 
 func (h *Handler) createVM(c echo.Context) error {
-	h.logger.Debug("http create vm", "method", c.Request().Method, "path", c.Request().URL.Path)
+	h.logger.DebugContext(c.Request().Context(), "http create vm", "method", c.Request().Method, "path", c.Request().URL.Path)
 	var req model.CreateVMRequest
 	if err := c.Bind(&req); err != nil {
-		h.logger.Debug("http create vm bind failed", "error", err)
+		h.logger.DebugContext(c.Request().Context(), "http create vm bind failed", "error", err)
 		return c.JSON(http.StatusBadRequest, errorResponse("bad_request", err))
 	}
-	h.logger.Debug("http create vm payload parsed", "rootfs", req.RootFS, "kernel", req.Kernel, "vcpu", req.VCPU, "memMiB", req.MemMiB, "ports", len(req.Ports), "autoStart", req.AutoStart)
+	async, err := parseBool(c.QueryParam("async"))
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, errorResponse("bad_request", errors.New("async must be a boolean")))
+	}
+	if ns := c.Param("ns"); ns != "" {
+		if req.Namespace != "" && req.Namespace != ns {
+			return c.JSON(http.StatusBadRequest, errorResponse("bad_request", fmt.Errorf("namespace %q does not match the path's %q", req.Namespace, ns)))
+		}
+		req.Namespace = ns
+	}
+	req, err = h.service.ApplyTemplate(c.Request().Context(), req)
+	if err != nil {
+		return h.writeServiceError(c, err)
+	}
+	if async {
+		return h.createVMAsync(c, req)
+	}
+	h.logger.DebugContext(c.Request().Context(), "http create vm payload parsed", "template", req.Tags[manager.TagTemplate], "rootfs", req.RootFS, "kernel", req.Kernel, "vcpu", req.VCPU, "memMiB", req.MemMiB, "ports", len(req.Ports), "autoStart", req.AutoStart)
 
-	id, err := h.service.CreateVM(c.Request().Context(), req)
+	id, err := h.service.CreateVM(scheduledContext(c), req)
+	var placed *manager.PlacementError
+	if errors.As(err, &placed) {
+		return h.forwardCreate(c, req, placed.Host)
+	}
 	if err != nil {
 		return h.writeServiceError(c, err)
 	}
-	h.logger.Info("http create vm success", "vmID", id)
+	h.logger.InfoContext(c.Request().Context(), "http create vm success", "vmID", id)
 
-	return c.JSON(http.StatusCreated, map[string]any{
+	body := map[string]any{
 		"id":     id,
 		"status": "created",
+	}
+	if warnings := h.service.ImageEnvWarnings(c.Request().Context(), req); len(warnings) > 0 {
+		body["warnings"] = warnings
+	}
+	return c.JSON(http.StatusCreated, body)
+}
+
+func (h *Handler) adoptVM(c echo.Context) error {
+	h.logger.DebugContext(c.Request().Context(), "http adopt vm", "method", c.Request().Method, "path", c.Request().URL.Path)
+	var req model.AdoptVMRequest
+	if err := c.Bind(&req); err != nil {
+		return c.JSON(http.StatusBadRequest, errorResponse("bad_request", err))
+	}
+	id, err := h.service.AdoptVM(c.Request().Context(), req)
+	if err != nil {
+		return h.writeServiceError(c, err)
+	}
+	h.logger.InfoContext(c.Request().Context(), "http adopt vm success", "vmID", id, "unit", req.Unit)
+	return c.JSON(http.StatusCreated, map[string]any{
+		"id":     id,
+		"status": "adopted",
 	})
 }
 
 func (h *Handler) startVM(c echo.Context) error {
 	id := c.Param("id")
-	h.logger.Debug("http start vm", "vmID", id, "method", c.Request().Method, "path", c.Request().URL.Path)
+	h.logger.DebugContext(c.Request().Context(), "http start vm", "vmID", id, "method", c.Request().Method, "path", c.Request().URL.Path)
 	if err := h.service.StartVM(c.Request().Context(), id); err != nil {
 		return h.writeServiceError(c, err)
 	}
-	h.logger.Info("http start vm success", "vmID", id)
+	h.logger.InfoContext(c.Request().Context(), "http start vm success", "vmID", id)
 	return c.JSON(http.StatusOK, map[string]any{
 		"id":     id,
 		"status": "started",
@@ -68,29 +232,119 @@ func (h *Handler) startVM(c echo.Context) error {
 
 func (h *Handler) stopVM(c echo.Context) error {
 	id := c.Param("id")
-	h.logger.Debug("http stop vm", "vmID", id, "method", c.Request().Method, "path", c.Request().URL.Path)
+	h.logger.DebugContext(c.Request().Context(), "http stop vm", "vmID", id, "method", c.Request().Method, "path", c.Request().URL.Path)
 	if err := h.service.StopVM(c.Request().Context(), id); err != nil {
 		return h.writeServiceError(c, err)
 	}
-	h.logger.Info("http stop vm success", "vmID", id)
+	h.logger.InfoContext(c.Request().Context(), "http stop vm success", "vmID", id)
 	return c.JSON(http.StatusOK, map[string]any{
 		"id":     id,
 		"status": "stopped",
 	})
 }
 
+// wakeVM starts a VM stopped for idleness; the forwarder calls it when a
+// connection arrives for one.
+func (h *Handler) wakeVM(c echo.Context) error {
+	id := c.Param("id")
+	var req model.WakeVMRequest
+	if err := c.Bind(&req); err != nil {
+		return c.JSON(http.StatusBadRequest, errorResponse("bad_request", err))
+	}
+	h.logger.DebugContext(c.Request().Context(), "http wake vm", "vmID", id, "port", req.Port)
+	if err := h.service.WakeVM(c.Request().Context(), id, req); err != nil {
+		return h.writeServiceError(c, err)
+	}
+	return c.JSON(http.StatusOK, map[string]any{
+		"id":     id,
+		"status": "running",
+	})
+}
+
+// execVM answers 200 with the command's exit code whatever it is; errors
+// are for commands that could not be run.
+func (h *Handler) execVM(c echo.Context) error {
+	id := c.Param("id")
+	var req model.ExecRequest
+	if err := c.Bind(&req); err != nil {
+		return c.JSON(http.StatusBadRequest, errorResponse("bad_request", err))
+	}
+	h.logger.DebugContext(c.Request().Context(), "http exec vm", "vmID", id, "method", c.Request().Method, "path", c.Request().URL.Path, "timeoutSeconds", req.TimeoutSeconds)
+	result, err := h.service.ExecVM(c.Request().Context(), id, req)
+	if err != nil {
+		return h.writeServiceError(c, err)
+	}
+	return c.JSON(http.StatusOK, result)
+}
+
+// reportActivity records the VMs the forwarder routed traffic to.
+func (h *Handler) reportActivity(c echo.Context) error {
+	var req model.ActivityReport
+	if err := c.Bind(&req); err != nil {
+		return c.JSON(http.StatusBadRequest, errorResponse("bad_request", err))
+	}
+	h.service.RecordActivity(c.Request().Context(), req.IDs)
+	c.Response().WriteHeader(http.StatusNoContent)
+	return nil
+}
+
+func (h *Handler) restartVM(c echo.Context) error {
+	id := c.Param("id")
+	h.logger.DebugContext(c.Request().Context(), "http restart vm", "vmID", id, "method", c.Request().Method, "path", c.Request().URL.Path, "timeoutRaw", c.QueryParam("timeout"))
+	timeout, err := parseInt(c.QueryParam("timeout"))
+	if err != nil || timeout < 0 {
+		return c.JSON(http.StatusBadRequest, errorResponse("bad_request", errors.New("timeout must be a non-negative number of seconds")))
+	}
+	state, err := h.service.RestartVM(c.Request().Context(), id, time.Duration(timeout)*time.Second)
+	if err != nil {
+		return h.writeServiceError(c, err)
+	}
+	h.logger.InfoContext(c.Request().Context(), "http restart vm success", "vmID", id, "mainPID", state.MainPID)
+	return c.JSON(http.StatusOK, map[string]any{
+		"id":      id,
+		"status":  "restarted",
+		"systemd": state,
+	})
+}
+
+func (h *Handler) pauseVM(c echo.Context) error {
+	id := c.Param("id")
+	h.logger.DebugContext(c.Request().Context(), "http pause vm", "vmID", id, "method", c.Request().Method, "path", c.Request().URL.Path)
+	if err := h.service.PauseVM(c.Request().Context(), id); err != nil {
+		return h.writeServiceError(c, err)
+	}
+	h.logger.InfoContext(c.Request().Context(), "http pause vm success", "vmID", id)
+	return c.JSON(http.StatusOK, map[string]any{
+		"id":     id,
+		"status": "paused",
+	})
+}
+
+func (h *Handler) resumeVM(c echo.Context) error {
+	id := c.Param("id")
+	h.logger.DebugContext(c.Request().Context(), "http resume vm", "vmID", id, "method", c.Request().Method, "path", c.Request().URL.Path)
+	if err := h.service.ResumeVM(c.Request().Context(), id); err != nil {
+		return h.writeServiceError(c, err)
+	}
+	h.logger.InfoContext(c.Request().Context(), "http resume vm success", "vmID", id)
+	return c.JSON(http.StatusOK, map[string]any{
+		"id":     id,
+		"status": "running",
+	})
+}
+
 func (h *Handler) deleteVM(c echo.Context) error {
 	id := c.Param("id")
-	h.logger.Debug("http delete vm", "vmID", id, "method", c.Request().Method, "path", c.Request().URL.Path, "retainDataRaw", c.QueryParam("retainData"))
+	h.logger.DebugContext(c.Request().Context(), "http delete vm", "vmID", id, "method", c.Request().Method, "path", c.Request().URL.Path, "retainDataRaw", c.QueryParam("retainData"))
 	retainData, err := parseBool(c.QueryParam("retainData"))
 	if err != nil {
-		h.logger.Debug("http delete vm query parse failed", "vmID", id, "error", err)
+		h.logger.DebugContext(c.Request().Context(), "http delete vm query parse failed", "vmID", id, "error", err)
 		return c.JSON(http.StatusBadRequest, errorResponse("bad_request", err))
 	}
 	if err := h.service.DeleteVM(c.Request().Context(), id, retainData); err != nil {
 		return h.writeServiceError(c, err)
 	}
-	h.logger.Info("http delete vm success", "vmID", id, "retainData", retainData)
+	h.logger.InfoContext(c.Request().Context(), "http delete vm success", "vmID", id, "retainData", retainData)
 	return c.JSON(http.StatusOK, map[string]any{
 		"id":     id,
 		"status": "deleted",
@@ -99,42 +353,377 @@ func (h *Handler) deleteVM(c echo.Context) error {
 
 func (h *Handler) getVM(c echo.Context) error {
 	id := c.Param("id")
-	h.logger.Debug("http get vm", "vmID", id, "method", c.Request().Method, "path", c.Request().URL.Path)
+	h.logger.DebugContext(c.Request().Context(), "http get vm", "vmID", id, "method", c.Request().Method, "path", c.Request().URL.Path)
+	reveal, err := h.reveal(c)
+	if err != nil {
+		return h.writeRevealError(c, err)
+	}
 	vm, err := h.service.GetVM(c.Request().Context(), id)
 	if err != nil {
 		return h.writeServiceError(c, err)
 	}
-	h.logger.Debug("http get vm success", "vmID", id)
+	h.logger.DebugContext(c.Request().Context(), "http get vm success", "vmID", id)
+	if !reveal {
+		vm = h.redactVM(vm)
+	}
+	if notModified(c, vmETag(vm, reveal)) {
+		c.Response().WriteHeader(http.StatusNotModified)
+		return nil
+	}
 	return c.JSON(http.StatusOK, vm)
 }
 
+func (h *Handler) updateVM(c echo.Context) error {
+	id := c.Param("id")
+	h.logger.DebugContext(c.Request().Context(), "http update vm", "vmID", id, "method", c.Request().Method, "path", c.Request().URL.Path, "ifMatch", c.Request().Header.Get("If-Match"))
+	revision, err := parseRevision(c.Request().Header.Get("If-Match"))
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, errorResponse("bad_request", err))
+	}
+	var req model.UpdateVMRequest
+	if err := c.Bind(&req); err != nil {
+		h.logger.DebugContext(c.Request().Context(), "http update vm bind failed", "vmID", id, "error", err)
+		return c.JSON(http.StatusBadRequest, errorResponse("bad_request", err))
+	}
+
+	vm, err := h.service.UpdateVM(c.Request().Context(), id, revision, req)
+	if err != nil {
+		return h.writeServiceError(c, err)
+	}
+	h.logger.InfoContext(c.Request().Context(), "http update vm success", "vmID", id, "revision", vm.Revision)
+	c.Response().Header().Set("ETag", vmETag(vm, false))
+	return c.JSON(http.StatusOK, h.redactVM(vm))
+}
+
+func (h *Handler) recreateVM(c echo.Context) error {
+	id := c.Param("id")
+	h.logger.DebugContext(c.Request().Context(), "http recreate vm", "vmID", id, "method", c.Request().Method, "path", c.Request().URL.Path)
+	var req model.RecreateVMRequest
+	if err := c.Bind(&req); err != nil {
+		return c.JSON(http.StatusBadRequest, errorResponse("bad_request", err))
+	}
+	vm, err := h.service.RecreateVM(c.Request().Context(), id, req)
+	if err != nil {
+		return h.writeServiceError(c, err)
+	}
+	h.logger.InfoContext(c.Request().Context(), "http recreate vm success", "vmID", id, "newVMID", vm.ID, "preserveAllocations", req.PreserveAllocations)
+	return c.JSON(http.StatusOK, h.redactVM(vm))
+}
+
 func (h *Handler) listVMs(c echo.Context) error {
-	h.logger.Debug("http list vms", "method", c.Request().Method, "path", c.Request().URL.Path)
-	vms, err := h.service.ListVMs(c.Request().Context())
+	h.logger.DebugContext(c.Request().Context(), "http list vms", "method", c.Request().Method, "path", c.Request().URL.Path)
+	reveal, err := h.reveal(c)
+	if err != nil {
+		return h.writeRevealError(c, err)
+	}
+	filter, err := h.listFilter(c, reveal)
+	if err != nil {
+		return h.writeRevealError(c, err)
+	}
+	limit, err := parseInt(c.QueryParam("limit"))
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, errorResponse("bad_request", errors.New("limit must be a non-negative integer")))
+	}
+	page := model.VMListPage{Limit: limit, Cursor: c.QueryParam("cursor"), Sort: c.QueryParam("sort")}
+	vms, next, err := h.service.ListVMs(c.Request().Context(), filter, page)
+	if err != nil {
+		return h.writeServiceError(c, err)
+	}
+	h.logger.DebugContext(c.Request().Context(), "http list vms success", "count", len(vms), "more", next != "")
+	if !reveal {
+		for i := range vms {
+			vms[i] = h.redactVM(vms[i])
+		}
+	}
+	fields := c.QueryParam("fields")
+	if notModified(c, listETag(vms, fields, next, reveal)) {
+		c.Response().WriteHeader(http.StatusNotModified)
+		return nil
+	}
+	body := map[string]any{"items": vms}
+	if fields != "" {
+		items, err := projectFields(vms, strings.Split(fields, ","))
+		if err != nil {
+			return c.JSON(http.StatusInternalServerError, errorResponse("internal_error", err))
+		}
+		body["items"] = items
+	}
+	if next != "" {
+		body["nextCursor"] = next
+	}
+	return c.JSON(http.StatusOK, body)
+}
+
+// listFilter reads ?namespace=, or the path's namespace, ?tag=key:value
+// (repeatable) and ?metadata.<path>=value. Filtering on a metadata key that
+// is redacted would reveal its value one guess at a time, so it needs
+// reveal like the value itself.
+func (h *Handler) listFilter(c echo.Context, reveal bool) (model.VMFilter, error) {
+	filter := model.VMFilter{Namespace: c.QueryParam("namespace")}
+	if ns := c.Param("ns"); ns != "" {
+		filter.Namespace = ns
+	}
+	query := c.Request().URL.Query()
+	for _, raw := range query["tag"] {
+		key, value, ok := strings.Cut(raw, ":")
+		if !ok || key == "" {
+			return model.VMFilter{}, fmt.Errorf("tag filter %q must be key:value", raw)
+		}
+		if filter.Tags == nil {
+			filter.Tags = map[string]string{}
+		}
+		filter.Tags[key] = value
+	}
+	for param, values := range query {
+		path, ok := strings.CutPrefix(param, "metadata.")
+		if !ok {
+			continue
+		}
+		if path == "" || len(values) != 1 {
+			return model.VMFilter{}, fmt.Errorf("metadata filter %q needs a key and one value", param)
+		}
+		if !reveal {
+			for _, key := range strings.Split(path, ".") {
+				if h.redactor.Sensitive(key) {
+					return model.VMFilter{}, fmt.Errorf("%w: filtering on redacted metadata %q", errRevealForbidden, path)
+				}
+			}
+		}
+		if filter.Metadata == nil {
+			filter.Metadata = map[string]string{}
+		}
+		filter.Metadata[path] = values[0]
+	}
+	return filter, nil
+}
+
+// projectFields keeps only the named top-level summary fields of each VM,
+// plus its id. Unknown names select nothing.
+func projectFields(vms []model.VMSummary, fields []string) ([]map[string]json.RawMessage, error) {
+	keep := map[string]bool{"id": true}
+	for _, field := range fields {
+		keep[strings.TrimSpace(field)] = true
+	}
+	items := make([]map[string]json.RawMessage, 0, len(vms))
+	for _, vm := range vms {
+		body, err := json.Marshal(vm)
+		if err != nil {
+			return nil, err
+		}
+		var all map[string]json.RawMessage
+		if err := json.Unmarshal(body, &all); err != nil {
+			return nil, err
+		}
+		item := make(map[string]json.RawMessage, len(keep))
+		for key, value := range all {
+			if keep[key] {
+				item[key] = value
+			}
+		}
+		items = append(items, item)
+	}
+	return items, nil
+}
+
+func (h *Handler) stateHistory(c echo.Context) error {
+	id := c.Param("id")
+	h.logger.DebugContext(c.Request().Context(), "http state history", "vmID", id, "method", c.Request().Method, "path", c.Request().URL.Path, "limitRaw", c.QueryParam("limit"))
+	limit, err := parseInt(c.QueryParam("limit"))
+	if err != nil || limit < 0 {
+		h.logger.DebugContext(c.Request().Context(), "http state history query parse failed", "vmID", id, "error", err)
+		return c.JSON(http.StatusBadRequest, errorResponse("bad_request", errors.New("limit must be a non-negative integer")))
+	}
+	items, err := h.service.StateHistory(c.Request().Context(), id, limit)
+	if err != nil {
+		return h.writeServiceError(c, err)
+	}
+	h.logger.DebugContext(c.Request().Context(), "http state history success", "vmID", id, "count", len(items))
+	return c.JSON(http.StatusOK, map[string]any{"items": items})
+}
+
+func (h *Handler) guestStats(c echo.Context) error {
+	id := c.Param("id")
+	h.logger.DebugContext(c.Request().Context(), "http guest stats", "vmID", id, "method", c.Request().Method, "path", c.Request().URL.Path)
+	stats, err := h.service.GuestStats(c.Request().Context(), id)
+	if err != nil {
+		return h.writeServiceError(c, err)
+	}
+	return c.JSON(http.StatusOK, stats)
+}
+
+func (h *Handler) vmMetrics(c echo.Context) error {
+	id := c.Param("id")
+	h.logger.DebugContext(c.Request().Context(), "http vm metrics", "vmID", id, "method", c.Request().Method, "path", c.Request().URL.Path)
+	metrics, err := h.service.VMMetrics(c.Request().Context(), id)
 	if err != nil {
 		return h.writeServiceError(c, err)
 	}
-	h.logger.Debug("http list vms success", "count", len(vms))
-	return c.JSON(http.StatusOK, map[string]any{"items": vms})
+	return c.JSON(http.StatusOK, metrics)
+}
+
+func (h *Handler) vmMetricsTotals(c echo.Context) error {
+	h.logger.DebugContext(c.Request().Context(), "http vm metrics totals", "method", c.Request().Method, "path", c.Request().URL.Path)
+	return c.JSON(http.StatusOK, h.service.VMMetricsTotals(c.Request().Context()))
+}
+
+func (h *Handler) hookHistory(c echo.Context) error {
+	id := c.Param("id")
+	h.logger.DebugContext(c.Request().Context(), "http hook history", "vmID", id, "method", c.Request().Method, "path", c.Request().URL.Path, "limitRaw", c.QueryParam("limit"))
+	limit, err := parseInt(c.QueryParam("limit"))
+	if err != nil || limit < 0 {
+		h.logger.DebugContext(c.Request().Context(), "http hook history query parse failed", "vmID", id, "error", err)
+		return c.JSON(http.StatusBadRequest, errorResponse("bad_request", errors.New("limit must be a non-negative integer")))
+	}
+	reveal, err := h.reveal(c)
+	if err != nil {
+		return h.writeRevealError(c, err)
+	}
+	items, err := h.service.HookHistory(c.Request().Context(), id, limit)
+	if err != nil {
+		return h.writeServiceError(c, err)
+	}
+	h.logger.DebugContext(c.Request().Context(), "http hook history success", "vmID", id, "count", len(items))
+	if !reveal {
+		items = h.redactHookHistory(items)
+	}
+	return c.JSON(http.StatusOK, map[string]any{"items": items})
+}
+
+func (h *Handler) testHook(c echo.Context) error {
+	id := c.Param("id")
+	h.logger.DebugContext(c.Request().Context(), "http hook test", "vmID", id, "method", c.Request().Method, "path", c.Request().URL.Path)
+	var req model.HookTestRequest
+	if err := c.Bind(&req); err != nil {
+		h.logger.DebugContext(c.Request().Context(), "http hook test bind failed", "vmID", id, "error", err)
+		return c.JSON(http.StatusBadRequest, errorResponse("bad_request", err))
+	}
+	result, err := h.service.TestHook(c.Request().Context(), id, req)
+	if err != nil {
+		return h.writeServiceError(c, err)
+	}
+	h.logger.DebugContext(c.Request().Context(), "http hook test success", "vmID", id, "event", result.Event, "dryRun", result.DryRun)
+	return c.JSON(http.StatusOK, h.redactHookTest(result))
+}
+
+func (h *Handler) backup(c echo.Context) error {
+	h.logger.DebugContext(c.Request().Context(), "http backup", "method", c.Request().Method, "path", c.Request().URL.Path, "includeDataRaw", c.QueryParam("includeData"))
+	includeData, err := parseBool(c.QueryParam("includeData"))
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, errorResponse("bad_request", errors.New("includeData must be a boolean")))
+	}
+
+	// Buffer so a failure mid-way still yields a JSON error instead of a truncated archive.
+	var buf bytes.Buffer
+	if err := h.service.Backup(c.Request().Context(), &buf, includeData); err != nil {
+		return h.writeServiceError(c, err)
+	}
+
+	filename := fmt.Sprintf("mergen-backup-%s.tar.gz", time.Now().UTC().Format("20060102T150405Z"))
+	res := c.Response()
+	res.Header().Set("Content-Type", "application/gzip")
+	res.Header().Set("Content-Disposition", `attachment; filename="`+filename+`"`)
+	res.Header().Set("Content-Length", strconv.Itoa(buf.Len()))
+	res.WriteHeader(http.StatusOK)
+	_, err = buf.WriteTo(res)
+	h.logger.InfoContext(c.Request().Context(), "http backup success", "bytes", res.Size, "includeData", includeData)
+	return err
+}
+
+func (h *Handler) fsck(c echo.Context) error {
+	h.logger.DebugContext(c.Request().Context(), "http fsck", "method", c.Request().Method, "path", c.Request().URL.Path, "dryRunRaw", c.QueryParam("dryRun"))
+	dryRun, err := parseBool(c.QueryParam("dryRun"))
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, errorResponse("bad_request", errors.New("dryRun must be a boolean")))
+	}
+	report, err := h.service.Fsck(c.Request().Context(), dryRun)
+	if err != nil {
+		return h.writeServiceError(c, err)
+	}
+	h.logger.InfoContext(c.Request().Context(), "http fsck success", "checked", report.Checked, "issues", len(report.Issues), "quarantined", len(report.Quarantined))
+	return c.JSON(http.StatusOK, report)
+}
+
+// hostDiagnostics answers 200 even when checks fail; the report's ok field
+// says whether the host can run VMs.
+func (h *Handler) hostDiagnostics(c echo.Context) error {
+	h.logger.DebugContext(c.Request().Context(), "http host diagnostics", "method", c.Request().Method, "path", c.Request().URL.Path)
+	report, err := h.service.HostDiagnostics(c.Request().Context())
+	if err != nil {
+		return h.writeServiceError(c, err)
+	}
+	return c.JSON(http.StatusOK, report)
+}
+
+func (h *Handler) hostCapacity(c echo.Context) error {
+	h.logger.DebugContext(c.Request().Context(), "http host capacity", "method", c.Request().Method, "path", c.Request().URL.Path)
+	capacity, err := h.service.HostCapacity(c.Request().Context())
+	if err != nil {
+		return h.writeServiceError(c, err)
+	}
+	return c.JSON(http.StatusOK, capacity)
+}
+
+func (h *Handler) verifyArtifacts(c echo.Context) error {
+	id := c.Param("id")
+	h.logger.DebugContext(c.Request().Context(), "http verify artifacts", "vmID", id, "method", c.Request().Method, "path", c.Request().URL.Path, "recordRaw", c.QueryParam("record"))
+	record, err := parseBool(c.QueryParam("record"))
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, errorResponse("bad_request", errors.New("record must be a boolean")))
+	}
+	report, err := h.service.VerifyArtifacts(c.Request().Context(), id, record)
+	if err != nil {
+		return h.writeServiceError(c, err)
+	}
+	h.logger.InfoContext(c.Request().Context(), "http verify artifacts success", "vmID", id, "ok", report.OK, "recorded", report.Recorded)
+	return c.JSON(http.StatusOK, report)
+}
+
+func (h *Handler) unlockVM(c echo.Context) error {
+	id := c.Param("id")
+	h.logger.DebugContext(c.Request().Context(), "http unlock vm", "vmID", id, "method", c.Request().Method, "path", c.Request().URL.Path, "forceRaw", c.QueryParam("force"))
+	force, err := parseBool(c.QueryParam("force"))
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, errorResponse("bad_request", errors.New("force must be a boolean")))
+	}
+	status, err := h.service.UnlockVM(c.Request().Context(), id, force)
+	if err != nil {
+		return h.writeServiceError(c, err)
+	}
+	h.logger.InfoContext(c.Request().Context(), "http unlock vm success", "vmID", id, "held", status.Held, "broken", status.Broken)
+	return c.JSON(http.StatusOK, status)
 }
 
 func (h *Handler) writeServiceError(c echo.Context, err error) error {
+	status, code := serviceErrorStatus(err)
+	if status == http.StatusInternalServerError {
+		h.logger.ErrorContext(c.Request().Context(), "http request failed", "status", status, "error", err)
+	} else {
+		h.logger.WarnContext(c.Request().Context(), "http request failed", "status", status, "error", err)
+	}
+	return c.JSON(status, errorResponse(code, err))
+}
+
+// serviceErrorStatus maps a manager error to its HTTP status and error code.
+func serviceErrorStatus(err error) (int, string) {
 	switch {
 	case errors.Is(err, manager.ErrInvalidRequest):
-		h.logger.Warn("http request failed", "status", http.StatusBadRequest, "error", err)
-		return c.JSON(http.StatusBadRequest, errorResponse("bad_request", err))
+		return http.StatusBadRequest, "bad_request"
 	case errors.Is(err, manager.ErrNotFound):
-		h.logger.Warn("http request failed", "status", http.StatusNotFound, "error", err)
-		return c.JSON(http.StatusNotFound, errorResponse("not_found", err))
+		return http.StatusNotFound, "not_found"
 	case errors.Is(err, manager.ErrConflict):
-		h.logger.Warn("http request failed", "status", http.StatusConflict, "error", err)
-		return c.JSON(http.StatusConflict, errorResponse("conflict", err))
+		return http.StatusConflict, "conflict"
+	case errors.Is(err, manager.ErrPreconditionFailed):
+		return http.StatusPreconditionFailed, "precondition_failed"
+	case errors.Is(err, manager.ErrPreconditionRequired):
+		return http.StatusPreconditionRequired, "precondition_required"
 	case errors.Is(err, manager.ErrUnavailable):
-		h.logger.Warn("http request failed", "status", http.StatusServiceUnavailable, "error", err)
-		return c.JSON(http.StatusServiceUnavailable, errorResponse("dependency_unavailable", err))
+		return http.StatusServiceUnavailable, "dependency_unavailable"
+	case errors.Is(err, manager.ErrQuotaExceeded):
+		return http.StatusForbidden, "quota_exceeded"
+	case errors.Is(err, manager.ErrNoCapacity):
+		return http.StatusConflict, "insufficient_capacity"
 	default:
-		h.logger.Error("http request failed", "status", http.StatusInternalServerError, "error", err)
-		return c.JSON(http.StatusInternalServerError, errorResponse("internal_error", err))
+		return http.StatusInternalServerError, "internal_error"
 	}
 }
 
@@ -151,3 +740,10 @@ func parseBool(value string) (bool, error) {
 	}
 	return strconv.ParseBool(value)
 }
+
+func parseInt(value string) (int, error) {
+	if value == "" {
+		return 0, nil
+	}
+	return strconv.Atoi(value)
+}
@@ -0,0 +1,109 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+
+	"github.com/labstack/echo/v4"
+
+	"github.com/alperreha/mergen-fire/internal/manager"
+	"github.com/alperreha/mergen-fire/internal/model"
+)
+
+// createVMAsync queues req as a create job and answers 202 with the job;
+// Location names where to poll it. A VM scheduled onto another host is
+// forwarded there by the job.
+func (h *Handler) createVMAsync(c echo.Context, req model.CreateVMRequest) error {
+	namespace := req.Namespace
+	if namespace == "" {
+		namespace = model.DefaultNamespace
+	}
+	header := peerHeader(c)
+	job, err := h.service.StartJob(scheduledContext(c), "create", namespace, jobErrorCode, func(ctx context.Context) (string, error) {
+		id, err := h.service.CreateVM(ctx, req)
+		var placed *manager.PlacementError
+		if errors.As(err, &placed) {
+			manager.ReportJobProgress(ctx, "forwarding to "+placed.Host.Name, "")
+			return h.createOn(ctx, header, req, placed.Host)
+		}
+		return id, err
+	})
+	if err != nil {
+		return h.writeServiceError(c, err)
+	}
+	location := "/v1/operations/" + job.ID
+	if ns := c.Param("ns"); ns != "" {
+		location = "/v1/namespaces/" + ns + "/operations/" + job.ID
+	}
+	c.Response().Header().Set("Location", location)
+	return c.JSON(http.StatusAccepted, job)
+}
+
+// peerError is a create another host refused; its code stands for the
+// job's error.
+type peerError struct {
+	host    string
+	code    string
+	message string
+}
+
+func (e *peerError) Error() string {
+	return fmt.Sprintf("%s: %s", e.host, e.message)
+}
+
+// createOn creates req on host, which it was scheduled onto, and returns
+// the new VM's id.
+func (h *Handler) createOn(ctx context.Context, header http.Header, req model.CreateVMRequest, host model.HostInfo) (string, error) {
+	resp, data, err := h.sendCreate(ctx, header, req, host)
+	if err != nil {
+		return "", err
+	}
+	var body struct {
+		ID      string `json:"id"`
+		Error   string `json:"error"`
+		Message string `json:"message"`
+	}
+	if err := json.Unmarshal(data, &body); err != nil {
+		return "", fmt.Errorf("%w: response from %s: %v", manager.ErrUnavailable, host.Name, err)
+	}
+	if resp.StatusCode != http.StatusCreated {
+		return "", &peerError{host: host.Name, code: body.Error, message: body.Message}
+	}
+	return body.ID, nil
+}
+
+func jobErrorCode(err error) string {
+	var peer *peerError
+	if errors.As(err, &peer) && peer.code != "" {
+		return peer.code
+	}
+	_, code := serviceErrorStatus(err)
+	return code
+}
+
+func (h *Handler) getOperation(c echo.Context) error {
+	job, err := h.service.GetJob(c.Request().Context(), c.Param("id"))
+	if err != nil {
+		return h.writeServiceError(c, err)
+	}
+	if ns := c.Param("ns"); ns != "" && job.Namespace != ns {
+		return h.writeServiceError(c, fmt.Errorf("%w: job %s", manager.ErrNotFound, job.ID))
+	}
+	return c.JSON(http.StatusOK, job)
+}
+
+// listOperations lists the jobs of ?namespace= or the path's namespace.
+func (h *Handler) listOperations(c echo.Context) error {
+	namespace := c.QueryParam("namespace")
+	if ns := c.Param("ns"); ns != "" {
+		namespace = ns
+	}
+	jobs, err := h.service.ListJobs(c.Request().Context(), namespace)
+	if err != nil {
+		return h.writeServiceError(c, err)
+	}
+	return c.JSON(http.StatusOK, map[string]any{"items": jobs})
+}
@@ -0,0 +1,83 @@
+package api_test
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/alperreha/mergen-fire/internal/model"
+	"github.com/alperreha/mergen-fire/internal/testsupport"
+)
+
+func TestAsyncCreate(t *testing.T) {
+	env := testsupport.NewEnv(t)
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+	go env.Service.RunJobs(ctx, 1)
+
+	wait := func(path string) model.Job {
+		t.Helper()
+		deadline := time.Now().Add(10 * time.Second)
+		for {
+			status, body := env.Request(t, http.MethodGet, path, nil)
+			var job model.Job
+			if status != http.StatusOK || json.Unmarshal(body, &job) != nil {
+				t.Fatalf("poll %s: status %d body %s", path, status, body)
+			}
+			if job.FinishedAt != nil {
+				return job
+			}
+			if time.Now().After(deadline) {
+				t.Fatalf("job still %s at stage %q", job.Status, job.Stage)
+			}
+			time.Sleep(20 * time.Millisecond)
+		}
+	}
+
+	req := env.Artifacts.CreateRequest()
+	req.AutoStart = true
+	status, body := env.Request(t, http.MethodPost, "/v1/vms?async=true", req)
+	var queued model.Job
+	if status != http.StatusAccepted || json.Unmarshal(body, &queued) != nil || queued.ID == "" || queued.Kind != "create" {
+		t.Fatalf("async create: status %d body %s", status, body)
+	}
+	job := wait("/v1/operations/" + queued.ID)
+	if job.Status != model.JobSucceeded || job.VMID == "" || job.Namespace != model.DefaultNamespace || job.StartedAt == nil {
+		t.Fatalf("unexpected finished job: %+v", job)
+	}
+	if status, body := env.Request(t, http.MethodGet, "/v1/vms/"+job.VMID, nil); status != http.StatusOK {
+		t.Fatalf("vm of the job: status %d body %s", status, body)
+	}
+	if active, _ := env.Units.IsActive(ctx, job.VMID); !active {
+		t.Fatalf("auto-started vm %s is not active", job.VMID)
+	}
+	if status, _ := env.Request(t, http.MethodGet, "/v1/namespaces/default/operations/"+job.ID, nil); status != http.StatusOK {
+		t.Fatalf("job under its namespace: status %d", status)
+	}
+	if status, _ := env.Request(t, http.MethodGet, "/v1/namespaces/team-a/operations/"+job.ID, nil); status != http.StatusNotFound {
+		t.Fatalf("job under another namespace: status %d, want 404", status)
+	}
+
+	req.RootFS = "/missing/rootfs.ext4"
+	status, body = env.Request(t, http.MethodPost, "/v1/vms?async=true", req)
+	if status != http.StatusAccepted || json.Unmarshal(body, &queued) != nil {
+		t.Fatalf("async create with a missing rootfs: status %d body %s", status, body)
+	}
+	job = wait("/v1/operations/" + queued.ID)
+	if job.Status != model.JobFailed || job.Error != "bad_request" || job.Message == "" || job.VMID != "" {
+		t.Fatalf("unexpected failed job: %+v", job)
+	}
+
+	status, body = env.Request(t, http.MethodGet, "/v1/operations", nil)
+	var list struct {
+		Items []model.Job `json:"items"`
+	}
+	if status != http.StatusOK || json.Unmarshal(body, &list) != nil || len(list.Items) != 2 || list.Items[0].ID != job.ID {
+		t.Fatalf("list jobs: status %d body %s", status, body)
+	}
+	if status, _ := env.Request(t, http.MethodGet, "/v1/operations/missing", nil); status != http.StatusNotFound {
+		t.Fatalf("missing job: status %d, want 404", status)
+	}
+}
@@ -0,0 +1,56 @@
+package api
+
+import (
+	"net/http"
+
+	"github.com/labstack/echo/v4"
+
+	"github.com/alperreha/mergen-fire/internal/model"
+)
+
+func (h *Handler) listKernels(c echo.Context) error {
+	h.logger.DebugContext(c.Request().Context(), "http list kernels", "method", c.Request().Method, "path", c.Request().URL.Path)
+	kernels, err := h.service.ListKernels(c.Request().Context())
+	if err != nil {
+		return h.writeServiceError(c, err)
+	}
+	return c.JSON(http.StatusOK, map[string]any{"items": kernels})
+}
+
+func (h *Handler) getKernel(c echo.Context) error {
+	name := c.Param("name")
+	kernel, err := h.service.GetKernel(c.Request().Context(), name)
+	if err != nil {
+		return h.writeServiceError(c, err)
+	}
+	return c.JSON(http.StatusOK, kernel)
+}
+
+// putKernel registers or replaces the kernel named in the path.
+func (h *Handler) putKernel(c echo.Context) error {
+	name := c.Param("name")
+	h.logger.DebugContext(c.Request().Context(), "http put kernel", "kernel", name, "method", c.Request().Method, "path", c.Request().URL.Path)
+	var req model.Kernel
+	if err := c.Bind(&req); err != nil {
+		return c.JSON(http.StatusBadRequest, errorResponse("bad_request", err))
+	}
+	req.Name = name
+	kernel, err := h.service.PutKernel(c.Request().Context(), req)
+	if err != nil {
+		return h.writeServiceError(c, err)
+	}
+	h.logger.InfoContext(c.Request().Context(), "http put kernel success", "kernel", kernel.Name, "path", kernel.Path, "arch", kernel.Arch)
+	return c.JSON(http.StatusOK, kernel)
+}
+
+func (h *Handler) deleteKernel(c echo.Context) error {
+	name := c.Param("name")
+	if err := h.service.DeleteKernel(c.Request().Context(), name); err != nil {
+		return h.writeServiceError(c, err)
+	}
+	h.logger.InfoContext(c.Request().Context(), "http delete kernel success", "kernel", name)
+	return c.JSON(http.StatusOK, map[string]any{
+		"name":   name,
+		"status": "deleted",
+	})
+}
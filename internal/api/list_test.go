@@ -0,0 +1,82 @@
+package api_test
+
+import (
+	"encoding/json"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/labstack/echo/v4"
+
+	"github.com/alperreha/mergen-fire/internal/api"
+	"github.com/alperreha/mergen-fire/internal/testsupport"
+)
+
+func TestListVMsFilters(t *testing.T) {
+	env := testsupport.NewEnv(t)
+	web := env.Artifacts.CreateRequest()
+	web.Tags = map[string]string{"app": "web"}
+	web.Metadata = map[string]any{"image": "nginx", "dbPassword": "hunter2"}
+	webID := env.CreateVM(t, web)
+	worker := env.Artifacts.CreateRequest()
+	worker.Tags = map[string]string{"app": "worker"}
+	worker.Metadata = map[string]any{"image": "nginx"}
+	env.CreateVM(t, worker)
+
+	e := echo.New()
+	api.Register(e, env.Service, api.RedactionConfig{RevealToken: "let-me-see"}, slog.New(slog.NewTextHandler(io.Discard, nil)))
+	server := httptest.NewServer(e)
+	defer server.Close()
+
+	list := func(query string, reveal bool) (int, []string) {
+		t.Helper()
+		r, err := http.NewRequest(http.MethodGet, server.URL+"/v1/vms?"+query, nil)
+		if err != nil {
+			t.Fatalf("build request: %v", err)
+		}
+		if reveal {
+			r.Header.Set("Authorization", "Bearer let-me-see")
+		}
+		resp, err := server.Client().Do(r)
+		if err != nil {
+			t.Fatalf("GET %s: %v", query, err)
+		}
+		defer resp.Body.Close()
+		var out struct {
+			Items []struct {
+				ID string `json:"id"`
+			} `json:"items"`
+		}
+		if resp.StatusCode == http.StatusOK {
+			if err := json.NewDecoder(resp.Body).Decode(&out); err != nil {
+				t.Fatalf("decode %s: %v", query, err)
+			}
+		}
+		ids := make([]string, 0, len(out.Items))
+		for _, item := range out.Items {
+			ids = append(ids, item.ID)
+		}
+		return resp.StatusCode, ids
+	}
+
+	if status, ids := list("metadata.image=nginx", false); status != http.StatusOK || len(ids) != 2 {
+		t.Fatalf("metadata filter: status %d ids %v", status, ids)
+	}
+	if status, ids := list("tag=app:web&metadata.image=nginx&fields=tags", false); status != http.StatusOK || len(ids) != 1 || ids[0] != webID {
+		t.Fatalf("tag and metadata filter: status %d ids %v, want [%s]", status, ids, webID)
+	}
+	if status, ids := list("tag=app:db", false); status != http.StatusOK || len(ids) != 0 {
+		t.Fatalf("unmatched tag: status %d ids %v", status, ids)
+	}
+	if status, _ := list("tag=app", false); status != http.StatusBadRequest {
+		t.Fatalf("tag without value: expected 400, got %d", status)
+	}
+	if status, _ := list("metadata.dbPassword=hunter2", false); status != http.StatusForbidden {
+		t.Fatalf("redacted key without reveal: expected 403, got %d", status)
+	}
+	if status, ids := list("metadata.dbPassword=hunter2&reveal=true", true); status != http.StatusOK || len(ids) != 1 {
+		t.Fatalf("redacted key with reveal: status %d ids %v", status, ids)
+	}
+}
@@ -0,0 +1,94 @@
+package api
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+
+	"github.com/labstack/echo/v4"
+
+	"github.com/alperreha/mergen-fire/internal/firecracker"
+	"github.com/alperreha/mergen-fire/internal/model"
+)
+
+// maxLogLine bounds one NDJSON line; longer ones end the stream.
+const maxLogLine = 1 << 20
+
+type logLine struct {
+	File string `json:"file"`
+	Line string `json:"line"`
+}
+
+// vmLogs streams a file of the VM's logs dir as plain text or, with
+// ?format=ndjson, as one JSON object per line. With ?follow=true the
+// stream stays open for new output until the client disconnects.
+func (h *Handler) vmLogs(c echo.Context) error {
+	id := c.Param("id")
+	h.logger.DebugContext(c.Request().Context(), "http vm logs", "vmID", id, "method", c.Request().Method, "path", c.Request().URL.Path, "file", c.QueryParam("file"), "tailRaw", c.QueryParam("tail"), "followRaw", c.QueryParam("follow"))
+	tail, err := parseInt(c.QueryParam("tail"))
+	if err != nil || tail < 0 {
+		return c.JSON(http.StatusBadRequest, errorResponse("bad_request", errors.New("tail must be a non-negative integer")))
+	}
+	follow, err := parseBool(c.QueryParam("follow"))
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, errorResponse("bad_request", errors.New("follow must be a boolean")))
+	}
+	format := c.QueryParam("format")
+	if format != "" && format != "text" && format != "ndjson" {
+		return c.JSON(http.StatusBadRequest, errorResponse("bad_request", fmt.Errorf("unknown format %q, expected text or ndjson", format)))
+	}
+	req := model.VMLogsRequest{File: c.QueryParam("file"), Tail: tail, Follow: follow}
+	logs, err := h.service.VMLogs(c.Request().Context(), id, req)
+	if err != nil {
+		return h.writeServiceError(c, err)
+	}
+	defer logs.Close()
+
+	res := c.Response()
+	res.Header().Set("Cache-Control", "no-cache")
+	if format == "ndjson" {
+		res.Header().Set("Content-Type", "application/x-ndjson")
+	} else {
+		res.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	}
+	res.WriteHeader(http.StatusOK)
+	// Whatever was written goes out before waiting for more.
+	reader := &flushingReader{r: logs, flush: res.Flush}
+
+	if format != "ndjson" {
+		_, _ = io.Copy(res, reader)
+		return nil
+	}
+	file := req.File
+	if file == "" {
+		file = firecracker.SerialLogName
+	}
+	scanner := bufio.NewScanner(reader)
+	scanner.Buffer(make([]byte, 0, 4096), maxLogLine)
+	encoder := json.NewEncoder(res)
+	for scanner.Scan() {
+		if err := encoder.Encode(logLine{File: file, Line: scanner.Text()}); err != nil {
+			return nil
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		h.logger.WarnContext(c.Request().Context(), "http vm logs stream ended", "vmID", id, "error", err)
+	}
+	res.Flush()
+	return nil
+}
+
+// flushingReader flushes the response each time the stream is about to
+// read, and so possibly wait for, more log output.
+type flushingReader struct {
+	r     io.Reader
+	flush func()
+}
+
+func (f *flushingReader) Read(p []byte) (int, error) {
+	f.flush()
+	return f.r.Read(p)
+}
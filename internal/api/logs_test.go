@@ -0,0 +1,81 @@
+package api_test
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/alperreha/mergen-fire/internal/testsupport"
+)
+
+func TestVMLogsNDJSONFollow(t *testing.T) {
+	env := testsupport.NewEnv(t)
+	id := env.CreateVM(t, env.Artifacts.CreateRequest())
+	meta, err := env.Store.ReadMeta(id)
+	if err != nil {
+		t.Fatalf("read meta: %v", err)
+	}
+	if err := os.MkdirAll(meta.Paths.LogsDir, 0o755); err != nil {
+		t.Fatalf("create logs dir: %v", err)
+	}
+	serial := filepath.Join(meta.Paths.LogsDir, "serial.log")
+	if err := os.WriteFile(serial, []byte("booting\nmounting root\n"), 0o644); err != nil {
+		t.Fatalf("write serial log: %v", err)
+	}
+
+	if status, body := env.Request(t, http.MethodGet, "/v1/vms/"+id+"/logs?tail=1", nil); status != http.StatusOK || string(body) != "mounting root\n" {
+		t.Fatalf("tail: status %d body %q", status, body)
+	}
+	if status, _ := env.Request(t, http.MethodGet, "/v1/vms/"+id+"/logs?tail=-1", nil); status != http.StatusBadRequest {
+		t.Fatalf("negative tail: status %d, want 400", status)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, env.API.URL+"/v1/vms/"+id+"/logs?tail=1&follow=true&format=ndjson", nil)
+	if err != nil {
+		t.Fatalf("build request: %v", err)
+	}
+	resp, err := env.API.Client().Do(req)
+	if err != nil {
+		t.Fatalf("follow logs: %v", err)
+	}
+	defer resp.Body.Close()
+	if ct := resp.Header.Get("Content-Type"); ct != "application/x-ndjson" {
+		t.Fatalf("content type %q", ct)
+	}
+	lines := bufio.NewScanner(resp.Body)
+	next := func() string {
+		t.Helper()
+		if !lines.Scan() {
+			t.Fatalf("stream ended: %v", lines.Err())
+		}
+		var line struct {
+			File string `json:"file"`
+			Line string `json:"line"`
+		}
+		if err := json.Unmarshal(lines.Bytes(), &line); err != nil || line.File != "serial.log" {
+			t.Fatalf("line %s: %+v, err %v", lines.Bytes(), line, err)
+		}
+		return line.Line
+	}
+	if got := next(); got != "mounting root" {
+		t.Fatalf("first line %q", got)
+	}
+	f, err := os.OpenFile(serial, os.O_APPEND|os.O_WRONLY, 0)
+	if err != nil {
+		t.Fatalf("open serial log: %v", err)
+	}
+	defer f.Close()
+	if _, err := f.WriteString("init started\n"); err != nil {
+		t.Fatalf("append serial log: %v", err)
+	}
+	if got := next(); got != "init started" {
+		t.Fatalf("followed line %q", got)
+	}
+}
@@ -0,0 +1,100 @@
+package api
+
+import (
+	"errors"
+	"log/slog"
+	"net/http"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/labstack/echo/v4"
+
+	"github.com/alperreha/mergen-fire/internal/model"
+)
+
+// readOnlySafe lists POST routes that change nothing on the host and so
+// stay available in read-only mode.
+var readOnlySafe = []string{"/v1/backup"}
+
+// Maintenance holds the read-only switch shared by the ReadOnly middleware,
+// the admin endpoint and config reloads.
+type Maintenance struct {
+	mu    sync.RWMutex
+	state model.MaintenanceState
+}
+
+func NewMaintenance(readOnly bool) *Maintenance {
+	m := &Maintenance{}
+	m.Set(readOnly, "")
+	return m
+}
+
+// Set switches read-only mode. Setting the current mode again keeps Since.
+func (m *Maintenance) Set(readOnly bool, reason string) model.MaintenanceState {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if !readOnly {
+		m.state = model.MaintenanceState{}
+		return m.state
+	}
+	if !m.state.ReadOnly {
+		now := time.Now().UTC()
+		m.state.Since = &now
+	}
+	m.state.ReadOnly, m.state.Reason = true, reason
+	return m.state
+}
+
+func (m *Maintenance) State() model.MaintenanceState {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return m.state
+}
+
+// ReadOnly answers mutating requests with 503 while m is in read-only mode.
+// Reads, admin endpoints and readOnlySafe routes always pass, so the mode
+// can be inspected and lifted through the API it guards.
+func ReadOnly(m *Maintenance) echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			req := c.Request()
+			switch req.Method {
+			case http.MethodGet, http.MethodHead, http.MethodOptions:
+				return next(c)
+			}
+			if strings.HasPrefix(c.Path(), "/v1/admin/") || slices.Contains(readOnlySafe, c.Path()) {
+				return next(c)
+			}
+			state := m.State()
+			if !state.ReadOnly {
+				return next(c)
+			}
+			message := "mergend is in read-only mode"
+			if state.Reason != "" {
+				message += ": " + state.Reason
+			}
+			return c.JSON(http.StatusServiceUnavailable, errorResponse("read_only", errors.New(message)))
+		}
+	}
+}
+
+// RegisterMaintenance mounts GET and PUT /v1/admin/maintenance.
+func RegisterMaintenance(e *echo.Echo, m *Maintenance, logger *slog.Logger) {
+	if logger == nil {
+		logger = slog.Default()
+	}
+	e.GET("/v1/admin/maintenance", func(c echo.Context) error {
+		return c.JSON(http.StatusOK, m.State())
+	})
+	e.PUT("/v1/admin/maintenance", func(c echo.Context) error {
+		var req model.MaintenanceRequest
+		if err := c.Bind(&req); err != nil {
+			return c.JSON(http.StatusBadRequest, errorResponse("bad_request", err))
+		}
+		state := m.Set(req.ReadOnly, strings.TrimSpace(req.Reason))
+		logger.WarnContext(c.Request().Context(), "read-only mode changed", "readOnly", state.ReadOnly, "reason", state.Reason)
+		return c.JSON(http.StatusOK, state)
+	})
+}
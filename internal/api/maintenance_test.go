@@ -0,0 +1,75 @@
+package api
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/labstack/echo/v4"
+)
+
+func TestReadOnly(t *testing.T) {
+	m := NewMaintenance(false)
+	e := echo.New()
+	e.Use(ReadOnly(m))
+	ok := func(c echo.Context) error { return c.JSON(http.StatusOK, map[string]string{}) }
+	e.GET("/v1/vms", ok)
+	e.POST("/v1/vms", ok)
+	e.PATCH("/v1/vms/:id", ok)
+	e.DELETE("/v1/vms/:id", ok)
+	e.POST("/v1/vms/:id/start", ok)
+	e.POST("/v1/backup", ok)
+	e.PUT("/v1/admin/maintenance", ok)
+
+	cases := []struct {
+		method   string
+		path     string
+		rejected bool
+	}{
+		{method: http.MethodGet, path: "/v1/vms"},
+		{method: http.MethodPost, path: "/v1/vms", rejected: true},
+		{method: http.MethodPatch, path: "/v1/vms/abc", rejected: true},
+		{method: http.MethodDelete, path: "/v1/vms/abc", rejected: true},
+		{method: http.MethodPost, path: "/v1/vms/abc/start", rejected: true},
+		{method: http.MethodPost, path: "/v1/backup"},
+		{method: http.MethodPut, path: "/v1/admin/maintenance"},
+	}
+	serve := func(method, path string) *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		e.ServeHTTP(rec, httptest.NewRequest(method, path, nil))
+		return rec
+	}
+
+	for _, tc := range cases {
+		if rec := serve(tc.method, tc.path); rec.Code != http.StatusOK {
+			t.Fatalf("writable: %s %s got %d", tc.method, tc.path, rec.Code)
+		}
+	}
+
+	state := m.Set(true, "disk replacement")
+	if state.Since == nil {
+		t.Fatal("expected read-only mode to record since")
+	}
+	for _, tc := range cases {
+		rec := serve(tc.method, tc.path)
+		want := http.StatusOK
+		if tc.rejected {
+			want = http.StatusServiceUnavailable
+		}
+		if rec.Code != want {
+			t.Fatalf("read-only: %s %s got %d, want %d", tc.method, tc.path, rec.Code, want)
+		}
+		if tc.rejected && !strings.Contains(rec.Body.String(), "disk replacement") {
+			t.Fatalf("read-only: expected reason in body, got %s", rec.Body.String())
+		}
+	}
+
+	if again := m.Set(true, "still busy"); !again.Since.Equal(*state.Since) {
+		t.Fatalf("setting read-only again moved since: %v -> %v", state.Since, again.Since)
+	}
+	m.Set(false, "")
+	if rec := serve(http.MethodPost, "/v1/vms"); rec.Code != http.StatusOK {
+		t.Fatalf("after lifting read-only: got %d", rec.Code)
+	}
+}
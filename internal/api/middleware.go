@@ -0,0 +1,317 @@
+package api
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/labstack/echo/v4"
+
+	"github.com/alperreha/mergen-fire/internal/logging"
+	"github.com/alperreha/mergen-fire/internal/redact"
+	"github.com/alperreha/mergen-fire/internal/tracing"
+)
+
+const HeaderRequestID = "X-Request-ID"
+
+// RequestID reuses a well-formed X-Request-ID from the client (or a proxy in
+// front of mergend) or generates one, echoes it in the response and attaches
+// it to the request context so context-aware log calls include it.
+func RequestID() echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			id := c.Request().Header.Get(HeaderRequestID)
+			if !validRequestID(id) {
+				id = newRequestID()
+			}
+			c.Response().Header().Set(HeaderRequestID, id)
+			c.SetRequest(c.Request().WithContext(logging.WithRequestID(c.Request().Context(), id)))
+			return next(c)
+		}
+	}
+}
+
+// Tracing opens a server span per request, continuing the caller's trace when
+// a traceparent header is present. Register it after RequestID.
+func Tracing() echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			req := c.Request()
+			ctx := tracing.Extract(req.Context(), req.Header.Get("traceparent"))
+			ctx, span := tracing.StartKind(ctx, tracing.KindServer, req.Method+" "+c.Path(),
+				"http.request.method", req.Method,
+				"http.route", c.Path(),
+				"url.path", req.URL.Path,
+				"request.id", logging.RequestID(ctx),
+			)
+			defer span.End()
+			c.SetRequest(req.WithContext(ctx))
+
+			err := next(c)
+			status := c.Response().Status
+			if err != nil && status == 0 {
+				status = http.StatusInternalServerError
+			}
+			span.SetAttributes("http.response.status_code", status)
+			if err != nil {
+				span.RecordError(err)
+			} else if status >= http.StatusInternalServerError {
+				span.RecordError(errors.New(http.StatusText(status)))
+			}
+			return err
+		}
+	}
+}
+
+// AccessLog writes one line per request once the handler returns. Register it
+// after RequestID so the line carries the request ID. Sensitive query
+// parameters are masked by redactor; a nil one masks by name only.
+func AccessLog(logger *slog.Logger, redactor *redact.Redactor) echo.MiddlewareFunc {
+	if logger == nil {
+		logger = slog.Default()
+	}
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			started := time.Now()
+			err := next(c)
+
+			req := c.Request()
+			status := c.Response().Status
+			if err != nil && status == 0 {
+				status = http.StatusInternalServerError
+				var httpErr *echo.HTTPError
+				if errors.As(err, &httpErr) {
+					status = httpErr.Code
+				}
+			} else if status == 0 {
+				status = http.StatusOK
+			}
+			level := slog.LevelInfo
+			if status >= http.StatusInternalServerError {
+				level = slog.LevelWarn
+			}
+			logger.Log(req.Context(), level, "http access",
+				"method", req.Method,
+				"path", req.URL.Path,
+				"query", redactor.Query(req.URL.RawQuery),
+				"status", status,
+				"bytes", c.Response().Size,
+				"latency", time.Since(started),
+				"remoteAddr", req.RemoteAddr,
+				"forwardedFor", req.Header.Get("X-Forwarded-For"),
+				"userAgent", req.UserAgent(),
+				"token", TokenName(req.Context()),
+			)
+			return err
+		}
+	}
+}
+
+// CORSConfig lets browsers on AllowOrigins call the API. "*" allows any
+// origin. Empty AllowMethods and AllowHeaders use the defaults below.
+type CORSConfig struct {
+	AllowOrigins []string
+	AllowMethods []string
+	AllowHeaders []string
+	MaxAge       time.Duration
+}
+
+var (
+	defaultCORSMethods = []string{http.MethodGet, http.MethodPost, http.MethodPut, http.MethodPatch, http.MethodDelete}
+	defaultCORSHeaders = []string{"Content-Type", "Authorization", HeaderRequestID, "traceparent", "If-Match", "If-None-Match"}
+)
+
+// CORS answers preflight requests and adds Access-Control-* headers for
+// allowed origins. Without AllowOrigins it does nothing.
+func CORS(cfg CORSConfig) echo.MiddlewareFunc {
+	methods, headers := cfg.AllowMethods, cfg.AllowHeaders
+	if len(methods) == 0 {
+		methods = defaultCORSMethods
+	}
+	if len(headers) == 0 {
+		headers = defaultCORSHeaders
+	}
+	allowMethods, allowHeaders := strings.Join(methods, ", "), strings.Join(headers, ", ")
+	anyOrigin := slices.Contains(cfg.AllowOrigins, "*")
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		if len(cfg.AllowOrigins) == 0 {
+			return next
+		}
+		return func(c echo.Context) error {
+			req := c.Request()
+			origin := req.Header.Get("Origin")
+			preflight := req.Method == http.MethodOptions && req.Header.Get("Access-Control-Request-Method") != ""
+			res := c.Response().Header()
+			res.Add("Vary", "Origin")
+			if origin == "" {
+				return next(c)
+			}
+			if !anyOrigin && !slices.Contains(cfg.AllowOrigins, origin) {
+				if preflight {
+					return c.JSON(http.StatusForbidden, errorResponse("forbidden", fmt.Errorf("origin %q is not allowed", origin)))
+				}
+				return next(c)
+			}
+			if anyOrigin {
+				res.Set("Access-Control-Allow-Origin", "*")
+			} else {
+				res.Set("Access-Control-Allow-Origin", origin)
+			}
+			if !preflight {
+				res.Set("Access-Control-Expose-Headers", HeaderRequestID+", ETag")
+				return next(c)
+			}
+			res.Set("Access-Control-Allow-Methods", allowMethods)
+			res.Set("Access-Control-Allow-Headers", allowHeaders)
+			if cfg.MaxAge > 0 {
+				res.Set("Access-Control-Max-Age", strconv.Itoa(int(cfg.MaxAge.Seconds())))
+			}
+			c.Response().WriteHeader(http.StatusNoContent)
+			return nil
+		}
+	}
+}
+
+// SecurityHeaders sets headers that keep browsers from sniffing, framing or
+// embedding API responses. HSTS is only sent on TLS connections, and only
+// when hstsMaxAge is positive.
+func SecurityHeaders(hstsMaxAge time.Duration) echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			res := c.Response().Header()
+			res.Set("X-Content-Type-Options", "nosniff")
+			res.Set("X-Frame-Options", "DENY")
+			res.Set("Referrer-Policy", "no-referrer")
+			res.Set("Content-Security-Policy", "default-src 'none'; frame-ancestors 'none'")
+			if hstsMaxAge > 0 && c.Request().TLS != nil {
+				res.Set("Strict-Transport-Security", "max-age="+strconv.Itoa(int(hstsMaxAge.Seconds())))
+			}
+			return next(c)
+		}
+	}
+}
+
+// BodyLimits bounds request bodies; zero fields are unlimited. MaxEntries
+// caps the members of any single JSON object or array, such as tags or env.
+type BodyLimits struct {
+	MaxBytes   int64
+	MaxDepth   int
+	MaxEntries int
+	// Exempt lists route patterns that stream their body, e.g. "/v1/migrations".
+	Exempt []string
+}
+
+// BodyLimit reads each request body up to MaxBytes before the handler runs,
+// answering 413 for larger bodies and 400 for JSON nested or sized past the
+// limits, so handlers never decode unbounded input.
+func BodyLimit(limits BodyLimits) echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			req := c.Request()
+			if req.Body == nil || req.Body == http.NoBody || slices.Contains(limits.Exempt, c.Path()) {
+				return next(c)
+			}
+			if limits.MaxBytes > 0 && req.ContentLength > limits.MaxBytes {
+				return c.JSON(http.StatusRequestEntityTooLarge, errorResponse("payload_too_large", fmt.Errorf("request body is %d bytes, the limit is %d", req.ContentLength, limits.MaxBytes)))
+			}
+			var body io.Reader = req.Body
+			if limits.MaxBytes > 0 {
+				body = io.LimitReader(req.Body, limits.MaxBytes+1)
+			}
+			data, err := io.ReadAll(body)
+			_ = req.Body.Close()
+			if err != nil {
+				return c.JSON(http.StatusBadRequest, errorResponse("bad_request", fmt.Errorf("read request body: %w", err)))
+			}
+			if limits.MaxBytes > 0 && int64(len(data)) > limits.MaxBytes {
+				return c.JSON(http.StatusRequestEntityTooLarge, errorResponse("payload_too_large", fmt.Errorf("request body exceeds %d bytes", limits.MaxBytes)))
+			}
+			if err := checkJSONShape(data, limits.MaxDepth, limits.MaxEntries); err != nil {
+				return c.JSON(http.StatusBadRequest, errorResponse("bad_request", err))
+			}
+			req.Body = io.NopCloser(bytes.NewReader(data))
+			req.ContentLength = int64(len(data))
+			return next(c)
+		}
+	}
+}
+
+// checkJSONShape walks the tokens of data without building values. Every
+// endpoint takes a JSON object, so other top-level values are refused.
+// Bodies that are not valid JSON pass; Bind reports those.
+func checkJSONShape(data []byte, maxDepth, maxEntries int) error {
+	type frame struct {
+		object bool
+		tokens int
+	}
+	var stack []frame
+	dec := json.NewDecoder(bytes.NewReader(data))
+	for first := true; ; first = false {
+		tok, err := dec.Token()
+		if err != nil {
+			return nil
+		}
+		delim, isDelim := tok.(json.Delim)
+		if first && delim != '{' {
+			return errors.New("request body must be a JSON object")
+		}
+		if maxDepth <= 0 && maxEntries <= 0 {
+			return nil
+		}
+		if isDelim && (delim == '}' || delim == ']') {
+			stack = stack[:len(stack)-1]
+			continue
+		}
+		if n := len(stack); n > 0 {
+			top := &stack[n-1]
+			top.tokens++
+			entries := top.tokens
+			if top.object {
+				entries = (top.tokens + 1) / 2
+			}
+			if maxEntries > 0 && entries > maxEntries {
+				return fmt.Errorf("json object or array has more than %d entries", maxEntries)
+			}
+		}
+		if isDelim {
+			stack = append(stack, frame{object: delim == '{'})
+			if maxDepth > 0 && len(stack) > maxDepth {
+				return fmt.Errorf("json nesting exceeds %d levels", maxDepth)
+			}
+		}
+	}
+}
+
+func newRequestID() string {
+	buf := make([]byte, 16)
+	if _, err := rand.Read(buf); err != nil {
+		return "unknown"
+	}
+	return hex.EncodeToString(buf)
+}
+
+// validRequestID accepts short printable tokens so client-supplied IDs cannot
+// inject separators or control characters into log lines.
+func validRequestID(id string) bool {
+	if id == "" || len(id) > 128 {
+		return false
+	}
+	for _, r := range id {
+		switch {
+		case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z', r >= '0' && r <= '9', r == '-', r == '_', r == '.', r == ':':
+		default:
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,183 @@
+package api
+
+import (
+	"crypto/tls"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/labstack/echo/v4"
+
+	"github.com/alperreha/mergen-fire/internal/logging"
+)
+
+// serveWith runs one request through mw in front of a POST and GET /v1/vms
+// handler that echoes the request ID from the context and the body it got.
+func serveWith(t *testing.T, mw echo.MiddlewareFunc, req *http.Request) *httptest.ResponseRecorder {
+	t.Helper()
+	e := echo.New()
+	e.Use(mw)
+	echoBody := func(c echo.Context) error {
+		var body []byte
+		if c.Request().Body != nil {
+			body, _ = io.ReadAll(c.Request().Body)
+		}
+		return c.JSON(http.StatusOK, map[string]string{
+			"requestID": logging.RequestID(c.Request().Context()),
+			"body":      string(body),
+		})
+	}
+	e.GET("/v1/vms", echoBody)
+	e.POST("/v1/vms", echoBody)
+	rec := httptest.NewRecorder()
+	e.ServeHTTP(rec, req)
+	return rec
+}
+
+func TestRequestID(t *testing.T) {
+	cases := []struct {
+		name     string
+		incoming string
+		keep     bool
+	}{
+		{name: "passed through", incoming: "req-123:abc.DEF_9", keep: true},
+		{name: "generated when absent"},
+		{name: "replaced when malformed", incoming: "bad id\nforged=1"},
+		{name: "replaced when too long", incoming: strings.Repeat("a", 129)},
+	}
+	for _, tc := range cases {
+		req := httptest.NewRequest(http.MethodGet, "/v1/vms", nil)
+		if tc.incoming != "" {
+			req.Header.Set(HeaderRequestID, tc.incoming)
+		}
+		rec := serveWith(t, RequestID(), req)
+		got := rec.Header().Get(HeaderRequestID)
+		if tc.keep && got != tc.incoming {
+			t.Fatalf("%s: response id %q, want %q", tc.name, got, tc.incoming)
+		}
+		if !tc.keep && (got == tc.incoming || len(got) != 32) {
+			t.Fatalf("%s: expected a generated id, got %q", tc.name, got)
+		}
+		if !strings.Contains(rec.Body.String(), `"requestID":"`+got+`"`) {
+			t.Fatalf("%s: context id does not match header %q: %s", tc.name, got, rec.Body.String())
+		}
+	}
+}
+
+func TestBodyLimit(t *testing.T) {
+	limits := BodyLimits{MaxBytes: 64, MaxDepth: 3, MaxEntries: 4}
+	cases := []struct {
+		name   string
+		body   string
+		exempt bool
+		want   int
+	}{
+		{name: "object within limits", body: `{"vcpu":1,"tags":{"a":"b"}}`, want: http.StatusOK},
+		{name: "oversized", body: `{"rootfs":"` + strings.Repeat("x", 64) + `"}`, want: http.StatusRequestEntityTooLarge},
+		{name: "array body", body: `[1,2]`, want: http.StatusBadRequest},
+		{name: "string body", body: `"vm"`, want: http.StatusBadRequest},
+		{name: "too deep", body: `{"a":{"b":{"c":{}}}}`, want: http.StatusBadRequest},
+		{name: "too many entries", body: `{"a":1,"b":2,"c":3,"d":4,"e":5}`, want: http.StatusBadRequest},
+		{name: "invalid json left to bind", body: `{"a":`, want: http.StatusOK},
+		{name: "exempt route", body: strings.Repeat("x", 100), exempt: true, want: http.StatusOK},
+	}
+	for _, tc := range cases {
+		l := limits
+		if tc.exempt {
+			l.Exempt = []string{"/v1/vms"}
+		}
+		req := httptest.NewRequest(http.MethodPost, "/v1/vms", strings.NewReader(tc.body))
+		req.Header.Set("Content-Type", "application/json")
+		rec := serveWith(t, BodyLimit(l), req)
+		if rec.Code != tc.want {
+			t.Fatalf("%s: status %d, want %d: %s", tc.name, rec.Code, tc.want, rec.Body.String())
+		}
+	}
+
+	// A body without a Content-Length is cut off at the limit as well.
+	req := httptest.NewRequest(http.MethodPost, "/v1/vms", io.MultiReader(strings.NewReader(`{"a":"`), strings.NewReader(strings.Repeat("x", 100)+`"}`)))
+	req.ContentLength = -1
+	if rec := serveWith(t, BodyLimit(limits), req); rec.Code != http.StatusRequestEntityTooLarge {
+		t.Fatalf("streamed oversized body: status %d", rec.Code)
+	}
+}
+
+func TestCORS(t *testing.T) {
+	mw := CORS(CORSConfig{AllowOrigins: []string{"https://dash.example.com"}, MaxAge: 10 * time.Minute})
+	cases := []struct {
+		name        string
+		method      string
+		origin      string
+		preflight   bool
+		status      int
+		allowOrigin string
+	}{
+		{name: "allowed preflight", method: http.MethodOptions, origin: "https://dash.example.com", preflight: true, status: http.StatusNoContent, allowOrigin: "https://dash.example.com"},
+		{name: "disallowed preflight", method: http.MethodOptions, origin: "https://evil.example.com", preflight: true, status: http.StatusForbidden},
+		{name: "allowed simple request", method: http.MethodGet, origin: "https://dash.example.com", status: http.StatusOK, allowOrigin: "https://dash.example.com"},
+		{name: "disallowed simple request", method: http.MethodGet, origin: "https://evil.example.com", status: http.StatusOK},
+		{name: "no origin", method: http.MethodGet, status: http.StatusOK},
+	}
+	for _, tc := range cases {
+		req := httptest.NewRequest(tc.method, "/v1/vms", nil)
+		if tc.origin != "" {
+			req.Header.Set("Origin", tc.origin)
+		}
+		if tc.preflight {
+			req.Header.Set("Access-Control-Request-Method", http.MethodDelete)
+		}
+		rec := serveWith(t, mw, req)
+		if rec.Code != tc.status {
+			t.Fatalf("%s: status %d, want %d", tc.name, rec.Code, tc.status)
+		}
+		if got := rec.Header().Get("Access-Control-Allow-Origin"); got != tc.allowOrigin {
+			t.Fatalf("%s: allow origin %q, want %q", tc.name, got, tc.allowOrigin)
+		}
+		if rec.Header().Get("Vary") != "Origin" {
+			t.Fatalf("%s: expected Vary: Origin, got %v", tc.name, rec.Header().Values("Vary"))
+		}
+		allowed := tc.status == http.StatusNoContent
+		if got := rec.Header().Get("Access-Control-Allow-Methods"); (got != "") != allowed || (allowed && !strings.Contains(got, http.MethodDelete)) {
+			t.Fatalf("%s: unexpected allow methods %q", tc.name, got)
+		}
+		if allowed && rec.Header().Get("Access-Control-Max-Age") != "600" {
+			t.Fatalf("%s: max age %q", tc.name, rec.Header().Get("Access-Control-Max-Age"))
+		}
+	}
+
+	// Without origins configured the middleware stays out of the way.
+	req := httptest.NewRequest(http.MethodOptions, "/v1/vms", nil)
+	req.Header.Set("Origin", "https://dash.example.com")
+	req.Header.Set("Access-Control-Request-Method", http.MethodGet)
+	if rec := serveWith(t, CORS(CORSConfig{}), req); rec.Header().Get("Access-Control-Allow-Origin") != "" || rec.Code == http.StatusNoContent {
+		t.Fatalf("unconfigured cors answered preflight: %d %v", rec.Code, rec.Header())
+	}
+}
+
+func TestSecurityHeaders(t *testing.T) {
+	want := map[string]string{
+		"X-Content-Type-Options":  "nosniff",
+		"X-Frame-Options":         "DENY",
+		"Referrer-Policy":         "no-referrer",
+		"Content-Security-Policy": "default-src 'none'; frame-ancestors 'none'",
+	}
+	for _, useTLS := range []bool{false, true} {
+		req := httptest.NewRequest(http.MethodGet, "/v1/vms", nil)
+		if useTLS {
+			req.TLS = &tls.ConnectionState{}
+		}
+		rec := serveWith(t, SecurityHeaders(time.Hour), req)
+		for name, value := range want {
+			if got := rec.Header().Get(name); got != value {
+				t.Fatalf("tls=%v: %s = %q, want %q", useTLS, name, got, value)
+			}
+		}
+		hsts := rec.Header().Get("Strict-Transport-Security")
+		if useTLS && hsts != "max-age=3600" || !useTLS && hsts != "" {
+			t.Fatalf("tls=%v: unexpected HSTS %q", useTLS, hsts)
+		}
+	}
+}
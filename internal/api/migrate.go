@@ -0,0 +1,41 @@
+package api
+
+import (
+	"fmt"
+	"net/http"
+
+	"github.com/labstack/echo/v4"
+
+	"github.com/alperreha/mergen-fire/internal/migration"
+	"github.com/alperreha/mergen-fire/internal/model"
+)
+
+func (h *Handler) migrateVM(c echo.Context) error {
+	id := c.Param("id")
+	h.logger.DebugContext(c.Request().Context(), "http migrate vm", "vmID", id, "method", c.Request().Method, "path", c.Request().URL.Path)
+	var req model.MigrateVMRequest
+	if err := c.Bind(&req); err != nil {
+		return c.JSON(http.StatusBadRequest, errorResponse("bad_request", err))
+	}
+	ctx := migration.WithHeader(c.Request().Context(), peerHeader(c))
+	result, err := h.service.MigrateVM(ctx, id, req)
+	if err != nil {
+		return h.writeServiceError(c, err)
+	}
+	h.logger.InfoContext(c.Request().Context(), "http migrate vm success", "vmID", id, "host", result.To, "live", result.Live)
+	return c.JSON(http.StatusOK, result)
+}
+
+// receiveVM is called by the source host of a migration, not by users.
+func (h *Handler) receiveVM(c echo.Context) error {
+	h.logger.DebugContext(c.Request().Context(), "http receive vm", "method", c.Request().Method, "path", c.Request().URL.Path, "contentLength", c.Request().ContentLength)
+	if contentType := c.Request().Header.Get("Content-Type"); contentType != migration.ContentType {
+		return c.JSON(http.StatusUnsupportedMediaType, errorResponse("bad_request", fmt.Errorf("content type must be %s", migration.ContentType)))
+	}
+	summary, err := h.service.ReceiveVM(c.Request().Context(), c.Request().Body)
+	if err != nil {
+		return h.writeServiceError(c, err)
+	}
+	h.logger.InfoContext(c.Request().Context(), "http receive vm success", "vmID", summary.ID)
+	return c.JSON(http.StatusOK, summary)
+}
@@ -0,0 +1,66 @@
+package api
+
+import (
+	"net/http"
+
+	"github.com/labstack/echo/v4"
+
+	"github.com/alperreha/mergen-fire/internal/model"
+)
+
+func (h *Handler) listNamespaces(c echo.Context) error {
+	h.logger.DebugContext(c.Request().Context(), "http list namespaces", "method", c.Request().Method, "path", c.Request().URL.Path)
+	namespaces, err := h.service.ListNamespaces(c.Request().Context())
+	if err != nil {
+		return h.writeServiceError(c, err)
+	}
+	return c.JSON(http.StatusOK, map[string]any{"items": namespaces})
+}
+
+func (h *Handler) getNamespace(c echo.Context) error {
+	namespace, err := h.service.GetNamespace(c.Request().Context(), c.Param("ns"))
+	if err != nil {
+		return h.writeServiceError(c, err)
+	}
+	return c.JSON(http.StatusOK, namespace)
+}
+
+// putNamespace registers or replaces the namespace named in the path.
+func (h *Handler) putNamespace(c echo.Context) error {
+	name := c.Param("ns")
+	h.logger.DebugContext(c.Request().Context(), "http put namespace", "namespace", name, "method", c.Request().Method, "path", c.Request().URL.Path)
+	var req model.Namespace
+	if err := c.Bind(&req); err != nil {
+		return c.JSON(http.StatusBadRequest, errorResponse("bad_request", err))
+	}
+	req.Name = name
+	namespace, err := h.service.PutNamespace(c.Request().Context(), req)
+	if err != nil {
+		return h.writeServiceError(c, err)
+	}
+	h.logger.InfoContext(c.Request().Context(), "http put namespace success", "namespace", namespace.Name)
+	return c.JSON(http.StatusOK, namespace)
+}
+
+func (h *Handler) deleteNamespace(c echo.Context) error {
+	name := c.Param("ns")
+	if err := h.service.DeleteNamespace(c.Request().Context(), name); err != nil {
+		return h.writeServiceError(c, err)
+	}
+	h.logger.InfoContext(c.Request().Context(), "http delete namespace success", "namespace", name)
+	return c.JSON(http.StatusOK, map[string]any{
+		"name":   name,
+		"status": "deleted",
+	})
+}
+
+// inNamespace serves next only for VMs of the path's namespace; the VMs of
+// other namespaces are not found under it.
+func (h *Handler) inNamespace(next echo.HandlerFunc) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		if err := h.service.InNamespace(c.Request().Context(), c.Param("id"), c.Param("ns")); err != nil {
+			return h.writeServiceError(c, err)
+		}
+		return next(c)
+	}
+}
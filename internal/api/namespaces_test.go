@@ -0,0 +1,77 @@
+package api_test
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/alperreha/mergen-fire/internal/model"
+	"github.com/alperreha/mergen-fire/internal/testsupport"
+)
+
+func TestNamespaceQuotas(t *testing.T) {
+	env := testsupport.NewEnv(t)
+	quota := model.NamespaceQuota{MaxVMs: 2, MemMiB: 256, Ports: 2}
+	if status, body := env.Request(t, http.MethodPut, "/v1/namespaces/team-a", model.Namespace{Quota: quota}); status != http.StatusOK {
+		t.Fatalf("put namespace: status %d body %s", status, body)
+	}
+
+	req := env.Artifacts.CreateRequest()
+	status, body := env.Request(t, http.MethodPost, "/v1/namespaces/team-a/vms", req)
+	if status != http.StatusCreated {
+		t.Fatalf("create in namespace: status %d body %s", status, body)
+	}
+	var created struct {
+		ID string `json:"id"`
+	}
+	if err := json.Unmarshal(body, &created); err != nil {
+		t.Fatalf("decode create: %v", err)
+	}
+	other := env.CreateVM(t, env.Artifacts.CreateRequest())
+
+	if status, body := env.Request(t, http.MethodGet, "/v1/namespaces/team-a/vms/"+created.ID, nil); status != http.StatusOK || !strings.Contains(string(body), `"namespace":"team-a"`) {
+		t.Fatalf("get in namespace: status %d body %s", status, body)
+	}
+	if status, _ := env.Request(t, http.MethodGet, "/v1/namespaces/team-a/vms/"+other, nil); status != http.StatusNotFound {
+		t.Fatalf("default vm under team-a: status %d, want 404", status)
+	}
+	if status, _ := env.Request(t, http.MethodPost, "/v1/namespaces/team-a/vms/"+other+"/stop", nil); status != http.StatusNotFound {
+		t.Fatalf("stop default vm under team-a: status %d, want 404", status)
+	}
+	status, body = env.Request(t, http.MethodGet, "/v1/namespaces/team-a/vms", nil)
+	if status != http.StatusOK || !strings.Contains(string(body), created.ID) || strings.Contains(string(body), other) {
+		t.Fatalf("list namespace: status %d body %s", status, body)
+	}
+
+	req.MemMiB = 192
+	status, body = env.Request(t, http.MethodPost, "/v1/namespaces/team-a/vms", req)
+	if status != http.StatusForbidden || !strings.Contains(string(body), "quota_exceeded") {
+		t.Fatalf("create over memory quota: status %d body %s, want 403", status, body)
+	}
+	req.Namespace = "team-b"
+	if status, body := env.Request(t, http.MethodPost, "/v1/namespaces/team-a/vms", req); status != http.StatusBadRequest {
+		t.Fatalf("create with another namespace in the body: status %d body %s, want 400", status, body)
+	}
+	if status, body := env.Request(t, http.MethodPost, "/v1/vms", req); status != http.StatusBadRequest {
+		t.Fatalf("create in unknown namespace: status %d body %s, want 400", status, body)
+	}
+
+	var namespace model.Namespace
+	status, body = env.Request(t, http.MethodGet, "/v1/namespaces/team-a", nil)
+	if status != http.StatusOK || json.Unmarshal(body, &namespace) != nil || namespace.Usage == nil {
+		t.Fatalf("get namespace: status %d body %s", status, body)
+	}
+	if *namespace.Usage != (model.NamespaceUsage{VMs: 1, MemMiB: 128, Ports: 1}) {
+		t.Fatalf("unexpected usage: %+v", *namespace.Usage)
+	}
+	if status, _ := env.Request(t, http.MethodDelete, "/v1/namespaces/team-a", nil); status != http.StatusConflict {
+		t.Fatalf("delete namespace with vms: status %d, want 409", status)
+	}
+	if status, body := env.Request(t, http.MethodDelete, "/v1/namespaces/team-a/vms/"+created.ID, nil); status != http.StatusOK {
+		t.Fatalf("delete vm: status %d body %s", status, body)
+	}
+	if status, body := env.Request(t, http.MethodDelete, "/v1/namespaces/team-a", nil); status != http.StatusOK {
+		t.Fatalf("delete empty namespace: status %d body %s", status, body)
+	}
+}
@@ -0,0 +1,454 @@
+package api
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/labstack/echo/v4"
+
+	"github.com/alperreha/mergen-fire/internal/config"
+	"github.com/alperreha/mergen-fire/internal/logging"
+	"github.com/alperreha/mergen-fire/internal/migration"
+	"github.com/alperreha/mergen-fire/internal/model"
+)
+
+// apiOperation documents one route in /openapi.json. Body and Response are
+// zero values of the Go types the handler binds and returns; their schemas
+// are derived from the json tags. Media replaces the JSON response for
+// routes that stream or download something else.
+type apiOperation struct {
+	Summary  string
+	Query    []string
+	Body     any
+	Status   int
+	Response any
+	Media    string
+}
+
+// itemsOf documents the {"items": [...]} body of list routes.
+type itemsOf struct{ elem any }
+
+// actionStatus is the body of VM actions that answer with the VM's new status.
+type actionStatus struct {
+	ID       string              `json:"id"`
+	Status   string              `json:"status"`
+	Warnings []string            `json:"warnings,omitempty"`
+	Systemd  *model.SystemdState `json:"systemd,omitempty"`
+	Snapshot any                 `json:"snapshot,omitempty"`
+}
+
+// namedStatus is the body of deletes of named resources.
+type namedStatus struct {
+	Name   string `json:"name"`
+	Status string `json:"status"`
+}
+
+type portStatus struct {
+	Port   int    `json:"port"`
+	Status string `json:"status"`
+}
+
+type summaryPage struct {
+	Items      []model.VMSummary `json:"items"`
+	NextCursor string            `json:"nextCursor,omitempty"`
+}
+
+type errorBody struct {
+	Error   string `json:"error"`
+	Message string `json:"message"`
+}
+
+var (
+	vmListQuery = []string{"namespace", "tag", "fields", "sort", "limit", "cursor", "reveal"}
+	logsQuery   = []string{"file", "tail", "follow", "format"}
+)
+
+// apiOperations documents every route by "METHOD pattern". A route missing
+// here still appears in the spec, with a generic summary and no schemas.
+var apiOperations = map[string]apiOperation{
+	"GET /healthz": {Summary: "Liveness; reports a tripped automation breaker as degraded"},
+
+	"POST /v1/vms":                            {Summary: "Create a VM, from a template or a full spec", Body: model.CreateVMRequest{}, Status: http.StatusCreated, Response: actionStatus{}},
+	"POST /v1/vms/adopt":                      {Summary: "Adopt a VM started outside mergend", Body: model.AdoptVMRequest{}, Status: http.StatusCreated, Response: actionStatus{}},
+	"POST /v1/vms:batch":                      {Summary: "Start, stop, restart or delete many VMs", Body: model.BatchVMRequest{}, Response: model.BatchVMResponse{}},
+	"GET /v1/vms":                             {Summary: "List VMs", Query: vmListQuery, Response: summaryPage{}},
+	"GET /v1/vms/:id":                         {Summary: "Get a VM", Query: []string{"reveal"}, Response: model.VMSummary{}},
+	"PATCH /v1/vms/:id":                       {Summary: "Update a VM; If-Match takes its revision", Body: model.UpdateVMRequest{}, Response: model.VMSummary{}},
+	"DELETE /v1/vms/:id":                      {Summary: "Delete a VM", Query: []string{"retainData"}, Response: actionStatus{}},
+	"POST /v1/vms/:id/start":                  {Summary: "Start a VM", Response: actionStatus{}},
+	"POST /v1/vms/:id/stop":                   {Summary: "Stop a VM", Response: actionStatus{}},
+	"POST /v1/vms/:id/restart":                {Summary: "Restart a VM", Query: []string{"timeout"}, Response: actionStatus{}},
+	"POST /v1/vms/:id/wake":                   {Summary: "Start a VM stopped for idleness, optionally until a port answers", Body: model.WakeVMRequest{}, Response: actionStatus{}},
+	"POST /v1/vms/:id/exec":                   {Summary: "Run a command in the guest and return its output and exit code", Body: model.ExecRequest{}, Response: model.ExecResult{}},
+	"POST /v1/vms/activity":                   {Summary: "Report forwarder traffic to VMs with an idle timeout", Body: model.ActivityReport{}, Status: http.StatusNoContent},
+	"POST /v1/vms/:id/pause":                  {Summary: "Pause a VM", Response: actionStatus{}},
+	"POST /v1/vms/:id/resume":                 {Summary: "Resume a paused VM", Response: actionStatus{}},
+	"POST /v1/vms/:id/recreate":               {Summary: "Recreate a VM from its current spec", Body: model.RecreateVMRequest{}, Response: model.VMSummary{}},
+	"POST /v1/vms/:id/snapshots":              {Summary: "Snapshot a VM", Body: model.CreateSnapshotRequest{}, Status: http.StatusCreated, Response: model.Snapshot{}},
+	"GET /v1/vms/:id/snapshots":               {Summary: "List a VM's snapshots", Response: itemsOf{model.Snapshot{}}},
+	"DELETE /v1/vms/:id/snapshots/:snapshot":  {Summary: "Delete a snapshot", Response: actionStatus{}},
+	"POST /v1/vms/:id/restore":                {Summary: "Restore a VM from a snapshot", Body: model.RestoreSnapshotRequest{}, Response: actionStatus{}},
+	"GET /v1/vms/:id/history":                 {Summary: "State transitions of a VM", Query: []string{"limit"}, Response: itemsOf{model.StateTransition{}}},
+	"GET /v1/vms/:id/stats":                   {Summary: "Guest resource usage", Response: model.GuestStats{}},
+	"GET /v1/vms/:id/metrics":                 {Summary: "Firecracker metrics of a VM", Response: model.VMMetrics{}},
+	"GET /v1/vms/:id/console":                 {Summary: "Serial console over WebSocket", Status: http.StatusSwitchingProtocols},
+	"GET /v1/vms/:id/logs":                    {Summary: "Tail or follow a VM's log files", Query: logsQuery, Media: "text/plain"},
+	"GET /v1/vms/:id/hooks/history":           {Summary: "Hook executions of a VM", Query: []string{"limit", "reveal"}, Response: itemsOf{model.HookExecution{}}},
+	"POST /v1/vms/:id/hooks/test":             {Summary: "Run or dry-run a VM's hooks for an event", Body: model.HookTestRequest{}, Response: model.HookTestResult{}},
+	"POST /v1/vms/:id/verify":                 {Summary: "Check a VM's artifacts against their checksums", Query: []string{"record"}, Response: model.ArtifactReport{}},
+	"POST /v1/vms/:id/unlock":                 {Summary: "Release a VM's operation lock", Query: []string{"force"}, Response: model.LockStatus{}},
+	"POST /v1/vms/:id/migrate":                {Summary: "Move a VM to another host", Body: model.MigrateVMRequest{}, Response: model.MigrationResult{}},
+	"POST /v1/migrations":                     {Summary: "Receive a migrating VM (host to host)", Body: migrationStream{}, Response: model.VMSummary{}},
+	"POST /v1/stacks":                         {Summary: "Create a stack of VMs", Body: model.StackManifest{}, Status: http.StatusCreated, Response: model.Stack{}},
+	"GET /v1/stacks":                          {Summary: "List stacks", Response: itemsOf{model.Stack{}}},
+	"GET /v1/stacks/:name":                    {Summary: "Get a stack", Response: model.Stack{}},
+	"POST /v1/stacks/:name/start":             {Summary: "Start a stack's VMs in dependency order", Response: model.Stack{}},
+	"POST /v1/stacks/:name/stop":              {Summary: "Stop a stack's VMs", Response: model.Stack{}},
+	"DELETE /v1/stacks/:name":                 {Summary: "Delete a stack and its VMs", Query: []string{"retainData"}, Response: namedStatus{}},
+	"GET /v1/ports":                           {Summary: "List port reservations", Response: itemsOf{model.PortReservation{}}},
+	"POST /v1/ports/reserve":                  {Summary: "Reserve a host port", Body: model.PortReservationRequest{}, Status: http.StatusCreated, Response: model.PortReservation{}},
+	"POST /v1/ports/release":                  {Summary: "Release a port reservation", Body: model.PortReleaseRequest{}, Response: portStatus{}},
+	"GET /v1/namespaces":                      {Summary: "List namespaces with their usage", Response: itemsOf{model.Namespace{}}},
+	"GET /v1/namespaces/:ns":                  {Summary: "Get a namespace with its usage", Response: model.Namespace{}},
+	"PUT /v1/namespaces/:ns":                  {Summary: "Register a namespace or replace its quota", Body: model.Namespace{}, Response: model.Namespace{}},
+	"DELETE /v1/namespaces/:ns":               {Summary: "Delete a namespace without VMs", Response: namedStatus{}},
+	"GET /v1/namespaces/:ns/vms":              {Summary: "List a namespace's VMs", Query: vmListQuery, Response: summaryPage{}},
+	"POST /v1/namespaces/:ns/vms":             {Summary: "Create a VM in a namespace", Body: model.CreateVMRequest{}, Status: http.StatusCreated, Response: actionStatus{}},
+	"GET /v1/namespaces/:ns/vms/:id":          {Summary: "Get a namespace's VM", Query: []string{"reveal"}, Response: model.VMSummary{}},
+	"PATCH /v1/namespaces/:ns/vms/:id":        {Summary: "Update a namespace's VM", Body: model.UpdateVMRequest{}, Response: model.VMSummary{}},
+	"DELETE /v1/namespaces/:ns/vms/:id":       {Summary: "Delete a namespace's VM", Query: []string{"retainData"}, Response: actionStatus{}},
+	"POST /v1/namespaces/:ns/vms/:id/start":   {Summary: "Start a namespace's VM", Response: actionStatus{}},
+	"POST /v1/namespaces/:ns/vms/:id/stop":    {Summary: "Stop a namespace's VM", Response: actionStatus{}},
+	"POST /v1/namespaces/:ns/vms/:id/restart": {Summary: "Restart a namespace's VM", Query: []string{"timeout"}, Response: actionStatus{}},
+	"POST /v1/namespaces/:ns/vms/:id/pause":   {Summary: "Pause a namespace's VM", Response: actionStatus{}},
+	"POST /v1/namespaces/:ns/vms/:id/resume":  {Summary: "Resume a namespace's VM", Response: actionStatus{}},
+	"POST /v1/namespaces/:ns/vms/:id/exec":    {Summary: "Run a command in a namespace's VM", Body: model.ExecRequest{}, Response: model.ExecResult{}},
+	"GET /v1/namespaces/:ns/vms/:id/history":  {Summary: "State transitions of a namespace's VM", Query: []string{"limit"}, Response: itemsOf{model.StateTransition{}}},
+	"GET /v1/namespaces/:ns/vms/:id/stats":    {Summary: "Guest resource usage of a namespace's VM", Response: model.GuestStats{}},
+	"GET /v1/namespaces/:ns/vms/:id/metrics":  {Summary: "Firecracker metrics of a namespace's VM", Response: model.VMMetrics{}},
+	"GET /v1/namespaces/:ns/vms/:id/console":  {Summary: "Serial console of a namespace's VM", Status: http.StatusSwitchingProtocols},
+	"GET /v1/namespaces/:ns/vms/:id/logs":     {Summary: "Log files of a namespace's VM", Query: logsQuery, Media: "text/plain"},
+	"GET /v1/namespaces/:ns/operations":       {Summary: "List a namespace's asynchronous jobs", Response: itemsOf{model.Job{}}},
+	"GET /v1/namespaces/:ns/operations/:id":   {Summary: "Poll an asynchronous job of a namespace", Response: model.Job{}},
+	"GET /v1/operations":                      {Summary: "List asynchronous jobs, newest first", Query: []string{"namespace"}, Response: itemsOf{model.Job{}}},
+	"GET /v1/operations/:id":                  {Summary: "Poll an asynchronous job", Response: model.Job{}},
+	"GET /v1/templates":                       {Summary: "List VM templates", Response: itemsOf{model.VMTemplate{}}},
+	"GET /v1/templates/:name":                 {Summary: "Get a VM template", Response: model.VMTemplate{}},
+	"PUT /v1/templates/:name":                 {Summary: "Register or replace a VM template", Body: model.VMTemplate{}, Response: model.VMTemplate{}},
+	"DELETE /v1/templates/:name":              {Summary: "Delete a VM template", Response: namedStatus{}},
+	"GET /v1/kernels":                         {Summary: "List catalog kernels", Response: itemsOf{model.Kernel{}}},
+	"GET /v1/kernels/:name":                   {Summary: "Get a catalog kernel", Response: model.Kernel{}},
+	"PUT /v1/kernels/:name":                   {Summary: "Register or replace a catalog kernel", Body: model.Kernel{}, Response: model.Kernel{}},
+	"DELETE /v1/kernels/:name":                {Summary: "Delete a catalog kernel", Response: namedStatus{}},
+	"GET /v1/host/diagnostics":                {Summary: "Check whether the host can run VMs", Response: model.HostDiagnostics{}},
+	"GET /v1/host/capacity":                   {Summary: "vCPUs and memory committed against what the host admits", Response: model.HostCapacity{}},
+	"GET /v1/usage":                           {Summary: "VM usage over a period", Query: []string{"from", "to", "groupBy", "format"}, Response: model.UsageReport{}},
+	"GET /v1/metrics":                         {Summary: "Firecracker metrics totals of the host", Response: model.VMMetricsTotals{}},
+	"GET /v1/events":                          {Summary: "Store changes as server-sent events", Media: "text/event-stream"},
+	"GET /v1/audit":                           {Summary: "Mutating API calls, newest first", Query: []string{"vm", "token", "action", "namespace", "since", "until", "limit"}, Response: itemsOf{model.AuditEntry{}}},
+	"POST /v1/backup":                         {Summary: "Download a backup archive", Query: []string{"includeData"}, Media: "application/gzip"},
+	"POST /v1/fsck":                           {Summary: "Check the store, quarantining broken VMs", Query: []string{"dryRun"}, Response: model.FsckReport{}},
+	"GET /v1/admin/breaker":                   {Summary: "Automation circuit breaker state", Response: model.BreakerState{}},
+	"POST /v1/admin/breaker/reset":            {Summary: "Reset the automation circuit breaker", Body: model.BreakerResetRequest{}, Response: model.BreakerState{}},
+	"POST /v1/admin/reload":                   {Summary: "Reload the config file", Response: config.ReloadResult{}},
+	"GET /v1/admin/loglevel":                  {Summary: "Log levels per component", Response: logging.LevelsSnapshot{}},
+	"PUT /v1/admin/loglevel":                  {Summary: "Change log levels", Body: model.LogLevelRequest{}, Response: logging.LevelsSnapshot{}},
+	"GET /v1/admin/maintenance":               {Summary: "Read-only mode state", Response: model.MaintenanceState{}},
+	"PUT /v1/admin/maintenance":               {Summary: "Enter or leave read-only mode", Body: model.MaintenanceRequest{}, Response: model.MaintenanceState{}},
+	"GET /v1/admin/upgrade":                   {Summary: "In-place upgrade status", Response: model.UpgradeStatus{}},
+}
+
+// migrationStream stands for the tar stream /v1/migrations reads.
+type migrationStream struct{}
+
+// RegisterOpenAPI serves /openapi.json, built from the routes of e on the
+// first request so that routes registered after it are included, and a
+// Swagger UI at /docs. Both stay open like /healthz; the spec holds no
+// secrets.
+func RegisterOpenAPI(e *echo.Echo) {
+	spec := sync.OnceValues(func() ([]byte, error) {
+		return json.Marshal(OpenAPI(e.Routes()))
+	})
+	e.GET("/openapi.json", func(c echo.Context) error {
+		body, err := spec()
+		if err != nil {
+			return c.JSON(http.StatusInternalServerError, errorResponse("internal_error", err))
+		}
+		res := c.Response()
+		res.Header().Set("Content-Type", "application/json")
+		res.WriteHeader(http.StatusOK)
+		_, err = res.Write(body)
+		return err
+	})
+	e.GET("/docs", func(c echo.Context) error {
+		res := c.Response()
+		res.Header().Set("Content-Type", "text/html; charset=utf-8")
+		res.Header().Set("Content-Security-Policy", docsCSP)
+		res.WriteHeader(http.StatusOK)
+		_, err := res.Write([]byte(docsPage))
+		return err
+	})
+}
+
+const swaggerUI = "https://unpkg.com/swagger-ui-dist@5"
+
+const docsScript = `SwaggerUIBundle({url: "/openapi.json", dom_id: "#swagger-ui"});`
+
+var docsPage = `<!doctype html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>mergend API</title>
+<link rel="stylesheet" href="` + swaggerUI + `/swagger-ui.css">
+</head>
+<body>
+<div id="swagger-ui"></div>
+<script src="` + swaggerUI + `/swagger-ui-bundle.js"></script>
+<script>` + docsScript + `</script>
+</body>
+</html>
+`
+
+// docsCSP loosens the API's policy for the UI only: its assets come from
+// unpkg and the one inline script is allowed by its hash.
+var docsCSP = func() string {
+	sum := sha256.Sum256([]byte(docsScript))
+	return "default-src 'none'; script-src https://unpkg.com 'sha256-" + base64.StdEncoding.EncodeToString(sum[:]) + "'; " +
+		"style-src https://unpkg.com; img-src 'self' data:; connect-src 'self'; frame-ancestors 'none'"
+}()
+
+// OpenAPI returns the OpenAPI 3 document of routes, leaving out /debug/
+// and the documentation routes themselves.
+func OpenAPI(routes []*echo.Route) map[string]any {
+	schemas := &schemaSet{schemas: map[string]any{}, names: map[string]reflect.Type{}}
+	paths := map[string]map[string]any{}
+	for _, route := range routes {
+		if strings.HasPrefix(route.Path, "/debug/") || route.Path == "/openapi.json" || route.Path == "/docs" {
+			continue
+		}
+		path, params := openAPIPath(route.Path)
+		if paths[path] == nil {
+			paths[path] = map[string]any{}
+		}
+		paths[path][strings.ToLower(route.Method)] = schemas.operation(route, params)
+	}
+	return map[string]any{
+		"openapi": "3.0.3",
+		"info": map[string]any{
+			"title":       "mergend API",
+			"version":     "v1",
+			"description": "Manages Firecracker microVMs as systemd units. Without API tokens configured no authentication is needed.",
+		},
+		"paths": paths,
+		"components": map[string]any{
+			"schemas": schemas.schemas,
+			"securitySchemes": map[string]any{
+				"bearerAuth": map[string]any{"type": "http", "scheme": "bearer"},
+			},
+		},
+	}
+}
+
+// openAPIPath turns /v1/vms/:id into /v1/vms/{id} and returns the params.
+func openAPIPath(pattern string) (string, []string) {
+	segments := strings.Split(pattern, "/")
+	var params []string
+	for i, segment := range segments {
+		if name, ok := strings.CutPrefix(segment, ":"); ok {
+			segments[i] = "{" + name + "}"
+			params = append(params, name)
+		}
+	}
+	return strings.Join(segments, "/"), params
+}
+
+// schemaSet collects the named schemas operations refer to.
+type schemaSet struct {
+	schemas map[string]any
+	names   map[string]reflect.Type
+}
+
+func (s *schemaSet) operation(route *echo.Route, params []string) map[string]any {
+	doc, ok := apiOperations[route.Method+" "+route.Path]
+	if !ok {
+		doc.Summary = route.Method + " " + route.Path
+	}
+	op := map[string]any{
+		"summary":     doc.Summary,
+		"operationId": operationID(route.Method, route.Path),
+		"tags":        []string{operationTag(route.Path)},
+	}
+	if strings.HasPrefix(route.Path, "/v1/") {
+		op["security"] = []map[string][]string{{"bearerAuth": {}}}
+	}
+	var parameters []map[string]any
+	for _, name := range params {
+		parameters = append(parameters, map[string]any{"name": name, "in": "path", "required": true, "schema": map[string]any{"type": "string"}})
+	}
+	for _, name := range doc.Query {
+		parameters = append(parameters, map[string]any{"name": name, "in": "query", "schema": map[string]any{"type": "string"}})
+	}
+	if len(parameters) > 0 {
+		op["parameters"] = parameters
+	}
+	switch doc.Body.(type) {
+	case nil:
+	case migrationStream:
+		op["requestBody"] = map[string]any{"required": true, "content": map[string]any{migration.ContentType: map[string]any{}}}
+	default:
+		op["requestBody"] = map[string]any{"required": true, "content": jsonContent(s.schema(reflect.TypeOf(doc.Body)))}
+	}
+	status := doc.Status
+	if status == 0 {
+		status = http.StatusOK
+	}
+	response := map[string]any{"description": http.StatusText(status)}
+	switch {
+	case doc.Media != "":
+		response["content"] = map[string]any{doc.Media: map[string]any{}}
+	case doc.Response != nil:
+		response["content"] = jsonContent(s.responseSchema(doc.Response))
+	}
+	op["responses"] = map[string]any{
+		strconv.Itoa(status): response,
+		"default":            map[string]any{"description": "Error", "content": jsonContent(s.schema(reflect.TypeOf(errorBody{})))},
+	}
+	return op
+}
+
+func (s *schemaSet) responseSchema(response any) map[string]any {
+	if list, ok := response.(itemsOf); ok {
+		return map[string]any{
+			"type":       "object",
+			"properties": map[string]any{"items": map[string]any{"type": "array", "items": s.schema(reflect.TypeOf(list.elem))}},
+		}
+	}
+	return s.schema(reflect.TypeOf(response))
+}
+
+var (
+	timeType = reflect.TypeOf(time.Time{})
+	rawType  = reflect.TypeOf(json.RawMessage{})
+)
+
+// schema describes t as encoding/json writes it. Named structs become
+// components, referenced by name.
+func (s *schemaSet) schema(t reflect.Type) map[string]any {
+	switch t {
+	case timeType:
+		return map[string]any{"type": "string", "format": "date-time"}
+	case rawType:
+		return map[string]any{}
+	}
+	switch t.Kind() {
+	case reflect.Pointer:
+		return s.schema(t.Elem())
+	case reflect.Bool:
+		return map[string]any{"type": "boolean"}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return map[string]any{"type": "integer"}
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return map[string]any{"type": "integer", "minimum": 0}
+	case reflect.Float32, reflect.Float64:
+		return map[string]any{"type": "number"}
+	case reflect.String:
+		return map[string]any{"type": "string"}
+	case reflect.Slice, reflect.Array:
+		if t.Elem().Kind() == reflect.Uint8 {
+			return map[string]any{"type": "string", "format": "byte"}
+		}
+		return map[string]any{"type": "array", "items": s.schema(t.Elem())}
+	case reflect.Map:
+		return map[string]any{"type": "object", "additionalProperties": s.schema(t.Elem())}
+	case reflect.Struct:
+		if t.Name() == "" {
+			return s.object(t)
+		}
+		name := s.name(t)
+		if _, ok := s.schemas[name]; !ok {
+			// Claim the name before recursing so that self-references end.
+			s.schemas[name] = map[string]any{}
+			s.schemas[name] = s.object(t)
+		}
+		return map[string]any{"$ref": "#/components/schemas/" + name}
+	default:
+		return map[string]any{}
+	}
+}
+
+// name is t's type name, capitalized, and qualified by its package when
+// another package's type took the bare name first.
+func (s *schemaSet) name(t reflect.Type) string {
+	name := strings.ToUpper(t.Name()[:1]) + t.Name()[1:]
+	if other, ok := s.names[name]; ok && other != t {
+		pkg := t.PkgPath()
+		name = pkg[strings.LastIndex(pkg, "/")+1:] + "." + name
+	}
+	s.names[name] = t
+	return name
+}
+
+func (s *schemaSet) object(t reflect.Type) map[string]any {
+	properties := map[string]any{}
+	s.fields(t, properties)
+	return map[string]any{"type": "object", "properties": properties}
+}
+
+// fields adds the json fields of t, including those of embedded structs.
+func (s *schemaSet) fields(t reflect.Type, properties map[string]any) {
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		tag := field.Tag.Get("json")
+		if tag == "-" {
+			continue
+		}
+		name, _, _ := strings.Cut(tag, ",")
+		if field.Anonymous && name == "" {
+			embedded := field.Type
+			if embedded.Kind() == reflect.Pointer {
+				embedded = embedded.Elem()
+			}
+			if embedded.Kind() == reflect.Struct {
+				s.fields(embedded, properties)
+				continue
+			}
+		}
+		if !field.IsExported() {
+			continue
+		}
+		if name == "" {
+			name = field.Name
+		}
+		properties[name] = s.schema(field.Type)
+	}
+}
+
+func jsonContent(schema map[string]any) map[string]any {
+	return map[string]any{"application/json": map[string]any{"schema": schema}}
+}
+
+// operationID turns "POST /v1/vms/:id/start" into "postVmsIdStart".
+func operationID(method, path string) string {
+	id := strings.ToLower(method)
+	for _, word := range strings.FieldsFunc(strings.TrimPrefix(path, "/v1"), func(r rune) bool {
+		return r == '/' || r == ':' || r == '-'
+	}) {
+		id += strings.ToUpper(word[:1]) + word[1:]
+	}
+	return id
+}
+
+// operationTag groups operations by their first path segment after /v1.
+func operationTag(path string) string {
+	rest := strings.TrimPrefix(path, "/v1/")
+	tag, _, _ := strings.Cut(rest, "/")
+	tag, _, _ = strings.Cut(tag, ":")
+	return strings.TrimPrefix(tag, "/")
+}
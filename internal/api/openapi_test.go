@@ -0,0 +1,78 @@
+package api
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/labstack/echo/v4"
+)
+
+func TestOpenAPI(t *testing.T) {
+	e := echo.New()
+	Register(e, nil, RedactionConfig{}, nil)
+	RegisterAdmin(e, nil, nil, nil)
+	RegisterMaintenance(e, NewMaintenance(false), nil)
+	RegisterOpenAPI(e)
+
+	for _, route := range e.Routes() {
+		if !strings.HasPrefix(route.Path, "/v1/") {
+			continue
+		}
+		if _, ok := apiOperations[route.Method+" "+route.Path]; !ok {
+			t.Errorf("%s %s is not documented in apiOperations", route.Method, route.Path)
+		}
+	}
+
+	rec := httptest.NewRecorder()
+	e.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/openapi.json", nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("openapi.json: got %d", rec.Code)
+	}
+	var spec struct {
+		OpenAPI string `json:"openapi"`
+		Paths   map[string]map[string]struct {
+			Parameters []struct {
+				Name string `json:"name"`
+				In   string `json:"in"`
+			} `json:"parameters"`
+			Responses map[string]struct {
+				Content map[string]struct {
+					Schema map[string]any `json:"schema"`
+				} `json:"content"`
+			} `json:"responses"`
+		} `json:"paths"`
+		Components struct {
+			Schemas map[string]struct {
+				Properties map[string]any `json:"properties"`
+			} `json:"schemas"`
+		} `json:"components"`
+	}
+	if err := json.Unmarshal(rec.Body.Bytes(), &spec); err != nil {
+		t.Fatalf("decode spec: %v", err)
+	}
+	if spec.OpenAPI != "3.0.3" {
+		t.Fatalf("unexpected openapi version %q", spec.OpenAPI)
+	}
+	getVM, ok := spec.Paths["/v1/vms/{id}"]["get"]
+	if !ok || len(getVM.Parameters) == 0 || getVM.Parameters[0].Name != "id" || getVM.Parameters[0].In != "path" {
+		t.Fatalf("GET /v1/vms/{id} missing or without its path parameter: %+v", getVM)
+	}
+	if ref := getVM.Responses["200"].Content["application/json"].Schema["$ref"]; ref != "#/components/schemas/VMSummary" {
+		t.Fatalf("GET /v1/vms/{id} responds with %v", ref)
+	}
+	if _, ok := spec.Components.Schemas["VMSummary"].Properties["namespace"]; !ok {
+		t.Fatalf("VMSummary schema lacks json fields: %+v", spec.Components.Schemas["VMSummary"])
+	}
+	if _, ok := spec.Paths["/v1/vms:batch"]["post"]; !ok {
+		t.Fatal("POST /v1/vms:batch missing")
+	}
+
+	rec = httptest.NewRecorder()
+	e.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/docs", nil))
+	if rec.Code != http.StatusOK || !strings.Contains(rec.Body.String(), "/openapi.json") || !strings.Contains(rec.Header().Get("Content-Security-Policy"), "'sha256-") {
+		t.Fatalf("docs: got %d, csp %q", rec.Code, rec.Header().Get("Content-Security-Policy"))
+	}
+}
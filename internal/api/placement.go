@@ -0,0 +1,95 @@
+package api
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/labstack/echo/v4"
+
+	"github.com/alperreha/mergen-fire/internal/logging"
+	"github.com/alperreha/mergen-fire/internal/manager"
+	"github.com/alperreha/mergen-fire/internal/model"
+	"github.com/alperreha/mergen-fire/internal/tracing"
+)
+
+// HeaderScheduledHost marks a create request forwarded by a peer that already
+// scheduled it onto the receiving host.
+const HeaderScheduledHost = "X-Mergen-Scheduled-Host"
+
+var peerClient = &http.Client{Timeout: 60 * time.Second}
+
+func scheduledContext(c echo.Context) context.Context {
+	ctx := c.Request().Context()
+	if host := strings.TrimSpace(c.Request().Header.Get(HeaderScheduledHost)); host != "" {
+		ctx = manager.WithScheduledHost(ctx, host)
+	}
+	return ctx
+}
+
+// peerHeader carries the caller's credentials and request id to another
+// mergend host acting on its behalf.
+func peerHeader(c echo.Context) http.Header {
+	header := http.Header{}
+	if id := logging.RequestID(c.Request().Context()); id != "" {
+		header.Set(HeaderRequestID, id)
+	}
+	if auth := c.Request().Header.Get("Authorization"); auth != "" {
+		header.Set("Authorization", auth)
+	}
+	return header
+}
+
+// forwardCreate sends a create request to the host it was scheduled onto and
+// relays that host's response.
+func (h *Handler) forwardCreate(c echo.Context, req model.CreateVMRequest, host model.HostInfo) error {
+	resp, data, err := h.sendCreate(c.Request().Context(), peerHeader(c), req, host)
+	if err != nil {
+		return h.writeServiceError(c, err)
+	}
+	res := c.Response()
+	res.Header().Set(HeaderScheduledHost, host.Name)
+	res.Header().Set("Content-Type", resp.Header.Get("Content-Type"))
+	res.WriteHeader(resp.StatusCode)
+	_, err = res.Write(data)
+	return err
+}
+
+// sendCreate posts req to host as a request already scheduled there and
+// returns the response with its body read.
+func (h *Handler) sendCreate(ctx context.Context, header http.Header, req model.CreateVMRequest, host model.HostInfo) (*http.Response, []byte, error) {
+	if host.URL == "" {
+		return nil, nil, fmt.Errorf("%w: vm scheduled on %s, which advertises no API URL", manager.ErrConflict, host.Name)
+	}
+	body, err := json.Marshal(req)
+	if err != nil {
+		return nil, nil, err
+	}
+	forward, err := http.NewRequestWithContext(ctx, http.MethodPost, strings.TrimRight(host.URL, "/")+"/v1/vms", bytes.NewReader(body))
+	if err != nil {
+		return nil, nil, err
+	}
+	forward.Header = header
+	forward.Header.Set("Content-Type", "application/json")
+	forward.Header.Set(HeaderScheduledHost, host.Name)
+	if traceparent := tracing.Traceparent(ctx); traceparent != "" {
+		forward.Header.Set("traceparent", traceparent)
+	}
+
+	h.logger.InfoContext(ctx, "forwarding create vm to scheduled host", "host", host.Name, "url", host.URL)
+	resp, err := peerClient.Do(forward)
+	if err != nil {
+		return nil, nil, fmt.Errorf("%w: forward to %s: %v", manager.ErrUnavailable, host.Name, err)
+	}
+	defer resp.Body.Close()
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, nil, fmt.Errorf("%w: read response from %s: %v", manager.ErrUnavailable, host.Name, err)
+	}
+	return resp, data, nil
+}
@@ -0,0 +1,47 @@
+package api
+
+import (
+	"net/http"
+
+	"github.com/labstack/echo/v4"
+
+	"github.com/alperreha/mergen-fire/internal/model"
+)
+
+func (h *Handler) listPortReservations(c echo.Context) error {
+	reservations, err := h.service.ListPortReservations(c.Request().Context())
+	if err != nil {
+		return h.writeServiceError(c, err)
+	}
+	return c.JSON(http.StatusOK, map[string]any{"items": reservations})
+}
+
+func (h *Handler) reservePort(c echo.Context) error {
+	h.logger.DebugContext(c.Request().Context(), "http reserve port", "method", c.Request().Method, "path", c.Request().URL.Path)
+	var req model.PortReservationRequest
+	if err := c.Bind(&req); err != nil {
+		return c.JSON(http.StatusBadRequest, errorResponse("bad_request", err))
+	}
+	res, err := h.service.ReservePort(c.Request().Context(), req)
+	if err != nil {
+		return h.writeServiceError(c, err)
+	}
+	h.logger.InfoContext(c.Request().Context(), "http reserve port success", "port", res.Port, "owner", res.Owner)
+	return c.JSON(http.StatusCreated, res)
+}
+
+func (h *Handler) releasePort(c echo.Context) error {
+	var req model.PortReleaseRequest
+	if err := c.Bind(&req); err != nil {
+		return c.JSON(http.StatusBadRequest, errorResponse("bad_request", err))
+	}
+	res, err := h.service.ReleasePort(c.Request().Context(), req.Port)
+	if err != nil {
+		return h.writeServiceError(c, err)
+	}
+	h.logger.InfoContext(c.Request().Context(), "http release port success", "port", res.Port, "owner", res.Owner)
+	return c.JSON(http.StatusOK, map[string]any{
+		"port":   res.Port,
+		"status": "released",
+	})
+}
@@ -0,0 +1,74 @@
+package api
+
+import (
+	"crypto/subtle"
+	"errors"
+	"net/http"
+	"strings"
+
+	"github.com/labstack/echo/v4"
+
+	"github.com/alperreha/mergen-fire/internal/model"
+)
+
+// RedactionConfig controls the masking of secret-looking values in
+// responses. Allow lists keys that are shown anyway. With RevealToken set,
+// ?reveal=true and "Authorization: Bearer <RevealToken>" return values
+// unmasked; without it nobody can reveal them over the API.
+type RedactionConfig struct {
+	Allow       []string
+	RevealToken string
+}
+
+// reveal reports whether c asked for unredacted values and may have them.
+func (h *Handler) reveal(c echo.Context) (bool, error) {
+	requested, err := parseBool(c.QueryParam("reveal"))
+	if err != nil {
+		return false, errors.New("reveal must be a boolean")
+	}
+	if !requested {
+		return false, nil
+	}
+	token, ok := strings.CutPrefix(c.Request().Header.Get("Authorization"), "Bearer ")
+	if h.revealToken == "" || !ok || subtle.ConstantTimeCompare([]byte(strings.TrimSpace(token)), []byte(h.revealToken)) != 1 {
+		return false, errRevealForbidden
+	}
+	h.logger.WarnContext(c.Request().Context(), "secrets revealed", "method", c.Request().Method, "path", c.Request().URL.Path, "remoteAddr", c.Request().RemoteAddr)
+	return true, nil
+}
+
+var errRevealForbidden = errors.New("reveal needs the reveal token as a bearer token")
+
+func (h *Handler) writeRevealError(c echo.Context, err error) error {
+	if errors.Is(err, errRevealForbidden) {
+		return c.JSON(http.StatusForbidden, errorResponse("forbidden", err))
+	}
+	return c.JSON(http.StatusBadRequest, errorResponse("bad_request", err))
+}
+
+func (h *Handler) redactVM(vm model.VMSummary) model.VMSummary {
+	vm.Metadata = h.redactor.Map(vm.Metadata)
+	return vm
+}
+
+func (h *Handler) redactHookTest(result model.HookTestResult) model.HookTestResult {
+	result.Hook.Headers = h.redactor.Strings(result.Hook.Headers)
+	result.Hook.URL = h.redactor.URL(result.Hook.URL)
+	result.Rendered.Headers = h.redactor.Strings(result.Rendered.Headers)
+	result.Rendered.URL = h.redactor.URL(result.Rendered.URL)
+	if result.Execution != nil {
+		execution := *result.Execution
+		execution.Target = h.redactor.URL(execution.Target)
+		result.Execution = &execution
+	}
+	return result
+}
+
+func (h *Handler) redactHookHistory(items []model.HookExecution) []model.HookExecution {
+	out := make([]model.HookExecution, len(items))
+	for i, item := range items {
+		item.Target = h.redactor.URL(item.Target)
+		out[i] = item
+	}
+	return out
+}
@@ -0,0 +1,66 @@
+package api
+
+import (
+	"net/http"
+
+	"github.com/labstack/echo/v4"
+
+	"github.com/alperreha/mergen-fire/internal/model"
+)
+
+func (h *Handler) createSnapshot(c echo.Context) error {
+	id := c.Param("id")
+	h.logger.DebugContext(c.Request().Context(), "http create snapshot", "vmID", id, "method", c.Request().Method, "path", c.Request().URL.Path)
+	var req model.CreateSnapshotRequest
+	if c.Request().ContentLength != 0 {
+		if err := c.Bind(&req); err != nil {
+			return c.JSON(http.StatusBadRequest, errorResponse("bad_request", err))
+		}
+	}
+	snap, err := h.service.CreateSnapshot(c.Request().Context(), id, req)
+	if err != nil {
+		return h.writeServiceError(c, err)
+	}
+	h.logger.InfoContext(c.Request().Context(), "http create snapshot success", "vmID", id, "snapshot", snap.ID)
+	return c.JSON(http.StatusCreated, snap)
+}
+
+func (h *Handler) listSnapshots(c echo.Context) error {
+	snaps, err := h.service.ListSnapshots(c.Request().Context(), c.Param("id"))
+	if err != nil {
+		return h.writeServiceError(c, err)
+	}
+	return c.JSON(http.StatusOK, map[string]any{"items": snaps})
+}
+
+func (h *Handler) deleteSnapshot(c echo.Context) error {
+	id, snapshot := c.Param("id"), c.Param("snapshot")
+	h.logger.DebugContext(c.Request().Context(), "http delete snapshot", "vmID", id, "snapshot", snapshot, "method", c.Request().Method, "path", c.Request().URL.Path)
+	if err := h.service.DeleteSnapshot(c.Request().Context(), id, snapshot); err != nil {
+		return h.writeServiceError(c, err)
+	}
+	return c.JSON(http.StatusOK, map[string]any{
+		"id":       id,
+		"snapshot": snapshot,
+		"status":   "deleted",
+	})
+}
+
+func (h *Handler) restoreSnapshot(c echo.Context) error {
+	id := c.Param("id")
+	h.logger.DebugContext(c.Request().Context(), "http restore snapshot", "vmID", id, "method", c.Request().Method, "path", c.Request().URL.Path)
+	var req model.RestoreSnapshotRequest
+	if err := c.Bind(&req); err != nil {
+		return c.JSON(http.StatusBadRequest, errorResponse("bad_request", err))
+	}
+	snap, err := h.service.RestoreSnapshot(c.Request().Context(), id, req)
+	if err != nil {
+		return h.writeServiceError(c, err)
+	}
+	h.logger.InfoContext(c.Request().Context(), "http restore snapshot success", "vmID", id, "snapshot", snap.ID)
+	return c.JSON(http.StatusOK, map[string]any{
+		"id":       id,
+		"snapshot": snap,
+		"status":   "restored",
+	})
+}
@@ -0,0 +1,76 @@
+package api
+
+import (
+	"net/http"
+
+	"github.com/labstack/echo/v4"
+
+	"github.com/alperreha/mergen-fire/internal/model"
+)
+
+func (h *Handler) createStack(c echo.Context) error {
+	h.logger.DebugContext(c.Request().Context(), "http create stack", "method", c.Request().Method, "path", c.Request().URL.Path)
+	var manifest model.StackManifest
+	if err := c.Bind(&manifest); err != nil {
+		return c.JSON(http.StatusBadRequest, errorResponse("bad_request", err))
+	}
+	stack, err := h.service.CreateStack(c.Request().Context(), manifest)
+	if err != nil {
+		return h.writeServiceError(c, err)
+	}
+	h.logger.InfoContext(c.Request().Context(), "http create stack success", "stack", stack.Name, "members", len(stack.Members))
+	return c.JSON(http.StatusCreated, stack)
+}
+
+func (h *Handler) listStacks(c echo.Context) error {
+	stacks, err := h.service.ListStacks(c.Request().Context())
+	if err != nil {
+		return h.writeServiceError(c, err)
+	}
+	return c.JSON(http.StatusOK, map[string]any{"items": stacks})
+}
+
+func (h *Handler) getStack(c echo.Context) error {
+	stack, err := h.service.GetStack(c.Request().Context(), c.Param("name"))
+	if err != nil {
+		return h.writeServiceError(c, err)
+	}
+	return c.JSON(http.StatusOK, stack)
+}
+
+func (h *Handler) startStack(c echo.Context) error {
+	name := c.Param("name")
+	h.logger.DebugContext(c.Request().Context(), "http start stack", "stack", name, "method", c.Request().Method, "path", c.Request().URL.Path)
+	stack, err := h.service.StartStack(c.Request().Context(), name)
+	if err != nil {
+		return h.writeServiceError(c, err)
+	}
+	return c.JSON(http.StatusOK, stack)
+}
+
+func (h *Handler) stopStack(c echo.Context) error {
+	name := c.Param("name")
+	h.logger.DebugContext(c.Request().Context(), "http stop stack", "stack", name, "method", c.Request().Method, "path", c.Request().URL.Path)
+	stack, err := h.service.StopStack(c.Request().Context(), name)
+	if err != nil {
+		return h.writeServiceError(c, err)
+	}
+	return c.JSON(http.StatusOK, stack)
+}
+
+func (h *Handler) deleteStack(c echo.Context) error {
+	name := c.Param("name")
+	h.logger.DebugContext(c.Request().Context(), "http delete stack", "stack", name, "method", c.Request().Method, "path", c.Request().URL.Path, "retainDataRaw", c.QueryParam("retainData"))
+	retainData, err := parseBool(c.QueryParam("retainData"))
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, errorResponse("bad_request", err))
+	}
+	if err := h.service.DeleteStack(c.Request().Context(), name, retainData); err != nil {
+		return h.writeServiceError(c, err)
+	}
+	h.logger.InfoContext(c.Request().Context(), "http delete stack success", "stack", name, "retainData", retainData)
+	return c.JSON(http.StatusOK, map[string]any{
+		"name":   name,
+		"status": "deleted",
+	})
+}
@@ -0,0 +1,56 @@
+package api
+
+import (
+	"net/http"
+
+	"github.com/labstack/echo/v4"
+
+	"github.com/alperreha/mergen-fire/internal/model"
+)
+
+func (h *Handler) listTemplates(c echo.Context) error {
+	h.logger.DebugContext(c.Request().Context(), "http list templates", "method", c.Request().Method, "path", c.Request().URL.Path)
+	templates, err := h.service.ListTemplates(c.Request().Context())
+	if err != nil {
+		return h.writeServiceError(c, err)
+	}
+	return c.JSON(http.StatusOK, map[string]any{"items": templates})
+}
+
+func (h *Handler) getTemplate(c echo.Context) error {
+	name := c.Param("name")
+	template, err := h.service.GetTemplate(c.Request().Context(), name)
+	if err != nil {
+		return h.writeServiceError(c, err)
+	}
+	return c.JSON(http.StatusOK, template)
+}
+
+// putTemplate registers or replaces the template named in the path.
+func (h *Handler) putTemplate(c echo.Context) error {
+	name := c.Param("name")
+	h.logger.DebugContext(c.Request().Context(), "http put template", "template", name, "method", c.Request().Method, "path", c.Request().URL.Path)
+	var req model.VMTemplate
+	if err := c.Bind(&req); err != nil {
+		return c.JSON(http.StatusBadRequest, errorResponse("bad_request", err))
+	}
+	req.Name = name
+	template, err := h.service.PutTemplate(c.Request().Context(), req)
+	if err != nil {
+		return h.writeServiceError(c, err)
+	}
+	h.logger.InfoContext(c.Request().Context(), "http put template success", "template", template.Name)
+	return c.JSON(http.StatusOK, template)
+}
+
+func (h *Handler) deleteTemplate(c echo.Context) error {
+	name := c.Param("name")
+	if err := h.service.DeleteTemplate(c.Request().Context(), name); err != nil {
+		return h.writeServiceError(c, err)
+	}
+	h.logger.InfoContext(c.Request().Context(), "http delete template success", "template", name)
+	return c.JSON(http.StatusOK, map[string]any{
+		"name":   name,
+		"status": "deleted",
+	})
+}
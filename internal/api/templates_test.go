@@ -0,0 +1,73 @@
+package api_test
+
+import (
+	"encoding/json"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/alperreha/mergen-fire/internal/model"
+	"github.com/alperreha/mergen-fire/internal/testsupport"
+)
+
+func TestCreateVMFromTemplate(t *testing.T) {
+	env := testsupport.NewEnv(t)
+	spec := env.Artifacts.CreateRequest()
+	spec.Tags = map[string]string{"tier": "web"}
+	status, body := env.Request(t, http.MethodPut, "/v1/templates/web-small", model.VMTemplate{Description: "small web vm", Spec: spec})
+	if status != http.StatusOK {
+		t.Fatalf("put template: status %d body %s", status, body)
+	}
+	if status, body := env.Request(t, http.MethodGet, "/v1/templates", nil); status != http.StatusOK || !json.Valid(body) {
+		t.Fatalf("list templates: status %d body %s", status, body)
+	}
+	templates, err := env.Store.ListTemplates()
+	if err != nil || len(templates) != 1 || templates[0].Name != "web-small" || templates[0].CreatedAt.IsZero() {
+		t.Fatalf("unexpected stored templates: %+v (%v)", templates, err)
+	}
+	configRoot := filepath.Dir(env.Store.PathsFor("x").ConfigDir)
+	if _, err := os.Stat(filepath.Join(filepath.Dir(configRoot), "templates.d", "web-small.json")); err != nil {
+		t.Fatalf("template not stored next to vm.d: %v", err)
+	}
+
+	id := env.CreateVM(t, map[string]any{
+		"template":  "web-small",
+		"overrides": map[string]any{"memMiB": 256, "tags": map[string]string{"team": "shop"}},
+	})
+	meta, err := env.Store.ReadMeta(id)
+	if err != nil {
+		t.Fatalf("read meta: %v", err)
+	}
+	cfg, err := env.Store.ReadVMConfig(id)
+	if err != nil {
+		t.Fatalf("read config: %v", err)
+	}
+	if cfg.MachineConfig.MemSizeMiB != 256 || cfg.MachineConfig.VCPUCount != 1 || meta.RootFS != spec.RootFS {
+		t.Fatalf("overrides not applied over the template: %+v %+v", cfg.MachineConfig, meta)
+	}
+	if meta.Tags["tier"] != "web" || meta.Tags["team"] != "shop" || meta.Tags["mergen.template"] != "web-small" {
+		t.Fatalf("unexpected tags: %+v", meta.Tags)
+	}
+
+	for _, req := range []map[string]any{
+		{"template": "missing"},
+		{"template": "web-small", "vcpu": 2},
+		{"template": "web-small", "overrides": map[string]any{"vcpus": 2}},
+		{"overrides": map[string]any{"vcpu": 2}},
+	} {
+		if status, body := env.Request(t, http.MethodPost, "/v1/vms", req); status != http.StatusBadRequest {
+			t.Fatalf("create %v: status %d body %s, want 400", req, status, body)
+		}
+	}
+
+	if status, body := env.Request(t, http.MethodDelete, "/v1/templates/web-small", nil); status != http.StatusOK {
+		t.Fatalf("delete template: status %d body %s", status, body)
+	}
+	if status, _ := env.Request(t, http.MethodGet, "/v1/templates/web-small", nil); status != http.StatusNotFound {
+		t.Fatalf("get deleted template: status %d, want 404", status)
+	}
+	if _, err := env.Store.ReadMeta(id); err != nil {
+		t.Fatalf("vm created from a deleted template: %v", err)
+	}
+}
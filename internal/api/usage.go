@@ -0,0 +1,51 @@
+package api
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/labstack/echo/v4"
+
+	"github.com/alperreha/mergen-fire/internal/usage"
+)
+
+const defaultUsageWindow = 24 * time.Hour
+
+// usage reports consumption between from and to (RFC 3339, default the last
+// 24 hours) grouped by a tag; format=csv returns it as CSV.
+func (h *Handler) usage(c echo.Context) error {
+	h.logger.DebugContext(c.Request().Context(), "http usage", "method", c.Request().Method, "path", c.Request().URL.Path, "from", c.QueryParam("from"), "to", c.QueryParam("to"))
+	to := time.Now().UTC()
+	if raw := c.QueryParam("to"); raw != "" {
+		parsed, err := time.Parse(time.RFC3339, raw)
+		if err != nil {
+			return c.JSON(http.StatusBadRequest, errorResponse("bad_request", fmt.Errorf("invalid to: %w", err)))
+		}
+		to = parsed
+	}
+	from := to.Add(-defaultUsageWindow)
+	if raw := c.QueryParam("from"); raw != "" {
+		parsed, err := time.Parse(time.RFC3339, raw)
+		if err != nil {
+			return c.JSON(http.StatusBadRequest, errorResponse("bad_request", fmt.Errorf("invalid from: %w", err)))
+		}
+		from = parsed
+	}
+	format := c.QueryParam("format")
+	if format != "" && format != "json" && format != "csv" {
+		return c.JSON(http.StatusBadRequest, errorResponse("bad_request", errors.New("format must be json or csv")))
+	}
+
+	report, err := h.service.Usage(c.Request().Context(), from, to, c.QueryParam("groupBy"))
+	if err != nil {
+		return h.writeServiceError(c, err)
+	}
+	if format == "csv" {
+		c.Response().Header().Set("Content-Type", "text/csv; charset=utf-8")
+		c.Response().WriteHeader(http.StatusOK)
+		return usage.WriteCSV(c.Response(), report)
+	}
+	return c.JSON(http.StatusOK, report)
+}
@@ -0,0 +1,205 @@
+package api
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/labstack/echo/v4"
+)
+
+// The subset of RFC 6455 the console needs: one connection per handler,
+// no extensions and no subprotocols.
+const (
+	wsGUID = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+
+	wsContinuation = 0x0
+	wsText         = 0x1
+	wsBinary       = 0x2
+	wsClose        = 0x8
+	wsPing         = 0x9
+	wsPong         = 0xa
+
+	// wsMaxMessage bounds a client message; console input is keystrokes
+	// and pasted lines.
+	wsMaxMessage = 64 << 10
+)
+
+var errNotWebSocket = errors.New("expected a websocket upgrade request")
+
+type wsConn struct {
+	conn    net.Conn
+	reader  *bufio.Reader
+	writeMu sync.Mutex
+}
+
+// checkWebSocket validates an upgrade request before anything is written,
+// so a bad one can still be answered with JSON.
+func checkWebSocket(r *http.Request) error {
+	if !headerHasToken(r.Header, "Connection", "upgrade") || !headerHasToken(r.Header, "Upgrade", "websocket") {
+		return errNotWebSocket
+	}
+	if r.Header.Get("Sec-WebSocket-Version") != "13" {
+		return fmt.Errorf("unsupported websocket version %q, expected 13", r.Header.Get("Sec-WebSocket-Version"))
+	}
+	if r.Header.Get("Sec-WebSocket-Key") == "" {
+		return errors.New("missing Sec-WebSocket-Key")
+	}
+	return nil
+}
+
+// upgradeWebSocket takes over the connection of a request checkWebSocket
+// accepted and completes the handshake.
+func upgradeWebSocket(c echo.Context) (*wsConn, error) {
+	conn, rw, err := http.NewResponseController(c.Response().Writer).Hijack()
+	if err != nil {
+		return nil, fmt.Errorf("take over connection: %w", err)
+	}
+	c.Response().Committed = true
+	// The server's read and write deadlines are meant for requests, not
+	// for a session that lasts as long as the operator stays attached.
+	_ = conn.SetDeadline(time.Time{})
+	sum := sha1.Sum([]byte(c.Request().Header.Get("Sec-WebSocket-Key") + wsGUID))
+	handshake := "HTTP/1.1 101 Switching Protocols\r\n" +
+		"Upgrade: websocket\r\n" +
+		"Connection: Upgrade\r\n" +
+		"Sec-WebSocket-Accept: " + base64.StdEncoding.EncodeToString(sum[:]) + "\r\n\r\n"
+	if _, err := conn.Write([]byte(handshake)); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return &wsConn{conn: conn, reader: rw.Reader}, nil
+}
+
+func headerHasToken(header http.Header, name, token string) bool {
+	for _, value := range header.Values(name) {
+		for _, part := range strings.Split(value, ",") {
+			if strings.EqualFold(strings.TrimSpace(part), token) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// ReadMessage returns the next text or binary message, answering pings on
+// the way. A close from the client is answered and returned as io.EOF.
+func (w *wsConn) ReadMessage() (byte, []byte, error) {
+	var (
+		opcode  byte
+		message []byte
+	)
+	for {
+		fin, op, payload, err := w.readFrame()
+		if err != nil {
+			return 0, nil, err
+		}
+		switch op {
+		case wsPing:
+			if err := w.writeFrame(wsPong, payload); err != nil {
+				return 0, nil, err
+			}
+			continue
+		case wsPong:
+			continue
+		case wsClose:
+			_ = w.writeFrame(wsClose, payload)
+			return 0, nil, io.EOF
+		case wsText, wsBinary:
+			if opcode != 0 {
+				return 0, nil, errors.New("websocket: new message inside a fragmented one")
+			}
+			opcode = op
+		case wsContinuation:
+			if opcode == 0 {
+				return 0, nil, errors.New("websocket: continuation without a message")
+			}
+		default:
+			return 0, nil, fmt.Errorf("websocket: unknown opcode %#x", op)
+		}
+		if len(message)+len(payload) > wsMaxMessage {
+			return 0, nil, fmt.Errorf("websocket: message exceeds %d bytes", wsMaxMessage)
+		}
+		message = append(message, payload...)
+		if fin {
+			return opcode, message, nil
+		}
+	}
+}
+
+func (w *wsConn) readFrame() (bool, byte, []byte, error) {
+	var head [2]byte
+	if _, err := io.ReadFull(w.reader, head[:]); err != nil {
+		return false, 0, nil, err
+	}
+	fin, opcode := head[0]&0x80 != 0, head[0]&0x0f
+	if head[1]&0x80 == 0 {
+		return false, 0, nil, errors.New("websocket: client frame is not masked")
+	}
+	length := uint64(head[1] & 0x7f)
+	switch length {
+	case 126:
+		var ext [2]byte
+		if _, err := io.ReadFull(w.reader, ext[:]); err != nil {
+			return false, 0, nil, err
+		}
+		length = uint64(binary.BigEndian.Uint16(ext[:]))
+	case 127:
+		var ext [8]byte
+		if _, err := io.ReadFull(w.reader, ext[:]); err != nil {
+			return false, 0, nil, err
+		}
+		length = binary.BigEndian.Uint64(ext[:])
+	}
+	if length > wsMaxMessage {
+		return false, 0, nil, fmt.Errorf("websocket: frame exceeds %d bytes", wsMaxMessage)
+	}
+	var mask [4]byte
+	if _, err := io.ReadFull(w.reader, mask[:]); err != nil {
+		return false, 0, nil, err
+	}
+	payload := make([]byte, length)
+	if _, err := io.ReadFull(w.reader, payload); err != nil {
+		return false, 0, nil, err
+	}
+	for i := range payload {
+		payload[i] ^= mask[i%4]
+	}
+	return fin, opcode, payload, nil
+}
+
+// writeFrame sends payload as one unmasked frame, as servers do.
+func (w *wsConn) writeFrame(opcode byte, payload []byte) error {
+	w.writeMu.Lock()
+	defer w.writeMu.Unlock()
+	frame := make([]byte, 0, len(payload)+10)
+	frame = append(frame, 0x80|opcode)
+	switch {
+	case len(payload) < 126:
+		frame = append(frame, byte(len(payload)))
+	case len(payload) <= 0xffff:
+		frame = append(frame, 126)
+		frame = binary.BigEndian.AppendUint16(frame, uint16(len(payload)))
+	default:
+		frame = append(frame, 127)
+		frame = binary.BigEndian.AppendUint64(frame, uint64(len(payload)))
+	}
+	frame = append(frame, payload...)
+	_, err := w.conn.Write(frame)
+	return err
+}
+
+// Close sends a normal closure (1000) and closes the connection.
+func (w *wsConn) Close() error {
+	_ = w.writeFrame(wsClose, []byte{0x03, 0xe8})
+	return w.conn.Close()
+}
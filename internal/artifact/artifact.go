@@ -0,0 +1,152 @@
+// Package artifact pins the rootfs, kernel, initrd and data disk of a VM by SHA-256 so
+// drift or on-disk corruption is caught before boot instead of surfacing as a
+// kernel panic inside the guest.
+package artifact
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"io"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/alperreha/mergen-fire/internal/model"
+)
+
+// Writable lists the artifacts the guest mounts read-write; their checksums
+// only hold while the VM is stopped and are re-recorded after a clean stop.
+var Writable = []string{model.ArtifactRootFS, model.ArtifactDataDisk}
+
+// WritableFor is Writable without the rootfs of a VM that mounts it
+// read-only, so drift in a read-only root is still caught across starts.
+func WritableFor(meta model.VMMetadata) []string {
+	if meta.RootReadOnly {
+		return []string{model.ArtifactDataDisk}
+	}
+	return Writable
+}
+
+// Paths returns the host path of every artifact the VM references.
+func Paths(meta model.VMMetadata) map[string]string {
+	paths := map[string]string{
+		model.ArtifactRootFS: meta.RootFS,
+		model.ArtifactKernel: meta.Kernel,
+	}
+	if strings.TrimSpace(meta.Initrd) != "" {
+		paths[model.ArtifactInitrd] = meta.Initrd
+	}
+	if strings.TrimSpace(meta.DataDisk) != "" {
+		paths[model.ArtifactDataDisk] = meta.DataDisk
+	}
+	return paths
+}
+
+func Checksum(path string) (model.Artifact, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return model.Artifact{}, err
+	}
+	defer file.Close()
+
+	hash := sha256.New()
+	size, err := io.Copy(hash, file)
+	if err != nil {
+		return model.Artifact{}, err
+	}
+	return model.Artifact{
+		Path:       path,
+		SHA256:     hex.EncodeToString(hash.Sum(nil)),
+		Size:       size,
+		RecordedAt: time.Now().UTC(),
+	}, nil
+}
+
+// Record checksums the named artifacts of meta, or all of them when names is
+// empty. Names the VM does not reference are skipped.
+func Record(meta model.VMMetadata, names ...string) (map[string]model.Artifact, error) {
+	paths := Paths(meta)
+	if len(names) == 0 {
+		for name := range paths {
+			names = append(names, name)
+		}
+	}
+	recorded := make(map[string]model.Artifact, len(names))
+	for _, name := range names {
+		path, ok := paths[name]
+		if !ok {
+			continue
+		}
+		sum, err := Checksum(path)
+		if err != nil {
+			return nil, err
+		}
+		recorded[name] = sum
+	}
+	return recorded, nil
+}
+
+// Verify re-hashes every artifact and compares it with the recorded checksum.
+// Artifacts without a recorded checksum (VMs created before checksums existed)
+// are reported as unrecorded and do not fail the report.
+func Verify(meta model.VMMetadata) model.ArtifactReport {
+	report := model.ArtifactReport{ID: meta.ID, CheckedAt: time.Now().UTC(), OK: true}
+	paths := Paths(meta)
+	names := make([]string, 0, len(paths))
+	for name := range paths {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		status := model.ArtifactStatus{Name: name, Path: paths[name]}
+		expected, recorded := meta.Artifacts[name]
+		if recorded && expected.Path != paths[name] {
+			// The VM was pointed at a different file; the old checksum says
+			// nothing about it.
+			recorded = false
+		}
+		if recorded {
+			status.Expected = expected.SHA256
+		}
+
+		sum, err := Checksum(paths[name])
+		switch {
+		case errors.Is(err, os.ErrNotExist):
+			status.Status = model.ArtifactMissing
+		case err != nil:
+			status.Status = model.ArtifactMissing
+			status.Error = err.Error()
+		case !recorded:
+			status.Status = model.ArtifactUnrecorded
+			status.Actual = sum.SHA256
+			status.Size = sum.Size
+		case sum.SHA256 != expected.SHA256:
+			status.Status = model.ArtifactModified
+			status.Actual = sum.SHA256
+			status.Size = sum.Size
+		default:
+			status.Status = model.ArtifactOK
+			status.Actual = sum.SHA256
+			status.Size = sum.Size
+		}
+		if status.Status == model.ArtifactMissing || status.Status == model.ArtifactModified {
+			report.OK = false
+		}
+		report.Artifacts = append(report.Artifacts, status)
+	}
+	return report
+}
+
+// Failed names the artifacts that failed verification, for error messages.
+func Failed(report model.ArtifactReport) []string {
+	var failed []string
+	for _, status := range report.Artifacts {
+		if status.Status == model.ArtifactMissing || status.Status == model.ArtifactModified {
+			failed = append(failed, status.Name+" "+status.Status)
+		}
+	}
+	return failed
+}
@@ -0,0 +1,66 @@
+package artifact
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/alperreha/mergen-fire/internal/model"
+)
+
+func TestVerifyDetectsDrift(t *testing.T) {
+	base := t.TempDir()
+	rootfs := filepath.Join(base, "rootfs.ext4")
+	kernel := filepath.Join(base, "vmlinux")
+	data := filepath.Join(base, "data.ext4")
+	for _, path := range []string{rootfs, kernel, data} {
+		if err := os.WriteFile(path, []byte(filepath.Base(path)), 0o644); err != nil {
+			t.Fatalf("write %s: %v", path, err)
+		}
+	}
+
+	meta := model.VMMetadata{ID: "vm-1", RootFS: rootfs, Kernel: kernel, DataDisk: data}
+	recorded, err := Record(meta)
+	if err != nil {
+		t.Fatalf("record: %v", err)
+	}
+	if len(recorded) != 3 {
+		t.Fatalf("expected 3 checksums, got %d", len(recorded))
+	}
+	meta.Artifacts = recorded
+
+	if report := Verify(meta); !report.OK {
+		t.Fatalf("expected clean report, got %+v", report)
+	}
+
+	if err := os.WriteFile(rootfs, []byte("corrupted"), 0o644); err != nil {
+		t.Fatalf("corrupt rootfs: %v", err)
+	}
+	if err := os.Remove(data); err != nil {
+		t.Fatalf("remove data disk: %v", err)
+	}
+	report := Verify(meta)
+	if report.OK {
+		t.Fatalf("expected drift to fail the report")
+	}
+	statuses := map[string]string{}
+	for _, status := range report.Artifacts {
+		statuses[status.Name] = status.Status
+	}
+	want := map[string]string{
+		model.ArtifactRootFS:   model.ArtifactModified,
+		model.ArtifactKernel:   model.ArtifactOK,
+		model.ArtifactDataDisk: model.ArtifactMissing,
+	}
+	for name, status := range want {
+		if statuses[name] != status {
+			t.Fatalf("expected %s to be %s, got %s", name, status, statuses[name])
+		}
+	}
+
+	delete(meta.Artifacts, model.ArtifactRootFS)
+	meta.DataDisk = ""
+	if report := Verify(meta); !report.OK {
+		t.Fatalf("expected unrecorded artifacts not to fail, got %+v", report)
+	}
+}
@@ -0,0 +1,135 @@
+// Package audit keeps an append-only record of the mutating API calls made
+// to mergend, one JSON line per call. Entries are only ever appended; the
+// file is reopened for every entry, so it can be rotated by renaming it.
+package audit
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+	"sync"
+
+	"github.com/alperreha/mergen-fire/internal/model"
+)
+
+const (
+	// DefaultLimit is how many entries Query returns without a limit, and
+	// MaxLimit the most it returns.
+	DefaultLimit = 100
+	MaxLimit     = 1000
+)
+
+type Log struct {
+	path string
+	mu   sync.Mutex
+}
+
+// Open returns the log at path, creating the file and its directory so a
+// path mergend cannot write to fails at startup rather than on the first
+// call.
+func Open(path string) (*Log, error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0o750); err != nil {
+		return nil, err
+	}
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0o640)
+	if err != nil {
+		return nil, err
+	}
+	if err := file.Close(); err != nil {
+		return nil, err
+	}
+	return &Log{path: path}, nil
+}
+
+func (l *Log) Path() string {
+	return l.path
+}
+
+// Append writes entry as one line and syncs it to disk before it returns.
+func (l *Log) Append(entry model.AuditEntry) error {
+	line, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+	line = append(line, '\n')
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	file, err := os.OpenFile(l.path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0o640)
+	if err != nil {
+		return err
+	}
+	if _, err := file.Write(line); err != nil {
+		file.Close()
+		return err
+	}
+	if err := file.Sync(); err != nil {
+		file.Close()
+		return err
+	}
+	return file.Close()
+}
+
+// Query returns the newest entries matching filter, newest first. Lines
+// that do not parse, such as one torn by a crash, are skipped.
+func (l *Log) Query(filter model.AuditFilter) ([]model.AuditEntry, error) {
+	limit := filter.Limit
+	if limit <= 0 {
+		limit = DefaultLimit
+	}
+	limit = min(limit, MaxLimit)
+
+	// Appends are single writes to an O_APPEND file, so reading needs no
+	// lock; a line being written just does not parse yet.
+	file, err := os.Open(l.path)
+	if errors.Is(err, os.ErrNotExist) {
+		return []model.AuditEntry{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	// Only the last limit matches are kept, compacting once twice as many
+	// have piled up.
+	var matches []model.AuditEntry
+	reader := bufio.NewReader(file)
+	for {
+		line, err := reader.ReadBytes('\n')
+		var entry model.AuditEntry
+		if len(line) > 0 && json.Unmarshal(line, &entry) == nil && selected(filter, entry) {
+			matches = append(matches, entry)
+			if len(matches) == 2*limit {
+				matches = append(matches[:0], matches[limit:]...)
+			}
+		}
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	if len(matches) > limit {
+		matches = matches[len(matches)-limit:]
+	}
+	slices.Reverse(matches)
+	return matches, nil
+}
+
+func selected(filter model.AuditFilter, entry model.AuditEntry) bool {
+	switch {
+	case filter.VMID != "" && entry.VMID != filter.VMID,
+		filter.Token != "" && entry.Token != filter.Token,
+		filter.Action != "" && entry.Action != filter.Action,
+		filter.Namespace != "" && entry.Namespace != filter.Namespace,
+		!filter.Since.IsZero() && entry.At.Before(filter.Since),
+		!filter.Until.IsZero() && !entry.At.Before(filter.Until):
+		return false
+	}
+	return true
+}
@@ -0,0 +1,50 @@
+package audit
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/alperreha/mergen-fire/internal/model"
+)
+
+func TestLogQuery(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "audit.log")
+	log, err := Open(path)
+	if err != nil {
+		t.Fatalf("open: %v", err)
+	}
+	base := time.Date(2026, 10, 1, 12, 0, 0, 0, time.UTC)
+	for i := range 5 {
+		if err := log.Append(model.AuditEntry{At: base.Add(time.Duration(i) * time.Minute), Action: "start", VMID: "a", Status: 200}); err != nil {
+			t.Fatalf("append: %v", err)
+		}
+	}
+	if err := log.Append(model.AuditEntry{At: base.Add(10 * time.Minute), Action: "delete", VMID: "b", Status: 200}); err != nil {
+		t.Fatalf("append: %v", err)
+	}
+	// A line torn by a crash is skipped, and appends carry on after it.
+	file, err := os.OpenFile(path, os.O_APPEND|os.O_WRONLY, 0)
+	if err != nil {
+		t.Fatalf("reopen: %v", err)
+	}
+	file.WriteString(`{"at":"2026-10-01T12:11:00Z","act` + "\n")
+	file.Close()
+	if err := log.Append(model.AuditEntry{At: base.Add(20 * time.Minute), Action: "stop", VMID: "a", Status: 200}); err != nil {
+		t.Fatalf("append after torn line: %v", err)
+	}
+
+	all, err := log.Query(model.AuditFilter{})
+	if err != nil || len(all) != 7 || all[0].Action != "stop" || !all[6].At.Equal(base) {
+		t.Fatalf("query all: %d entries, first %+v, err=%v", len(all), all, err)
+	}
+	newest, _ := log.Query(model.AuditFilter{VMID: "a", Limit: 2})
+	if len(newest) != 2 || newest[0].Action != "stop" || !newest[1].At.Equal(base.Add(4*time.Minute)) {
+		t.Fatalf("newest two of vm a: %+v", newest)
+	}
+	window, _ := log.Query(model.AuditFilter{Action: "start", Since: base.Add(time.Minute), Until: base.Add(3 * time.Minute)})
+	if len(window) != 2 {
+		t.Fatalf("starts in [1m, 3m): %+v", window)
+	}
+}
@@ -0,0 +1,467 @@
+package certs
+
+import (
+	"bytes"
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"math/big"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// LetsEncrypt is the production directory of Let's Encrypt.
+const LetsEncrypt = "https://acme-v02.api.letsencrypt.org/directory"
+
+const (
+	acmeBadNonce     = "urn:ietf:params:acme:error:badNonce"
+	acmePollInterval = 2 * time.Second
+	acmeMaxBody      = 1 << 20
+)
+
+// ChallengeSolver publishes the certificate that answers a tls-alpn-01
+// challenge where the CA will connect, and withdraws it afterwards. Dir is
+// one, read by the forwarder.
+type ChallengeSolver interface {
+	Present(domain string, cert tls.Certificate) error
+	CleanUp(domain string) error
+}
+
+// ACME obtains and revokes certificates from an RFC 8555 CA, validating
+// domains over tls-alpn-01. It registers its account on first use.
+type ACME struct {
+	directoryURL string
+	email        string
+	key          *ecdsa.PrivateKey
+	solver       ChallengeSolver
+	client       *http.Client
+	logger       *slog.Logger
+	// pollInterval spaces authorization and order polls.
+	pollInterval time.Duration
+
+	mu         sync.Mutex
+	directory  *acmeDirectory
+	accountURL string
+	nonce      string
+}
+
+type acmeDirectory struct {
+	NewNonce   string `json:"newNonce"`
+	NewAccount string `json:"newAccount"`
+	NewOrder   string `json:"newOrder"`
+	RevokeCert string `json:"revokeCert"`
+}
+
+type acmeProblem struct {
+	Type   string `json:"type"`
+	Detail string `json:"detail"`
+	Status int    `json:"status"`
+}
+
+func (p *acmeProblem) Error() string {
+	return fmt.Sprintf("acme: %s: %s", p.Type, p.Detail)
+}
+
+type acmeOrder struct {
+	Status         string       `json:"status"`
+	Authorizations []string     `json:"authorizations"`
+	Finalize       string       `json:"finalize"`
+	Certificate    string       `json:"certificate"`
+	Error          *acmeProblem `json:"error"`
+}
+
+type acmeAuthorization struct {
+	Status     string `json:"status"`
+	Identifier struct {
+		Value string `json:"value"`
+	} `json:"identifier"`
+	Challenges []acmeChallenge `json:"challenges"`
+}
+
+type acmeChallenge struct {
+	Type   string       `json:"type"`
+	URL    string       `json:"url"`
+	Token  string       `json:"token"`
+	Status string       `json:"status"`
+	Error  *acmeProblem `json:"error"`
+}
+
+// NewACME returns a client of the CA at directoryURL using the account key
+// key; email, if set, is the account's contact.
+func NewACME(directoryURL, email string, key *ecdsa.PrivateKey, solver ChallengeSolver) *ACME {
+	return &ACME{
+		directoryURL: directoryURL,
+		email:        strings.TrimSpace(email),
+		key:          key,
+		solver:       solver,
+		client:       &http.Client{Timeout: 30 * time.Second},
+		logger:       slog.Default(),
+		pollInterval: acmePollInterval,
+	}
+}
+
+func (a *ACME) WithHTTPClient(client *http.Client) *ACME {
+	if client != nil {
+		a.client = client
+	}
+	return a
+}
+
+func (a *ACME) WithLogger(logger *slog.Logger) *ACME {
+	if logger != nil {
+		a.logger = logger
+	}
+	return a
+}
+
+// Issue orders a certificate for domains signed over key and returns its
+// PEM chain, leaf first. It blocks until the CA has validated every domain
+// or ctx ends.
+func (a *ACME) Issue(ctx context.Context, domains []string, key crypto.Signer) ([]byte, error) {
+	if len(domains) == 0 {
+		return nil, errors.New("acme: no domains to issue for")
+	}
+	if err := a.register(ctx); err != nil {
+		return nil, err
+	}
+	identifiers := make([]map[string]string, 0, len(domains))
+	for _, domain := range domains {
+		identifiers = append(identifiers, map[string]string{"type": "dns", "value": domain})
+	}
+	var order acmeOrder
+	resp, err := a.post(ctx, a.directory.NewOrder, map[string]any{"identifiers": identifiers}, &order)
+	if err != nil {
+		return nil, fmt.Errorf("new order: %w", err)
+	}
+	orderURL := resp.Header.Get("Location")
+	for _, authzURL := range order.Authorizations {
+		if err := a.authorize(ctx, authzURL); err != nil {
+			return nil, err
+		}
+	}
+
+	csr, err := x509.CreateCertificateRequest(rand.Reader, &x509.CertificateRequest{
+		Subject:  pkix.Name{CommonName: domains[0]},
+		DNSNames: domains,
+	}, key)
+	if err != nil {
+		return nil, fmt.Errorf("create csr: %w", err)
+	}
+	if _, err := a.post(ctx, order.Finalize, map[string]string{"csr": b64(csr)}, &order); err != nil {
+		return nil, fmt.Errorf("finalize order: %w", err)
+	}
+	for order.Status != "valid" {
+		switch order.Status {
+		case "invalid":
+			return nil, fmt.Errorf("order invalid: %v", order.Error)
+		case "pending", "ready", "processing":
+		default:
+			return nil, fmt.Errorf("unexpected order status %q", order.Status)
+		}
+		if err := sleep(ctx, a.pollInterval); err != nil {
+			return nil, err
+		}
+		if _, err := a.post(ctx, orderURL, nil, &order); err != nil {
+			return nil, fmt.Errorf("poll order: %w", err)
+		}
+	}
+	resp, err = a.post(ctx, order.Certificate, nil, nil)
+	if err != nil {
+		return nil, fmt.Errorf("download certificate: %w", err)
+	}
+	chain, err := io.ReadAll(io.LimitReader(resp.Body, acmeMaxBody))
+	_ = resp.Body.Close()
+	if err != nil {
+		return nil, fmt.Errorf("download certificate: %w", err)
+	}
+	return chain, nil
+}
+
+// Revoke asks the CA to revoke the certificate in DER form.
+func (a *ACME) Revoke(ctx context.Context, certDER []byte) error {
+	if err := a.register(ctx); err != nil {
+		return err
+	}
+	resp, err := a.post(ctx, a.directory.RevokeCert, map[string]string{"certificate": b64(certDER)}, nil)
+	if err != nil {
+		return fmt.Errorf("revoke certificate: %w", err)
+	}
+	return resp.Body.Close()
+}
+
+// authorize answers the tls-alpn-01 challenge of one authorization and
+// waits for the CA to check it.
+func (a *ACME) authorize(ctx context.Context, authzURL string) error {
+	var authz acmeAuthorization
+	if _, err := a.post(ctx, authzURL, nil, &authz); err != nil {
+		return fmt.Errorf("fetch authorization: %w", err)
+	}
+	if authz.Status == "valid" {
+		return nil
+	}
+	domain := authz.Identifier.Value
+	var challenge *acmeChallenge
+	for i := range authz.Challenges {
+		if authz.Challenges[i].Type == "tls-alpn-01" {
+			challenge = &authz.Challenges[i]
+		}
+	}
+	if challenge == nil {
+		return fmt.Errorf("%s: ca offers no tls-alpn-01 challenge", domain)
+	}
+	cert, err := ChallengeCert(domain, challenge.Token+"."+jwkThumbprint(&a.key.PublicKey))
+	if err != nil {
+		return err
+	}
+	if err := a.solver.Present(domain, cert); err != nil {
+		return fmt.Errorf("%s: present challenge: %w", domain, err)
+	}
+	defer func() {
+		if err := a.solver.CleanUp(domain); err != nil {
+			a.logger.Warn("acme challenge cleanup failed", "domain", domain, "error", err)
+		}
+	}()
+	a.logger.Debug("acme challenge presented", "domain", domain)
+
+	resp, err := a.post(ctx, challenge.URL, struct{}{}, nil)
+	if err != nil {
+		return fmt.Errorf("%s: accept challenge: %w", domain, err)
+	}
+	_ = resp.Body.Close()
+	for {
+		if err := sleep(ctx, a.pollInterval); err != nil {
+			return err
+		}
+		if _, err := a.post(ctx, authzURL, nil, &authz); err != nil {
+			return fmt.Errorf("%s: poll authorization: %w", domain, err)
+		}
+		switch authz.Status {
+		case "valid":
+			return nil
+		case "pending", "processing":
+			continue
+		}
+		for _, c := range authz.Challenges {
+			if c.Type == "tls-alpn-01" && c.Error != nil {
+				return fmt.Errorf("%s: validation failed: %w", domain, c.Error)
+			}
+		}
+		return fmt.Errorf("%s: authorization %s", domain, authz.Status)
+	}
+}
+
+// register fetches the directory and creates or looks up the account.
+func (a *ACME) register(ctx context.Context) error {
+	a.mu.Lock()
+	ready := a.accountURL != ""
+	a.mu.Unlock()
+	if ready {
+		return nil
+	}
+	if a.directory == nil {
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, a.directoryURL, nil)
+		if err != nil {
+			return err
+		}
+		resp, err := a.client.Do(req)
+		if err != nil {
+			return fmt.Errorf("fetch acme directory: %w", err)
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			return fmt.Errorf("fetch acme directory: %s", resp.Status)
+		}
+		var directory acmeDirectory
+		if err := json.NewDecoder(io.LimitReader(resp.Body, acmeMaxBody)).Decode(&directory); err != nil {
+			return fmt.Errorf("decode acme directory: %w", err)
+		}
+		a.directory = &directory
+	}
+	account := map[string]any{"termsOfServiceAgreed": true}
+	if a.email != "" {
+		account["contact"] = []string{"mailto:" + a.email}
+	}
+	resp, err := a.post(ctx, a.directory.NewAccount, account, nil)
+	if err != nil {
+		return fmt.Errorf("register acme account: %w", err)
+	}
+	_ = resp.Body.Close()
+	a.mu.Lock()
+	a.accountURL = resp.Header.Get("Location")
+	a.mu.Unlock()
+	a.logger.Info("acme account ready", "account", a.accountURL)
+	return nil
+}
+
+// post sends payload as a JWS signed with the account key; a nil payload is
+// a POST-as-GET. A response body is decoded into out unless out is nil, in
+// which case the caller closes it. A stale nonce is retried once.
+func (a *ACME) post(ctx context.Context, url string, payload any, out any) (*http.Response, error) {
+	resp, err := a.postOnce(ctx, url, payload)
+	var problem *acmeProblem
+	if errors.As(err, &problem) && problem.Type == acmeBadNonce {
+		resp, err = a.postOnce(ctx, url, payload)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if out == nil {
+		return resp, nil
+	}
+	defer resp.Body.Close()
+	if err := json.NewDecoder(io.LimitReader(resp.Body, acmeMaxBody)).Decode(out); err != nil {
+		return nil, fmt.Errorf("decode %s: %w", url, err)
+	}
+	return resp, nil
+}
+
+func (a *ACME) postOnce(ctx context.Context, url string, payload any) (*http.Response, error) {
+	nonce, err := a.takeNonce(ctx)
+	if err != nil {
+		return nil, err
+	}
+	body, err := a.sign(url, nonce, payload)
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/jose+json")
+	resp, err := a.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if next := resp.Header.Get("Replay-Nonce"); next != "" {
+		a.mu.Lock()
+		a.nonce = next
+		a.mu.Unlock()
+	}
+	if resp.StatusCode >= http.StatusBadRequest {
+		defer resp.Body.Close()
+		problem := &acmeProblem{Status: resp.StatusCode}
+		if err := json.NewDecoder(io.LimitReader(resp.Body, acmeMaxBody)).Decode(problem); err != nil || problem.Type == "" {
+			return nil, fmt.Errorf("acme: %s %s", url, resp.Status)
+		}
+		return nil, problem
+	}
+	return resp, nil
+}
+
+func (a *ACME) takeNonce(ctx context.Context) (string, error) {
+	a.mu.Lock()
+	nonce := a.nonce
+	a.nonce = ""
+	a.mu.Unlock()
+	if nonce != "" {
+		return nonce, nil
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodHead, a.directory.NewNonce, nil)
+	if err != nil {
+		return "", err
+	}
+	resp, err := a.client.Do(req)
+	if err != nil {
+		return "", fmt.Errorf("fetch acme nonce: %w", err)
+	}
+	_ = resp.Body.Close()
+	nonce = resp.Header.Get("Replay-Nonce")
+	if nonce == "" {
+		return "", errors.New("acme: no nonce in newNonce response")
+	}
+	return nonce, nil
+}
+
+// sign builds the flattened JWS of payload. Requests before the account
+// exists carry the account's JWK, later ones its URL.
+func (a *ACME) sign(url, nonce string, payload any) ([]byte, error) {
+	protected := map[string]any{"alg": "ES256", "nonce": nonce, "url": url}
+	a.mu.Lock()
+	accountURL := a.accountURL
+	a.mu.Unlock()
+	if accountURL != "" {
+		protected["kid"] = accountURL
+	} else {
+		protected["jwk"] = jwk(&a.key.PublicKey)
+	}
+	header, err := json.Marshal(protected)
+	if err != nil {
+		return nil, err
+	}
+	encodedPayload := ""
+	if payload != nil {
+		content, err := json.Marshal(payload)
+		if err != nil {
+			return nil, err
+		}
+		encodedPayload = b64(content)
+	}
+	signingInput := b64(header) + "." + encodedPayload
+	digest := sha256.Sum256([]byte(signingInput))
+	r, s, err := ecdsa.Sign(rand.Reader, a.key, digest[:])
+	if err != nil {
+		return nil, err
+	}
+	signature := make([]byte, 64)
+	r.FillBytes(signature[:32])
+	s.FillBytes(signature[32:])
+	return json.Marshal(map[string]string{
+		"protected": b64(header),
+		"payload":   encodedPayload,
+		"signature": b64(signature),
+	})
+}
+
+func jwk(key *ecdsa.PublicKey) map[string]string {
+	return map[string]string{
+		"crv": "P-256",
+		"kty": "EC",
+		"x":   b64(fixedBytes(key.X)),
+		"y":   b64(fixedBytes(key.Y)),
+	}
+}
+
+// jwkThumbprint is the RFC 7638 thumbprint key authorizations end with.
+func jwkThumbprint(key *ecdsa.PublicKey) string {
+	fields := jwk(key)
+	canonical := fmt.Sprintf(`{"crv":%s,"kty":%s,"x":%s,"y":%s}`,
+		strconv.Quote(fields["crv"]), strconv.Quote(fields["kty"]), strconv.Quote(fields["x"]), strconv.Quote(fields["y"]))
+	digest := sha256.Sum256([]byte(canonical))
+	return b64(digest[:])
+}
+
+func fixedBytes(n *big.Int) []byte {
+	out := make([]byte, 32)
+	n.FillBytes(out)
+	return out
+}
+
+func b64(content []byte) string {
+	return base64.RawURLEncoding.EncodeToString(content)
+}
+
+func sleep(ctx context.Context, d time.Duration) error {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return nil
+	}
+}
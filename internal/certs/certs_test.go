@@ -0,0 +1,326 @@
+package certs
+
+import (
+	"bytes"
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"io"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestNormalizeDomains(t *testing.T) {
+	got, err := NormalizeDomains([]string{" App.Example.com. ", "api.example.com"})
+	if err != nil {
+		t.Fatalf("NormalizeDomains: %v", err)
+	}
+	if strings.Join(got, ",") != "app.example.com,api.example.com" {
+		t.Fatalf("unexpected domains: %v", got)
+	}
+	for _, bad := range [][]string{
+		{"*.example.com"},
+		{"localhost"},
+		{"-app.example.com"},
+		{"app_1.example.com"},
+		{"a.example.com", "A.example.com"},
+	} {
+		if _, err := NormalizeDomains(bad); err == nil {
+			t.Fatalf("expected %v to be rejected", bad)
+		}
+	}
+}
+
+func TestDirSaveLoadAllRemove(t *testing.T) {
+	dir := NewDir(t.TempDir())
+	key, err := NewKey()
+	if err != nil {
+		t.Fatalf("NewKey: %v", err)
+	}
+	if err := dir.Save("vm-1", selfSigned(t, key, "app.example.com", "www.example.com"), key); err != nil {
+		t.Fatalf("Save: %v", err)
+	}
+	info, err := os.Stat(filepath.Join(dir.Root(), "vm-1.key"))
+	if err != nil || info.Mode().Perm() != 0o600 {
+		t.Fatalf("expected private key file, got %v %v", info, err)
+	}
+	leaf, err := dir.Leaf("vm-1")
+	if err != nil || leaf.DNSNames[0] != "app.example.com" {
+		t.Fatalf("Leaf: %v %v", leaf, err)
+	}
+	loaded, err := dir.LoadAll()
+	if err != nil {
+		t.Fatalf("LoadAll: %v", err)
+	}
+	if loaded["app.example.com"] == nil || loaded["www.example.com"] != loaded["app.example.com"] {
+		t.Fatalf("expected both names to map to the certificate, got %v", loaded)
+	}
+	if err := dir.Remove("vm-1"); err != nil {
+		t.Fatalf("Remove: %v", err)
+	}
+	if _, err := dir.Leaf("vm-1"); !os.IsNotExist(err) {
+		t.Fatalf("expected removed certificate, got %v", err)
+	}
+	if err := dir.Remove("vm-1"); err != nil {
+		t.Fatalf("second Remove: %v", err)
+	}
+}
+
+func TestLoadOrCreateKeyReusesKey(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "account.key")
+	first, err := LoadOrCreateKey(path)
+	if err != nil {
+		t.Fatalf("create: %v", err)
+	}
+	second, err := LoadOrCreateKey(path)
+	if err != nil {
+		t.Fatalf("load: %v", err)
+	}
+	if !first.Equal(second) {
+		t.Fatal("expected the stored key to be reused")
+	}
+}
+
+func TestACMEIssueAndRevoke(t *testing.T) {
+	dir := NewDir(t.TempDir())
+	accountKey, _ := NewKey()
+	ca := newFakeCA(t, dir, accountKey)
+	client := NewACME(ca.server.URL+"/directory", "ops@example.com", accountKey, dir).WithHTTPClient(ca.server.Client())
+	client.pollInterval = time.Millisecond
+
+	key, _ := NewKey()
+	chain, err := client.Issue(context.Background(), []string{"app.example.com"}, key)
+	if err != nil {
+		t.Fatalf("Issue: %v", err)
+	}
+	block, _ := pem.Decode(chain)
+	leaf, err := x509.ParseCertificate(block.Bytes)
+	if err != nil {
+		t.Fatalf("parse issued certificate: %v", err)
+	}
+	if len(leaf.DNSNames) != 1 || leaf.DNSNames[0] != "app.example.com" {
+		t.Fatalf("unexpected names: %v", leaf.DNSNames)
+	}
+	if ca.challengeSeen != "app.example.com" {
+		t.Fatalf("expected the challenge certificate to be presented, got %q", ca.challengeSeen)
+	}
+	if _, err := dir.Challenge("app.example.com"); !os.IsNotExist(err) {
+		t.Fatalf("expected challenge to be cleaned up, got %v", err)
+	}
+	if err := client.Revoke(context.Background(), leaf.Raw); err != nil {
+		t.Fatalf("Revoke: %v", err)
+	}
+	if ca.revoked != 1 || ca.accounts != 1 {
+		t.Fatalf("expected one account and one revocation, got %d and %d", ca.accounts, ca.revoked)
+	}
+}
+
+func TestACMEIssueValidationFailure(t *testing.T) {
+	dir := NewDir(t.TempDir())
+	accountKey, _ := NewKey()
+	ca := newFakeCA(t, dir, accountKey)
+	ca.failValidation = true
+	client := NewACME(ca.server.URL+"/directory", "", accountKey, dir).WithHTTPClient(ca.server.Client())
+	client.pollInterval = time.Millisecond
+	key, _ := NewKey()
+	if _, err := client.Issue(context.Background(), []string{"app.example.com"}, key); err == nil || !strings.Contains(err.Error(), "validation failed") {
+		t.Fatalf("expected validation failure, got %v", err)
+	}
+}
+
+// fakeCA implements the ACME endpoints Issue and Revoke use. It validates
+// a challenge by reading the certificate the solver presented in dir.
+type fakeCA struct {
+	t              *testing.T
+	server         *httptest.Server
+	dir            *Dir
+	accountKey     *ecdsa.PrivateKey
+	signer         *ecdsa.PrivateKey
+	failValidation bool
+
+	mu            sync.Mutex
+	accounts      int
+	revoked       int
+	authzStatus   string
+	orderStatus   string
+	csr           *x509.CertificateRequest
+	challengeSeen string
+}
+
+func newFakeCA(t *testing.T, dir *Dir, accountKey *ecdsa.PrivateKey) *fakeCA {
+	ca := &fakeCA{t: t, dir: dir, accountKey: accountKey, signer: mustKey(t), authzStatus: "pending", orderStatus: "pending"}
+	ca.server = httptest.NewTLSServer(http.HandlerFunc(ca.serve))
+	t.Cleanup(ca.server.Close)
+	return ca
+}
+
+func (ca *fakeCA) serve(w http.ResponseWriter, r *http.Request) {
+	ca.mu.Lock()
+	defer ca.mu.Unlock()
+	base := ca.server.URL
+	w.Header().Set("Replay-Nonce", "nonce-"+time.Now().Format(time.RFC3339Nano))
+	if r.URL.Path == "/directory" {
+		_ = json.NewEncoder(w).Encode(acmeDirectory{
+			NewNonce:   base + "/nonce",
+			NewAccount: base + "/account",
+			NewOrder:   base + "/order",
+			RevokeCert: base + "/revoke",
+		})
+		return
+	}
+	if r.URL.Path == "/nonce" {
+		return
+	}
+	var jws struct {
+		Protected string `json:"protected"`
+		Payload   string `json:"payload"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&jws); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	payload, _ := base64.RawURLEncoding.DecodeString(jws.Payload)
+	switch r.URL.Path {
+	case "/account":
+		ca.accounts++
+		w.Header().Set("Location", base+"/account/1")
+		w.WriteHeader(http.StatusCreated)
+	case "/order":
+		w.Header().Set("Location", base+"/order/1")
+		ca.writeOrder(w)
+	case "/order/1":
+		if ca.orderStatus == "processing" {
+			ca.orderStatus = "valid"
+		}
+		ca.writeOrder(w)
+	case "/authz/1":
+		_ = json.NewEncoder(w).Encode(ca.authorization())
+	case "/challenge/1":
+		ca.validate()
+		_, _ = w.Write([]byte("{}"))
+	case "/finalize":
+		var body struct {
+			CSR string `json:"csr"`
+		}
+		_ = json.Unmarshal(payload, &body)
+		der, _ := base64.RawURLEncoding.DecodeString(body.CSR)
+		csr, err := x509.ParseCertificateRequest(der)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		ca.csr, ca.orderStatus = csr, "processing"
+		ca.writeOrder(w)
+	case "/cert/1":
+		der, err := x509.CreateCertificate(rand.Reader, &x509.Certificate{
+			SerialNumber: big.NewInt(42),
+			Subject:      pkix.Name{CommonName: ca.csr.DNSNames[0]},
+			DNSNames:     ca.csr.DNSNames,
+			NotBefore:    time.Now().Add(-time.Hour),
+			NotAfter:     time.Now().Add(90 * 24 * time.Hour),
+		}, &x509.Certificate{SerialNumber: big.NewInt(1), Subject: pkix.Name{CommonName: "fake ca"}}, ca.csr.PublicKey, ca.signer)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		_ = pem.Encode(w, &pem.Block{Type: "CERTIFICATE", Bytes: der})
+	case "/revoke":
+		ca.revoked++
+	default:
+		w.Header().Set("Content-Type", "application/problem+json")
+		w.WriteHeader(http.StatusNotFound)
+		_, _ = io.WriteString(w, `{"type":"urn:ietf:params:acme:error:malformed","detail":"not found"}`)
+	}
+}
+
+func (ca *fakeCA) writeOrder(w http.ResponseWriter) {
+	base := ca.server.URL
+	order := acmeOrder{
+		Status:         ca.orderStatus,
+		Authorizations: []string{base + "/authz/1"},
+		Finalize:       base + "/finalize",
+	}
+	if ca.orderStatus == "valid" {
+		order.Certificate = base + "/cert/1"
+	}
+	_ = json.NewEncoder(w).Encode(order)
+}
+
+func (ca *fakeCA) authorization() acmeAuthorization {
+	authz := acmeAuthorization{Status: ca.authzStatus}
+	authz.Identifier.Value = "app.example.com"
+	challenge := acmeChallenge{Type: "tls-alpn-01", URL: ca.server.URL + "/challenge/1", Token: "token-1", Status: ca.authzStatus}
+	if ca.authzStatus == "invalid" {
+		challenge.Error = &acmeProblem{Type: "urn:ietf:params:acme:error:unauthorized", Detail: "wrong key authorization"}
+	}
+	authz.Challenges = []acmeChallenge{{Type: "http-01", URL: ca.server.URL + "/other"}, challenge}
+	return authz
+}
+
+// validate checks the presented challenge certificate carries the digest
+// of the key authorization, as a CA would over a TLS connection.
+func (ca *fakeCA) validate() {
+	ca.authzStatus = "invalid"
+	if ca.failValidation {
+		return
+	}
+	cert, err := ca.dir.Challenge("app.example.com")
+	if err != nil {
+		ca.t.Errorf("challenge not presented: %v", err)
+		return
+	}
+	leaf, err := x509.ParseCertificate(cert.Certificate[0])
+	if err != nil {
+		ca.t.Errorf("parse challenge certificate: %v", err)
+		return
+	}
+	want := sha256.Sum256([]byte("token-1." + jwkThumbprint(&ca.accountKey.PublicKey)))
+	for _, ext := range leaf.Extensions {
+		var digest []byte
+		if ext.Id.Equal(idPeACMEIdentifier) && ext.Critical {
+			if _, err := asn1.Unmarshal(ext.Value, &digest); err == nil && bytes.Equal(digest, want[:]) {
+				ca.authzStatus, ca.challengeSeen = "valid", leaf.DNSNames[0]
+			}
+		}
+	}
+}
+
+func selfSigned(t *testing.T, key crypto.Signer, names ...string) []byte {
+	t.Helper()
+	signer := mustKey(t)
+	der, err := x509.CreateCertificate(rand.Reader, &x509.Certificate{
+		SerialNumber: big.NewInt(7),
+		Subject:      pkix.Name{CommonName: names[0]},
+		DNSNames:     names,
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}, &x509.Certificate{SerialNumber: big.NewInt(1), Subject: pkix.Name{CommonName: "test ca"}}, key.Public(), signer)
+	if err != nil {
+		t.Fatalf("create certificate: %v", err)
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+}
+
+func mustKey(t *testing.T) *ecdsa.PrivateKey {
+	t.Helper()
+	key, err := NewKey()
+	if err != nil {
+		t.Fatalf("NewKey: %v", err)
+	}
+	return key
+}
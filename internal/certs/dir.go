@@ -0,0 +1,224 @@
+// Package certs keeps TLS certificates for VMs' custom domains. mergend
+// obtains them from an ACME CA and writes them to a Dir; the forwarder reads
+// the same Dir to pick a certificate by SNI and to answer the CA's
+// tls-alpn-01 challenges on its HTTPS listener.
+package certs
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// challengeDir holds the tls-alpn-01 certificates of pending validations.
+const challengeDir = "challenges"
+
+// Dir stores one certificate chain and key per VM as <vmID>.crt and
+// <vmID>.key, and challenge certificates under challenges/<domain>.
+type Dir struct {
+	root string
+}
+
+func NewDir(root string) *Dir {
+	return &Dir{root: root}
+}
+
+func (d *Dir) Root() string {
+	return d.root
+}
+
+// Save writes vmID's chain and key, replacing any previous pair. The key
+// goes first so a reader never pairs a new chain with an old key.
+func (d *Dir) Save(vmID string, chainPEM []byte, key crypto.Signer) error {
+	keyPEM, err := encodeKey(key)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(d.root, 0o700); err != nil {
+		return err
+	}
+	if err := writeAtomic(filepath.Join(d.root, vmID+".key"), keyPEM, 0o600); err != nil {
+		return err
+	}
+	return writeAtomic(filepath.Join(d.root, vmID+".crt"), chainPEM, 0o644)
+}
+
+// Leaf returns vmID's certificate, or an error satisfying os.IsNotExist
+// when there is none.
+func (d *Dir) Leaf(vmID string) (*x509.Certificate, error) {
+	chain, err := os.ReadFile(filepath.Join(d.root, vmID+".crt"))
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(chain)
+	if block == nil || block.Type != "CERTIFICATE" {
+		return nil, fmt.Errorf("%s.crt holds no certificate", vmID)
+	}
+	return x509.ParseCertificate(block.Bytes)
+}
+
+// Remove deletes vmID's chain and key; missing files are not an error.
+func (d *Dir) Remove(vmID string) error {
+	var errs []error
+	for _, name := range []string{vmID + ".crt", vmID + ".key"} {
+		if err := os.Remove(filepath.Join(d.root, name)); err != nil && !os.IsNotExist(err) {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// Modified returns when a certificate was last saved or removed; the
+// forwarder reloads when it changes.
+func (d *Dir) Modified() (time.Time, error) {
+	info, err := os.Stat(d.root)
+	if err != nil {
+		return time.Time{}, err
+	}
+	return info.ModTime(), nil
+}
+
+// LoadAll returns every stored certificate keyed by the DNS names it
+// covers, lower case. Pairs that do not load are skipped and reported in
+// the error.
+func (d *Dir) LoadAll() (map[string]*tls.Certificate, error) {
+	entries, err := os.ReadDir(d.root)
+	if err != nil {
+		return nil, err
+	}
+	out := map[string]*tls.Certificate{}
+	var errs []error
+	for _, entry := range entries {
+		name, ok := strings.CutSuffix(entry.Name(), ".crt")
+		if entry.IsDir() || !ok {
+			continue
+		}
+		cert, err := tls.LoadX509KeyPair(filepath.Join(d.root, entry.Name()), filepath.Join(d.root, name+".key"))
+		if err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", name, err))
+			continue
+		}
+		for _, dnsName := range cert.Leaf.DNSNames {
+			out[strings.ToLower(dnsName)] = &cert
+		}
+	}
+	return out, errors.Join(errs...)
+}
+
+// Present stores the tls-alpn-01 certificate for domain; CleanUp removes it.
+func (d *Dir) Present(domain string, cert tls.Certificate) error {
+	chainPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert.Certificate[0]})
+	key, ok := cert.PrivateKey.(crypto.Signer)
+	if !ok {
+		return errors.New("challenge key is not a signer")
+	}
+	keyPEM, err := encodeKey(key)
+	if err != nil {
+		return err
+	}
+	dir := filepath.Join(d.root, challengeDir)
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return err
+	}
+	if err := writeAtomic(filepath.Join(dir, domain+".key"), keyPEM, 0o600); err != nil {
+		return err
+	}
+	return writeAtomic(filepath.Join(dir, domain+".crt"), chainPEM, 0o644)
+}
+
+func (d *Dir) CleanUp(domain string) error {
+	dir := filepath.Join(d.root, challengeDir)
+	var errs []error
+	for _, name := range []string{domain + ".crt", domain + ".key"} {
+		if err := os.Remove(filepath.Join(dir, name)); err != nil && !os.IsNotExist(err) {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// Challenge returns the pending tls-alpn-01 certificate for domain.
+func (d *Dir) Challenge(domain string) (*tls.Certificate, error) {
+	domain = strings.ToLower(strings.TrimSuffix(domain, "."))
+	if ValidateDomain(domain) != nil {
+		return nil, fmt.Errorf("invalid challenge domain %q", domain)
+	}
+	dir := filepath.Join(d.root, challengeDir)
+	cert, err := tls.LoadX509KeyPair(filepath.Join(dir, domain+".crt"), filepath.Join(dir, domain+".key"))
+	if err != nil {
+		return nil, err
+	}
+	return &cert, nil
+}
+
+// LoadOrCreateKey reads a PEM private key from path, creating a P-256 key
+// there when the file does not exist.
+func LoadOrCreateKey(path string) (*ecdsa.PrivateKey, error) {
+	content, err := os.ReadFile(path)
+	if err == nil {
+		block, _ := pem.Decode(content)
+		if block == nil {
+			return nil, fmt.Errorf("%s holds no pem key", path)
+		}
+		parsed, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+		if err != nil {
+			return nil, fmt.Errorf("parse %s: %w", path, err)
+		}
+		key, ok := parsed.(*ecdsa.PrivateKey)
+		if !ok {
+			return nil, fmt.Errorf("%s is not an ecdsa key", path)
+		}
+		return key, nil
+	}
+	if !os.IsNotExist(err) {
+		return nil, err
+	}
+	key, err := NewKey()
+	if err != nil {
+		return nil, err
+	}
+	keyPEM, err := encodeKey(key)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0o700); err != nil {
+		return nil, err
+	}
+	return key, writeAtomic(path, keyPEM, 0o600)
+}
+
+func encodeKey(key crypto.Signer) ([]byte, error) {
+	der, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		return nil, err
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der}), nil
+}
+
+func writeAtomic(path string, content []byte, mode os.FileMode) error {
+	tmp, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+".tmp-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(content); err != nil {
+		_ = tmp.Close()
+		return err
+	}
+	if err := tmp.Chmod(mode); err != nil {
+		_ = tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
@@ -0,0 +1,64 @@
+package certs
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"fmt"
+	"slices"
+	"strings"
+)
+
+// MaxDomains bounds the names on one VM's certificate.
+const MaxDomains = 10
+
+// NormalizeDomains lower-cases domains, drops trailing dots and checks each
+// is a DNS name a CA can validate over tls-alpn-01, which rules out
+// wildcards.
+func NormalizeDomains(domains []string) ([]string, error) {
+	if len(domains) > MaxDomains {
+		return nil, fmt.Errorf("at most %d domains are supported, got %d", MaxDomains, len(domains))
+	}
+	out := make([]string, 0, len(domains))
+	for _, domain := range domains {
+		domain = strings.ToLower(strings.TrimSuffix(strings.TrimSpace(domain), "."))
+		if err := ValidateDomain(domain); err != nil {
+			return nil, err
+		}
+		if slices.Contains(out, domain) {
+			return nil, fmt.Errorf("domain %s is listed twice", domain)
+		}
+		out = append(out, domain)
+	}
+	return out, nil
+}
+
+// ValidateDomain checks a normalized domain name.
+func ValidateDomain(domain string) error {
+	if domain == "" || len(domain) > 253 {
+		return fmt.Errorf("invalid domain %q: expected 1-253 characters", domain)
+	}
+	labels := strings.Split(domain, ".")
+	if len(labels) < 2 {
+		return fmt.Errorf("invalid domain %q: expected at least two labels", domain)
+	}
+	for _, label := range labels {
+		if label == "*" {
+			return fmt.Errorf("invalid domain %q: wildcards cannot be validated over tls-alpn-01", domain)
+		}
+		if len(label) == 0 || len(label) > 63 || label[0] == '-' || label[len(label)-1] == '-' {
+			return fmt.Errorf("invalid domain %q: labels are 1-63 characters and do not start or end with '-'", domain)
+		}
+		for _, r := range label {
+			if !(r >= 'a' && r <= 'z' || r >= '0' && r <= '9' || r == '-') {
+				return fmt.Errorf("invalid domain %q: labels may only contain letters, digits and '-'", domain)
+			}
+		}
+	}
+	return nil
+}
+
+// NewKey returns a key for a certificate or an ACME account.
+func NewKey() (*ecdsa.PrivateKey, error) {
+	return ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+}
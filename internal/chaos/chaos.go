@@ -0,0 +1,174 @@
+// Package chaos injects faults into mergend's dependencies so retry and
+// reconcile paths can be exercised on purpose. It is off unless configured,
+// and a nil *Injector injects nothing.
+package chaos
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"math/rand"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/alperreha/mergen-fire/internal/systemd"
+)
+
+// ErrInjected marks failures produced by the injector rather than by the
+// real dependency.
+var ErrInjected = errors.New("injected fault")
+
+// Config holds per-call probabilities in 0..1. Seed makes a run repeatable;
+// zero picks a random seed.
+type Config struct {
+	SystemdFailRate      float64
+	FirecrackerDelay     time.Duration
+	FirecrackerDelayRate float64
+	HookDropRate         float64
+	Seed                 int64
+}
+
+type Stats struct {
+	SystemdFailures   int64 `json:"systemdFailures"`
+	FirecrackerDelays int64 `json:"firecrackerDelays"`
+	HookDrops         int64 `json:"hookDrops"`
+}
+
+type Injector struct {
+	config Config
+	logger *slog.Logger
+
+	mu  sync.Mutex
+	rng *rand.Rand
+
+	systemdFailures   atomic.Int64
+	firecrackerDelays atomic.Int64
+	hookDrops         atomic.Int64
+}
+
+func New(config Config, logger *slog.Logger) *Injector {
+	if logger == nil {
+		logger = slog.Default()
+	}
+	seed := config.Seed
+	if seed == 0 {
+		seed = time.Now().UnixNano()
+	}
+	return &Injector{config: config, logger: logger, rng: rand.New(rand.NewSource(seed))}
+}
+
+func (i *Injector) roll(rate float64) bool {
+	if rate <= 0 {
+		return false
+	}
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	return i.rng.Float64() < rate
+}
+
+// SystemdFault returns an ErrInjected error for a systemctl call that should
+// fail, nil otherwise.
+func (i *Injector) SystemdFault(ctx context.Context, operation, id string) error {
+	if i == nil || !i.roll(i.config.SystemdFailRate) {
+		return nil
+	}
+	i.systemdFailures.Add(1)
+	i.logger.WarnContext(ctx, "chaos: failing systemd call", "operation", operation, "vmID", id)
+	return fmt.Errorf("%w: systemctl %s", ErrInjected, operation)
+}
+
+// FirecrackerDelay sleeps before a Firecracker API call when the dice say so.
+// It returns early with the context's error if ctx ends first.
+func (i *Injector) FirecrackerDelay(ctx context.Context, endpoint string) error {
+	if i == nil || i.config.FirecrackerDelay <= 0 || !i.roll(i.config.FirecrackerDelayRate) {
+		return nil
+	}
+	i.firecrackerDelays.Add(1)
+	i.logger.WarnContext(ctx, "chaos: delaying firecracker api call", "endpoint", endpoint, "delay", i.config.FirecrackerDelay.String())
+	timer := time.NewTimer(i.config.FirecrackerDelay)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// DropHook reports whether a hook delivery should be dropped.
+func (i *Injector) DropHook(ctx context.Context, event, hookType, id string) bool {
+	if i == nil || !i.roll(i.config.HookDropRate) {
+		return false
+	}
+	i.hookDrops.Add(1)
+	i.logger.WarnContext(ctx, "chaos: dropping hook delivery", "event", event, "type", hookType, "vmID", id)
+	return true
+}
+
+func (i *Injector) Stats() Stats {
+	if i == nil {
+		return Stats{}
+	}
+	return Stats{
+		SystemdFailures:   i.systemdFailures.Load(),
+		FirecrackerDelays: i.firecrackerDelays.Load(),
+		HookDrops:         i.hookDrops.Load(),
+	}
+}
+
+// Systemd wraps client so each call may fail before reaching systemctl.
+func Systemd(client systemd.Client, injector *Injector) systemd.Client {
+	if injector == nil {
+		return client
+	}
+	return &faultySystemd{client: client, injector: injector}
+}
+
+type faultySystemd struct {
+	client   systemd.Client
+	injector *Injector
+}
+
+func (f *faultySystemd) Start(ctx context.Context, id string) error {
+	if err := f.injector.SystemdFault(ctx, "start", id); err != nil {
+		return err
+	}
+	return f.client.Start(ctx, id)
+}
+
+func (f *faultySystemd) Stop(ctx context.Context, id string) error {
+	if err := f.injector.SystemdFault(ctx, "stop", id); err != nil {
+		return err
+	}
+	return f.client.Stop(ctx, id)
+}
+
+func (f *faultySystemd) Kill(ctx context.Context, id string) error {
+	if err := f.injector.SystemdFault(ctx, "kill", id); err != nil {
+		return err
+	}
+	return f.client.Kill(ctx, id)
+}
+
+func (f *faultySystemd) Disable(ctx context.Context, id string) error {
+	if err := f.injector.SystemdFault(ctx, "disable", id); err != nil {
+		return err
+	}
+	return f.client.Disable(ctx, id)
+}
+
+func (f *faultySystemd) IsActive(ctx context.Context, id string) (bool, error) {
+	if err := f.injector.SystemdFault(ctx, "is-active", id); err != nil {
+		return false, err
+	}
+	return f.client.IsActive(ctx, id)
+}
+
+func (f *faultySystemd) Status(ctx context.Context, id string) (systemd.Status, error) {
+	if err := f.injector.SystemdFault(ctx, "show", id); err != nil {
+		return systemd.Status{}, err
+	}
+	return f.client.Status(ctx, id)
+}
@@ -0,0 +1,84 @@
+package chaos
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/alperreha/mergen-fire/internal/systemd"
+)
+
+type stubSystemd struct {
+	starts int
+}
+
+func (s *stubSystemd) Start(context.Context, string) error {
+	s.starts++
+	return nil
+}
+func (s *stubSystemd) Stop(context.Context, string) error             { return nil }
+func (s *stubSystemd) Kill(context.Context, string) error             { return nil }
+func (s *stubSystemd) Disable(context.Context, string) error          { return nil }
+func (s *stubSystemd) IsActive(context.Context, string) (bool, error) { return false, nil }
+func (s *stubSystemd) Status(context.Context, string) (systemd.Status, error) {
+	return systemd.Status{}, nil
+}
+
+func TestSystemd_FailsAtFullRate(t *testing.T) {
+	stub := &stubSystemd{}
+	injector := New(Config{SystemdFailRate: 1}, nil)
+	client := Systemd(stub, injector)
+
+	err := client.Start(context.Background(), "vm1")
+	if !errors.Is(err, ErrInjected) {
+		t.Fatalf("expected injected error, got %v", err)
+	}
+	if stub.starts != 0 {
+		t.Fatal("expected the real client not to be called")
+	}
+	if injector.Stats().SystemdFailures != 1 {
+		t.Fatalf("expected one failure counted, got %+v", injector.Stats())
+	}
+}
+
+func TestSystemd_PassesThroughAtZeroRate(t *testing.T) {
+	stub := &stubSystemd{}
+	client := Systemd(stub, New(Config{}, nil))
+	if err := client.Start(context.Background(), "vm1"); err != nil || stub.starts != 1 {
+		t.Fatalf("expected pass-through start, got err=%v starts=%d", err, stub.starts)
+	}
+}
+
+func TestSeedIsRepeatable(t *testing.T) {
+	a := New(Config{HookDropRate: 0.5, Seed: 42}, nil)
+	b := New(Config{HookDropRate: 0.5, Seed: 42}, nil)
+	for i := 0; i < 50; i++ {
+		if a.DropHook(context.Background(), "onCreate", "http", "vm1") != b.DropHook(context.Background(), "onCreate", "http", "vm1") {
+			t.Fatalf("runs diverged at call %d", i)
+		}
+	}
+}
+
+func TestFirecrackerDelay_StopsWithContext(t *testing.T) {
+	injector := New(Config{FirecrackerDelay: time.Hour, FirecrackerDelayRate: 1}, nil)
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if err := injector.FirecrackerDelay(ctx, "/actions"); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("expected deadline exceeded, got %v", err)
+	}
+}
+
+func TestNilInjectorIsInert(t *testing.T) {
+	var injector *Injector
+	if injector.DropHook(context.Background(), "onCreate", "http", "vm1") {
+		t.Fatal("nil injector dropped a hook")
+	}
+	if err := injector.FirecrackerDelay(context.Background(), "/actions"); err != nil {
+		t.Fatalf("nil injector delayed: %v", err)
+	}
+	stub := &stubSystemd{}
+	if Systemd(stub, nil) != systemd.Client(stub) {
+		t.Fatal("expected nil injector to leave the client unwrapped")
+	}
+}
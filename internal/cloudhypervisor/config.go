@@ -0,0 +1,116 @@
+// Package cloudhypervisor runs VMs under Cloud Hypervisor. mergen renders
+// every VM's vm.json in Firecracker's schema; this package translates it to
+// Cloud Hypervisor's VmConfig and drives the VMM's REST API.
+package cloudhypervisor
+
+import "github.com/alperreha/mergen-fire/internal/model"
+
+// VMConfig is the subset of Cloud Hypervisor's VmConfig mergen sets.
+type VMConfig struct {
+	CPUs    CPUsConfig     `json:"cpus"`
+	Memory  MemoryConfig   `json:"memory"`
+	Payload PayloadConfig  `json:"payload"`
+	Disks   []DiskConfig   `json:"disks,omitempty"`
+	Net     []NetConfig    `json:"net,omitempty"`
+	FS      []FSConfig     `json:"fs,omitempty"`
+	Devices []DeviceConfig `json:"devices,omitempty"`
+	Vsock   *VsockConfig   `json:"vsock,omitempty"`
+	Serial  ConsoleConfig  `json:"serial"`
+	Console ConsoleConfig  `json:"console"`
+}
+
+type CPUsConfig struct {
+	BootVCPUs int `json:"boot_vcpus"`
+	MaxVCPUs  int `json:"max_vcpus"`
+}
+
+// MemoryConfig is shared when the VM has virtio-fs devices, whose
+// vhost-user backends map guest memory.
+type MemoryConfig struct {
+	Size   int64 `json:"size"`
+	Shared bool  `json:"shared,omitempty"`
+}
+
+type PayloadConfig struct {
+	Kernel    string `json:"kernel"`
+	Initramfs string `json:"initramfs,omitempty"`
+	Cmdline   string `json:"cmdline,omitempty"`
+}
+
+type DiskConfig struct {
+	ID       string `json:"id,omitempty"`
+	Path     string `json:"path"`
+	Readonly bool   `json:"readonly,omitempty"`
+}
+
+type NetConfig struct {
+	ID  string `json:"id,omitempty"`
+	Tap string `json:"tap"`
+	MAC string `json:"mac,omitempty"`
+}
+
+// FSConfig is a virtio-fs device backed by the virtiofsd on Socket.
+type FSConfig struct {
+	Tag       string `json:"tag"`
+	Socket    string `json:"socket"`
+	NumQueues int    `json:"num_queues"`
+	QueueSize int    `json:"queue_size"`
+}
+
+// DeviceConfig is a VFIO device; Path is its sysfs directory.
+type DeviceConfig struct {
+	ID   string `json:"id,omitempty"`
+	Path string `json:"path"`
+}
+
+type VsockConfig struct {
+	ID     string `json:"id,omitempty"`
+	CID    int    `json:"cid"`
+	Socket string `json:"socket"`
+}
+
+// ConsoleConfig sets where the serial port or virtio console goes.
+type ConsoleConfig struct {
+	Mode string `json:"mode"`
+}
+
+// FromVMConfig translates a rendered vm.json. The root drive goes first so
+// it is /dev/vda in the guest, as root= in the boot args expects. Guest
+// output goes to the serial port, which the unit captures like Firecracker's.
+func FromVMConfig(cfg model.VMConfig) VMConfig {
+	out := VMConfig{
+		CPUs: CPUsConfig{
+			BootVCPUs: cfg.MachineConfig.VCPUCount,
+			MaxVCPUs:  cfg.MachineConfig.VCPUCount,
+		},
+		Memory: MemoryConfig{Size: int64(cfg.MachineConfig.MemSizeMiB) << 20},
+		Payload: PayloadConfig{
+			Kernel:    cfg.BootSource.KernelImagePath,
+			Initramfs: cfg.BootSource.InitrdPath,
+			Cmdline:   cfg.BootSource.BootArgs,
+		},
+		Serial:  ConsoleConfig{Mode: "Tty"},
+		Console: ConsoleConfig{Mode: "Off"},
+	}
+	for _, root := range []bool{true, false} {
+		for _, drive := range cfg.Drives {
+			if drive.IsRootDevice == root {
+				out.Disks = append(out.Disks, DiskConfig{ID: drive.DriveID, Path: drive.PathOnHost, Readonly: drive.IsReadOnly})
+			}
+		}
+	}
+	for _, nic := range cfg.NetworkInterfaces {
+		out.Net = append(out.Net, NetConfig{ID: nic.IfaceID, Tap: nic.HostDevName, MAC: nic.GuestMAC})
+	}
+	for _, fs := range cfg.FS {
+		out.FS = append(out.FS, FSConfig{Tag: fs.Tag, Socket: fs.SocketPath, NumQueues: 1, QueueSize: 1024})
+		out.Memory.Shared = true
+	}
+	for _, device := range cfg.Devices {
+		out.Devices = append(out.Devices, DeviceConfig{ID: device.ID, Path: device.Path})
+	}
+	if cfg.Vsock != nil {
+		out.Vsock = &VsockConfig{ID: cfg.Vsock.VsockID, CID: cfg.Vsock.GuestCID, Socket: cfg.Vsock.UdsPath}
+	}
+	return out
+}
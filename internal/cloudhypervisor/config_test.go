@@ -0,0 +1,123 @@
+package cloudhypervisor
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/alperreha/mergen-fire/internal/model"
+)
+
+func testVMConfig() model.VMConfig {
+	return model.VMConfig{
+		BootSource: model.BootSource{KernelImagePath: "/k/vmlinux", InitrdPath: "/k/initrd", BootArgs: "console=ttyS0 root=/dev/vda rw"},
+		Drives: []model.Drive{
+			{DriveID: "data", PathOnHost: "/d/data.ext4"},
+			{DriveID: "rootfs", PathOnHost: "/d/rootfs.ext4", IsRootDevice: true, IsReadOnly: true},
+		},
+		MachineConfig:     model.MachineConfig{VCPUCount: 2, MemSizeMiB: 256},
+		NetworkInterfaces: []model.NetworkInterface{{IfaceID: "eth0", HostDevName: "tap-6f008233", GuestMAC: "02:FC:00:00:00:02"}},
+	}
+}
+
+func TestFromVMConfig(t *testing.T) {
+	cfg := FromVMConfig(testVMConfig())
+	if cfg.CPUs.BootVCPUs != 2 || cfg.CPUs.MaxVCPUs != 2 || cfg.Memory.Size != 256<<20 {
+		t.Fatalf("unexpected cpus/memory: %+v %+v", cfg.CPUs, cfg.Memory)
+	}
+	if cfg.Payload.Kernel != "/k/vmlinux" || cfg.Payload.Initramfs != "/k/initrd" || cfg.Payload.Cmdline != "console=ttyS0 root=/dev/vda rw" {
+		t.Fatalf("unexpected payload: %+v", cfg.Payload)
+	}
+	if len(cfg.Disks) != 2 || cfg.Disks[0].ID != "rootfs" || !cfg.Disks[0].Readonly || cfg.Disks[1].ID != "data" {
+		t.Fatalf("root disk must come first: %+v", cfg.Disks)
+	}
+	if len(cfg.Net) != 1 || cfg.Net[0].Tap != "tap-6f008233" || cfg.Net[0].MAC != "02:FC:00:00:00:02" {
+		t.Fatalf("unexpected net: %+v", cfg.Net)
+	}
+	if cfg.Vsock != nil || cfg.Serial.Mode != "Tty" || cfg.Console.Mode != "Off" {
+		t.Fatalf("unexpected vsock/serial/console: %+v %+v %+v", cfg.Vsock, cfg.Serial, cfg.Console)
+	}
+	if cfg.Memory.Shared || len(cfg.FS) != 0 {
+		t.Fatalf("memory must not be shared without virtio-fs: %+v", cfg.Memory)
+	}
+
+	withFS := testVMConfig()
+	withFS.FS = []model.FSDevice{{Tag: "src", SocketPath: "/run/mergen/vm1/virtiofs-src.sock", SharedDir: "/src"}}
+	cfg = FromVMConfig(withFS)
+	if !cfg.Memory.Shared || len(cfg.FS) != 1 || cfg.FS[0].Tag != "src" || cfg.FS[0].Socket != "/run/mergen/vm1/virtiofs-src.sock" {
+		t.Fatalf("unexpected virtio-fs config: %+v %+v", cfg.Memory, cfg.FS)
+	}
+
+	withDevice := testVMConfig()
+	withDevice.Devices = []model.PCIDevice{{ID: "vfio0", Path: "/sys/bus/pci/devices/0000:01:00.0/"}}
+	cfg = FromVMConfig(withDevice)
+	if len(cfg.Devices) != 1 || cfg.Devices[0].ID != "vfio0" || cfg.Devices[0].Path != "/sys/bus/pci/devices/0000:01:00.0/" {
+		t.Fatalf("unexpected vfio devices: %+v", cfg.Devices)
+	}
+}
+
+func TestConfiguratorCreatesAndBoots(t *testing.T) {
+	dir, err := os.MkdirTemp("", "mergen-ch-")
+	if err != nil {
+		t.Fatalf("temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	socketPath := filepath.Join(dir, "api.sock")
+	listener, err := net.Listen("unix", socketPath)
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+
+	var mu sync.Mutex
+	var calls []string
+	var created VMConfig
+	server := &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		calls = append(calls, r.Method+" "+r.URL.Path)
+		if r.URL.Path == "/api/v1/vm.create" {
+			body, _ := io.ReadAll(r.Body)
+			if err := json.Unmarshal(body, &created); err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+		}
+		if r.URL.Path == "/api/v1/vm.pause" {
+			http.Error(w, "vm not running", http.StatusInternalServerError)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	})}
+	go func() { _ = server.Serve(listener) }()
+	defer server.Close()
+
+	configurator := NewConfigurator(5 * time.Second)
+	if err := configurator.ConfigureAndStart(context.Background(), socketPath, testVMConfig()); err != nil {
+		t.Fatalf("ConfigureAndStart() error = %v", err)
+	}
+	if err := configurator.Pause(context.Background(), socketPath); err == nil {
+		t.Fatal("expected pause error to be returned")
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	want := []string{"PUT /api/v1/vm.create", "PUT /api/v1/vm.boot", "PUT /api/v1/vm.pause"}
+	if len(calls) != len(want) {
+		t.Fatalf("calls = %v, want %v", calls, want)
+	}
+	for idx := range want {
+		if calls[idx] != want[idx] {
+			t.Fatalf("calls = %v, want %v", calls, want)
+		}
+	}
+	if created.Payload.Kernel != "/k/vmlinux" || len(created.Disks) != 2 {
+		t.Fatalf("unexpected created config: %+v", created)
+	}
+}
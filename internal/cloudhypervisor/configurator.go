@@ -0,0 +1,118 @@
+package cloudhypervisor
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/alperreha/mergen-fire/internal/model"
+	"github.com/alperreha/mergen-fire/internal/tracing"
+)
+
+// Configurator drives a Cloud Hypervisor started with --api-socket and no
+// VM config, the way RawConfigurator drives Firecracker.
+type Configurator struct {
+	client *http.Client
+	logger *slog.Logger
+}
+
+func NewConfigurator(timeout time.Duration) *Configurator {
+	return &Configurator{
+		client: &http.Client{
+			Timeout: timeout,
+		},
+		logger: slog.Default(),
+	}
+}
+
+func (c *Configurator) WithLogger(logger *slog.Logger) *Configurator {
+	if logger != nil {
+		c.logger = logger
+	}
+	return c
+}
+
+// ConfigureAndStart creates the VM from the translated vm.json and boots it.
+// MMDS has no Cloud Hypervisor equivalent and is ignored.
+func (c *Configurator) ConfigureAndStart(ctx context.Context, socketPath string, cfg model.VMConfig) error {
+	c.logger.Debug("configuring cloud hypervisor", "socketPath", socketPath, "drives", len(cfg.Drives), "networkIfaces", len(cfg.NetworkInterfaces))
+	if err := c.doJSON(ctx, socketPath, "vm.create", FromVMConfig(cfg)); err != nil {
+		return fmt.Errorf("vm.create: %w", err)
+	}
+	if err := c.doJSON(ctx, socketPath, "vm.boot", nil); err != nil {
+		return fmt.Errorf("vm.boot: %w", err)
+	}
+	c.logger.Debug("cloud hypervisor vm created and booted", "socketPath", socketPath)
+	return nil
+}
+
+func (c *Configurator) Pause(ctx context.Context, socketPath string) error {
+	return c.doJSON(ctx, socketPath, "vm.pause", nil)
+}
+
+func (c *Configurator) Resume(ctx context.Context, socketPath string) error {
+	return c.doJSON(ctx, socketPath, "vm.resume", nil)
+}
+
+// PowerButton asks the guest to shut down, like a press of the ACPI power
+// button.
+func (c *Configurator) PowerButton(ctx context.Context, socketPath string) error {
+	return c.doJSON(ctx, socketPath, "vm.power-button", nil)
+}
+
+func (c *Configurator) doJSON(ctx context.Context, socketPath, action string, payload any) (err error) {
+	endpoint := "/api/v1/" + action
+	c.logger.Debug("sending cloud hypervisor api request", "socketPath", socketPath, "endpoint", endpoint)
+	ctx, span := tracing.StartKind(ctx, tracing.KindClient, "cloud-hypervisor PUT "+endpoint, "socketPath", socketPath)
+	defer func() { span.RecordError(err); span.End() }()
+
+	var body io.Reader
+	if payload != nil {
+		encoded, err := json.Marshal(payload)
+		if err != nil {
+			return err
+		}
+		body = bytes.NewReader(encoded)
+	}
+	request, err := http.NewRequestWithContext(ctx, http.MethodPut, "http://localhost"+endpoint, body)
+	if err != nil {
+		return err
+	}
+	if payload != nil {
+		request.Header.Set("Content-Type", "application/json")
+	}
+
+	transport := &http.Transport{
+		DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+			var dialer net.Dialer
+			return dialer.DialContext(ctx, "unix", socketPath)
+		},
+	}
+	defer transport.CloseIdleConnections()
+
+	client := *c.client
+	client.Transport = transport
+
+	response, err := client.Do(request)
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+	span.SetAttributes("http.response.status_code", response.StatusCode)
+	if response.StatusCode < 200 || response.StatusCode >= 300 {
+		detail, _ := io.ReadAll(io.LimitReader(response.Body, 4096))
+		if msg := strings.TrimSpace(string(detail)); msg != "" {
+			return fmt.Errorf("cloud hypervisor api status: %s: %s", response.Status, msg)
+		}
+		return fmt.Errorf("cloud hypervisor api status: %s", response.Status)
+	}
+	c.logger.Debug("cloud hypervisor api request successful", "endpoint", endpoint, "status", response.Status)
+	return nil
+}
@@ -0,0 +1,102 @@
+package config
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// Token scopes: a read token may only use GET and HEAD, an admin token
+// the whole API.
+const (
+	ScopeRead  = "read"
+	ScopeAdmin = "admin"
+)
+
+// APIToken is one bearer token accepted on /v1. Name identifies it in logs
+// so that Secret never has to be. A token with a Namespace only reaches
+// that namespace's routes.
+type APIToken struct {
+	Name      string
+	Scope     string
+	Namespace string
+	Secret    string
+}
+
+// AuthConfig lists the API tokens, from MGR_API_TOKENS and the lines of
+// TokensFile together. Without any token the API is open.
+type AuthConfig struct {
+	Tokens     []APIToken
+	TokensFile string
+}
+
+// ParseAPIToken parses "name:scope:secret", where scope may name a
+// namespace as "read@team-a". The secret may itself contain colons.
+func ParseAPIToken(entry string) (APIToken, error) {
+	parts := strings.SplitN(strings.TrimSpace(entry), ":", 3)
+	if len(parts) != 3 {
+		return APIToken{}, errors.New("expected name:scope:token")
+	}
+	token := APIToken{Name: strings.TrimSpace(parts[0]), Scope: strings.TrimSpace(parts[1]), Secret: strings.TrimSpace(parts[2])}
+	if token.Name == "" || token.Secret == "" {
+		return APIToken{}, errors.New("expected name:scope:token")
+	}
+	if scope, namespace, ok := strings.Cut(token.Scope, "@"); ok {
+		if namespace == "" {
+			return APIToken{}, fmt.Errorf("token %s: scope %q names no namespace", token.Name, token.Scope)
+		}
+		token.Scope, token.Namespace = scope, namespace
+	}
+	if token.Scope != ScopeRead && token.Scope != ScopeAdmin {
+		return APIToken{}, fmt.Errorf("token %s: unknown scope %q (%s or %s)", token.Name, token.Scope, ScopeRead, ScopeAdmin)
+	}
+	return token, nil
+}
+
+// readTokensFile reads one name:scope:token entry per line; blank lines and
+// lines starting with # are skipped.
+func readTokensFile(path string) ([]APIToken, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	var tokens []APIToken
+	scanner := bufio.NewScanner(file)
+	for line := 1; scanner.Scan(); line++ {
+		entry := strings.TrimSpace(scanner.Text())
+		if entry == "" || strings.HasPrefix(entry, "#") {
+			continue
+		}
+		token, err := ParseAPIToken(entry)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %v", line, err)
+		}
+		tokens = append(tokens, token)
+	}
+	return tokens, scanner.Err()
+}
+
+// tokens reads MGR_API_TOKENS and the tokens file. A file that cannot be
+// read is an error rather than an open API.
+func (r *reader) tokens(key, fileKey string) AuthConfig {
+	auth := AuthConfig{TokensFile: r.str(fileKey, "")}
+	for _, entry := range r.list(key) {
+		token, err := ParseAPIToken(entry)
+		if err != nil {
+			r.errs = append(r.errs, fmt.Errorf("%s: %v", key, err))
+			continue
+		}
+		auth.Tokens = append(auth.Tokens, token)
+	}
+	if auth.TokensFile != "" {
+		tokens, err := readTokensFile(auth.TokensFile)
+		if err != nil {
+			r.errs = append(r.errs, fmt.Errorf("%s: %v", fileKey, err))
+		}
+		auth.Tokens = append(auth.Tokens, tokens...)
+	}
+	return auth
+}
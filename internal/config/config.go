@@ -1,60 +1,735 @@
 package config
 
 import (
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
 	"os"
 	"strconv"
+	"strings"
 	"time"
+
+	"github.com/alperreha/mergen-fire/internal/firecracker"
+	"github.com/alperreha/mergen-fire/internal/hooks"
+	"github.com/alperreha/mergen-fire/internal/logging"
+	"github.com/alperreha/mergen-fire/internal/model"
+	"github.com/alperreha/mergen-fire/internal/network"
 )
 
 type Config struct {
 	HTTPAddr        string
+	API             APIConfig
+	Auth            AuthConfig
+	ReadOnly        bool
 	ConfigRoot      string
 	DataRoot        string
 	RunRoot         string
+	StoreBackend    string
+	SQLitePath      string
+	AuditFile       string
+	EtcdEndpoints   []string
+	EtcdPrefix      string
+	EtcdLockTTL     time.Duration
+	LockWait        time.Duration
+	BootFileCheck   time.Duration
+	ScheduleCheck   time.Duration
+	ReconcileCheck  time.Duration
+	HealthCheck     time.Duration
+	IdleCheck       time.Duration
+	DeleteDrain     time.Duration
+	RestartTimeout  time.Duration
+	MigrateTimeout  time.Duration
 	GlobalHooksDir  string
+	HookSecretsFile string
+	KernelsFile     string
+	HostKeyFile     string
+	HostKeyCommand  string
+	HookWorkers     int
+	HookQueueSize   int
+	HookTimeout     time.Duration
+	HookTimeouts    map[string]time.Duration
+	LogRotate       LogRotateConfig
+	Usage           UsageConfig
+	Jobs            JobsConfig
+	Capacity        CapacityConfig
+	Certs           CertsConfig
+	VerifyArtifacts bool
 	UnitPrefix      string
+	Hypervisor      string
 	SystemctlPath   string
 	CommandTimeout  time.Duration
 	ShutdownTimeout time.Duration
-	PortStart       int
-	PortEnd         int
-	GuestCIDR       string
-	LogLevel        string
-	LogFormat       string
+	// UpgradeReadyTimeout bounds how long a SIGUSR2 upgrade waits for the
+	// new process; UpgradeDrainTimeout how long the old one then keeps
+	// finishing its requests.
+	UpgradeReadyTimeout time.Duration
+	UpgradeDrainTimeout time.Duration
+	PortStart           int
+	PortEnd             int
+	GuestCIDR           string
+	GuestMACPrefix      string
+	TapPrefix           string
+	NetNSPrefix         string
+	NameIDChars         int
+	PortsFile           string
+	TLS                 TLSConfig
+	Breaker             BreakerConfig
+	Tracing             TracingConfig
+	Chaos               ChaosConfig
+	Host                HostConfig
+	LogLevel            string
+	LogLevels           map[string]string
+	LogFormat           string
+	LogOutput           logging.Output
+	// Bridge is the host bridge holding the guest CIDR's gateway; with
+	// NetworkInit mergend creates it, IP forwarding and the nftables table on
+	// start, as `mergenctl network init` does.
+	Bridge      string
+	NetworkInit bool
+	// GuestStatsCheck is how often mergend looks for VMs it has no guest
+	// stats listener for yet.
+	GuestStatsCheck time.Duration
+	// VMMetricsCheck is how often mergend looks for Firecracker VMs whose
+	// metrics FIFO it does not read yet.
+	VMMetricsCheck time.Duration
+}
+
+type LogRotateConfig struct {
+	Interval   time.Duration
+	MaxSizeMiB int
+	MaxAgeDays int
+	MaxFiles   int
+	Compress   bool
+}
+
+// APIConfig bounds request bodies (zero disables a limit) and sets the
+// browser-facing CORS and HSTS policy.
+type APIConfig struct {
+	MaxBodyBytes   int64
+	MaxJSONDepth   int
+	MaxJSONEntries int
+	CORSOrigins    []string
+	CORSMethods    []string
+	CORSHeaders    []string
+	CORSMaxAge     time.Duration
+	HSTSMaxAge     time.Duration
+	// RedactAllow lists keys whose values responses and access logs show
+	// although their names look secret; RevealToken lets admins request
+	// unredacted responses.
+	RedactAllow []string
+	RevealToken string
+}
+
+// CertsConfig controls certificates for VMs' custom domains. Without an
+// ACMEDirectory domains are routed under the forwarder's own certificate.
+type CertsConfig struct {
+	Dir             string
+	ACMEDirectory   string
+	ACMEEmail       string
+	RenewBeforeDays int
+	CheckInterval   time.Duration
+}
+
+// UsageConfig controls usage metering; a zero Interval disables it.
+type UsageConfig struct {
+	Dir       string
+	Interval  time.Duration
+	TenantTag string
+}
+
+// JobsConfig sizes the queue of asynchronous jobs, such as creates with
+// ?async=true. Finished jobs are kept for Retention; zero keeps them.
+type JobsConfig struct {
+	Workers   int
+	QueueSize int
+	Retention time.Duration
+}
+
+// CapacityConfig sets what the VMs of this host may commit: its CPUs and
+// memory times an overcommit factor. Zero VCPUs or MemMiB are detected from
+// the host; a zero factor turns that check off.
+type CapacityConfig struct {
+	VCPUs            int
+	MemMiB           int
+	CPUOvercommit    float64
+	MemoryOvercommit float64
+}
+
+// TLSConfig with a ClientCAFile requires client certificates.
+type TLSConfig struct {
+	CertFile     string
+	KeyFile      string
+	ClientCAFile string
+}
+
+// BreakerConfig sets when repeated failures pause background automation;
+// zero limits disable a trigger and a zero Cooldown waits for a reset.
+type BreakerConfig struct {
+	CreateFailures int
+	HookFailures   int
+	HookWindow     time.Duration
+	Cooldown       time.Duration
+}
+
+// TracingConfig exports spans over OTLP/HTTP when Endpoint is set. Endpoint
+// and ServiceName fall back to the standard OTEL_* variables.
+type TracingConfig struct {
+	Endpoint    string
+	ServiceName string
+	SampleRatio float64
+	Headers     map[string]string
+}
+
+// HostConfig identifies this mergend instance to the scheduler. In cluster
+// mode AdvertiseURL is where peers forward create requests placed here.
+type HostConfig struct {
+	Name         string
+	Labels       map[string]string
+	AdvertiseURL string
 }
 
+// ChaosConfig turns on fault injection for resilience testing. Rates are
+// per-call probabilities in 0..1 and only apply when Enabled is set.
+type ChaosConfig struct {
+	Enabled              bool
+	SystemdFailRate      float64
+	FirecrackerDelay     time.Duration
+	FirecrackerDelayRate float64
+	HookDropRate         float64
+	Seed                 int64
+}
+
+// FileKeys maps mergend config file keys to env vars.
+var FileKeys = map[string]string{
+	"httpAddr":                   "MGR_HTTP_ADDR",
+	"readOnly":                   "MGR_READ_ONLY",
+	"api.maxBodyBytes":           "MGR_API_MAX_BODY_BYTES",
+	"api.maxJSONDepth":           "MGR_API_MAX_JSON_DEPTH",
+	"api.maxJSONEntries":         "MGR_API_MAX_JSON_ENTRIES",
+	"api.cors.origins":           "MGR_API_CORS_ORIGINS",
+	"api.cors.methods":           "MGR_API_CORS_METHODS",
+	"api.cors.headers":           "MGR_API_CORS_HEADERS",
+	"api.cors.maxAgeSeconds":     "MGR_API_CORS_MAX_AGE_SECONDS",
+	"api.hstsMaxAgeSeconds":      "MGR_API_HSTS_MAX_AGE_SECONDS",
+	"api.redact.allow":           "MGR_API_REDACT_ALLOW",
+	"api.revealToken":            "MGR_API_REVEAL_TOKEN",
+	"api.tokens":                 "MGR_API_TOKENS",
+	"api.tokensFile":             "MGR_API_TOKENS_FILE",
+	"configRoot":                 "MGR_CONFIG_ROOT",
+	"dataRoot":                   "MGR_DATA_ROOT",
+	"runRoot":                    "MGR_RUN_ROOT",
+	"store.backend":              "MGR_STORE_BACKEND",
+	"store.sqlitePath":           "MGR_SQLITE_PATH",
+	"audit.file":                 "MGR_AUDIT_FILE",
+	"store.verifyArtifacts":      "MGR_VERIFY_ARTIFACTS",
+	"etcd.endpoints":             "MGR_ETCD_ENDPOINTS",
+	"etcd.prefix":                "MGR_ETCD_PREFIX",
+	"etcd.lockTTLSeconds":        "MGR_ETCD_LOCK_TTL_SECONDS",
+	"lock.waitSeconds":           "MGR_LOCK_WAIT_SECONDS",
+	"bootFileCheckSeconds":       "MGR_BOOT_FILE_CHECK_SECONDS",
+	"scheduleCheckSeconds":       "MGR_SCHEDULE_CHECK_SECONDS",
+	"reconcileCheckSeconds":      "MGR_RECONCILE_CHECK_SECONDS",
+	"healthCheckSeconds":         "MGR_HEALTH_CHECK_SECONDS",
+	"idleCheckSeconds":           "MGR_IDLE_CHECK_SECONDS",
+	"guestStatsCheckSeconds":     "MGR_GUEST_STATS_CHECK_SECONDS",
+	"vmMetricsCheckSeconds":      "MGR_VM_METRICS_CHECK_SECONDS",
+	"deleteDrainSeconds":         "MGR_DELETE_DRAIN_SECONDS",
+	"restartTimeoutSeconds":      "MGR_RESTART_TIMEOUT_SECONDS",
+	"migration.timeoutSeconds":   "MGR_MIGRATION_TIMEOUT_SECONDS",
+	"hooks.globalDir":            "MGR_GLOBAL_HOOKS_DIR",
+	"hooks.secretsFile":          "MGR_HOOK_SECRETS_FILE",
+	"kernels.file":               "MGR_KERNELS_FILE",
+	"hooks.workers":              "MGR_HOOK_WORKERS",
+	"hooks.queueSize":            "MGR_HOOK_QUEUE_SIZE",
+	"hooks.timeoutSeconds":       "MGR_HOOK_TIMEOUT_SECONDS",
+	"hooks.eventTimeouts":        "MGR_HOOK_EVENT_TIMEOUTS",
+	"hostKey.file":               "MGR_HOST_KEY_FILE",
+	"hostKey.command":            "MGR_HOST_KEY_COMMAND",
+	"logRotate.intervalSeconds":  "MGR_LOG_ROTATE_INTERVAL_SECONDS",
+	"logRotate.maxSizeMiB":       "MGR_LOG_ROTATE_MAX_SIZE_MIB",
+	"logRotate.maxAgeDays":       "MGR_LOG_ROTATE_MAX_AGE_DAYS",
+	"logRotate.maxFiles":         "MGR_LOG_ROTATE_MAX_FILES",
+	"logRotate.compress":         "MGR_LOG_ROTATE_COMPRESS",
+	"jobs.workers":               "MGR_JOB_WORKERS",
+	"jobs.queueSize":             "MGR_JOB_QUEUE_SIZE",
+	"jobs.retentionHours":        "MGR_JOB_RETENTION_HOURS",
+	"capacity.vcpus":             "MGR_CAPACITY_VCPUS",
+	"capacity.memMiB":            "MGR_CAPACITY_MEM_MIB",
+	"capacity.cpuOvercommit":     "MGR_CPU_OVERCOMMIT",
+	"capacity.memoryOvercommit":  "MGR_MEMORY_OVERCOMMIT",
+	"usage.dir":                  "MGR_USAGE_DIR",
+	"usage.intervalSeconds":      "MGR_USAGE_INTERVAL_SECONDS",
+	"usage.tenantTag":            "MGR_USAGE_TENANT_TAG",
+	"certs.dir":                  "MGR_CERT_DIR",
+	"certs.acme.directoryURL":    "MGR_ACME_DIRECTORY_URL",
+	"certs.acme.email":           "MGR_ACME_EMAIL",
+	"certs.renewBeforeDays":      "MGR_CERT_RENEW_BEFORE_DAYS",
+	"certs.checkIntervalSeconds": "MGR_CERT_CHECK_INTERVAL_SECONDS",
+	"systemd.unitPrefix":         "MGR_UNIT_PREFIX",
+	"hypervisor":                 "MGR_HYPERVISOR",
+	"systemd.systemctlPath":      "MGR_SYSTEMCTL_PATH",
+	"commandTimeoutSeconds":      "MGR_COMMAND_TIMEOUT_SECONDS",
+	"shutdownTimeoutSeconds":     "MGR_SHUTDOWN_TIMEOUT_SECONDS",
+	"upgradeReadyTimeoutSeconds": "MGR_UPGRADE_READY_TIMEOUT_SECONDS",
+	"upgradeDrainTimeoutSeconds": "MGR_UPGRADE_DRAIN_TIMEOUT_SECONDS",
+	"network.guestCIDR":          "MGR_GUEST_CIDR",
+	"network.bridge":             "MGR_BRIDGE",
+	"network.init":               "MGR_NETWORK_INIT",
+	"network.guestMACPrefix":     "MGR_GUEST_MAC_PREFIX",
+	"network.tapPrefix":          "MGR_TAP_PREFIX",
+	"network.netnsPrefix":        "MGR_NETNS_PREFIX",
+	"network.nameIDChars":        "MGR_NAME_ID_CHARS",
+	"network.reservationsFile":   "MGR_PORT_RESERVATIONS_FILE",
+	"network.portStart":          "MGR_PORT_START",
+	"network.portEnd":            "MGR_PORT_END",
+	"tls.certFile":               "MGR_TLS_CERT_FILE",
+	"tls.keyFile":                "MGR_TLS_KEY_FILE",
+	"tls.clientCAFile":           "MGR_TLS_CLIENT_CA_FILE",
+	"breaker.createFailures":     "MGR_BREAKER_CREATE_FAILURES",
+	"breaker.hookFailures":       "MGR_BREAKER_HOOK_FAILURES",
+	"breaker.hookWindowSeconds":  "MGR_BREAKER_HOOK_WINDOW_SECONDS",
+	"breaker.cooldownSeconds":    "MGR_BREAKER_COOLDOWN_SECONDS",
+	"tracing.endpoint":           "MGR_TRACING_ENDPOINT",
+	"tracing.serviceName":        "MGR_TRACING_SERVICE_NAME",
+	"tracing.sampleRatio":        "MGR_TRACING_SAMPLE_RATIO",
+	"tracing.headers":            "MGR_TRACING_HEADERS",
+	"host.name":                  "MGR_HOST_NAME",
+	"host.labels":                "MGR_HOST_LABELS",
+	"host.advertiseURL":          "MGR_ADVERTISE_URL",
+	"chaos.enabled":              "MGR_CHAOS_ENABLED",
+	"chaos.systemdFailRate":      "MGR_CHAOS_SYSTEMD_FAIL_RATE",
+	"chaos.firecrackerDelayMs":   "MGR_CHAOS_FIRECRACKER_DELAY_MS",
+	"chaos.firecrackerDelayRate": "MGR_CHAOS_FIRECRACKER_DELAY_RATE",
+	"chaos.hookDropRate":         "MGR_CHAOS_HOOK_DROP_RATE",
+	"chaos.seed":                 "MGR_CHAOS_SEED",
+	"log.level":                  "MGR_LOG_LEVEL",
+	"log.components":             "MGR_LOG_LEVELS",
+	"log.format":                 "MGR_LOG_FORMAT",
+	"log.file":                   "MGR_LOG_FILE",
+	"log.stdout":                 "MGR_LOG_STDOUT",
+	"log.rotation.maxSizeMiB":    "MGR_LOG_FILE_MAX_SIZE_MIB",
+	"log.rotation.rotateHours":   "MGR_LOG_FILE_ROTATE_HOURS",
+	"log.rotation.maxAgeDays":    "MGR_LOG_FILE_MAX_AGE_DAYS",
+	"log.rotation.maxFiles":      "MGR_LOG_FILE_MAX_FILES",
+	"log.rotation.compress":      "MGR_LOG_FILE_COMPRESS",
+}
+
+// FromEnv keeps the defaults for malformed values; Load rejects them.
 func FromEnv() Config {
-	return Config{
-		HTTPAddr:        getEnv("MGR_HTTP_ADDR", ":8080"),
-		ConfigRoot:      getEnv("MGR_CONFIG_ROOT", "/etc/mergen/vm.d"),
-		DataRoot:        getEnv("MGR_DATA_ROOT", "/var/lib/mergen"),
-		RunRoot:         getEnv("MGR_RUN_ROOT", "/run/mergen"),
-		GlobalHooksDir:  getEnv("MGR_GLOBAL_HOOKS_DIR", "/etc/mergen/hooks.d"),
-		UnitPrefix:      getEnv("MGR_UNIT_PREFIX", "mergen"),
-		SystemctlPath:   getEnv("MGR_SYSTEMCTL_PATH", "systemctl"),
-		CommandTimeout:  time.Duration(getEnvInt("MGR_COMMAND_TIMEOUT_SECONDS", 10)) * time.Second,
-		ShutdownTimeout: time.Duration(getEnvInt("MGR_SHUTDOWN_TIMEOUT_SECONDS", 15)) * time.Second,
-		PortStart:       getEnvInt("MGR_PORT_START", 20000),
-		PortEnd:         getEnvInt("MGR_PORT_END", 40000),
-		GuestCIDR:       getEnv("MGR_GUEST_CIDR", "172.30.0.0/24"),
-		LogLevel:        getEnv("MGR_LOG_LEVEL", "info"),
-		LogFormat:       getEnv("MGR_LOG_FORMAT", "console"),
-	}
-}
-
-func getEnv(key, fallback string) string {
-	if value, ok := os.LookupEnv(key); ok && value != "" {
+	cfg, _ := build(os.LookupEnv)
+	return cfg
+}
+
+// Load reads and validates the environment and the config file at path, if any.
+func Load(path string) (Config, error) {
+	var file map[string]string
+	if strings.TrimSpace(path) != "" {
+		values, err := ReadFile(path, FileKeys)
+		if err != nil {
+			return Config{}, err
+		}
+		file = values
+	}
+	cfg, errs := build(Overlay(file))
+	errs = append(errs, cfg.Validate())
+	return cfg, errors.Join(errs...)
+}
+
+func build(lookup func(string) (string, bool)) (Config, []error) {
+	r := &reader{lookup: lookup}
+	cfg := Config{
+		HTTPAddr: r.str("MGR_HTTP_ADDR", ":8080"),
+		API: APIConfig{
+			MaxBodyBytes:   int64(r.int("MGR_API_MAX_BODY_BYTES", 1<<20)),
+			MaxJSONDepth:   r.int("MGR_API_MAX_JSON_DEPTH", 32),
+			MaxJSONEntries: r.int("MGR_API_MAX_JSON_ENTRIES", 1024),
+			CORSOrigins:    r.list("MGR_API_CORS_ORIGINS"),
+			CORSMethods:    r.list("MGR_API_CORS_METHODS"),
+			CORSHeaders:    r.list("MGR_API_CORS_HEADERS"),
+			CORSMaxAge:     r.seconds("MGR_API_CORS_MAX_AGE_SECONDS", 600),
+			HSTSMaxAge:     r.seconds("MGR_API_HSTS_MAX_AGE_SECONDS", 31536000),
+			RedactAllow:    r.list("MGR_API_REDACT_ALLOW"),
+			RevealToken:    r.str("MGR_API_REVEAL_TOKEN", ""),
+		},
+		Auth:            r.tokens("MGR_API_TOKENS", "MGR_API_TOKENS_FILE"),
+		ReadOnly:        r.bool("MGR_READ_ONLY", false),
+		ConfigRoot:      r.str("MGR_CONFIG_ROOT", "/etc/mergen/vm.d"),
+		DataRoot:        r.str("MGR_DATA_ROOT", "/var/lib/mergen"),
+		RunRoot:         r.str("MGR_RUN_ROOT", "/run/mergen"),
+		StoreBackend:    r.str("MGR_STORE_BACKEND", "fs"),
+		SQLitePath:      r.str("MGR_SQLITE_PATH", "/var/lib/mergen/mergen.db"),
+		AuditFile:       r.str("MGR_AUDIT_FILE", "/var/lib/mergen/audit.log"),
+		EtcdEndpoints:   r.list("MGR_ETCD_ENDPOINTS"),
+		EtcdPrefix:      r.str("MGR_ETCD_PREFIX", "/mergen"),
+		EtcdLockTTL:     r.seconds("MGR_ETCD_LOCK_TTL_SECONDS", 15),
+		LockWait:        r.seconds("MGR_LOCK_WAIT_SECONDS", 10),
+		BootFileCheck:   r.seconds("MGR_BOOT_FILE_CHECK_SECONDS", 30),
+		ScheduleCheck:   r.seconds("MGR_SCHEDULE_CHECK_SECONDS", 30),
+		ReconcileCheck:  r.seconds("MGR_RECONCILE_CHECK_SECONDS", 30),
+		HealthCheck:     r.seconds("MGR_HEALTH_CHECK_SECONDS", 5),
+		IdleCheck:       r.seconds("MGR_IDLE_CHECK_SECONDS", 60),
+		DeleteDrain:     r.seconds("MGR_DELETE_DRAIN_SECONDS", 5),
+		RestartTimeout:  r.seconds("MGR_RESTART_TIMEOUT_SECONDS", 30),
+		MigrateTimeout:  r.seconds("MGR_MIGRATION_TIMEOUT_SECONDS", 600),
+		GlobalHooksDir:  r.str("MGR_GLOBAL_HOOKS_DIR", "/etc/mergen/hooks.d"),
+		HookSecretsFile: r.str("MGR_HOOK_SECRETS_FILE", "/etc/mergen/hook-secrets.json"),
+		KernelsFile:     r.str("MGR_KERNELS_FILE", "/etc/mergen/kernels.json"),
+		HostKeyFile:     r.str("MGR_HOST_KEY_FILE", ""),
+		HostKeyCommand:  r.str("MGR_HOST_KEY_COMMAND", ""),
+		HookWorkers:     r.int("MGR_HOOK_WORKERS", hooks.DefaultWorkers),
+		HookQueueSize:   r.int("MGR_HOOK_QUEUE_SIZE", hooks.DefaultQueueSize),
+		HookTimeout:     r.seconds("MGR_HOOK_TIMEOUT_SECONDS", int(hooks.DefaultTimeout/time.Second)),
+		HookTimeouts:    r.durationMap("MGR_HOOK_EVENT_TIMEOUTS"),
+		LogRotate: LogRotateConfig{
+			Interval:   r.seconds("MGR_LOG_ROTATE_INTERVAL_SECONDS", 300),
+			MaxSizeMiB: r.int("MGR_LOG_ROTATE_MAX_SIZE_MIB", 64),
+			MaxAgeDays: r.int("MGR_LOG_ROTATE_MAX_AGE_DAYS", 7),
+			MaxFiles:   r.int("MGR_LOG_ROTATE_MAX_FILES", 5),
+			Compress:   r.bool("MGR_LOG_ROTATE_COMPRESS", true),
+		},
+		Usage: UsageConfig{
+			Dir:       r.str("MGR_USAGE_DIR", "/var/lib/mergen/usage"),
+			Interval:  r.seconds("MGR_USAGE_INTERVAL_SECONDS", 60),
+			TenantTag: r.str("MGR_USAGE_TENANT_TAG", "tenant"),
+		},
+		Jobs: JobsConfig{
+			Workers:   r.int("MGR_JOB_WORKERS", 2),
+			QueueSize: r.int("MGR_JOB_QUEUE_SIZE", 64),
+			Retention: time.Duration(r.int("MGR_JOB_RETENTION_HOURS", 24)) * time.Hour,
+		},
+		Capacity: CapacityConfig{
+			VCPUs:            r.int("MGR_CAPACITY_VCPUS", 0),
+			MemMiB:           r.int("MGR_CAPACITY_MEM_MIB", 0),
+			CPUOvercommit:    r.float("MGR_CPU_OVERCOMMIT", 4),
+			MemoryOvercommit: r.float("MGR_MEMORY_OVERCOMMIT", 1),
+		},
+		Certs: CertsConfig{
+			Dir:             r.str("MGR_CERT_DIR", "/var/lib/mergen/certs"),
+			ACMEDirectory:   r.str("MGR_ACME_DIRECTORY_URL", ""),
+			ACMEEmail:       r.str("MGR_ACME_EMAIL", ""),
+			RenewBeforeDays: r.int("MGR_CERT_RENEW_BEFORE_DAYS", 30),
+			CheckInterval:   r.seconds("MGR_CERT_CHECK_INTERVAL_SECONDS", 3600),
+		},
+		VerifyArtifacts:     r.bool("MGR_VERIFY_ARTIFACTS", false),
+		UnitPrefix:          r.str("MGR_UNIT_PREFIX", "mergen"),
+		Hypervisor:          r.str("MGR_HYPERVISOR", model.HypervisorFirecracker),
+		SystemctlPath:       r.str("MGR_SYSTEMCTL_PATH", "systemctl"),
+		CommandTimeout:      r.seconds("MGR_COMMAND_TIMEOUT_SECONDS", 10),
+		ShutdownTimeout:     r.seconds("MGR_SHUTDOWN_TIMEOUT_SECONDS", 15),
+		UpgradeReadyTimeout: r.seconds("MGR_UPGRADE_READY_TIMEOUT_SECONDS", 30),
+		UpgradeDrainTimeout: r.seconds("MGR_UPGRADE_DRAIN_TIMEOUT_SECONDS", 3600),
+		PortStart:           r.int("MGR_PORT_START", 20000),
+		PortEnd:             r.int("MGR_PORT_END", 40000),
+		GuestCIDR:           r.str("MGR_GUEST_CIDR", "172.30.0.0/24"),
+		Bridge:              r.str("MGR_BRIDGE", network.DefaultBridge),
+		NetworkInit:         r.bool("MGR_NETWORK_INIT", true),
+		GuestStatsCheck:     r.seconds("MGR_GUEST_STATS_CHECK_SECONDS", 10),
+		VMMetricsCheck:      r.seconds("MGR_VM_METRICS_CHECK_SECONDS", 10),
+		GuestMACPrefix:      r.str("MGR_GUEST_MAC_PREFIX", network.DefaultMACPrefix),
+		TapPrefix:           r.str("MGR_TAP_PREFIX", network.DefaultTapPrefix),
+		NetNSPrefix:         r.str("MGR_NETNS_PREFIX", network.DefaultNetNSPrefix),
+		NameIDChars:         r.int("MGR_NAME_ID_CHARS", network.DefaultNameIDChars),
+		PortsFile:           r.str("MGR_PORT_RESERVATIONS_FILE", "/var/lib/mergen/port-reservations.json"),
+		TLS: TLSConfig{
+			CertFile:     r.str("MGR_TLS_CERT_FILE", ""),
+			KeyFile:      r.str("MGR_TLS_KEY_FILE", ""),
+			ClientCAFile: r.str("MGR_TLS_CLIENT_CA_FILE", ""),
+		},
+		Breaker: BreakerConfig{
+			CreateFailures: r.int("MGR_BREAKER_CREATE_FAILURES", 5),
+			HookFailures:   r.int("MGR_BREAKER_HOOK_FAILURES", 50),
+			HookWindow:     r.seconds("MGR_BREAKER_HOOK_WINDOW_SECONDS", 60),
+			Cooldown:       r.seconds("MGR_BREAKER_COOLDOWN_SECONDS", 900),
+		},
+		Tracing: TracingConfig{
+			Endpoint:    r.str("MGR_TRACING_ENDPOINT", r.str("OTEL_EXPORTER_OTLP_ENDPOINT", "")),
+			ServiceName: r.str("MGR_TRACING_SERVICE_NAME", r.str("OTEL_SERVICE_NAME", "mergend")),
+			SampleRatio: r.float("MGR_TRACING_SAMPLE_RATIO", 1),
+			Headers:     r.stringMap("MGR_TRACING_HEADERS"),
+		},
+		Host: HostConfig{
+			Name:         r.str("MGR_HOST_NAME", defaultHostName()),
+			Labels:       r.stringMap("MGR_HOST_LABELS"),
+			AdvertiseURL: r.str("MGR_ADVERTISE_URL", ""),
+		},
+		Chaos: ChaosConfig{
+			Enabled:              r.bool("MGR_CHAOS_ENABLED", false),
+			SystemdFailRate:      r.float("MGR_CHAOS_SYSTEMD_FAIL_RATE", 0),
+			FirecrackerDelay:     time.Duration(r.int("MGR_CHAOS_FIRECRACKER_DELAY_MS", 0)) * time.Millisecond,
+			FirecrackerDelayRate: r.float("MGR_CHAOS_FIRECRACKER_DELAY_RATE", 0),
+			HookDropRate:         r.float("MGR_CHAOS_HOOK_DROP_RATE", 0),
+			Seed:                 int64(r.int("MGR_CHAOS_SEED", 0)),
+		},
+		LogLevel:  r.str("MGR_LOG_LEVEL", "info"),
+		LogLevels: r.stringMap("MGR_LOG_LEVELS"),
+		LogFormat: r.str("MGR_LOG_FORMAT", "console"),
+		LogOutput: logging.Output{
+			File:        r.str("MGR_LOG_FILE", ""),
+			Stdout:      r.bool("MGR_LOG_STDOUT", r.str("MGR_LOG_FILE", "") == ""),
+			MaxSizeMiB:  r.int("MGR_LOG_FILE_MAX_SIZE_MIB", 100),
+			RotateEvery: time.Duration(r.int("MGR_LOG_FILE_ROTATE_HOURS", 24)) * time.Hour,
+			MaxAgeDays:  r.int("MGR_LOG_FILE_MAX_AGE_DAYS", 14),
+			MaxFiles:    r.int("MGR_LOG_FILE_MAX_FILES", 7),
+			Compress:    r.bool("MGR_LOG_FILE_COMPRESS", true),
+		},
+	}
+	return cfg, r.errs
+}
+
+func (c Config) Validate() error {
+	var errs []error
+	switch c.StoreBackend {
+	case "fs", "sqlite":
+	case "etcd":
+		if len(c.EtcdEndpoints) == 0 {
+			errs = append(errs, errors.New("MGR_ETCD_ENDPOINTS is required for the etcd store backend"))
+		}
+	default:
+		errs = append(errs, fmt.Errorf("MGR_STORE_BACKEND: unknown backend %q (fs, sqlite or etcd)", c.StoreBackend))
+	}
+	if err := firecracker.ValidateHypervisor(c.Hypervisor); err != nil {
+		errs = append(errs, fmt.Errorf("MGR_HYPERVISOR: %v", err))
+	}
+	if _, _, err := net.ParseCIDR(c.GuestCIDR); err != nil {
+		errs = append(errs, fmt.Errorf("MGR_GUEST_CIDR: %v", err))
+	}
+	if c.Bridge == "" || len(c.Bridge) > 15 {
+		errs = append(errs, fmt.Errorf("MGR_BRIDGE: %q must be 1 to 15 characters", c.Bridge))
+	}
+	if _, err := network.ParseMACPrefix(c.GuestMACPrefix); err != nil {
+		errs = append(errs, fmt.Errorf("MGR_GUEST_MAC_PREFIX: %v", err))
+	}
+	if err := network.ValidateNaming(c.TapPrefix, c.NetNSPrefix, c.NameIDChars); err != nil {
+		errs = append(errs, fmt.Errorf("MGR_TAP_PREFIX/MGR_NETNS_PREFIX/MGR_NAME_ID_CHARS: %v", err))
+	}
+	if c.PortStart <= 0 || c.PortEnd > 65535 || c.PortStart > c.PortEnd {
+		errs = append(errs, fmt.Errorf("MGR_PORT_START/MGR_PORT_END: invalid range %d-%d", c.PortStart, c.PortEnd))
+	}
+	if c.HookWorkers <= 0 || c.HookQueueSize <= 0 {
+		errs = append(errs, errors.New("MGR_HOOK_WORKERS and MGR_HOOK_QUEUE_SIZE must be positive"))
+	}
+	if c.Jobs.Workers <= 0 || c.Jobs.QueueSize <= 0 || c.Jobs.Retention < 0 {
+		errs = append(errs, errors.New("MGR_JOB_WORKERS and MGR_JOB_QUEUE_SIZE must be positive, MGR_JOB_RETENTION_HOURS not negative"))
+	}
+	if c.Capacity.VCPUs < 0 || c.Capacity.MemMiB < 0 || c.Capacity.CPUOvercommit < 0 || c.Capacity.MemoryOvercommit < 0 {
+		errs = append(errs, errors.New("MGR_CAPACITY_VCPUS, MGR_CAPACITY_MEM_MIB, MGR_CPU_OVERCOMMIT and MGR_MEMORY_OVERCOMMIT must not be negative"))
+	}
+	if (c.TLS.CertFile == "") != (c.TLS.KeyFile == "") {
+		errs = append(errs, errors.New("MGR_TLS_CERT_FILE and MGR_TLS_KEY_FILE must be set together"))
+	}
+	if c.TLS.ClientCAFile != "" && c.TLS.CertFile == "" {
+		errs = append(errs, errors.New("MGR_TLS_CLIENT_CA_FILE requires MGR_TLS_CERT_FILE and MGR_TLS_KEY_FILE"))
+	}
+	if c.API.MaxBodyBytes < 0 || c.API.MaxJSONDepth < 0 || c.API.MaxJSONEntries < 0 {
+		errs = append(errs, errors.New("MGR_API_MAX_BODY_BYTES, MGR_API_MAX_JSON_DEPTH and MGR_API_MAX_JSON_ENTRIES must not be negative"))
+	}
+	names, secrets := map[string]bool{}, map[string]bool{}
+	for _, token := range c.Auth.Tokens {
+		if names[token.Name] || secrets[token.Secret] {
+			errs = append(errs, fmt.Errorf("MGR_API_TOKENS/MGR_API_TOKENS_FILE: token %s is listed twice or shares its secret", token.Name))
+		}
+		names[token.Name], secrets[token.Secret] = true, true
+	}
+	if secrets[c.API.RevealToken] {
+		errs = append(errs, errors.New("MGR_API_REVEAL_TOKEN must differ from every API token"))
+	}
+	if c.UpgradeReadyTimeout <= 0 || c.UpgradeDrainTimeout <= 0 {
+		errs = append(errs, errors.New("MGR_UPGRADE_READY_TIMEOUT_SECONDS and MGR_UPGRADE_DRAIN_TIMEOUT_SECONDS must be positive"))
+	}
+	if c.Breaker.CreateFailures < 0 || c.Breaker.HookFailures < 0 || c.Breaker.HookWindow < 0 || c.Breaker.Cooldown < 0 {
+		errs = append(errs, errors.New("MGR_BREAKER_* settings must not be negative"))
+	}
+	if c.Breaker.HookFailures > 0 && c.Breaker.HookWindow == 0 {
+		errs = append(errs, errors.New("MGR_BREAKER_HOOK_WINDOW_SECONDS must be positive when MGR_BREAKER_HOOK_FAILURES is set"))
+	}
+	if c.Certs.RenewBeforeDays < 0 || c.Certs.CheckInterval < 0 {
+		errs = append(errs, errors.New("MGR_CERT_RENEW_BEFORE_DAYS and MGR_CERT_CHECK_INTERVAL_SECONDS must not be negative"))
+	}
+	if c.Certs.ACMEDirectory != "" {
+		if u, err := url.Parse(c.Certs.ACMEDirectory); err != nil || u.Scheme != "https" || u.Host == "" {
+			errs = append(errs, fmt.Errorf("MGR_ACME_DIRECTORY_URL: expected an https URL, got %q", c.Certs.ACMEDirectory))
+		}
+		if c.Certs.Dir == "" {
+			errs = append(errs, errors.New("MGR_CERT_DIR is required with MGR_ACME_DIRECTORY_URL"))
+		}
+	}
+	if c.Tracing.SampleRatio < 0 || c.Tracing.SampleRatio > 1 {
+		errs = append(errs, fmt.Errorf("MGR_TRACING_SAMPLE_RATIO: %v is outside 0..1", c.Tracing.SampleRatio))
+	}
+	if c.Tracing.Endpoint != "" {
+		if u, err := url.Parse(c.Tracing.Endpoint); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			errs = append(errs, fmt.Errorf("MGR_TRACING_ENDPOINT: expected an http(s) URL, got %q", c.Tracing.Endpoint))
+		}
+	}
+	if strings.TrimSpace(c.Host.Name) == "" || strings.Contains(c.Host.Name, "/") {
+		errs = append(errs, fmt.Errorf("MGR_HOST_NAME: invalid host name %q", c.Host.Name))
+	}
+	if c.Host.AdvertiseURL != "" {
+		if u, err := url.Parse(c.Host.AdvertiseURL); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			errs = append(errs, fmt.Errorf("MGR_ADVERTISE_URL: expected an http(s) URL, got %q", c.Host.AdvertiseURL))
+		}
+	}
+	for _, rate := range []struct {
+		name  string
+		value float64
+	}{
+		{"MGR_CHAOS_SYSTEMD_FAIL_RATE", c.Chaos.SystemdFailRate},
+		{"MGR_CHAOS_FIRECRACKER_DELAY_RATE", c.Chaos.FirecrackerDelayRate},
+		{"MGR_CHAOS_HOOK_DROP_RATE", c.Chaos.HookDropRate},
+	} {
+		if rate.value < 0 || rate.value > 1 {
+			errs = append(errs, fmt.Errorf("%s: %v is outside 0..1", rate.name, rate.value))
+		}
+	}
+	if c.Chaos.FirecrackerDelay < 0 {
+		errs = append(errs, errors.New("MGR_CHAOS_FIRECRACKER_DELAY_MS must not be negative"))
+	}
+	if !validLevel(c.LogLevel) {
+		errs = append(errs, fmt.Errorf("MGR_LOG_LEVEL: unknown level %q", c.LogLevel))
+	}
+	for component, level := range c.LogLevels {
+		if !validLevel(level) {
+			errs = append(errs, fmt.Errorf("MGR_LOG_LEVELS: unknown level %q for %s", level, component))
+		}
+	}
+	if c.LogOutput.File == "" && !c.LogOutput.Stdout {
+		errs = append(errs, errors.New("MGR_LOG_STDOUT=false needs MGR_LOG_FILE, otherwise nothing is logged"))
+	}
+	if c.LogOutput.MaxSizeMiB < 0 || c.LogOutput.RotateEvery < 0 || c.LogOutput.MaxAgeDays < 0 || c.LogOutput.MaxFiles < 0 {
+		errs = append(errs, errors.New("MGR_LOG_FILE_* limits must not be negative"))
+	}
+	switch strings.ToLower(c.LogFormat) {
+	case "console", "json", "text":
+	default:
+		errs = append(errs, fmt.Errorf("MGR_LOG_FORMAT: unknown format %q", c.LogFormat))
+	}
+	return errors.Join(errs...)
+}
+
+func defaultHostName() string {
+	name, err := os.Hostname()
+	if err != nil {
+		return "localhost"
+	}
+	return name
+}
+
+func validLevel(level string) bool {
+	switch strings.ToLower(strings.TrimSpace(level)) {
+	case "debug", "info", "warn", "warning", "error":
+		return true
+	}
+	return false
+}
+
+type reader struct {
+	lookup func(string) (string, bool)
+	errs   []error
+}
+
+func (r *reader) str(key, fallback string) string {
+	if value, ok := r.lookup(key); ok && value != "" {
 		return value
 	}
 	return fallback
 }
 
-func getEnvInt(key string, fallback int) int {
-	if value, ok := os.LookupEnv(key); ok && value != "" {
-		parsed, err := strconv.Atoi(value)
-		if err == nil {
-			return parsed
+func (r *reader) int(key string, fallback int) int {
+	value, ok := r.lookup(key)
+	if !ok || strings.TrimSpace(value) == "" {
+		return fallback
+	}
+	parsed, err := strconv.Atoi(strings.TrimSpace(value))
+	if err != nil {
+		r.errs = append(r.errs, fmt.Errorf("%s: invalid integer %q", key, value))
+		return fallback
+	}
+	return parsed
+}
+
+func (r *reader) float(key string, fallback float64) float64 {
+	value, ok := r.lookup(key)
+	if !ok || strings.TrimSpace(value) == "" {
+		return fallback
+	}
+	parsed, err := strconv.ParseFloat(strings.TrimSpace(value), 64)
+	if err != nil {
+		r.errs = append(r.errs, fmt.Errorf("%s: invalid number %q", key, value))
+		return fallback
+	}
+	return parsed
+}
+
+func (r *reader) seconds(key string, fallback int) time.Duration {
+	return time.Duration(r.int(key, fallback)) * time.Second
+}
+
+func (r *reader) bool(key string, fallback bool) bool {
+	value, ok := r.lookup(key)
+	if !ok || strings.TrimSpace(value) == "" {
+		return fallback
+	}
+	parsed, err := strconv.ParseBool(strings.TrimSpace(value))
+	if err != nil {
+		r.errs = append(r.errs, fmt.Errorf("%s: invalid boolean %q", key, value))
+		return fallback
+	}
+	return parsed
+}
+
+func (r *reader) list(key string) []string {
+	value, ok := r.lookup(key)
+	if !ok {
+		return nil
+	}
+	var out []string
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			out = append(out, item)
 		}
 	}
-	return fallback
+	return out
+}
+
+// stringMap parses "key=value" pairs separated by commas, e.g.
+// "x-api-key=secret,x-tenant=edge".
+func (r *reader) stringMap(key string) map[string]string {
+	value, ok := r.lookup(key)
+	if !ok || strings.TrimSpace(value) == "" {
+		return nil
+	}
+	out := map[string]string{}
+	for _, pair := range strings.Split(value, ",") {
+		name, raw, found := strings.Cut(strings.TrimSpace(pair), "=")
+		if !found || strings.TrimSpace(name) == "" {
+			r.errs = append(r.errs, fmt.Errorf("%s: expected name=value, got %q", key, pair))
+			continue
+		}
+		out[strings.TrimSpace(name)] = strings.TrimSpace(raw)
+	}
+	return out
+}
+
+// durationMap parses "onDelete=5m,onCreate=30s".
+func (r *reader) durationMap(key string) map[string]time.Duration {
+	value, ok := r.lookup(key)
+	if !ok || strings.TrimSpace(value) == "" {
+		return nil
+	}
+	out := map[string]time.Duration{}
+	for _, pair := range strings.Split(value, ",") {
+		name, raw, found := strings.Cut(strings.TrimSpace(pair), "=")
+		if !found {
+			r.errs = append(r.errs, fmt.Errorf("%s: expected name=duration, got %q", key, pair))
+			continue
+		}
+		parsed, err := time.ParseDuration(strings.TrimSpace(raw))
+		if err != nil || parsed <= 0 {
+			r.errs = append(r.errs, fmt.Errorf("%s: invalid duration %q for %s", key, raw, name))
+			continue
+		}
+		out[strings.TrimSpace(name)] = parsed
+	}
+	return out
 }
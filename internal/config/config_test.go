@@ -0,0 +1,108 @@
+package config
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestLoadFileWithEnvOverride(t *testing.T) {
+	dir := t.TempDir()
+	yamlPath := filepath.Join(dir, "mergend.yaml")
+	tomlPath := filepath.Join(dir, "mergend.toml")
+	writeFile(t, yamlPath, `
+httpAddr: ":9090"
+store:
+  backend: etcd
+etcd:
+  endpoints: [http://10.0.0.1:2379, http://10.0.0.2:2379]
+hooks:
+  eventTimeouts:
+    onDelete: 5m
+network:
+  portStart: 30000
+  portEnd: 30100
+logRotate:
+  maxFiles: 8
+`)
+	writeFile(t, tomlPath, `
+httpAddr = ":9090"
+[store]
+backend = "etcd"
+[etcd]
+endpoints = ["http://10.0.0.1:2379", "http://10.0.0.2:2379"]
+[hooks.eventTimeouts]
+onDelete = "5m"
+[network]
+portStart = 30000
+portEnd = 30100
+[logRotate]
+maxFiles = 8
+`)
+	t.Setenv("MGR_PORT_END", "30200")
+
+	for _, path := range []string{yamlPath, tomlPath} {
+		cfg, err := Load(path)
+		if err != nil {
+			t.Fatalf("%s: load: %v", path, err)
+		}
+		if cfg.HTTPAddr != ":9090" || cfg.StoreBackend != "etcd" || len(cfg.EtcdEndpoints) != 2 {
+			t.Fatalf("%s: unexpected config: %+v", path, cfg)
+		}
+		if cfg.PortStart != 30000 || cfg.PortEnd != 30200 {
+			t.Fatalf("%s: expected env to override port end, got %d-%d", path, cfg.PortStart, cfg.PortEnd)
+		}
+		if cfg.HookTimeouts["onDelete"] != 5*time.Minute || cfg.LogRotate.MaxFiles != 8 {
+			t.Fatalf("%s: unexpected nested values: timeouts=%v logRotate=%+v", path, cfg.HookTimeouts, cfg.LogRotate)
+		}
+		if cfg.ConfigRoot != "/etc/mergen/vm.d" {
+			t.Fatalf("%s: expected default config root, got %q", path, cfg.ConfigRoot)
+		}
+	}
+}
+
+func TestLoadRejectsInvalidFiles(t *testing.T) {
+	dir := t.TempDir()
+	cases := map[string]string{
+		"unknown key":   "httpAdr: \":9090\"\n",
+		"unknown field": "store:\n  backnd: fs\n",
+		"bad integer":   "network:\n  portStart: lots\n",
+		"bad backend":   "store:\n  backend: zfs\n",
+		"tls half set":  "tls:\n  certFile: /etc/mergen/api.crt\n",
+		"token scope":   "api:\n  tokens: [ci:write:abc]\n",
+		"tokens file":   "api:\n  tokensFile: /nonexistent/api-tokens\n",
+	}
+	for name, content := range cases {
+		path := filepath.Join(dir, strings.ReplaceAll(name, " ", "-")+".yaml")
+		writeFile(t, path, content)
+		if _, err := Load(path); err == nil {
+			t.Fatalf("%s: expected validation error", name)
+		}
+	}
+}
+
+func writeFile(t *testing.T, path, content string) {
+	t.Helper()
+	if err := os.WriteFile(path, []byte(content), 0o644); err != nil {
+		t.Fatalf("write %s: %v", path, err)
+	}
+}
+
+func TestDiffSeparatesReloadableFields(t *testing.T) {
+	current := FromEnv()
+	next := current
+	next.LogLevel = "debug"
+	next.PortEnd = current.PortEnd + 100
+	next.DataRoot = "/srv/mergen"
+	next.HookTimeouts = map[string]time.Duration{"onDelete": time.Minute}
+
+	applied, rejected := Diff(current, next, map[string]bool{"LogLevel": true, "PortEnd": true, "HookTimeouts": true})
+	if strings.Join(applied, ",") != "HookTimeouts,PortEnd,LogLevel" {
+		t.Fatalf("unexpected applied fields: %v", applied)
+	}
+	if strings.Join(rejected, ",") != "DataRoot" {
+		t.Fatalf("unexpected rejected fields: %v", rejected)
+	}
+}
@@ -0,0 +1,149 @@
+package config
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/BurntSushi/toml"
+	"gopkg.in/yaml.v3"
+)
+
+// ReadFile flattens a YAML or TOML config file into values keyed by the env
+// vars keys maps its dotted keys to. Unknown keys are errors.
+func ReadFile(path string, keys map[string]string) (map[string]string, error) {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	doc := map[string]any{}
+	switch ext := strings.ToLower(filepath.Ext(path)); ext {
+	case ".yaml", ".yml":
+		if err := yaml.Unmarshal(content, &doc); err != nil {
+			return nil, fmt.Errorf("%s: %w", path, err)
+		}
+	case ".toml":
+		if err := toml.Unmarshal(content, &doc); err != nil {
+			return nil, fmt.Errorf("%s: %w", path, err)
+		}
+	default:
+		return nil, fmt.Errorf("%s: unsupported config file extension %q (use .yaml, .yml or .toml)", path, ext)
+	}
+
+	values := map[string]string{}
+	var errs []error
+	flatten("", doc, keys, values, &errs)
+	if len(errs) > 0 {
+		return nil, fmt.Errorf("%s: %w", path, errors.Join(errs...))
+	}
+	return values, nil
+}
+
+// Overlay looks keys up in the environment, then in file.
+func Overlay(file map[string]string) func(string) (string, bool) {
+	return func(key string) (string, bool) {
+		if value, ok := os.LookupEnv(key); ok && strings.TrimSpace(value) != "" {
+			return value, true
+		}
+		value, ok := file[key]
+		return value, ok
+	}
+}
+
+func flatten(prefix string, doc map[string]any, keys map[string]string, out map[string]string, errs *[]error) {
+	names := make([]string, 0, len(doc))
+	for name := range doc {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		key := name
+		if prefix != "" {
+			key = prefix + "." + name
+		}
+		value := doc[name]
+
+		if env, ok := keys[key]; ok {
+			text, err := scalarString(value)
+			if err != nil {
+				*errs = append(*errs, fmt.Errorf("%s: %w", key, err))
+				continue
+			}
+			out[env] = text
+			continue
+		}
+		section, isSection := toMap(value)
+		if !isSection || !hasSection(keys, key) {
+			*errs = append(*errs, fmt.Errorf("unknown key %q", key))
+			continue
+		}
+		flatten(key, section, keys, out, errs)
+	}
+}
+
+// scalarString spells a leaf value as its env var would.
+func scalarString(value any) (string, error) {
+	switch typed := value.(type) {
+	case nil:
+		return "", nil
+	case string:
+		return typed, nil
+	case bool, int, int64, uint64, float64:
+		return fmt.Sprint(typed), nil
+	case []any:
+		items := make([]string, 0, len(typed))
+		for _, item := range typed {
+			text, err := scalarString(item)
+			if err != nil || strings.Contains(text, ",") {
+				return "", fmt.Errorf("list items must be plain values without commas")
+			}
+			items = append(items, text)
+		}
+		return strings.Join(items, ","), nil
+	}
+	if section, ok := toMap(value); ok {
+		names := make([]string, 0, len(section))
+		for name := range section {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		pairs := make([]string, 0, len(names))
+		for _, name := range names {
+			text, err := scalarString(section[name])
+			if err != nil {
+				return "", err
+			}
+			pairs = append(pairs, name+"="+text)
+		}
+		return strings.Join(pairs, ","), nil
+	}
+	return "", fmt.Errorf("unsupported value %v", value)
+}
+
+func toMap(value any) (map[string]any, bool) {
+	switch typed := value.(type) {
+	case map[string]any:
+		return typed, true
+	case map[any]any:
+		converted := make(map[string]any, len(typed))
+		for key, item := range typed {
+			converted[fmt.Sprint(key)] = item
+		}
+		return converted, true
+	}
+	return nil, false
+}
+
+func hasSection(keys map[string]string, section string) bool {
+	for key := range keys {
+		if strings.HasPrefix(key, section+".") {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,71 @@
+package config
+
+import (
+	"context"
+	"os"
+	"reflect"
+	"time"
+)
+
+type ReloadResult struct {
+	Path       string    `json:"path,omitempty"`
+	ReloadedAt time.Time `json:"reloadedAt"`
+	Applied    []string  `json:"applied"`
+	Rejected   []string  `json:"rejected"`
+}
+
+// Diff compares two configs of the same struct type field by field. Changed
+// fields named in safe are returned as applied, every other change as
+// rejected. Nested structs count as one field.
+func Diff(current, next any, safe map[string]bool) (applied, rejected []string) {
+	a, b := reflect.ValueOf(current), reflect.ValueOf(next)
+	applied, rejected = []string{}, []string{}
+	for i := 0; i < a.NumField(); i++ {
+		name := a.Type().Field(i).Name
+		if reflect.DeepEqual(a.Field(i).Interface(), b.Field(i).Interface()) {
+			continue
+		}
+		if safe[name] {
+			applied = append(applied, name)
+		} else {
+			rejected = append(rejected, name)
+		}
+	}
+	return applied, rejected
+}
+
+// WatchFile calls onChange whenever path's size or modification time changes,
+// checking every interval until ctx ends. Polling keeps it working for editors
+// and config management tools that replace the file instead of writing it.
+func WatchFile(ctx context.Context, path string, interval time.Duration, onChange func()) {
+	if interval <= 0 {
+		interval = 5 * time.Second
+	}
+	last := fileStamp(path)
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		if stamp := fileStamp(path); stamp != last {
+			last = stamp
+			onChange()
+		}
+	}
+}
+
+type stamp struct {
+	size    int64
+	modTime time.Time
+}
+
+func fileStamp(path string) stamp {
+	info, err := os.Stat(path)
+	if err != nil {
+		return stamp{}
+	}
+	return stamp{size: info.Size(), modTime: info.ModTime()}
+}
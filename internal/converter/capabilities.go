@@ -0,0 +1,272 @@
+package converter
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	storagearchive "go.podman.io/storage/pkg/archive"
+)
+
+const (
+	capabilityXattr = "security.capability"
+	paxXattrPrefix  = "SCHILY.xattr."
+	// specialModeBits are the permission bits setcap'd and setuid programs
+	// depend on beyond rwx.
+	specialModeBits = os.ModeSetuid | os.ModeSetgid
+)
+
+// specialFile is a file whose layer entry carries a file capability or a
+// setuid/setgid bit, i.e. an attribute that ApplyLayer drops silently when
+// the output directory's filesystem or the user cannot keep it.
+type specialFile struct {
+	Capability []byte
+	Mode       os.FileMode
+}
+
+// LostAttribute is a file capability or setuid/setgid bit of the image that
+// rootfs.ext4 does not have. rootfs.tar carries it either way.
+type LostAttribute struct {
+	Path      string
+	Attribute string
+	Reason    string
+}
+
+// CapabilityReport says how file capabilities and setuid/setgid bits of the
+// image came through conversion. Restored are paths the rootfs directory
+// lost but rootfs.tar and rootfs.ext4 were fixed up to carry again.
+type CapabilityReport struct {
+	Preserved int
+	Restored  []string
+	Lost      []LostAttribute
+}
+
+// scanLayerSpecialFiles returns the special files of the image after its
+// layers are stacked, keyed by slash path relative to the rootfs. It reads
+// the layer tars rather than the applied rootfs, which may already have
+// lost the attributes.
+func scanLayerSpecialFiles(layers []layerFile) (map[string]specialFile, error) {
+	files := map[string]specialFile{}
+	for _, layer := range layers {
+		if err := scanLayer(layer.Path, files); err != nil {
+			return nil, fmt.Errorf("scan layer %s for capabilities: %w", layer.Digest.String(), err)
+		}
+	}
+	return files, nil
+}
+
+func scanLayer(layerPath string, files map[string]specialFile) error {
+	file, err := os.Open(layerPath)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	stream, err := storagearchive.DecompressStream(file)
+	if err != nil {
+		return err
+	}
+	defer stream.Close()
+
+	tr := tar.NewReader(stream)
+	for {
+		hdr, err := tr.Next()
+		if errors.Is(err, io.EOF) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		name := path.Clean(strings.TrimPrefix(hdr.Name, "./"))
+		dir, base := path.Split(name)
+		// Whiteouts hide what lower layers put at a path or under a dir.
+		if base == storagearchive.WhiteoutOpaqueDir {
+			removeSpecialFiles(files, path.Clean(dir))
+			continue
+		}
+		if hidden, ok := strings.CutPrefix(base, storagearchive.WhiteoutPrefix); ok {
+			removeSpecialFiles(files, path.Join(dir, hidden))
+			continue
+		}
+		delete(files, name)
+		if hdr.Typeflag != tar.TypeReg {
+			continue
+		}
+		special := specialFile{Mode: hdr.FileInfo().Mode() & specialModeBits}
+		if value, ok := hdr.PAXRecords[paxXattrPrefix+capabilityXattr]; ok {
+			special.Capability = []byte(value)
+		}
+		if special.Capability != nil || special.Mode != 0 {
+			files[name] = special
+		}
+	}
+}
+
+// removeSpecialFiles forgets name and everything below it.
+func removeSpecialFiles(files map[string]specialFile, name string) {
+	for candidate := range files {
+		if candidate == name || name == "." || strings.HasPrefix(candidate, name+"/") {
+			delete(files, candidate)
+		}
+	}
+}
+
+// restoreSpecialFiles puts back the attributes of expected that the rootfs
+// directory lost, where the filesystem lets it. Files stripped since are
+// skipped. Whatever still differs is returned as pending, for
+// createTarFromDir and patchExt4 to carry over.
+func restoreSpecialFiles(rootfsDir string, expected map[string]specialFile) (report CapabilityReport, pending map[string]specialFile) {
+	pending = map[string]specialFile{}
+	for name, want := range expected {
+		target := filepath.Join(rootfsDir, filepath.FromSlash(name))
+		info, err := os.Lstat(target)
+		if err != nil || !info.Mode().IsRegular() {
+			continue
+		}
+		intact, fixed := true, false
+		if want.Mode != 0 && info.Mode()&specialModeBits != want.Mode {
+			if err := os.Chmod(target, info.Mode().Perm()|want.Mode|info.Mode()&os.ModeSticky); err != nil {
+				intact = false
+			} else if info, err = os.Lstat(target); err != nil || info.Mode()&specialModeBits != want.Mode {
+				// Chmod as a non-owner, or nosuid, can drop the bits quietly.
+				intact = false
+			} else {
+				fixed = true
+			}
+		}
+		if want.Capability != nil {
+			got, err := getXattr(target, capabilityXattr)
+			if err != nil || !bytes.Equal(got, want.Capability) {
+				if setXattr(target, capabilityXattr, want.Capability) != nil {
+					intact = false
+				} else {
+					fixed = true
+				}
+			}
+		}
+		switch {
+		case !intact:
+			pending[name] = want
+		case fixed:
+			report.Restored = append(report.Restored, "/"+name)
+		default:
+			report.Preserved++
+		}
+	}
+	sort.Strings(report.Restored)
+	return report, pending
+}
+
+// patchExt4 writes the attributes in pending straight into the ext4 image
+// with debugfs, since mkfs.ext4 -d copied them from a directory that does
+// not have them. Paths it cannot fix are returned as lost.
+func patchExt4(ctx context.Context, rootfsDir, ext4Path string, pending map[string]specialFile) (restored []string, lost []LostAttribute) {
+	names := make([]string, 0, len(pending))
+	for name := range pending {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	if len(names) == 0 {
+		return nil, nil
+	}
+
+	if _, err := exec.LookPath("debugfs"); err != nil {
+		for _, name := range names {
+			lost = append(lost, lostAttributes(name, pending[name], "debugfs not found to patch rootfs.ext4")...)
+		}
+		return nil, lost
+	}
+	for _, name := range names {
+		if err := patchExt4File(ctx, rootfsDir, ext4Path, name, pending[name]); err != nil {
+			lost = append(lost, lostAttributes(name, pending[name], err.Error())...)
+			continue
+		}
+		restored = append(restored, "/"+name)
+	}
+	return restored, lost
+}
+
+func patchExt4File(ctx context.Context, rootfsDir, ext4Path, name string, want specialFile) error {
+	imagePath := "/" + name
+	if strings.ContainsAny(imagePath, " \t\n\"\\") {
+		return errors.New("path cannot be passed to debugfs")
+	}
+	if want.Capability != nil {
+		valueFile, err := os.CreateTemp("", "mergen-capability-*")
+		if err != nil {
+			return err
+		}
+		defer os.Remove(valueFile.Name())
+		_, err = valueFile.Write(want.Capability)
+		if closeErr := valueFile.Close(); err == nil {
+			err = closeErr
+		}
+		if err != nil {
+			return err
+		}
+		if err := debugfs(ctx, ext4Path, fmt.Sprintf("ea_set -f %s %s %s", valueFile.Name(), imagePath, capabilityXattr)); err != nil {
+			return err
+		}
+	}
+	if want.Mode != 0 {
+		info, err := os.Lstat(filepath.Join(rootfsDir, filepath.FromSlash(name)))
+		if err != nil {
+			return err
+		}
+		mode := uint32(info.Mode().Perm()) | 0o100000
+		if want.Mode&os.ModeSetuid != 0 {
+			mode |= 0o4000
+		}
+		if want.Mode&os.ModeSetgid != 0 {
+			mode |= 0o2000
+		}
+		if err := debugfs(ctx, ext4Path, fmt.Sprintf("sif %s mode 0%o", imagePath, mode)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// debugfs runs one write request against image. debugfs reports most
+// request errors on stderr with a zero exit status, so anything there but
+// its version banner counts as failure.
+func debugfs(ctx context.Context, image, request string) error {
+	cmd := exec.CommandContext(ctx, "debugfs", "-w", "-R", request, image)
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	var problems []string
+	if err := cmd.Run(); err != nil {
+		problems = append(problems, err.Error())
+	}
+	for _, line := range strings.Split(strings.TrimSpace(stderr.String()), "\n") {
+		if line != "" && !strings.HasPrefix(line, "debugfs ") {
+			problems = append(problems, line)
+		}
+	}
+	if len(problems) > 0 {
+		return fmt.Errorf("debugfs %q: %s", request, strings.Join(problems, "; "))
+	}
+	return nil
+}
+
+func lostAttributes(name string, want specialFile, reason string) []LostAttribute {
+	var lost []LostAttribute
+	if want.Capability != nil {
+		lost = append(lost, LostAttribute{Path: "/" + name, Attribute: capabilityXattr, Reason: reason})
+	}
+	if want.Mode&os.ModeSetuid != 0 {
+		lost = append(lost, LostAttribute{Path: "/" + name, Attribute: "setuid", Reason: reason})
+	}
+	if want.Mode&os.ModeSetgid != 0 {
+		lost = append(lost, LostAttribute{Path: "/" + name, Attribute: "setgid", Reason: reason})
+	}
+	return lost
+}
@@ -21,6 +21,7 @@ import (
 
 	digest "github.com/opencontainers/go-digest"
 	dockertransport "go.podman.io/image/v5/docker"
+	"go.podman.io/image/v5/docker/reference"
 	"go.podman.io/image/v5/pkg/blobinfocache/none"
 	"go.podman.io/image/v5/types"
 	storagearchive "go.podman.io/storage/pkg/archive"
@@ -31,6 +32,9 @@ const (
 	defaultSbinInitPath   = "./artifacts/sbin-init/sbin-init"
 	defaultBootArgs       = "console=ttyS0 reboot=k panic=1 pci=off init=/sbin/init mergen.meta=/etc/mergen/image-meta.json"
 	defaultRootFSOverhead = 256
+	// initramfsDrivers are the modules a stock distro kernel needs to reach
+	// a Firecracker root disk and network.
+	initramfsDrivers = "virtio_mmio virtio_blk virtio_net ext4"
 )
 
 type Options struct {
@@ -40,6 +44,17 @@ type Options struct {
 	SizeMiB      int
 	SkipPull     bool
 	SbinInitPath string
+	// Initramfs also builds initrd.img with dracut from the modules of
+	// KernelVersion installed on this host, for kernels that load virtio
+	// as modules.
+	Initramfs     bool
+	KernelVersion string
+	// Strip removes docs, man pages, locales and package caches from the
+	// rootfs; PruneManifest names a file of further globs to remove. Both
+	// run after the layers are applied.
+	Strip         bool
+	PruneManifest string
+	Pull          PullOptions
 }
 
 type Result struct {
@@ -48,7 +63,13 @@ type Result struct {
 	RootFSDir             string
 	RootFSTarPath         string
 	RootFSExt4Path        string
+	InitrdPath            string
+	Strip                 StripReport
+	Capabilities          CapabilityReport
+	Layout                LayoutReport
 	MetadataPath          string
+	RequiredEnvPath       string
+	RequiredEnv           []RequiredEnvVar
 	SuggestedBootArgsPath string
 	SuggestedVMPath       string
 	StartCommand          []string
@@ -79,6 +100,11 @@ func (r *Runner) Run(ctx context.Context, opts Options) (Result, error) {
 	if err := ensureCommand("mkfs.ext4"); err != nil {
 		return Result{}, err
 	}
+	if normalized.Initramfs {
+		if err := ensureCommand("dracut"); err != nil {
+			return Result{}, err
+		}
+	}
 	if err := ensureReadableFile(normalized.SbinInitPath); err != nil {
 		return Result{}, err
 	}
@@ -88,6 +114,9 @@ func (r *Runner) Run(ctx context.Context, opts Options) (Result, error) {
 		"image", normalized.Image,
 		"outputDir", normalized.OutputDir,
 		"skipPull", normalized.SkipPull,
+		"proxy", normalized.Pull.Proxy != "",
+		"rateLimit", normalized.Pull.RateLimit,
+		"registryConcurrency", normalized.Pull.RegistryConcurrency,
 	)
 
 	if err := os.MkdirAll(normalized.OutputDir, 0o755); err != nil {
@@ -112,7 +141,7 @@ func (r *Runner) Run(ctx context.Context, opts Options) (Result, error) {
 		}
 	} else {
 		r.logger.Info("pulling image via containers/image docker transport", "image", normalized.Image, "cacheDir", cacheDir)
-		pulled, err = pullAndCacheImage(ctx, normalized.Image, cacheDir)
+		pulled, err = r.pullAndCacheImage(ctx, normalized.Image, cacheDir, normalized.Pull)
 		if err != nil {
 			return Result{}, err
 		}
@@ -124,6 +153,33 @@ func (r *Runner) Run(ctx context.Context, opts Options) (Result, error) {
 	if err := applyLayers(pulled.Layers, rootfsDir); err != nil {
 		return Result{}, err
 	}
+	specialFiles, err := scanLayerSpecialFiles(pulled.Layers)
+	if err != nil {
+		return Result{}, err
+	}
+
+	var stripped StripReport
+	if normalized.Strip {
+		report, err := stripRootFS(rootfsDir, defaultStripPatterns)
+		if err != nil {
+			return Result{}, err
+		}
+		stripped.add(report)
+	}
+	if normalized.PruneManifest != "" {
+		patterns, err := readPruneManifest(normalized.PruneManifest)
+		if err != nil {
+			return Result{}, err
+		}
+		report, err := stripRootFS(rootfsDir, patterns)
+		if err != nil {
+			return Result{}, err
+		}
+		stripped.add(report)
+	}
+	if normalized.Strip || normalized.PruneManifest != "" {
+		r.logger.Info("rootfs stripped", "removed", stripped.Removed, "bytesSaved", stripped.BytesSaved)
+	}
 
 	imageMeta := metadata{
 		Image:             normalized.Image,
@@ -146,10 +202,25 @@ func (r *Runner) Run(ctx context.Context, opts Options) (Result, error) {
 		return Result{}, err
 	}
 
+	requiredEnv := scanRequiredEnv(rootfsDir, pulled.Config.Env, pulled.Config.Entrypoint, pulled.Config.Cmd)
+	requiredEnvPath := filepath.Join(normalized.OutputDir, "required-env.json")
+	if err := writeRequiredEnv(requiredEnvPath, normalized.Image, requiredEnv); err != nil {
+		return Result{}, err
+	}
+	r.logger.Info("required env scanned", "variables", len(requiredEnv), "path", requiredEnvPath)
+
+	layout, err := sparsifyRootFS(rootfsDir, specialFiles)
+	if err != nil {
+		return Result{}, err
+	}
+	capabilities, pending := restoreSpecialFiles(rootfsDir, specialFiles)
+
 	rootfsTar := filepath.Join(normalized.OutputDir, "rootfs.tar")
-	if err := createTarFromDir(rootfsDir, rootfsTar); err != nil {
+	layout.Hardlinks, err = createTarFromDir(rootfsDir, rootfsTar, pending)
+	if err != nil {
 		return Result{}, err
 	}
+	r.logger.Info("rootfs layout", "hardlinks", layout.Hardlinks, "sparseFiles", layout.SparseFiles, "holeBytes", layout.HoleBytes)
 
 	sizeMiB := normalized.SizeMiB
 	if sizeMiB == 0 {
@@ -167,6 +238,28 @@ func (r *Runner) Run(ctx context.Context, opts Options) (Result, error) {
 	if err := buildExt4(ctx, rootfsDir, rootfsExt4, sizeMiB); err != nil {
 		return Result{}, err
 	}
+	restored, lost := patchExt4(ctx, rootfsDir, rootfsExt4, pending)
+	capabilities.Restored = append(capabilities.Restored, restored...)
+	capabilities.Lost = lost
+	sort.Strings(capabilities.Restored)
+	for _, attr := range capabilities.Lost {
+		r.logger.Warn("file attribute lost in conversion", "path", attr.Path, "attribute", attr.Attribute, "reason", attr.Reason)
+	}
+	r.logger.Info(
+		"file capabilities checked",
+		"preserved", capabilities.Preserved,
+		"restored", len(capabilities.Restored),
+		"lost", len(capabilities.Lost),
+	)
+
+	var initrdPath string
+	if normalized.Initramfs {
+		initrdPath = filepath.Join(normalized.OutputDir, "initrd.img")
+		r.logger.Info("building initramfs", "kernelVersion", normalized.KernelVersion, "path", initrdPath)
+		if err := buildInitramfs(ctx, normalized.KernelVersion, initrdPath); err != nil {
+			return Result{}, err
+		}
+	}
 
 	bootArgsPath := filepath.Join(normalized.OutputDir, "suggested-bootargs.txt")
 	if err := os.WriteFile(bootArgsPath, []byte(defaultBootArgs+"\n"), 0o644); err != nil {
@@ -174,7 +267,7 @@ func (r *Runner) Run(ctx context.Context, opts Options) (Result, error) {
 	}
 
 	suggestedVMPath := filepath.Join(normalized.OutputDir, "suggested-vm-request.json")
-	if err := writeSuggestedVMRequest(suggestedVMPath, normalized.Image, rootfsExt4, suggestedHTTPPort); err != nil {
+	if err := writeSuggestedVMRequest(suggestedVMPath, normalized.Image, rootfsExt4, initrdPath, suggestedHTTPPort); err != nil {
 		return Result{}, err
 	}
 
@@ -184,7 +277,13 @@ func (r *Runner) Run(ctx context.Context, opts Options) (Result, error) {
 		RootFSDir:             rootfsDir,
 		RootFSTarPath:         rootfsTar,
 		RootFSExt4Path:        rootfsExt4,
+		InitrdPath:            initrdPath,
+		Strip:                 stripped,
+		Capabilities:          capabilities,
+		Layout:                layout,
 		MetadataPath:          filepath.Join(normalized.OutputDir, "image-meta.json"),
+		RequiredEnvPath:       requiredEnvPath,
+		RequiredEnv:           requiredEnv,
 		SuggestedBootArgsPath: bootArgsPath,
 		SuggestedVMPath:       suggestedVMPath,
 		StartCommand:          startCmd,
@@ -202,12 +301,17 @@ func (r *Runner) Run(ctx context.Context, opts Options) (Result, error) {
 }
 
 type normalizedOptions struct {
-	Image        string
-	OutputDir    string
-	Name         string
-	SizeMiB      int
-	SkipPull     bool
-	SbinInitPath string
+	Image         string
+	OutputDir     string
+	Name          string
+	SizeMiB       int
+	SkipPull      bool
+	SbinInitPath  string
+	Initramfs     bool
+	KernelVersion string
+	Strip         bool
+	PruneManifest string
+	Pull          PullOptions
 }
 
 func normalizeOptions(opts Options) (normalizedOptions, error) {
@@ -235,13 +339,35 @@ func normalizeOptions(opts Options) (normalizedOptions, error) {
 		return normalizedOptions{}, fmt.Errorf("sizeMiB must be >= 0, got %d", opts.SizeMiB)
 	}
 
+	kernelVersion := strings.TrimSpace(opts.KernelVersion)
+	if opts.Initramfs && kernelVersion == "" {
+		return normalizedOptions{}, errors.New("kernel version is required to build an initramfs")
+	}
+
+	pruneManifest := strings.TrimSpace(opts.PruneManifest)
+	if pruneManifest != "" {
+		if err := ensureReadableFile(pruneManifest); err != nil {
+			return normalizedOptions{}, err
+		}
+	}
+
+	pull, err := normalizePullOptions(opts.Pull)
+	if err != nil {
+		return normalizedOptions{}, err
+	}
+
 	return normalizedOptions{
-		Image:        image,
-		OutputDir:    outputDir,
-		Name:         name,
-		SizeMiB:      opts.SizeMiB,
-		SkipPull:     opts.SkipPull,
-		SbinInitPath: sbinInitPath,
+		Image:         image,
+		OutputDir:     outputDir,
+		Name:          name,
+		SizeMiB:       opts.SizeMiB,
+		SkipPull:      opts.SkipPull,
+		SbinInitPath:  sbinInitPath,
+		Initramfs:     opts.Initramfs,
+		KernelVersion: kernelVersion,
+		Strip:         opts.Strip,
+		PruneManifest: pruneManifest,
+		Pull:          pull,
 	}, nil
 }
 
@@ -357,7 +483,7 @@ type imageManifest struct {
 	Layers    []manifestDescriptor `json:"layers"`
 }
 
-func pullAndCacheImage(ctx context.Context, image, cacheDir string) (pulledImage, error) {
+func (r *Runner) pullAndCacheImage(ctx context.Context, image, cacheDir string, opts PullOptions) (pulledImage, error) {
 	if err := os.RemoveAll(cacheDir); err != nil {
 		return pulledImage{}, fmt.Errorf("clean image cache dir: %w", err)
 	}
@@ -370,13 +496,22 @@ func pullAndCacheImage(ctx context.Context, image, cacheDir string) (pulledImage
 		return pulledImage{}, fmt.Errorf("parse docker image reference: %w", err)
 	}
 
-	src, err := ref.NewImageSource(ctx, &types.SystemContext{})
+	p := newPuller(opts, reference.Domain(ref.DockerReference()), r.logger)
+	src, err := ref.NewImageSource(ctx, p.systemContext())
 	if err != nil {
 		return pulledImage{}, fmt.Errorf("open image source: %w", err)
 	}
 	defer src.Close()
 
-	manifestBytes, manifestMIME, err := resolveSingleManifest(ctx, src)
+	var (
+		manifestBytes []byte
+		manifestMIME  string
+	)
+	err = p.retry(ctx, "manifest", func() error {
+		var err error
+		manifestBytes, manifestMIME, err = resolveSingleManifest(ctx, src)
+		return err
+	})
 	if err != nil {
 		return pulledImage{}, err
 	}
@@ -391,7 +526,7 @@ func pullAndCacheImage(ctx context.Context, image, cacheDir string) (pulledImage
 	if err != nil {
 		return pulledImage{}, fmt.Errorf("invalid config digest: %w", err)
 	}
-	configBytes, err := downloadBlobToBytes(ctx, src, types.BlobInfo{
+	configBytes, err := downloadBlobToBytes(ctx, p, src, types.BlobInfo{
 		Digest:    configDigest,
 		Size:      parsedManifest.Config.Size,
 		MediaType: parsedManifest.Config.MediaType,
@@ -427,7 +562,7 @@ func pullAndCacheImage(ctx context.Context, image, cacheDir string) (pulledImage
 			MediaType: layer.MediaType,
 			URLs:      cloneStrings(layer.URLs),
 		}
-		if err := downloadBlobToFile(ctx, src, layerInfo, layerPath); err != nil {
+		if err := downloadBlobToFile(ctx, p, src, layerInfo, layerPath); err != nil {
 			return pulledImage{}, fmt.Errorf("download layer %d (%s): %w", idx, layerDigest.String(), err)
 		}
 		layers = append(layers, layerFile{Digest: layerDigest, Path: layerPath})
@@ -591,14 +726,24 @@ func selectManifestDescriptor(manifests []manifestDescriptor) (manifestDescripto
 	return manifests[0], nil
 }
 
-func downloadBlobToBytes(ctx context.Context, src types.ImageSource, info types.BlobInfo) ([]byte, error) {
-	reader, _, err := src.GetBlob(ctx, info, none.NoCache)
-	if err != nil {
-		return nil, err
-	}
-	defer reader.Close()
+func downloadBlobToBytes(ctx context.Context, p *puller, src types.ImageSource, info types.BlobInfo) ([]byte, error) {
+	var payload []byte
+	err := p.retry(ctx, info.Digest.String(), func() error {
+		release, err := p.acquireSlot(ctx)
+		if err != nil {
+			return err
+		}
+		defer release()
 
-	payload, err := io.ReadAll(reader)
+		reader, _, err := src.GetBlob(ctx, info, none.NoCache)
+		if err != nil {
+			return err
+		}
+		defer reader.Close()
+
+		payload, err = io.ReadAll(p.reader(ctx, reader))
+		return err
+	})
 	if err != nil {
 		return nil, err
 	}
@@ -610,33 +755,41 @@ func downloadBlobToBytes(ctx context.Context, src types.ImageSource, info types.
 	return payload, nil
 }
 
-func downloadBlobToFile(ctx context.Context, src types.ImageSource, info types.BlobInfo, targetPath string) error {
+func downloadBlobToFile(ctx context.Context, p *puller, src types.ImageSource, info types.BlobInfo, targetPath string) error {
 	if err := os.MkdirAll(filepath.Dir(targetPath), 0o755); err != nil {
 		return fmt.Errorf("create blob dir: %w", err)
 	}
 
-	reader, _, err := src.GetBlob(ctx, info, none.NoCache)
-	if err != nil {
-		return err
-	}
-	defer reader.Close()
+	return p.retry(ctx, info.Digest.String(), func() error {
+		release, err := p.acquireSlot(ctx)
+		if err != nil {
+			return err
+		}
+		defer release()
 
-	file, err := os.Create(targetPath)
-	if err != nil {
-		return fmt.Errorf("create blob file %s: %w", targetPath, err)
-	}
-	defer file.Close()
+		reader, _, err := src.GetBlob(ctx, info, none.NoCache)
+		if err != nil {
+			return err
+		}
+		defer reader.Close()
 
-	digester := info.Digest.Algorithm().Digester()
-	writer := io.MultiWriter(file, digester.Hash())
-	if _, err := io.Copy(writer, reader); err != nil {
-		return fmt.Errorf("write blob file %s: %w", targetPath, err)
-	}
+		file, err := os.Create(targetPath)
+		if err != nil {
+			return fmt.Errorf("create blob file %s: %w", targetPath, err)
+		}
+		defer file.Close()
 
-	if got := digester.Digest(); got != info.Digest {
-		return fmt.Errorf("blob digest mismatch for %s: expected %s, got %s", targetPath, info.Digest.String(), got.String())
-	}
-	return nil
+		digester := info.Digest.Algorithm().Digester()
+		writer := io.MultiWriter(file, digester.Hash())
+		if _, err := io.Copy(writer, p.reader(ctx, reader)); err != nil {
+			return fmt.Errorf("write blob file %s: %w", targetPath, err)
+		}
+
+		if got := digester.Digest(); got != info.Digest {
+			return fmt.Errorf("blob digest mismatch for %s: expected %s, got %s", targetPath, info.Digest.String(), got.String())
+		}
+		return nil
+	})
 }
 
 func verifyDigest(expected digest.Digest, payload []byte) error {
@@ -779,17 +932,25 @@ func writeExecutableFileReplacingSymlink(path string, content []byte) error {
 	return nil
 }
 
-func createTarFromDir(srcDir, tarPath string) error {
+// createTarFromDir archives srcDir with the file capabilities it holds.
+// Entries in overrides get their capability and setuid/setgid bits from
+// there, for files the directory could not keep them on. Further names of
+// a hard-linked file are archived as links to the first, and the count of
+// those is returned. Holes are archived as zeros; archive/tar cannot write
+// sparse entries.
+func createTarFromDir(srcDir, tarPath string, overrides map[string]specialFile) (int, error) {
 	out, err := os.Create(tarPath)
 	if err != nil {
-		return fmt.Errorf("create tar file: %w", err)
+		return 0, fmt.Errorf("create tar file: %w", err)
 	}
 	defer out.Close()
 
 	tw := tar.NewWriter(out)
 	defer tw.Close()
 
-	return filepath.WalkDir(srcDir, func(path string, d fs.DirEntry, walkErr error) error {
+	hardlinks := 0
+	linked := map[inode]string{}
+	err = filepath.WalkDir(srcDir, func(path string, d fs.DirEntry, walkErr error) error {
 		if walkErr != nil {
 			return walkErr
 		}
@@ -821,11 +982,35 @@ func createTarFromDir(srcDir, tarPath string) error {
 			return err
 		}
 		hdr.Name = rel
+		if info.Mode().IsRegular() {
+			if capability, err := getXattr(path, capabilityXattr); err == nil && capability != nil {
+				hdr.PAXRecords = map[string]string{paxXattrPrefix + capabilityXattr: string(capability)}
+			}
+		}
+		if override, ok := overrides[rel]; ok {
+			if override.Capability != nil {
+				hdr.PAXRecords = map[string]string{paxXattrPrefix + capabilityXattr: string(override.Capability)}
+			}
+			if override.Mode&os.ModeSetuid != 0 {
+				hdr.Mode |= 0o4000
+			}
+			if override.Mode&os.ModeSetgid != 0 {
+				hdr.Mode |= 0o2000
+			}
+		}
+		if id, nlink, ok := fileIdentity(info); ok && nlink > 1 && info.Mode().IsRegular() {
+			if first, seen := linked[id]; seen {
+				hdr.Typeflag, hdr.Linkname, hdr.Size = tar.TypeLink, first, 0
+				hardlinks++
+			} else {
+				linked[id] = rel
+			}
+		}
 		if err := tw.WriteHeader(hdr); err != nil {
 			return err
 		}
 
-		if !info.Mode().IsRegular() {
+		if hdr.Typeflag != tar.TypeReg {
 			return nil
 		}
 
@@ -840,10 +1025,15 @@ func createTarFromDir(srcDir, tarPath string) error {
 		}
 		return closeErr
 	})
+	return hardlinks, err
 }
 
+// directorySizeBytes sums the space regular files in dir take on disk,
+// counting a hard-linked file once and leaving out its holes, as
+// mkfs.ext4 -d stores them.
 func directorySizeBytes(dir string) (int64, error) {
 	var total int64
+	seen := map[inode]bool{}
 	err := filepath.WalkDir(dir, func(path string, d fs.DirEntry, walkErr error) error {
 		if walkErr != nil {
 			return walkErr
@@ -853,7 +1043,13 @@ func directorySizeBytes(dir string) (int64, error) {
 			if err != nil {
 				return err
 			}
-			total += info.Size()
+			if id, nlink, ok := fileIdentity(info); ok && nlink > 1 {
+				if seen[id] {
+					return nil
+				}
+				seen[id] = true
+			}
+			total += min(info.Size(), allocatedBytes(info))
 		}
 		return nil
 	})
@@ -873,6 +1069,25 @@ func buildExt4(ctx context.Context, rootfsDir, ext4Path string, sizeMiB int) err
 	return nil
 }
 
+// buildInitramfs writes a generic (not host-only) dracut initramfs that
+// loads the virtio drivers and hands over to root= and init= from the
+// kernel command line.
+func buildInitramfs(ctx context.Context, kernelVersion, initrdPath string) error {
+	modulesDir := filepath.Join("/lib/modules", kernelVersion)
+	if _, err := os.Stat(modulesDir); err != nil {
+		return fmt.Errorf("modules for kernel %s not installed: %w", kernelVersion, err)
+	}
+	_, err := runCommand(ctx, "dracut",
+		"--force",
+		"--no-hostonly",
+		"--no-hostonly-cmdline",
+		"--kver", kernelVersion,
+		"--add-drivers", initramfsDrivers,
+		initrdPath,
+	)
+	return err
+}
+
 func exposedPortsList(in map[string]struct{}) []string {
 	if len(in) == 0 {
 		return nil
@@ -931,7 +1146,7 @@ func inferHTTPPort(exposed map[string]struct{}) int {
 	return candidates[0].port
 }
 
-func writeSuggestedVMRequest(path, image, rootfsExt4 string, httpPort int) error {
+func writeSuggestedVMRequest(path, image, rootfsExt4, initrd string, httpPort int) error {
 	if httpPort <= 0 {
 		httpPort = 80
 	}
@@ -948,11 +1163,19 @@ func writeSuggestedVMRequest(path, image, rootfsExt4 string, httpPort int) error
 				"host":  0,
 			},
 		},
-		"bootArgs": defaultBootArgs,
+		"boot": map[string]any{
+			"init": "/sbin/init",
+			"extra": map[string]string{
+				"mergen.meta": "/etc/mergen/image-meta.json",
+			},
+		},
 		"metadata": map[string]any{
 			"image": image,
 		},
 	}
+	if initrd != "" {
+		payload["initrd"] = initrd
+	}
 
 	body, err := json.MarshalIndent(payload, "", "  ")
 	if err != nil {
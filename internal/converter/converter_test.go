@@ -1,9 +1,19 @@
 package converter
 
 import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
 	"os"
 	"path/filepath"
 	"testing"
+	"time"
+
+	dockertransport "go.podman.io/image/v5/docker"
 )
 
 func TestSanitizeName(t *testing.T) {
@@ -136,3 +146,428 @@ func TestInjectSbinInitReplacesSymlinkWithoutTouchingTarget(t *testing.T) {
 		t.Fatalf("/sbin/mergen-init content mismatch: got %q want %q", string(copyAfter), initBinary)
 	}
 }
+
+func TestStripRootFS(t *testing.T) {
+	t.Parallel()
+
+	tmpDir := t.TempDir()
+	rootfsDir := filepath.Join(tmpDir, "rootfs")
+	files := map[string]string{
+		"usr/share/doc/curl/README":          "0123456789",
+		"usr/share/locale/de/LC_MESSAGES/mo": "12345",
+		"var/lib/apt/lists/index":            "abc",
+		"usr/bin/curl":                       "binary",
+	}
+	for rel, content := range files {
+		path := filepath.Join(rootfsDir, rel)
+		if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+			t.Fatalf("mkdir %s: %v", rel, err)
+		}
+		if err := os.WriteFile(path, []byte(content), 0o644); err != nil {
+			t.Fatalf("write %s: %v", rel, err)
+		}
+	}
+	// An absolute image symlink resolves against the host during conversion.
+	hostDir := filepath.Join(tmpDir, "host-man")
+	if err := os.MkdirAll(hostDir, 0o755); err != nil {
+		t.Fatalf("mkdir host dir: %v", err)
+	}
+	hostFile := filepath.Join(hostDir, "ls.1")
+	if err := os.WriteFile(hostFile, []byte("host"), 0o644); err != nil {
+		t.Fatalf("write host file: %v", err)
+	}
+	if err := os.Symlink(hostDir, filepath.Join(rootfsDir, "usr", "share", "man")); err != nil {
+		t.Fatalf("symlink man: %v", err)
+	}
+
+	report, err := stripRootFS(rootfsDir, defaultStripPatterns)
+	if err != nil {
+		t.Fatalf("stripRootFS failed: %v", err)
+	}
+	if report.Removed != 3 || report.BytesSaved != 18 {
+		t.Fatalf("report = %+v, want 3 entries and 18 bytes", report)
+	}
+	if _, err := os.Stat(hostFile); err != nil {
+		t.Fatalf("file behind a rootfs symlink was removed: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(rootfsDir, "usr", "bin", "curl")); err != nil {
+		t.Fatalf("unmatched file was removed: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(rootfsDir, "usr", "share", "doc")); err != nil {
+		t.Fatalf("stripped directory itself was removed: %v", err)
+	}
+}
+
+func TestReadPruneManifest(t *testing.T) {
+	t.Parallel()
+
+	tmpDir := t.TempDir()
+	valid := filepath.Join(tmpDir, "prune.txt")
+	if err := os.WriteFile(valid, []byte("# caches\n/var/cache/*\n\nusr/lib/python3*/test\n"), 0o644); err != nil {
+		t.Fatalf("write manifest: %v", err)
+	}
+	patterns, err := readPruneManifest(valid)
+	if err != nil {
+		t.Fatalf("readPruneManifest failed: %v", err)
+	}
+	if len(patterns) != 2 || patterns[0] != "var/cache/*" || patterns[1] != "usr/lib/python3*/test" {
+		t.Fatalf("patterns = %q", patterns)
+	}
+
+	for _, bad := range []string{"../etc/*", "/", "usr/../../etc", "usr/["} {
+		path := filepath.Join(tmpDir, "bad.txt")
+		if err := os.WriteFile(path, []byte(bad+"\n"), 0o644); err != nil {
+			t.Fatalf("write manifest: %v", err)
+		}
+		if _, err := readPruneManifest(path); err == nil {
+			t.Fatalf("readPruneManifest accepted %q", bad)
+		}
+	}
+}
+
+func TestScanRequiredEnv(t *testing.T) {
+	t.Parallel()
+
+	rootfsDir := t.TempDir()
+	script := `#!/bin/sh
+set -e
+: "${POSTGRES_PASSWORD:?set a password}"
+DATA_DIR="${PGDATA:-/var/lib/postgresql/data}"
+for FILE in /docker-entrypoint.d/*; do echo "$FILE"; done
+echo "$POSTGRES_USER on $HOSTNAME in $DATA_DIR with $DEBUG_LEVEL"
+exec "$@"
+`
+	for rel, content := range map[string]string{
+		"usr/local/bin/docker-entrypoint.sh": script,
+		"docker-entrypoint.d/10-tls.sh":      "#!/bin/sh\ncp \"$TLS_CERT\" /etc/ssl/\n",
+		"docker-entrypoint.d/README":         "$IGNORED\n",
+	} {
+		path := filepath.Join(rootfsDir, rel)
+		if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+			t.Fatalf("mkdir %s: %v", rel, err)
+		}
+		if err := os.WriteFile(path, []byte(content), 0o755); err != nil {
+			t.Fatalf("write %s: %v", rel, err)
+		}
+	}
+	if err := os.Symlink("usr/local/bin/docker-entrypoint.sh", filepath.Join(rootfsDir, "entrypoint.sh")); err != nil {
+		t.Fatalf("symlink entrypoint: %v", err)
+	}
+
+	vars := scanRequiredEnv(rootfsDir,
+		[]string{"PATH=/usr/local/bin:/usr/bin", "POSTGRES_USER=postgres", "API_KEY="},
+		[]string{"/entrypoint.sh"}, []string{"postgres"})
+
+	got := map[string]RequiredEnvVar{}
+	for _, v := range vars {
+		got[v.Name] = v
+	}
+	want := map[string]bool{"API_KEY": true, "POSTGRES_PASSWORD": true, "DEBUG_LEVEL": false, "TLS_CERT": false}
+	if len(got) != len(want) {
+		t.Fatalf("scanRequiredEnv() = %+v, want %v", vars, want)
+	}
+	for name, required := range want {
+		v, ok := got[name]
+		if !ok || v.Required != required {
+			t.Fatalf("variable %s = %+v, want required=%v", name, v, required)
+		}
+	}
+	if sources := got["POSTGRES_PASSWORD"].Sources; len(sources) != 1 || sources[0] != "/usr/local/bin/docker-entrypoint.sh" {
+		t.Fatalf("POSTGRES_PASSWORD sources = %q", sources)
+	}
+}
+
+func TestScanLayerSpecialFiles(t *testing.T) {
+	t.Parallel()
+
+	tmpDir := t.TempDir()
+	capability := "\x01\x00\x00\x02\x00\x04\x00\x00"
+	lower := writeLayer(t, filepath.Join(tmpDir, "lower.tar"), []tar.Header{
+		{Name: "usr/sbin/nginx", Mode: 0o755, PAXRecords: map[string]string{paxXattrPrefix + capabilityXattr: capability}},
+		{Name: "usr/bin/passwd", Mode: 0o4755},
+		{Name: "usr/bin/wall", Mode: 0o2755},
+		{Name: "opt/tool/ping", Mode: 0o4755},
+		{Name: "usr/bin/plain", Mode: 0o755},
+	})
+	upper := writeLayer(t, filepath.Join(tmpDir, "upper.tar"), []tar.Header{
+		{Name: "usr/bin/.wh.wall", Mode: 0o644},
+		{Name: "opt/tool/.wh..wh..opq", Mode: 0o644},
+		{Name: "usr/bin/passwd", Mode: 0o755},
+		{Name: "usr/bin/su", Mode: 0o4755},
+	})
+
+	files, err := scanLayerSpecialFiles([]layerFile{{Path: lower}, {Path: upper}})
+	if err != nil {
+		t.Fatalf("scanLayerSpecialFiles failed: %v", err)
+	}
+	if len(files) != 2 {
+		t.Fatalf("files = %v, want nginx and su", files)
+	}
+	if got := files["usr/sbin/nginx"]; string(got.Capability) != capability || got.Mode != 0 {
+		t.Fatalf("nginx = %+v, want its capability", got)
+	}
+	if got := files["usr/bin/su"]; got.Mode != os.ModeSetuid {
+		t.Fatalf("su = %+v, want setuid", got)
+	}
+}
+
+func TestRestoreSpecialFilesAndTarOverrides(t *testing.T) {
+	t.Parallel()
+
+	tmpDir := t.TempDir()
+	rootfsDir := filepath.Join(tmpDir, "rootfs")
+	for _, rel := range []string{"usr/bin/su", "usr/bin/sudo"} {
+		path := filepath.Join(rootfsDir, rel)
+		if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+			t.Fatalf("mkdir %s: %v", rel, err)
+		}
+		if err := os.WriteFile(path, []byte("binary"), 0o755); err != nil {
+			t.Fatalf("write %s: %v", rel, err)
+		}
+	}
+	if err := os.Chmod(filepath.Join(rootfsDir, "usr/bin/sudo"), 0o755|os.ModeSetuid); err != nil {
+		t.Fatalf("chmod sudo: %v", err)
+	}
+	expected := map[string]specialFile{
+		"usr/bin/su":         {Mode: os.ModeSetuid},
+		"usr/bin/sudo":       {Mode: os.ModeSetuid},
+		"usr/share/stripped": {Mode: os.ModeSetuid},
+	}
+
+	report, pending := restoreSpecialFiles(rootfsDir, expected)
+	if report.Preserved != 1 || len(report.Restored) != 1 || report.Restored[0] != "/usr/bin/su" || len(pending) != 0 {
+		t.Fatalf("report = %+v pending = %v, want sudo preserved and su restored", report, pending)
+	}
+	info, err := os.Stat(filepath.Join(rootfsDir, "usr/bin/su"))
+	if err != nil || info.Mode()&os.ModeSetuid == 0 {
+		t.Fatalf("su mode = %v err = %v, want setuid restored", info.Mode(), err)
+	}
+
+	// Attributes the directory cannot keep still reach the tar.
+	capability := "\x01\x00\x00\x02\x00\x20\x00\x00"
+	overrides := map[string]specialFile{"usr/bin/sudo": {Capability: []byte(capability), Mode: os.ModeSetgid}}
+	tarPath := filepath.Join(tmpDir, "rootfs.tar")
+	if _, err := createTarFromDir(rootfsDir, tarPath, overrides); err != nil {
+		t.Fatalf("createTarFromDir failed: %v", err)
+	}
+	headers := readTarHeaders(t, tarPath)
+	sudo, ok := headers["usr/bin/sudo"]
+	if !ok {
+		t.Fatalf("sudo missing from tar: %v", headers)
+	}
+	if sudo.PAXRecords[paxXattrPrefix+capabilityXattr] != capability || sudo.Mode&0o6000 != 0o6000 {
+		t.Fatalf("sudo header mode %o pax %v, want capability and setuid+setgid", sudo.Mode, sudo.PAXRecords)
+	}
+	if su := headers["usr/bin/su"]; su.Mode&0o4000 == 0 {
+		t.Fatalf("su header mode %o, want setuid", su.Mode)
+	}
+}
+
+func writeLayer(t *testing.T, path string, headers []tar.Header) string {
+	t.Helper()
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	for _, hdr := range headers {
+		hdr.Typeflag = tar.TypeReg
+		hdr.Format = tar.FormatPAX
+		if err := tw.WriteHeader(&hdr); err != nil {
+			t.Fatalf("write header %s: %v", hdr.Name, err)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatalf("close tar: %v", err)
+	}
+	if err := os.WriteFile(path, buf.Bytes(), 0o644); err != nil {
+		t.Fatalf("write layer: %v", err)
+	}
+	return path
+}
+
+func readTarHeaders(t *testing.T, path string) map[string]*tar.Header {
+	t.Helper()
+	file, err := os.Open(path)
+	if err != nil {
+		t.Fatalf("open tar: %v", err)
+	}
+	defer file.Close()
+	headers := map[string]*tar.Header{}
+	tr := tar.NewReader(file)
+	for {
+		hdr, err := tr.Next()
+		if errors.Is(err, io.EOF) {
+			return headers
+		}
+		if err != nil {
+			t.Fatalf("read tar: %v", err)
+		}
+		headers[hdr.Name] = hdr
+	}
+}
+
+func TestCreateTarFromDirHardlinks(t *testing.T) {
+	t.Parallel()
+
+	tmpDir := t.TempDir()
+	rootfsDir := filepath.Join(tmpDir, "rootfs")
+	busybox := filepath.Join(rootfsDir, "bin", "busybox")
+	if err := os.MkdirAll(filepath.Dir(busybox), 0o755); err != nil {
+		t.Fatalf("mkdir: %v", err)
+	}
+	if err := os.WriteFile(busybox, bytes.Repeat([]byte("b"), 1000), 0o755); err != nil {
+		t.Fatalf("write busybox: %v", err)
+	}
+	for _, applet := range []string{"ls", "sh"} {
+		if err := os.Link(busybox, filepath.Join(rootfsDir, "bin", applet)); err != nil {
+			t.Fatalf("link %s: %v", applet, err)
+		}
+	}
+
+	hardlinks, err := createTarFromDir(rootfsDir, filepath.Join(tmpDir, "rootfs.tar"), nil)
+	if err != nil {
+		t.Fatalf("createTarFromDir failed: %v", err)
+	}
+	if hardlinks != 2 {
+		t.Fatalf("hardlinks = %d, want 2", hardlinks)
+	}
+	headers := readTarHeaders(t, filepath.Join(tmpDir, "rootfs.tar"))
+	if first := headers["bin/busybox"]; first.Typeflag != tar.TypeReg || first.Size != 1000 {
+		t.Fatalf("busybox header = %+v, want the file itself", first)
+	}
+	for _, applet := range []string{"bin/ls", "bin/sh"} {
+		if hdr := headers[applet]; hdr.Typeflag != tar.TypeLink || hdr.Linkname != "bin/busybox" || hdr.Size != 0 {
+			t.Fatalf("%s header = %+v, want a link to bin/busybox", applet, hdr)
+		}
+	}
+
+	size, err := directorySizeBytes(rootfsDir)
+	if err != nil {
+		t.Fatalf("directorySizeBytes failed: %v", err)
+	}
+	if size != 1000 {
+		t.Fatalf("size = %d, want the linked file counted once", size)
+	}
+}
+
+func TestSparsifyRootFS(t *testing.T) {
+	t.Parallel()
+
+	rootfsDir := t.TempDir()
+	// Data, two zero blocks, data, then a partial zero block kept as data.
+	content := bytes.Repeat([]byte{0}, sparseMinSize+3*holeBlockSize+100)
+	copy(content, "head")
+	copy(content[3*holeBlockSize:], "middle")
+	path := filepath.Join(rootfsDir, "disk.img")
+	if err := os.WriteFile(path, content, 0o644); err != nil {
+		t.Fatalf("write image: %v", err)
+	}
+	if err := os.WriteFile(filepath.Join(rootfsDir, "setuid"), content, 0o755); err != nil {
+		t.Fatalf("write special file: %v", err)
+	}
+
+	report, err := sparsifyRootFS(rootfsDir, map[string]specialFile{"setuid": {Mode: os.ModeSetuid}})
+	if err != nil {
+		t.Fatalf("sparsifyRootFS failed: %v", err)
+	}
+	if report.SparseFiles == 0 {
+		t.Skip("filesystem does not support punching holes")
+	}
+	wantHoles := int64(2*holeBlockSize) + int64(len(content)-4*holeBlockSize-100)/holeBlockSize*holeBlockSize
+	if report.SparseFiles != 1 || report.HoleBytes != wantHoles {
+		t.Fatalf("report = %+v, want one file with %d bytes of holes", report, wantHoles)
+	}
+	got, err := os.ReadFile(path)
+	if err != nil || !bytes.Equal(got, content) {
+		t.Fatalf("sparsified image content changed (err %v)", err)
+	}
+}
+
+func TestNormalizePullOptions(t *testing.T) {
+	opts, err := normalizePullOptions(PullOptions{Proxy: " http://proxy:3128 "})
+	if err != nil || opts.Proxy != "http://proxy:3128" || opts.LockDir != defaultPullLockDir {
+		t.Fatalf("unexpected options %+v err=%v", opts, err)
+	}
+	for _, bad := range []PullOptions{{Proxy: "proxy:3128"}, {RateLimit: -1}, {RegistryConcurrency: -1}, {Retries: -1}} {
+		if _, err := normalizePullOptions(bad); err == nil {
+			t.Fatalf("expected %+v to be rejected", bad)
+		}
+	}
+}
+
+func TestBandwidthDelay(t *testing.T) {
+	b := &bandwidth{rate: 1000}
+	now := time.Now()
+	if wait := b.delay(now, 1000); wait > 0 {
+		t.Fatalf("first second should be a free burst, waited %s", wait)
+	}
+	if wait := b.delay(now, 500); wait != 500*time.Millisecond {
+		t.Fatalf("expected 500ms wait past the burst, got %s", wait)
+	}
+	// Idle time is not banked beyond the burst.
+	if wait := b.delay(now.Add(time.Minute), 1000); wait > 0 {
+		t.Fatalf("expected no wait after idling, got %s", wait)
+	}
+}
+
+func TestPullerRetriesTooManyRequests(t *testing.T) {
+	p := newPuller(PullOptions{Retries: 2}, "registry-1.docker.io", slog.New(slog.NewTextHandler(io.Discard, nil)))
+	var slept []time.Duration
+	p.sleep = func(_ context.Context, d time.Duration) error {
+		slept = append(slept, d)
+		return nil
+	}
+
+	calls := 0
+	err := p.retry(context.Background(), "manifest", func() error {
+		calls++
+		if calls < 3 {
+			return fmt.Errorf("reading manifest: toomanyrequests: You have reached your pull rate limit")
+		}
+		return nil
+	})
+	if err != nil || calls != 3 || len(slept) != 2 || slept[1] != 2*slept[0] {
+		t.Fatalf("calls %d slept %v err=%v", calls, slept, err)
+	}
+
+	calls = 0
+	err = p.retry(context.Background(), "blob", func() error {
+		calls++
+		return dockertransport.ErrTooManyRequests
+	})
+	if !errors.Is(err, dockertransport.ErrTooManyRequests) || calls != 3 {
+		t.Fatalf("expected to give up after the retries, calls %d err=%v", calls, err)
+	}
+
+	calls = 0
+	if err := p.retry(context.Background(), "blob", func() error { calls++; return errors.New("not found") }); err == nil || calls != 1 {
+		t.Fatalf("other errors must not be retried, calls %d err=%v", calls, err)
+	}
+}
+
+func TestPullerRegistrySlots(t *testing.T) {
+	p := newPuller(PullOptions{RegistryConcurrency: 2, LockDir: t.TempDir()}, "ghcr.io:443", slog.New(slog.NewTextHandler(io.Discard, nil)))
+	first, err := p.acquireSlot(context.Background())
+	if err != nil {
+		t.Fatalf("first slot: %v", err)
+	}
+	second, err := p.acquireSlot(context.Background())
+	if err != nil {
+		t.Fatalf("second slot: %v", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	p.sleep = func(context.Context, time.Duration) error {
+		cancel()
+		return ctx.Err()
+	}
+	if _, err := p.acquireSlot(ctx); !errors.Is(err, context.Canceled) {
+		t.Fatalf("expected to wait for a free slot, got %v", err)
+	}
+
+	second()
+	third, err := p.acquireSlot(context.Background())
+	if err != nil {
+		t.Fatalf("slot after release: %v", err)
+	}
+	first()
+	third()
+}
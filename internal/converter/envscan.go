@@ -0,0 +1,203 @@
+package converter
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// entrypointDirs hold scripts that official images' docker-entrypoint.sh
+// sources before starting the workload.
+var entrypointDirs = []string{"docker-entrypoint.d", "docker-entrypoint-initdb.d"}
+
+var (
+	// envReference matches $VAR and ${VAR...}; group 2 is the expansion
+	// operator, e.g. ":-" for a default or ":?" for a required value.
+	envReference  = regexp.MustCompile(`\$(?:\{([A-Za-z_][A-Za-z0-9_]*)(:?[-=?+])?|([A-Za-z_][A-Za-z0-9_]*))`)
+	envAssignment = regexp.MustCompile(`(?m)(?:^|[\s;(&|])(?:export\s+|local\s+|readonly\s+|declare\s+(?:-\w+\s+)*)?([A-Za-z_][A-Za-z0-9_]*)=`)
+	envLoopOrRead = regexp.MustCompile(`(?:\bfor\s+|\bread\s+(?:-\w+\s+)*)([A-Za-z_][A-Za-z0-9_]*)`)
+	envVarName    = regexp.MustCompile(`^[A-Z][A-Z0-9_]*$`)
+)
+
+// ambientEnv are set by the shell, the kernel or the guest init, so a
+// script reading them needs nothing from the user.
+var ambientEnv = map[string]bool{
+	"PATH": true, "HOME": true, "PWD": true, "OLDPWD": true, "HOSTNAME": true, "USER": true,
+	"SHELL": true, "TERM": true, "IFS": true, "UID": true, "EUID": true, "PPID": true,
+	"RANDOM": true, "LINENO": true, "SECONDS": true, "OPTARG": true, "OPTIND": true, "LANG": true,
+	"LC_ALL": true, "TMPDIR": true, "BASH_SOURCE": true, "FUNCNAME": true, "SHLVL": true,
+}
+
+// RequiredEnvVar is a variable the workload likely reads from its
+// environment. Required marks the ones it cannot run without: declared
+// empty by the image, or expanded as ${VAR:?} by a script.
+type RequiredEnvVar struct {
+	Name     string   `json:"name"`
+	Required bool     `json:"required"`
+	Sources  []string `json:"sources"`
+}
+
+type requiredEnvFile struct {
+	Image     string           `json:"image"`
+	Variables []RequiredEnvVar `json:"variables"`
+}
+
+type envScan struct {
+	vars map[string]*RequiredEnvVar
+}
+
+func (s *envScan) note(name, source string, required bool) {
+	v, ok := s.vars[name]
+	if !ok {
+		v = &RequiredEnvVar{Name: name}
+		s.vars[name] = v
+	}
+	v.Required = v.Required || required
+	for _, existing := range v.Sources {
+		if existing == source {
+			return
+		}
+	}
+	v.Sources = append(v.Sources, source)
+}
+
+// scanRequiredEnv lists the environment the image likely expects: image
+// env entries without a value, and upper-case variables its entrypoint
+// scripts read without a default or assigning them first. Variables the
+// image env sets are left out.
+func scanRequiredEnv(rootfsDir string, imageEnv, entrypoint, cmd []string) []RequiredEnvVar {
+	scan := &envScan{vars: map[string]*RequiredEnvVar{}}
+	provided := map[string]bool{}
+	imagePath := ""
+	for _, entry := range imageEnv {
+		name, value, _ := strings.Cut(entry, "=")
+		if name == "PATH" {
+			imagePath = value
+		}
+		if value == "" {
+			scan.note(name, "image env", true)
+			continue
+		}
+		provided[name] = true
+	}
+
+	var scripts []string
+	for _, argv := range [][]string{entrypoint, cmd} {
+		if len(argv) == 0 {
+			continue
+		}
+		if path := resolveInRootFS(rootfsDir, argv[0], imagePath); path != "" {
+			scripts = append(scripts, path)
+		}
+	}
+	for _, dir := range entrypointDirs {
+		matches, _ := filepath.Glob(filepath.Join(rootfsDir, dir, "*.sh"))
+		scripts = append(scripts, matches...)
+	}
+	seen := map[string]bool{}
+	for _, path := range scripts {
+		if seen[path] {
+			continue
+		}
+		seen[path] = true
+		content, err := os.ReadFile(path)
+		if err != nil || !bytes.HasPrefix(content, []byte("#!")) {
+			continue
+		}
+		source := "/" + strings.TrimPrefix(filepath.ToSlash(strings.TrimPrefix(path, rootfsDir)), "/")
+		scanScript(scan, string(content), source, provided)
+	}
+
+	out := make([]RequiredEnvVar, 0, len(scan.vars))
+	for _, v := range scan.vars {
+		out = append(out, *v)
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].Name < out[j].Name })
+	return out
+}
+
+func scanScript(scan *envScan, content, source string, provided map[string]bool) {
+	assigned := map[string]bool{}
+	for _, m := range envAssignment.FindAllStringSubmatch(content, -1) {
+		assigned[m[1]] = true
+	}
+	for _, m := range envLoopOrRead.FindAllStringSubmatch(content, -1) {
+		assigned[m[1]] = true
+	}
+	for _, m := range envReference.FindAllStringSubmatch(content, -1) {
+		name, op := m[1], m[2]
+		if name == "" {
+			name = m[3]
+		}
+		if !envVarName.MatchString(name) || ambientEnv[name] || provided[name] {
+			continue
+		}
+		switch strings.TrimPrefix(op, ":") {
+		case "-", "=", "+":
+			continue
+		case "?":
+			scan.note(name, source, true)
+			continue
+		}
+		if !assigned[name] {
+			scan.note(name, source, false)
+		}
+	}
+}
+
+// resolveInRootFS finds an entrypoint binary inside the rootfs, searching
+// the image PATH for bare names and following symlinks against the rootfs
+// rather than the host. It returns "" when nothing regular is found.
+func resolveInRootFS(rootfsDir, name, imagePath string) string {
+	candidates := []string{name}
+	if !strings.HasPrefix(name, "/") {
+		if imagePath == "" {
+			imagePath = "/usr/local/sbin:/usr/local/bin:/usr/sbin:/usr/bin:/sbin:/bin"
+		}
+		candidates = candidates[:0]
+		for _, dir := range strings.Split(imagePath, ":") {
+			candidates = append(candidates, filepath.Join(dir, name))
+		}
+	}
+	for _, candidate := range candidates {
+		current := filepath.Clean("/" + candidate)
+		for hops := 0; hops < 8; hops++ {
+			hostPath := filepath.Join(rootfsDir, current)
+			info, err := os.Lstat(hostPath)
+			if err != nil {
+				break
+			}
+			if info.Mode().IsRegular() {
+				return hostPath
+			}
+			if info.Mode()&os.ModeSymlink == 0 {
+				break
+			}
+			target, err := os.Readlink(hostPath)
+			if err != nil {
+				break
+			}
+			if !filepath.IsAbs(target) {
+				target = filepath.Join(filepath.Dir(current), target)
+			}
+			current = filepath.Clean("/" + target)
+		}
+	}
+	return ""
+}
+
+func writeRequiredEnv(path, image string, vars []RequiredEnvVar) error {
+	body, err := json.MarshalIndent(requiredEnvFile{Image: image, Variables: vars}, "", "  ")
+	if err != nil {
+		return fmt.Errorf("encode required env: %w", err)
+	}
+	if err := os.WriteFile(path, append(body, '\n'), 0o644); err != nil {
+		return fmt.Errorf("write required env: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,37 @@
+package converter
+
+import (
+	"errors"
+	"os"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+// fileIdentity returns the device and inode of info and its link count.
+func fileIdentity(info os.FileInfo) (inode, uint64, bool) {
+	stat, ok := info.Sys().(*syscall.Stat_t)
+	if !ok {
+		return inode{}, 0, false
+	}
+	return inode{dev: uint64(stat.Dev), ino: stat.Ino}, uint64(stat.Nlink), true
+}
+
+// allocatedBytes is the disk space info's file takes, less than its size
+// when it has holes.
+func allocatedBytes(info os.FileInfo) int64 {
+	if stat, ok := info.Sys().(*syscall.Stat_t); ok {
+		return stat.Blocks * 512
+	}
+	return info.Size()
+}
+
+// punchHole deallocates length bytes at offset of file, keeping its size.
+// errHolesUnsupported reports a filesystem that cannot.
+func punchHole(file *os.File, offset, length int64) error {
+	err := unix.Fallocate(int(file.Fd()), unix.FALLOC_FL_PUNCH_HOLE|unix.FALLOC_FL_KEEP_SIZE, offset, length)
+	if errors.Is(err, unix.EOPNOTSUPP) || errors.Is(err, unix.ENOSYS) {
+		return errHolesUnsupported
+	}
+	return err
+}
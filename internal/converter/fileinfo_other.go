@@ -0,0 +1,17 @@
+//go:build !linux
+
+package converter
+
+import "os"
+
+func fileIdentity(os.FileInfo) (inode, uint64, bool) {
+	return inode{}, 0, false
+}
+
+func allocatedBytes(info os.FileInfo) int64 {
+	return info.Size()
+}
+
+func punchHole(*os.File, int64, int64) error {
+	return errHolesUnsupported
+}
@@ -0,0 +1,144 @@
+package converter
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+)
+
+const (
+	// holeBlockSize is the granularity zero runs are punched at; it matches
+	// the ext4 block size mkfs.ext4 picks for rootfs-sized images.
+	holeBlockSize = 4096
+	// sparseMinSize skips files too small for holes to matter.
+	sparseMinSize = 1 << 20
+)
+
+var errHolesUnsupported = errors.New("filesystem does not support punching holes")
+
+type inode struct {
+	dev uint64
+	ino uint64
+}
+
+// LayoutReport says how much of the rootfs is shared or unallocated on
+// disk: hard links are archived and built into rootfs.ext4 once, and zero
+// blocks of large files are left as holes.
+type LayoutReport struct {
+	Hardlinks   int
+	SparseFiles int
+	HoleBytes   int64
+}
+
+// sparsifyRootFS punches holes into the all-zero blocks of large regular
+// files. Layer application writes a sparse image file back out in full;
+// this undoes that for the ext4 build, which copies holes as holes. Files
+// in special are skipped: punching a hole makes the kernel drop setuid
+// bits and capabilities. A filesystem without hole punching leaves the
+// files as they are.
+func sparsifyRootFS(rootfsDir string, special map[string]specialFile) (LayoutReport, error) {
+	var report LayoutReport
+	seen := map[inode]bool{}
+	buf := make([]byte, 256*holeBlockSize)
+	err := filepath.WalkDir(rootfsDir, func(path string, d fs.DirEntry, walkErr error) error {
+		if walkErr != nil {
+			return walkErr
+		}
+		if !d.Type().IsRegular() {
+			return nil
+		}
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		if info.Size() < sparseMinSize {
+			return nil
+		}
+		rel, err := filepath.Rel(rootfsDir, path)
+		if err != nil {
+			return err
+		}
+		if _, ok := special[filepath.ToSlash(rel)]; ok {
+			return nil
+		}
+		if id, _, ok := fileIdentity(info); ok {
+			if seen[id] {
+				return nil
+			}
+			seen[id] = true
+		}
+		punched, err := punchZeroBlocks(path, buf)
+		if err != nil {
+			return err
+		}
+		if punched > 0 {
+			report.SparseFiles++
+			report.HoleBytes += punched
+		}
+		return nil
+	})
+	if errors.Is(err, errHolesUnsupported) {
+		return LayoutReport{}, nil
+	}
+	if err != nil {
+		return LayoutReport{}, fmt.Errorf("sparsify rootfs: %w", err)
+	}
+	return report, nil
+}
+
+// punchZeroBlocks turns runs of whole zero blocks in path into holes and
+// returns the bytes deallocated. Blocks that are holes already count too,
+// since they read back as zeros.
+func punchZeroBlocks(path string, buf []byte) (int64, error) {
+	file, err := os.OpenFile(path, os.O_RDWR, 0)
+	if err != nil {
+		return 0, err
+	}
+	defer file.Close()
+
+	var punched, runStart, offset int64
+	runStart = -1
+	flush := func(end int64) error {
+		if runStart < 0 {
+			return nil
+		}
+		if err := punchHole(file, runStart, end-runStart); err != nil {
+			return err
+		}
+		punched += end - runStart
+		runStart = -1
+		return nil
+	}
+	zero := make([]byte, holeBlockSize)
+	for {
+		n, err := io.ReadFull(file, buf)
+		// A trailing partial block is kept as data.
+		for i := 0; i+holeBlockSize <= n; i += holeBlockSize {
+			blockStart := offset + int64(i)
+			if bytes.Equal(buf[i:i+holeBlockSize], zero) {
+				if runStart < 0 {
+					runStart = blockStart
+				}
+				continue
+			}
+			if err := flush(blockStart); err != nil {
+				return 0, err
+			}
+		}
+		offset += int64(n)
+		if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+			break
+		}
+		if err != nil {
+			return 0, err
+		}
+	}
+	if err := flush(offset - offset%holeBlockSize); err != nil {
+		return 0, err
+	}
+	return punched, nil
+}
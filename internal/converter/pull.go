@@ -0,0 +1,217 @@
+package converter
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/url"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	dockertransport "go.podman.io/image/v5/docker"
+	"go.podman.io/image/v5/types"
+
+	"github.com/alperreha/mergen-fire/internal/lock"
+)
+
+const (
+	defaultPullLockDir = "/run/mergen/converter"
+	defaultPullRetries = 3
+	// rateLimitChunk bounds a single throttled read, so a limited download
+	// is paced in small steps rather than in bursts of a whole buffer.
+	rateLimitChunk = 32 << 10
+	// tooManyRequestsDelay is the first wait after the registry client gave
+	// up on a 429; it doubles up to tooManyRequestsMaxDelay.
+	tooManyRequestsDelay    = 30 * time.Second
+	tooManyRequestsMaxDelay = 5 * time.Minute
+	slotPollInterval        = 500 * time.Millisecond
+)
+
+// PullOptions shape how images are fetched from their registry. The zero
+// value pulls through the proxy in HTTP_PROXY, HTTPS_PROXY and NO_PROXY
+// with no limits.
+type PullOptions struct {
+	// Proxy replaces the proxy from the environment, e.g.
+	// http://proxy:3128 or socks5://proxy:1080.
+	Proxy string
+	// RateLimit caps the download bandwidth of the whole pull, in bytes per
+	// second; 0 leaves it unlimited.
+	RateLimit int64
+	// RegistryConcurrency caps the blob downloads running against one
+	// registry at once, across every converter on the host sharing LockDir;
+	// 0 leaves it unlimited.
+	RegistryConcurrency int
+	LockDir             string
+	// Retries is how often a request the registry still refuses with 429
+	// after the client's own Retry-After backoff is tried again. The client
+	// honors Retry-After for up to five attempts per request; these retries
+	// wait 30s, doubling up to 5m, on top of that.
+	Retries int
+}
+
+func normalizePullOptions(opts PullOptions) (PullOptions, error) {
+	opts.Proxy = strings.TrimSpace(opts.Proxy)
+	if opts.Proxy != "" {
+		proxy, err := url.Parse(opts.Proxy)
+		if err != nil || proxy.Scheme == "" || proxy.Host == "" {
+			return PullOptions{}, fmt.Errorf("invalid proxy %q: expected scheme://host:port", opts.Proxy)
+		}
+	}
+	if opts.RateLimit < 0 {
+		return PullOptions{}, fmt.Errorf("rate limit must be >= 0, got %d", opts.RateLimit)
+	}
+	if opts.RegistryConcurrency < 0 {
+		return PullOptions{}, fmt.Errorf("registry concurrency must be >= 0, got %d", opts.RegistryConcurrency)
+	}
+	if opts.Retries < 0 {
+		return PullOptions{}, fmt.Errorf("retries must be >= 0, got %d", opts.Retries)
+	}
+	if strings.TrimSpace(opts.LockDir) == "" {
+		opts.LockDir = defaultPullLockDir
+	}
+	return opts, nil
+}
+
+// puller applies PullOptions to the requests of one pull.
+type puller struct {
+	opts      PullOptions
+	registry  string
+	bandwidth *bandwidth
+	logger    *slog.Logger
+	// sleep is swapped out by tests.
+	sleep func(ctx context.Context, d time.Duration) error
+}
+
+func newPuller(opts PullOptions, registry string, logger *slog.Logger) *puller {
+	p := &puller{opts: opts, registry: registry, logger: logger, sleep: sleepContext}
+	if opts.RateLimit > 0 {
+		p.bandwidth = &bandwidth{rate: opts.RateLimit}
+	}
+	return p
+}
+
+func (p *puller) systemContext() *types.SystemContext {
+	sys := &types.SystemContext{}
+	if p.opts.Proxy != "" {
+		// Validated in normalizePullOptions.
+		sys.DockerProxyURL, _ = url.Parse(p.opts.Proxy)
+	}
+	return sys
+}
+
+// retry runs fn again while the registry refuses it with 429.
+func (p *puller) retry(ctx context.Context, what string, fn func() error) error {
+	delay := tooManyRequestsDelay
+	for attempt := 0; ; attempt++ {
+		err := fn()
+		if err == nil || !isTooManyRequests(err) || attempt >= p.opts.Retries {
+			return err
+		}
+		p.logger.Warn("registry rate limit hit, backing off", "registry", p.registry, "request", what, "attempt", attempt+1, "delay", delay)
+		if err := p.sleep(ctx, delay); err != nil {
+			return err
+		}
+		delay = min(delay*2, tooManyRequestsMaxDelay)
+	}
+}
+
+// acquireSlot takes one of the registry's download slots, waiting while all
+// of them are held by this or other converters.
+func (p *puller) acquireSlot(ctx context.Context) (func(), error) {
+	if p.opts.RegistryConcurrency <= 0 {
+		return func() {}, nil
+	}
+	name := strings.NewReplacer(":", "_", "/", "_").Replace(p.registry)
+	waited := false
+	for {
+		for slot := 0; slot < p.opts.RegistryConcurrency; slot++ {
+			path := filepath.Join(p.opts.LockDir, fmt.Sprintf("%s.%d.lock", name, slot))
+			held, err := lock.Acquire(path, "pull "+p.registry)
+			if errors.Is(err, lock.ErrAlreadyLocked) {
+				continue
+			}
+			if err != nil {
+				return nil, fmt.Errorf("take registry download slot: %w", err)
+			}
+			return func() { _ = held.Release() }, nil
+		}
+		if !waited {
+			p.logger.Info("registry download slots busy, waiting", "registry", p.registry, "slots", p.opts.RegistryConcurrency)
+			waited = true
+		}
+		if err := p.sleep(ctx, slotPollInterval); err != nil {
+			return nil, err
+		}
+	}
+}
+
+func (p *puller) reader(ctx context.Context, r io.Reader) io.Reader {
+	if p.bandwidth == nil {
+		return r
+	}
+	return &throttledReader{ctx: ctx, r: r, bandwidth: p.bandwidth}
+}
+
+// isTooManyRequests matches a 429 from a blob fetch and the
+// toomanyrequests error code registries such as Docker Hub return for
+// manifests.
+func isTooManyRequests(err error) bool {
+	return errors.Is(err, dockertransport.ErrTooManyRequests) || strings.Contains(strings.ToLower(err.Error()), "toomanyrequests")
+}
+
+// bandwidth paces reads to rate bytes per second, allowing a burst of one
+// second's worth.
+type bandwidth struct {
+	rate int64
+
+	mu sync.Mutex
+	// paid is when the bytes read so far have been paid for.
+	paid time.Time
+}
+
+// delay books n bytes and returns how long the reader has to wait first.
+func (b *bandwidth) delay(now time.Time, n int) time.Duration {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.paid.Before(now) {
+		b.paid = now
+	}
+	b.paid = b.paid.Add(time.Duration(int64(n) * int64(time.Second) / b.rate))
+	return b.paid.Sub(now) - time.Second
+}
+
+type throttledReader struct {
+	ctx       context.Context
+	r         io.Reader
+	bandwidth *bandwidth
+}
+
+func (t *throttledReader) Read(buf []byte) (int, error) {
+	if len(buf) > rateLimitChunk {
+		buf = buf[:rateLimitChunk]
+	}
+	n, err := t.r.Read(buf)
+	if n > 0 {
+		if wait := t.bandwidth.delay(time.Now(), n); wait > 0 {
+			if sleepErr := sleepContext(t.ctx, wait); sleepErr != nil {
+				return n, sleepErr
+			}
+		}
+	}
+	return n, err
+}
+
+func sleepContext(ctx context.Context, d time.Duration) error {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return nil
+	}
+}
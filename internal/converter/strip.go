@@ -0,0 +1,154 @@
+package converter
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// defaultStripPatterns are what Options.Strip removes: documentation, man
+// pages, locales and package manager caches a VM never reads. Patterns are
+// filepath.Match globs relative to the rootfs; they empty the directories
+// rather than delete them so packages installed later still find them.
+var defaultStripPatterns = []string{
+	"usr/share/doc/*",
+	"usr/share/man/*",
+	"usr/share/info/*",
+	"usr/share/locale/*",
+	"usr/share/lintian/*",
+	"var/cache/apt/*",
+	"var/lib/apt/lists/*",
+	"var/cache/apk/*",
+	"var/cache/dnf/*",
+	"var/cache/yum/*",
+}
+
+// StripReport says what stripping removed from the rootfs. BytesSaved
+// counts regular file sizes, so hard links are counted once per name.
+type StripReport struct {
+	Removed    int
+	BytesSaved int64
+}
+
+func (r *StripReport) add(other StripReport) {
+	r.Removed += other.Removed
+	r.BytesSaved += other.BytesSaved
+}
+
+// readPruneManifest reads one glob per line, in the form of
+// defaultStripPatterns. Blank lines and lines starting with # are skipped.
+func readPruneManifest(path string) ([]string, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("open prune manifest: %w", err)
+	}
+	defer file.Close()
+
+	var patterns []string
+	scanner := bufio.NewScanner(file)
+	for line := 1; scanner.Scan(); line++ {
+		pattern := strings.TrimSpace(scanner.Text())
+		if pattern == "" || strings.HasPrefix(pattern, "#") {
+			continue
+		}
+		if err := validatePrunePattern(pattern); err != nil {
+			return nil, fmt.Errorf("prune manifest %s line %d: %w", path, line, err)
+		}
+		patterns = append(patterns, strings.TrimPrefix(pattern, "/"))
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("read prune manifest: %w", err)
+	}
+	return patterns, nil
+}
+
+// validatePrunePattern keeps manifest globs inside the rootfs. A leading /
+// is allowed and means the rootfs root.
+func validatePrunePattern(pattern string) error {
+	rel := strings.TrimPrefix(pattern, "/")
+	if _, err := filepath.Match(rel, ""); err != nil {
+		return fmt.Errorf("invalid glob %q: %w", pattern, err)
+	}
+	clean := filepath.Clean(rel)
+	if clean == "." || clean == ".." || strings.HasPrefix(clean, "../") || clean != rel {
+		return fmt.Errorf("pattern %q must name paths below the rootfs root", pattern)
+	}
+	return nil
+}
+
+// stripRootFS removes every rootfs entry matching patterns. Matches reached
+// through a symlinked directory are skipped: image symlinks are absolute
+// and would resolve against the host here.
+func stripRootFS(rootfsDir string, patterns []string) (StripReport, error) {
+	var report StripReport
+	for _, pattern := range patterns {
+		matches, err := filepath.Glob(filepath.Join(rootfsDir, pattern))
+		if err != nil {
+			return report, fmt.Errorf("strip pattern %q: %w", pattern, err)
+		}
+		for _, match := range matches {
+			rel, err := filepath.Rel(rootfsDir, match)
+			if err != nil {
+				return report, err
+			}
+			inside, err := parentsInsideRootFS(rootfsDir, rel)
+			if err != nil {
+				return report, err
+			}
+			if !inside {
+				continue
+			}
+			size, err := entrySizeBytes(match)
+			if err != nil {
+				return report, err
+			}
+			if err := os.RemoveAll(match); err != nil {
+				return report, fmt.Errorf("strip %s: %w", rel, err)
+			}
+			report.Removed++
+			report.BytesSaved += size
+		}
+	}
+	return report, nil
+}
+
+// parentsInsideRootFS reports whether no directory on the way from
+// rootfsDir to rel is a symlink.
+func parentsInsideRootFS(rootfsDir, rel string) (bool, error) {
+	current := rootfsDir
+	parts := strings.Split(filepath.Dir(rel), string(filepath.Separator))
+	for _, part := range parts {
+		if part == "." {
+			continue
+		}
+		current = filepath.Join(current, part)
+		info, err := os.Lstat(current)
+		if err != nil {
+			return false, err
+		}
+		if info.Mode()&os.ModeSymlink != 0 {
+			return false, nil
+		}
+	}
+	return true, nil
+}
+
+func entrySizeBytes(path string) (int64, error) {
+	info, err := os.Lstat(path)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return 0, nil
+		}
+		return 0, err
+	}
+	if info.IsDir() {
+		return directorySizeBytes(path)
+	}
+	if info.Mode().IsRegular() {
+		return info.Size(), nil
+	}
+	return 0, nil
+}
@@ -0,0 +1,29 @@
+package converter
+
+import (
+	"errors"
+
+	"golang.org/x/sys/unix"
+)
+
+// getXattr returns the value of attr on path, not following symlinks, or
+// nil when it is not set.
+func getXattr(path, attr string) ([]byte, error) {
+	size, err := unix.Lgetxattr(path, attr, nil)
+	if errors.Is(err, unix.ENODATA) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	value := make([]byte, size)
+	size, err = unix.Lgetxattr(path, attr, value)
+	if err != nil {
+		return nil, err
+	}
+	return value[:size], nil
+}
+
+func setXattr(path, attr string, value []byte) error {
+	return unix.Lsetxattr(path, attr, value, 0)
+}
@@ -0,0 +1,15 @@
+//go:build !linux
+
+package converter
+
+import "errors"
+
+var errXattrUnsupported = errors.New("extended attributes are only supported on linux")
+
+func getXattr(string, string) ([]byte, error) {
+	return nil, errXattrUnsupported
+}
+
+func setXattr(string, string, []byte) error {
+	return errXattrUnsupported
+}
@@ -0,0 +1,196 @@
+// Package diagnostics checks that a host has what mergend and the mergen@
+// unit need to boot VMs, and says how to fix what is missing.
+package diagnostics
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/alperreha/mergen-fire/internal/model"
+)
+
+// helperScripts are the ExecStart* commands of deploy/systemd/mergen@.service.
+var helperScripts = []string{
+	"mergen-net-setup",
+	"mergen-jailer-start",
+	"mergen-configure-start",
+	"mergen-graceful-stop",
+	"mergen-net-cleanup",
+}
+
+var unitDirs = []string{"/etc/systemd/system", "/usr/lib/systemd/system", "/lib/systemd/system"}
+
+// Checker runs the host checks. Paths are resolved below root, so tests can
+// point it at a fake filesystem.
+type Checker struct {
+	unitPrefix string
+	scriptDir  string
+	root       string
+	lookPath   func(string) (string, error)
+}
+
+func NewChecker(unitPrefix string) *Checker {
+	if unitPrefix == "" {
+		unitPrefix = "mergen"
+	}
+	return &Checker{
+		unitPrefix: unitPrefix,
+		scriptDir:  "/usr/local/bin",
+		root:       "/",
+		lookPath:   exec.LookPath,
+	}
+}
+
+func (c *Checker) WithRoot(root string) *Checker {
+	c.root = root
+	return c
+}
+
+// WithLookPath replaces exec.LookPath for finding binaries.
+func (c *Checker) WithLookPath(lookPath func(string) (string, error)) *Checker {
+	if lookPath != nil {
+		c.lookPath = lookPath
+	}
+	return c
+}
+
+// Run executes every check. OK is false if any check failed.
+func (c *Checker) Run() model.HostDiagnostics {
+	checks := []model.DiagnosticCheck{
+		c.checkKVM(),
+		c.checkBinary("firecracker", model.DiagnosticFail, "install a Firecracker release binary into PATH, e.g. /usr/local/bin/firecracker, or set MGN_FIRECRACKER_BIN in the VM env"),
+		c.checkBinary("jailer", model.DiagnosticWarn, "install the jailer from the same Firecracker release to run VMs chrooted and with dropped privileges"),
+		c.checkBinary("ip", model.DiagnosticFail, "install iproute2; mergen-net-setup creates the netns and tap with it"),
+		c.checkBinary("curl", model.DiagnosticFail, "install curl; mergen-configure-start talks to the Firecracker API with it"),
+		c.checkBinary("jq", model.DiagnosticFail, "install jq; mergen-configure-start reads vm.json with it"),
+		c.checkUnitTemplate(),
+		c.checkHelperScripts(),
+		c.checkNFTables(),
+		c.checkIPForwarding(),
+		c.checkCgroupV2(),
+	}
+	report := model.HostDiagnostics{CheckedAt: time.Now().UTC(), OK: true, Checks: checks}
+	for _, check := range checks {
+		if check.Status == model.DiagnosticFail {
+			report.OK = false
+		}
+	}
+	return report
+}
+
+func (c *Checker) path(p string) string {
+	return filepath.Join(c.root, p)
+}
+
+func (c *Checker) checkKVM() model.DiagnosticCheck {
+	check := model.DiagnosticCheck{Name: "kvm"}
+	if _, err := os.Stat(c.path("/dev/kvm")); err != nil {
+		return fail(check, "/dev/kvm is missing", "enable virtualization in the BIOS or, on a cloud VM, nested virtualization; then load the module with `modprobe kvm_intel` or `modprobe kvm_amd`")
+	}
+	f, err := os.OpenFile(c.path("/dev/kvm"), os.O_RDWR, 0)
+	if err != nil {
+		return fail(check, fmt.Sprintf("/dev/kvm is not accessible: %v", err), "run mergend as root or add its user to the kvm group (`usermod -aG kvm <user>`)")
+	}
+	_ = f.Close()
+	return ok(check, "/dev/kvm is accessible")
+}
+
+func (c *Checker) checkBinary(name, severity, remediation string) model.DiagnosticCheck {
+	check := model.DiagnosticCheck{Name: name}
+	found, err := c.lookPath(name)
+	if err != nil {
+		check.Status = severity
+		check.Message = fmt.Sprintf("%s not found in PATH", name)
+		check.Remediation = remediation
+		return check
+	}
+	return ok(check, found)
+}
+
+func (c *Checker) checkUnitTemplate() model.DiagnosticCheck {
+	unit := c.unitPrefix + "@.service"
+	check := model.DiagnosticCheck{Name: "systemd-template"}
+	for _, dir := range unitDirs {
+		if _, err := os.Stat(c.path(filepath.Join(dir, unit))); err == nil {
+			return ok(check, filepath.Join(dir, unit))
+		}
+	}
+	return fail(check, unit+" is not installed",
+		fmt.Sprintf("install -D -m 0644 deploy/systemd/mergen@.service /etc/systemd/system/%s && systemctl daemon-reload", unit))
+}
+
+func (c *Checker) checkHelperScripts() model.DiagnosticCheck {
+	check := model.DiagnosticCheck{Name: "helper-scripts"}
+	var missing []string
+	for _, script := range helperScripts {
+		info, err := os.Stat(c.path(filepath.Join(c.scriptDir, script)))
+		if err != nil || info.Mode().Perm()&0o111 == 0 {
+			missing = append(missing, script)
+		}
+	}
+	if len(missing) > 0 {
+		return fail(check, "missing or not executable in "+c.scriptDir+": "+strings.Join(missing, ", "),
+			fmt.Sprintf("install -m 0755 scripts/<name> %s/<name> for each of them", c.scriptDir))
+	}
+	return ok(check, "all unit helpers installed in "+c.scriptDir)
+}
+
+func (c *Checker) checkNFTables() model.DiagnosticCheck {
+	check := model.DiagnosticCheck{Name: "nftables"}
+	if _, err := c.lookPath("nft"); err != nil {
+		return warn(check, "nft not found in PATH", "install nftables for the DNAT rules that publish host ports")
+	}
+	if _, err := os.Stat(c.path("/sys/module/nf_tables")); err != nil {
+		return warn(check, "nf_tables kernel module is not loaded", "load it with `modprobe nf_tables`")
+	}
+	return ok(check, "nft available and nf_tables loaded")
+}
+
+func (c *Checker) checkIPForwarding() model.DiagnosticCheck {
+	check := model.DiagnosticCheck{Name: "ip-forwarding"}
+	raw, err := os.ReadFile(c.path("/proc/sys/net/ipv4/ip_forward"))
+	if err != nil {
+		return fail(check, fmt.Sprintf("cannot read net.ipv4.ip_forward: %v", err), "check that /proc is mounted")
+	}
+	if strings.TrimSpace(string(raw)) != "1" {
+		return fail(check, "net.ipv4.ip_forward is 0, guests cannot reach or be reached through the host",
+			"sysctl -w net.ipv4.ip_forward=1 and persist it in /etc/sysctl.d/99-mergen.conf")
+	}
+	return ok(check, "net.ipv4.ip_forward=1")
+}
+
+func (c *Checker) checkCgroupV2() model.DiagnosticCheck {
+	check := model.DiagnosticCheck{Name: "cgroup-v2"}
+	raw, err := os.ReadFile(c.path("/sys/fs/cgroup/cgroup.controllers"))
+	if err != nil {
+		return fail(check, "/sys/fs/cgroup is not the unified cgroup v2 hierarchy",
+			"boot with systemd.unified_cgroup_hierarchy=1 (the default on current distributions)")
+	}
+	controllers := strings.Fields(string(raw))
+	for _, needed := range []string{"cpu", "memory"} {
+		if !slices.Contains(controllers, needed) {
+			return warn(check, "cgroup v2 without the "+needed+" controller", "enable it in the kernel and systemd so VM units can be limited")
+		}
+	}
+	return ok(check, "cgroup v2 with "+strings.Join(controllers, " "))
+}
+
+func ok(check model.DiagnosticCheck, message string) model.DiagnosticCheck {
+	check.Status, check.Message = model.DiagnosticOK, message
+	return check
+}
+
+func warn(check model.DiagnosticCheck, message, remediation string) model.DiagnosticCheck {
+	check.Status, check.Message, check.Remediation = model.DiagnosticWarn, message, remediation
+	return check
+}
+
+func fail(check model.DiagnosticCheck, message, remediation string) model.DiagnosticCheck {
+	check.Status, check.Message, check.Remediation = model.DiagnosticFail, message, remediation
+	return check
+}
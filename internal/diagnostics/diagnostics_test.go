@@ -0,0 +1,76 @@
+package diagnostics
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/alperreha/mergen-fire/internal/model"
+)
+
+func TestChecker_ReportsMissingPrerequisites(t *testing.T) {
+	root := t.TempDir()
+	write := func(path, content string, mode os.FileMode) {
+		t.Helper()
+		full := filepath.Join(root, path)
+		if err := os.MkdirAll(filepath.Dir(full), 0o755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(full, []byte(content), mode); err != nil {
+			t.Fatal(err)
+		}
+	}
+	write("/dev/kvm", "", 0o666)
+	write("/etc/systemd/system/mergen@.service", "[Unit]\n", 0o644)
+	for _, script := range helperScripts {
+		write(filepath.Join("/usr/local/bin", script), "#!/bin/sh\n", 0o755)
+	}
+	write("/proc/sys/net/ipv4/ip_forward", "0\n", 0o644)
+	write("/sys/fs/cgroup/cgroup.controllers", "cpuset cpu io memory pids\n", 0o644)
+
+	lookPath := func(name string) (string, error) {
+		if name == "jailer" || name == "nft" {
+			return "", errors.New("not found")
+		}
+		return "/usr/bin/" + name, nil
+	}
+	report := NewChecker("mergen").WithRoot(root).WithLookPath(lookPath).Run()
+
+	statuses := map[string]string{}
+	for _, check := range report.Checks {
+		statuses[check.Name] = check.Status
+		if check.Status != model.DiagnosticOK && check.Remediation == "" {
+			t.Errorf("%s: expected a remediation for %s", check.Name, check.Message)
+		}
+	}
+	want := map[string]string{
+		"kvm":              model.DiagnosticOK,
+		"firecracker":      model.DiagnosticOK,
+		"jailer":           model.DiagnosticWarn,
+		"systemd-template": model.DiagnosticOK,
+		"helper-scripts":   model.DiagnosticOK,
+		"nftables":         model.DiagnosticWarn,
+		"ip-forwarding":    model.DiagnosticFail,
+		"cgroup-v2":        model.DiagnosticOK,
+	}
+	for name, status := range want {
+		if statuses[name] != status {
+			t.Errorf("%s: expected %s, got %q", name, status, statuses[name])
+		}
+	}
+	if report.OK {
+		t.Fatal("expected report not ok with ip forwarding off")
+	}
+
+	write("/proc/sys/net/ipv4/ip_forward", "1\n", 0o644)
+	if err := os.Remove(filepath.Join(root, "/usr/local/bin/mergen-net-cleanup")); err != nil {
+		t.Fatal(err)
+	}
+	report = NewChecker("mergen").WithRoot(root).WithLookPath(lookPath).Run()
+	for _, check := range report.Checks {
+		if check.Name == "helper-scripts" && check.Status != model.DiagnosticFail {
+			t.Fatalf("expected missing helper reported, got %+v", check)
+		}
+	}
+}
@@ -0,0 +1,308 @@
+package etcd
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var ErrUnavailable = errors.New("etcd unavailable")
+
+// Client talks to etcd v3 through its JSON gRPC gateway (/v3/...), which every
+// etcd server exposes on the client port, so no gRPC dependency is needed.
+type Client struct {
+	endpoints []string
+	http      *http.Client
+	logger    *slog.Logger
+}
+
+type KeyValue struct {
+	Key            string
+	Value          []byte
+	CreateRevision int64
+	ModRevision    int64
+	Lease          int64
+}
+
+// Compare is one guard of a transaction. ModRevision 0 with Target "CREATE"
+// means "key does not exist".
+type Compare struct {
+	Key      string
+	Target   string
+	Revision int64
+}
+
+type Op struct {
+	Key      string
+	Value    []byte
+	Lease    int64
+	Delete   bool
+	RangeEnd string
+}
+
+func NewClient(endpoints []string, timeout time.Duration) *Client {
+	cleaned := make([]string, 0, len(endpoints))
+	for _, endpoint := range endpoints {
+		endpoint = strings.TrimRight(strings.TrimSpace(endpoint), "/")
+		if endpoint == "" {
+			continue
+		}
+		if !strings.Contains(endpoint, "://") {
+			endpoint = "http://" + endpoint
+		}
+		cleaned = append(cleaned, endpoint)
+	}
+	if timeout <= 0 {
+		timeout = 5 * time.Second
+	}
+	return &Client{
+		endpoints: cleaned,
+		http:      &http.Client{Timeout: timeout},
+		logger:    slog.Default(),
+	}
+}
+
+func (c *Client) WithLogger(logger *slog.Logger) *Client {
+	if logger != nil {
+		c.logger = logger
+	}
+	return c
+}
+
+func (c *Client) WithHTTPClient(client *http.Client) *Client {
+	if client != nil {
+		c.http = client
+	}
+	return c
+}
+
+// Get returns nil when the key does not exist.
+func (c *Client) Get(ctx context.Context, key string) (*KeyValue, error) {
+	kvs, _, err := c.rangeKeys(ctx, key, "")
+	if err != nil || len(kvs) == 0 {
+		return nil, err
+	}
+	return &kvs[0], nil
+}
+
+// Prefix returns every key starting with prefix and the store revision the
+// read was served at.
+func (c *Client) Prefix(ctx context.Context, prefix string) ([]KeyValue, int64, error) {
+	return c.rangeKeys(ctx, prefix, PrefixEnd(prefix))
+}
+
+func (c *Client) Put(ctx context.Context, key string, value []byte, lease int64) error {
+	return c.call(ctx, "/v3/kv/put", putRequest(key, value, lease), nil)
+}
+
+func (c *Client) DeletePrefix(ctx context.Context, prefix string) error {
+	return c.call(ctx, "/v3/kv/deleterange", map[string]string{
+		"key":       encodeKey(prefix),
+		"range_end": encodeKey(PrefixEnd(prefix)),
+	}, nil)
+}
+
+// Txn applies ops atomically when every compare holds.
+func (c *Client) Txn(ctx context.Context, compares []Compare, ops []Op) (bool, error) {
+	request := map[string]any{}
+	compareList := make([]map[string]any, 0, len(compares))
+	for _, cmp := range compares {
+		entry := map[string]any{
+			"key":    encodeKey(cmp.Key),
+			"target": cmp.Target,
+			"result": "EQUAL",
+		}
+		switch cmp.Target {
+		case "CREATE":
+			entry["create_revision"] = strconv.FormatInt(cmp.Revision, 10)
+		default:
+			entry["mod_revision"] = strconv.FormatInt(cmp.Revision, 10)
+		}
+		compareList = append(compareList, entry)
+	}
+	request["compare"] = compareList
+
+	success := make([]map[string]any, 0, len(ops))
+	for _, op := range ops {
+		if op.Delete {
+			del := map[string]string{"key": encodeKey(op.Key)}
+			if op.RangeEnd != "" {
+				del["range_end"] = encodeKey(op.RangeEnd)
+			}
+			success = append(success, map[string]any{"request_delete_range": del})
+			continue
+		}
+		success = append(success, map[string]any{"request_put": putRequest(op.Key, op.Value, op.Lease)})
+	}
+	request["success"] = success
+
+	var response struct {
+		Succeeded bool `json:"succeeded"`
+	}
+	if err := c.call(ctx, "/v3/kv/txn", request, &response); err != nil {
+		return false, err
+	}
+	return response.Succeeded, nil
+}
+
+func (c *Client) Grant(ctx context.Context, ttl time.Duration) (int64, error) {
+	var response struct {
+		ID int64String `json:"ID"`
+	}
+	seconds := int64(ttl / time.Second)
+	if seconds < 1 {
+		seconds = 1
+	}
+	if err := c.call(ctx, "/v3/lease/grant", map[string]string{"TTL": strconv.FormatInt(seconds, 10)}, &response); err != nil {
+		return 0, err
+	}
+	return int64(response.ID), nil
+}
+
+func (c *Client) KeepAlive(ctx context.Context, lease int64) error {
+	return c.call(ctx, "/v3/lease/keepalive", map[string]string{"ID": strconv.FormatInt(lease, 10)}, nil)
+}
+
+func (c *Client) Revoke(ctx context.Context, lease int64) error {
+	return c.call(ctx, "/v3/lease/revoke", map[string]string{"ID": strconv.FormatInt(lease, 10)}, nil)
+}
+
+func (c *Client) rangeKeys(ctx context.Context, key, rangeEnd string) ([]KeyValue, int64, error) {
+	request := map[string]string{"key": encodeKey(key)}
+	if rangeEnd != "" {
+		request["range_end"] = encodeKey(rangeEnd)
+	}
+	var response struct {
+		Header struct {
+			Revision int64String `json:"revision"`
+		} `json:"header"`
+		Kvs []struct {
+			Key            string      `json:"key"`
+			Value          string      `json:"value"`
+			CreateRevision int64String `json:"create_revision"`
+			ModRevision    int64String `json:"mod_revision"`
+			Lease          int64String `json:"lease"`
+		} `json:"kvs"`
+	}
+	if err := c.call(ctx, "/v3/kv/range", request, &response); err != nil {
+		return nil, 0, err
+	}
+
+	kvs := make([]KeyValue, 0, len(response.Kvs))
+	for _, raw := range response.Kvs {
+		decodedKey, err := base64.StdEncoding.DecodeString(raw.Key)
+		if err != nil {
+			return nil, 0, fmt.Errorf("decode etcd key: %w", err)
+		}
+		value, err := base64.StdEncoding.DecodeString(raw.Value)
+		if err != nil {
+			return nil, 0, fmt.Errorf("decode etcd value: %w", err)
+		}
+		kvs = append(kvs, KeyValue{
+			Key:            string(decodedKey),
+			Value:          value,
+			CreateRevision: int64(raw.CreateRevision),
+			ModRevision:    int64(raw.ModRevision),
+			Lease:          int64(raw.Lease),
+		})
+	}
+	return kvs, int64(response.Header.Revision), nil
+}
+
+// call tries each endpoint in order until one answers.
+func (c *Client) call(ctx context.Context, path string, request, response any) error {
+	if len(c.endpoints) == 0 {
+		return fmt.Errorf("%w: no endpoints configured", ErrUnavailable)
+	}
+	body, err := json.Marshal(request)
+	if err != nil {
+		return err
+	}
+
+	var lastErr error
+	for _, endpoint := range c.endpoints {
+		req, err := http.NewRequestWithContext(ctx, http.MethodPost, endpoint+path, bytes.NewReader(body))
+		if err != nil {
+			return err
+		}
+		req.Header.Set("Content-Type", "application/json")
+
+		resp, err := c.http.Do(req)
+		if err != nil {
+			lastErr = err
+			c.logger.Debug("etcd endpoint failed", "endpoint", endpoint, "path", path, "error", err)
+			continue
+		}
+		content, readErr := io.ReadAll(io.LimitReader(resp.Body, 16<<20))
+		_ = resp.Body.Close()
+		if readErr != nil {
+			lastErr = readErr
+			continue
+		}
+		if resp.StatusCode >= 500 {
+			lastErr = fmt.Errorf("%s: status %d: %s", path, resp.StatusCode, strings.TrimSpace(string(content)))
+			continue
+		}
+		if resp.StatusCode >= 300 {
+			return fmt.Errorf("etcd %s: status %d: %s", path, resp.StatusCode, strings.TrimSpace(string(content)))
+		}
+		if response == nil {
+			return nil
+		}
+		return json.Unmarshal(content, response)
+	}
+	return fmt.Errorf("%w: %v", ErrUnavailable, lastErr)
+}
+
+func putRequest(key string, value []byte, lease int64) map[string]string {
+	request := map[string]string{
+		"key":   encodeKey(key),
+		"value": base64.StdEncoding.EncodeToString(value),
+	}
+	if lease != 0 {
+		request["lease"] = strconv.FormatInt(lease, 10)
+	}
+	return request
+}
+
+func encodeKey(key string) string {
+	return base64.StdEncoding.EncodeToString([]byte(key))
+}
+
+// PrefixEnd is the range_end that selects every key with the given prefix.
+func PrefixEnd(prefix string) string {
+	end := []byte(prefix)
+	for i := len(end) - 1; i >= 0; i-- {
+		if end[i] < 0xff {
+			end[i]++
+			return string(end[:i+1])
+		}
+	}
+	return "\x00"
+}
+
+// int64String decodes the gateway's int64 fields, which are JSON strings.
+type int64String int64
+
+func (v *int64String) UnmarshalJSON(data []byte) error {
+	text := strings.Trim(string(data), `"`)
+	if text == "" || text == "null" {
+		*v = 0
+		return nil
+	}
+	parsed, err := strconv.ParseInt(text, 10, 64)
+	if err != nil {
+		return err
+	}
+	*v = int64String(parsed)
+	return nil
+}
@@ -0,0 +1,240 @@
+// Package etcdtest provides an in-memory stand-in for the etcd v3 JSON
+// gateway, covering the calls made by etcd.Client.
+package etcdtest
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strconv"
+	"sync"
+)
+
+type entry struct {
+	value  []byte
+	create int64
+	mod    int64
+	lease  int64
+}
+
+type Server struct {
+	*httptest.Server
+
+	mu        sync.Mutex
+	revision  int64
+	nextLease int64
+	kvs       map[string]entry
+	leases    map[int64]bool
+}
+
+func NewServer() *Server {
+	s := &Server{kvs: map[string]entry{}, leases: map[int64]bool{}}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/v3/kv/range", s.handleRange)
+	mux.HandleFunc("/v3/kv/put", s.handlePut)
+	mux.HandleFunc("/v3/kv/deleterange", s.handleDelete)
+	mux.HandleFunc("/v3/kv/txn", s.handleTxn)
+	mux.HandleFunc("/v3/lease/grant", s.handleGrant)
+	mux.HandleFunc("/v3/lease/keepalive", func(w http.ResponseWriter, r *http.Request) { writeJSON(w, map[string]any{}) })
+	mux.HandleFunc("/v3/lease/revoke", s.handleRevoke)
+	s.Server = httptest.NewServer(mux)
+	return s
+}
+
+type rangeRequest struct {
+	Key      string `json:"key"`
+	RangeEnd string `json:"range_end"`
+}
+
+type putRequest struct {
+	Key   string `json:"key"`
+	Value string `json:"value"`
+	Lease string `json:"lease"`
+}
+
+type compare struct {
+	Key            string `json:"key"`
+	Target         string `json:"target"`
+	CreateRevision string `json:"create_revision"`
+	ModRevision    string `json:"mod_revision"`
+}
+
+type txnRequest struct {
+	Compare []compare `json:"compare"`
+	Success []struct {
+		RequestPut         *putRequest   `json:"request_put"`
+		RequestDeleteRange *rangeRequest `json:"request_delete_range"`
+	} `json:"success"`
+}
+
+func (s *Server) handleRange(w http.ResponseWriter, r *http.Request) {
+	var req rangeRequest
+	if !decode(w, r, &req) {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	keys := s.match(req)
+	kvs := make([]map[string]string, 0, len(keys))
+	for _, key := range keys {
+		e := s.kvs[key]
+		kvs = append(kvs, map[string]string{
+			"key":             base64.StdEncoding.EncodeToString([]byte(key)),
+			"value":           base64.StdEncoding.EncodeToString(e.value),
+			"create_revision": strconv.FormatInt(e.create, 10),
+			"mod_revision":    strconv.FormatInt(e.mod, 10),
+			"lease":           strconv.FormatInt(e.lease, 10),
+		})
+	}
+	writeJSON(w, map[string]any{
+		"header": map[string]string{"revision": strconv.FormatInt(s.revision, 10)},
+		"kvs":    kvs,
+	})
+}
+
+func (s *Server) handlePut(w http.ResponseWriter, r *http.Request) {
+	var req putRequest
+	if !decode(w, r, &req) {
+		return
+	}
+	s.mu.Lock()
+	s.put(req)
+	s.mu.Unlock()
+	writeJSON(w, map[string]any{})
+}
+
+func (s *Server) handleDelete(w http.ResponseWriter, r *http.Request) {
+	var req rangeRequest
+	if !decode(w, r, &req) {
+		return
+	}
+	s.mu.Lock()
+	s.delete(req)
+	s.mu.Unlock()
+	writeJSON(w, map[string]any{})
+}
+
+func (s *Server) handleTxn(w http.ResponseWriter, r *http.Request) {
+	var req txnRequest
+	if !decode(w, r, &req) {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, cmp := range req.Compare {
+		key := decodeString(cmp.Key)
+		e := s.kvs[key]
+		switch cmp.Target {
+		case "CREATE":
+			want, _ := strconv.ParseInt(cmp.CreateRevision, 10, 64)
+			if e.create != want {
+				writeJSON(w, map[string]any{"succeeded": false})
+				return
+			}
+		default:
+			want, _ := strconv.ParseInt(cmp.ModRevision, 10, 64)
+			if e.mod != want {
+				writeJSON(w, map[string]any{"succeeded": false})
+				return
+			}
+		}
+	}
+	for _, op := range req.Success {
+		switch {
+		case op.RequestPut != nil:
+			s.put(*op.RequestPut)
+		case op.RequestDeleteRange != nil:
+			s.delete(*op.RequestDeleteRange)
+		}
+	}
+	writeJSON(w, map[string]any{"succeeded": true})
+}
+
+func (s *Server) handleGrant(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	s.nextLease++
+	id := s.nextLease
+	s.leases[id] = true
+	s.mu.Unlock()
+	writeJSON(w, map[string]string{"ID": strconv.FormatInt(id, 10)})
+}
+
+func (s *Server) handleRevoke(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		ID string `json:"ID"`
+	}
+	if !decode(w, r, &req) {
+		return
+	}
+	id, _ := strconv.ParseInt(req.ID, 10, 64)
+	s.mu.Lock()
+	delete(s.leases, id)
+	for key, e := range s.kvs {
+		if e.lease == id {
+			delete(s.kvs, key)
+			s.revision++
+		}
+	}
+	s.mu.Unlock()
+	writeJSON(w, map[string]any{})
+}
+
+func (s *Server) put(req putRequest) {
+	key := decodeString(req.Key)
+	value, _ := base64.StdEncoding.DecodeString(req.Value)
+	lease, _ := strconv.ParseInt(req.Lease, 10, 64)
+	s.revision++
+	e, ok := s.kvs[key]
+	if !ok {
+		e.create = s.revision
+	}
+	e.value = value
+	e.mod = s.revision
+	e.lease = lease
+	s.kvs[key] = e
+}
+
+func (s *Server) delete(req rangeRequest) {
+	keys := s.match(req)
+	if len(keys) > 0 {
+		s.revision++
+	}
+	for _, key := range keys {
+		delete(s.kvs, key)
+	}
+}
+
+func (s *Server) match(req rangeRequest) []string {
+	key := decodeString(req.Key)
+	end := decodeString(req.RangeEnd)
+	var keys []string
+	for candidate := range s.kvs {
+		if end == "" && candidate == key || end != "" && candidate >= key && candidate < end {
+			keys = append(keys, candidate)
+		}
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func decode(w http.ResponseWriter, r *http.Request, out any) bool {
+	if err := json.NewDecoder(r.Body).Decode(out); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return false
+	}
+	return true
+}
+
+func decodeString(encoded string) string {
+	decoded, _ := base64.StdEncoding.DecodeString(encoded)
+	return string(decoded)
+}
+
+func writeJSON(w http.ResponseWriter, payload any) {
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(payload)
+}
@@ -0,0 +1,250 @@
+package firecracker
+
+import (
+	"errors"
+	"fmt"
+	"path"
+	"slices"
+	"sort"
+	"strings"
+
+	"github.com/alperreha/mergen-fire/internal/model"
+)
+
+// maxBootArgsLen is the x86 kernel's COMMAND_LINE_SIZE; longer command lines
+// are truncated by the guest without a word.
+const maxBootArgsLen = 2048
+
+// singleBootArgs are parameters the kernel (or its init) reads once, so a
+// second occurrence is a mistake rather than an override.
+var singleBootArgs = map[string]bool{
+	"ip":         true,
+	"root":       true,
+	"rootfstype": true,
+	"init":       true,
+}
+
+// BuildBootArgs merges opts into raw (or the default boot args when raw is
+// empty) and appends the ip= argument for guestIP unless one is present.
+// Fields in opts replace the matching default but conflict with a different
+// value given explicitly in raw.
+func BuildBootArgs(raw string, opts *model.BootOptions, guestIP string) (string, error) {
+	return buildBootArgs(defaultBootArgs, raw, opts, guestIP)
+}
+
+func buildBootArgs(defaults, raw string, opts *model.BootOptions, guestIP string) (string, error) {
+	explicit := strings.TrimSpace(raw) != ""
+	base := defaults
+	if explicit {
+		base = raw
+	}
+	params, initArgs := splitBootArgs(base)
+	if err := checkSingleBootArgs(params); err != nil {
+		return "", fmt.Errorf("bootArgs: %w", err)
+	}
+
+	structured, err := bootOptionArgs(opts)
+	if err != nil {
+		return "", err
+	}
+	for _, arg := range structured {
+		key, value := bootArgKey(arg)
+		existing := bootArgValues(params, key)
+		switch {
+		case len(existing) == 0:
+			params = append(params, arg)
+		case len(existing) == 1 && existing[0] == value:
+		case explicit:
+			return "", fmt.Errorf("boot: %s conflicts with %s=%s in bootArgs", arg, key, existing[0])
+		default:
+			params = append(withoutBootArg(params, key), arg)
+		}
+	}
+
+	if len(bootArgValues(params, "ip")) == 0 {
+		if kernelIPArg, ok := buildKernelIPArg(guestIP); ok {
+			params = append(params, kernelIPArg)
+		}
+	}
+
+	bootArgs := strings.Join(params, " ")
+	if len(initArgs) > 0 {
+		bootArgs += " -- " + strings.Join(initArgs, " ")
+	}
+	if len(bootArgs) > maxBootArgsLen {
+		return "", fmt.Errorf("boot args are %d bytes, the kernel accepts at most %d", len(bootArgs), maxBootArgsLen)
+	}
+	return bootArgs, nil
+}
+
+// ReplaceBootArgs swaps the command line of a rendered config for raw while
+// keeping what mergen put there for the VM: the ip= argument and the
+// mergen.* arguments its guest init reads are carried over from current
+// unless raw sets them, and Cloud Hypervisor VMs get their root= back.
+func ReplaceBootArgs(current, raw string, meta model.VMMetadata) (string, error) {
+	params, initArgs := splitBootArgs(raw)
+	if len(params) == 0 {
+		return "", errors.New("bootArgs: no kernel parameters given")
+	}
+	if err := checkSingleBootArgs(params); err != nil {
+		return "", fmt.Errorf("bootArgs: %w", err)
+	}
+	kept, _ := splitBootArgs(current)
+	for _, arg := range kept {
+		key, _ := bootArgKey(arg)
+		if key != "ip" && !strings.HasPrefix(key, "mergen.") {
+			continue
+		}
+		if len(bootArgValues(params, key)) == 0 {
+			params = append(params, arg)
+		}
+	}
+	bootArgs := strings.Join(params, " ")
+	if len(initArgs) > 0 {
+		bootArgs += " -- " + strings.Join(initArgs, " ")
+	}
+	if meta.Hypervisor == model.HypervisorCloudHypervisor {
+		return withRootDevice(bootArgs, meta.RootReadOnly)
+	}
+	if len(bootArgs) > maxBootArgsLen {
+		return "", fmt.Errorf("boot args are %d bytes, the kernel accepts at most %d", len(bootArgs), maxBootArgsLen)
+	}
+	return bootArgs, nil
+}
+
+// WithoutGuestIP drops the ip= argument from bootArgs, so rendering them
+// again for another guest IP adds the new one.
+func WithoutGuestIP(bootArgs string) string {
+	params, initArgs := splitBootArgs(bootArgs)
+	out := strings.Join(withoutBootArg(params, "ip"), " ")
+	if len(initArgs) > 0 {
+		out += " -- " + strings.Join(initArgs, " ")
+	}
+	return out
+}
+
+func bootOptionArgs(opts *model.BootOptions) ([]string, error) {
+	if opts == nil {
+		return nil, nil
+	}
+	var args []string
+	if opts.Console != "" {
+		if err := checkBootArgValue(opts.Console); err != nil {
+			return nil, fmt.Errorf("boot.console: %w", err)
+		}
+		args = append(args, "console="+opts.Console)
+	}
+	if opts.Init != "" {
+		if !path.IsAbs(opts.Init) {
+			return nil, errors.New("boot.init: must be an absolute path")
+		}
+		if err := checkBootArgValue(opts.Init); err != nil {
+			return nil, fmt.Errorf("boot.init: %w", err)
+		}
+		args = append(args, "init="+opts.Init)
+	}
+	keys := make([]string, 0, len(opts.Extra))
+	for key := range opts.Extra {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		if key == "" || key == "--" || strings.ContainsAny(key, "= \t\n\"") {
+			return nil, fmt.Errorf("boot.extra: invalid parameter name %q", key)
+		}
+		if key == "console" || key == "init" {
+			return nil, fmt.Errorf("boot.extra: set %s with boot.%s", key, key)
+		}
+		value := opts.Extra[key]
+		if value == "" {
+			args = append(args, key)
+			continue
+		}
+		if err := checkBootArgValue(value); err != nil {
+			return nil, fmt.Errorf("boot.extra.%s: %w", key, err)
+		}
+		args = append(args, key+"="+value)
+	}
+	return args, nil
+}
+
+func checkBootArgValue(value string) error {
+	if strings.ContainsAny(value, " \t\n\"") {
+		return errors.New("must not contain whitespace or quotes")
+	}
+	return nil
+}
+
+func checkSingleBootArgs(params []string) error {
+	seen := map[string]bool{}
+	for _, arg := range params {
+		key, _ := bootArgKey(arg)
+		if !singleBootArgs[key] {
+			continue
+		}
+		if seen[key] {
+			return fmt.Errorf("%s= given more than once", key)
+		}
+		seen[key] = true
+	}
+	return nil
+}
+
+// withRootDevice adds root= for the first virtio disk, and rw or ro, unless
+// bootArgs names a root already. Firecracker derives them from the root
+// drive; Cloud Hypervisor leaves them to the command line.
+func withRootDevice(bootArgs string, readOnly bool) (string, error) {
+	params, initArgs := splitBootArgs(bootArgs)
+	if len(bootArgValues(params, "root")) > 0 {
+		return bootArgs, nil
+	}
+	params = append(params, "root="+rootDiskDevice)
+	if !slices.Contains(params, "ro") && !slices.Contains(params, "rw") {
+		params = append(params, map[bool]string{true: "ro", false: "rw"}[readOnly])
+	}
+	out := strings.Join(params, " ")
+	if len(initArgs) > 0 {
+		out += " -- " + strings.Join(initArgs, " ")
+	}
+	if len(out) > maxBootArgsLen {
+		return "", fmt.Errorf("boot args are %d bytes, the kernel accepts at most %d", len(out), maxBootArgsLen)
+	}
+	return out, nil
+}
+
+// splitBootArgs separates kernel parameters from the arguments after "--",
+// which the kernel passes to init untouched.
+func splitBootArgs(bootArgs string) ([]string, []string) {
+	fields := strings.Fields(bootArgs)
+	for i, field := range fields {
+		if field == "--" {
+			return fields[:i:i], fields[i+1:]
+		}
+	}
+	return fields, nil
+}
+
+func bootArgKey(arg string) (string, string) {
+	key, value, _ := strings.Cut(arg, "=")
+	return key, value
+}
+
+func bootArgValues(params []string, key string) []string {
+	var values []string
+	for _, arg := range params {
+		if k, v := bootArgKey(arg); k == key {
+			values = append(values, v)
+		}
+	}
+	return values
+}
+
+func withoutBootArg(params []string, key string) []string {
+	kept := make([]string, 0, len(params))
+	for _, arg := range params {
+		if k, _ := bootArgKey(arg); k != key {
+			kept = append(kept, arg)
+		}
+	}
+	return kept
+}
@@ -1,6 +1,7 @@
 package firecracker
 
 import (
+	"errors"
 	"fmt"
 	"net/netip"
 	"strings"
@@ -10,35 +11,82 @@ import (
 )
 
 const defaultBootArgs = "console=ttyS0 reboot=k panic=1 pci=off"
+
+// cloudHypervisorBootArgs drops pci=off: Cloud Hypervisor attaches its
+// virtio devices over PCI.
+const (
+	cloudHypervisorBootArgs = "console=ttyS0 reboot=k panic=1"
+	rootDiskDevice          = "/dev/vda"
+)
+
+// Drive IDs of the rendered config. The root drive is attached first and the
+// data disk second, so the guest sees them as /dev/vda and /dev/vdb.
+const (
+	RootDriveID = "rootfs"
+	DataDriveID = "data"
+
+	// OverlayBootArg tells mergen-init-snapshot to mount an overlay over a
+	// read-only root. Its value is the block device holding upper/ and work/,
+	// or "tmpfs" to keep writes in memory.
+	OverlayBootArg    = "mergen.overlay"
+	overlayDataDevice = "/dev/vdb"
+	overlayTmpfs      = "tmpfs"
+
+	// GrowRootBootArg tells mergen-init-snapshot to grow the root filesystem
+	// to the size of its drive.
+	GrowRootBootArg = "mergen.growroot"
+)
+
 const (
 	defaultGuestMask   = "255.255.255.0"
 	defaultGuestIfName = "eth0"
 )
 
-func RenderVMConfig(req model.CreateVMRequest, meta model.VMMetadata) model.VMConfig {
-	bootArgs := resolvedBootArgs(req.BootArgs, meta.GuestIP)
+// RenderVMConfig builds the VM config for req; it fails only on invalid or
+// conflicting boot args. The config uses Firecracker's schema whatever the
+// hypervisor, and is translated when a VM runs under another one, but the
+// boot args are rendered for meta.Hypervisor.
+func RenderVMConfig(req model.CreateVMRequest, meta model.VMMetadata) (model.VMConfig, error) {
+	defaults := defaultBootArgs
+	if meta.Hypervisor == model.HypervisorCloudHypervisor {
+		defaults = cloudHypervisorBootArgs
+	}
+	bootArgs, err := buildBootArgs(defaults, req.BootArgs, BootOptionsFor(req), meta.GuestIP)
+	if err != nil {
+		return model.VMConfig{}, err
+	}
+	if meta.Hypervisor == model.HypervisorCloudHypervisor {
+		if bootArgs, err = withRootDevice(bootArgs, req.RootReadOnly); err != nil {
+			return model.VMConfig{}, err
+		}
+	}
 
+	rootID := req.RootDevice
+	if rootID == "" {
+		rootID = RootDriveID
+	}
 	drives := []model.Drive{
 		{
-			DriveID:      "rootfs",
+			DriveID:      rootID,
 			PathOnHost:   req.RootFS,
 			IsRootDevice: true,
-			IsReadOnly:   false,
+			IsReadOnly:   req.RootReadOnly,
 		},
 	}
 
 	if strings.TrimSpace(req.DataDisk) != "" {
 		drives = append(drives, model.Drive{
-			DriveID:      "data",
+			DriveID:      DataDriveID,
 			PathOnHost:   req.DataDisk,
 			IsRootDevice: false,
 			IsReadOnly:   false,
 		})
 	}
 
-	return model.VMConfig{
+	cfg := model.VMConfig{
 		BootSource: model.BootSource{
 			KernelImagePath: req.Kernel,
+			InitrdPath:      req.Initrd,
 			BootArgs:        bootArgs,
 		},
 		Drives: drives,
@@ -51,34 +99,46 @@ func RenderVMConfig(req model.CreateVMRequest, meta model.VMMetadata) model.VMCo
 			{
 				IfaceID:     "eth0",
 				HostDevName: meta.TapName,
-				GuestMAC:    network.GuestMAC(meta.ID),
+				GuestMAC:    network.MACOf(meta),
 			},
 		},
 	}
-}
-
-func resolvedBootArgs(requested, guestIP string) string {
-	bootArgs := strings.TrimSpace(requested)
-	if bootArgs == "" {
-		bootArgs = defaultBootArgs
+	if meta.Paths.RunDir != "" {
+		cfg.Vsock = vsockDevice(meta.Paths.RunDir)
+		cfg.Console = consoleDevice(meta.Paths)
+		if meta.Hypervisor != model.HypervisorCloudHypervisor {
+			cfg.Metrics = metricsDevice(meta.Paths.RunDir)
+		}
 	}
-
-	if !hasKernelArgWithPrefix(bootArgs, "ip=") {
-		if kernelIPArg, ok := buildKernelIPArg(guestIP); ok {
-			bootArgs += " " + kernelIPArg
+	if len(req.GuestEnv) > 0 && req.GuestEnvVia == GuestEnvMMDS {
+		cfg.MMDSConfig, cfg.MMDS = guestEnvMMDS(req.GuestEnv)
+	}
+	if len(req.SharedDirs) > 0 {
+		if meta.Paths.RunDir == "" {
+			return model.VMConfig{}, errors.New("sharedDirs need the vm's run dir for virtiofsd sockets")
 		}
+		cfg.FS = fsDevices(req.SharedDirs, meta.Paths.RunDir)
 	}
-
-	return strings.Join(strings.Fields(bootArgs), " ")
+	if len(meta.Devices) > 0 {
+		cfg.Devices = pciDevices(meta.Devices)
+	}
+	return cfg, nil
 }
 
-func hasKernelArgWithPrefix(bootArgs, prefix string) bool {
-	for _, arg := range strings.Fields(bootArgs) {
-		if strings.HasPrefix(arg, prefix) {
-			return true
+// withBootExtra returns a copy of boot with key=value added unless the
+// caller set key already.
+func withBootExtra(boot *model.BootOptions, key, value string) *model.BootOptions {
+	out := model.BootOptions{Extra: map[string]string{}}
+	if boot != nil {
+		out.Console, out.Init = boot.Console, boot.Init
+		for k, v := range boot.Extra {
+			out.Extra[k] = v
 		}
 	}
-	return false
+	if _, ok := out.Extra[key]; !ok {
+		out.Extra[key] = value
+	}
+	return &out
 }
 
 func buildKernelIPArg(guestIP string) (string, bool) {
@@ -1,6 +1,7 @@
 package firecracker
 
 import (
+	"strings"
 	"testing"
 
 	"github.com/alperreha/mergen-fire/internal/model"
@@ -19,7 +20,10 @@ func TestRenderVMConfig_Defaults(t *testing.T) {
 		GuestIP: "172.30.0.2",
 	}
 
-	cfg := RenderVMConfig(req, meta)
+	cfg, err := RenderVMConfig(req, meta)
+	if err != nil {
+		t.Fatalf("render: %v", err)
+	}
 	expectedBootArgs := "console=ttyS0 reboot=k panic=1 pci=off ip=172.30.0.2::172.30.0.1:255.255.255.0::eth0:off"
 	if cfg.BootSource.BootArgs != expectedBootArgs {
 		t.Fatalf("unexpected boot args: %q", cfg.BootSource.BootArgs)
@@ -55,7 +59,10 @@ func TestRenderVMConfig_DoesNotDuplicateExistingBootArgs(t *testing.T) {
 		GuestIP: "172.30.0.2",
 	}
 
-	cfg := RenderVMConfig(req, meta)
+	cfg, err := RenderVMConfig(req, meta)
+	if err != nil {
+		t.Fatalf("render: %v", err)
+	}
 	expectedBootArgs := "console=ttyS0 init=/init ip=10.0.0.2::10.0.0.1:255.255.255.0::eth0:off"
 	if cfg.BootSource.BootArgs != expectedBootArgs {
 		t.Fatalf("unexpected boot args: %q", cfg.BootSource.BootArgs)
@@ -74,8 +81,338 @@ func TestRenderVMConfig_NoGuestIPKeepsDefaultBootArgs(t *testing.T) {
 		TapName: "tap-6f008233",
 	}
 
-	cfg := RenderVMConfig(req, meta)
+	cfg, err := RenderVMConfig(req, meta)
+	if err != nil {
+		t.Fatalf("render: %v", err)
+	}
 	if cfg.BootSource.BootArgs != defaultBootArgs {
 		t.Fatalf("unexpected boot args: %q", cfg.BootSource.BootArgs)
 	}
 }
+
+func TestBuildBootArgs_StructuredFields(t *testing.T) {
+	cases := []struct {
+		name    string
+		raw     string
+		opts    *model.BootOptions
+		want    string
+		wantErr string
+	}{
+		{
+			name: "fields replace defaults",
+			opts: &model.BootOptions{Console: "ttyS1", Init: "/sbin/init", Extra: map[string]string{"quiet": "", "mergen.meta": "/etc/mergen/image-meta.json"}},
+			want: "reboot=k panic=1 pci=off console=ttyS1 init=/sbin/init mergen.meta=/etc/mergen/image-meta.json quiet ip=172.30.0.2::172.30.0.1:255.255.255.0::eth0:off",
+		},
+		{
+			name: "fields merge into raw override before init args",
+			raw:  "console=ttyS0 root=/dev/vda -- --verbose",
+			opts: &model.BootOptions{Init: "/init", Extra: map[string]string{"root": "/dev/vda"}},
+			want: "console=ttyS0 root=/dev/vda init=/init ip=172.30.0.2::172.30.0.1:255.255.255.0::eth0:off -- --verbose",
+		},
+		{
+			name:    "field conflicts with raw",
+			raw:     "console=ttyS0 init=/init",
+			opts:    &model.BootOptions{Init: "/sbin/init"},
+			wantErr: "conflicts with init=/init",
+		},
+		{
+			name:    "duplicate ip in raw",
+			raw:     "ip=10.0.0.2::10.0.0.1:255.255.255.0::eth0:off ip=dhcp",
+			wantErr: "ip= given more than once",
+		},
+		{
+			name:    "duplicate root in raw",
+			raw:     "root=/dev/vda root=/dev/vdb",
+			wantErr: "root= given more than once",
+		},
+		{
+			name:    "relative init",
+			opts:    &model.BootOptions{Init: "init"},
+			wantErr: "absolute path",
+		},
+		{
+			name:    "whitespace in value",
+			opts:    &model.BootOptions{Extra: map[string]string{"mergen.env": "a b"}},
+			wantErr: "whitespace",
+		},
+		{
+			name:    "console through extra",
+			opts:    &model.BootOptions{Extra: map[string]string{"console": "ttyS1"}},
+			wantErr: "boot.console",
+		},
+		{
+			name:    "too long",
+			raw:     "x=" + strings.Repeat("a", maxBootArgsLen),
+			wantErr: "at most",
+		},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			got, err := BuildBootArgs(tc.raw, tc.opts, "172.30.0.2")
+			if tc.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tc.wantErr) {
+					t.Fatalf("expected error containing %q, got %q, %v", tc.wantErr, got, err)
+				}
+				return
+			}
+			if err != nil || got != tc.want {
+				t.Fatalf("unexpected boot args:\n got %q (%v)\nwant %q", got, err, tc.want)
+			}
+		})
+	}
+}
+
+func TestReplaceBootArgs(t *testing.T) {
+	current := "console=ttyS0 reboot=k panic=1 pci=off mergen.overlay=tmpfs ip=172.30.0.2::172.30.0.1:255.255.255.0::eth0:off -- --old"
+	cases := []struct {
+		name    string
+		raw     string
+		meta    model.VMMetadata
+		want    string
+		wantErr string
+	}{
+		{
+			name: "keeps mergen arguments",
+			raw:  "console=ttyS1 quiet -- --verbose",
+			want: "console=ttyS1 quiet mergen.overlay=tmpfs ip=172.30.0.2::172.30.0.1:255.255.255.0::eth0:off -- --verbose",
+		},
+		{
+			name: "raw ip wins",
+			raw:  "console=ttyS0 ip=dhcp mergen.overlay=/dev/vdb",
+			want: "console=ttyS0 ip=dhcp mergen.overlay=/dev/vdb",
+		},
+		{
+			name: "cloud hypervisor root",
+			raw:  "console=ttyS0",
+			meta: model.VMMetadata{Hypervisor: model.HypervisorCloudHypervisor, RootReadOnly: true},
+			want: "console=ttyS0 mergen.overlay=tmpfs ip=172.30.0.2::172.30.0.1:255.255.255.0::eth0:off root=/dev/vda ro",
+		},
+		{
+			name:    "only init args",
+			raw:     "-- --verbose",
+			wantErr: "no kernel parameters",
+		},
+		{
+			name:    "duplicate init",
+			raw:     "init=/a init=/b",
+			wantErr: "init= given more than once",
+		},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			got, err := ReplaceBootArgs(current, tc.raw, tc.meta)
+			if tc.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tc.wantErr) {
+					t.Fatalf("expected error containing %q, got %q, %v", tc.wantErr, got, err)
+				}
+				return
+			}
+			if err != nil || got != tc.want {
+				t.Fatalf("unexpected boot args:\n got %q (%v)\nwant %q", got, err, tc.want)
+			}
+		})
+	}
+}
+
+func TestRenderVMConfig_ReadOnlyRoot(t *testing.T) {
+	meta := model.VMMetadata{ID: "6f008233-68f7-47b8-b2d1-6a9f0632b30b", TapName: "tap-6f008233"}
+	req := model.CreateVMRequest{
+		RootFS:       "/var/lib/mergen/images/app.ext4",
+		Kernel:       "/var/lib/mergen/vmlinux",
+		DataDisk:     "/var/lib/mergen/vm1/data.ext4",
+		RootReadOnly: true,
+		RootDevice:   "app",
+	}
+	cfg, err := RenderVMConfig(req, meta)
+	if err != nil {
+		t.Fatalf("render: %v", err)
+	}
+	if root := cfg.Drives[0]; root.DriveID != "app" || !root.IsRootDevice || !root.IsReadOnly {
+		t.Fatalf("expected read-only root drive named app, got %+v", root)
+	}
+	if data := cfg.Drives[1]; data.DriveID != DataDriveID || data.IsReadOnly {
+		t.Fatalf("expected writable data drive, got %+v", data)
+	}
+	if !strings.HasSuffix(cfg.BootSource.BootArgs, " mergen.overlay=/dev/vdb") {
+		t.Fatalf("expected overlay on the data disk, got %q", cfg.BootSource.BootArgs)
+	}
+
+	req.DataDisk = ""
+	cfg, err = RenderVMConfig(req, meta)
+	if err != nil || !strings.HasSuffix(cfg.BootSource.BootArgs, " mergen.overlay=tmpfs") {
+		t.Fatalf("expected in-memory overlay without a data disk, got %q %v", cfg.BootSource.BootArgs, err)
+	}
+
+	req.RootReadOnly = false
+	cfg, err = RenderVMConfig(req, meta)
+	if err != nil || cfg.Drives[0].IsReadOnly || strings.Contains(cfg.BootSource.BootArgs, OverlayBootArg) {
+		t.Fatalf("expected writable root without overlay, got %+v %q %v", cfg.Drives[0], cfg.BootSource.BootArgs, err)
+	}
+}
+
+func TestRenderVMConfig_GuestEnv(t *testing.T) {
+	meta := model.VMMetadata{ID: "6f008233-68f7-47b8-b2d1-6a9f0632b30b", TapName: "tap-6f008233"}
+	req := model.CreateVMRequest{
+		RootFS:   "/var/lib/mergen/images/app.ext4",
+		Kernel:   "/var/lib/mergen/vmlinux",
+		GuestEnv: map[string]string{"GREETING": "hello world"},
+	}
+	cfg, err := RenderVMConfig(req, meta)
+	if err != nil {
+		t.Fatalf("render: %v", err)
+	}
+	if !strings.Contains(cfg.BootSource.BootArgs, " mergen.env=eyJHUkVFVElORyI6ImhlbGxvIHdvcmxkIn0") || cfg.MMDSConfig != nil {
+		t.Fatalf("expected env on the command line only, got %q %+v", cfg.BootSource.BootArgs, cfg.MMDSConfig)
+	}
+
+	req.GuestEnvVia = GuestEnvMMDS
+	cfg, err = RenderVMConfig(req, meta)
+	if err != nil {
+		t.Fatalf("render: %v", err)
+	}
+	if !strings.Contains(cfg.BootSource.BootArgs, " mergen.env=mmds") || cfg.MMDSConfig == nil || cfg.MMDSConfig.NetworkInterfaces[0] != "eth0" {
+		t.Fatalf("expected env in mmds, got %q %+v", cfg.BootSource.BootArgs, cfg.MMDSConfig)
+	}
+	env := cfg.MMDS["mergen"].(map[string]any)["env"].(map[string]string)
+	if env["GREETING"] != "hello world" {
+		t.Fatalf("unexpected mmds document: %#v", cfg.MMDS)
+	}
+
+	if err := ValidateGuestEnv(map[string]string{"1BAD": "x"}, ""); err == nil {
+		t.Fatalf("expected invalid name to be rejected")
+	}
+	if err := ValidateGuestEnv(nil, "file"); err == nil {
+		t.Fatalf("expected unknown delivery to be rejected")
+	}
+}
+
+func TestRenderVMConfig_CloudHypervisorBootArgs(t *testing.T) {
+	req := model.CreateVMRequest{
+		RootFS:       "/var/lib/mergen/vm1/rootfs.ext4",
+		Kernel:       "/var/lib/mergen/vm1/vmlinux",
+		VCPU:         1,
+		MemMiB:       512,
+		RootReadOnly: true,
+	}
+	meta := model.VMMetadata{
+		ID:         "6f008233-68f7-47b8-b2d1-6a9f0632b30b",
+		TapName:    "tap-6f008233",
+		GuestIP:    "172.30.0.2",
+		Hypervisor: model.HypervisorCloudHypervisor,
+	}
+
+	cfg, err := RenderVMConfig(req, meta)
+	if err != nil {
+		t.Fatalf("render: %v", err)
+	}
+	expectedBootArgs := "console=ttyS0 reboot=k panic=1 mergen.overlay=tmpfs ip=172.30.0.2::172.30.0.1:255.255.255.0::eth0:off root=/dev/vda ro"
+	if cfg.BootSource.BootArgs != expectedBootArgs {
+		t.Fatalf("unexpected boot args: %q", cfg.BootSource.BootArgs)
+	}
+
+	req.BootArgs = "console=ttyS0 root=/dev/vda1 -- --verbose"
+	cfg, err = RenderVMConfig(req, meta)
+	if err != nil {
+		t.Fatalf("render with explicit root: %v", err)
+	}
+	if strings.Contains(cfg.BootSource.BootArgs, "root=/dev/vda ") || !strings.HasSuffix(cfg.BootSource.BootArgs, " -- --verbose") {
+		t.Fatalf("explicit root should be kept as is: %q", cfg.BootSource.BootArgs)
+	}
+}
+
+func TestConfiguratorFor(t *testing.T) {
+	for _, name := range []string{"", model.HypervisorFirecracker, model.HypervisorCloudHypervisor} {
+		if _, err := ConfiguratorFor(name, 0); err != nil {
+			t.Fatalf("ConfiguratorFor(%q) error = %v", name, err)
+		}
+	}
+	if err := ValidateHypervisor("qemu"); err == nil {
+		t.Fatal("expected unknown hypervisor to be rejected")
+	}
+}
+
+func TestRenderVMConfig_SharedDirs(t *testing.T) {
+	req := model.CreateVMRequest{
+		RootFS: "/var/lib/mergen/vm1/rootfs.ext4",
+		Kernel: "/var/lib/mergen/vm1/vmlinux",
+		VCPU:   1,
+		MemMiB: 512,
+		SharedDirs: []model.SharedDir{
+			{Tag: "src", HostPath: "/home/dev/src", GuestPath: "/workspace"},
+			{Tag: "cache", HostPath: "/var/cache/app", GuestPath: "/var/cache/app/", ReadOnly: true},
+		},
+	}
+	meta := model.VMMetadata{
+		ID:         "6f008233-68f7-47b8-b2d1-6a9f0632b30b",
+		TapName:    "tap-6f008233",
+		Hypervisor: model.HypervisorCloudHypervisor,
+		Paths:      model.VMPaths{RunDir: "/run/mergen/6f008233-68f7-47b8-b2d1-6a9f0632b30b"},
+	}
+	if err := ValidateSharedDirs(req.SharedDirs, meta.Hypervisor); err != nil {
+		t.Fatalf("validate: %v", err)
+	}
+
+	cfg, err := RenderVMConfig(req, meta)
+	if err != nil {
+		t.Fatalf("render: %v", err)
+	}
+	if !strings.Contains(cfg.BootSource.BootArgs, " mergen.shares=src:/workspace,cache:/var/cache/app:ro") {
+		t.Fatalf("boot args miss shares: %q", cfg.BootSource.BootArgs)
+	}
+	if len(cfg.FS) != 2 || cfg.FS[0].SocketPath != meta.Paths.RunDir+"/virtiofs-src.sock" || cfg.FS[1].SharedDir != "/var/cache/app" || !cfg.FS[1].ReadOnly {
+		t.Fatalf("unexpected fs devices: %+v", cfg.FS)
+	}
+	if cfg.Metrics != nil {
+		t.Fatalf("cloud hypervisor vm got a metrics fifo: %+v", cfg.Metrics)
+	}
+
+	invalid := [][]model.SharedDir{
+		{{Tag: "bad tag", HostPath: "/a", GuestPath: "/a"}},
+		{{Tag: "a", HostPath: "rel", GuestPath: "/a"}},
+		{{Tag: "a", HostPath: "/a", GuestPath: "/"}},
+		{{Tag: "a", HostPath: "/a", GuestPath: "/a:b"}},
+		{{Tag: "a", HostPath: "/a", GuestPath: "/a"}, {Tag: "a", HostPath: "/b", GuestPath: "/b"}},
+		{{Tag: "a", HostPath: "/a", GuestPath: "/a"}, {Tag: "b", HostPath: "/b", GuestPath: "/a/"}},
+	}
+	for _, dirs := range invalid {
+		if err := ValidateSharedDirs(dirs, model.HypervisorCloudHypervisor); err == nil {
+			t.Fatalf("expected %+v to be rejected", dirs)
+		}
+	}
+	if err := ValidateSharedDirs(req.SharedDirs, model.HypervisorFirecracker); err == nil {
+		t.Fatal("expected shared dirs to need cloud-hypervisor")
+	}
+}
+
+func TestRenderVMConfig_Devices(t *testing.T) {
+	devices, err := ValidateDevices([]string{"01:00.0", "0000:02:1F.7"}, model.HypervisorCloudHypervisor)
+	if err != nil {
+		t.Fatalf("validate: %v", err)
+	}
+	if len(devices) != 2 || devices[0] != "0000:01:00.0" || devices[1] != "0000:02:1f.7" {
+		t.Fatalf("unexpected normalized devices: %v", devices)
+	}
+	req := model.CreateVMRequest{RootFS: "/var/lib/mergen/vm1/rootfs.ext4", Kernel: "/var/lib/mergen/vm1/vmlinux", VCPU: 1, MemMiB: 512}
+	meta := model.VMMetadata{
+		ID:         "6f008233-68f7-47b8-b2d1-6a9f0632b30b",
+		TapName:    "tap-6f008233",
+		Hypervisor: model.HypervisorCloudHypervisor,
+		Devices:    devices,
+	}
+	cfg, err := RenderVMConfig(req, meta)
+	if err != nil {
+		t.Fatalf("render: %v", err)
+	}
+	if len(cfg.Devices) != 2 || cfg.Devices[0].Path != "/sys/bus/pci/devices/0000:01:00.0/" || cfg.Devices[1].ID != "vfio1" {
+		t.Fatalf("unexpected pci devices: %+v", cfg.Devices)
+	}
+
+	for _, invalid := range [][]string{{"1:00.0"}, {"0000:01:20.0"}, {"0000:01:00.8"}, {"01:00.0", "0000:01:00.0"}} {
+		if _, err := ValidateDevices(invalid, model.HypervisorCloudHypervisor); err == nil {
+			t.Fatalf("expected %v to be rejected", invalid)
+		}
+	}
+	if _, err := ValidateDevices(devices, model.HypervisorFirecracker); err == nil {
+		t.Fatal("expected devices to need cloud-hypervisor")
+	}
+}
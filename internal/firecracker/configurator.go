@@ -2,10 +2,35 @@ package firecracker
 
 import (
 	"context"
+	"fmt"
+	"time"
 
+	"github.com/alperreha/mergen-fire/internal/cloudhypervisor"
 	"github.com/alperreha/mergen-fire/internal/model"
 )
 
+// Configurator configures a freshly started VMM from a rendered vm.json and
+// boots the VM.
 type Configurator interface {
 	ConfigureAndStart(ctx context.Context, socketPath string, cfg model.VMConfig) error
 }
+
+var _ Configurator = (*cloudhypervisor.Configurator)(nil)
+
+// ConfiguratorFor returns the configurator of the named hypervisor; an empty
+// name is Firecracker.
+func ConfiguratorFor(hypervisor string, timeout time.Duration) (Configurator, error) {
+	switch hypervisor {
+	case "", model.HypervisorFirecracker:
+		return NewConfigurator(timeout), nil
+	case model.HypervisorCloudHypervisor:
+		return cloudhypervisor.NewConfigurator(timeout), nil
+	}
+	return nil, fmt.Errorf("unknown hypervisor %q (%s or %s)", hypervisor, model.HypervisorFirecracker, model.HypervisorCloudHypervisor)
+}
+
+// ValidateHypervisor checks a hypervisor name; empty selects the default.
+func ValidateHypervisor(hypervisor string) error {
+	_, err := ConfiguratorFor(hypervisor, 0)
+	return err
+}
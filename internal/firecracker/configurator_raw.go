@@ -5,6 +5,7 @@ import (
 	"context"
 	"encoding/json"
 	"fmt"
+	"io"
 	"log/slog"
 	"net"
 	"net/http"
@@ -12,12 +13,15 @@ import (
 	"path"
 	"time"
 
+	"github.com/alperreha/mergen-fire/internal/chaos"
 	"github.com/alperreha/mergen-fire/internal/model"
+	"github.com/alperreha/mergen-fire/internal/tracing"
 )
 
 type RawConfigurator struct {
 	client *http.Client
 	logger *slog.Logger
+	chaos  *chaos.Injector
 }
 
 func NewRawConfigurator(timeout time.Duration) *RawConfigurator {
@@ -36,8 +40,19 @@ func (r *RawConfigurator) WithLogger(logger *slog.Logger) *RawConfigurator {
 	return r
 }
 
+// WithChaos lets the injector delay API calls before they are sent.
+func (r *RawConfigurator) WithChaos(injector *chaos.Injector) *RawConfigurator {
+	r.chaos = injector
+	return r
+}
+
 func (r *RawConfigurator) ConfigureAndStart(ctx context.Context, socketPath string, cfg model.VMConfig) error {
 	r.logger.Debug("configuring firecracker via raw socket", "socketPath", socketPath, "drives", len(cfg.Drives), "networkIfaces", len(cfg.NetworkInterfaces))
+	if cfg.Metrics != nil {
+		if err := r.doJSON(ctx, socketPath, http.MethodPut, "/metrics", cfg.Metrics); err != nil {
+			return fmt.Errorf("metrics: %w", err)
+		}
+	}
 	if err := r.doJSON(ctx, socketPath, http.MethodPut, "/boot-source", cfg.BootSource); err != nil {
 		return fmt.Errorf("boot-source: %w", err)
 	}
@@ -72,17 +87,35 @@ func (r *RawConfigurator) ConfigureAndStart(ctx context.Context, socketPath stri
 }
 
 func (r *RawConfigurator) doJSON(ctx context.Context, socketPath, method, endpoint string, payload any) error {
+	return r.do(ctx, socketPath, method, endpoint, payload, nil)
+}
+
+// do sends payload, if any, and decodes the response into out, if set.
+func (r *RawConfigurator) do(ctx context.Context, socketPath, method, endpoint string, payload, out any) (err error) {
 	r.logger.Debug("sending firecracker api request", "socketPath", socketPath, "method", method, "endpoint", endpoint)
-	body, err := json.Marshal(payload)
-	if err != nil {
+	ctx, span := tracing.StartKind(ctx, tracing.KindClient, "firecracker "+method+" "+endpoint, "socketPath", socketPath)
+	defer func() { span.RecordError(err); span.End() }()
+
+	if err := r.chaos.FirecrackerDelay(ctx, endpoint); err != nil {
 		return err
 	}
 
-	request, err := http.NewRequestWithContext(ctx, method, "http://firecracker"+endpoint, bytes.NewReader(body))
+	var body io.Reader
+	if payload != nil {
+		encoded, err := json.Marshal(payload)
+		if err != nil {
+			return err
+		}
+		body = bytes.NewReader(encoded)
+	}
+
+	request, err := http.NewRequestWithContext(ctx, method, "http://firecracker"+endpoint, body)
 	if err != nil {
 		return err
 	}
-	request.Header.Set("Content-Type", "application/json")
+	if body != nil {
+		request.Header.Set("Content-Type", "application/json")
+	}
 
 	transport := &http.Transport{
 		DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
@@ -100,9 +133,15 @@ func (r *RawConfigurator) doJSON(ctx context.Context, socketPath, method, endpoi
 		return err
 	}
 	defer response.Body.Close()
+	span.SetAttributes("http.response.status_code", response.StatusCode)
 	if response.StatusCode < 200 || response.StatusCode >= 300 {
 		return fmt.Errorf("firecracker api status: %s", response.Status)
 	}
+	if out != nil {
+		if err := json.NewDecoder(response.Body).Decode(out); err != nil {
+			return fmt.Errorf("decode firecracker api response: %w", err)
+		}
+	}
 	r.logger.Debug("firecracker api request successful", "method", method, "endpoint", endpoint, "status", response.Status)
 	return nil
 }
@@ -0,0 +1,29 @@
+package firecracker
+
+import (
+	"path/filepath"
+
+	"github.com/alperreha/mergen-fire/internal/model"
+)
+
+// ConsoleInputPath is the FIFO mergen-jailer-start makes the VMM's stdin,
+// which both VMMs read the guest serial port's input from.
+func ConsoleInputPath(runDir string) string {
+	return filepath.Join(runDir, "console.in")
+}
+
+// SerialLogName is the file in a VM's logs dir the guest serial output goes
+// to unless the VM's env sets MGN_SERIAL_LOG.
+const SerialLogName = "serial.log"
+
+func SerialLogPath(logsDir string) string {
+	return filepath.Join(logsDir, SerialLogName)
+}
+
+func consoleDevice(paths model.VMPaths) *model.Console {
+	console := &model.Console{InputPath: ConsoleInputPath(paths.RunDir)}
+	if paths.LogsDir != "" {
+		console.OutputPath = SerialLogPath(paths.LogsDir)
+	}
+	return console
+}
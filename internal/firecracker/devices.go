@@ -0,0 +1,74 @@
+package firecracker
+
+import (
+	"fmt"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	"github.com/alperreha/mergen-fire/internal/model"
+)
+
+// PCIDevicesDir is where sysfs lists the host's PCI devices.
+const PCIDevicesDir = "/sys/bus/pci/devices"
+
+// maxDevices bounds the VFIO devices one VM takes.
+const maxDevices = 8
+
+// pciAddressPattern matches [domain:]bus:device.function; a device number
+// is 5 bits, a function 3.
+var pciAddressPattern = regexp.MustCompile(`^(?:([0-9a-fA-F]{4}):)?([0-9a-fA-F]{2}):([01][0-9a-fA-F])\.([0-7])$`)
+
+// NormalizePCIAddress returns addr in sysfs form, lower case with the
+// domain, so "01:00.0" becomes "0000:01:00.0".
+func NormalizePCIAddress(addr string) (string, error) {
+	match := pciAddressPattern.FindStringSubmatch(strings.TrimSpace(addr))
+	if match == nil {
+		return "", fmt.Errorf("invalid pci address %q: expected [domain:]bus:device.function, e.g. 0000:01:00.0", addr)
+	}
+	domain := match[1]
+	if domain == "" {
+		domain = "0000"
+	}
+	return strings.ToLower(fmt.Sprintf("%s:%s:%s.%s", domain, match[2], match[3], match[4])), nil
+}
+
+// ValidateDevices checks the passthrough devices of a VM running under
+// hypervisor and returns them normalized. Whether the host has them is up
+// to the caller.
+func ValidateDevices(devices []string, hypervisor string) ([]string, error) {
+	if len(devices) == 0 {
+		return nil, nil
+	}
+	if hypervisor != model.HypervisorCloudHypervisor {
+		return nil, fmt.Errorf("devices need hypervisor %s; firecracker has no vfio passthrough", model.HypervisorCloudHypervisor)
+	}
+	if len(devices) > maxDevices {
+		return nil, fmt.Errorf("at most %d devices are supported, got %d", maxDevices, len(devices))
+	}
+	normalized := make([]string, 0, len(devices))
+	for _, device := range devices {
+		addr, err := NormalizePCIAddress(device)
+		if err != nil {
+			return nil, fmt.Errorf("devices: %w", err)
+		}
+		for _, seen := range normalized {
+			if seen == addr {
+				return nil, fmt.Errorf("devices: %s is listed twice", addr)
+			}
+		}
+		normalized = append(normalized, addr)
+	}
+	return normalized, nil
+}
+
+func pciDevices(addrs []string) []model.PCIDevice {
+	devices := make([]model.PCIDevice, 0, len(addrs))
+	for i, addr := range addrs {
+		devices = append(devices, model.PCIDevice{
+			ID:   fmt.Sprintf("vfio%d", i),
+			Path: filepath.Join(PCIDevicesDir, addr) + "/",
+		})
+	}
+	return devices
+}
@@ -0,0 +1,83 @@
+package firecracker
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/alperreha/mergen-fire/internal/model"
+)
+
+// GuestEnvBootArg carries the guest environment to mergen-init-snapshot:
+// either the environment as base64url-encoded JSON, or "mmds" to fetch it
+// from the metadata service under mergen.env.
+const (
+	GuestEnvBootArg = "mergen.env"
+	GuestEnvCmdline = "cmdline"
+	GuestEnvMMDS    = "mmds"
+)
+
+var guestEnvName = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+
+// ValidateGuestEnv checks variable names and the delivery method.
+func ValidateGuestEnv(env map[string]string, via string) error {
+	if via != "" && via != GuestEnvCmdline && via != GuestEnvMMDS {
+		return fmt.Errorf("invalid guestEnvVia %q: expected %s or %s", via, GuestEnvCmdline, GuestEnvMMDS)
+	}
+	names := make([]string, 0, len(env))
+	for name := range env {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		if !guestEnvName.MatchString(name) {
+			return fmt.Errorf("invalid guestEnv name %q", name)
+		}
+		if strings.ContainsRune(env[name], 0) {
+			return fmt.Errorf("guestEnv %s contains a NUL byte", name)
+		}
+	}
+	return nil
+}
+
+// BootOptionsFor adds the boot args mergen itself needs for req (overlay
+// root, root growth, guest env, shared dirs) to the caller's boot options.
+func BootOptionsFor(req model.CreateVMRequest) *model.BootOptions {
+	boot := req.Boot
+	if req.RootReadOnly {
+		overlay := overlayTmpfs
+		if strings.TrimSpace(req.DataDisk) != "" {
+			overlay = overlayDataDevice
+		}
+		boot = withBootExtra(boot, OverlayBootArg, overlay)
+	}
+	if req.RootFSSizeMiB > 0 {
+		boot = withBootExtra(boot, GrowRootBootArg, "1")
+	}
+	if len(req.GuestEnv) > 0 {
+		value := GuestEnvMMDS
+		if req.GuestEnvVia != GuestEnvMMDS {
+			value = encodeGuestEnv(req.GuestEnv)
+		}
+		boot = withBootExtra(boot, GuestEnvBootArg, value)
+	}
+	if len(req.SharedDirs) > 0 {
+		boot = withBootExtra(boot, SharesBootArg, sharesArg(req.SharedDirs))
+	}
+	return boot
+}
+
+// encodeGuestEnv uses unpadded base64url so the value has no characters the
+// kernel command line treats specially.
+func encodeGuestEnv(env map[string]string) string {
+	raw, _ := json.Marshal(env)
+	return base64.RawURLEncoding.EncodeToString(raw)
+}
+
+func guestEnvMMDS(env map[string]string) (*model.MMDSConfig, map[string]any) {
+	cfg := &model.MMDSConfig{Version: "V2", NetworkInterfaces: []string{defaultGuestIfName}}
+	return cfg, map[string]any{"mergen": map[string]any{"env": env}}
+}
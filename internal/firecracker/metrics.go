@@ -0,0 +1,17 @@
+package firecracker
+
+import (
+	"path/filepath"
+
+	"github.com/alperreha/mergen-fire/internal/model"
+)
+
+// MetricsPath is the FIFO Firecracker writes a VM's metrics to and mergend
+// reads them from. It outlives restarts of the VMM.
+func MetricsPath(runDir string) string {
+	return filepath.Join(runDir, "metrics.fifo")
+}
+
+func metricsDevice(runDir string) *model.Metrics {
+	return &model.Metrics{MetricsPath: MetricsPath(runDir)}
+}
@@ -2,7 +2,10 @@ package firecracker
 
 import (
 	"errors"
+	"net"
 	"os"
+	"syscall"
+	"time"
 )
 
 func SocketPresent(socketPath string) (bool, error) {
@@ -16,3 +19,32 @@ func SocketPresent(socketPath string) (bool, error) {
 
 	return info.Mode()&os.ModeSocket != 0, nil
 }
+
+// SocketStale reports whether socketPath is a socket no process listens on,
+// as a Firecracker process that crashed leaves behind. Connecting is the
+// check: the kernel refuses it only when nothing is bound to the file.
+func SocketStale(socketPath string) (bool, error) {
+	present, err := SocketPresent(socketPath)
+	if err != nil || !present {
+		return false, err
+	}
+	conn, err := net.DialTimeout("unix", socketPath, time.Second)
+	if err == nil {
+		_ = conn.Close()
+		return false, nil
+	}
+	return errors.Is(err, syscall.ECONNREFUSED), nil
+}
+
+// RemoveStaleSocket removes socketPath if SocketStale reports it stale and
+// returns whether it did.
+func RemoveStaleSocket(socketPath string) (bool, error) {
+	stale, err := SocketStale(socketPath)
+	if err != nil || !stale {
+		return false, err
+	}
+	if err := os.Remove(socketPath); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return false, err
+	}
+	return true, nil
+}
@@ -0,0 +1,90 @@
+package firecracker
+
+import (
+	"fmt"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	"github.com/alperreha/mergen-fire/internal/model"
+)
+
+// SharesBootArg tells mergen-init-snapshot which virtio-fs tags to mount
+// where, as tag:/guest/path[:ro] entries separated by commas.
+const SharesBootArg = "mergen.shares"
+
+// maxSharedDirs bounds the virtiofsd processes one VM runs.
+const maxSharedDirs = 8
+
+// virtio-fs tags are at most 36 bytes.
+var sharedDirTagPattern = regexp.MustCompile(`^[A-Za-z0-9_-]{1,36}$`)
+
+// ValidateSharedDirs checks dirs for a VM running under hypervisor. Guest
+// paths must not contain the separators of SharesBootArg or whitespace.
+func ValidateSharedDirs(dirs []model.SharedDir, hypervisor string) error {
+	if len(dirs) == 0 {
+		return nil
+	}
+	if hypervisor != model.HypervisorCloudHypervisor {
+		return fmt.Errorf("sharedDirs need hypervisor %s; firecracker has no virtio-fs device", model.HypervisorCloudHypervisor)
+	}
+	if len(dirs) > maxSharedDirs {
+		return fmt.Errorf("at most %d sharedDirs are supported, got %d", maxSharedDirs, len(dirs))
+	}
+	tags := map[string]bool{}
+	guestPaths := map[string]bool{}
+	for _, dir := range dirs {
+		if !sharedDirTagPattern.MatchString(dir.Tag) {
+			return fmt.Errorf("sharedDirs: invalid tag %q: expected 1-36 letters, digits, '-' or '_'", dir.Tag)
+		}
+		if tags[dir.Tag] {
+			return fmt.Errorf("sharedDirs: duplicate tag %q", dir.Tag)
+		}
+		tags[dir.Tag] = true
+		if !filepath.IsAbs(dir.HostPath) {
+			return fmt.Errorf("sharedDirs %s: hostPath must be absolute", dir.Tag)
+		}
+		guestPath := path.Clean(dir.GuestPath)
+		switch {
+		case !path.IsAbs(dir.GuestPath) || guestPath == "/":
+			return fmt.Errorf("sharedDirs %s: guestPath must be an absolute path other than /", dir.Tag)
+		case strings.ContainsAny(dir.GuestPath, ",: \t\n"):
+			return fmt.Errorf("sharedDirs %s: guestPath must not contain commas, colons or whitespace", dir.Tag)
+		case guestPaths[guestPath]:
+			return fmt.Errorf("sharedDirs %s: guestPath %s is used twice", dir.Tag, guestPath)
+		}
+		guestPaths[guestPath] = true
+	}
+	return nil
+}
+
+// VirtioFSSocket is where the virtiofsd for tag listens.
+func VirtioFSSocket(runDir, tag string) string {
+	return filepath.Join(runDir, "virtiofs-"+tag+".sock")
+}
+
+func fsDevices(dirs []model.SharedDir, runDir string) []model.FSDevice {
+	devices := make([]model.FSDevice, 0, len(dirs))
+	for _, dir := range dirs {
+		devices = append(devices, model.FSDevice{
+			Tag:        dir.Tag,
+			SocketPath: VirtioFSSocket(runDir, dir.Tag),
+			SharedDir:  dir.HostPath,
+			ReadOnly:   dir.ReadOnly,
+		})
+	}
+	return devices
+}
+
+func sharesArg(dirs []model.SharedDir) string {
+	entries := make([]string, 0, len(dirs))
+	for _, dir := range dirs {
+		entry := dir.Tag + ":" + path.Clean(dir.GuestPath)
+		if dir.ReadOnly {
+			entry += ":ro"
+		}
+		entries = append(entries, entry)
+	}
+	return strings.Join(entries, ",")
+}
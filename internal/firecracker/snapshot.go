@@ -0,0 +1,89 @@
+package firecracker
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"path/filepath"
+)
+
+// SnapshotFiles are the two files of a full Firecracker snapshot: the
+// microVM state and the guest memory.
+type SnapshotFiles struct {
+	StatePath string `json:"statePath"`
+	MemPath   string `json:"memPath"`
+}
+
+// SnapshotDir is where a VM's pending snapshot lives. mergen-configure-start
+// restores from it instead of booting when both files are present and removes
+// them afterwards, so a snapshot is resumed at most once.
+func SnapshotDir(dataDir string) string {
+	return filepath.Join(dataDir, "snapshot")
+}
+
+func SnapshotFilesIn(dir string) SnapshotFiles {
+	return SnapshotFiles{
+		StatePath: filepath.Join(dir, "vmstate"),
+		MemPath:   filepath.Join(dir, "mem"),
+	}
+}
+
+// Instance states reported by the Firecracker API.
+const (
+	StateNotStarted = "Not started"
+	StateRunning    = "Running"
+	StatePaused     = "Paused"
+)
+
+// InstanceState returns the run state of the microVM behind socketPath.
+func (r *RawConfigurator) InstanceState(ctx context.Context, socketPath string) (string, error) {
+	var info struct {
+		State string `json:"state"`
+	}
+	if err := r.do(ctx, socketPath, http.MethodGet, "/", nil, &info); err != nil {
+		return "", fmt.Errorf("instance info: %w", err)
+	}
+	return info.State, nil
+}
+
+func (r *RawConfigurator) Pause(ctx context.Context, socketPath string) error {
+	if err := r.doJSON(ctx, socketPath, http.MethodPatch, "/vm", map[string]string{"state": "Paused"}); err != nil {
+		return fmt.Errorf("pause: %w", err)
+	}
+	return nil
+}
+
+func (r *RawConfigurator) Resume(ctx context.Context, socketPath string) error {
+	if err := r.doJSON(ctx, socketPath, http.MethodPatch, "/vm", map[string]string{"state": "Resumed"}); err != nil {
+		return fmt.Errorf("resume: %w", err)
+	}
+	return nil
+}
+
+// CreateSnapshot writes a full snapshot of a paused microVM.
+func (r *RawConfigurator) CreateSnapshot(ctx context.Context, socketPath string, files SnapshotFiles) error {
+	if err := r.doJSON(ctx, socketPath, http.MethodPut, "/snapshot/create", map[string]string{
+		"snapshot_type": "Full",
+		"snapshot_path": files.StatePath,
+		"mem_file_path": files.MemPath,
+	}); err != nil {
+		return fmt.Errorf("snapshot create: %w", err)
+	}
+	return nil
+}
+
+// LoadSnapshot restores a snapshot into a freshly started, unconfigured
+// Firecracker process.
+func (r *RawConfigurator) LoadSnapshot(ctx context.Context, socketPath string, files SnapshotFiles, resume bool) error {
+	if err := r.doJSON(ctx, socketPath, http.MethodPut, "/snapshot/load", map[string]any{
+		"snapshot_path": files.StatePath,
+		"mem_backend": map[string]string{
+			"backend_type": "File",
+			"backend_path": files.MemPath,
+		},
+		"resume_vm": resume,
+	}); err != nil {
+		return fmt.Errorf("snapshot load: %w", err)
+	}
+	return nil
+}
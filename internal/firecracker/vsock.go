@@ -0,0 +1,78 @@
+package firecracker
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/alperreha/mergen-fire/internal/model"
+)
+
+const (
+	VsockDeviceID = "vsock0"
+	// GuestCID is the context ID of every guest. Both VMMs connect a VM's
+	// vsock to unix sockets of its own, so the IDs need not differ.
+	GuestCID = 3
+	// GuestStatsPort is the host vsock port mergen-init-snapshot sends its
+	// resource samples to.
+	GuestStatsPort = 1027
+	// GuestExecPort is the guest vsock port mergen-init-snapshot runs
+	// commands sent to it on.
+	GuestExecPort = 1028
+)
+
+// VsockPath is the unix socket the VMM serves the VM's vsock device on.
+func VsockPath(runDir string) string {
+	return filepath.Join(runDir, "vsock.sock")
+}
+
+// VsockHostPath is the unix socket a guest connection to port of the host
+// (CID 2) is forwarded to; whoever wants those connections listens on it.
+func VsockHostPath(runDir string, port int) string {
+	return fmt.Sprintf("%s_%d", VsockPath(runDir), port)
+}
+
+func vsockDevice(runDir string) *model.Vsock {
+	return &model.Vsock{VsockID: VsockDeviceID, GuestCID: GuestCID, UdsPath: VsockPath(runDir)}
+}
+
+// DialGuest connects to port of the guest through the VMM's vsock socket at
+// udsPath, with the CONNECT handshake Firecracker and Cloud Hypervisor both
+// speak.
+func DialGuest(ctx context.Context, udsPath string, port int) (net.Conn, error) {
+	var dialer net.Dialer
+	conn, err := dialer.DialContext(ctx, "unix", udsPath)
+	if err != nil {
+		return nil, err
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		_ = conn.SetDeadline(deadline)
+	}
+	if _, err := fmt.Fprintf(conn, "CONNECT %d\n", port); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	// The reply is read byte by byte so nothing the guest sends after it
+	// is taken from the caller.
+	var reply []byte
+	b := make([]byte, 1)
+	for len(reply) < 64 {
+		if _, err := conn.Read(b); err != nil {
+			conn.Close()
+			return nil, fmt.Errorf("vsock port %d: no reply to CONNECT: %w", port, err)
+		}
+		if b[0] == '\n' {
+			break
+		}
+		reply = append(reply, b[0])
+	}
+	if !strings.HasPrefix(string(reply), "OK ") {
+		conn.Close()
+		return nil, fmt.Errorf("vsock port %d: %s", port, strings.TrimSpace(string(reply)))
+	}
+	_ = conn.SetDeadline(time.Time{})
+	return conn, nil
+}
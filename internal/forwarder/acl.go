@@ -0,0 +1,210 @@
+package forwarder
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"net/netip"
+	"os"
+	"strings"
+)
+
+// VM tags carrying a per-VM ACL, in the comma-separated form of the FWD_ACL_*
+// settings.
+const (
+	aclAllowTag          = "acl.allow"
+	aclDenyTag           = "acl.deny"
+	aclAllowCountriesTag = "acl.allowCountries"
+	aclDenyCountriesTag  = "acl.denyCountries"
+)
+
+// ACL filters connections by source address and, with a GeoIP database, by
+// source country. Deny entries win. When any allow entry is set, a source
+// must match an allowed CIDR or an allowed country; otherwise everything not
+// denied passes.
+type ACL struct {
+	Allow          []netip.Prefix
+	Deny           []netip.Prefix
+	AllowCountries []string
+	DenyCountries  []string
+}
+
+// ParseACL reads comma-separated CIDRs (a bare address means just that
+// address) and ISO 3166 country codes.
+func ParseACL(allow, deny, allowCountries, denyCountries string) (ACL, error) {
+	var acl ACL
+	var err error
+	if acl.Allow, err = parsePrefixes(allow); err != nil {
+		return ACL{}, err
+	}
+	if acl.Deny, err = parsePrefixes(deny); err != nil {
+		return ACL{}, err
+	}
+	if acl.AllowCountries, err = parseCountries(allowCountries); err != nil {
+		return ACL{}, err
+	}
+	if acl.DenyCountries, err = parseCountries(denyCountries); err != nil {
+		return ACL{}, err
+	}
+	return acl, nil
+}
+
+func (a ACL) empty() bool {
+	return len(a.Allow) == 0 && len(a.Deny) == 0 && len(a.AllowCountries) == 0 && len(a.DenyCountries) == 0
+}
+
+func (a ACL) usesCountries() bool {
+	return len(a.AllowCountries) > 0 || len(a.DenyCountries) > 0
+}
+
+// permits reports whether addr, located in country ("" when unknown), may
+// connect.
+func (a ACL) permits(addr netip.Addr, country string) bool {
+	addr = addr.Unmap()
+	if prefixesContain(a.Deny, addr) || (country != "" && containsString(a.DenyCountries, country)) {
+		return false
+	}
+	if len(a.Allow) == 0 && len(a.AllowCountries) == 0 {
+		return true
+	}
+	return prefixesContain(a.Allow, addr) || (country != "" && containsString(a.AllowCountries, country))
+}
+
+// aclFromTags reads a VM's ACL tags; tags that do not parse are an error so
+// a typo cannot silently open the VM up.
+func aclFromTags(tags map[string]string) (ACL, error) {
+	if len(tags) == 0 {
+		return ACL{}, nil
+	}
+	return ParseACL(tags[aclAllowTag], tags[aclDenyTag], tags[aclAllowCountriesTag], tags[aclDenyCountriesTag])
+}
+
+func parsePrefixes(raw string) ([]netip.Prefix, error) {
+	var out []netip.Prefix
+	for _, item := range strings.Split(raw, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+		if !strings.Contains(item, "/") {
+			addr, err := netip.ParseAddr(item)
+			if err != nil {
+				return nil, fmt.Errorf("invalid acl address %q: %w", item, err)
+			}
+			addr = addr.Unmap()
+			out = append(out, netip.PrefixFrom(addr, addr.BitLen()))
+			continue
+		}
+		prefix, err := netip.ParsePrefix(item)
+		if err != nil {
+			return nil, fmt.Errorf("invalid acl cidr %q: %w", item, err)
+		}
+		out = append(out, prefix.Masked())
+	}
+	return out, nil
+}
+
+func parseCountries(raw string) ([]string, error) {
+	var out []string
+	for _, item := range strings.Split(raw, ",") {
+		item = strings.ToUpper(strings.TrimSpace(item))
+		if item == "" {
+			continue
+		}
+		if len(item) != 2 || item[0] < 'A' || item[0] > 'Z' || item[1] < 'A' || item[1] > 'Z' {
+			return nil, fmt.Errorf("invalid country code %q: want two letters, e.g. DE", item)
+		}
+		out = append(out, item)
+	}
+	return out, nil
+}
+
+func prefixesContain(prefixes []netip.Prefix, addr netip.Addr) bool {
+	for _, prefix := range prefixes {
+		if prefix.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+func containsString(values []string, value string) bool {
+	for _, candidate := range values {
+		if candidate == value {
+			return true
+		}
+	}
+	return false
+}
+
+// GeoIP maps addresses to countries from a CSV of "cidr,country" lines, the
+// shape of the free per-country range lists. Lookups try each prefix length
+// from the longest, so the most specific range wins.
+type GeoIP struct {
+	ranges map[netip.Prefix]string
+}
+
+// LoadGeoIP reads a GeoIP CSV. Blank lines, # comments and a header line
+// whose first column is not a CIDR are skipped.
+func LoadGeoIP(path string) (*GeoIP, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("open geoip file: %w", err)
+	}
+	defer file.Close()
+
+	geo := &GeoIP{ranges: map[netip.Prefix]string{}}
+	scanner := bufio.NewScanner(file)
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+		cidr, country, ok := strings.Cut(text, ",")
+		if !ok {
+			return nil, fmt.Errorf("geoip file %s line %d: want cidr,country", path, line)
+		}
+		prefix, err := netip.ParsePrefix(strings.TrimSpace(cidr))
+		if err != nil {
+			if line == 1 {
+				continue
+			}
+			return nil, fmt.Errorf("geoip file %s line %d: %w", path, line, err)
+		}
+		// Lists with more columns carry the code first, e.g. "DE,Germany".
+		country, _, _ = strings.Cut(country, ",")
+		geo.ranges[prefix.Masked()] = strings.ToUpper(strings.Trim(strings.TrimSpace(country), `"`))
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("read geoip file: %w", err)
+	}
+	return geo, nil
+}
+
+// Country returns addr's country code, or "" when the database has no range
+// for it or there is no database.
+func (g *GeoIP) Country(addr netip.Addr) string {
+	if g == nil {
+		return ""
+	}
+	addr = addr.Unmap()
+	for bits := addr.BitLen(); bits >= 0; bits-- {
+		prefix, err := addr.Prefix(bits)
+		if err != nil {
+			return ""
+		}
+		if country, ok := g.ranges[prefix]; ok {
+			return country
+		}
+	}
+	return ""
+}
+
+// remoteAddr extracts the source address of conn, unmapped from IPv4-in-IPv6.
+func remoteAddr(conn net.Conn) (netip.Addr, bool) {
+	addrPort, err := netip.ParseAddrPort(conn.RemoteAddr().String())
+	if err != nil {
+		return netip.Addr{}, false
+	}
+	return addrPort.Addr().Unmap(), true
+}
@@ -0,0 +1,71 @@
+package forwarder
+
+import (
+	"net/netip"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestACLPermits(t *testing.T) {
+	acl, err := ParseACL("10.0.0.0/8, 192.0.2.7", "10.9.0.0/16", "de", "")
+	if err != nil {
+		t.Fatalf("parse acl: %v", err)
+	}
+	cases := []struct {
+		addr    string
+		country string
+		want    bool
+	}{
+		{addr: "10.1.2.3", want: true},
+		{addr: "10.9.1.1", want: false},
+		{addr: "192.0.2.7", want: true},
+		{addr: "::ffff:192.0.2.7", want: true},
+		{addr: "192.0.2.8", want: false},
+		{addr: "198.51.100.1", country: "DE", want: true},
+		{addr: "198.51.100.1", country: "FR", want: false},
+	}
+	for _, tc := range cases {
+		if got := acl.permits(netip.MustParseAddr(tc.addr), tc.country); got != tc.want {
+			t.Fatalf("permits(%s, %q) = %v, want %v", tc.addr, tc.country, got, tc.want)
+		}
+	}
+
+	denyOnly, err := ParseACL("", "", "", "CN")
+	if err != nil {
+		t.Fatalf("parse deny-only acl: %v", err)
+	}
+	if !denyOnly.permits(netip.MustParseAddr("203.0.113.1"), "") || denyOnly.permits(netip.MustParseAddr("203.0.113.1"), "CN") {
+		t.Fatal("deny-only acl should pass everything but the denied country")
+	}
+
+	if _, err := ParseACL("10.0.0.0/33", "", "", ""); err == nil {
+		t.Fatal("expected invalid cidr to fail")
+	}
+	if _, err := ParseACL("", "", "Germany", ""); err == nil {
+		t.Fatal("expected invalid country code to fail")
+	}
+}
+
+func TestLoadGeoIP(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "geoip.csv")
+	content := "network,country\n# comment\n198.51.100.0/24,DE,Germany\n198.51.100.128/25,FR\n2001:db8::/32,\"NL\"\n"
+	if err := os.WriteFile(path, []byte(content), 0o644); err != nil {
+		t.Fatalf("write geoip file: %v", err)
+	}
+	geo, err := LoadGeoIP(path)
+	if err != nil {
+		t.Fatalf("load geoip: %v", err)
+	}
+	cases := map[string]string{
+		"198.51.100.1":   "DE",
+		"198.51.100.200": "FR",
+		"2001:db8::1":    "NL",
+		"203.0.113.1":    "",
+	}
+	for addr, want := range cases {
+		if got := geo.Country(netip.MustParseAddr(addr)); got != want {
+			t.Fatalf("Country(%s) = %q, want %q", addr, got, want)
+		}
+	}
+}
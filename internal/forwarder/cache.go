@@ -0,0 +1,446 @@
+package forwarder
+
+import (
+	"container/list"
+	"context"
+	"crypto/tls"
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/alperreha/mergen-fire/internal/model"
+)
+
+// A VM tag cacheTagPrefix+<listener> set to "on" (e.g. cache.https=on)
+// makes the forwarder speak HTTP to that VM itself instead of piping bytes,
+// so it can answer repeated requests for static assets from memory.
+const cacheTagPrefix = "cache."
+
+// cacheEnabled reports whether meta opted in to response caching on
+// listener.
+func cacheEnabled(meta model.VMMetadata, listener string) bool {
+	switch strings.ToLower(strings.TrimSpace(meta.Tags[cacheTagPrefix+listener])) {
+	case "on", "true", "1":
+		return true
+	}
+	return false
+}
+
+// cacheFor returns the response cache of meta's VM. A VM recreated under
+// the same ID starts with an empty one; pruneCaches frees the old one.
+func (s *Server) cacheFor(meta model.VMMetadata) *responseCache {
+	s.cachesMu.Lock()
+	defer s.cachesMu.Unlock()
+	cache, ok := s.caches[meta.ID]
+	if !ok || !cache.createdAt.Equal(meta.CreatedAt) {
+		cache = newResponseCache(s.config.CacheMaxBytes, s.config.CacheMaxEntryBytes)
+		cache.createdAt = meta.CreatedAt
+		s.caches[meta.ID] = cache
+	}
+	return cache
+}
+
+// pruneCaches drops the response caches of VMs that are no longer routed,
+// or were recreated under the same ID. The resolver calls it with the
+// routable VMs after every refresh.
+func (s *Server) pruneCaches(routable []model.VMMetadata) {
+	created := make(map[string]time.Time, len(routable))
+	for _, meta := range routable {
+		created[meta.ID] = meta.CreatedAt
+	}
+	s.cachesMu.Lock()
+	defer s.cachesMu.Unlock()
+	for id, cache := range s.caches {
+		if at, ok := created[id]; !ok || !at.Equal(cache.createdAt) {
+			delete(s.caches, id)
+			s.logger.Debug("response cache dropped", "vmID", id, "bytes", cache.bytes())
+		}
+	}
+}
+
+// serveHTTP reverse-proxies the requests on conn to targetAddr in the VM's
+// network namespace, through the VM's response cache. It returns once conn
+// is closed and any upgraded (e.g. websocket) stream on it has ended.
+func (s *Server) serveHTTP(conn *tls.Conn, meta model.VMMetadata, targetAddr string) {
+	transport := &http.Transport{
+		DialContext: func(ctx context.Context, network, _ string) (net.Conn, error) {
+			ctx, cancel := context.WithTimeout(ctx, s.config.DialTimeout)
+			defer cancel()
+			backendConn, err := s.dialer.DialContext(ctx, network, targetAddr, meta.NetNS)
+			if err != nil {
+				return nil, err
+			}
+			s.setKeepAlive(backendConn)
+			return backendConn, nil
+		},
+		MaxIdleConnsPerHost: 1,
+		IdleConnTimeout:     90 * time.Second,
+	}
+	defer transport.CloseIdleConnections()
+
+	proxy := &httputil.ReverseProxy{
+		Rewrite: func(r *httputil.ProxyRequest) {
+			r.SetURL(&url.URL{Scheme: "http", Host: targetAddr})
+			r.Out.Host = r.In.Host
+			r.SetXForwarded()
+		},
+		Transport: transport,
+		ErrorHandler: func(w http.ResponseWriter, r *http.Request, err error) {
+			s.logger.Warn("backend request failed", "vmID", meta.ID, "targetAddr", targetAddr, "path", r.URL.Path, "error", err)
+			http.Error(w, "backend unavailable", http.StatusBadGateway)
+		},
+	}
+
+	var handlers sync.WaitGroup
+	cache := s.cacheFor(meta)
+	listener := newConnListener(conn)
+	server := &http.Server{
+		Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			handlers.Add(1)
+			defer handlers.Done()
+			cache.serve(w, r, proxy)
+		}),
+		ReadHeaderTimeout: 30 * time.Second,
+		ConnState: func(_ net.Conn, state http.ConnState) {
+			if state == http.StateClosed || state == http.StateHijacked {
+				listener.Close()
+			}
+		},
+	}
+	_ = server.Serve(listener)
+	handlers.Wait()
+}
+
+// connListener hands one accepted connection to an http.Server, then
+// blocks until closed.
+type connListener struct {
+	conn   net.Conn
+	once   sync.Once
+	accept chan net.Conn
+	closed chan struct{}
+}
+
+func newConnListener(conn net.Conn) *connListener {
+	listener := &connListener{conn: conn, accept: make(chan net.Conn, 1), closed: make(chan struct{})}
+	listener.accept <- conn
+	return listener
+}
+
+func (l *connListener) Accept() (net.Conn, error) {
+	select {
+	case conn := <-l.accept:
+		return conn, nil
+	case <-l.closed:
+		return nil, net.ErrClosed
+	}
+}
+
+func (l *connListener) Close() error {
+	l.once.Do(func() { close(l.closed) })
+	return nil
+}
+
+func (l *connListener) Addr() net.Addr {
+	return l.conn.LocalAddr()
+}
+
+// responseCache keeps a VM's cacheable responses in memory, evicting the
+// least recently used once maxBytes is reached. Only GET responses with a
+// 200 status and an explicit shared max-age are kept, as a shared cache in
+// front of the guest would: Cache-Control no-store, private and no-cache,
+// Set-Cookie and a Vary on anything but Accept-Encoding rule one out.
+type responseCache struct {
+	maxBytes  int
+	maxEntry  int
+	createdAt time.Time
+	now       func() time.Time
+
+	mu      sync.Mutex
+	size    int
+	order   *list.List
+	entries map[string]*list.Element
+}
+
+type cachedResponse struct {
+	key     string
+	header  http.Header
+	body    []byte
+	stored  time.Time
+	age     time.Duration
+	expires time.Time
+}
+
+func newResponseCache(maxBytes, maxEntry int) *responseCache {
+	return &responseCache{
+		maxBytes: maxBytes,
+		maxEntry: maxEntry,
+		now:      time.Now,
+		order:    list.New(),
+		entries:  map[string]*list.Element{},
+	}
+}
+
+// serve answers r from the cache when it holds a fresh response, and
+// otherwise passes it to next, keeping the response if it qualifies.
+func (c *responseCache) serve(w http.ResponseWriter, r *http.Request, next http.Handler) {
+	if !cacheableRequest(r) {
+		next.ServeHTTP(w, r)
+		return
+	}
+	key := cacheKey(r)
+	if !requestBypassesCache(r) {
+		if entry := c.get(key); entry != nil {
+			c.write(w, r, entry)
+			return
+		}
+	}
+	if r.Method != http.MethodGet {
+		next.ServeHTTP(w, r)
+		return
+	}
+	recorder := &cacheRecorder{ResponseWriter: w, limit: c.maxEntry}
+	next.ServeHTTP(recorder, r)
+	if entry := recorder.response(key, c.now()); entry != nil {
+		c.put(entry)
+	}
+}
+
+func (c *responseCache) get(key string) *cachedResponse {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	element, ok := c.entries[key]
+	if !ok {
+		return nil
+	}
+	entry := element.Value.(*cachedResponse)
+	if !c.now().Before(entry.expires) {
+		c.remove(element)
+		return nil
+	}
+	c.order.MoveToFront(element)
+	return entry
+}
+
+func (c *responseCache) put(entry *cachedResponse) {
+	size := entry.size()
+	if size > c.maxEntry || size > c.maxBytes {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if element, ok := c.entries[entry.key]; ok {
+		c.remove(element)
+	}
+	c.entries[entry.key] = c.order.PushFront(entry)
+	c.size += size
+	for c.size > c.maxBytes {
+		c.remove(c.order.Back())
+	}
+}
+
+func (c *responseCache) bytes() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.size
+}
+
+// remove drops element; the caller holds c.mu.
+func (c *responseCache) remove(element *list.Element) {
+	entry := c.order.Remove(element).(*cachedResponse)
+	delete(c.entries, entry.key)
+	c.size -= entry.size()
+}
+
+func (c *responseCache) write(w http.ResponseWriter, r *http.Request, entry *cachedResponse) {
+	header := w.Header()
+	for name, values := range entry.header {
+		header[name] = append([]string(nil), values...)
+	}
+	age := entry.age + c.now().Sub(entry.stored)
+	header.Set("Age", strconv.Itoa(int(age/time.Second)))
+	header.Set("X-Cache", "HIT")
+	if etag := entry.header.Get("ETag"); etag != "" && etagMatches(r.Header.Get("If-None-Match"), etag) {
+		header.Del("Content-Length")
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+	header.Set("Content-Length", strconv.Itoa(len(entry.body)))
+	w.WriteHeader(http.StatusOK)
+	if r.Method != http.MethodHead {
+		_, _ = w.Write(entry.body)
+	}
+}
+
+func (e *cachedResponse) size() int {
+	size := len(e.key) + len(e.body)
+	for name, values := range e.header {
+		size += len(name)
+		for _, value := range values {
+			size += len(value)
+		}
+	}
+	return size
+}
+
+// cacheableRequest reports whether r may be answered from or stored in the
+// cache at all.
+func cacheableRequest(r *http.Request) bool {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		return false
+	}
+	return r.Header.Get("Authorization") == "" && r.Header.Get("Range") == "" && r.Header.Get("Upgrade") == ""
+}
+
+// requestBypassesCache reports whether the client asked for a response
+// from the guest; the response is still stored for later requests.
+func requestBypassesCache(r *http.Request) bool {
+	directives := parseCacheControl(r.Header.Values("Cache-Control"))
+	_, noCache := directives["no-cache"]
+	_, noStore := directives["no-store"]
+	return noCache || noStore || strings.Contains(strings.ToLower(r.Header.Get("Pragma")), "no-cache")
+}
+
+// cacheKey is the request's host and URI, plus its Accept-Encoding since
+// that is the one Vary the cache honors.
+func cacheKey(r *http.Request) string {
+	return strings.ToLower(r.Host) + r.URL.RequestURI() + "\x00" + strings.Join(r.Header.Values("Accept-Encoding"), ",")
+}
+
+// cacheRecorder passes a response through to the client while keeping a
+// copy of it, as long as it can still be stored.
+type cacheRecorder struct {
+	http.ResponseWriter
+	limit     int
+	status    int
+	storable  bool
+	maxAge    time.Duration
+	body      []byte
+	header    http.Header
+	truncated bool
+}
+
+func (r *cacheRecorder) WriteHeader(status int) {
+	if r.status == 0 && status >= http.StatusOK {
+		r.status = status
+		r.header = r.ResponseWriter.Header().Clone()
+		r.maxAge, r.storable = storableResponse(status, r.header)
+	}
+	r.ResponseWriter.WriteHeader(status)
+}
+
+func (r *cacheRecorder) Write(p []byte) (int, error) {
+	if r.status == 0 {
+		r.WriteHeader(http.StatusOK)
+	}
+	if r.storable && !r.truncated {
+		if len(r.body)+len(p) > r.limit {
+			r.body, r.truncated = nil, true
+		} else {
+			r.body = append(r.body, p...)
+		}
+	}
+	return r.ResponseWriter.Write(p)
+}
+
+// Unwrap lets http.ResponseController reach the client's writer, which
+// the reverse proxy uses to flush.
+func (r *cacheRecorder) Unwrap() http.ResponseWriter {
+	return r.ResponseWriter
+}
+
+func (r *cacheRecorder) response(key string, now time.Time) *cachedResponse {
+	if !r.storable || r.truncated {
+		return nil
+	}
+	if length := r.header.Get("Content-Length"); length != "" && length != strconv.Itoa(len(r.body)) {
+		// The guest or the client gave up halfway through.
+		return nil
+	}
+	age := time.Duration(0)
+	if seconds, err := strconv.Atoi(r.header.Get("Age")); err == nil && seconds > 0 {
+		age = time.Duration(seconds) * time.Second
+	}
+	if age >= r.maxAge {
+		return nil
+	}
+	header := r.header
+	header.Del("Age")
+	header.Del("Content-Length")
+	return &cachedResponse{
+		key:     key,
+		header:  header,
+		body:    r.body,
+		stored:  now,
+		age:     age,
+		expires: now.Add(r.maxAge - age),
+	}
+}
+
+// storableResponse reports whether a response with status and header may
+// be kept, and for how long from when it was generated.
+func storableResponse(status int, header http.Header) (time.Duration, bool) {
+	if status != http.StatusOK || len(header.Values("Set-Cookie")) > 0 {
+		return 0, false
+	}
+	for _, vary := range header.Values("Vary") {
+		for _, field := range strings.Split(vary, ",") {
+			if field = strings.TrimSpace(field); field != "" && !strings.EqualFold(field, "Accept-Encoding") {
+				return 0, false
+			}
+		}
+	}
+	directives := parseCacheControl(header.Values("Cache-Control"))
+	for _, name := range []string{"no-store", "no-cache", "private"} {
+		if _, ok := directives[name]; ok {
+			return 0, false
+		}
+	}
+	raw, ok := directives["s-maxage"]
+	if !ok {
+		raw, ok = directives["max-age"]
+	}
+	if !ok {
+		return 0, false
+	}
+	seconds, err := strconv.Atoi(raw)
+	if err != nil || seconds <= 0 {
+		return 0, false
+	}
+	return time.Duration(seconds) * time.Second, true
+}
+
+// parseCacheControl splits Cache-Control header values into lowercased
+// directives and their (unquoted) arguments.
+func parseCacheControl(values []string) map[string]string {
+	directives := map[string]string{}
+	for _, value := range values {
+		for _, part := range strings.Split(value, ",") {
+			name, arg, _ := strings.Cut(strings.TrimSpace(part), "=")
+			if name = strings.ToLower(strings.TrimSpace(name)); name != "" {
+				directives[name] = strings.Trim(strings.TrimSpace(arg), `"`)
+			}
+		}
+	}
+	return directives
+}
+
+// etagMatches reports whether an If-None-Match header lists etag, using
+// the weak comparison conditional GETs call for.
+func etagMatches(ifNoneMatch, etag string) bool {
+	if ifNoneMatch == "" {
+		return false
+	}
+	etag = strings.TrimPrefix(etag, "W/")
+	for _, candidate := range strings.Split(ifNoneMatch, ",") {
+		candidate = strings.TrimSpace(candidate)
+		if candidate == "*" || strings.TrimPrefix(candidate, "W/") == etag {
+			return true
+		}
+	}
+	return false
+}
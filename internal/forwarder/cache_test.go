@@ -0,0 +1,198 @@
+package forwarder
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/alperreha/mergen-fire/internal/model"
+)
+
+// cacheBackend answers every path with its Cache-Control from headers and
+// counts the requests that reach it.
+type cacheBackend struct {
+	hits    int
+	headers map[string]http.Header
+}
+
+func (b *cacheBackend) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	b.hits++
+	for name, values := range b.headers[r.URL.Path] {
+		w.Header()[name] = values
+	}
+	_, _ = w.Write([]byte("body of " + r.URL.Path))
+}
+
+func fetch(t *testing.T, cache *responseCache, backend http.Handler, method, path string, header http.Header) *httptest.ResponseRecorder {
+	t.Helper()
+	request := httptest.NewRequest(method, "https://app1.example.com"+path, nil)
+	for name, values := range header {
+		request.Header[name] = values
+	}
+	recorder := httptest.NewRecorder()
+	cache.serve(recorder, request, backend)
+	return recorder
+}
+
+func TestResponseCacheHonorsCacheControl(t *testing.T) {
+	now := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+	cache := newResponseCache(1<<20, 1<<10)
+	cache.now = func() time.Time { return now }
+	backend := &cacheBackend{headers: map[string]http.Header{
+		"/app.js":      {"Cache-Control": {"public, max-age=60"}, "Etag": {`"v1"`}},
+		"/nostore.js":  {"Cache-Control": {"no-store"}},
+		"/private.js":  {"Cache-Control": {"private, max-age=60"}},
+		"/cookie.js":   {"Cache-Control": {"max-age=60"}, "Set-Cookie": {"session=1"}},
+		"/vary.js":     {"Cache-Control": {"max-age=60"}, "Vary": {"Cookie"}},
+		"/plain.html":  {},
+		"/shared.css":  {"Cache-Control": {"max-age=0, s-maxage=30"}},
+		"/stale.css":   {"Cache-Control": {"max-age=60"}, "Age": {"60"}},
+		"/encoded.css": {"Cache-Control": {"max-age=60"}, "Vary": {"Accept-Encoding"}},
+	}}
+
+	for _, path := range []string{"/app.js", "/nostore.js", "/private.js", "/cookie.js", "/vary.js", "/plain.html", "/shared.css", "/stale.css"} {
+		backend.hits = 0
+		fetch(t, cache, backend, http.MethodGet, path, nil)
+		second := fetch(t, cache, backend, http.MethodGet, path, nil)
+		if second.Body.String() != "body of "+path {
+			t.Fatalf("%s: unexpected body %q", path, second.Body.String())
+		}
+		wantHits := 2
+		if path == "/app.js" || path == "/shared.css" {
+			wantHits = 1
+		}
+		if backend.hits != wantHits {
+			t.Fatalf("%s: expected %d backend hits, got %d", path, wantHits, backend.hits)
+		}
+	}
+
+	now = now.Add(10 * time.Second)
+	hit := fetch(t, cache, backend, http.MethodGet, "/app.js", nil)
+	if hit.Header().Get("Age") != "10" || hit.Header().Get("X-Cache") != "HIT" || hit.Header().Get("Content-Length") != "15" {
+		t.Fatalf("unexpected cached headers: %v", hit.Header())
+	}
+	if got := fetch(t, cache, backend, http.MethodGet, "/app.js", http.Header{"If-None-Match": {`W/"v1"`}}); got.Code != http.StatusNotModified {
+		t.Fatalf("expected 304 for a matching etag, got %d", got.Code)
+	}
+	if got := fetch(t, cache, backend, http.MethodHead, "/app.js", nil); got.Body.Len() != 0 || got.Header().Get("X-Cache") != "HIT" {
+		t.Fatalf("expected a bodiless cached HEAD answer, got %q %v", got.Body.String(), got.Header())
+	}
+
+	backend.hits = 0
+	fetch(t, cache, backend, http.MethodGet, "/app.js", http.Header{"Cache-Control": {"no-cache"}})
+	fetch(t, cache, backend, http.MethodGet, "/app.js", http.Header{"Authorization": {"Bearer x"}})
+	if backend.hits != 2 {
+		t.Fatalf("expected no-cache and authorized requests to reach the guest, got %d hits", backend.hits)
+	}
+
+	backend.hits = 0
+	fetch(t, cache, backend, http.MethodGet, "/encoded.css", http.Header{"Accept-Encoding": {"gzip"}})
+	fetch(t, cache, backend, http.MethodGet, "/encoded.css", http.Header{"Accept-Encoding": {"br"}})
+	fetch(t, cache, backend, http.MethodGet, "/encoded.css", http.Header{"Accept-Encoding": {"gzip"}})
+	if backend.hits != 2 {
+		t.Fatalf("expected one guest request per accepted encoding, got %d", backend.hits)
+	}
+
+	now = now.Add(time.Minute)
+	backend.hits = 0
+	fetch(t, cache, backend, http.MethodGet, "/app.js", nil)
+	if backend.hits != 1 {
+		t.Fatalf("expected an expired response to be fetched again, got %d hits", backend.hits)
+	}
+}
+
+func TestResponseCacheEvictsLeastRecentlyUsed(t *testing.T) {
+	backend := &cacheBackend{headers: map[string]http.Header{}}
+	for _, path := range []string{"/a", "/b", "/c", "/big"} {
+		backend.headers[path] = http.Header{"Cache-Control": {"max-age=60"}}
+	}
+	backend.headers["/big"]["X-Padding"] = []string{strings.Repeat("x", 200)}
+	entrySize := func(path string) int {
+		probe := newResponseCache(1<<20, 1<<20)
+		fetch(t, probe, backend, http.MethodGet, path, nil)
+		return probe.size
+	}
+	cache := newResponseCache(2*entrySize("/a"), 1<<20)
+
+	fetch(t, cache, backend, http.MethodGet, "/a", nil)
+	fetch(t, cache, backend, http.MethodGet, "/b", nil)
+	fetch(t, cache, backend, http.MethodGet, "/a", nil)
+	fetch(t, cache, backend, http.MethodGet, "/c", nil)
+
+	backend.hits = 0
+	fetch(t, cache, backend, http.MethodGet, "/a", nil)
+	fetch(t, cache, backend, http.MethodGet, "/c", nil)
+	if backend.hits != 0 {
+		t.Fatalf("expected /a and /c to stay cached, got %d backend hits", backend.hits)
+	}
+	fetch(t, cache, backend, http.MethodGet, "/b", nil)
+	if backend.hits != 1 {
+		t.Fatalf("expected /b to have been evicted")
+	}
+
+	fetch(t, cache, backend, http.MethodGet, "/big", nil)
+	if _, ok := cache.entries[cacheKey(httptest.NewRequest(http.MethodGet, "https://app1.example.com/big", nil))]; ok {
+		t.Fatalf("expected a response larger than the cache not to be stored")
+	}
+}
+
+func TestCacheEnabledReadsListenerTag(t *testing.T) {
+	if cacheEnabled(model.VMMetadata{}, httpsListener) {
+		t.Fatalf("expected caching to be off without a tag")
+	}
+	if !cacheEnabled(model.VMMetadata{Tags: map[string]string{"cache.https": "on"}}, httpsListener) {
+		t.Fatalf("expected cache.https=on to turn caching on")
+	}
+	if cacheEnabled(model.VMMetadata{Tags: map[string]string{"cache.https": "off"}}, httpsListener) {
+		t.Fatalf("expected cache.https=off to leave caching off")
+	}
+}
+
+func TestResolverRefreshDropsCachesOfRemovedVMs(t *testing.T) {
+	created := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+	kept := model.VMMetadata{ID: "11111111-0000-0000-0000-000000000000", CreatedAt: created, Tags: map[string]string{"app": "kept"}}
+	gone := model.VMMetadata{ID: "22222222-0000-0000-0000-000000000000", CreatedAt: created, Tags: map[string]string{"app": "gone"}}
+	vms := []model.VMMetadata{kept, gone}
+
+	resolver := NewResolver("", "", "localhost", time.Hour, nil)
+	resolver.source = func() ([]model.VMMetadata, error) { return append([]model.VMMetadata(nil), vms...), nil }
+	server := &Server{
+		config:   Config{CacheMaxBytes: 1 << 20, CacheMaxEntryBytes: 1 << 10},
+		resolver: resolver,
+		logger:   resolver.logger,
+		caches:   map[string]*responseCache{},
+	}
+	resolver.OnRefresh(server.pruneCaches)
+
+	for _, meta := range vms {
+		if _, err := resolver.Resolve(meta.Tags["app"] + ".localhost"); err != nil {
+			t.Fatalf("resolve %s: %v", meta.ID, err)
+		}
+		fetch(t, server.cacheFor(meta), &cacheBackend{headers: map[string]http.Header{"/a.js": {"Cache-Control": {"max-age=60"}}}}, http.MethodGet, "/a.js", nil)
+	}
+	if len(server.caches) != 2 {
+		t.Fatalf("expected two caches, got %d", len(server.caches))
+	}
+
+	vms = []model.VMMetadata{kept}
+	resolver.Invalidate()
+	if _, err := resolver.Resolve("kept.localhost"); err != nil {
+		t.Fatalf("resolve after delete: %v", err)
+	}
+	if _, ok := server.caches[gone.ID]; ok || len(server.caches) != 1 {
+		t.Fatalf("expected only the kept vm's cache, got %v", server.caches)
+	}
+
+	recreated := kept
+	recreated.CreatedAt = created.Add(time.Minute)
+	vms = []model.VMMetadata{recreated}
+	resolver.Invalidate()
+	if _, err := resolver.Resolve("kept.localhost"); err != nil {
+		t.Fatalf("resolve after recreate: %v", err)
+	}
+	if len(server.caches) != 0 {
+		t.Fatalf("expected the recreated vm's old cache to be dropped, got %v", server.caches)
+	}
+}
@@ -3,35 +3,137 @@ package forwarder
 import (
 	"fmt"
 	"net"
+	"net/url"
 	"os"
 	"strconv"
 	"strings"
 	"time"
+
+	"github.com/alperreha/mergen-fire/internal/config"
+	"github.com/alperreha/mergen-fire/internal/logging"
 )
 
 type Config struct {
-	ConfigRoot       string
-	NetNSRoot        string
-	CertFile         string
-	KeyFile          string
+	ConfigRoot string
+	// MergendURL, when set, makes the resolver list VMs from mergend's API
+	// instead of reading ConfigRoot. MergendToken is sent as its bearer
+	// token; a read-scoped one is enough.
+	MergendURL   string
+	MergendToken string
+	NetNSRoot    string
+	CertFile     string
+	KeyFile      string
+	// VMCertDir is mergend's certificate dir (MGR_CERT_DIR); when set,
+	// VMs' custom domains get their own certificates and ACME tls-alpn-01
+	// validations are answered on the HTTPS listener.
+	VMCertDir        string
 	HTTPSAddr        string
 	DomainPrefix     string
 	DomainSuffix     string
 	LogLevel         string
+	LogLevels        map[string]string
+	LogOutput        logging.Output
 	LogFormat        string
 	DialTimeout      time.Duration
 	ResolverCacheTTL time.Duration
 	ShutdownTimeout  time.Duration
+	// KeepAlive applies to both the client and the backend leg of every
+	// routed connection; a leg failing its probes closes the other one.
+	KeepAlive net.KeepAliveConfig
+	// ACL applies to every listener and ListenerACLs, keyed by listener
+	// name, to one; both are checked on accept, before the TLS handshake.
+	// GeoIPFile locates sources for their country lists.
+	ACL          ACL
+	ListenerACLs map[string]ACL
+	GeoIPFile    string
+	// DebugAddr, when set, serves routing traces over plain HTTP and makes
+	// the server keep the last TraceBuffer connection traces.
+	DebugAddr   string
+	TraceBuffer int
+	// CacheMaxBytes bounds the response cache of each VM tagged
+	// cache.https=on, and CacheMaxEntryBytes a single response in it;
+	// zero turns caching off for every VM.
+	CacheMaxBytes      int
+	CacheMaxEntryBytes int
+	// WakeTimeout bounds how long a connection to a VM stopped for
+	// idleness waits for it to boot, and ActivityReport is how often
+	// traffic to such VMs is reported; both need MergendURL.
+	WakeTimeout    time.Duration
+	ActivityReport time.Duration
+}
+
+// FileKeys maps forwarder config file keys to env vars.
+var FileKeys = map[string]string{
+	"configRoot":                         "FWD_CONFIG_ROOT",
+	"mergendURL":                         "FWD_MERGEND_URL",
+	"mergendToken":                       "FWD_MERGEND_TOKEN",
+	"netnsRoot":                          "FWD_NETNS_ROOT",
+	"httpsAddr":                          "FWD_HTTPS_ADDR",
+	"tls.certFile":                       "FWD_TLS_CERT_FILE",
+	"tls.keyFile":                        "FWD_TLS_KEY_FILE",
+	"tls.vmCertDir":                      "FWD_VM_CERT_DIR",
+	"domain.prefix":                      "FWD_DOMAIN_PREFIX",
+	"domain.suffix":                      "FWD_DOMAIN_SUFFIX",
+	"log.level":                          "FWD_LOG_LEVEL",
+	"log.components":                     "FWD_LOG_LEVELS",
+	"log.file":                           "FWD_LOG_FILE",
+	"log.stdout":                         "FWD_LOG_STDOUT",
+	"log.rotation.maxSizeMiB":            "FWD_LOG_FILE_MAX_SIZE_MIB",
+	"log.rotation.rotateHours":           "FWD_LOG_FILE_ROTATE_HOURS",
+	"log.rotation.maxAgeDays":            "FWD_LOG_FILE_MAX_AGE_DAYS",
+	"log.rotation.maxFiles":              "FWD_LOG_FILE_MAX_FILES",
+	"log.rotation.compress":              "FWD_LOG_FILE_COMPRESS",
+	"log.format":                         "FWD_LOG_FORMAT",
+	"dialTimeoutSeconds":                 "FWD_DIAL_TIMEOUT_SECONDS",
+	"resolverCacheTTLSeconds":            "FWD_RESOLVER_CACHE_TTL_SECONDS",
+	"shutdownTimeoutSeconds":             "FWD_SHUTDOWN_TIMEOUT_SECONDS",
+	"keepalive.idleSeconds":              "FWD_KEEPALIVE_IDLE_SECONDS",
+	"keepalive.intervalSeconds":          "FWD_KEEPALIVE_INTERVAL_SECONDS",
+	"keepalive.count":                    "FWD_KEEPALIVE_COUNT",
+	"acl.allow":                          "FWD_ACL_ALLOW",
+	"acl.deny":                           "FWD_ACL_DENY",
+	"acl.allowCountries":                 "FWD_ACL_ALLOW_COUNTRIES",
+	"acl.denyCountries":                  "FWD_ACL_DENY_COUNTRIES",
+	"listeners.https.acl.allow":          "FWD_HTTPS_ACL_ALLOW",
+	"listeners.https.acl.deny":           "FWD_HTTPS_ACL_DENY",
+	"listeners.https.acl.allowCountries": "FWD_HTTPS_ACL_ALLOW_COUNTRIES",
+	"listeners.https.acl.denyCountries":  "FWD_HTTPS_ACL_DENY_COUNTRIES",
+	"geoip.file":                         "FWD_GEOIP_FILE",
+	"debug.addr":                         "FWD_DEBUG_ADDR",
+	"debug.traceBuffer":                  "FWD_TRACE_BUFFER",
+	"cache.maxBytes":                     "FWD_CACHE_MAX_BYTES",
+	"cache.maxEntryBytes":                "FWD_CACHE_MAX_ENTRY_BYTES",
+	"idle.wakeTimeoutSeconds":            "FWD_WAKE_TIMEOUT_SECONDS",
+	"idle.activityReportSeconds":         "FWD_ACTIVITY_REPORT_SECONDS",
 }
 
 func FromEnv() (Config, error) {
-	httpsAddr, err := normalizeListenAddr(getEnv("FWD_HTTPS_ADDR", ":443"))
+	return load(os.LookupEnv, false)
+}
+
+// Load is FromEnv with the config file at path, if any, and rejects
+// malformed numbers.
+func Load(path string) (Config, error) {
+	var file map[string]string
+	if strings.TrimSpace(path) != "" {
+		values, err := config.ReadFile(path, FileKeys)
+		if err != nil {
+			return Config{}, err
+		}
+		file = values
+	}
+	return load(config.Overlay(file), true)
+}
+
+func load(lookup func(string) (string, bool), strict bool) (Config, error) {
+	env := envReader{lookup: lookup}
+	httpsAddr, err := normalizeListenAddr(env.get("FWD_HTTPS_ADDR", ":443"))
 	if err != nil {
 		return Config{}, err
 	}
 
-	domainPrefix := normalizeDomainPart(getEnv("FWD_DOMAIN_PREFIX", ""))
-	domainSuffix := normalizeDomainPart(getEnv("FWD_DOMAIN_SUFFIX", "localhost"))
+	domainPrefix := normalizeDomainPart(env.get("FWD_DOMAIN_PREFIX", ""))
+	domainSuffix := normalizeDomainPart(env.get("FWD_DOMAIN_SUFFIX", "localhost"))
 	if domainSuffix == "" {
 		return Config{}, fmt.Errorf("FWD_DOMAIN_SUFFIX cannot be empty")
 	}
@@ -39,23 +141,114 @@ func FromEnv() (Config, error) {
 	defaultCertBase := domainBase(domainPrefix, domainSuffix)
 
 	cfg := Config{
-		ConfigRoot:       getEnv("FWD_CONFIG_ROOT", "/etc/mergen/vm.d"),
-		NetNSRoot:        getEnv("FWD_NETNS_ROOT", "/run/netns"),
-		CertFile:         getEnv("FWD_TLS_CERT_FILE", "/etc/mergen/certs/wildcard."+defaultCertBase+".crt"),
-		KeyFile:          getEnv("FWD_TLS_KEY_FILE", "/etc/mergen/certs/wildcard."+defaultCertBase+".key"),
+		ConfigRoot:       env.get("FWD_CONFIG_ROOT", "/etc/mergen/vm.d"),
+		MergendURL:       strings.TrimSpace(env.get("FWD_MERGEND_URL", "")),
+		MergendToken:     strings.TrimSpace(env.get("FWD_MERGEND_TOKEN", "")),
+		NetNSRoot:        env.get("FWD_NETNS_ROOT", "/run/netns"),
+		CertFile:         env.get("FWD_TLS_CERT_FILE", "/etc/mergen/certs/wildcard."+defaultCertBase+".crt"),
+		KeyFile:          env.get("FWD_TLS_KEY_FILE", "/etc/mergen/certs/wildcard."+defaultCertBase+".key"),
+		VMCertDir:        strings.TrimSpace(env.get("FWD_VM_CERT_DIR", "")),
 		HTTPSAddr:        httpsAddr,
 		DomainPrefix:     domainPrefix,
 		DomainSuffix:     domainSuffix,
-		LogLevel:         getEnv("FWD_LOG_LEVEL", "debug"),
-		LogFormat:        getEnv("FWD_LOG_FORMAT", "console"),
-		DialTimeout:      time.Duration(getEnvInt("FWD_DIAL_TIMEOUT_SECONDS", 5)) * time.Second,
-		ResolverCacheTTL: time.Duration(getEnvInt("FWD_RESOLVER_CACHE_TTL_SECONDS", 5)) * time.Second,
-		ShutdownTimeout:  time.Duration(getEnvInt("FWD_SHUTDOWN_TIMEOUT_SECONDS", 15)) * time.Second,
+		LogLevel:         env.get("FWD_LOG_LEVEL", "debug"),
+		LogFormat:        env.get("FWD_LOG_FORMAT", "console"),
+		DialTimeout:      time.Duration(env.getInt("FWD_DIAL_TIMEOUT_SECONDS", 5)) * time.Second,
+		ResolverCacheTTL: time.Duration(env.getInt("FWD_RESOLVER_CACHE_TTL_SECONDS", 5)) * time.Second,
+		ShutdownTimeout:  time.Duration(env.getInt("FWD_SHUTDOWN_TIMEOUT_SECONDS", 15)) * time.Second,
+		KeepAlive: net.KeepAliveConfig{
+			Idle:     time.Duration(env.getInt("FWD_KEEPALIVE_IDLE_SECONDS", 30)) * time.Second,
+			Interval: time.Duration(env.getInt("FWD_KEEPALIVE_INTERVAL_SECONDS", 10)) * time.Second,
+			Count:    env.getInt("FWD_KEEPALIVE_COUNT", 3),
+		},
+		GeoIPFile:          env.get("FWD_GEOIP_FILE", ""),
+		DebugAddr:          strings.TrimSpace(env.get("FWD_DEBUG_ADDR", "")),
+		TraceBuffer:        env.getInt("FWD_TRACE_BUFFER", defaultTraceSize),
+		CacheMaxBytes:      env.getInt("FWD_CACHE_MAX_BYTES", 16<<20),
+		CacheMaxEntryBytes: env.getInt("FWD_CACHE_MAX_ENTRY_BYTES", 1<<20),
+		WakeTimeout:        time.Duration(env.getInt("FWD_WAKE_TIMEOUT_SECONDS", 20)) * time.Second,
+		ActivityReport:     time.Duration(env.getInt("FWD_ACTIVITY_REPORT_SECONDS", 30)) * time.Second,
+		LogOutput: logging.Output{
+			File:        env.get("FWD_LOG_FILE", ""),
+			Stdout:      env.getBool("FWD_LOG_STDOUT", env.get("FWD_LOG_FILE", "") == ""),
+			MaxSizeMiB:  env.getInt("FWD_LOG_FILE_MAX_SIZE_MIB", 100),
+			RotateEvery: time.Duration(env.getInt("FWD_LOG_FILE_ROTATE_HOURS", 24)) * time.Hour,
+			MaxAgeDays:  env.getInt("FWD_LOG_FILE_MAX_AGE_DAYS", 14),
+			MaxFiles:    env.getInt("FWD_LOG_FILE_MAX_FILES", 7),
+			Compress:    env.getBool("FWD_LOG_FILE_COMPRESS", true),
+		},
+	}
+	if strict && env.err != nil {
+		return Config{}, env.err
+	}
+	// Zero idle time turns keepalive off; the other fields need a value
+	// then, since the OS defaults are what this replaces.
+	cfg.KeepAlive.Enable = cfg.KeepAlive.Idle > 0
+	if cfg.KeepAlive.Enable && (cfg.KeepAlive.Interval <= 0 || cfg.KeepAlive.Count <= 0) {
+		return Config{}, fmt.Errorf("FWD_KEEPALIVE_INTERVAL_SECONDS and FWD_KEEPALIVE_COUNT must be positive when keepalive is on")
+	}
+	if cfg.CacheMaxBytes < 0 || cfg.CacheMaxEntryBytes <= 0 {
+		return Config{}, fmt.Errorf("FWD_CACHE_MAX_BYTES cannot be negative and FWD_CACHE_MAX_ENTRY_BYTES must be positive")
+	}
+	// The API client gives up on a request after 30s.
+	if cfg.WakeTimeout <= 0 || cfg.WakeTimeout > 25*time.Second {
+		return Config{}, fmt.Errorf("FWD_WAKE_TIMEOUT_SECONDS must be between 1 and 25")
+	}
+	if cfg.ACL, err = loadACL(&env, "FWD_ACL"); err != nil {
+		return Config{}, err
+	}
+	cfg.ListenerACLs = map[string]ACL{}
+	for _, listener := range []string{httpsListener} {
+		acl, err := loadACL(&env, "FWD_"+strings.ToUpper(listener)+"_ACL")
+		if err != nil {
+			return Config{}, err
+		}
+		if !acl.empty() {
+			cfg.ListenerACLs[listener] = acl
+		}
+	}
+	usesCountries := cfg.ACL.usesCountries()
+	for _, acl := range cfg.ListenerACLs {
+		usesCountries = usesCountries || acl.usesCountries()
+	}
+	if usesCountries && cfg.GeoIPFile == "" {
+		return Config{}, fmt.Errorf("country ACLs need FWD_GEOIP_FILE")
+	}
+	if cfg.MergendURL != "" {
+		parsed, err := url.Parse(cfg.MergendURL)
+		if err != nil || (parsed.Scheme != "http" && parsed.Scheme != "https") || parsed.Host == "" {
+			return Config{}, fmt.Errorf("invalid FWD_MERGEND_URL %q: want http(s)://host[:port]", cfg.MergendURL)
+		}
+	}
+	if strict && cfg.LogOutput.File == "" && !cfg.LogOutput.Stdout {
+		return Config{}, fmt.Errorf("FWD_LOG_STDOUT=false needs FWD_LOG_FILE, otherwise nothing is logged")
+	}
+	if raw := env.get("FWD_LOG_LEVELS", ""); raw != "" {
+		levels, err := logging.ParseComponentLevels(raw)
+		if err != nil && strict {
+			return Config{}, fmt.Errorf("FWD_LOG_LEVELS: %w", err)
+		}
+		cfg.LogLevels = levels
 	}
 
 	return cfg, nil
 }
 
+// loadACL reads the <prefix>_ALLOW, _DENY, _ALLOW_COUNTRIES and
+// _DENY_COUNTRIES settings.
+func loadACL(env *envReader, prefix string) (ACL, error) {
+	acl, err := ParseACL(
+		env.get(prefix+"_ALLOW", ""),
+		env.get(prefix+"_DENY", ""),
+		env.get(prefix+"_ALLOW_COUNTRIES", ""),
+		env.get(prefix+"_DENY_COUNTRIES", ""),
+	)
+	if err != nil {
+		return ACL{}, fmt.Errorf("%s_*: %w", prefix, err)
+	}
+	return acl, nil
+}
+
 func domainBase(prefix, suffix string) string {
 	if prefix == "" {
 		return suffix
@@ -88,20 +281,43 @@ func normalizeListenAddr(raw string) (string, error) {
 	return addr, nil
 }
 
-func getEnv(key, fallback string) string {
-	if value, ok := os.LookupEnv(key); ok && strings.TrimSpace(value) != "" {
+type envReader struct {
+	lookup func(string) (string, bool)
+	err    error
+}
+
+func (e *envReader) get(key, fallback string) string {
+	if value, ok := e.lookup(key); ok && strings.TrimSpace(value) != "" {
 		return value
 	}
 	return fallback
 }
 
-func getEnvInt(key string, fallback int) int {
-	value, ok := os.LookupEnv(key)
+func (e *envReader) getInt(key string, fallback int) int {
+	value, ok := e.lookup(key)
 	if !ok || strings.TrimSpace(value) == "" {
 		return fallback
 	}
 	parsed, err := strconv.Atoi(value)
 	if err != nil {
+		if e.err == nil {
+			e.err = fmt.Errorf("%s: invalid integer %q", key, value)
+		}
+		return fallback
+	}
+	return parsed
+}
+
+func (e *envReader) getBool(key string, fallback bool) bool {
+	value, ok := e.lookup(key)
+	if !ok || strings.TrimSpace(value) == "" {
+		return fallback
+	}
+	parsed, err := strconv.ParseBool(strings.TrimSpace(value))
+	if err != nil {
+		if e.err == nil {
+			e.err = fmt.Errorf("%s: invalid boolean %q", key, value)
+		}
 		return fallback
 	}
 	return parsed
@@ -0,0 +1,52 @@
+package forwarder
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// DebugHandler serves routing traces on the debug listener:
+//
+//	GET /debug/traces?serverName=app1.example.com&limit=20
+//	GET /debug/route?serverName=app1.example.com
+//
+// The first lists recent connection traces, newest first; the second
+// traces how a name would be routed now, without dialing the VM.
+func (s *Server) DebugHandler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /debug/traces", func(w http.ResponseWriter, r *http.Request) {
+		limit := 0
+		if raw := r.URL.Query().Get("limit"); raw != "" {
+			parsed, err := strconv.Atoi(raw)
+			if err != nil || parsed < 0 {
+				writeDebugJSON(w, http.StatusBadRequest, map[string]string{"error": "limit must be a non-negative integer"})
+				return
+			}
+			limit = parsed
+		}
+		items := []RouteTrace{}
+		if s.traces != nil {
+			items = s.traces.List(r.URL.Query().Get("serverName"), limit)
+		}
+		writeDebugJSON(w, http.StatusOK, map[string]any{"items": items})
+	})
+	mux.HandleFunc("GET /debug/route", func(w http.ResponseWriter, r *http.Request) {
+		serverName := strings.TrimSpace(r.URL.Query().Get("serverName"))
+		if serverName == "" {
+			writeDebugJSON(w, http.StatusBadRequest, map[string]string{"error": "serverName is required"})
+			return
+		}
+		writeDebugJSON(w, http.StatusOK, ExplainRoute(s.resolver, s.dialer, serverName))
+	})
+	return mux
+}
+
+func writeDebugJSON(w http.ResponseWriter, status int, body any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+	_ = encoder.Encode(body)
+}
@@ -0,0 +1,117 @@
+package forwarder
+
+import (
+	"context"
+	"time"
+
+	"github.com/alperreha/mergen-fire/internal/model"
+)
+
+// Waker starts VMs stopped for idleness and hears of the traffic that keeps
+// them running; mergend's API client is one.
+type Waker interface {
+	WakeVM(ctx context.Context, id string, port int, timeout time.Duration) error
+	ReportActivity(ctx context.Context, ids []string) error
+}
+
+// vmActivity is the traffic to one VM since the last activity report.
+type vmActivity struct {
+	open int
+	seen bool
+}
+
+// WithWaker has connections to a stopped VM with an idle timeout wake it,
+// waiting up to timeout for its guest port, and RunActivityReports report
+// traffic through w. Without a waker such VMs are routed like any other.
+func (s *Server) WithWaker(w Waker, timeout time.Duration) *Server {
+	s.waker, s.wakeTimeout = w, timeout
+	return s
+}
+
+// wakes reports whether connections to meta's VM are tracked and may wake
+// it.
+func (s *Server) wakes(meta model.VMMetadata) bool {
+	return s.waker != nil && meta.IdleTimeoutMinutes > 0
+}
+
+// wake starts meta's VM and waits until port accepts connections.
+func (s *Server) wake(meta model.VMMetadata, port int, trace *RouteTrace) error {
+	ctx, cancel := context.WithTimeout(context.Background(), s.wakeTimeout+5*time.Second)
+	defer cancel()
+	started := time.Now()
+	err := s.waker.WakeVM(ctx, meta.ID, port, s.wakeTimeout)
+	trace.add("wake", err, "vm idle-stopped, woken in %s", time.Since(started).Round(time.Millisecond))
+	if err != nil {
+		s.logger.Warn("vm wake failed", "vmID", meta.ID, "port", port, "error", err)
+		return err
+	}
+	s.logger.Info("vm woken for connection", "vmID", meta.ID, "duration", time.Since(started).String())
+	return nil
+}
+
+// trackActivity counts an open connection to the VM until the returned func
+// is called.
+func (s *Server) trackActivity(id string) func() {
+	s.activityMu.Lock()
+	activity, ok := s.activity[id]
+	if !ok {
+		activity = &vmActivity{}
+		s.activity[id] = activity
+	}
+	activity.open++
+	activity.seen = true
+	s.activityMu.Unlock()
+	return func() {
+		s.activityMu.Lock()
+		activity.open--
+		s.activityMu.Unlock()
+	}
+}
+
+// RunActivityReports reports, each interval until ctx ends, the VMs with an
+// idle timeout that had connections since the last report or still have
+// open ones, so mergend does not stop them for idleness.
+func (s *Server) RunActivityReports(ctx context.Context, interval time.Duration) {
+	if s.waker == nil || interval <= 0 {
+		return
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		ids := s.activeVMs()
+		if len(ids) == 0 {
+			continue
+		}
+		if err := s.waker.ReportActivity(ctx, ids); err != nil {
+			s.logger.Warn("vm activity report failed", "count", len(ids), "error", err)
+			s.activityMu.Lock()
+			for _, id := range ids {
+				if activity, ok := s.activity[id]; ok {
+					activity.seen = true
+				}
+			}
+			s.activityMu.Unlock()
+		}
+	}
+}
+
+// activeVMs returns the VMs to report and starts a new report period.
+func (s *Server) activeVMs() []string {
+	s.activityMu.Lock()
+	defer s.activityMu.Unlock()
+	var ids []string
+	for id, activity := range s.activity {
+		if !activity.seen && activity.open == 0 {
+			delete(s.activity, id)
+			continue
+		}
+		ids = append(ids, id)
+		activity.seen = false
+	}
+	return ids
+}
@@ -75,6 +75,16 @@ func (d NetNSDialer) DialContext(ctx context.Context, network, address, netns st
 	return dialer.DialContext(ctx, network, address)
 }
 
+// NetNSPath returns the namespace file a dial into netns would enter.
+func (d NetNSDialer) NetNSPath(netns string) (string, error) {
+	path, target, err := d.openTargetNS(netns)
+	if err != nil {
+		return "", err
+	}
+	_ = target.Close()
+	return path, nil
+}
+
 func (d NetNSDialer) openTargetNS(netns string) (string, *os.File, error) {
 	var lastErr error
 	for _, root := range d.roots {
@@ -1,6 +1,7 @@
 package forwarder
 
 import (
+	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
@@ -17,69 +18,182 @@ import (
 
 var ErrVMNotFound = errors.New("vm not found for requested host")
 
+// apiListTimeout bounds one VM listing from mergend; Resolve waits for it
+// when the cache has expired.
+const apiListTimeout = 10 * time.Second
+
+// VMLister lists VM summaries with only the named fields, as
+// pkg/client.Client does against mergend's GET /v1/vms.
+type VMLister interface {
+	ListVMs(ctx context.Context, fields ...string) ([]model.VMSummary, error)
+}
+
 type Resolver struct {
-	configRoot   string
-	domainPrefix string
-	domainSuffix string
-	domainTail   string
-	cacheTTL     time.Duration
-	logger       *slog.Logger
+	configRoot string
+	source     func() ([]model.VMMetadata, error)
+	cacheTTL   time.Duration
+	logger     *slog.Logger
 
 	mu         sync.RWMutex
+	domainTail string
 	cacheUntil time.Time
 	cache      map[string]model.VMMetadata
-	ordered    []model.VMMetadata
+	// domains maps VMs' custom domains, matched as whole server names.
+	domains map[string]model.VMMetadata
+	ordered []model.VMMetadata
+	// shadowed lists, per alias, the VMs that also claimed it but lost to
+	// an older VM; traces report them.
+	shadowed  map[string][]string
+	refreshed time.Time
+	// refreshing is closed when the fetch in flight ends; nil when none
+	// is. The fetch runs without mu, so lookups are not held up by a slow
+	// source. staleFetch is set when Invalidate runs meanwhile.
+	refreshing chan struct{}
+	refreshErr error
+	staleFetch bool
+	// onRefresh is called with the routable VMs after each rebuild.
+	onRefresh func([]model.VMMetadata)
 }
 
 func NewResolver(configRoot, domainPrefix, domainSuffix string, cacheTTL time.Duration, logger *slog.Logger) *Resolver {
 	if logger == nil {
 		logger = slog.Default()
 	}
+	if cacheTTL <= 0 {
+		cacheTTL = 5 * time.Second
+	}
+
+	r := &Resolver{
+		configRoot: configRoot,
+		domainTail: domainTail(domainPrefix, domainSuffix),
+		cacheTTL:   cacheTTL,
+		logger:     logger,
+		cache:      map[string]model.VMMetadata{},
+		ordered:    nil,
+	}
+	r.source = r.readAllMetas
+	return r
+}
+
+// NewAPIResolver resolves against mergend's VM list instead of meta.json
+// files, so the forwarder needs no access to the config root. Follow the
+// API's event stream to invalidate the cache.
+func NewAPIResolver(api VMLister, domainPrefix, domainSuffix string, cacheTTL time.Duration, logger *slog.Logger) *Resolver {
+	r := NewResolver("", domainPrefix, domainSuffix, cacheTTL, logger)
+	r.source = func() ([]model.VMMetadata, error) {
+		ctx, cancel := context.WithTimeout(context.Background(), apiListTimeout)
+		defer cancel()
+		vms, err := api.ListVMs(ctx, "createdAt", "network", "tags", "metadata", "deletion", "domains", "desiredState", "idleTimeoutMinutes")
+		if err != nil {
+			return nil, fmt.Errorf("list vms from mergend: %w", err)
+		}
+		metas := make([]model.VMMetadata, 0, len(vms))
+		for _, vm := range vms {
+			metas = append(metas, metaFromSummary(vm))
+		}
+		return metas, nil
+	}
+	return r
+}
+
+// metaFromSummary keeps the summary fields routing, aliasing and waking
+// read.
+func metaFromSummary(vm model.VMSummary) model.VMMetadata {
+	return model.VMMetadata{
+		ID:        vm.ID,
+		CreatedAt: vm.CreatedAt,
+		Ports:     vm.Network.Ports,
+		HTTPPort:  vm.Network.HTTPPort,
+		GuestIP:   vm.Network.GuestIP,
+		TapName:   vm.Network.TapName,
+		NetNS:     vm.Network.NetNS,
+		Metadata:  vm.Metadata,
+		Tags:      vm.Tags,
+		Deletion:  vm.Deletion,
+		Domains:   vm.Domains,
+
+		DesiredState:       vm.DesiredState,
+		IdleTimeoutMinutes: vm.IdleTimeoutMinutes,
+	}
+}
+
+// SetDomains changes the SNI suffix VMs are routed under, e.g. on config
+// reload.
+func (r *Resolver) SetDomains(domainPrefix, domainSuffix string) {
+	tail := domainTail(domainPrefix, domainSuffix)
+	r.mu.Lock()
+	r.domainTail = tail
+	r.mu.Unlock()
+}
+
+func domainTail(domainPrefix, domainSuffix string) string {
 	domainPrefix = normalizeDomainPart(domainPrefix)
 	domainSuffix = normalizeDomainPart(domainSuffix)
 	if domainSuffix == "" {
 		domainSuffix = "localhost"
 	}
-	if cacheTTL <= 0 {
-		cacheTTL = 5 * time.Second
-	}
-
 	tail := "." + domainSuffix
 	if domainPrefix != "" {
 		tail = "." + domainPrefix + tail
 	}
-
-	return &Resolver{
-		configRoot:   configRoot,
-		domainPrefix: domainPrefix,
-		domainSuffix: domainSuffix,
-		domainTail:   tail,
-		cacheTTL:     cacheTTL,
-		logger:       logger,
-		cache:        map[string]model.VMMetadata{},
-		ordered:      nil,
-	}
+	return tail
 }
 
 func (r *Resolver) Resolve(serverName string) (model.VMMetadata, error) {
+	return r.resolve(serverName, nil)
+}
+
+// resolve is Resolve recording each step into trace, which may be nil.
+func (r *Resolver) resolve(serverName string, trace *RouteTrace) (model.VMMetadata, error) {
+	if meta, ok := r.resolveDomain(serverName); ok {
+		trace.add("domain", nil, "custom domain of vm %s", meta.ID)
+		trace.add("meta", nil, "vm %s guestIP %s netns %q httpPort %d", meta.ID, meta.GuestIP, meta.NetNS, meta.HTTPPort)
+		return meta, nil
+	}
 	label, err := r.labelFromServerName(serverName)
+	r.mu.RLock()
+	tail := r.domainTail
+	r.mu.RUnlock()
+	trace.add("label", err, "label %q under domain tail %q", label, tail)
 	if err != nil {
 		return model.VMMetadata{}, err
 	}
 
-	if err := r.refreshCacheIfNeeded(); err != nil {
-		return model.VMMetadata{}, err
-	}
-
+	err = r.refreshCacheIfNeeded()
 	r.mu.RLock()
+	trace.add("cache", err, "%d aliases for %d vms, refreshed %s", len(r.cache), len(r.ordered), r.refreshed.Format(time.RFC3339))
 	meta, ok := r.cache[label]
+	shadowed := r.shadowed[label]
 	r.mu.RUnlock()
+	if err != nil {
+		return model.VMMetadata{}, err
+	}
 	if !ok {
-		return model.VMMetadata{}, fmt.Errorf("%w: %s", ErrVMNotFound, serverName)
+		err := fmt.Errorf("%w: %s", ErrVMNotFound, serverName)
+		trace.add("alias", err, "no vm has alias %q", label)
+		return model.VMMetadata{}, err
 	}
+	trace.add("alias", nil, "alias %q from %s of vm %s", label, aliasSource(meta, label), meta.ID)
+	if len(shadowed) > 0 {
+		trace.add("shadowed", nil, "alias %q is also claimed by %s; the oldest vm wins", label, strings.Join(shadowed, ", "))
+	}
+	trace.add("meta", nil, "vm %s guestIP %s netns %q httpPort %d", meta.ID, meta.GuestIP, meta.NetNS, meta.HTTPPort)
 	return meta, nil
 }
 
+// resolveDomain looks serverName up among VMs' custom domains. A refresh
+// error is left to the alias lookup that follows to report.
+func (r *Resolver) resolveDomain(serverName string) (model.VMMetadata, bool) {
+	name := strings.TrimSuffix(strings.ToLower(strings.TrimSpace(serverName)), ".")
+	if name == "" || r.refreshCacheIfNeeded() != nil {
+		return model.VMMetadata{}, false
+	}
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	meta, ok := r.domains[name]
+	return meta, ok
+}
+
 func (r *Resolver) ResolveFirst() (model.VMMetadata, error) {
 	if err := r.refreshCacheIfNeeded(); err != nil {
 		return model.VMMetadata{}, err
@@ -93,41 +207,127 @@ func (r *Resolver) ResolveFirst() (model.VMMetadata, error) {
 	return r.ordered[0], nil
 }
 
+// OnRefresh registers fn to be called, outside the resolver's lock, with
+// the routable VMs each time the cache is rebuilt.
+func (r *Resolver) OnRefresh(fn func([]model.VMMetadata)) {
+	r.mu.Lock()
+	r.onRefresh = fn
+	r.mu.Unlock()
+}
+
+func (r *Resolver) Invalidate() {
+	r.mu.Lock()
+	r.cacheUntil = time.Time{}
+	r.staleFetch = r.refreshing != nil
+	r.mu.Unlock()
+}
+
+// Follow invalidates the cache on every store event so new or changed VMs are
+// routable before the TTL expires. It returns when events is closed.
+func (r *Resolver) Follow(events <-chan model.StoreEvent) {
+	for event := range events {
+		r.logger.Debug("store event, invalidating resolver cache", "type", event.Type, "vmID", event.ID)
+		r.Invalidate()
+	}
+}
+
 func (r *Resolver) labelFromServerName(serverName string) (string, error) {
 	name := strings.ToLower(strings.TrimSpace(serverName))
 	name = strings.TrimSuffix(name, ".")
 	if name == "" {
 		return "", errors.New("tls server name is empty")
 	}
-	if !strings.HasSuffix(name, r.domainTail) {
-		return "", fmt.Errorf("server name must end with %s", r.domainTail)
+	r.mu.RLock()
+	tail := r.domainTail
+	r.mu.RUnlock()
+	if !strings.HasSuffix(name, tail) {
+		return "", fmt.Errorf("server name must end with %s", tail)
 	}
-	label := strings.TrimSuffix(name, r.domainTail)
+	label := strings.TrimSuffix(name, tail)
 	if label == "" || strings.Contains(label, ".") {
 		return "", fmt.Errorf("invalid server name label in %s", serverName)
 	}
 	return label, nil
 }
 
+// refreshCacheIfNeeded reloads the cache once it has expired. Only one
+// caller fetches at a time; the others keep using the entries they have, or
+// wait for the fetch when there are none yet.
 func (r *Resolver) refreshCacheIfNeeded() error {
+	r.mu.Lock()
+	if time.Now().Before(r.cacheUntil) && len(r.cache) > 0 {
+		r.mu.Unlock()
+		return nil
+	}
+	if done := r.refreshing; done != nil {
+		if len(r.cache) > 0 {
+			r.mu.Unlock()
+			return nil
+		}
+		r.mu.Unlock()
+		<-done
+		r.mu.RLock()
+		defer r.mu.RUnlock()
+		return r.refreshErr
+	}
+	done := make(chan struct{})
+	r.refreshing, r.staleFetch = done, false
+	r.mu.Unlock()
+
+	metas, err := r.source()
+	var next, domains map[string]model.VMMetadata
+	var shadowed map[string][]string
+	var routable []model.VMMetadata
+	if err == nil {
+		next, domains, shadowed, routable = r.buildCache(metas)
+	}
+	swapErr := r.swapCache(done, err, next, domains, shadowed, routable)
 	r.mu.RLock()
-	cacheValid := time.Now().Before(r.cacheUntil) && len(r.cache) > 0
+	notify := r.onRefresh
 	r.mu.RUnlock()
-	if cacheValid {
-		return nil
+	if err == nil && notify != nil {
+		notify(routable)
 	}
+	return swapErr
+}
 
+// swapCache ends the fetch that done tracks, installing its result unless
+// the fetch failed with err.
+func (r *Resolver) swapCache(done chan struct{}, err error, next, domains map[string]model.VMMetadata, shadowed map[string][]string, routable []model.VMMetadata) error {
 	r.mu.Lock()
 	defer r.mu.Unlock()
-	if time.Now().Before(r.cacheUntil) && len(r.cache) > 0 {
-		return nil
+	defer close(done)
+	r.refreshing, r.refreshErr = nil, err
+	// An invalidation that raced the fetch may not be reflected in it, so
+	// the result is used but expires at once.
+	until := time.Now().Add(r.cacheTTL)
+	if r.staleFetch {
+		until = time.Time{}
 	}
-
-	metas, err := r.readAllMetas()
 	if err != nil {
-		return err
+		if len(r.cache) == 0 {
+			return err
+		}
+		// Keep routing to the VMs last seen rather than fail every
+		// connection while the source is unreachable.
+		r.logger.Warn("resolver refresh failed, serving cached entries", "entries", len(r.cache), "error", err)
+		r.refreshErr = nil
+		r.cacheUntil = until
+		return nil
 	}
+	r.cache = next
+	r.domains = domains
+	r.shadowed = shadowed
+	r.refreshed = time.Now().UTC()
+	r.ordered = routable
+	r.cacheUntil = until
+	r.logger.Debug("forwarder resolver cache refreshed", "entries", len(next), "orderedVMs", len(r.ordered), "ttl", r.cacheTTL.String())
+	return nil
+}
 
+// buildCache orders metas oldest first and indexes the routable ones by
+// alias and custom domain; on a clash the older VM keeps the name.
+func (r *Resolver) buildCache(metas []model.VMMetadata) (map[string]model.VMMetadata, map[string]model.VMMetadata, map[string][]string, []model.VMMetadata) {
 	sort.SliceStable(metas, func(i, j int) bool {
 		left := metas[i].CreatedAt
 		right := metas[j].CreatedAt
@@ -147,21 +347,31 @@ func (r *Resolver) refreshCacheIfNeeded() error {
 	})
 
 	next := map[string]model.VMMetadata{}
+	domains := map[string]model.VMMetadata{}
+	shadowed := map[string][]string{}
+	routable := make([]model.VMMetadata, 0, len(metas))
 	for _, meta := range metas {
+		// A VM being deleted is drained: new connections are not routed.
+		if meta.Deletion != nil {
+			continue
+		}
+		routable = append(routable, meta)
 		for _, alias := range aliasesForMeta(meta) {
 			if _, exists := next[alias]; exists {
 				r.logger.Warn("duplicate alias while building resolver cache", "alias", alias, "vmID", meta.ID)
+				shadowed[alias] = append(shadowed[alias], meta.ID)
 				continue
 			}
 			next[alias] = meta
 		}
+		for _, domain := range meta.Domains {
+			if _, exists := domains[domain]; !exists {
+				domains[domain] = meta
+			}
+		}
 	}
 
-	r.cache = next
-	r.ordered = append([]model.VMMetadata(nil), metas...)
-	r.cacheUntil = time.Now().Add(r.cacheTTL)
-	r.logger.Debug("forwarder resolver cache refreshed", "entries", len(next), "orderedVMs", len(r.ordered), "ttl", r.cacheTTL.String())
-	return nil
+	return next, domains, shadowed, routable
 }
 
 func (r *Resolver) readAllMetas() ([]model.VMMetadata, error) {
@@ -190,6 +400,25 @@ func (r *Resolver) readAllMetas() ([]model.VMMetadata, error) {
 	return metas, nil
 }
 
+// aliasSource names the field of meta alias came from, for traces.
+func aliasSource(meta model.VMMetadata, alias string) string {
+	if strings.EqualFold(meta.ID, alias) {
+		return "id"
+	}
+	if len(meta.ID) >= 8 && strings.EqualFold(meta.ID[:8], alias) {
+		return "short id"
+	}
+	for _, key := range []string{"host", "hostname", "app", "name"} {
+		if strings.EqualFold(strings.TrimSpace(meta.Tags[key]), alias) {
+			return "tag " + key
+		}
+		if value, ok := meta.Metadata[key].(string); ok && strings.EqualFold(strings.TrimSpace(value), alias) {
+			return "metadata " + key
+		}
+	}
+	return "unknown field"
+}
+
 func aliasesForMeta(meta model.VMMetadata) []string {
 	seen := map[string]struct{}{}
 	out := make([]string, 0, 8)
@@ -1,10 +1,17 @@
 package forwarder
 
 import (
+	"net/http"
+	"net/http/httptest"
 	"os"
 	"path/filepath"
+	"strings"
+	"sync/atomic"
 	"testing"
 	"time"
+
+	"github.com/alperreha/mergen-fire/internal/model"
+	"github.com/alperreha/mergen-fire/pkg/client"
 )
 
 func TestResolverResolveByTagAndUUID(t *testing.T) {
@@ -118,3 +125,124 @@ func TestResolverResolveFirst(t *testing.T) {
 		t.Fatalf("expected older vm id %s, got %s", olderID, first.ID)
 	}
 }
+
+func TestAPIResolverListsFromMergend(t *testing.T) {
+	up := true
+	var gotFields string
+	api := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/v1/vms" {
+			http.NotFound(w, r)
+			return
+		}
+		if !up {
+			http.Error(w, `{"error":"down"}`, http.StatusInternalServerError)
+			return
+		}
+		gotFields = r.URL.Query().Get("fields")
+		_, _ = w.Write([]byte(`{"items":[{
+  "id":"084604f6-0766-4b7d-9d23-0b7a011d6eaa",
+  "network":{"guestIP":"172.30.0.5","netns":"mergen-084604f6","httpPort":8080},
+  "tags":{"app":"app1"}
+}]}`))
+	}))
+	defer api.Close()
+
+	c := client.New(api.URL).WithRetries(0, time.Millisecond)
+	resolver := NewAPIResolver(c, "", "localhost", time.Millisecond, nil)
+
+	meta, err := resolver.Resolve("app1.localhost")
+	if err != nil {
+		t.Fatalf("resolve app alias: %v", err)
+	}
+	if meta.GuestIP != "172.30.0.5" || meta.NetNS != "mergen-084604f6" || meta.HTTPPort != 8080 {
+		t.Fatalf("unexpected routing fields: %+v", meta)
+	}
+	if !strings.Contains(gotFields, "network") || !strings.Contains(gotFields, "tags") {
+		t.Fatalf("expected network and tags to be requested, got fields=%q", gotFields)
+	}
+
+	up = false
+	time.Sleep(5 * time.Millisecond)
+	if _, err := resolver.Resolve("084604f6.localhost"); err != nil {
+		t.Fatalf("expected cached entries while mergend is down: %v", err)
+	}
+}
+
+func TestResolverResolveCustomDomain(t *testing.T) {
+	root := t.TempDir()
+	vmID := "22222222-3333-4444-5555-666666666666"
+	vmDir := filepath.Join(root, vmID)
+	if err := os.MkdirAll(vmDir, 0o755); err != nil {
+		t.Fatalf("mkdir vm dir: %v", err)
+	}
+	meta := `{
+  "id":"22222222-3333-4444-5555-666666666666",
+  "guestIP":"10.0.0.4",
+  "netns":"mergen-22222222",
+  "domains":["shop.example.com"],
+  "tags":{"app":"shop"}
+}`
+	if err := os.WriteFile(filepath.Join(vmDir, "meta.json"), []byte(meta), 0o644); err != nil {
+		t.Fatalf("write meta: %v", err)
+	}
+
+	resolver := NewResolver(root, "", "localhost", 1*time.Second, nil)
+	byDomain, err := resolver.Resolve("Shop.Example.com.")
+	if err != nil {
+		t.Fatalf("resolve custom domain: %v", err)
+	}
+	if byDomain.ID != vmID {
+		t.Fatalf("unexpected vm id by domain: %s", byDomain.ID)
+	}
+	if _, err := resolver.Resolve("other.example.com"); err == nil {
+		t.Fatal("expected unknown domain outside the suffix to fail")
+	}
+}
+
+func TestResolverServesCachedEntriesDuringSlowRefresh(t *testing.T) {
+	vm := model.VMMetadata{ID: "33333333-4444-5555-6666-777777777777", GuestIP: "10.0.0.9", Tags: map[string]string{"app": "slow"}}
+	var calls atomic.Int32
+	release := make(chan struct{})
+	resolver := NewResolver("", "", "localhost", time.Millisecond, nil)
+	resolver.source = func() ([]model.VMMetadata, error) {
+		if calls.Add(1) > 1 {
+			<-release
+		}
+		return []model.VMMetadata{vm}, nil
+	}
+	if _, err := resolver.Resolve("slow.localhost"); err != nil {
+		t.Fatalf("initial resolve: %v", err)
+	}
+	time.Sleep(5 * time.Millisecond)
+
+	refreshed := make(chan error, 1)
+	go func() {
+		_, err := resolver.Resolve("slow.localhost")
+		refreshed <- err
+	}()
+	for calls.Load() < 2 {
+		time.Sleep(time.Millisecond)
+	}
+
+	done := make(chan error, 1)
+	go func() {
+		_, err := resolver.Resolve("slow.localhost")
+		done <- err
+	}()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatalf("resolve during refresh: %v", err)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("resolve blocked behind the refresh in flight")
+	}
+	if got := calls.Load(); got != 2 {
+		t.Fatalf("expected a single refresh in flight, source called %d times", got)
+	}
+
+	close(release)
+	if err := <-refreshed; err != nil {
+		t.Fatalf("refreshing resolve: %v", err)
+	}
+}
@@ -8,14 +8,24 @@ import (
 	"io"
 	"log/slog"
 	"net"
+	"slices"
 	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
+	"github.com/alperreha/mergen-fire/internal/certs"
 	"github.com/alperreha/mergen-fire/internal/model"
 )
 
+// A VM tag portTagPrefix+<listener> overrides the guest port for that
+// listener; the TLS listener is httpsListener.
+const (
+	httpsListener = "https"
+	portTagPrefix = "ports."
+)
+
 type Dialer interface {
 	DialContext(ctx context.Context, network, address, netns string) (net.Conn, error)
 }
@@ -25,10 +35,20 @@ type Server struct {
 	resolver *Resolver
 	dialer   Dialer
 	logger   *slog.Logger
-	cert     tls.Certificate
+	geoip    *GeoIP
+	traces   *TraceBuffer
+	cert     atomic.Pointer[tls.Certificate]
+	vmCerts  *vmCertificates
 	connMu   sync.Mutex
 	connWG   sync.WaitGroup
 	conns    map[net.Conn]struct{}
+	cachesMu sync.Mutex
+	caches   map[string]*responseCache
+
+	waker       Waker
+	wakeTimeout time.Duration
+	activityMu  sync.Mutex
+	activity    map[string]*vmActivity
 }
 
 func NewServer(config Config, resolver *Resolver, dialer Dialer, logger *slog.Logger) (*Server, error) {
@@ -47,14 +67,49 @@ func NewServer(config Config, resolver *Resolver, dialer Dialer, logger *slog.Lo
 		return nil, fmt.Errorf("load tls cert/key: %w", err)
 	}
 
-	return &Server{
+	var geoip *GeoIP
+	if config.GeoIPFile != "" {
+		if geoip, err = LoadGeoIP(config.GeoIPFile); err != nil {
+			return nil, err
+		}
+	}
+
+	server := &Server{
 		config:   config,
 		resolver: resolver,
 		dialer:   dialer,
 		logger:   logger,
-		cert:     cert,
+		geoip:    geoip,
 		conns:    map[net.Conn]struct{}{},
-	}, nil
+		caches:   map[string]*responseCache{},
+		activity: map[string]*vmActivity{},
+	}
+	if config.DebugAddr != "" {
+		server.traces = NewTraceBuffer(config.TraceBuffer)
+	}
+	if config.VMCertDir != "" {
+		server.vmCerts = &vmCertificates{dir: certs.NewDir(config.VMCertDir), logger: logger}
+	}
+	resolver.OnRefresh(server.pruneCaches)
+	server.cert.Store(&cert)
+	return server, nil
+}
+
+// Traces returns the recent connection traces, or nil when tracing is off.
+func (s *Server) Traces() *TraceBuffer {
+	return s.traces
+}
+
+// ReloadCertificate swaps the serving certificate for new handshakes;
+// established connections keep theirs.
+func (s *Server) ReloadCertificate(certFile, keyFile string) error {
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return fmt.Errorf("load tls cert/key: %w", err)
+	}
+	s.cert.Store(&cert)
+	s.logger.Info("tls certificate reloaded", "certFile", certFile)
+	return nil
 }
 
 func (s *Server) Run(ctx context.Context) error {
@@ -70,11 +125,40 @@ func (s *Server) runTLSListener(ctx context.Context, listenAddr string) error {
 	if err != nil {
 		return fmt.Errorf("listen %s failed: %w", listenAddr, err)
 	}
+	return s.serve(ctx, base)
+}
+
+// Serve accepts TLS connections on an existing listener until ctx ends, then
+// waits for routed connections to finish. Tests use it with a ":0" listener.
+func (s *Server) Serve(ctx context.Context, base net.Listener) error {
+	if err := s.serve(ctx, base); err != nil {
+		return err
+	}
+	s.waitForConnections()
+	return nil
+}
+
+func (s *Server) serve(ctx context.Context, base net.Listener) error {
 	defer base.Close()
+	listenAddr := base.Addr().String()
 
 	tlsConfig := &tls.Config{
-		Certificates: []tls.Certificate{s.cert},
-		MinVersion:   tls.VersionTLS12,
+		GetCertificate: func(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+			if cert := s.vmCerts.lookup(hello.ServerName); cert != nil {
+				return cert, nil
+			}
+			return s.cert.Load(), nil
+		},
+		// Returning an error here aborts the handshake, so VMs' own ACLs
+		// apply before any certificate is sent. ACME validations are
+		// answered for mergend instead of being routed.
+		GetConfigForClient: func(hello *tls.ClientHelloInfo) (*tls.Config, error) {
+			if slices.Contains(hello.SupportedProtos, certs.ALPNProtocol) {
+				return s.vmCerts.challengeConfig(hello)
+			}
+			return nil, s.admitVM(hello)
+		},
+		MinVersion: tls.VersionTLS12,
 	}
 	listener := tls.NewListener(base, tlsConfig)
 
@@ -99,6 +183,13 @@ func (s *Server) runTLSListener(ctx context.Context, listenAddr string) error {
 			return fmt.Errorf("accept failed on %s: %w", listenAddr, err)
 		}
 
+		if !s.admit(conn, httpsListener) {
+			_ = conn.Close()
+			continue
+		}
+		if tlsConn, ok := conn.(*tls.Conn); ok {
+			s.setKeepAlive(tlsConn.NetConn())
+		}
 		s.trackConn(conn)
 		s.connWG.Add(1)
 		go s.handleTLSConn(conn)
@@ -120,6 +211,10 @@ func (s *Server) handleTLSConn(clientConn net.Conn) {
 		s.logger.Warn("tls handshake failed", "remoteAddr", tlsConn.RemoteAddr().String(), "error", err)
 		return
 	}
+	if state := tlsConn.ConnectionState(); state.NegotiatedProtocol == certs.ALPNProtocol {
+		s.logger.Info("acme tls-alpn-01 challenge answered", "serverName", state.ServerName, "remoteAddr", tlsConn.RemoteAddr().String())
+		return
+	}
 
 	serverName := strings.ToLower(strings.TrimSpace(tlsConn.ConnectionState().ServerName))
 	if serverName == "" {
@@ -128,26 +223,71 @@ func (s *Server) handleTLSConn(clientConn net.Conn) {
 		return
 	}
 
-	meta, err := s.resolver.Resolve(serverName)
+	trace := s.traces.begin(serverName, tlsConn.RemoteAddr().String())
+	defer func() { s.traces.record(trace) }()
+
+	meta, err := s.resolver.resolve(serverName, trace)
 	if err != nil {
 		s.logger.Warn("sni resolve failed", "serverName", serverName, "error", err)
+		trace.finish(TraceNotFound)
 		_ = writeHTTPError(tlsConn, 404, "vm not found")
 		return
 	}
+	if trace != nil {
+		trace.VMID = meta.ID
+	}
 
-	targetGuestPort, err := targetHTTPPort(meta)
+	targetGuestPort, err := resolveTargetGuestPort(meta, httpsListener)
+	if trace != nil {
+		trace.add("port", err, "%s", portSource(meta, targetGuestPort))
+	}
 	if err != nil {
 		s.logger.Warn("vm http port unavailable", "serverName", serverName, "vmID", meta.ID, "error", err)
+		trace.finish(TraceNoPort)
 		_ = writeHTTPError(tlsConn, 502, "vm http port not configured")
 		return
 	}
 
 	targetAddr := net.JoinHostPort(meta.GuestIP, strconv.Itoa(targetGuestPort))
+	woken := false
+	if s.wakes(meta) {
+		defer s.trackActivity(meta.ID)()
+		if meta.DesiredState == model.DesiredStopped {
+			if err := s.wake(meta, targetGuestPort, trace); err != nil {
+				trace.finish(TraceDialFailed)
+				_ = writeHTTPError(tlsConn, 503, "vm is starting, try again")
+				return
+			}
+			woken = true
+		}
+	}
+	if s.config.CacheMaxBytes > 0 && cacheEnabled(meta, httpsListener) {
+		// Backends are dialed per request, so a dial failure is a 502 on
+		// that request rather than on the connection.
+		traceNetNS(trace, s.dialer, meta.NetNS)
+		trace.add("cache", nil, "http proxied through the response cache (tag %s%s)", cacheTagPrefix, httpsListener)
+		trace.finish(TraceRouted)
+		s.traces.record(trace)
+		trace = nil
+		s.logger.Debug("connection routed through cache", "serverName", serverName, "vmID", meta.ID, "targetAddr", targetAddr)
+		s.serveHTTP(tlsConn, meta, targetAddr)
+		return
+	}
 	dialCtx, cancel := context.WithTimeout(context.Background(), s.config.DialTimeout)
 	defer cancel()
 
-	backendConn, err := s.dialer.DialContext(dialCtx, "tcp", targetAddr, meta.NetNS)
+	traceNetNS(trace, s.dialer, meta.NetNS)
+	backendConn, err := dialTraced(dialCtx, trace, s.dialer, targetAddr, meta.NetNS)
+	if err != nil && !woken && s.wakes(meta) {
+		// The resolver may not know yet that the VM was stopped.
+		if s.wake(meta, targetGuestPort, trace) == nil {
+			redialCtx, cancel := context.WithTimeout(context.Background(), s.config.DialTimeout)
+			defer cancel()
+			backendConn, err = dialTraced(redialCtx, trace, s.dialer, targetAddr, meta.NetNS)
+		}
+	}
 	if err != nil {
+		trace.finish(TraceDialFailed)
 		s.logger.Warn(
 			"backend dial failed",
 			"serverName", serverName,
@@ -161,6 +301,11 @@ func (s *Server) handleTLSConn(clientConn net.Conn) {
 		return
 	}
 	defer backendConn.Close()
+	s.setKeepAlive(backendConn)
+	trace.finish(TraceRouted)
+	// Record now rather than when the connection ends, which may be hours.
+	s.traces.record(trace)
+	trace = nil
 
 	s.logger.Debug(
 		"connection routed",
@@ -175,7 +320,17 @@ func (s *Server) handleTLSConn(clientConn net.Conn) {
 	proxyStreams(tlsConn, backendConn)
 }
 
-func targetHTTPPort(meta model.VMMetadata) (int, error) {
+// resolveTargetGuestPort picks the guest port a connection on listener is
+// routed to: the VM's "ports.<listener>" tag (e.g. ports.https=8443) when
+// set, otherwise its httpPort.
+func resolveTargetGuestPort(meta model.VMMetadata, listener string) (int, error) {
+	if raw, ok := meta.Tags[portTagPrefix+listener]; ok {
+		port, err := strconv.Atoi(strings.TrimSpace(raw))
+		if err != nil || port <= 0 || port > 65535 {
+			return 0, fmt.Errorf("invalid %s%s tag: %q", portTagPrefix, listener, raw)
+		}
+		return port, nil
+	}
 	if meta.HTTPPort <= 0 || meta.HTTPPort > 65535 {
 		return 0, fmt.Errorf("invalid httpPort: %d", meta.HTTPPort)
 	}
@@ -240,25 +395,92 @@ func (s *Server) closeAllConnections() {
 	}
 }
 
+// admit checks a new connection against the global and the listener's ACL.
+// Sources that are not IP addresses, such as test pipes, pass.
+func (s *Server) admit(conn net.Conn, listener string) bool {
+	addr, ok := remoteAddr(conn)
+	if !ok {
+		return true
+	}
+	country := s.geoip.Country(addr)
+	if s.config.ACL.permits(addr, country) && s.config.ListenerACLs[listener].permits(addr, country) {
+		return true
+	}
+	s.logger.Debug("connection rejected by acl", "listener", listener, "remoteAddr", addr.String(), "country", country)
+	return false
+}
+
+// admitVM checks the source against the ACL tags of the VM the SNI names.
+// Names that resolve to no VM pass here and get a 404 after the handshake.
+// Tags that do not parse, or country tags without a GeoIP database, reject
+// every source.
+func (s *Server) admitVM(hello *tls.ClientHelloInfo) error {
+	meta, err := s.resolver.Resolve(hello.ServerName)
+	if err != nil {
+		return nil
+	}
+	acl, err := aclFromTags(meta.Tags)
+	if err != nil {
+		s.logger.Warn("invalid vm acl tags, rejecting connections", "vmID", meta.ID, "error", err)
+		return fmt.Errorf("vm %s has invalid acl tags", meta.ID)
+	}
+	if acl.empty() || hello.Conn == nil {
+		return nil
+	}
+	if acl.usesCountries() && s.geoip == nil {
+		s.logger.Warn("vm acl names countries but no geoip file is configured, rejecting connections", "vmID", meta.ID)
+		return fmt.Errorf("vm %s acl needs geoip", meta.ID)
+	}
+	addr, ok := remoteAddr(hello.Conn)
+	if !ok {
+		return nil
+	}
+	country := s.geoip.Country(addr)
+	if !acl.permits(addr, country) {
+		s.logger.Debug("connection rejected by vm acl", "vmID", meta.ID, "remoteAddr", addr.String(), "country", country)
+		if trace := s.traces.begin(strings.ToLower(hello.ServerName), addr.String()); trace != nil {
+			trace.VMID = meta.ID
+			trace.add("acl", nil, "source %s (country %q) is not allowed by the vm's acl tags", addr, country)
+			trace.finish(TraceRejected)
+			s.traces.record(trace)
+		}
+		return fmt.Errorf("source %s not allowed for vm %s", addr, meta.ID)
+	}
+	return nil
+}
+
+// setKeepAlive applies the configured probes to a TCP leg. Other conn types,
+// such as the pipes tests use, are left alone.
+func (s *Server) setKeepAlive(conn net.Conn) {
+	tcpConn, ok := conn.(*net.TCPConn)
+	if !ok {
+		return
+	}
+	if err := tcpConn.SetKeepAliveConfig(s.config.KeepAlive); err != nil {
+		s.logger.Debug("set tcp keepalive failed", "remoteAddr", conn.RemoteAddr().String(), "error", err)
+	}
+}
+
+// proxyStreams copies both ways until both sides are done. A side that ends
+// cleanly half-closes the other, but a read or write error means a dead
+// peer, so both legs are closed instead of leaving the survivor half-open.
 func proxyStreams(client net.Conn, backend net.Conn) {
 	var wg sync.WaitGroup
 	wg.Add(2)
 
-	go func() {
+	pipe := func(dst, src net.Conn) {
 		defer wg.Done()
-		_, _ = io.Copy(backend, client)
-		if c, ok := backend.(interface{ CloseWrite() error }); ok {
-			_ = c.CloseWrite()
+		if _, err := io.Copy(dst, src); err != nil {
+			_ = client.Close()
+			_ = backend.Close()
+			return
 		}
-	}()
-
-	go func() {
-		defer wg.Done()
-		_, _ = io.Copy(client, backend)
-		if c, ok := client.(interface{ CloseWrite() error }); ok {
+		if c, ok := dst.(interface{ CloseWrite() error }); ok {
 			_ = c.CloseWrite()
 		}
-	}()
+	}
+	go pipe(backend, client)
+	go pipe(client, backend)
 
 	wg.Wait()
 }
@@ -284,6 +506,8 @@ func httpStatusText(code int) string {
 		return "Misdirected Request"
 	case 502:
 		return "Bad Gateway"
+	case 503:
+		return "Service Unavailable"
 	default:
 		return "Error"
 	}
@@ -1,12 +1,15 @@
 package forwarder
 
 import (
+	"net"
+	"slices"
 	"testing"
+	"time"
 
 	"github.com/alperreha/mergen-fire/internal/model"
 )
 
-func TestTargetHTTPPort(t *testing.T) {
+func TestResolveTargetGuestPort(t *testing.T) {
 	cases := []struct {
 		name     string
 		meta     model.VMMetadata
@@ -28,10 +31,25 @@ func TestTargetHTTPPort(t *testing.T) {
 			meta:    model.VMMetadata{HTTPPort: 70000},
 			wantErr: true,
 		},
+		{
+			name:     "listener tag overrides http port",
+			meta:     model.VMMetadata{HTTPPort: 80, Tags: map[string]string{"ports.https": "8443"}},
+			wantPort: 8443,
+		},
+		{
+			name:     "other listener tag is ignored",
+			meta:     model.VMMetadata{HTTPPort: 80, Tags: map[string]string{"ports.http": "8080"}},
+			wantPort: 80,
+		},
+		{
+			name:    "invalid listener tag",
+			meta:    model.VMMetadata{HTTPPort: 80, Tags: map[string]string{"ports.https": "web"}},
+			wantErr: true,
+		},
 	}
 
 	for _, tc := range cases {
-		got, err := targetHTTPPort(tc.meta)
+		got, err := resolveTargetGuestPort(tc.meta, httpsListener)
 		if tc.wantErr {
 			if err == nil {
 				t.Fatalf("%s: expected error, got nil", tc.name)
@@ -46,3 +64,65 @@ func TestTargetHTTPPort(t *testing.T) {
 		}
 	}
 }
+
+func TestProxyStreamsClosesBothLegsOnReset(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	defer listener.Close()
+	pair := func() (net.Conn, net.Conn) {
+		dialed, err := net.Dial("tcp", listener.Addr().String())
+		if err != nil {
+			t.Fatalf("dial: %v", err)
+		}
+		accepted, err := listener.Accept()
+		if err != nil {
+			t.Fatalf("accept: %v", err)
+		}
+		return dialed, accepted
+	}
+	clientPeer, clientConn := pair()
+	backendConn, backendPeer := pair()
+	defer backendPeer.Close()
+
+	done := make(chan struct{})
+	go func() {
+		proxyStreams(clientConn, backendConn)
+		close(done)
+	}()
+
+	// An aborted close sends RST, as a dead peer's kernel would on the next
+	// keepalive probe.
+	_ = clientPeer.(*net.TCPConn).SetLinger(0)
+	_ = clientPeer.Close()
+
+	select {
+	case <-done:
+	case <-time.After(2 * time.Second):
+		t.Fatal("proxyStreams kept the backend leg open after the client reset")
+	}
+	_ = backendPeer.SetReadDeadline(time.Now().Add(time.Second))
+	if _, err := backendPeer.Read(make([]byte, 1)); err == nil {
+		t.Fatal("expected backend peer to see the connection closed")
+	}
+}
+
+func TestActiveVMs(t *testing.T) {
+	s := &Server{activity: map[string]*vmActivity{}}
+	s.trackActivity("closed")()
+	done := s.trackActivity("open")
+
+	got := s.activeVMs()
+	slices.Sort(got)
+	if !slices.Equal(got, []string{"closed", "open"}) {
+		t.Fatalf("first report %v, want both vms", got)
+	}
+	if got := s.activeVMs(); !slices.Equal(got, []string{"open"}) {
+		t.Fatalf("second report %v, want only the vm with an open connection", got)
+	}
+	done()
+	if got := s.activeVMs(); len(got) != 0 {
+		t.Fatalf("report after the connection closed %v, want none", got)
+	}
+}
@@ -0,0 +1,179 @@
+package forwarder
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/alperreha/mergen-fire/internal/model"
+)
+
+// Trace outcomes.
+const (
+	TraceRouted     = "routed"
+	TraceNotFound   = "not_found"
+	TraceNoPort     = "no_port"
+	TraceDialFailed = "dial_failed"
+	TraceRejected   = "rejected"
+	TraceDryRun     = "dry_run"
+)
+
+const defaultTraceSize = 256
+
+// TraceStep is one routing decision, e.g. the label parsed from the SNI or
+// the alias that matched.
+type TraceStep struct {
+	Step   string `json:"step"`
+	Detail string `json:"detail"`
+	Error  string `json:"error,omitempty"`
+}
+
+// RouteTrace records how one connection, or one dry run, was routed.
+type RouteTrace struct {
+	ID         uint64      `json:"id"`
+	At         time.Time   `json:"at"`
+	ServerName string      `json:"serverName"`
+	RemoteAddr string      `json:"remoteAddr,omitempty"`
+	VMID       string      `json:"vmID,omitempty"`
+	Outcome    string      `json:"outcome"`
+	Steps      []TraceStep `json:"steps"`
+}
+
+// add appends a step; it is a no-op on a nil trace so untraced connections
+// pay nothing.
+func (t *RouteTrace) add(step string, err error, format string, args ...any) {
+	if t == nil {
+		return
+	}
+	entry := TraceStep{Step: step, Detail: fmt.Sprintf(format, args...)}
+	if err != nil {
+		entry.Error = err.Error()
+	}
+	t.Steps = append(t.Steps, entry)
+}
+
+func (t *RouteTrace) finish(outcome string) {
+	if t != nil {
+		t.Outcome = outcome
+	}
+}
+
+// TraceBuffer keeps the most recent connection traces.
+type TraceBuffer struct {
+	mu     sync.Mutex
+	nextID uint64
+	traces []RouteTrace
+	start  int
+	size   int
+}
+
+func NewTraceBuffer(size int) *TraceBuffer {
+	if size <= 0 {
+		size = defaultTraceSize
+	}
+	return &TraceBuffer{size: size}
+}
+
+// begin returns a new trace, or nil when b is nil.
+func (b *TraceBuffer) begin(serverName, remoteAddr string) *RouteTrace {
+	if b == nil {
+		return nil
+	}
+	return &RouteTrace{At: time.Now().UTC(), ServerName: serverName, RemoteAddr: remoteAddr}
+}
+
+func (b *TraceBuffer) record(trace *RouteTrace) {
+	if b == nil || trace == nil {
+		return
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.nextID++
+	trace.ID = b.nextID
+	if len(b.traces) < b.size {
+		b.traces = append(b.traces, *trace)
+		return
+	}
+	b.traces[b.start] = *trace
+	b.start = (b.start + 1) % b.size
+}
+
+// List returns up to limit traces, newest first, optionally only those for
+// serverName. A limit of zero returns all kept traces.
+func (b *TraceBuffer) List(serverName string, limit int) []RouteTrace {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	serverName = strings.ToLower(strings.TrimSuffix(strings.TrimSpace(serverName), "."))
+	out := make([]RouteTrace, 0, len(b.traces))
+	for idx := len(b.traces) - 1; idx >= 0; idx-- {
+		trace := b.traces[(b.start+idx)%len(b.traces)]
+		if serverName != "" && trace.ServerName != serverName {
+			continue
+		}
+		out = append(out, trace)
+		if limit > 0 && len(out) == limit {
+			break
+		}
+	}
+	return out
+}
+
+// netnsLocator is implemented by dialers that can say which namespace file
+// a dial would enter.
+type netnsLocator interface {
+	NetNSPath(netns string) (string, error)
+}
+
+// ExplainRoute traces how serverName would be routed without dialing the
+// backend.
+func ExplainRoute(resolver *Resolver, dialer Dialer, serverName string) RouteTrace {
+	serverName = strings.ToLower(strings.TrimSpace(serverName))
+	trace := &RouteTrace{At: time.Now().UTC(), ServerName: serverName}
+	meta, err := resolver.resolve(serverName, trace)
+	if err != nil {
+		trace.finish(TraceNotFound)
+		return *trace
+	}
+	trace.VMID = meta.ID
+	port, err := resolveTargetGuestPort(meta, httpsListener)
+	trace.add("port", err, "%s", portSource(meta, port))
+	if err != nil {
+		trace.finish(TraceNoPort)
+		return *trace
+	}
+	traceNetNS(trace, dialer, meta.NetNS)
+	trace.add("target", nil, "would dial %s in netns %q", net.JoinHostPort(meta.GuestIP, strconv.Itoa(port)), meta.NetNS)
+	trace.finish(TraceDryRun)
+	return *trace
+}
+
+func traceNetNS(trace *RouteTrace, dialer Dialer, netns string) {
+	if trace == nil {
+		return
+	}
+	locator, ok := dialer.(netnsLocator)
+	if !ok {
+		return
+	}
+	path, err := locator.NetNSPath(netns)
+	trace.add("netns", err, "netns %q at %s", netns, path)
+}
+
+func portSource(meta model.VMMetadata, port int) string {
+	if raw, ok := meta.Tags[portTagPrefix+httpsListener]; ok {
+		return fmt.Sprintf("guest port %s from tag %s%s", raw, portTagPrefix, httpsListener)
+	}
+	return fmt.Sprintf("guest port %d from httpPort", port)
+}
+
+// dialTraced dials and records the outcome and duration.
+func dialTraced(ctx context.Context, trace *RouteTrace, dialer Dialer, addr, netns string) (net.Conn, error) {
+	started := time.Now()
+	conn, err := dialer.DialContext(ctx, "tcp", addr, netns)
+	trace.add("dial", err, "tcp %s in netns %q took %s", addr, netns, time.Since(started).Round(time.Microsecond))
+	return conn, err
+}
@@ -0,0 +1,64 @@
+package forwarder
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestExplainRouteReportsShadowedAlias(t *testing.T) {
+	root := t.TempDir()
+	metas := map[string]string{
+		"11111111-0000-0000-0000-000000000001": `{"id":"11111111-0000-0000-0000-000000000001","createdAt":"2024-01-01T00:00:00Z","guestIP":"172.30.0.2","netns":"mergen-11111111","httpPort":80,"tags":{"app":"app1"}}`,
+		"22222222-0000-0000-0000-000000000002": `{"id":"22222222-0000-0000-0000-000000000002","createdAt":"2024-02-01T00:00:00Z","guestIP":"172.30.0.3","netns":"mergen-22222222","httpPort":80,"tags":{"app":"app1"}}`,
+	}
+	for id, meta := range metas {
+		if err := os.MkdirAll(filepath.Join(root, id), 0o755); err != nil {
+			t.Fatalf("mkdir vm dir: %v", err)
+		}
+		if err := os.WriteFile(filepath.Join(root, id, "meta.json"), []byte(meta), 0o644); err != nil {
+			t.Fatalf("write meta: %v", err)
+		}
+	}
+	resolver := NewResolver(root, "", "example.com", time.Second, nil)
+
+	trace := ExplainRoute(resolver, nil, "App1.example.com")
+	if trace.Outcome != TraceDryRun || trace.VMID != "11111111-0000-0000-0000-000000000001" {
+		t.Fatalf("unexpected trace outcome: %+v", trace)
+	}
+	steps := map[string]string{}
+	for _, step := range trace.Steps {
+		steps[step.Step] = step.Detail
+	}
+	if !strings.Contains(steps["alias"], "tag app") {
+		t.Fatalf("expected alias source in trace, got %q", steps["alias"])
+	}
+	if !strings.Contains(steps["shadowed"], "22222222-0000-0000-0000-000000000002") {
+		t.Fatalf("expected shadowed vm in trace, got %q", steps["shadowed"])
+	}
+	if !strings.Contains(steps["target"], "172.30.0.2:80") {
+		t.Fatalf("expected target in trace, got %q", steps["target"])
+	}
+
+	missing := ExplainRoute(resolver, nil, "nope.example.com")
+	if missing.Outcome != TraceNotFound {
+		t.Fatalf("expected not_found, got %q", missing.Outcome)
+	}
+}
+
+func TestTraceBufferKeepsNewest(t *testing.T) {
+	buffer := NewTraceBuffer(2)
+	for _, name := range []string{"a.example.com", "b.example.com", "a.example.com"} {
+		buffer.record(buffer.begin(name, ""))
+	}
+	all := buffer.List("", 0)
+	if len(all) != 2 || all[0].ID != 3 || all[1].ID != 2 {
+		t.Fatalf("unexpected traces: %+v", all)
+	}
+	onlyA := buffer.List("A.example.com.", 0)
+	if len(onlyA) != 1 || onlyA[0].ID != 3 {
+		t.Fatalf("unexpected filtered traces: %+v", onlyA)
+	}
+}
@@ -0,0 +1,61 @@
+package forwarder
+
+import (
+	"crypto/tls"
+	"errors"
+	"log/slog"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/alperreha/mergen-fire/internal/certs"
+)
+
+// vmCertificates serves the certificates mergend keeps for VMs' custom
+// domains, reloading them whenever mergend saves or removes one.
+type vmCertificates struct {
+	dir    *certs.Dir
+	logger *slog.Logger
+
+	mu       sync.Mutex
+	modified time.Time
+	byName   map[string]*tls.Certificate
+}
+
+// lookup returns the certificate for serverName, or nil when no VM has one
+// and the default certificate applies.
+func (v *vmCertificates) lookup(serverName string) *tls.Certificate {
+	if v == nil {
+		return nil
+	}
+	name := strings.TrimSuffix(strings.ToLower(serverName), ".")
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	modified, err := v.dir.Modified()
+	if err == nil && !modified.Equal(v.modified) {
+		byName, err := v.dir.LoadAll()
+		if err != nil {
+			v.logger.Warn("some vm certificates failed to load", "dir", v.dir.Root(), "error", err)
+		}
+		v.byName, v.modified = byName, modified
+		v.logger.Debug("vm certificates reloaded", "dir", v.dir.Root(), "names", len(byName))
+	}
+	return v.byName[name]
+}
+
+// challengeConfig answers an ACME CA's tls-alpn-01 validation for the
+// domain in hello with the certificate mergend presented for it.
+func (v *vmCertificates) challengeConfig(hello *tls.ClientHelloInfo) (*tls.Config, error) {
+	if v == nil {
+		return nil, errors.New("acme challenge received but no vm certificate dir is configured")
+	}
+	cert, err := v.dir.Challenge(hello.ServerName)
+	if err != nil {
+		return nil, err
+	}
+	return &tls.Config{
+		Certificates: []tls.Certificate{*cert},
+		NextProtos:   []string{certs.ALPNProtocol},
+		MinVersion:   tls.VersionTLS12,
+	}, nil
+}
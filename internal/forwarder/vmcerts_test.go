@@ -0,0 +1,82 @@
+package forwarder
+
+import (
+	"crypto"
+	"crypto/tls"
+	"encoding/pem"
+	"log/slog"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/alperreha/mergen-fire/internal/certs"
+)
+
+func TestVMCertificatesLookupReloads(t *testing.T) {
+	dir := certs.NewDir(t.TempDir())
+	vmCerts := &vmCertificates{dir: dir, logger: slog.Default()}
+	if cert := vmCerts.lookup("shop.example.com"); cert != nil {
+		t.Fatal("expected no certificate before one is saved")
+	}
+
+	saveVMCert(t, dir, "vm-1", "shop.example.com")
+	// Directory mtimes can be coarse; make the save visible as a change.
+	future := time.Now().Add(time.Minute)
+	if err := os.Chtimes(dir.Root(), future, future); err != nil {
+		t.Fatalf("chtimes: %v", err)
+	}
+	if cert := vmCerts.lookup("Shop.Example.com."); cert == nil {
+		t.Fatal("expected the saved certificate after reload")
+	}
+
+	if err := dir.Remove("vm-1"); err != nil {
+		t.Fatalf("remove: %v", err)
+	}
+	later := future.Add(time.Minute)
+	if err := os.Chtimes(dir.Root(), later, later); err != nil {
+		t.Fatalf("chtimes: %v", err)
+	}
+	if cert := vmCerts.lookup("shop.example.com"); cert != nil {
+		t.Fatal("expected the removed certificate to be dropped")
+	}
+}
+
+func TestVMCertificatesChallengeConfig(t *testing.T) {
+	dir := certs.NewDir(t.TempDir())
+	vmCerts := &vmCertificates{dir: dir, logger: slog.Default()}
+	hello := &tls.ClientHelloInfo{ServerName: "shop.example.com", SupportedProtos: []string{certs.ALPNProtocol}}
+	if _, err := vmCerts.challengeConfig(hello); err == nil {
+		t.Fatal("expected an error without a pending challenge")
+	}
+	challenge, err := certs.ChallengeCert("shop.example.com", "token.thumbprint")
+	if err != nil {
+		t.Fatalf("challenge cert: %v", err)
+	}
+	if err := dir.Present("shop.example.com", challenge); err != nil {
+		t.Fatalf("present: %v", err)
+	}
+	config, err := vmCerts.challengeConfig(hello)
+	if err != nil {
+		t.Fatalf("challengeConfig: %v", err)
+	}
+	if len(config.Certificates) != 1 || len(config.NextProtos) != 1 || config.NextProtos[0] != certs.ALPNProtocol {
+		t.Fatalf("unexpected challenge config: %+v", config)
+	}
+	var missing *vmCertificates
+	if _, err := missing.challengeConfig(hello); err == nil {
+		t.Fatal("expected an error without a vm certificate dir")
+	}
+}
+
+// saveVMCert stores a self-signed certificate for name as vmID's.
+func saveVMCert(t *testing.T, dir *certs.Dir, vmID, name string) {
+	t.Helper()
+	cert, err := certs.ChallengeCert(name, "unused")
+	if err != nil {
+		t.Fatalf("create certificate: %v", err)
+	}
+	chain := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert.Certificate[0]})
+	if err := dir.Save(vmID, chain, cert.PrivateKey.(crypto.Signer)); err != nil {
+		t.Fatalf("save: %v", err)
+	}
+}
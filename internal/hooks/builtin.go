@@ -0,0 +1,192 @@
+package hooks
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/alperreha/mergen-fire/internal/firecracker"
+	"github.com/alperreha/mergen-fire/internal/model"
+)
+
+const defaultSlackMessage = "mergen: vm {{ .ID }} {{ .Event }}"
+
+func (r *Runner) execSlack(ctx context.Context, hook model.HookEntry, payload model.HookContext) (string, error) {
+	webhookURL := strings.TrimSpace(hook.URL)
+	if webhookURL == "" && strings.TrimSpace(hook.SecretRef) != "" {
+		secret, err := r.lookupSecret(hook.SecretRef)
+		if err != nil {
+			return "", fmt.Errorf("resolve slack webhook: %w", err)
+		}
+		webhookURL = secret
+	}
+	if webhookURL == "" {
+		return "", errors.New("slack hook needs url or secretRef")
+	}
+
+	message := hook.Message
+	if strings.TrimSpace(message) == "" {
+		message = defaultSlackMessage
+	}
+	text, err := renderTemplate(message, payload)
+	if err != nil {
+		return "", fmt.Errorf("render message: %w", err)
+	}
+
+	body := map[string]string{"text": text}
+	if hook.Channel != "" {
+		body["channel"] = hook.Channel
+	}
+	return r.sendJSON(ctx, http.MethodPost, webhookURL, "", body)
+}
+
+// maxGuestExecReply bounds the exec agent's reply: a MiB each of stdout
+// and stderr, which JSON escaping can grow.
+const maxGuestExecReply = 16 << 20
+
+// guestExecRequest and guestExecResponse are the wire form of
+// mergen-init-snapshot's exec agent.
+type guestExecRequest struct {
+	Argv      []string `json:"argv"`
+	WorkDir   string   `json:"workDir,omitempty"`
+	TimeoutMs int64    `json:"timeoutMs,omitempty"`
+}
+
+type guestExecResponse struct {
+	ExitCode int    `json:"exitCode"`
+	Stdout   string `json:"stdout"`
+	Stderr   string `json:"stderr"`
+	TimedOut bool   `json:"timedOut,omitempty"`
+	Error    string `json:"error,omitempty"`
+}
+
+// execInVM runs cmd in the guest through the exec agent of its init, over
+// the VM's vsock device. The command is killed at the hook's deadline.
+func (r *Runner) execInVM(ctx context.Context, hook model.HookEntry, payload model.HookContext) (string, error) {
+	if len(hook.Cmd) == 0 {
+		return "", errors.New("exec-in-vm hook command is empty")
+	}
+	argv := make([]string, 0, len(hook.Cmd))
+	for _, part := range hook.Cmd {
+		rendered, err := renderTemplate(part, payload)
+		if err != nil {
+			return "", err
+		}
+		argv = append(argv, rendered)
+	}
+	workDir, err := renderTemplate(hook.WorkDir, payload)
+	if err != nil {
+		return "", fmt.Errorf("render workDir: %w", err)
+	}
+	udsPath, err := guestVsockPath(payload)
+	if err != nil {
+		return "", err
+	}
+	var timeoutMs int64
+	if deadline, ok := ctx.Deadline(); ok {
+		timeoutMs = max(time.Until(deadline).Milliseconds(), 1)
+	}
+	r.logger.Debug("executing command in vm", "vmID", payload.ID, "command", argv[0], "uds", udsPath)
+
+	conn, err := firecracker.DialGuest(ctx, udsPath, firecracker.GuestExecPort)
+	if err != nil {
+		return "", fmt.Errorf("exec agent not reachable: %w", err)
+	}
+	defer conn.Close()
+	stop := context.AfterFunc(ctx, func() { conn.Close() })
+	defer stop()
+
+	if err := json.NewEncoder(conn).Encode(guestExecRequest{Argv: argv, WorkDir: workDir, TimeoutMs: timeoutMs}); err != nil {
+		return "", fmt.Errorf("send exec request: %w", err)
+	}
+	var reply guestExecResponse
+	if err := json.NewDecoder(io.LimitReader(conn, maxGuestExecReply)).Decode(&reply); err != nil {
+		if ctx.Err() != nil {
+			err = ctx.Err()
+		}
+		return "", fmt.Errorf("read exec result: %w", err)
+	}
+	output := strings.TrimSpace(reply.Stdout + "\n" + reply.Stderr)
+	switch {
+	case reply.Error != "":
+		return output, fmt.Errorf("exec-in-vm failed: %s", reply.Error)
+	case reply.TimedOut:
+		return output, errors.New("exec-in-vm timed out")
+	case reply.ExitCode != 0:
+		return output, fmt.Errorf("exec-in-vm exited with code %d", reply.ExitCode)
+	}
+	return output, nil
+}
+
+// guestVsockPath reads the VMM's vsock socket from the VM's vm.json.
+func guestVsockPath(payload model.HookContext) (string, error) {
+	if payload.Paths.VMConfigPath == "" {
+		return "", errors.New("vm config path unknown")
+	}
+	content, err := os.ReadFile(payload.Paths.VMConfigPath)
+	if err != nil {
+		return "", fmt.Errorf("read vm config: %w", err)
+	}
+	var cfg model.VMConfig
+	if err := json.Unmarshal(content, &cfg); err != nil {
+		return "", fmt.Errorf("decode vm config: %w", err)
+	}
+	if cfg.Vsock == nil || cfg.Vsock.UdsPath == "" {
+		return "", errors.New("vm has no vsock device, recreate it to get one")
+	}
+	return cfg.Vsock.UdsPath, nil
+}
+
+// maxProviderResponseBytes bounds provider API responses that are decoded
+// rather than recorded, such as a DNS record listing.
+const maxProviderResponseBytes = 1 << 20
+
+func (r *Runner) sendJSON(ctx context.Context, method, url, token string, payload any) (string, error) {
+	status, respBody, err := r.doJSON(ctx, method, url, token, payload, maxRecordedOutputBytes+1)
+	output := status
+	if trimmed := strings.TrimSpace(string(respBody)); trimmed != "" {
+		output += "\n" + trimmed
+	}
+	return output, err
+}
+
+// doJSON sends payload as JSON and returns the response status and up to
+// limit bytes of its body. A non-2xx status is an error.
+func (r *Runner) doJSON(ctx context.Context, method, url, token string, payload any, limit int64) (string, []byte, error) {
+	var reader io.Reader
+	if payload != nil {
+		body, err := json.Marshal(payload)
+		if err != nil {
+			return "", nil, err
+		}
+		reader = bytes.NewReader(body)
+	}
+	req, err := http.NewRequestWithContext(ctx, method, url, reader)
+	if err != nil {
+		return "", nil, err
+	}
+	if payload != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+
+	resp, err := r.client.Do(req)
+	if err != nil {
+		return "", nil, err
+	}
+	defer resp.Body.Close()
+	respBody, _ := io.ReadAll(io.LimitReader(resp.Body, limit))
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return resp.Status, respBody, fmt.Errorf("unexpected response status: %s", resp.Status)
+	}
+	return resp.Status, respBody, nil
+}
@@ -0,0 +1,207 @@
+package hooks
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/alperreha/mergen-fire/internal/model"
+)
+
+const (
+	defaultDNSTTL        = 60
+	defaultDNSValue      = "{{ .GuestIP }}"
+	cloudflareAPIBaseURL = "https://api.cloudflare.com/client/v4"
+)
+
+type DNSRecord struct {
+	Zone  string `json:"zone,omitempty"`
+	Name  string `json:"name"`
+	Type  string `json:"type"`
+	Value string `json:"value"`
+	TTL   int    `json:"ttl"`
+}
+
+type DNSProvider interface {
+	UpsertRecord(ctx context.Context, record DNSRecord) error
+	DeleteRecord(ctx context.Context, record DNSRecord) error
+}
+
+func (r *Runner) WithDNSProvider(name string, provider DNSProvider) *Runner {
+	if r.dnsProviders == nil {
+		r.dnsProviders = map[string]DNSProvider{}
+	}
+	r.dnsProviders[strings.ToLower(strings.TrimSpace(name))] = provider
+	return r
+}
+
+func (r *Runner) execDNS(ctx context.Context, hook model.HookEntry, payload model.HookContext) (string, error) {
+	if hook.DNS == nil {
+		return "", errors.New("dns hook needs a dns block")
+	}
+	spec := *hook.DNS
+
+	name, err := renderTemplate(spec.Name, payload)
+	if err != nil {
+		return "", fmt.Errorf("render dns name: %w", err)
+	}
+	if strings.TrimSpace(name) == "" {
+		return "", errors.New("dns hook name is empty")
+	}
+	valueTemplate := spec.Value
+	if strings.TrimSpace(valueTemplate) == "" {
+		valueTemplate = defaultDNSValue
+	}
+	value, err := renderTemplate(valueTemplate, payload)
+	if err != nil {
+		return "", fmt.Errorf("render dns value: %w", err)
+	}
+	ttl := spec.TTL
+	if ttl <= 0 {
+		ttl = defaultDNSTTL
+	}
+	record := DNSRecord{Zone: spec.Zone, Name: name, Type: "A", Value: value, TTL: ttl}
+
+	provider, err := r.dnsProvider(spec, hook)
+	if err != nil {
+		return "", err
+	}
+
+	action := strings.ToLower(strings.TrimSpace(spec.Action))
+	if action == "" {
+		action = "upsert"
+		if payload.Event == model.HookOnDelete || payload.Event == model.HookOnStop {
+			action = "delete"
+		}
+	}
+	switch action {
+	case "upsert":
+		err = provider.UpsertRecord(ctx, record)
+	case "delete":
+		err = provider.DeleteRecord(ctx, record)
+	default:
+		return "", fmt.Errorf("unsupported dns action: %s", spec.Action)
+	}
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%s %s A %s", action, record.Name, record.Value), nil
+}
+
+func (r *Runner) dnsProvider(spec model.DNSHook, hook model.HookEntry) (DNSProvider, error) {
+	name := strings.ToLower(strings.TrimSpace(spec.Provider))
+	if provider, ok := r.dnsProviders[name]; ok {
+		return provider, nil
+	}
+
+	var token string
+	if strings.TrimSpace(hook.SecretRef) != "" {
+		secret, err := r.lookupSecret(hook.SecretRef)
+		if err != nil {
+			return nil, fmt.Errorf("resolve dns token: %w", err)
+		}
+		token = secret
+	}
+
+	switch name {
+	case "http":
+		if spec.Endpoint == "" {
+			return nil, errors.New("http dns provider needs endpoint")
+		}
+		return &httpDNSProvider{runner: r, endpoint: spec.Endpoint, token: token}, nil
+	case "cloudflare":
+		if spec.Zone == "" {
+			return nil, errors.New("cloudflare dns provider needs zone (zone id)")
+		}
+		baseURL := spec.Endpoint
+		if baseURL == "" {
+			baseURL = cloudflareAPIBaseURL
+		}
+		return &cloudflareDNSProvider{runner: r, baseURL: strings.TrimRight(baseURL, "/"), token: token}, nil
+	default:
+		return nil, fmt.Errorf("unknown dns provider: %s", spec.Provider)
+	}
+}
+
+// httpDNSProvider PUTs/DELETEs the record as JSON to a user supplied endpoint.
+type httpDNSProvider struct {
+	runner   *Runner
+	endpoint string
+	token    string
+}
+
+func (p *httpDNSProvider) UpsertRecord(ctx context.Context, record DNSRecord) error {
+	_, err := p.runner.sendJSON(ctx, http.MethodPut, p.endpoint, p.token, record)
+	return err
+}
+
+func (p *httpDNSProvider) DeleteRecord(ctx context.Context, record DNSRecord) error {
+	_, err := p.runner.sendJSON(ctx, http.MethodDelete, p.endpoint, p.token, record)
+	return err
+}
+
+type cloudflareDNSProvider struct {
+	runner  *Runner
+	baseURL string
+	token   string
+}
+
+type cloudflareRecord struct {
+	ID      string `json:"id,omitempty"`
+	Type    string `json:"type"`
+	Name    string `json:"name"`
+	Content string `json:"content"`
+	TTL     int    `json:"ttl"`
+}
+
+func (p *cloudflareDNSProvider) UpsertRecord(ctx context.Context, record DNSRecord) error {
+	existing, err := p.find(ctx, record)
+	if err != nil {
+		return err
+	}
+	body := cloudflareRecord{Type: record.Type, Name: record.Name, Content: record.Value, TTL: record.TTL}
+	if existing == "" {
+		_, err = p.runner.sendJSON(ctx, http.MethodPost, p.recordsURL(record.Zone), p.token, body)
+		return err
+	}
+	_, err = p.runner.sendJSON(ctx, http.MethodPut, p.recordsURL(record.Zone)+"/"+existing, p.token, body)
+	return err
+}
+
+func (p *cloudflareDNSProvider) DeleteRecord(ctx context.Context, record DNSRecord) error {
+	existing, err := p.find(ctx, record)
+	if err != nil || existing == "" {
+		return err
+	}
+	_, err = p.runner.sendJSON(ctx, http.MethodDelete, p.recordsURL(record.Zone)+"/"+existing, p.token, nil)
+	return err
+}
+
+func (p *cloudflareDNSProvider) recordsURL(zone string) string {
+	return p.baseURL + "/zones/" + url.PathEscape(zone) + "/dns_records"
+}
+
+func (p *cloudflareDNSProvider) find(ctx context.Context, record DNSRecord) (string, error) {
+	query := url.Values{"type": {record.Type}, "name": {record.Name}}
+	_, body, err := p.runner.doJSON(ctx, http.MethodGet, p.recordsURL(record.Zone)+"?"+query.Encode(), p.token, nil, maxProviderResponseBytes+1)
+	if err != nil {
+		return "", err
+	}
+	if len(body) > maxProviderResponseBytes {
+		return "", fmt.Errorf("cloudflare records response exceeds %d bytes", maxProviderResponseBytes)
+	}
+	var response struct {
+		Result []cloudflareRecord `json:"result"`
+	}
+	if err := json.Unmarshal(body, &response); err != nil {
+		return "", fmt.Errorf("decode cloudflare records: %w", err)
+	}
+	if len(response.Result) == 0 {
+		return "", nil
+	}
+	return response.Result[0].ID, nil
+}
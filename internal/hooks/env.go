@@ -0,0 +1,146 @@
+package hooks
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/alperreha/mergen-fire/internal/model"
+	"github.com/alperreha/mergen-fire/internal/sealing"
+	"github.com/alperreha/mergen-fire/internal/store"
+)
+
+// hookEnv layers the daemon environment, the VM env file and the hook context,
+// later entries winning, so scripts see the same MGN_* values as the unit.
+func hookEnv(payload model.HookContext, sealer *sealing.Sealer) ([]string, error) {
+	env := map[string]string{}
+	for _, kv := range os.Environ() {
+		if key, value, ok := strings.Cut(kv, "="); ok {
+			env[key] = value
+		}
+	}
+
+	if payload.Paths.EnvPath != "" || payload.Paths.SealedEnvPath != "" {
+		vmEnv, err := store.ReadVMEnv(payload.Paths, sealer)
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			return nil, fmt.Errorf("read vm env file: %w", err)
+		}
+		for key, value := range vmEnv {
+			env[key] = value
+		}
+	}
+
+	for key, value := range contextEnv(payload) {
+		env[key] = value
+	}
+
+	keys := make([]string, 0, len(env))
+	for key := range env {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	out := make([]string, 0, len(keys))
+	for _, key := range keys {
+		out = append(out, key+"="+env[key])
+	}
+	return out, nil
+}
+
+func contextEnv(payload model.HookContext) map[string]string {
+	env := map[string]string{
+		"MGN_VM_ID":       payload.ID,
+		"MGN_HOOK_EVENT":  payload.Event,
+		"MGN_GUEST_IP":    payload.GuestIP,
+		"MGN_HOST_PORTS":  joinInts(payload.HostPorts),
+		"MGN_GUEST_PORTS": joinInts(payload.GuestPorts),
+		"MGN_CONFIG_DIR":  payload.Paths.ConfigDir,
+		"MGN_VM_JSON":     payload.Paths.VMConfigPath,
+		"MGN_META_JSON":   payload.Paths.MetaPath,
+		"MGN_HOOKS_JSON":  payload.Paths.HooksPath,
+		"MGN_ENV_FILE":    payload.Paths.EnvPath,
+		"MGN_RUN_DIR":     payload.Paths.RunDir,
+		"MGN_SOCKET_PATH": payload.Paths.SocketPath,
+		"MGN_DATA_DIR":    payload.Paths.DataDir,
+		"MGN_LOG_DIR":     payload.Paths.LogsDir,
+	}
+	if !payload.CreatedAt.IsZero() {
+		env["MGN_CREATED_AT"] = payload.CreatedAt.UTC().Format(time.RFC3339)
+	}
+	for i, guest := range payload.GuestPorts {
+		if i < len(payload.HostPorts) {
+			env["MGN_HOST_PORT_"+strconv.Itoa(guest)] = strconv.Itoa(payload.HostPorts[i])
+		}
+	}
+	for key, value := range payload.Metadata {
+		env["MGN_META_"+envKey(key)] = envValue(value)
+	}
+	if encoded, err := json.Marshal(payload); err == nil {
+		env["MGN_HOOK_CONTEXT"] = string(encoded)
+	}
+
+	for key, value := range env {
+		if value == "" {
+			delete(env, key)
+		}
+	}
+	return env
+}
+
+func hookWorkDir(hook model.HookEntry, payload model.HookContext) (string, error) {
+	if strings.TrimSpace(hook.WorkDir) != "" {
+		dir, err := renderTemplate(hook.WorkDir, payload)
+		if err != nil {
+			return "", fmt.Errorf("render workDir: %w", err)
+		}
+		return dir, nil
+	}
+	if payload.Paths.ConfigDir != "" {
+		if info, err := os.Stat(payload.Paths.ConfigDir); err == nil && info.IsDir() {
+			return payload.Paths.ConfigDir, nil
+		}
+	}
+	return "", nil
+}
+
+func envKey(key string) string {
+	return strings.Map(func(r rune) rune {
+		switch {
+		case r >= 'A' && r <= 'Z', r >= '0' && r <= '9':
+			return r
+		case r >= 'a' && r <= 'z':
+			return r - 'a' + 'A'
+		default:
+			return '_'
+		}
+	}, key)
+}
+
+func envValue(value any) string {
+	switch v := value.(type) {
+	case nil:
+		return ""
+	case string:
+		return v
+	case bool, float64, int, int64:
+		return fmt.Sprint(v)
+	default:
+		encoded, err := json.Marshal(v)
+		if err != nil {
+			return fmt.Sprint(v)
+		}
+		return string(encoded)
+	}
+}
+
+func joinInts(values []int) string {
+	parts := make([]string, 0, len(values))
+	for _, value := range values {
+		parts = append(parts, strconv.Itoa(value))
+	}
+	return strings.Join(parts, ",")
+}
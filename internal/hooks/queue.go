@@ -0,0 +1,162 @@
+package hooks
+
+import (
+	"context"
+	"hash/fnv"
+	"time"
+
+	"github.com/alperreha/mergen-fire/internal/model"
+)
+
+const (
+	DefaultWorkers   = 4
+	DefaultQueueSize = 256
+	DefaultTimeout   = 20 * time.Second
+)
+
+type hookJob struct {
+	ctx     context.Context
+	event   string
+	hooks   []model.HookEntry
+	payload model.HookContext
+}
+
+type QueueStats struct {
+	Workers   int   `json:"workers"`
+	Capacity  int   `json:"capacity"`
+	Depth     int   `json:"depth"`
+	InFlight  int64 `json:"inFlight"`
+	Processed int64 `json:"processed"`
+	Dropped   int64 `json:"dropped"`
+}
+
+func (r *Runner) WithWorkers(workers, queueSize int) *Runner {
+	if workers > 0 {
+		r.workers = workers
+	}
+	if queueSize > 0 {
+		r.queueSize = queueSize
+	}
+	return r
+}
+
+// Jobs are sharded by VM ID so events for the same VM always run in order on
+// one worker while different VMs proceed in parallel.
+func (r *Runner) startWorkers() {
+	workers := r.workers
+	if workers <= 0 {
+		workers = DefaultWorkers
+	}
+	queueSize := r.queueSize
+	if queueSize <= 0 {
+		queueSize = DefaultQueueSize
+	}
+	perShard := queueSize / workers
+	if perShard < 1 {
+		perShard = 1
+	}
+
+	r.shards = make([]chan hookJob, workers)
+	for i := range r.shards {
+		shard := make(chan hookJob, perShard)
+		r.shards[i] = shard
+		r.workerWG.Add(1)
+		go r.worker(shard)
+	}
+	r.logger.Debug("hook workers started", "workers", workers, "queuePerWorker", perShard)
+}
+
+func (r *Runner) worker(jobs <-chan hookJob) {
+	defer r.workerWG.Done()
+	for job := range jobs {
+		r.inFlight.Add(1)
+		parent := job.ctx
+		if parent == nil {
+			parent = context.Background()
+		}
+		ctx, cancel := context.WithTimeout(parent, r.eventTimeout(job.event, job.hooks))
+		stop := context.AfterFunc(r.baseCtx, cancel)
+		err := r.Run(ctx, job.event, job.hooks, job.payload)
+		stop()
+		cancel()
+		r.inFlight.Add(-1)
+		r.processed.Add(1)
+		if err != nil {
+			r.logger.Warn("hook execution finished with errors", "event", job.event, "vmID", job.payload.ID, "error", err)
+			continue
+		}
+		r.logger.Debug("hook execution finished", "event", job.event, "vmID", job.payload.ID, "hookCount", len(job.hooks))
+	}
+}
+
+func (r *Runner) enqueue(job hookJob) bool {
+	r.startOnce.Do(r.startWorkers)
+
+	r.queueMu.RLock()
+	defer r.queueMu.RUnlock()
+	if r.closed {
+		r.dropped.Add(1)
+		return false
+	}
+
+	select {
+	case r.shards[shardFor(job.payload.ID, len(r.shards))] <- job:
+		return true
+	default:
+		r.dropped.Add(1)
+		return false
+	}
+}
+
+func (r *Runner) Stats() QueueStats {
+	r.queueMu.RLock()
+	defer r.queueMu.RUnlock()
+
+	stats := QueueStats{
+		Workers:   len(r.shards),
+		InFlight:  r.inFlight.Load(),
+		Processed: r.processed.Load(),
+		Dropped:   r.dropped.Load(),
+	}
+	for _, shard := range r.shards {
+		stats.Capacity += cap(shard)
+		stats.Depth += len(shard)
+	}
+	return stats
+}
+
+// Shutdown stops accepting new jobs and waits for queued ones to drain. When
+// ctx expires first, in-flight hooks are cancelled and the error is returned.
+func (r *Runner) Shutdown(ctx context.Context) error {
+	r.queueMu.Lock()
+	if !r.closed {
+		r.closed = true
+		for _, shard := range r.shards {
+			close(shard)
+		}
+	}
+	r.queueMu.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		r.workerWG.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		r.cancelBase()
+		select {
+		case <-done:
+		case <-time.After(time.Second):
+		}
+		return ctx.Err()
+	}
+}
+
+func shardFor(id string, shards int) int {
+	h := fnv.New32a()
+	_, _ = h.Write([]byte(id))
+	return int(h.Sum32() % uint32(shards))
+}
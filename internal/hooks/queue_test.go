@@ -0,0 +1,117 @@
+package hooks
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/alperreha/mergen-fire/internal/model"
+)
+
+func TestRunAsyncPreservesPerVMOrder(t *testing.T) {
+	var (
+		mu    sync.Mutex
+		order []string
+	)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		order = append(order, r.URL.Query().Get("event"))
+		mu.Unlock()
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer server.Close()
+
+	runner := NewRunner(nil).WithWorkers(4, 64)
+	events := []string{model.HookOnCreate, model.HookOnStart, model.HookOnStop, model.HookOnDelete}
+	for _, event := range events {
+		runner.RunAsync(context.Background(), event, []model.HookEntry{{Type: "http", URL: server.URL + "?event=" + event}}, model.HookContext{ID: "vm-1"})
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := runner.Shutdown(ctx); err != nil {
+		t.Fatalf("shutdown: %v", err)
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	if len(order) != len(events) {
+		t.Fatalf("expected %d deliveries, got %v", len(events), order)
+	}
+	for i := range events {
+		if order[i] != events[i] {
+			t.Fatalf("unexpected order: %v", order)
+		}
+	}
+}
+
+func TestRunAsyncDropsWhenQueueFull(t *testing.T) {
+	release := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		<-release
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer server.Close()
+
+	runner := NewRunner(nil).WithWorkers(1, 1)
+	hooks := []model.HookEntry{{Type: "http", URL: server.URL}}
+	for i := 0; i < 3; i++ {
+		runner.RunAsync(context.Background(), model.HookOnCreate, hooks, model.HookContext{ID: "vm-1"})
+	}
+
+	if stats := runner.Stats(); stats.Dropped == 0 {
+		t.Fatalf("expected dropped jobs, got %+v", stats)
+	}
+	close(release)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := runner.Shutdown(ctx); err != nil {
+		t.Fatalf("shutdown: %v", err)
+	}
+}
+
+func TestEventTimeoutHonoursOverridesAndHookTimeouts(t *testing.T) {
+	runner := NewRunner(nil).WithTimeouts(10*time.Second, map[string]time.Duration{model.HookOnDelete: time.Minute})
+
+	if got := runner.eventTimeout(model.HookOnCreate, nil); got != 10*time.Second {
+		t.Fatalf("expected default timeout, got %s", got)
+	}
+	if got := runner.eventTimeout(model.HookOnDelete, nil); got != time.Minute {
+		t.Fatalf("expected event override, got %s", got)
+	}
+	hooks := []model.HookEntry{{TimeoutMs: 90_000}, {TimeoutMs: 30_000}}
+	if got := runner.eventTimeout(model.HookOnDelete, hooks); got != 2*time.Minute {
+		t.Fatalf("expected sum of hook timeouts, got %s", got)
+	}
+}
+
+func TestShutdownCancelsInFlightHooks(t *testing.T) {
+	started := make(chan struct{})
+	release := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		close(started)
+		select {
+		case <-r.Context().Done():
+		case <-release:
+		}
+	}))
+	defer server.Close()
+	defer close(release)
+
+	runner := NewRunner(nil).WithWorkers(1, 1)
+	runner.RunAsync(context.Background(), model.HookOnDelete, []model.HookEntry{{Type: "http", URL: server.URL}}, model.HookContext{ID: "vm-1"})
+	<-started
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if err := runner.Shutdown(ctx); err == nil {
+		t.Fatalf("expected shutdown to report the expired deadline")
+	}
+	if stats := runner.Stats(); stats.InFlight != 0 {
+		t.Fatalf("expected in-flight hook to be cancelled, got %+v", stats)
+	}
+}
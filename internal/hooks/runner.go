@@ -6,55 +6,171 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
+	"io"
 	"log/slog"
 	"net/http"
 	"os/exec"
+	"strconv"
 	"strings"
-	"text/template"
+	"sync"
+	"sync/atomic"
 	"time"
 
+	"github.com/alperreha/mergen-fire/internal/chaos"
 	"github.com/alperreha/mergen-fire/internal/model"
+	"github.com/alperreha/mergen-fire/internal/sealing"
+	"github.com/alperreha/mergen-fire/internal/tracing"
 )
 
+const maxRecordedOutputBytes = 4096
+
+type HistoryRecorder interface {
+	AppendHookExecution(id string, record model.HookExecution) error
+}
+
+// Observer is told the outcome of every hook run, e.g. to notice a storm
+// of failures.
+type Observer interface {
+	ObserveHook(event string, err error)
+}
+
 type Runner struct {
-	logger *slog.Logger
-	client *http.Client
+	logger      *slog.Logger
+	client      *http.Client
+	secretsFile string
+	sealer      *sealing.Sealer
+	recorder    HistoryRecorder
+	observer    Observer
+	chaos       *chaos.Injector
+
+	workers   int
+	queueSize int
+
+	timeoutsMu     sync.RWMutex
+	defaultTimeout time.Duration
+	eventTimeouts  map[string]time.Duration
+	baseCtx        context.Context
+	cancelBase     context.CancelFunc
+	startOnce      sync.Once
+	queueMu        sync.RWMutex
+	closed         bool
+	shards         []chan hookJob
+	workerWG       sync.WaitGroup
+	inFlight       atomic.Int64
+	processed      atomic.Int64
+	dropped        atomic.Int64
+
+	dnsProviders map[string]DNSProvider
 }
 
 func NewRunner(logger *slog.Logger) *Runner {
 	if logger == nil {
 		logger = slog.Default()
 	}
+	baseCtx, cancelBase := context.WithCancel(context.Background())
 	return &Runner{
-		logger: logger,
-		client: &http.Client{},
+		logger:         logger,
+		client:         &http.Client{},
+		defaultTimeout: DefaultTimeout,
+		baseCtx:        baseCtx,
+		cancelBase:     cancelBase,
 	}
 }
 
-func (r *Runner) RunAsync(event string, hooks []model.HookEntry, payload model.HookContext) {
+func (r *Runner) WithSecretsFile(path string) *Runner {
+	r.secretsFile = strings.TrimSpace(path)
+	return r
+}
+
+// WithChaos lets the injector drop hook deliveries; a dropped hook counts as
+// a failed one.
+func (r *Runner) WithChaos(injector *chaos.Injector) *Runner {
+	r.chaos = injector
+	return r
+}
+
+// WithSealer lets the runner open sealed VM env files and a sealed secrets file.
+func (r *Runner) WithSealer(sealer *sealing.Sealer) *Runner {
+	r.sealer = sealer
+	return r
+}
+
+// WithTimeouts sets the umbrella deadline for one async event run. Per-event
+// values override the default; zero keeps the built-in 20s. Safe to call
+// while hooks run, e.g. on config reload.
+func (r *Runner) WithTimeouts(defaultTimeout time.Duration, perEvent map[string]time.Duration) *Runner {
+	r.timeoutsMu.Lock()
+	defer r.timeoutsMu.Unlock()
+	if defaultTimeout > 0 {
+		r.defaultTimeout = defaultTimeout
+	}
+	r.eventTimeouts = perEvent
+	return r
+}
+
+// eventTimeout never cuts a run shorter than the sum of its explicit
+// per-hook timeouts.
+func (r *Runner) eventTimeout(event string, hooks []model.HookEntry) time.Duration {
+	r.timeoutsMu.RLock()
+	timeout := r.defaultTimeout
+	if override, ok := r.eventTimeouts[event]; ok && override > 0 {
+		timeout = override
+	}
+	r.timeoutsMu.RUnlock()
+	var perHook time.Duration
+	for _, hook := range hooks {
+		perHook += time.Duration(hook.TimeoutMs) * time.Millisecond
+	}
+	if perHook > timeout {
+		timeout = perHook
+	}
+	return timeout
+}
+
+func (r *Runner) WithRecorder(recorder HistoryRecorder) *Runner {
+	r.recorder = recorder
+	return r
+}
+
+func (r *Runner) WithObserver(observer Observer) *Runner {
+	r.observer = observer
+	return r
+}
+
+func (r *Runner) RunAsync(ctx context.Context, event string, hooks []model.HookEntry, payload model.HookContext) {
 	if len(hooks) == 0 {
 		r.logger.Debug("no hooks to execute", "event", event, "vmID", payload.ID)
 		return
 	}
 	r.logger.Debug("scheduling async hook execution", "event", event, "vmID", payload.ID, "hookCount", len(hooks))
 
-	go func() {
-		ctx, cancel := context.WithTimeout(context.Background(), 20*time.Second)
-		defer cancel()
-		if err := r.Run(ctx, event, hooks, payload); err != nil {
-			r.logger.Warn("hook execution finished with errors", "event", event, "vmID", payload.ID, "error", err)
-			return
-		}
-		r.logger.Debug("hook execution finished", "event", event, "vmID", payload.ID, "hookCount", len(hooks))
-	}()
+	if !r.enqueue(hookJob{ctx: context.WithoutCancel(ctx), event: event, hooks: hooks, payload: payload}) {
+		r.logger.Warn("hook queue full, dropping hook execution", "event", event, "vmID", payload.ID, "hookCount", len(hooks))
+	}
 }
 
 func (r *Runner) Run(ctx context.Context, event string, hooks []model.HookEntry, payload model.HookContext) error {
 	var strictErrors []error
+	payload.Event = event
 
 	for i, hook := range hooks {
 		r.logger.Debug("executing hook", "event", event, "vmID", payload.ID, "index", i, "type", hook.Type, "strict", hook.Strict)
-		if err := r.execute(ctx, hook, payload); err != nil {
+		startedAt := time.Now()
+		hookCtx, span := tracing.Start(ctx, "hook "+hook.Type, "event", event, "vmID", payload.ID, "index", i, "target", hookTarget(hook))
+		var output string
+		var err error
+		if r.chaos.DropHook(ctx, event, hook.Type, payload.ID) {
+			err = fmt.Errorf("%w: hook delivery dropped", chaos.ErrInjected)
+		} else {
+			output, err = r.execute(hookCtx, hook, payload)
+		}
+		span.RecordError(err)
+		span.End()
+		r.record(event, i, hook, payload, startedAt, output, err)
+		if r.observer != nil {
+			r.observer.ObserveHook(event, err)
+		}
+		if err != nil {
 			r.logger.Warn("hook failed", "event", event, "type", hook.Type, "vmID", payload.ID, "error", err)
 			if hook.Strict {
 				strictErrors = append(strictErrors, err)
@@ -70,7 +186,56 @@ func (r *Runner) Run(ctx context.Context, event string, hooks []model.HookEntry,
 	return nil
 }
 
-func (r *Runner) execute(ctx context.Context, hook model.HookEntry, payload model.HookContext) error {
+func (r *Runner) record(event string, index int, hook model.HookEntry, payload model.HookContext, startedAt time.Time, output string, err error) {
+	if r.recorder == nil || payload.ID == "" {
+		return
+	}
+	record := newExecution(event, index, hook, startedAt, output, err)
+	if recordErr := r.recorder.AppendHookExecution(payload.ID, record); recordErr != nil {
+		r.logger.Warn("recording hook execution failed", "event", event, "vmID", payload.ID, "error", recordErr)
+	}
+}
+
+func newExecution(event string, index int, hook model.HookEntry, startedAt time.Time, output string, err error) model.HookExecution {
+	record := model.HookExecution{
+		Event:      event,
+		Index:      index,
+		Type:       hook.Type,
+		Target:     hookTarget(hook),
+		StartedAt:  startedAt.UTC(),
+		DurationMs: time.Since(startedAt).Milliseconds(),
+		Status:     "succeeded",
+	}
+	if err != nil {
+		record.Status = "failed"
+		record.Error = err.Error()
+	}
+	record.Output, record.Truncated = truncateOutput(output)
+	return record
+}
+
+func hookTarget(hook model.HookEntry) string {
+	if hook.DNS != nil {
+		return hook.DNS.Provider + ":" + hook.DNS.Name
+	}
+	if strings.EqualFold(hook.Type, "slack") {
+		return "slack"
+	}
+	if hook.URL != "" {
+		return hook.URL
+	}
+	return strings.Join(hook.Cmd, " ")
+}
+
+func truncateOutput(output string) (string, bool) {
+	output = strings.TrimSpace(output)
+	if len(output) <= maxRecordedOutputBytes {
+		return output, false
+	}
+	return output[:maxRecordedOutputBytes], true
+}
+
+func (r *Runner) execute(ctx context.Context, hook model.HookEntry, payload model.HookContext) (string, error) {
 	hookCtx := ctx
 	cancel := func() {}
 	if hook.TimeoutMs > 0 {
@@ -83,77 +248,135 @@ func (r *Runner) execute(ctx context.Context, hook model.HookEntry, payload mode
 		return r.execHTTP(hookCtx, hook, payload)
 	case "exec":
 		return r.execCommand(hookCtx, hook, payload)
+	case "slack":
+		return r.execSlack(hookCtx, hook, payload)
+	case "dns":
+		return r.execDNS(hookCtx, hook, payload)
+	case "exec-in-vm":
+		return r.execInVM(hookCtx, hook, payload)
 	default:
-		return fmt.Errorf("unsupported hook type: %s", hook.Type)
+		return "", fmt.Errorf("unsupported hook type: %s", hook.Type)
 	}
 }
 
-func (r *Runner) execHTTP(ctx context.Context, hook model.HookEntry, payload model.HookContext) error {
+func (r *Runner) execHTTP(ctx context.Context, hook model.HookEntry, payload model.HookContext) (string, error) {
 	if hook.URL == "" {
-		return errors.New("http hook url is empty")
+		return "", errors.New("http hook url is empty")
 	}
-	r.logger.Debug("executing http hook", "vmID", payload.ID, "url", hook.URL)
-	body, err := json.Marshal(payload)
+	url, err := renderTemplate(hook.URL, payload)
 	if err != nil {
-		return err
+		return "", fmt.Errorf("render url: %w", err)
+	}
+	r.logger.Debug("executing http hook", "vmID", payload.ID, "url", url)
+
+	var body []byte
+	if strings.TrimSpace(hook.Body) != "" {
+		rendered, err := renderTemplate(hook.Body, payload)
+		if err != nil {
+			return "", fmt.Errorf("render body: %w", err)
+		}
+		body = []byte(rendered)
+	} else {
+		body, err = json.Marshal(payload)
+		if err != nil {
+			return "", err
+		}
 	}
 
-	req, err := http.NewRequestWithContext(ctx, http.MethodPost, hook.URL, bytes.NewReader(body))
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(body))
 	if err != nil {
-		return err
+		return "", err
 	}
 	req.Header.Set("Content-Type", "application/json")
+	if traceparent := tracing.Traceparent(ctx); traceparent != "" {
+		req.Header.Set("traceparent", traceparent)
+	}
 	for key, value := range hook.Headers {
-		req.Header.Set(key, value)
+		rendered, err := renderTemplate(value, payload)
+		if err != nil {
+			return "", fmt.Errorf("render header %s: %w", key, err)
+		}
+		req.Header.Set(key, rendered)
+	}
+	if err := r.applyHTTPAuth(req, hook, body); err != nil {
+		return "", err
 	}
 
 	resp, err := r.client.Do(req)
 	if err != nil {
-		return err
+		return "", err
 	}
 	defer resp.Body.Close()
+	respBody, _ := io.ReadAll(io.LimitReader(resp.Body, maxRecordedOutputBytes+1))
+	output := resp.Status
+	if trimmed := strings.TrimSpace(string(respBody)); trimmed != "" {
+		output += "\n" + trimmed
+	}
 	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
-		return fmt.Errorf("unexpected response status: %s", resp.Status)
+		return output, fmt.Errorf("unexpected response status: %s", resp.Status)
+	}
+	r.logger.Debug("http hook succeeded", "vmID", payload.ID, "url", url, "status", resp.Status)
+	return output, nil
+}
+
+func (r *Runner) applyHTTPAuth(req *http.Request, hook model.HookEntry, body []byte) error {
+	if strings.TrimSpace(hook.SecretRef) != "" {
+		token, err := r.lookupSecret(hook.SecretRef)
+		if err != nil {
+			return fmt.Errorf("resolve bearer token: %w", err)
+		}
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	if strings.TrimSpace(hook.HMACSecretRef) != "" {
+		secret, err := r.lookupSecret(hook.HMACSecretRef)
+		if err != nil {
+			return fmt.Errorf("resolve hmac secret: %w", err)
+		}
+		now := time.Now()
+		req.Header.Set(TimestampHeader, strconv.FormatInt(now.Unix(), 10))
+		req.Header.Set(SignatureHeader, SignPayload(secret, now, body))
 	}
-	r.logger.Debug("http hook succeeded", "vmID", payload.ID, "url", hook.URL, "status", resp.Status)
 	return nil
 }
 
-func (r *Runner) execCommand(ctx context.Context, hook model.HookEntry, payload model.HookContext) error {
+func (r *Runner) execCommand(ctx context.Context, hook model.HookEntry, payload model.HookContext) (string, error) {
 	if len(hook.Cmd) == 0 {
-		return errors.New("exec hook command is empty")
+		return "", errors.New("exec hook command is empty")
 	}
 
 	argv := make([]string, 0, len(hook.Cmd))
 	for _, part := range hook.Cmd {
 		rendered, err := renderTemplate(part, payload)
 		if err != nil {
-			return err
+			return "", err
 		}
 		argv = append(argv, rendered)
 	}
 
-	cmd := exec.CommandContext(ctx, argv[0], argv[1:]...)
-	r.logger.Debug("executing command hook", "vmID", payload.ID, "command", strings.Join(argv, " "))
-	output, err := cmd.CombinedOutput()
+	workDir, err := hookWorkDir(hook, payload)
 	if err != nil {
-		return fmt.Errorf("exec hook failed: %w, output=%s", err, strings.TrimSpace(string(output)))
+		return "", err
 	}
-	trimmed := strings.TrimSpace(string(output))
-	if trimmed != "" {
-		r.logger.Debug("command hook output", "vmID", payload.ID, "command", strings.Join(argv, " "), "output", trimmed)
+	env, err := hookEnv(payload, r.sealer)
+	if err != nil {
+		return "", err
+	}
+
+	if traceparent := tracing.Traceparent(ctx); traceparent != "" {
+		env = append(env, "TRACEPARENT="+traceparent)
 	}
-	return nil
-}
 
-func renderTemplate(input string, payload model.HookContext) (string, error) {
-	tpl, err := template.New("hook").Option("missingkey=error").Parse(input)
+	cmd := exec.CommandContext(ctx, argv[0], argv[1:]...)
+	cmd.Dir = workDir
+	cmd.Env = env
+	r.logger.Debug("executing command hook", "vmID", payload.ID, "command", strings.Join(argv, " "), "dir", workDir)
+	output, err := cmd.CombinedOutput()
+	trimmed := strings.TrimSpace(string(output))
 	if err != nil {
-		return "", err
+		return trimmed, fmt.Errorf("exec hook failed: %w, output=%s", err, trimmed)
 	}
-	var buf bytes.Buffer
-	if err := tpl.Execute(&buf, payload); err != nil {
-		return "", err
+	if trimmed != "" {
+		r.logger.Debug("command hook output", "vmID", payload.ID, "command", strings.Join(argv, " "), "output", trimmed)
 	}
-	return buf.String(), nil
+	return trimmed, nil
 }
@@ -0,0 +1,319 @@
+package hooks
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/alperreha/mergen-fire/internal/firecracker"
+	"github.com/alperreha/mergen-fire/internal/model"
+)
+
+func TestRunHTTPHookSignsPayloadAndSetsBearer(t *testing.T) {
+	secretsPath := filepath.Join(t.TempDir(), "hook-secrets.json")
+	if err := os.WriteFile(secretsPath, []byte(`{"token":"t0k3n","signing":"s3cr3t"}`), 0o600); err != nil {
+		t.Fatalf("write secrets: %v", err)
+	}
+
+	var (
+		gotAuth  string
+		gotValid bool
+	)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		gotAuth = r.Header.Get("Authorization")
+		gotValid = VerifySignature("s3cr3t", r.Header.Get(TimestampHeader), r.Header.Get(SignatureHeader), body)
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer server.Close()
+
+	runner := NewRunner(nil).WithSecretsFile(secretsPath)
+	err := runner.Run(context.Background(), model.HookOnCreate, []model.HookEntry{
+		{Type: "http", URL: server.URL, SecretRef: "token", HMACSecretRef: "signing", Strict: true},
+	}, model.HookContext{ID: "vm-1"})
+	if err != nil {
+		t.Fatalf("run hooks: %v", err)
+	}
+	if gotAuth != "Bearer t0k3n" {
+		t.Fatalf("unexpected authorization header: %q", gotAuth)
+	}
+	if !gotValid {
+		t.Fatalf("signature did not verify")
+	}
+}
+
+func TestRunHTTPHookMissingSecretFailsStrictHook(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer server.Close()
+
+	runner := NewRunner(nil).WithSecretsFile(filepath.Join(t.TempDir(), "missing.json"))
+	err := runner.Run(context.Background(), model.HookOnCreate, []model.HookEntry{
+		{Type: "http", URL: server.URL, SecretRef: "token", Strict: true},
+	}, model.HookContext{ID: "vm-1"})
+	if err == nil {
+		t.Fatalf("expected missing secret to fail strict hook")
+	}
+}
+
+func TestRunHTTPHookRendersURLHeadersAndBody(t *testing.T) {
+	var (
+		gotQuery  string
+		gotHeader string
+		gotBody   string
+	)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		gotQuery = r.URL.RawQuery
+		gotHeader = r.Header.Get("X-VM")
+		gotBody = string(body)
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer server.Close()
+
+	runner := NewRunner(nil)
+	err := runner.Run(context.Background(), model.HookOnStart, []model.HookEntry{
+		{
+			Type:    "http",
+			URL:     server.URL + "/register?id={{ .ID }}&port={{ hostPort 80 }}",
+			Headers: map[string]string{"X-VM": "{{ upper .ID }}"},
+			Body:    `{"vm":{{ json .ID }},"meta":{{ json .Metadata }}}`,
+			Strict:  true,
+		},
+	}, model.HookContext{ID: "vm-1", GuestPorts: []int{80}, HostPorts: []int{18080}, Metadata: map[string]any{"env": "dev"}})
+	if err != nil {
+		t.Fatalf("run hooks: %v", err)
+	}
+	if gotQuery != "id=vm-1&port=18080" {
+		t.Fatalf("unexpected query: %q", gotQuery)
+	}
+	if gotHeader != "VM-1" {
+		t.Fatalf("unexpected header: %q", gotHeader)
+	}
+	if gotBody != `{"vm":"vm-1","meta":{"env":"dev"}}` {
+		t.Fatalf("unexpected body: %q", gotBody)
+	}
+}
+
+func TestRenderTemplateUnknownGuestPortFails(t *testing.T) {
+	if _, err := renderTemplate("{{ hostPort 22 }}", model.HookContext{GuestPorts: []int{80}, HostPorts: []int{18080}}); err == nil {
+		t.Fatalf("expected error for unpublished guest port")
+	}
+}
+
+func TestRunExecHookReceivesContextEnv(t *testing.T) {
+	configDir := t.TempDir()
+	envPath := filepath.Join(configDir, "env")
+	if err := os.WriteFile(envPath, []byte("APP_MODE='blue green'\nMGN_VM_ID=stale\n"), 0o600); err != nil {
+		t.Fatalf("write env: %v", err)
+	}
+	outPath := filepath.Join(t.TempDir(), "out")
+
+	runner := NewRunner(nil)
+	err := runner.Run(context.Background(), model.HookOnStart, []model.HookEntry{
+		{
+			Type:   "exec",
+			Cmd:    []string{"/bin/sh", "-c", `printf '%s|%s|%s|%s|%s' "$MGN_VM_ID" "$MGN_HOOK_EVENT" "$MGN_HOST_PORT_80" "$APP_MODE" "$PWD" > "$0"`, outPath},
+			Strict: true,
+		},
+	}, model.HookContext{
+		ID:         "vm-1",
+		GuestPorts: []int{80},
+		HostPorts:  []int{18080},
+		Paths:      model.VMPaths{ConfigDir: configDir, EnvPath: envPath},
+	})
+	if err != nil {
+		t.Fatalf("run hooks: %v", err)
+	}
+
+	got, err := os.ReadFile(outPath)
+	if err != nil {
+		t.Fatalf("read output: %v", err)
+	}
+	want := "vm-1|onStart|18080|blue green|" + configDir
+	if string(got) != want {
+		t.Fatalf("expected %q, got %q", want, string(got))
+	}
+}
+
+func TestRunSlackAndDNSHooks(t *testing.T) {
+	var (
+		slackText string
+		dnsMethod string
+		dnsRecord DNSRecord
+	)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/slack":
+			var body map[string]string
+			_ = json.NewDecoder(r.Body).Decode(&body)
+			slackText = body["text"]
+		case "/dns":
+			dnsMethod = r.Method
+			_ = json.NewDecoder(r.Body).Decode(&dnsRecord)
+		}
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer server.Close()
+
+	runner := NewRunner(nil)
+	err := runner.Run(context.Background(), model.HookOnCreate, []model.HookEntry{
+		{Type: "slack", URL: server.URL + "/slack", Strict: true},
+		{Type: "dns", DNS: &model.DNSHook{Provider: "http", Endpoint: server.URL + "/dns", Name: "{{ .ID }}.vm.example.com"}, Strict: true},
+	}, model.HookContext{ID: "vm-1", GuestIP: "172.30.0.2"})
+	if err != nil {
+		t.Fatalf("run hooks: %v", err)
+	}
+	if slackText != "mergen: vm vm-1 onCreate" {
+		t.Fatalf("unexpected slack text: %q", slackText)
+	}
+	if dnsMethod != http.MethodPut || dnsRecord.Name != "vm-1.vm.example.com" || dnsRecord.Value != "172.30.0.2" || dnsRecord.TTL != 60 {
+		t.Fatalf("unexpected dns request: %s %+v", dnsMethod, dnsRecord)
+	}
+}
+
+func TestRunCloudflareDNSHookReadsFullListing(t *testing.T) {
+	var updated string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodGet:
+			// Larger than the recorded output of a hook, which used to cut
+			// the listing short.
+			records := []cloudflareRecord{{ID: "rec-1", Type: "A", Name: "vm-1.vm.example.com", Content: "172.30.0.9", TTL: 60}}
+			for i := 0; i < 100; i++ {
+				records = append(records, cloudflareRecord{ID: fmt.Sprintf("other-%d", i), Type: "A", Name: "other.vm.example.com", Content: "172.30.0.10", TTL: 60})
+			}
+			_ = json.NewEncoder(w).Encode(map[string]any{"result": records})
+		case http.MethodPut:
+			updated = r.URL.Path
+		default:
+			t.Errorf("unexpected %s %s", r.Method, r.URL.Path)
+		}
+	}))
+	defer server.Close()
+
+	runner := NewRunner(nil)
+	err := runner.Run(context.Background(), model.HookOnStart, []model.HookEntry{
+		{Type: "dns", DNS: &model.DNSHook{Provider: "cloudflare", Endpoint: server.URL, Zone: "zone-1", Name: "{{ .ID }}.vm.example.com"}, Strict: true},
+	}, model.HookContext{ID: "vm-1", GuestIP: "172.30.0.2"})
+	if err != nil {
+		t.Fatalf("run hooks: %v", err)
+	}
+	if updated != "/zones/zone-1/dns_records/rec-1" {
+		t.Fatalf("expected existing record to be updated, got PUT %q", updated)
+	}
+}
+
+func TestRunExecInVMHook(t *testing.T) {
+	dir := t.TempDir()
+	udsPath := filepath.Join(dir, "v.sock")
+	listener, err := net.Listen("unix", udsPath)
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	defer listener.Close()
+	requests := make(chan guestExecRequest, 2)
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			reader := bufio.NewReader(conn)
+			if line, _ := reader.ReadString('\n'); line != fmt.Sprintf("CONNECT %d\n", firecracker.GuestExecPort) {
+				conn.Close()
+				continue
+			}
+			_, _ = conn.Write([]byte("OK 1073741824\n"))
+			var req guestExecRequest
+			if err := json.NewDecoder(reader).Decode(&req); err != nil {
+				conn.Close()
+				continue
+			}
+			requests <- req
+			reply := guestExecResponse{Stdout: strings.Join(req.Argv, " ")}
+			if req.Argv[0] == "false" {
+				reply = guestExecResponse{ExitCode: 1, Stderr: "nope"}
+			}
+			_ = json.NewEncoder(conn).Encode(reply)
+			conn.Close()
+		}
+	}()
+
+	vmConfigPath := filepath.Join(dir, "vm.json")
+	content, _ := json.Marshal(model.VMConfig{Vsock: &model.Vsock{VsockID: "vsock0", GuestCID: 3, UdsPath: udsPath}})
+	if err := os.WriteFile(vmConfigPath, content, 0o600); err != nil {
+		t.Fatalf("write vm config: %v", err)
+	}
+	payload := model.HookContext{ID: "vm-1", Paths: model.VMPaths{VMConfigPath: vmConfigPath}}
+	runner := NewRunner(nil)
+
+	output, err := runner.execute(context.Background(), model.HookEntry{Type: "exec-in-vm", Cmd: []string{"echo", "{{ .ID }}"}, TimeoutMs: 5000}, payload)
+	if err != nil {
+		t.Fatalf("exec in vm: %v", err)
+	}
+	if output != "echo vm-1" {
+		t.Fatalf("unexpected output: %q", output)
+	}
+	if req := <-requests; req.TimeoutMs <= 0 || req.TimeoutMs > 5000 {
+		t.Fatalf("expected the hook timeout to reach the agent, got %dms", req.TimeoutMs)
+	}
+
+	output, err = runner.execute(context.Background(), model.HookEntry{Type: "exec-in-vm", Cmd: []string{"false"}}, payload)
+	if err == nil || output != "nope" {
+		t.Fatalf("expected failing command to fail the hook, got %q (%v)", output, err)
+	}
+
+	content, _ = json.Marshal(model.VMConfig{})
+	if err := os.WriteFile(vmConfigPath, content, 0o600); err != nil {
+		t.Fatalf("write vm config: %v", err)
+	}
+	if _, err := runner.execute(context.Background(), model.HookEntry{Type: "exec-in-vm", Cmd: []string{"true"}}, payload); err == nil || !strings.Contains(err.Error(), "no vsock device") {
+		t.Fatalf("expected missing vsock device error, got %v", err)
+	}
+}
+
+type recordingObserver struct {
+	events []string
+	errs   []error
+}
+
+func (o *recordingObserver) ObserveHook(event string, err error) {
+	o.events = append(o.events, event)
+	o.errs = append(o.errs, err)
+}
+
+func TestRunReportsHookResultsToObserver(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/fail" {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer server.Close()
+
+	observer := &recordingObserver{}
+	runner := NewRunner(nil).WithObserver(observer)
+	_ = runner.Run(context.Background(), model.HookOnStart, []model.HookEntry{
+		{Type: "http", URL: server.URL + "/ok"},
+		{Type: "http", URL: server.URL + "/fail"},
+	}, model.HookContext{ID: "vm-1"})
+
+	if len(observer.errs) != 2 || observer.events[0] != model.HookOnStart {
+		t.Fatalf("expected 2 observed %s hooks, got %v", model.HookOnStart, observer.events)
+	}
+	if observer.errs[0] != nil || observer.errs[1] == nil {
+		t.Fatalf("expected success then failure, got %v", observer.errs)
+	}
+}
@@ -0,0 +1,75 @@
+package hooks
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	SignatureHeader = "X-Mergen-Signature"
+	TimestampHeader = "X-Mergen-Timestamp"
+)
+
+var ErrSecretNotFound = errors.New("hook secret not found")
+
+// Secrets are re-read on every lookup so rotation does not need a restart.
+func (r *Runner) lookupSecret(name string) (string, error) {
+	name = strings.TrimSpace(name)
+	if name == "" {
+		return "", errors.New("secret reference is empty")
+	}
+	if r.secretsFile == "" {
+		return "", fmt.Errorf("%w: %s (no secrets file configured)", ErrSecretNotFound, name)
+	}
+
+	content, err := os.ReadFile(r.secretsFile)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return "", fmt.Errorf("%w: %s (secrets file %s missing)", ErrSecretNotFound, name, r.secretsFile)
+		}
+		return "", fmt.Errorf("read hook secrets file: %w", err)
+	}
+	content, err = r.sealer.Open(content)
+	if err != nil {
+		return "", fmt.Errorf("open hook secrets file: %w", err)
+	}
+
+	secrets := map[string]string{}
+	if len(content) > 0 {
+		if err := json.Unmarshal(content, &secrets); err != nil {
+			return "", fmt.Errorf("decode hook secrets file: %w", err)
+		}
+	}
+
+	value, ok := secrets[name]
+	if !ok || value == "" {
+		return "", fmt.Errorf("%w: %s", ErrSecretNotFound, name)
+	}
+	return value, nil
+}
+
+// The signed message is "<unix-seconds>.<body>" so receivers can reject replays.
+func SignPayload(secret string, timestamp time.Time, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(strconv.FormatInt(timestamp.Unix(), 10)))
+	mac.Write([]byte("."))
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+func VerifySignature(secret, timestamp, signature string, body []byte) bool {
+	seconds, err := strconv.ParseInt(strings.TrimSpace(timestamp), 10, 64)
+	if err != nil {
+		return false
+	}
+	expected := SignPayload(secret, time.Unix(seconds, 0), body)
+	return hmac.Equal([]byte(expected), []byte(strings.TrimSpace(signature)))
+}
@@ -0,0 +1,98 @@
+package hooks
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"strings"
+	"text/template"
+
+	"github.com/alperreha/mergen-fire/internal/model"
+)
+
+// templateFuncs is the function map available to exec argv, HTTP url, header
+// and body templates. Keep README "Hook templates" in sync when adding entries.
+func templateFuncs(payload model.HookContext) template.FuncMap {
+	return template.FuncMap{
+		"hostPort": func(guestPort int) (int, error) {
+			for i, guest := range payload.GuestPorts {
+				if guest == guestPort && i < len(payload.HostPorts) {
+					return payload.HostPorts[i], nil
+				}
+			}
+			return 0, fmt.Errorf("no host port published for guest port %d", guestPort)
+		},
+		"json": func(value any) (string, error) {
+			encoded, err := json.Marshal(value)
+			if err != nil {
+				return "", err
+			}
+			return string(encoded), nil
+		},
+		"jsonIndent": func(value any) (string, error) {
+			encoded, err := json.MarshalIndent(value, "", "  ")
+			if err != nil {
+				return "", err
+			}
+			return string(encoded), nil
+		},
+		"meta": func(key string) any {
+			if payload.Metadata == nil {
+				return ""
+			}
+			if value, ok := payload.Metadata[key]; ok {
+				return value
+			}
+			return ""
+		},
+		"default": func(fallback, value any) any {
+			if isEmptyValue(value) {
+				return fallback
+			}
+			return value
+		},
+		"join":  strings.Join,
+		"lower": strings.ToLower,
+		"upper": strings.ToUpper,
+		"trim":  strings.TrimSpace,
+	}
+}
+
+func renderTemplate(input string, payload model.HookContext) (string, error) {
+	if !strings.Contains(input, "{{") {
+		return input, nil
+	}
+	tpl, err := template.New("hook").Funcs(templateFuncs(payload)).Option("missingkey=error").Parse(input)
+	if err != nil {
+		return "", err
+	}
+	var buf bytes.Buffer
+	if err := tpl.Execute(&buf, payload); err != nil {
+		return "", err
+	}
+	return buf.String(), nil
+}
+
+func isEmptyValue(value any) bool {
+	if value == nil {
+		return true
+	}
+	v := reflect.ValueOf(value)
+	switch v.Kind() {
+	case reflect.String, reflect.Slice, reflect.Map, reflect.Array:
+		return v.Len() == 0
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return v.Int() == 0
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return v.Uint() == 0
+	case reflect.Float32, reflect.Float64:
+		return v.Float() == 0
+	case reflect.Bool:
+		return !v.Bool()
+	case reflect.Pointer, reflect.Interface:
+		return v.IsNil()
+	default:
+		return false
+	}
+}
@@ -0,0 +1,80 @@
+package hooks
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/alperreha/mergen-fire/internal/model"
+)
+
+// Render evaluates every template of a hook without executing it.
+func (r *Runner) Render(event string, hook model.HookEntry, payload model.HookContext) (model.RenderedHook, error) {
+	payload.Event = event
+	var (
+		rendered model.RenderedHook
+		err      error
+	)
+
+	if rendered.URL, err = renderTemplate(hook.URL, payload); err != nil {
+		return rendered, fmt.Errorf("render url: %w", err)
+	}
+	if len(hook.Headers) > 0 {
+		rendered.Headers = make(map[string]string, len(hook.Headers))
+		for key, value := range hook.Headers {
+			if rendered.Headers[key], err = renderTemplate(value, payload); err != nil {
+				return rendered, fmt.Errorf("render header %s: %w", key, err)
+			}
+		}
+	}
+	if rendered.Body, err = renderTemplate(hook.Body, payload); err != nil {
+		return rendered, fmt.Errorf("render body: %w", err)
+	}
+	for _, part := range hook.Cmd {
+		value, err := renderTemplate(part, payload)
+		if err != nil {
+			return rendered, fmt.Errorf("render cmd: %w", err)
+		}
+		rendered.Cmd = append(rendered.Cmd, value)
+	}
+	if rendered.WorkDir, err = renderTemplate(hook.WorkDir, payload); err != nil {
+		return rendered, fmt.Errorf("render workDir: %w", err)
+	}
+
+	switch strings.ToLower(strings.TrimSpace(hook.Type)) {
+	case "slack":
+		message := hook.Message
+		if strings.TrimSpace(message) == "" {
+			message = defaultSlackMessage
+		}
+		if rendered.Message, err = renderTemplate(message, payload); err != nil {
+			return rendered, fmt.Errorf("render message: %w", err)
+		}
+	case "dns":
+		if hook.DNS != nil {
+			if rendered.DNSName, err = renderTemplate(hook.DNS.Name, payload); err != nil {
+				return rendered, fmt.Errorf("render dns name: %w", err)
+			}
+			value := hook.DNS.Value
+			if strings.TrimSpace(value) == "" {
+				value = defaultDNSValue
+			}
+			if rendered.DNSValue, err = renderTemplate(value, payload); err != nil {
+				return rendered, fmt.Errorf("render dns value: %w", err)
+			}
+		}
+	}
+	return rendered, nil
+}
+
+// Fire executes a single hook synchronously and returns its execution record.
+// Test runs are not written to the VM's hook history.
+func (r *Runner) Fire(ctx context.Context, event string, index int, hook model.HookEntry, payload model.HookContext) model.HookExecution {
+	payload.Event = event
+	ctx, cancel := context.WithTimeout(ctx, r.eventTimeout(event, []model.HookEntry{hook}))
+	defer cancel()
+	startedAt := time.Now()
+	output, err := r.execute(ctx, hook, payload)
+	return newExecution(event, index, hook, startedAt, output, err)
+}
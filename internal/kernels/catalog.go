@@ -0,0 +1,218 @@
+// Package kernels keeps the host's catalog of named kernel images, so VMs can
+// ask for "5.10-minimal" instead of a path that changes with every rollout.
+package kernels
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"regexp"
+	"runtime"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/alperreha/mergen-fire/internal/artifact"
+	"github.com/alperreha/mergen-fire/internal/model"
+)
+
+var (
+	ErrNotFound = errors.New("kernel not found")
+	ErrInvalid  = errors.New("invalid kernel")
+)
+
+var namePattern = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9._-]{0,63}$`)
+
+// Architectures Firecracker runs on, as reported by uname -m.
+const (
+	ArchX86_64  = "x86_64"
+	ArchAarch64 = "aarch64"
+)
+
+// HostArch is the kernel architecture this mergend can boot.
+func HostArch() string {
+	if runtime.GOARCH == "arm64" {
+		return ArchAarch64
+	}
+	return ArchX86_64
+}
+
+// IsName reports whether ref names a catalog entry rather than a path.
+func IsName(ref string) bool {
+	return !strings.Contains(ref, "/") && namePattern.MatchString(ref)
+}
+
+type catalogFile struct {
+	Kernels []model.Kernel `json:"kernels"`
+}
+
+// Catalog is a JSON file of kernel entries. Every call reads the file, so
+// edits by hand or by another process are picked up.
+type Catalog struct {
+	path   string
+	logger *slog.Logger
+	mu     sync.Mutex
+}
+
+func NewCatalog(path string) *Catalog {
+	return &Catalog{path: path, logger: slog.Default()}
+}
+
+func (c *Catalog) WithLogger(logger *slog.Logger) *Catalog {
+	if logger != nil {
+		c.logger = logger
+	}
+	return c
+}
+
+// List returns the entries sorted by name.
+func (c *Catalog) List() ([]model.Kernel, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.read()
+}
+
+func (c *Catalog) Get(name string) (model.Kernel, error) {
+	kernels, err := c.List()
+	if err != nil {
+		return model.Kernel{}, err
+	}
+	for _, kernel := range kernels {
+		if kernel.Name == name {
+			return kernel, nil
+		}
+	}
+	return model.Kernel{}, fmt.Errorf("%w: %s", ErrNotFound, name)
+}
+
+// Put registers kernel under its name, replacing an entry of the same name.
+// The image is checksummed so later drift can be told apart from a rollout.
+func (c *Catalog) Put(kernel model.Kernel) (model.Kernel, error) {
+	kernel.Name = strings.TrimSpace(kernel.Name)
+	kernel.Path = strings.TrimSpace(kernel.Path)
+	kernel.Initrd = strings.TrimSpace(kernel.Initrd)
+	if !namePattern.MatchString(kernel.Name) {
+		return model.Kernel{}, fmt.Errorf("%w: name must match %s", ErrInvalid, namePattern)
+	}
+	if !filepath.IsAbs(kernel.Path) {
+		return model.Kernel{}, fmt.Errorf("%w: path must be absolute", ErrInvalid)
+	}
+	if kernel.Initrd != "" {
+		if !filepath.IsAbs(kernel.Initrd) {
+			return model.Kernel{}, fmt.Errorf("%w: initrd must be absolute", ErrInvalid)
+		}
+		if _, err := os.Stat(kernel.Initrd); err != nil {
+			return model.Kernel{}, fmt.Errorf("%w: initrd: %v", ErrInvalid, err)
+		}
+	}
+	if kernel.Arch == "" {
+		kernel.Arch = HostArch()
+	}
+	if kernel.Arch != ArchX86_64 && kernel.Arch != ArchAarch64 {
+		return model.Kernel{}, fmt.Errorf("%w: arch must be %s or %s", ErrInvalid, ArchX86_64, ArchAarch64)
+	}
+	sum, err := artifact.Checksum(kernel.Path)
+	if err != nil {
+		return model.Kernel{}, fmt.Errorf("%w: %v", ErrInvalid, err)
+	}
+	kernel.SHA256 = sum.SHA256
+	kernel.Size = sum.Size
+	kernel.RegisteredAt = time.Now().UTC()
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	kernels, err := c.read()
+	if err != nil {
+		return model.Kernel{}, err
+	}
+	replaced := false
+	for i := range kernels {
+		if kernels[i].Name == kernel.Name {
+			kernels[i] = kernel
+			replaced = true
+		}
+	}
+	if !replaced {
+		kernels = append(kernels, kernel)
+	}
+	if err := c.write(kernels); err != nil {
+		return model.Kernel{}, err
+	}
+	c.logger.Info("kernel registered", "name", kernel.Name, "path", kernel.Path, "arch", kernel.Arch, "replaced", replaced)
+	return kernel, nil
+}
+
+// Delete drops the entry; the image file and VMs created from it are left
+// alone.
+func (c *Catalog) Delete(name string) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	kernels, err := c.read()
+	if err != nil {
+		return err
+	}
+	kept := kernels[:0]
+	for _, kernel := range kernels {
+		if kernel.Name != name {
+			kept = append(kept, kernel)
+		}
+	}
+	if len(kept) == len(kernels) {
+		return fmt.Errorf("%w: %s", ErrNotFound, name)
+	}
+	if err := c.write(kept); err != nil {
+		return err
+	}
+	c.logger.Info("kernel removed", "name", name)
+	return nil
+}
+
+func (c *Catalog) read() ([]model.Kernel, error) {
+	content, err := os.ReadFile(c.path)
+	if errors.Is(err, os.ErrNotExist) {
+		return []model.Kernel{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var file catalogFile
+	if err := json.Unmarshal(content, &file); err != nil {
+		return nil, fmt.Errorf("parse kernel catalog %s: %w", c.path, err)
+	}
+	if file.Kernels == nil {
+		file.Kernels = []model.Kernel{}
+	}
+	sort.Slice(file.Kernels, func(i, j int) bool { return file.Kernels[i].Name < file.Kernels[j].Name })
+	return file.Kernels, nil
+}
+
+func (c *Catalog) write(kernels []model.Kernel) error {
+	content, err := json.MarshalIndent(catalogFile{Kernels: kernels}, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(c.path), 0o755); err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(c.path), ".tmp-kernels-")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(content); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Chmod(0o644); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), c.path)
+}
@@ -0,0 +1,58 @@
+package kernels
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/alperreha/mergen-fire/internal/model"
+)
+
+func TestCatalog_PutGetDelete(t *testing.T) {
+	dir := t.TempDir()
+	image := filepath.Join(dir, "vmlinux")
+	if err := os.WriteFile(image, []byte("kernel"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	catalog := NewCatalog(filepath.Join(dir, "etc", "kernels.json"))
+
+	if list, err := catalog.List(); err != nil || len(list) != 0 {
+		t.Fatalf("expected empty catalog without a file, got %v %v", list, err)
+	}
+	kernel, err := catalog.Put(model.Kernel{Name: "5.10-minimal", Path: image})
+	if err != nil {
+		t.Fatalf("put: %v", err)
+	}
+	if kernel.Arch != HostArch() || kernel.SHA256 == "" || kernel.Size != 6 {
+		t.Fatalf("expected arch and checksum filled in, got %+v", kernel)
+	}
+	if _, err := catalog.Put(model.Kernel{Name: "5.10-minimal", Path: image, BootArgs: "quiet"}); err != nil {
+		t.Fatalf("replace: %v", err)
+	}
+	got, err := NewCatalog(catalog.path).Get("5.10-minimal")
+	if err != nil || got.BootArgs != "quiet" {
+		t.Fatalf("expected replaced entry persisted, got %+v %v", got, err)
+	}
+
+	for _, bad := range []model.Kernel{
+		{Name: "../x", Path: image},
+		{Name: "k", Path: "vmlinux"},
+		{Name: "k", Path: image, Arch: "riscv64"},
+		{Name: "k", Path: filepath.Join(dir, "missing")},
+	} {
+		if _, err := catalog.Put(bad); !errors.Is(err, ErrInvalid) {
+			t.Fatalf("expected ErrInvalid for %+v, got %v", bad, err)
+		}
+	}
+
+	if err := catalog.Delete("5.10-minimal"); err != nil {
+		t.Fatalf("delete: %v", err)
+	}
+	if _, err := catalog.Get("5.10-minimal"); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("expected ErrNotFound after delete, got %v", err)
+	}
+	if err := catalog.Delete("5.10-minimal"); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("expected ErrNotFound deleting twice, got %v", err)
+	}
+}
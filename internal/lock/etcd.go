@@ -0,0 +1,176 @@
+package lock
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"sync"
+	"time"
+
+	"github.com/alperreha/mergen-fire/internal/etcd"
+	"github.com/alperreha/mergen-fire/internal/model"
+)
+
+const defaultLeaseTTL = 15 * time.Second
+
+type EtcdLocker struct {
+	client *etcd.Client
+	prefix string
+	ttl    time.Duration
+	logger *slog.Logger
+}
+
+func NewEtcdLocker(client *etcd.Client, prefix string, ttl time.Duration) *EtcdLocker {
+	if ttl <= 0 {
+		ttl = defaultLeaseTTL
+	}
+	return &EtcdLocker{
+		client: client,
+		prefix: prefix,
+		ttl:    ttl,
+		logger: slog.Default(),
+	}
+}
+
+func (l *EtcdLocker) WithLogger(logger *slog.Logger) *EtcdLocker {
+	if logger != nil {
+		l.logger = logger
+	}
+	return l
+}
+
+// Lock creates <prefix>/locks/<id> bound to a fresh lease, holding the
+// holder as JSON. The lease is kept alive until Release; if this process dies
+// the key expires after the TTL.
+func (l *EtcdLocker) Lock(id, operation string, wait time.Duration) (Handle, error) {
+	var handle Handle
+	err := retryLocked(wait, func() error {
+		var err error
+		handle, err = l.tryLock(id, operation)
+		return err
+	})
+	return handle, err
+}
+
+func (l *EtcdLocker) tryLock(id, operation string) (Handle, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), l.ttl)
+	defer cancel()
+
+	holder, err := json.Marshal(newHolder(operation))
+	if err != nil {
+		return nil, err
+	}
+	lease, err := l.client.Grant(ctx, l.ttl)
+	if err != nil {
+		return nil, err
+	}
+	key := l.key(id)
+	acquired, err := l.client.Txn(ctx,
+		[]etcd.Compare{{Key: key, Target: "CREATE", Revision: 0}},
+		[]etcd.Op{{Key: key, Value: holder, Lease: lease}},
+	)
+	if err != nil || !acquired {
+		_ = l.client.Revoke(ctx, lease)
+		if err != nil {
+			return nil, err
+		}
+		return nil, ErrAlreadyLocked
+	}
+
+	handle := &etcdLock{locker: l, key: key, lease: lease, stop: make(chan struct{})}
+	go handle.keepAlive()
+	return handle, nil
+}
+
+func (l *EtcdLocker) Inspect(id string) (model.LockStatus, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), l.ttl)
+	defer cancel()
+	status, _, err := l.inspect(ctx, id)
+	return status, err
+}
+
+// Break deletes the lock key unless it changed since it was inspected. Without
+// force only keys whose holder is a dead process on this host are removed;
+// everything else expires with its lease anyway.
+func (l *EtcdLocker) Break(id string, force bool) (model.LockStatus, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), l.ttl)
+	defer cancel()
+
+	status, revision, err := l.inspect(ctx, id)
+	if err != nil || !status.Held {
+		return status, err
+	}
+	if !status.Stale && !force {
+		return status, fmt.Errorf("%w: %s", ErrAlreadyLocked, Describe(status.Holder))
+	}
+	key := l.key(id)
+	deleted, err := l.client.Txn(ctx,
+		[]etcd.Compare{{Key: key, Target: "MOD", Revision: revision}},
+		[]etcd.Op{{Key: key, Delete: true}},
+	)
+	if err != nil {
+		return status, err
+	}
+	if !deleted {
+		return status, fmt.Errorf("%w: lock changed while breaking it", ErrAlreadyLocked)
+	}
+	status.Broken = true
+	return status, nil
+}
+
+func (l *EtcdLocker) inspect(ctx context.Context, id string) (model.LockStatus, int64, error) {
+	status := model.LockStatus{ID: id}
+	kv, err := l.client.Get(ctx, l.key(id))
+	if err != nil || kv == nil {
+		return status, 0, err
+	}
+	status.Held = true
+	var holder model.LockHolder
+	if json.Unmarshal(kv.Value, &holder) == nil && holder.PID > 0 {
+		status.Holder = &holder
+		status.Stale = isStale(holder)
+	}
+	return status, kv.ModRevision, nil
+}
+
+func (l *EtcdLocker) key(id string) string {
+	return l.prefix + "/locks/" + id
+}
+
+type etcdLock struct {
+	locker *EtcdLocker
+	key    string
+	lease  int64
+	stop   chan struct{}
+	once   sync.Once
+}
+
+func (h *etcdLock) keepAlive() {
+	ticker := time.NewTicker(h.locker.ttl / 3)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-h.stop:
+			return
+		case <-ticker.C:
+			ctx, cancel := context.WithTimeout(context.Background(), h.locker.ttl/3)
+			if err := h.locker.client.KeepAlive(ctx, h.lease); err != nil {
+				h.locker.logger.Warn("etcd lock keepalive failed", "key", h.key, "error", err)
+			}
+			cancel()
+		}
+	}
+}
+
+// Release revokes the lease, which deletes the lock key.
+func (h *etcdLock) Release() error {
+	var err error
+	h.once.Do(func() {
+		close(h.stop)
+		ctx, cancel := context.WithTimeout(context.Background(), h.locker.ttl)
+		defer cancel()
+		err = h.locker.client.Revoke(ctx, h.lease)
+	})
+	return err
+}
@@ -0,0 +1,36 @@
+package lock
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/alperreha/mergen-fire/internal/etcd"
+	"github.com/alperreha/mergen-fire/internal/etcd/etcdtest"
+)
+
+func TestEtcdLockerExcludesOtherHolders(t *testing.T) {
+	server := etcdtest.NewServer()
+	defer server.Close()
+	client := etcd.NewClient([]string{server.URL}, time.Second)
+
+	first := NewEtcdLocker(client, "/mergen", 3*time.Second)
+	second := NewEtcdLocker(client, "/mergen", 3*time.Second)
+
+	handle, err := first.Lock("vm-1", "start", 0)
+	if err != nil {
+		t.Fatalf("first lock: %v", err)
+	}
+	if _, err := second.Lock("vm-1", "start", 0); !errors.Is(err, ErrAlreadyLocked) {
+		t.Fatalf("expected ErrAlreadyLocked, got %v", err)
+	}
+	if err := handle.Release(); err != nil {
+		t.Fatalf("release: %v", err)
+	}
+
+	again, err := second.Lock("vm-1", "start", 0)
+	if err != nil {
+		t.Fatalf("lock after release: %v", err)
+	}
+	_ = again.Release()
+}
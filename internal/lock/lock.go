@@ -1,10 +1,16 @@
 package lock
 
 import (
+	"encoding/json"
 	"errors"
+	"fmt"
+	"io"
 	"os"
 	"path/filepath"
 	"syscall"
+	"time"
+
+	"github.com/alperreha/mergen-fire/internal/model"
 )
 
 var ErrAlreadyLocked = errors.New("lock already held")
@@ -13,25 +19,79 @@ type FileLock struct {
 	file *os.File
 }
 
-func Acquire(path string) (*FileLock, error) {
+// Acquire takes an exclusive flock on path and records the holder (PID, host,
+// operation, time) in the file so a conflicting caller can tell who has it.
+func Acquire(path, operation string) (*FileLock, error) {
 	if err := os.MkdirAll(filepath.Dir(path), 0o750); err != nil {
 		return nil, err
 	}
 
-	lockFile, err := os.OpenFile(path, os.O_CREATE|os.O_RDWR, 0o640)
-	if err != nil {
-		return nil, err
-	}
+	for {
+		lockFile, err := os.OpenFile(path, os.O_CREATE|os.O_RDWR, 0o640)
+		if err != nil {
+			return nil, err
+		}
 
-	if err := syscall.Flock(int(lockFile.Fd()), syscall.LOCK_EX|syscall.LOCK_NB); err != nil {
-		lockFile.Close()
-		if errors.Is(err, syscall.EWOULDBLOCK) {
-			return nil, ErrAlreadyLocked
+		if err := syscall.Flock(int(lockFile.Fd()), syscall.LOCK_EX|syscall.LOCK_NB); err != nil {
+			lockFile.Close()
+			if errors.Is(err, syscall.EWOULDBLOCK) {
+				return nil, ErrAlreadyLocked
+			}
+			return nil, err
 		}
-		return nil, err
+
+		// Break unlinks the lock file. If that happened between our open and
+		// flock we now hold a lock on an orphaned inode that excludes nobody.
+		current, err := isCurrent(lockFile, path)
+		if err != nil {
+			lockFile.Close()
+			return nil, err
+		}
+		if !current {
+			lockFile.Close()
+			continue
+		}
+
+		if err := writeHolder(lockFile, operation); err != nil {
+			_ = syscall.Flock(int(lockFile.Fd()), syscall.LOCK_UN)
+			lockFile.Close()
+			return nil, err
+		}
+		return &FileLock{file: lockFile}, nil
 	}
+}
 
-	return &FileLock{file: lockFile}, nil
+// AcquireWithTimeout keeps trying Acquire until it succeeds or d elapses, so
+// short overlapping operations queue instead of failing. A blocked flock(2)
+// cannot be interrupted from Go, so the deadline is implemented by polling
+// LOCK_NB with backoff. d <= 0 behaves like Acquire.
+func AcquireWithTimeout(path, operation string, d time.Duration) (*FileLock, error) {
+	var held *FileLock
+	err := retryLocked(d, func() error {
+		var err error
+		held, err = Acquire(path, operation)
+		return err
+	})
+	return held, err
+}
+
+// retryLocked re-runs attempt while it reports ErrAlreadyLocked and the
+// deadline has not passed.
+func retryLocked(d time.Duration, attempt func() error) error {
+	deadline := time.Now().Add(d)
+	delay := 5 * time.Millisecond
+	for {
+		err := attempt()
+		if !errors.Is(err, ErrAlreadyLocked) {
+			return err
+		}
+		remaining := time.Until(deadline)
+		if remaining <= 0 {
+			return err
+		}
+		time.Sleep(min(delay, remaining))
+		delay = min(delay*2, 250*time.Millisecond)
+	}
 }
 
 func (l *FileLock) Release() error {
@@ -39,9 +99,158 @@ func (l *FileLock) Release() error {
 		return nil
 	}
 
+	_ = l.file.Truncate(0)
 	if err := syscall.Flock(int(l.file.Fd()), syscall.LOCK_UN); err != nil {
 		_ = l.file.Close()
 		return err
 	}
 	return l.file.Close()
 }
+
+// Inspect reports whether path is locked and by whom. flock is dropped when
+// the holder's last descriptor closes, so a held lock whose recorded PID is
+// dead means the descriptor leaked into a surviving child; it is reported as
+// stale. Holders on other hosts are never considered stale.
+func Inspect(path string) (model.LockStatus, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return model.LockStatus{}, nil
+		}
+		return model.LockStatus{}, err
+	}
+	defer file.Close()
+
+	if err := syscall.Flock(int(file.Fd()), syscall.LOCK_SH|syscall.LOCK_NB); err == nil {
+		_ = syscall.Flock(int(file.Fd()), syscall.LOCK_UN)
+		return model.LockStatus{}, nil
+	} else if !errors.Is(err, syscall.EWOULDBLOCK) {
+		return model.LockStatus{}, err
+	}
+
+	status := model.LockStatus{Held: true}
+	content, err := io.ReadAll(file)
+	if err != nil {
+		return status, err
+	}
+	var holder model.LockHolder
+	if json.Unmarshal(content, &holder) == nil && holder.PID > 0 {
+		status.Holder = &holder
+		status.Stale = isStale(holder)
+	}
+	return status, nil
+}
+
+// Break removes a held lock file so the next Acquire starts on a fresh inode.
+// Unless force is set only stale locks are broken. The old holder, if still
+// running, keeps its now meaningless lock until it releases it.
+func Break(path string, force bool) (model.LockStatus, error) {
+	status, err := Inspect(path)
+	if err != nil || !status.Held {
+		return status, err
+	}
+	if !status.Stale && !force {
+		return status, fmt.Errorf("%w: %s", ErrAlreadyLocked, Describe(status.Holder))
+	}
+	if err := os.Remove(path); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return status, err
+	}
+	status.Broken = true
+	return status, nil
+}
+
+func newHolder(operation string) model.LockHolder {
+	hostname, _ := os.Hostname()
+	return model.LockHolder{
+		PID:        os.Getpid(),
+		Host:       hostname,
+		Operation:  operation,
+		AcquiredAt: time.Now().UTC(),
+	}
+}
+
+func writeHolder(file *os.File, operation string) error {
+	content, err := json.Marshal(newHolder(operation))
+	if err != nil {
+		return err
+	}
+	if err := file.Truncate(0); err != nil {
+		return err
+	}
+	_, err = file.WriteAt(content, 0)
+	return err
+}
+
+func isCurrent(file *os.File, path string) (bool, error) {
+	held, err := file.Stat()
+	if err != nil {
+		return false, err
+	}
+	onDisk, err := os.Stat(path)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return false, nil
+		}
+		return false, err
+	}
+	return os.SameFile(held, onDisk), nil
+}
+
+func isStale(holder model.LockHolder) bool {
+	hostname, _ := os.Hostname()
+	if holder.Host != hostname || holder.PID <= 0 {
+		return false
+	}
+	err := syscall.Kill(holder.PID, 0)
+	return errors.Is(err, syscall.ESRCH)
+}
+
+// Describe renders a lock holder for conflict messages.
+func Describe(holder *model.LockHolder) string {
+	if holder == nil {
+		return "held by an unknown process"
+	}
+	operation := holder.Operation
+	if operation == "" {
+		operation = "unknown operation"
+	}
+	return fmt.Sprintf("held by pid %d on %s for %s since %s", holder.PID, holder.Host, operation, holder.AcquiredAt.Format(time.RFC3339))
+}
+
+// Locker hands out per-VM locks. FileLocker only excludes processes on one
+// host; EtcdLocker holds leased keys so it works across mergend instances.
+//
+// Lock waits up to wait for a held lock before returning ErrAlreadyLocked.
+type Locker interface {
+	Lock(id, operation string, wait time.Duration) (Handle, error)
+	Inspect(id string) (model.LockStatus, error)
+	Break(id string, force bool) (model.LockStatus, error)
+}
+
+type Handle interface {
+	Release() error
+}
+
+type FileLocker struct {
+	pathFor func(id string) string
+}
+
+func NewFileLocker(pathFor func(id string) string) *FileLocker {
+	return &FileLocker{pathFor: pathFor}
+}
+
+func (l *FileLocker) Lock(id, operation string, wait time.Duration) (Handle, error) {
+	return AcquireWithTimeout(l.pathFor(id), operation, wait)
+}
+
+func (l *FileLocker) Inspect(id string) (model.LockStatus, error) {
+	status, err := Inspect(l.pathFor(id))
+	status.ID = id
+	return status, err
+}
+
+func (l *FileLocker) Break(id string, force bool) (model.LockStatus, error) {
+	status, err := Break(l.pathFor(id), force)
+	status.ID = id
+	return status, err
+}
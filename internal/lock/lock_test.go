@@ -0,0 +1,97 @@
+package lock
+
+import (
+	"encoding/json"
+	"errors"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/alperreha/mergen-fire/internal/model"
+)
+
+func TestFileLockRecordsHolderAndBreaksStaleLocks(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "vm-1.lock")
+
+	held, err := Acquire(path, "start")
+	if err != nil {
+		t.Fatalf("acquire: %v", err)
+	}
+	status, err := Inspect(path)
+	if err != nil {
+		t.Fatalf("inspect: %v", err)
+	}
+	if !status.Held || status.Stale || status.Holder == nil || status.Holder.PID != os.Getpid() || status.Holder.Operation != "start" {
+		t.Fatalf("unexpected status for live holder: %+v", status)
+	}
+	if _, err := Acquire(path, "stop"); !errors.Is(err, ErrAlreadyLocked) {
+		t.Fatalf("expected ErrAlreadyLocked, got %v", err)
+	}
+	if _, err := Break(path, false); !errors.Is(err, ErrAlreadyLocked) {
+		t.Fatalf("expected live lock not to be broken without force, got %v", err)
+	}
+
+	// Pretend the descriptor leaked into a process that has since exited.
+	cmd := exec.Command("true")
+	if err := cmd.Run(); err != nil {
+		t.Skipf("cannot run helper process: %v", err)
+	}
+	hostname, _ := os.Hostname()
+	content, _ := json.Marshal(model.LockHolder{PID: cmd.Process.Pid, Host: hostname, Operation: "delete", AcquiredAt: time.Now()})
+	if err := os.WriteFile(path, content, 0o640); err != nil {
+		t.Fatalf("rewrite holder: %v", err)
+	}
+
+	status, err = Break(path, false)
+	if err != nil {
+		t.Fatalf("break stale lock: %v", err)
+	}
+	if !status.Stale || !status.Broken {
+		t.Fatalf("expected stale lock to be broken, got %+v", status)
+	}
+
+	next, err := Acquire(path, "stop")
+	if err != nil {
+		t.Fatalf("acquire after break: %v", err)
+	}
+	if err := held.Release(); err != nil {
+		t.Fatalf("release orphaned lock: %v", err)
+	}
+	if status, _ := Inspect(path); !status.Held || status.Holder.Operation != "stop" {
+		t.Fatalf("expected new holder to survive old release, got %+v", status)
+	}
+	if err := next.Release(); err != nil {
+		t.Fatalf("release: %v", err)
+	}
+	if status, _ := Inspect(path); status.Held {
+		t.Fatalf("expected lock to be free, got %+v", status)
+	}
+}
+
+func TestAcquireWithTimeoutWaitsForRelease(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "vm-1.lock")
+
+	held, err := Acquire(path, "start")
+	if err != nil {
+		t.Fatalf("acquire: %v", err)
+	}
+	if _, err := AcquireWithTimeout(path, "stop", 30*time.Millisecond); !errors.Is(err, ErrAlreadyLocked) {
+		t.Fatalf("expected timeout with ErrAlreadyLocked, got %v", err)
+	}
+
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		_ = held.Release()
+	}()
+	started := time.Now()
+	next, err := AcquireWithTimeout(path, "stop", 2*time.Second)
+	if err != nil {
+		t.Fatalf("acquire with timeout: %v", err)
+	}
+	defer next.Release()
+	if waited := time.Since(started); waited < 40*time.Millisecond {
+		t.Fatalf("expected to wait for the holder, waited %s", waited)
+	}
+}
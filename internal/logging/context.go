@@ -0,0 +1,49 @@
+package logging
+
+import (
+	"context"
+	"encoding/hex"
+	"log/slog"
+
+	"github.com/alperreha/mergen-fire/internal/tracing"
+)
+
+type requestIDKey struct{}
+
+// WithRequestID tags ctx so every record logged with it (InfoContext and
+// friends) carries a requestID attribute.
+func WithRequestID(ctx context.Context, id string) context.Context {
+	return context.WithValue(ctx, requestIDKey{}, id)
+}
+
+func RequestID(ctx context.Context) string {
+	if ctx == nil {
+		return ""
+	}
+	id, _ := ctx.Value(requestIDKey{}).(string)
+	return id
+}
+
+// contextHandler adds request-scoped attributes (request and trace IDs) from
+// the record's context.
+type contextHandler struct {
+	slog.Handler
+}
+
+func (h contextHandler) Handle(ctx context.Context, record slog.Record) error {
+	if id := RequestID(ctx); id != "" {
+		record.AddAttrs(slog.String("requestID", id))
+	}
+	if sc := tracing.SpanContextFrom(ctx); sc.IsValid() && sc.Sampled {
+		record.AddAttrs(slog.String("traceID", hex.EncodeToString(sc.TraceID[:])))
+	}
+	return h.Handler.Handle(ctx, record)
+}
+
+func (h contextHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return contextHandler{h.Handler.WithAttrs(attrs)}
+}
+
+func (h contextHandler) WithGroup(name string) slog.Handler {
+	return contextHandler{h.Handler.WithGroup(name)}
+}
@@ -0,0 +1,216 @@
+package logging
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// Levels hands out per-component loggers that share one output and can have
+// their minimum level changed while the process runs. A component without an
+// override follows the default level.
+type Levels struct {
+	handler slog.Handler
+	def     slog.LevelVar
+
+	mu         sync.RWMutex
+	components map[string]*componentLevel
+}
+
+type componentLevel struct {
+	levels   *Levels
+	override *slog.Level
+}
+
+func (c *componentLevel) Level() slog.Level {
+	c.levels.mu.RLock()
+	defer c.levels.mu.RUnlock()
+	if c.override != nil {
+		return *c.override
+	}
+	return c.levels.def.Level()
+}
+
+// NewLevels writes to w, usually the writer from Output.Open.
+func NewLevels(defaultLevel slog.Level, format string, w io.Writer) *Levels {
+	// The shared handler lets everything through; levelHandler filters per
+	// component before any formatting happens.
+	l := &Levels{
+		handler:    newHandler(w, slog.LevelDebug, format),
+		components: map[string]*componentLevel{},
+	}
+	l.def.Set(defaultLevel)
+	return l
+}
+
+// Logger returns the logger for component, tagged with a component attribute.
+func (l *Levels) Logger(component string) *slog.Logger {
+	l.mu.Lock()
+	level, ok := l.components[component]
+	if !ok {
+		level = &componentLevel{levels: l}
+		l.components[component] = level
+	}
+	l.mu.Unlock()
+	return slog.New(contextHandler{levelHandler{l.handler, level}}).With("component", component)
+}
+
+// Apply sets the default level (when non-empty) and the given component
+// overrides; an empty component level resets that component to the default.
+// Nothing changes unless every value is valid.
+func (l *Levels) Apply(defaultLevel string, components map[string]string) error {
+	var def *slog.Level
+	if strings.TrimSpace(defaultLevel) != "" {
+		level, err := StrictLevel(defaultLevel)
+		if err != nil {
+			return err
+		}
+		def = &level
+	}
+	overrides := map[string]*slog.Level{}
+	l.mu.RLock()
+	for name, value := range components {
+		if _, ok := l.components[name]; !ok {
+			l.mu.RUnlock()
+			return fmt.Errorf("unknown log component %q", name)
+		}
+		if strings.TrimSpace(value) == "" {
+			overrides[name] = nil
+			continue
+		}
+		level, err := StrictLevel(value)
+		if err != nil {
+			l.mu.RUnlock()
+			return fmt.Errorf("%s: %w", name, err)
+		}
+		overrides[name] = &level
+	}
+	l.mu.RUnlock()
+
+	if def != nil {
+		l.def.Set(*def)
+	}
+	l.mu.Lock()
+	for name, level := range overrides {
+		l.components[name].override = level
+	}
+	l.mu.Unlock()
+	return nil
+}
+
+// Cycle moves the default level one step more verbose, wrapping from debug
+// back to error, and returns the new level.
+func (l *Levels) Cycle() slog.Level {
+	var next slog.Level
+	switch current := l.def.Level(); {
+	case current > slog.LevelWarn:
+		next = slog.LevelWarn
+	case current > slog.LevelInfo:
+		next = slog.LevelInfo
+	case current > slog.LevelDebug:
+		next = slog.LevelDebug
+	default:
+		next = slog.LevelError
+	}
+	l.def.Set(next)
+	return next
+}
+
+type LevelsSnapshot struct {
+	Default    string            `json:"default"`
+	Components map[string]string `json:"components"`
+	Overrides  []string          `json:"overrides"`
+}
+
+// Snapshot reports the effective level of every component and which of them
+// carry an override.
+func (l *Levels) Snapshot() LevelsSnapshot {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	snapshot := LevelsSnapshot{
+		Default:    LevelName(l.def.Level()),
+		Components: make(map[string]string, len(l.components)),
+		Overrides:  []string{},
+	}
+	for name, c := range l.components {
+		level := l.def.Level()
+		if c.override != nil {
+			level = *c.override
+			snapshot.Overrides = append(snapshot.Overrides, name)
+		}
+		snapshot.Components[name] = LevelName(level)
+	}
+	sort.Strings(snapshot.Overrides)
+	return snapshot
+}
+
+// StrictLevel is ParseLevel for user input: unknown names are an error
+// instead of falling back to info.
+func StrictLevel(level string) (slog.Level, error) {
+	switch strings.ToLower(strings.TrimSpace(level)) {
+	case "debug", "info", "warn", "warning", "error":
+		return ParseLevel(level), nil
+	}
+	return slog.LevelInfo, fmt.Errorf("unknown log level %q", level)
+}
+
+func LevelName(level slog.Level) string {
+	return strings.ToLower(level.String())
+}
+
+// ParseComponentLevels parses "component=level" pairs separated by commas,
+// e.g. "api=debug,store=warn".
+func ParseComponentLevels(value string) (map[string]string, error) {
+	out := map[string]string{}
+	for _, pair := range strings.Split(value, ",") {
+		pair = strings.TrimSpace(pair)
+		if pair == "" {
+			continue
+		}
+		name, level, found := strings.Cut(pair, "=")
+		if !found || strings.TrimSpace(name) == "" {
+			return nil, fmt.Errorf("expected component=level, got %q", pair)
+		}
+		if _, err := StrictLevel(level); err != nil {
+			return nil, fmt.Errorf("%s: %w", strings.TrimSpace(name), err)
+		}
+		out[strings.TrimSpace(name)] = strings.TrimSpace(level)
+	}
+	return out, nil
+}
+
+// OverrideChanges turns two override sets into the argument for Apply: the
+// overrides in next plus an empty value (back to the default) for every
+// component dropped since current.
+func OverrideChanges(current, next map[string]string) map[string]string {
+	changes := make(map[string]string, len(current)+len(next))
+	for name := range current {
+		changes[name] = ""
+	}
+	for name, level := range next {
+		changes[name] = level
+	}
+	return changes
+}
+
+// levelHandler drops records below its component's level.
+type levelHandler struct {
+	slog.Handler
+	level slog.Leveler
+}
+
+func (h levelHandler) Enabled(ctx context.Context, level slog.Level) bool {
+	return level >= h.level.Level() && h.Handler.Enabled(ctx, level)
+}
+
+func (h levelHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return levelHandler{h.Handler.WithAttrs(attrs), h.level}
+}
+
+func (h levelHandler) WithGroup(name string) slog.Handler {
+	return levelHandler{h.Handler.WithGroup(name), h.level}
+}
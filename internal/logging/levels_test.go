@@ -0,0 +1,63 @@
+package logging
+
+import (
+	"bytes"
+	"log/slog"
+	"strings"
+	"testing"
+)
+
+func TestComponentLevelsOverrideDefault(t *testing.T) {
+	var out bytes.Buffer
+	levels := NewLevels(slog.LevelInfo, "text", &out)
+	api := levels.Logger("api")
+	store := levels.Logger("store")
+
+	if err := levels.Apply("", map[string]string{"api": "debug"}); err != nil {
+		t.Fatalf("apply: %v", err)
+	}
+	api.Debug("api debug")
+	store.Debug("store debug")
+	if !strings.Contains(out.String(), "api debug") || strings.Contains(out.String(), "store debug") {
+		t.Fatalf("expected only the api debug line, got:\n%s", out.String())
+	}
+
+	if err := levels.Apply("warn", map[string]string{"api": ""}); err != nil {
+		t.Fatalf("apply: %v", err)
+	}
+	out.Reset()
+	api.Info("api info")
+	store.Warn("store warn")
+	if strings.Contains(out.String(), "api info") || !strings.Contains(out.String(), "store warn") {
+		t.Fatalf("expected api to follow the warn default again, got:\n%s", out.String())
+	}
+	if snapshot := levels.Snapshot(); snapshot.Default != "warn" || snapshot.Components["api"] != "warn" || len(snapshot.Overrides) != 0 {
+		t.Fatalf("unexpected snapshot: %+v", snapshot)
+	}
+}
+
+func TestApplyRejectsUnknownValues(t *testing.T) {
+	levels := NewLevels(slog.LevelInfo, "text", &bytes.Buffer{})
+	levels.Logger("api")
+
+	if err := levels.Apply("debug", map[string]string{"api": "loud"}); err == nil {
+		t.Fatal("expected invalid level to be rejected")
+	}
+	if err := levels.Apply("", map[string]string{"apii": "debug"}); err == nil {
+		t.Fatal("expected unknown component to be rejected")
+	}
+	if snapshot := levels.Snapshot(); snapshot.Default != "info" {
+		t.Fatalf("expected rejected apply to change nothing, got default %s", snapshot.Default)
+	}
+}
+
+func TestCycleWrapsAround(t *testing.T) {
+	levels := NewLevels(slog.LevelInfo, "text", &bytes.Buffer{})
+	var seen []string
+	for i := 0; i < 4; i++ {
+		seen = append(seen, LevelName(levels.Cycle()))
+	}
+	if got := strings.Join(seen, ","); got != "debug,error,warn,info" {
+		t.Fatalf("unexpected cycle order: %s", got)
+	}
+}
@@ -13,21 +13,29 @@ import (
 )
 
 func New(level, format string) *slog.Logger {
-	minLevel := parseLevel(level)
-	format = strings.ToLower(strings.TrimSpace(format))
+	levelVar := new(slog.LevelVar)
+	levelVar.Set(ParseLevel(level))
+	return NewDynamic(levelVar, format)
+}
+
+// NewDynamic builds a logger whose minimum level follows minLevel, so it can
+// be changed while the process runs.
+func NewDynamic(minLevel *slog.LevelVar, format string) *slog.Logger {
+	return slog.New(contextHandler{newHandler(os.Stdout, minLevel, format)})
+}
 
-	writer := io.Writer(os.Stdout)
-	switch format {
+func newHandler(w io.Writer, minLevel slog.Leveler, format string) slog.Handler {
+	switch strings.ToLower(strings.TrimSpace(format)) {
 	case "json":
-		return slog.New(slog.NewJSONHandler(writer, &slog.HandlerOptions{Level: minLevel}))
+		return slog.NewJSONHandler(w, &slog.HandlerOptions{Level: minLevel})
 	case "text":
-		return slog.New(slog.NewTextHandler(writer, &slog.HandlerOptions{Level: minLevel}))
+		return slog.NewTextHandler(w, &slog.HandlerOptions{Level: minLevel})
 	default:
-		return slog.New(newConsoleHandler(writer, minLevel))
+		return newConsoleHandler(w, minLevel)
 	}
 }
 
-func parseLevel(level string) slog.Level {
+func ParseLevel(level string) slog.Level {
 	switch strings.ToLower(strings.TrimSpace(level)) {
 	case "debug":
 		return slog.LevelDebug
@@ -41,16 +49,22 @@ func parseLevel(level string) slog.Level {
 }
 
 type consoleHandler struct {
-	mu       sync.Mutex
-	w        io.Writer
-	minLevel slog.Level
+	out      *lockedWriter
+	minLevel slog.Leveler
 	attrs    []slog.Attr
 	groups   []string
 }
 
-func newConsoleHandler(w io.Writer, minLevel slog.Level) *consoleHandler {
+// lockedWriter is shared by a handler and everything derived from it with
+// WithAttrs/WithGroup, so concurrent lines never interleave.
+type lockedWriter struct {
+	mu sync.Mutex
+	w  io.Writer
+}
+
+func newConsoleHandler(w io.Writer, minLevel slog.Leveler) *consoleHandler {
 	return &consoleHandler{
-		w:        w,
+		out:      &lockedWriter{w: w},
 		minLevel: minLevel,
 		attrs:    nil,
 		groups:   nil,
@@ -58,7 +72,7 @@ func newConsoleHandler(w io.Writer, minLevel slog.Level) *consoleHandler {
 }
 
 func (h *consoleHandler) Enabled(_ context.Context, level slog.Level) bool {
-	return level >= h.minLevel
+	return level >= h.minLevel.Level()
 }
 
 func (h *consoleHandler) Handle(_ context.Context, record slog.Record) error {
@@ -88,9 +102,9 @@ func (h *consoleHandler) Handle(_ context.Context, record slog.Record) error {
 	}
 	builder.WriteString("\n")
 
-	h.mu.Lock()
-	defer h.mu.Unlock()
-	_, err := io.WriteString(h.w, builder.String())
+	h.out.mu.Lock()
+	defer h.out.mu.Unlock()
+	_, err := io.WriteString(h.out.w, builder.String())
 	return err
 }
 
@@ -0,0 +1,42 @@
+package logging
+
+import (
+	"io"
+	"os"
+	"time"
+
+	"github.com/alperreha/mergen-fire/internal/logrotate"
+)
+
+// Output says where a daemon writes its log lines: stdout, a rotating file, or
+// both. Without File everything goes to stdout.
+type Output struct {
+	File        string
+	Stdout      bool
+	MaxSizeMiB  int
+	RotateEvery time.Duration
+	MaxAgeDays  int
+	MaxFiles    int
+	Compress    bool
+}
+
+// Open returns the writer for o and a close func that flushes pending
+// rotation work and closes the file.
+func (o Output) Open() (io.Writer, func() error, error) {
+	if o.File == "" {
+		return os.Stdout, func() error { return nil }, nil
+	}
+	file, err := logrotate.OpenFile(o.File, logrotate.Policy{
+		MaxSizeBytes: int64(o.MaxSizeMiB) << 20,
+		MaxAge:       time.Duration(o.MaxAgeDays) * 24 * time.Hour,
+		MaxFiles:     o.MaxFiles,
+		Compress:     o.Compress,
+	}, o.RotateEvery)
+	if err != nil {
+		return nil, nil, err
+	}
+	if o.Stdout {
+		return io.MultiWriter(file, os.Stdout), file.Close, nil
+	}
+	return file, file.Close, nil
+}
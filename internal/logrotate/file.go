@@ -0,0 +1,195 @@
+package logrotate
+
+import (
+	"compress/gzip"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// File is an append-only log file that rotates itself, for daemons writing
+// their own logs. Unlike Manager it owns the file handle, so rotation is a
+// rename plus reopen and no lines are lost. Copies use the same
+// "<file>.<UTC timestamp>[.gz]" names and the same pruning rules.
+type File struct {
+	path        string
+	policy      Policy
+	rotateEvery time.Duration
+	now         func() time.Time
+
+	mu       sync.Mutex
+	file     *os.File
+	size     int64
+	openedAt time.Time
+	closed   bool
+
+	// Compression and pruning run off the write path, one rotation at a time.
+	pending sync.WaitGroup
+	bgMu    sync.Mutex
+}
+
+// OpenFile opens path for appending, creating it and its directory when
+// needed. The file rotates once it grows past policy.MaxSizeBytes or has been
+// written for rotateEvery; zero disables either trigger.
+func OpenFile(path string, policy Policy, rotateEvery time.Duration) (*File, error) {
+	f := &File{path: path, policy: policy, rotateEvery: rotateEvery, now: time.Now}
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return nil, err
+	}
+	if err := f.open(); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+func (f *File) open() error {
+	file, err := os.OpenFile(f.path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0o640)
+	if err != nil {
+		return err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		_ = file.Close()
+		return err
+	}
+	f.file = file
+	f.size = info.Size()
+	// A file carried over from the previous run counts from its last write,
+	// so a restart does not reset the age trigger.
+	f.openedAt = f.now()
+	if info.Size() > 0 {
+		f.openedAt = info.ModTime()
+	}
+	return nil
+}
+
+func (f *File) Write(p []byte) (int, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.closed {
+		return 0, os.ErrClosed
+	}
+	if f.file == nil {
+		// A reopen after rotation failed; try again rather than give up.
+		if err := f.open(); err != nil {
+			return 0, err
+		}
+	}
+	if f.due(int64(len(p))) {
+		// A failed rotation must not stop logging; keep appending and retry
+		// on the next write.
+		_ = f.rotate()
+	}
+	n, err := f.file.Write(p)
+	f.size += int64(n)
+	return n, err
+}
+
+func (f *File) due(incoming int64) bool {
+	if f.size == 0 {
+		return false
+	}
+	if f.policy.MaxSizeBytes > 0 && f.size+incoming > f.policy.MaxSizeBytes {
+		return true
+	}
+	return f.rotateEvery > 0 && f.now().Sub(f.openedAt) >= f.rotateEvery
+}
+
+func (f *File) rotate() error {
+	now := f.now().UTC()
+	target := f.path + "." + now.Format(rotatedLayout)
+	if fileExists(target) || fileExists(target+".gz") {
+		// Second-resolution names: wait for the next second instead of
+		// overwriting a copy.
+		return os.ErrExist
+	}
+	if err := f.file.Close(); err != nil {
+		return err
+	}
+	f.file = nil
+	renameErr := os.Rename(f.path, target)
+	if err := f.open(); err != nil {
+		return err
+	}
+	if renameErr != nil {
+		return renameErr
+	}
+
+	f.pending.Add(1)
+	go func() {
+		defer f.pending.Done()
+		f.bgMu.Lock()
+		defer f.bgMu.Unlock()
+		if f.policy.Compress {
+			_ = compressFile(target)
+		}
+		_, _ = f.prune(now)
+	}()
+	return nil
+}
+
+func (f *File) prune(now time.Time) (int, error) {
+	dir, base := filepath.Split(f.path)
+	if dir == "" {
+		dir = "."
+	}
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return 0, err
+	}
+	var files []rotatedFile
+	for _, entry := range entries {
+		match := rotatedName.FindStringSubmatch(entry.Name())
+		if match == nil || match[1] != base {
+			continue
+		}
+		stamp, err := time.Parse(rotatedLayout, match[2])
+		if err != nil {
+			continue
+		}
+		files = append(files, rotatedFile{name: entry.Name(), at: stamp})
+	}
+	return pruneRotated(dir, files, f.policy, now)
+}
+
+// Close waits for background compression and closes the active file.
+func (f *File) Close() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.pending.Wait()
+	f.closed = true
+	if f.file == nil {
+		return nil
+	}
+	err := f.file.Close()
+	f.file = nil
+	return err
+}
+
+func compressFile(path string) error {
+	src, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+	dst, err := os.OpenFile(path+".gz", os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0o640)
+	if err != nil {
+		return err
+	}
+	gz := gzip.NewWriter(dst)
+	_, copyErr := io.Copy(gz, src)
+	closeErr := errors.Join(gz.Close(), dst.Close())
+	if err := errors.Join(copyErr, closeErr); err != nil {
+		_ = os.Remove(path + ".gz")
+		return err
+	}
+	return os.Remove(path)
+}
+
+func fileExists(path string) bool {
+	_, err := os.Stat(path)
+	return err == nil
+}
@@ -0,0 +1,65 @@
+package logrotate
+
+import (
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestFileRotatesBySizeAndAge(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "mergend.log")
+	f, err := OpenFile(path, Policy{MaxSizeBytes: 64, MaxFiles: 2, Compress: true}, time.Hour)
+	if err != nil {
+		t.Fatalf("open: %v", err)
+	}
+	now := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	f.now = func() time.Time { return now }
+	f.openedAt = now
+
+	line := strings.Repeat("x", 40) + "\n"
+	for i := 0; i < 4; i++ {
+		if _, err := f.Write([]byte(line)); err != nil {
+			t.Fatalf("write: %v", err)
+		}
+		now = now.Add(time.Second)
+	}
+	// Small write well past the age trigger.
+	now = now.Add(2 * time.Hour)
+	if _, err := f.Write([]byte("late\n")); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+	if err := f.Close(); err != nil {
+		t.Fatalf("close: %v", err)
+	}
+
+	current, err := os.ReadFile(path)
+	if err != nil || string(current) != "late\n" {
+		t.Fatalf("expected only the last line in the active file, got %q (%v)", current, err)
+	}
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatalf("readdir: %v", err)
+	}
+	var rotated []string
+	for _, entry := range entries {
+		if entry.Name() != "mergend.log" {
+			rotated = append(rotated, entry.Name())
+		}
+	}
+	sort.Strings(rotated)
+	if len(rotated) != 2 {
+		t.Fatalf("expected two copies kept after pruning, got %v", rotated)
+	}
+	for _, name := range rotated {
+		if !strings.HasSuffix(name, ".gz") {
+			t.Fatalf("expected compressed copies, got %v", rotated)
+		}
+	}
+	if _, err := f.Write([]byte("after close\n")); err == nil {
+		t.Fatal("expected write after close to fail")
+	}
+}
@@ -0,0 +1,259 @@
+package logrotate
+
+import (
+	"compress/gzip"
+	"context"
+	"errors"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"time"
+
+	"github.com/alperreha/mergen-fire/internal/model"
+)
+
+const (
+	defaultInterval = 5 * time.Minute
+	rotatedLayout   = "20060102T150405Z"
+)
+
+// Rotated copies are named "<file>.<UTC timestamp>[.gz]".
+var rotatedName = regexp.MustCompile(`^(.+)\.(\d{8}T\d{6}Z)(\.gz)?$`)
+
+type MetaLister interface {
+	ListMetas() ([]model.VMMetadata, error)
+}
+
+type Policy struct {
+	MaxSizeBytes int64
+	MaxAge       time.Duration
+	MaxFiles     int
+	Compress     bool
+}
+
+type Stats struct {
+	Rotated int `json:"rotated"`
+	Pruned  int `json:"pruned"`
+}
+
+// Manager rotates files under every VM's LogsDir with copy-and-truncate, so
+// writers holding the file open with O_APPEND (firecracker's serial output)
+// keep working.
+type Manager struct {
+	store    MetaLister
+	policy   Policy
+	interval time.Duration
+	now      func() time.Time
+	logger   *slog.Logger
+}
+
+func NewManager(store MetaLister, policy Policy) *Manager {
+	return &Manager{
+		store:    store,
+		policy:   policy,
+		interval: defaultInterval,
+		now:      time.Now,
+		logger:   slog.Default(),
+	}
+}
+
+func (m *Manager) WithLogger(logger *slog.Logger) *Manager {
+	if logger != nil {
+		m.logger = logger
+	}
+	return m
+}
+
+func (m *Manager) WithInterval(interval time.Duration) *Manager {
+	if interval > 0 {
+		m.interval = interval
+	}
+	return m
+}
+
+func (m *Manager) Run(ctx context.Context) {
+	m.logger.Info("log rotation scheduled", "interval", m.interval, "maxSizeBytes", m.policy.MaxSizeBytes, "maxAge", m.policy.MaxAge, "maxFiles", m.policy.MaxFiles)
+	ticker := time.NewTicker(m.interval)
+	defer ticker.Stop()
+	for {
+		if _, err := m.RotateAll(); err != nil {
+			m.logger.Warn("log rotation pass failed", "error", err)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func (m *Manager) RotateAll() (Stats, error) {
+	metas, err := m.store.ListMetas()
+	if err != nil {
+		return Stats{}, err
+	}
+	var total Stats
+	for _, meta := range metas {
+		if meta.Paths.LogsDir == "" {
+			continue
+		}
+		stats, err := m.RotateDir(meta.Paths.LogsDir, m.PolicyFor(meta))
+		total.Rotated += stats.Rotated
+		total.Pruned += stats.Pruned
+		if err != nil {
+			m.logger.Warn("log rotation failed", "vmID", meta.ID, "dir", meta.Paths.LogsDir, "error", err)
+		}
+	}
+	if total.Rotated > 0 || total.Pruned > 0 {
+		m.logger.Info("log rotation pass finished", "rotated", total.Rotated, "pruned", total.Pruned)
+	}
+	return total, nil
+}
+
+// PolicyFor applies the VM's non-zero overrides to the global policy.
+func (m *Manager) PolicyFor(meta model.VMMetadata) Policy {
+	policy := m.policy
+	override := meta.LogPolicy
+	if override == nil {
+		return policy
+	}
+	if override.MaxSizeMiB > 0 {
+		policy.MaxSizeBytes = int64(override.MaxSizeMiB) << 20
+	}
+	if override.MaxAgeDays > 0 {
+		policy.MaxAge = time.Duration(override.MaxAgeDays) * 24 * time.Hour
+	}
+	if override.MaxFiles > 0 {
+		policy.MaxFiles = override.MaxFiles
+	}
+	if override.Compress != nil {
+		policy.Compress = *override.Compress
+	}
+	return policy
+}
+
+func (m *Manager) RotateDir(dir string, policy Policy) (Stats, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return Stats{}, nil
+		}
+		return Stats{}, err
+	}
+
+	var stats Stats
+	now := m.now().UTC()
+	rotated := map[string][]rotatedFile{}
+	for _, entry := range entries {
+		if !entry.Type().IsRegular() {
+			continue
+		}
+		name := entry.Name()
+		if match := rotatedName.FindStringSubmatch(name); match != nil {
+			stamp, err := time.Parse(rotatedLayout, match[2])
+			if err != nil {
+				continue
+			}
+			rotated[match[1]] = append(rotated[match[1]], rotatedFile{name: name, at: stamp})
+			continue
+		}
+
+		info, err := entry.Info()
+		if err != nil {
+			return stats, err
+		}
+		if policy.MaxSizeBytes <= 0 || info.Size() <= policy.MaxSizeBytes {
+			continue
+		}
+		target, err := rotateFile(filepath.Join(dir, name), now, policy.Compress)
+		if err != nil {
+			return stats, err
+		}
+		stats.Rotated++
+		rotated[name] = append(rotated[name], rotatedFile{name: filepath.Base(target), at: now})
+		m.logger.Debug("log file rotated", "file", filepath.Join(dir, name), "size", info.Size(), "target", target)
+	}
+
+	for _, files := range rotated {
+		pruned, err := pruneRotated(dir, files, policy, now)
+		stats.Pruned += pruned
+		if err != nil {
+			return stats, err
+		}
+	}
+	return stats, nil
+}
+
+// pruneRotated removes copies of one file beyond the policy's age and count
+// limits, newest kept first.
+func pruneRotated(dir string, files []rotatedFile, policy Policy, now time.Time) (int, error) {
+	sort.Slice(files, func(i, j int) bool { return files[i].at.After(files[j].at) })
+	pruned := 0
+	for idx, file := range files {
+		expired := policy.MaxAge > 0 && now.Sub(file.at) > policy.MaxAge
+		overflow := policy.MaxFiles > 0 && idx >= policy.MaxFiles
+		if !expired && !overflow {
+			continue
+		}
+		if err := os.Remove(filepath.Join(dir, file.name)); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return pruned, err
+		}
+		pruned++
+	}
+	return pruned, nil
+}
+
+type rotatedFile struct {
+	name string
+	at   time.Time
+}
+
+func rotateFile(path string, now time.Time, compress bool) (string, error) {
+	target := path + "." + now.Format(rotatedLayout)
+	if compress {
+		target += ".gz"
+	}
+
+	src, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer src.Close()
+
+	dst, err := os.OpenFile(target, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0o640)
+	if err != nil {
+		return "", err
+	}
+	var w io.Writer = dst
+	var gz *gzip.Writer
+	if compress {
+		gz = gzip.NewWriter(dst)
+		w = gz
+	}
+	if _, err := io.Copy(w, src); err != nil {
+		_ = dst.Close()
+		_ = os.Remove(target)
+		return "", err
+	}
+	if gz != nil {
+		if err := gz.Close(); err != nil {
+			_ = dst.Close()
+			_ = os.Remove(target)
+			return "", err
+		}
+	}
+	if err := dst.Close(); err != nil {
+		_ = os.Remove(target)
+		return "", err
+	}
+
+	// Lines written between the copy and the truncate are lost; acceptable for
+	// console logs and the price of not needing the writer's cooperation.
+	if err := os.Truncate(path, 0); err != nil {
+		return "", err
+	}
+	return target, nil
+}
@@ -0,0 +1,93 @@
+package logrotate
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/alperreha/mergen-fire/internal/model"
+)
+
+func TestRotateDirCompressesAndPrunes(t *testing.T) {
+	dir := t.TempDir()
+	logPath := filepath.Join(dir, "serial.log")
+	if err := os.WriteFile(logPath, bytes.Repeat([]byte("x"), 2048), 0o640); err != nil {
+		t.Fatalf("write log: %v", err)
+	}
+	for _, stamp := range []string{"20240101T000000Z", "20240102T000000Z", "20240103T000000Z"} {
+		if err := os.WriteFile(filepath.Join(dir, "serial.log."+stamp+".gz"), []byte("old"), 0o640); err != nil {
+			t.Fatalf("write rotated: %v", err)
+		}
+	}
+
+	now := time.Date(2024, 1, 4, 0, 0, 0, 0, time.UTC)
+	m := NewManager(nil, Policy{})
+	m.now = func() time.Time { return now }
+
+	stats, err := m.RotateDir(dir, Policy{MaxSizeBytes: 1024, MaxFiles: 2, Compress: true})
+	if err != nil {
+		t.Fatalf("rotate: %v", err)
+	}
+	if stats.Rotated != 1 || stats.Pruned != 2 {
+		t.Fatalf("unexpected stats: %+v", stats)
+	}
+
+	info, err := os.Stat(logPath)
+	if err != nil || info.Size() != 0 {
+		t.Fatalf("expected active log truncated, got %v err=%v", info, err)
+	}
+	rotated := filepath.Join(dir, "serial.log.20240104T000000Z.gz")
+	file, err := os.Open(rotated)
+	if err != nil {
+		t.Fatalf("open rotated: %v", err)
+	}
+	defer file.Close()
+	gz, err := gzip.NewReader(file)
+	if err != nil {
+		t.Fatalf("gzip reader: %v", err)
+	}
+	content, _ := io.ReadAll(gz)
+	if len(content) != 2048 {
+		t.Fatalf("expected 2048 bytes in rotated log, got %d", len(content))
+	}
+
+	entries, _ := os.ReadDir(dir)
+	names := make([]string, 0, len(entries))
+	for _, entry := range entries {
+		names = append(names, entry.Name())
+	}
+	if strings.Join(names, ",") != "serial.log,serial.log.20240103T000000Z.gz,serial.log.20240104T000000Z.gz" {
+		t.Fatalf("unexpected files after prune: %v", names)
+	}
+}
+
+func TestRotateDirPrunesByAge(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "serial.log.20240101T000000Z"), []byte("old"), 0o640); err != nil {
+		t.Fatalf("write rotated: %v", err)
+	}
+	m := NewManager(nil, Policy{})
+	m.now = func() time.Time { return time.Date(2024, 1, 10, 0, 0, 0, 0, time.UTC) }
+
+	stats, err := m.RotateDir(dir, Policy{MaxAge: 7 * 24 * time.Hour})
+	if err != nil {
+		t.Fatalf("rotate: %v", err)
+	}
+	if stats.Pruned != 1 {
+		t.Fatalf("expected expired file pruned, got %+v", stats)
+	}
+}
+
+func TestPolicyForAppliesOverrides(t *testing.T) {
+	m := NewManager(nil, Policy{MaxSizeBytes: 64 << 20, MaxAge: time.Hour, MaxFiles: 5, Compress: true})
+	disabled := false
+	policy := m.PolicyFor(model.VMMetadata{LogPolicy: &model.LogPolicy{MaxSizeMiB: 1, Compress: &disabled}})
+	if policy.MaxSizeBytes != 1<<20 || policy.Compress || policy.MaxFiles != 5 || policy.MaxAge != time.Hour {
+		t.Fatalf("unexpected merged policy: %+v", policy)
+	}
+}
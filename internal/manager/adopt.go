@@ -0,0 +1,190 @@
+package manager
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/netip"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/alperreha/mergen-fire/internal/firecracker"
+	"github.com/alperreha/mergen-fire/internal/model"
+	"github.com/alperreha/mergen-fire/internal/network"
+)
+
+var unitNamePattern = regexp.MustCompile(`^[A-Za-z0-9:_.@\\-]+\.service$`)
+
+// AdoptVM registers a Firecracker VM started outside mergen, such as one
+// run by a hand-written unit, so it can be listed, started, stopped and
+// deleted like the VMs mergen created. The VM itself is left untouched:
+// its unit keeps running it from its own socket and network. Deleting an
+// adopted VM stops and disables its unit but leaves its files alone.
+func (s *Service) AdoptVM(ctx context.Context, req model.AdoptVMRequest) (string, error) {
+	s.logger.DebugContext(ctx, "adopt vm request received", "unit", req.Unit, "socketPath", req.SocketPath, "guestIP", req.GuestIP)
+	if err := validateAdopt(req); err != nil {
+		return "", fmt.Errorf("%w: %v", ErrInvalidRequest, err)
+	}
+	if req.GuestMAC != "" {
+		hw, _ := net.ParseMAC(req.GuestMAC)
+		req.GuestMAC = strings.ToUpper(hw.String())
+	}
+	present, err := firecracker.SocketPresent(req.SocketPath)
+	if err != nil {
+		return "", err
+	}
+	if !present {
+		return "", fmt.Errorf("%w: no firecracker socket at %s", ErrInvalidRequest, req.SocketPath)
+	}
+
+	id := req.ID
+	if id == "" {
+		if id, err = newUUIDv4(); err != nil {
+			return "", err
+		}
+	}
+	exists, err := s.store.Exists(id)
+	if err != nil {
+		return "", err
+	}
+	if exists {
+		return "", fmt.Errorf("%w: vm %s already exists", ErrConflict, id)
+	}
+	metas, err := s.store.ListMetas()
+	if err != nil {
+		return "", err
+	}
+	if err := adoptConflicts(metas, req); err != nil {
+		return "", fmt.Errorf("%w: %v", ErrConflict, err)
+	}
+
+	meta := model.VMMetadata{
+		ID:         id,
+		CreatedAt:  time.Now().UTC(),
+		RootFS:     req.RootFS,
+		Kernel:     req.Kernel,
+		Initrd:     req.Initrd,
+		DataDisk:   req.DataDisk,
+		Ports:      req.Ports,
+		HTTPPort:   req.HTTPPort,
+		GuestIP:    req.GuestIP,
+		GuestMAC:   req.GuestMAC,
+		TapName:    req.TapName,
+		NetNS:      req.NetNS,
+		Metadata:   req.Metadata,
+		Tags:       req.Tags,
+		Host:       s.host.Name,
+		Unit:       req.Unit,
+		SocketPath: req.SocketPath,
+	}
+	if meta.Ports == nil {
+		meta.Ports = []model.PortBinding{}
+	}
+	for i := range meta.Ports {
+		if meta.Ports[i].Protocol == "" {
+			meta.Ports[i].Protocol = "tcp"
+		}
+	}
+	// vm.json only describes the VM here; its unit never reads it.
+	cfg := model.VMConfig{
+		BootSource:    model.BootSource{KernelImagePath: req.Kernel, InitrdPath: req.Initrd},
+		MachineConfig: model.MachineConfig{VCPUCount: req.VCPU, MemSizeMiB: req.MemMiB},
+	}
+	if req.RootFS != "" {
+		cfg.Drives = append(cfg.Drives, model.Drive{DriveID: "rootfs", PathOnHost: req.RootFS, IsRootDevice: true})
+	}
+	if req.DataDisk != "" {
+		cfg.Drives = append(cfg.Drives, model.Drive{DriveID: "data", PathOnHost: req.DataDisk})
+	}
+	if req.TapName != "" {
+		cfg.NetworkInterfaces = append(cfg.NetworkInterfaces, model.NetworkInterface{IfaceID: "eth0", HostDevName: req.TapName, GuestMAC: meta.GuestMAC})
+	}
+
+	paths := s.store.PathsFor(id)
+	paths.SocketPath = req.SocketPath
+	meta.Paths = paths
+	if _, err := s.store.SaveVM(id, cfg, meta, model.HooksConfig{}, s.baseEnv(meta, paths, nil)); err != nil {
+		s.logger.ErrorContext(ctx, "failed to persist adopted vm", "vmID", id, "error", err)
+		return "", err
+	}
+	s.recordTransition(ctx, id, model.TransitionCreated, "adopted from "+req.Unit)
+	s.logger.InfoContext(ctx, "vm adopted", "vmID", id, "unit", req.Unit, "socketPath", req.SocketPath, "guestIP", req.GuestIP)
+	return id, nil
+}
+
+func validateAdopt(req model.AdoptVMRequest) error {
+	if req.ID != "" && (strings.ContainsAny(req.ID, "/ ") || strings.Contains(req.ID, "..")) {
+		return fmt.Errorf("invalid id %q", req.ID)
+	}
+	if !unitNamePattern.MatchString(req.Unit) {
+		return fmt.Errorf("unit must be a systemd service name, got %q", req.Unit)
+	}
+	if !filepath.IsAbs(req.SocketPath) {
+		return errors.New("socketPath must be an absolute path")
+	}
+	if req.GuestIP != "" {
+		if addr, err := netip.ParseAddr(req.GuestIP); err != nil || !addr.Is4() {
+			return fmt.Errorf("guestIP must be an IPv4 address, got %q", req.GuestIP)
+		}
+	}
+	if req.GuestMAC != "" {
+		if hw, err := net.ParseMAC(req.GuestMAC); err != nil || len(hw) != 6 {
+			return fmt.Errorf("guestMAC must be a MAC address, got %q", req.GuestMAC)
+		}
+	}
+	if len(req.TapName) > 15 {
+		return fmt.Errorf("tapName %q is longer than 15 characters", req.TapName)
+	}
+	if req.VCPU < 0 || req.MemMiB < 0 {
+		return errors.New("vcpu and memMiB must not be negative")
+	}
+	for _, path := range []string{req.RootFS, req.Kernel, req.Initrd, req.DataDisk} {
+		if path != "" && !filepath.IsAbs(path) {
+			return fmt.Errorf("%s must be an absolute path", path)
+		}
+	}
+	seen := map[int]struct{}{}
+	for _, port := range req.Ports {
+		if port.Guest <= 0 || port.Guest > 65535 || port.Host <= 0 || port.Host > 65535 {
+			return fmt.Errorf("invalid port binding %d:%d", port.Host, port.Guest)
+		}
+		if port.Protocol != "" && port.Protocol != "tcp" && port.Protocol != "udp" {
+			return fmt.Errorf("unsupported protocol: %s", port.Protocol)
+		}
+		if _, dup := seen[port.Host]; dup {
+			return fmt.Errorf("duplicate host port %d", port.Host)
+		}
+		seen[port.Host] = struct{}{}
+	}
+	return nil
+}
+
+// adoptConflicts reports resources of req that a registered VM already
+// holds, since the allocator would otherwise hand them out twice.
+func adoptConflicts(metas []model.VMMetadata, req model.AdoptVMRequest) error {
+	for _, meta := range metas {
+		switch {
+		case meta.Unit == req.Unit:
+			return fmt.Errorf("unit %s is already registered as vm %s", req.Unit, meta.ID)
+		case meta.Paths.SocketPath == req.SocketPath:
+			return fmt.Errorf("socket %s belongs to vm %s", req.SocketPath, meta.ID)
+		case req.GuestIP != "" && meta.GuestIP == req.GuestIP:
+			return fmt.Errorf("guest ip %s belongs to vm %s", req.GuestIP, meta.ID)
+		case req.TapName != "" && meta.TapName == req.TapName:
+			return fmt.Errorf("tap %s belongs to vm %s", req.TapName, meta.ID)
+		case req.GuestMAC != "" && network.MACOf(meta) == req.GuestMAC:
+			return fmt.Errorf("guest mac %s belongs to vm %s", req.GuestMAC, meta.ID)
+		}
+		for _, used := range meta.Ports {
+			for _, port := range req.Ports {
+				if used.Host == port.Host {
+					return fmt.Errorf("host port %d belongs to vm %s", port.Host, meta.ID)
+				}
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,91 @@
+package manager
+
+import (
+	"context"
+	"fmt"
+	"sync"
+
+	"github.com/alperreha/mergen-fire/internal/model"
+	"github.com/alperreha/mergen-fire/internal/tracing"
+)
+
+const (
+	// maxBatchVMs bounds one batch request.
+	maxBatchVMs = 1000
+	// batchConcurrency is how many VMs of a batch are acted on at once. Each
+	// action takes the VM's own lock, so they only compete for systemd.
+	batchConcurrency = 8
+)
+
+// BatchVMs runs req.Action on each VM of req.IDs, batchConcurrency at a
+// time, and returns the error of each in the order of req.IDs; nil means
+// it succeeded. One VM failing does not stop the others. The returned error
+// is set only for an invalid request.
+func (s *Service) BatchVMs(ctx context.Context, req model.BatchVMRequest) (_ []error, err error) {
+	ctx, span := tracing.Start(ctx, "manager.BatchVMs", "action", req.Action, "vms", len(req.IDs))
+	defer func() { span.RecordError(err); span.End() }()
+	s.logger.DebugContext(ctx, "batch requested", "action", req.Action, "vms", len(req.IDs))
+
+	var action func(ctx context.Context, id string) error
+	switch req.Action {
+	case model.BatchStart:
+		action = s.StartVM
+	case model.BatchStop:
+		action = s.StopVM
+	case model.BatchRestart:
+		action = func(ctx context.Context, id string) error {
+			_, err := s.RestartVM(ctx, id, 0)
+			return err
+		}
+	case model.BatchDelete:
+		action = func(ctx context.Context, id string) error {
+			return s.DeleteVM(ctx, id, req.RetainData)
+		}
+	default:
+		return nil, fmt.Errorf("%w: action must be one of %s, %s, %s or %s", ErrInvalidRequest, model.BatchStart, model.BatchStop, model.BatchRestart, model.BatchDelete)
+	}
+	if len(req.IDs) == 0 {
+		return nil, fmt.Errorf("%w: ids is required", ErrInvalidRequest)
+	}
+	if len(req.IDs) > maxBatchVMs {
+		return nil, fmt.Errorf("%w: at most %d ids per batch", ErrInvalidRequest, maxBatchVMs)
+	}
+	seen := make(map[string]bool, len(req.IDs))
+	for _, id := range req.IDs {
+		if id == "" {
+			return nil, fmt.Errorf("%w: ids must not be empty", ErrInvalidRequest)
+		}
+		if seen[id] {
+			return nil, fmt.Errorf("%w: vm %s is listed twice", ErrInvalidRequest, id)
+		}
+		seen[id] = true
+	}
+
+	errs := make([]error, len(req.IDs))
+	slots := make(chan struct{}, batchConcurrency)
+	var wg sync.WaitGroup
+	for i, id := range req.IDs {
+		select {
+		case slots <- struct{}{}:
+		case <-ctx.Done():
+			errs[i] = ctx.Err()
+			continue
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			defer func() { <-slots }()
+			errs[i] = action(ctx, id)
+		}()
+	}
+	wg.Wait()
+
+	failed := 0
+	for _, err := range errs {
+		if err != nil {
+			failed++
+		}
+	}
+	s.logger.InfoContext(ctx, "batch finished", "action", req.Action, "vms", len(req.IDs), "failed", failed)
+	return errs, nil
+}
@@ -0,0 +1,148 @@
+package manager
+
+import (
+	"context"
+	"errors"
+	"os"
+	"syscall"
+	"time"
+
+	"github.com/alperreha/mergen-fire/internal/model"
+	"github.com/alperreha/mergen-fire/internal/systemd"
+)
+
+// fileIdentity is what a boot file looked like when its VM was first seen
+// running.
+type fileIdentity struct {
+	dev, ino uint64
+	size     int64
+	modTime  time.Time
+}
+
+type bootFile struct {
+	role     string
+	path     string
+	baseline fileIdentity
+	status   string
+	since    *time.Time
+}
+
+// bootBaseline is keyed by the unit's main PID, so a restart, which boots
+// the files as they are now, starts a new baseline.
+type bootBaseline struct {
+	pid   int
+	files []bootFile
+}
+
+// WatchBootFiles checks the boot files of every running VM each interval
+// until ctx ends, so changes are reported as events even when nobody reads
+// the VM. GetVM runs the same check.
+func (s *Service) WatchBootFiles(ctx context.Context, interval time.Duration) {
+	if interval <= 0 {
+		return
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		ids, err := s.store.ListVMIDs()
+		if err != nil {
+			s.logger.WarnContext(ctx, "boot file check: list vms failed", "error", err)
+			continue
+		}
+		for _, id := range ids {
+			meta, err := s.store.ReadMeta(id)
+			if err != nil {
+				continue
+			}
+			status, err := s.systemd.Status(ctx, id)
+			if err != nil && !errors.Is(err, systemd.ErrUnavailable) {
+				continue
+			}
+			s.checkBootFiles(ctx, meta, status)
+		}
+	}
+}
+
+// checkBootFiles compares the rootfs, kernel and initrd of a running VM with
+// the files it booted from. The rootfs is written by the guest, so only its
+// replacement or deletion counts; the kernel and initrd also count as
+// modified when their size or mtime changed. Files changed before mergend
+// first saw the VM running are not detected.
+func (s *Service) checkBootFiles(ctx context.Context, meta model.VMMetadata, status systemd.Status) []model.BootFileState {
+	s.bootMu.Lock()
+	defer s.bootMu.Unlock()
+	if !status.Active {
+		delete(s.bootFiles, meta.ID)
+		return nil
+	}
+	if s.bootFiles == nil {
+		s.bootFiles = map[string]*bootBaseline{}
+	}
+	baseline, ok := s.bootFiles[meta.ID]
+	if !ok || baseline.pid != status.MainPID {
+		baseline = &bootBaseline{pid: status.MainPID}
+		for _, file := range []struct{ role, path string }{{"rootfs", meta.RootFS}, {"kernel", meta.Kernel}, {"initrd", meta.Initrd}} {
+			if file.path == "" {
+				continue
+			}
+			identity, err := statIdentity(file.path)
+			entry := bootFile{role: file.role, path: file.path, baseline: identity, status: model.BootFileUnchanged}
+			if err != nil {
+				entry.status = model.BootFileDeleted
+			}
+			baseline.files = append(baseline.files, entry)
+		}
+		s.bootFiles[meta.ID] = baseline
+	}
+
+	out := make([]model.BootFileState, 0, len(baseline.files))
+	for idx := range baseline.files {
+		file := &baseline.files[idx]
+		if next := bootFileStatus(file); next != file.status {
+			now := time.Now().UTC()
+			file.status, file.since = next, &now
+			s.logger.WarnContext(ctx, "vm boot file changed under running vm", "vmID", meta.ID, "role", file.role, "path", file.path, "status", next)
+			s.publish(model.StoreEvent{Type: model.StoreEventBootFileChanged, ID: meta.ID, Revision: meta.Revision, At: now})
+		}
+		out = append(out, model.BootFileState{Role: file.role, Path: file.path, Status: file.status, Since: file.since})
+	}
+	return out
+}
+
+// forgetBootFiles drops a VM's baseline, e.g. when it is started or
+// stopped, so the next check records the files as booted.
+func (s *Service) forgetBootFiles(id string) {
+	s.bootMu.Lock()
+	delete(s.bootFiles, id)
+	s.bootMu.Unlock()
+}
+
+func bootFileStatus(file *bootFile) string {
+	current, err := statIdentity(file.path)
+	switch {
+	case err != nil:
+		return model.BootFileDeleted
+	case current.dev != file.baseline.dev || current.ino != file.baseline.ino:
+		return model.BootFileReplaced
+	case file.role != "rootfs" && (current.size != file.baseline.size || !current.modTime.Equal(file.baseline.modTime)):
+		return model.BootFileModified
+	}
+	return model.BootFileUnchanged
+}
+
+func statIdentity(path string) (fileIdentity, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return fileIdentity{}, err
+	}
+	identity := fileIdentity{size: info.Size(), modTime: info.ModTime()}
+	if stat, ok := info.Sys().(*syscall.Stat_t); ok {
+		identity.dev, identity.ino = uint64(stat.Dev), stat.Ino
+	}
+	return identity, nil
+}
@@ -0,0 +1,198 @@
+package manager
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"sync"
+	"time"
+
+	"github.com/alperreha/mergen-fire/internal/model"
+)
+
+// BreakerPolicy says when repeated failures pause mergend's background
+// automation. A zero limit disables that trigger; a zero Cooldown keeps the
+// breaker open until it is reset through the API.
+type BreakerPolicy struct {
+	// CreateFailures trips after this many CreateVM failures in a row.
+	// Rejected requests (400, 404, 409, 412) are the caller's mistake and
+	// do not count.
+	CreateFailures int
+	// HookFailures trips after this many hook failures within HookWindow.
+	HookFailures int
+	HookWindow   time.Duration
+	Cooldown     time.Duration
+}
+
+// Breaker counts failures and, past the policy's limits, pauses automation
+// such as certificate issuing until its cooldown ends or an operator
+// resets it. API requests are never refused by it. A nil Breaker never
+// trips.
+type Breaker struct {
+	policy BreakerPolicy
+	logger *slog.Logger
+
+	mu           sync.Mutex
+	state        model.BreakerState
+	hookFailures []time.Time
+	// probation is set when a cooldown ends: the first create failure
+	// after it trips again without counting up to the limit.
+	probation bool
+}
+
+func NewBreaker(policy BreakerPolicy, logger *slog.Logger) *Breaker {
+	if logger == nil {
+		logger = slog.Default()
+	}
+	return &Breaker{policy: policy, logger: logger}
+}
+
+// RecordCreate counts a CreateVM result; a success closes the streak.
+func (b *Breaker) RecordCreate(err error) {
+	if b == nil || b.policy.CreateFailures <= 0 {
+		return
+	}
+	if err != nil && isCallerError(err) {
+		return
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.expireLocked(time.Now())
+	if err == nil {
+		b.state.CreateFailures = 0
+		b.probation = false
+		return
+	}
+	b.state.CreateFailures++
+	if b.probation || b.state.CreateFailures >= b.policy.CreateFailures {
+		b.tripLocked(fmt.Sprintf("%d consecutive create failures, last: %v", b.state.CreateFailures, err))
+	}
+}
+
+// ObserveHook counts a hook result; it satisfies hooks.Observer.
+func (b *Breaker) ObserveHook(event string, err error) {
+	if b == nil || b.policy.HookFailures <= 0 || err == nil {
+		return
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	now := time.Now()
+	b.expireLocked(now)
+	cutoff := now.Add(-b.policy.HookWindow)
+	recent := b.hookFailures[:0]
+	for _, at := range b.hookFailures {
+		if at.After(cutoff) {
+			recent = append(recent, at)
+		}
+	}
+	b.hookFailures = append(recent, now)
+	b.state.HookFailures = len(b.hookFailures)
+	if len(b.hookFailures) >= b.policy.HookFailures {
+		b.tripLocked(fmt.Sprintf("%d hook failures within %s, last on %s: %v", len(b.hookFailures), b.policy.HookWindow, event, err))
+	}
+}
+
+// Allow reports whether automation may run.
+func (b *Breaker) Allow() bool {
+	if b == nil {
+		return true
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.expireLocked(time.Now())
+	return !b.state.Tripped
+}
+
+// Reset closes the breaker and clears its counters.
+func (b *Breaker) Reset(reason string) model.BreakerState {
+	if b == nil {
+		return model.BreakerState{}
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.state.Tripped {
+		b.logger.Warn("automation circuit breaker reset", "reason", reason, "trippedFor", b.state.Reason)
+	}
+	b.state = model.BreakerState{Trips: b.state.Trips}
+	b.hookFailures, b.probation = nil, false
+	return b.state
+}
+
+// Restore takes over state from a previous mergend process, so an upgrade
+// does not close a tripped breaker.
+func (b *Breaker) Restore(state model.BreakerState) {
+	if b == nil {
+		return
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.state = state
+	b.expireLocked(time.Now())
+}
+
+func (b *Breaker) State() model.BreakerState {
+	if b == nil {
+		return model.BreakerState{}
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.expireLocked(time.Now())
+	return b.state
+}
+
+func (b *Breaker) tripLocked(reason string) {
+	now := time.Now().UTC()
+	if !b.state.Tripped {
+		b.state.Trips++
+		b.state.Since = &now
+	}
+	b.state.Tripped, b.state.Reason, b.probation = true, reason, false
+	b.state.ResumesAt = nil
+	if b.policy.Cooldown > 0 {
+		resumes := now.Add(b.policy.Cooldown)
+		b.state.ResumesAt = &resumes
+	}
+	b.logger.Error("automation circuit breaker tripped, background automation paused", "reason", reason, "resumesAt", b.state.ResumesAt)
+}
+
+// expireLocked half-opens a breaker whose cooldown has passed.
+func (b *Breaker) expireLocked(now time.Time) {
+	if !b.state.Tripped || b.state.ResumesAt == nil || now.Before(*b.state.ResumesAt) {
+		return
+	}
+	b.logger.Warn("automation circuit breaker cooldown over, resuming on probation", "trippedFor", b.state.Reason)
+	b.state = model.BreakerState{Trips: b.state.Trips}
+	b.hookFailures, b.probation = nil, true
+}
+
+// isCallerError reports errors a request brought on itself.
+func isCallerError(err error) bool {
+	return errors.Is(err, ErrInvalidRequest) || errors.Is(err, ErrNotFound) ||
+		errors.Is(err, ErrConflict) || errors.Is(err, ErrPreconditionFailed) ||
+		errors.Is(err, ErrPreconditionRequired) || errors.Is(err, context.Canceled)
+}
+
+// WithBreaker lets b pause automation after repeated failures and counts
+// CreateVM results towards it.
+func (s *Service) WithBreaker(b *Breaker) *Service {
+	s.breaker = b
+	return s
+}
+
+// AutomationPaused reports whether the breaker holds background work back.
+func (s *Service) AutomationPaused() bool {
+	return !s.breaker.Allow()
+}
+
+func (s *Service) BreakerState() model.BreakerState {
+	return s.breaker.State()
+}
+
+func (s *Service) RestoreBreaker(state model.BreakerState) {
+	s.breaker.Restore(state)
+}
+
+func (s *Service) ResetBreaker(reason string) model.BreakerState {
+	return s.breaker.Reset(reason)
+}
@@ -0,0 +1,182 @@
+package manager
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"os"
+	"runtime"
+	"strconv"
+	"strings"
+
+	"github.com/alperreha/mergen-fire/internal/model"
+)
+
+// CapacityPolicy is what the VMs of this host may commit: VCPUs and MemMiB
+// times their overcommit factor. Zero VCPUs or MemMiB stand for the host's
+// CPUs and memory; a zero factor leaves that resource unchecked.
+type CapacityPolicy struct {
+	VCPUs            int
+	MemMiB           int
+	CPUOvercommit    float64
+	MemoryOvercommit float64
+}
+
+// capacityClaim holds capacity for a VM between its admission and the save
+// that makes it count: a create, a migration received or a resize. The
+// saved configs of the VM and of the one named by replaces are not counted
+// meanwhile.
+type capacityClaim struct {
+	vmID     string
+	replaces string
+	usage    model.CapacityUsage
+}
+
+// WithCapacity checks creates, migrations received and resizes against
+// policy. Without it nothing is checked.
+func (s *Service) WithCapacity(policy CapacityPolicy) *Service {
+	if policy.VCPUs <= 0 {
+		policy.VCPUs = runtime.NumCPU()
+	}
+	if policy.MemMiB <= 0 {
+		memMiB, err := hostMemMiB("/proc/meminfo")
+		if err != nil {
+			s.logger.Warn("host memory unknown, memory admission disabled; set MGR_CAPACITY_MEM_MIB", "error", err)
+			policy.MemoryOvercommit = 0
+		}
+		policy.MemMiB = memMiB
+	}
+	s.capacity = policy
+	return s
+}
+
+// HostCapacity reports what this host admits and what its VMs, and the
+// creates and migrations being admitted, commit of it.
+func (s *Service) HostCapacity(ctx context.Context) (model.HostCapacity, error) {
+	s.logger.DebugContext(ctx, "host capacity requested")
+	s.capacityMu.Lock()
+	defer s.capacityMu.Unlock()
+	committed, vms, err := s.committedCapacity()
+	if err != nil {
+		return model.HostCapacity{}, err
+	}
+	return model.HostCapacity{
+		Host:             s.host.Name,
+		VCPUs:            s.capacity.VCPUs,
+		MemMiB:           s.capacity.MemMiB,
+		CPUOvercommit:    s.capacity.CPUOvercommit,
+		MemoryOvercommit: s.capacity.MemoryOvercommit,
+		Allocatable:      s.allocatable(),
+		Committed:        committed,
+		VMs:              vms,
+	}, nil
+}
+
+func (s *Service) allocatable() model.CapacityUsage {
+	return model.CapacityUsage{
+		VCPUs:  int(float64(s.capacity.VCPUs) * s.capacity.CPUOvercommit),
+		MemMiB: int(float64(s.capacity.MemMiB) * s.capacity.MemoryOvercommit),
+	}
+}
+
+// admitCapacity claims add for vmID if the host has room for it, replacing
+// what the VM named by replaces commits, if any. The check and the claim
+// are one step under capacityMu, so two admissions cannot both take the
+// last of it; the caller releases the claim once the VM is saved or has
+// failed.
+func (s *Service) admitCapacity(ctx context.Context, vmID, replaces string, add model.CapacityUsage) (func(), error) {
+	if s.capacity.CPUOvercommit <= 0 && s.capacity.MemoryOvercommit <= 0 {
+		return func() {}, nil
+	}
+	s.capacityMu.Lock()
+	defer s.capacityMu.Unlock()
+	if s.capacityClaims == nil {
+		s.capacityClaims = map[*capacityClaim]struct{}{}
+	}
+	claim := &capacityClaim{vmID: vmID, replaces: replaces, usage: add}
+	s.capacityClaims[claim] = struct{}{}
+	committed, _, err := s.committedCapacity()
+	if err != nil {
+		delete(s.capacityClaims, claim)
+		return nil, err
+	}
+	allocatable := s.allocatable()
+	switch {
+	case s.capacity.CPUOvercommit > 0 && committed.VCPUs > allocatable.VCPUs:
+		err = fmt.Errorf("%w: host %s admits %d vcpus, %d are committed and %d more asked for", ErrNoCapacity, s.host.Name, allocatable.VCPUs, committed.VCPUs-add.VCPUs, add.VCPUs)
+	case s.capacity.MemoryOvercommit > 0 && committed.MemMiB > allocatable.MemMiB:
+		err = fmt.Errorf("%w: host %s admits %d MiB of memory, %d MiB are committed and %d more asked for", ErrNoCapacity, s.host.Name, allocatable.MemMiB, committed.MemMiB-add.MemMiB, add.MemMiB)
+	}
+	if err != nil {
+		delete(s.capacityClaims, claim)
+		s.logger.DebugContext(ctx, "vm refused by host capacity", "vcpu", add.VCPUs, "memMiB", add.MemMiB, "error", err)
+		return nil, err
+	}
+	return func() {
+		s.capacityMu.Lock()
+		delete(s.capacityClaims, claim)
+		s.capacityMu.Unlock()
+	}, nil
+}
+
+// committedCapacity sums the configs of this host's VMs, including stopped
+// ones, which may start at any time, and the open claims. A VM saved while
+// its claim is still open counts through the claim only. Callers hold
+// capacityMu.
+func (s *Service) committedCapacity() (model.CapacityUsage, int, error) {
+	metas, err := s.store.ListMetas()
+	if err != nil {
+		return model.CapacityUsage{}, 0, err
+	}
+	var committed model.CapacityUsage
+	replaced := map[string]bool{}
+	for claim := range s.capacityClaims {
+		committed.VCPUs += claim.usage.VCPUs
+		committed.MemMiB += claim.usage.MemMiB
+		replaced[claim.vmID] = true
+		if claim.replaces != "" {
+			replaced[claim.replaces] = true
+		}
+	}
+	vms := 0
+	for _, meta := range metas {
+		if meta.Host != "" && meta.Host != s.host.Name {
+			continue
+		}
+		vms++
+		if replaced[meta.ID] {
+			continue
+		}
+		cfg, err := s.store.ReadVMConfig(meta.ID)
+		if err != nil {
+			continue
+		}
+		committed.VCPUs += cfg.MachineConfig.VCPUCount
+		committed.MemMiB += cfg.MachineConfig.MemSizeMiB
+	}
+	return committed, vms, nil
+}
+
+// hostMemMiB reads MemTotal from a meminfo file.
+func hostMemMiB(path string) (int, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return 0, err
+	}
+	defer file.Close()
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) >= 2 && fields[0] == "MemTotal:" {
+			kib, err := strconv.Atoi(fields[1])
+			if err != nil {
+				return 0, fmt.Errorf("%s: MemTotal: %w", path, err)
+			}
+			return kib / 1024, nil
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return 0, err
+	}
+	return 0, fmt.Errorf("%s: no MemTotal", path)
+}
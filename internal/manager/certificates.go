@@ -0,0 +1,211 @@
+package manager
+
+import (
+	"context"
+	"crypto"
+	"crypto/x509"
+	"fmt"
+	"os"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/alperreha/mergen-fire/internal/certs"
+	"github.com/alperreha/mergen-fire/internal/model"
+	"github.com/alperreha/mergen-fire/internal/tracing"
+)
+
+// certRetryAfter spaces failed issue attempts for one VM, which keeps a
+// misconfigured domain from running into the CA's rate limits.
+const certRetryAfter = time.Hour
+
+// CertificateIssuer obtains and revokes certificates, e.g. certs.ACME.
+type CertificateIssuer interface {
+	Issue(ctx context.Context, domains []string, key crypto.Signer) ([]byte, error)
+	Revoke(ctx context.Context, certDER []byte) error
+}
+
+// WithCertificates makes mergend keep a certificate for every VM with
+// domains in dir, issued by issuer and renewed renewBefore its expiry.
+// Without it domains are only routed, under the forwarder's own certificate.
+func (s *Service) WithCertificates(issuer CertificateIssuer, dir *certs.Dir, renewBefore time.Duration) *Service {
+	if issuer != nil && dir != nil {
+		s.certIssuer, s.certDir, s.certRenewBefore = issuer, dir, renewBefore
+	}
+	return s
+}
+
+// claimDomains checks that no VM in existing has any of domains.
+func claimDomains(existing []model.VMMetadata, domains []string) error {
+	for _, domain := range domains {
+		for _, meta := range existing {
+			if slices.Contains(meta.Domains, domain) {
+				return fmt.Errorf("%w: domain %s belongs to vm %s", ErrConflict, domain, meta.ID)
+			}
+		}
+	}
+	return nil
+}
+
+// WatchCertificates issues missing certificates and renews expiring ones
+// each interval until ctx ends. A VM created with domains is handled right
+// away.
+func (s *Service) WatchCertificates(ctx context.Context, interval time.Duration) {
+	if s.certIssuer == nil || interval <= 0 {
+		return
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		s.syncCertificates(ctx)
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		case <-s.certKick:
+		}
+	}
+}
+
+// kickCertificates wakes WatchCertificates without blocking.
+func (s *Service) kickCertificates() {
+	select {
+	case s.certKick <- struct{}{}:
+	default:
+	}
+}
+
+func (s *Service) syncCertificates(ctx context.Context) {
+	if s.AutomationPaused() {
+		s.logger.DebugContext(ctx, "certificate check skipped, automation paused by circuit breaker")
+		return
+	}
+	metas, err := s.store.ListMetas()
+	if err != nil {
+		s.logger.WarnContext(ctx, "certificate check: list vms failed", "error", err)
+		return
+	}
+	for _, meta := range metas {
+		if ctx.Err() != nil {
+			return
+		}
+		if len(meta.Domains) == 0 || meta.Deletion != nil || !s.certificateDue(ctx, meta) {
+			continue
+		}
+		s.issueCertificate(ctx, meta)
+	}
+}
+
+// certificateDue reports whether meta's certificate is missing, does not
+// cover its domains or expires within the renewal window, unless the last
+// attempt failed too recently.
+func (s *Service) certificateDue(ctx context.Context, meta model.VMMetadata) bool {
+	if state := meta.Certificate; state != nil && state.LastAttempt != nil && state.Error != "" && time.Since(*state.LastAttempt) < certRetryAfter {
+		return false
+	}
+	leaf, err := s.certDir.Leaf(meta.ID)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			s.logger.WarnContext(ctx, "stored certificate unreadable, reissuing", "vmID", meta.ID, "error", err)
+		}
+		return true
+	}
+	for _, domain := range meta.Domains {
+		if !slices.Contains(leaf.DNSNames, domain) {
+			return true
+		}
+	}
+	return time.Until(leaf.NotAfter) < s.certRenewBefore
+}
+
+func (s *Service) issueCertificate(ctx context.Context, meta model.VMMetadata) {
+	ctx, span := tracing.Start(ctx, "manager.issueCertificate", "vmID", meta.ID, "domains", strings.Join(meta.Domains, ","))
+	defer span.End()
+	s.logger.InfoContext(ctx, "issuing vm certificate", "vmID", meta.ID, "domains", meta.Domains)
+	s.recordCertificate(meta.ID, func(state *model.CertificateState) {
+		if state.Status == "" || state.Status == model.CertificateFailed {
+			state.Status = model.CertificatePending
+		}
+	})
+
+	leaf, err := s.obtainCertificate(ctx, meta)
+	span.RecordError(err)
+	now := time.Now().UTC()
+	if err != nil {
+		s.logger.WarnContext(ctx, "vm certificate issue failed", "vmID", meta.ID, "domains", meta.Domains, "error", err)
+		s.recordCertificate(meta.ID, func(state *model.CertificateState) {
+			if state.Status != model.CertificateIssued {
+				state.Status = model.CertificateFailed
+			}
+			state.LastAttempt, state.Error = &now, err.Error()
+		})
+		return
+	}
+	s.logger.InfoContext(ctx, "vm certificate issued", "vmID", meta.ID, "serial", leaf.SerialNumber.Text(16), "notAfter", leaf.NotAfter)
+	s.recordCertificate(meta.ID, func(state *model.CertificateState) {
+		notAfter := leaf.NotAfter.UTC()
+		*state = model.CertificateState{
+			Status:      model.CertificateIssued,
+			Serial:      leaf.SerialNumber.Text(16),
+			IssuedAt:    &now,
+			NotAfter:    &notAfter,
+			LastAttempt: &now,
+		}
+	})
+}
+
+// obtainCertificate issues a certificate for meta's domains under a fresh
+// key and stores it for the forwarder.
+func (s *Service) obtainCertificate(ctx context.Context, meta model.VMMetadata) (*x509.Certificate, error) {
+	key, err := certs.NewKey()
+	if err != nil {
+		return nil, err
+	}
+	chain, err := s.certIssuer.Issue(ctx, meta.Domains, key)
+	if err != nil {
+		return nil, err
+	}
+	if err := s.certDir.Save(meta.ID, chain, key); err != nil {
+		return nil, fmt.Errorf("store certificate: %w", err)
+	}
+	return s.certDir.Leaf(meta.ID)
+}
+
+// recordCertificate updates meta.Certificate. Failing to record is logged
+// only; the next check finds the certificate on disk either way.
+func (s *Service) recordCertificate(id string, update func(*model.CertificateState)) {
+	meta, err := s.store.ReadMeta(id)
+	if err == nil {
+		_, err = s.store.UpdateMeta(id, meta.Revision, func(meta *model.VMMetadata) error {
+			if meta.Certificate == nil {
+				meta.Certificate = &model.CertificateState{}
+			}
+			update(meta.Certificate)
+			return nil
+		})
+	}
+	if err != nil {
+		s.logger.Warn("record vm certificate state failed", "vmID", id, "error", err)
+	}
+}
+
+// deleteCertificateStep revokes the VM's certificate and removes it. The CA
+// being unreachable does not hold up the delete: the certificate is logged
+// and left to expire.
+func (s *Service) deleteCertificateStep(ctx context.Context, meta model.VMMetadata, _ bool) error {
+	if s.certDir == nil {
+		return nil
+	}
+	leaf, err := s.certDir.Leaf(meta.ID)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err == nil && s.certIssuer != nil {
+		if err := s.certIssuer.Revoke(ctx, leaf.Raw); err != nil {
+			s.logger.WarnContext(ctx, "vm certificate revocation failed, leaving it to expire", "vmID", meta.ID, "serial", leaf.SerialNumber.Text(16), "notAfter", leaf.NotAfter, "error", err)
+		} else {
+			s.logger.InfoContext(ctx, "vm certificate revoked", "vmID", meta.ID, "serial", leaf.SerialNumber.Text(16))
+		}
+	}
+	return s.certDir.Remove(meta.ID)
+}
@@ -0,0 +1,107 @@
+package manager
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"sync"
+	"syscall"
+)
+
+// consoleBacklog is how much earlier serial output an attach replays,
+// enough to see a boot failure that already happened.
+const consoleBacklog = 16 << 10
+
+// ConsoleSession is an attached serial console. Read follows the guest's
+// serial output, starting shortly before the attach; Write sends input to
+// the guest while its VMM runs. Both end with the context OpenConsole got.
+type ConsoleSession struct {
+	output    *logFollower
+	inputPath string
+
+	inputMu sync.Mutex
+	input   *os.File
+}
+
+// OpenConsole attaches to the serial console of a VM created with one.
+func (s *Service) OpenConsole(ctx context.Context, id string) (*ConsoleSession, error) {
+	s.logger.DebugContext(ctx, "console attach requested", "vmID", id)
+	meta, err := s.readMeta(id)
+	if err != nil {
+		return nil, err
+	}
+	if meta.Unit != "" {
+		return nil, fmt.Errorf("%w: adopted vm %s runs from its own unit's config", ErrConflict, id)
+	}
+	cfg, err := s.store.ReadVMConfig(id)
+	if err != nil {
+		return nil, err
+	}
+	if cfg.Console == nil {
+		return nil, fmt.Errorf("%w: vm %s was created without a console, recreate it to get one", ErrConflict, id)
+	}
+	outputPath := cfg.Console.OutputPath
+	if reader, ok := s.store.(migrationStore); ok {
+		if env, err := reader.ReadEnv(id); err == nil && env["MGN_SERIAL_LOG"] != "" {
+			outputPath = env["MGN_SERIAL_LOG"]
+		}
+	}
+	if outputPath == "" || outputPath == "journal" {
+		return nil, fmt.Errorf("%w: serial output of vm %s goes to the unit journal", ErrConflict, id)
+	}
+
+	output := &logFollower{ctx: ctx, path: outputPath, follow: true}
+	if err := output.open(); err != nil {
+		return nil, err
+	}
+	if output.file != nil {
+		if stat, err := output.file.Stat(); err == nil {
+			output.offset = max(stat.Size()-consoleBacklog, 0)
+		}
+	}
+	s.logger.InfoContext(ctx, "console attached", "vmID", id, "output", outputPath)
+	return &ConsoleSession{output: output, inputPath: cfg.Console.InputPath}, nil
+}
+
+// Read waits for serial output and returns io.EOF once the session's
+// context ends.
+func (c *ConsoleSession) Read(p []byte) (int, error) {
+	return c.output.Read(p)
+}
+
+// Write sends input to the guest's serial port. It fails with ErrConflict
+// while no VMM holds the console FIFO open.
+func (c *ConsoleSession) Write(p []byte) (int, error) {
+	c.inputMu.Lock()
+	defer c.inputMu.Unlock()
+	if c.input == nil {
+		// Opening a FIFO without a reader fails with ENXIO instead of
+		// blocking when it is non-blocking.
+		f, err := os.OpenFile(c.inputPath, os.O_WRONLY|syscall.O_NONBLOCK, 0)
+		if errors.Is(err, os.ErrNotExist) || errors.Is(err, syscall.ENXIO) {
+			return 0, fmt.Errorf("%w: vm is not running", ErrConflict)
+		}
+		if err != nil {
+			return 0, err
+		}
+		c.input = f
+	}
+	n, err := c.input.Write(p)
+	if errors.Is(err, syscall.EPIPE) {
+		c.input.Close()
+		c.input = nil
+		return n, fmt.Errorf("%w: vm is not running", ErrConflict)
+	}
+	return n, err
+}
+
+func (c *ConsoleSession) Close() error {
+	c.inputMu.Lock()
+	defer c.inputMu.Unlock()
+	if c.input != nil {
+		c.input.Close()
+		c.input = nil
+	}
+	return c.output.Close()
+}
@@ -0,0 +1,184 @@
+package manager
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os/exec"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/alperreha/mergen-fire/internal/firecracker"
+	"github.com/alperreha/mergen-fire/internal/model"
+	"github.com/alperreha/mergen-fire/internal/store"
+	"github.com/alperreha/mergen-fire/internal/systemd"
+	"github.com/alperreha/mergen-fire/internal/tracing"
+)
+
+// defaultNetCleanup is the script the unit runs as ExecStopPost.
+const defaultNetCleanup = "/usr/local/bin/mergen-net-cleanup"
+
+type deleteStep struct {
+	name string
+	run  func(ctx context.Context, meta model.VMMetadata, retainData bool) error
+}
+
+// runDelete deletes a VM as an ordered pipeline: take it out of forwarder
+// routing, stop its unit, make sure Firecracker let go of its drives, remove
+// a netns the unit left behind, revoke the certificate of its domains, then
+// remove it from the store. Each step's
+// result is kept in meta.Deletion, so after a failure the VM stays in the
+// store and deleting it again resumes from the failed step. Callers hold the
+// VM lock.
+func (s *Service) runDelete(ctx context.Context, meta model.VMMetadata, retainData bool) error {
+	steps := []deleteStep{
+		{model.DeleteStepDrain, s.deleteDrainStep},
+		{model.DeleteStepStop, s.deleteStopStep},
+		{model.DeleteStepVolumes, s.deleteVolumesStep},
+		{model.DeleteStepNetwork, s.deleteNetworkStep},
+		{model.DeleteStepCerts, s.deleteCertificateStep},
+		{model.DeleteStepStore, s.deleteStoreStep},
+	}
+	var completed []string
+	if meta.Deletion != nil {
+		completed = meta.Deletion.Completed
+		s.logger.InfoContext(ctx, "resuming vm delete", "vmID", meta.ID, "completed", strings.Join(completed, ","), "failedStep", meta.Deletion.FailedStep)
+	}
+	for _, step := range steps {
+		if slices.Contains(completed, step.name) {
+			continue
+		}
+		_, span := tracing.Start(ctx, "manager.DeleteVM."+step.name, "vmID", meta.ID)
+		err := step.run(ctx, meta, retainData)
+		span.RecordError(err)
+		span.End()
+		if err != nil {
+			s.logger.WarnContext(ctx, "vm delete step failed", "vmID", meta.ID, "step", step.name, "error", err)
+			s.recordDeleteProgress(meta.ID, func(progress *model.DeleteProgress) {
+				progress.FailedStep, progress.Error = step.name, err.Error()
+			})
+			return fmt.Errorf("delete step %s: %w", step.name, err)
+		}
+		s.logger.DebugContext(ctx, "vm delete step done", "vmID", meta.ID, "step", step.name)
+		if step.name == model.DeleteStepStore {
+			break
+		}
+		completed = append(completed, step.name)
+		s.recordDeleteProgress(meta.ID, func(progress *model.DeleteProgress) {
+			progress.Completed = append(progress.Completed, step.name)
+			progress.FailedStep, progress.Error = "", ""
+		})
+	}
+	return nil
+}
+
+// recordDeleteProgress updates meta.Deletion. Failing to record is logged
+// only: the step already ran, and rerunning it on resume is harmless.
+func (s *Service) recordDeleteProgress(id string, update func(*model.DeleteProgress)) {
+	meta, err := s.store.ReadMeta(id)
+	if err == nil {
+		_, err = s.store.UpdateMeta(id, meta.Revision, func(meta *model.VMMetadata) error {
+			if meta.Deletion == nil {
+				meta.Deletion = &model.DeleteProgress{StartedAt: time.Now().UTC()}
+			}
+			update(meta.Deletion)
+			return nil
+		})
+	}
+	if err != nil {
+		s.logger.Warn("record vm delete progress failed", "vmID", id, "error", err)
+	}
+}
+
+// deleteDrainStep marks the VM as being deleted, which the forwarder takes
+// as a signal to stop routing new connections to it, then gives open ones
+// the drain period to finish.
+func (s *Service) deleteDrainStep(ctx context.Context, meta model.VMMetadata, _ bool) error {
+	current, err := s.store.ReadMeta(meta.ID)
+	if err != nil {
+		return err
+	}
+	if _, err := s.store.UpdateMeta(meta.ID, current.Revision, func(meta *model.VMMetadata) error {
+		if meta.Deletion == nil {
+			meta.Deletion = &model.DeleteProgress{StartedAt: time.Now().UTC()}
+		}
+		return nil
+	}); err != nil {
+		return err
+	}
+	if s.deleteDrain <= 0 {
+		return nil
+	}
+	timer := time.NewTimer(s.deleteDrain)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return nil
+	}
+}
+
+func (s *Service) deleteStopStep(ctx context.Context, meta model.VMMetadata, _ bool) error {
+	if err := s.systemd.Stop(ctx, meta.ID); err != nil && !errors.Is(err, systemd.ErrUnavailable) {
+		return fmt.Errorf("stop unit: %w", err)
+	}
+	if err := s.systemd.Disable(ctx, meta.ID); err != nil && !errors.Is(err, systemd.ErrUnavailable) {
+		return fmt.Errorf("disable unit: %w", err)
+	}
+	return nil
+}
+
+// deleteVolumesStep checks that Firecracker has exited and so released the
+// rootfs and data disk before their files are removed.
+func (s *Service) deleteVolumesStep(ctx context.Context, meta model.VMMetadata, _ bool) error {
+	status, err := s.systemd.Status(ctx, meta.ID)
+	if err != nil && !errors.Is(err, systemd.ErrUnavailable) {
+		return err
+	}
+	if status.Active {
+		return fmt.Errorf("unit %s is still active (pid %d) and holds the vm's drives", status.Unit, status.MainPID)
+	}
+	present, err := firecracker.SocketPresent(meta.Paths.SocketPath)
+	if err != nil || !present {
+		return err
+	}
+	stale, err := firecracker.SocketStale(meta.Paths.SocketPath)
+	if err != nil {
+		return err
+	}
+	if !stale {
+		return fmt.Errorf("firecracker still serves %s and holds the vm's drives", meta.Paths.SocketPath)
+	}
+	return nil
+}
+
+// deleteNetworkStep removes the VM's netns when mergen-net-cleanup did not
+// run, e.g. because the unit never started. It runs before the store step
+// since the cleanup script reads the VM's env file.
+func (s *Service) deleteNetworkStep(ctx context.Context, meta model.VMMetadata, _ bool) error {
+	if !s.namer.NetNSPresent(meta.NetNS) {
+		return nil
+	}
+	if s.netCleanup == "" {
+		return fmt.Errorf("netns %s is still present", meta.NetNS)
+	}
+	output, err := exec.CommandContext(ctx, s.netCleanup, meta.ID).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("%s: %w: %s", s.netCleanup, err, strings.TrimSpace(string(output)))
+	}
+	if s.namer.NetNSPresent(meta.NetNS) {
+		return fmt.Errorf("netns %s is still present after %s", meta.NetNS, s.netCleanup)
+	}
+	s.logger.InfoContext(ctx, "removed leftover vm netns", "vmID", meta.ID, "netns", meta.NetNS)
+	return nil
+}
+
+func (s *Service) deleteStoreStep(_ context.Context, meta model.VMMetadata, retainData bool) error {
+	err := s.store.DeleteVM(meta.ID, retainData)
+	if errors.Is(err, store.ErrNotFound) {
+		return nil
+	}
+	return err
+}
@@ -0,0 +1,61 @@
+package manager
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+
+	"github.com/alperreha/mergen-fire/internal/model"
+)
+
+// vfioDriver is the driver a device has to be bound to before a VM can
+// take it.
+const vfioDriver = "vfio-pci"
+
+// WithPCIDevicesDir sets where the host's PCI devices are looked up,
+// normally /sys/bus/pci/devices.
+func (s *Service) WithPCIDevicesDir(dir string) *Service {
+	if strings.TrimSpace(dir) != "" {
+		s.pciDevicesDir = dir
+	}
+	return s
+}
+
+// claimDevices checks that each of devices is ready for passthrough on this
+// host and not owned by a VM in existing. Ownership is meta.Devices, so
+// callers hold deviceMu until the claiming VM is saved.
+func (s *Service) claimDevices(existing []model.VMMetadata, devices []string) error {
+	for _, addr := range devices {
+		for _, meta := range existing {
+			if slices.Contains(meta.Devices, addr) {
+				return fmt.Errorf("%w: device %s belongs to vm %s", ErrConflict, addr, meta.ID)
+			}
+		}
+		if err := s.deviceReady(addr); err != nil {
+			return fmt.Errorf("%w: %v", ErrInvalidRequest, err)
+		}
+	}
+	return nil
+}
+
+// deviceReady reports why addr cannot be passed through: it is missing,
+// bound to a host driver, or not in an IOMMU group VFIO can open.
+func (s *Service) deviceReady(addr string) error {
+	dir := filepath.Join(s.pciDevicesDir, addr)
+	if _, err := os.Stat(dir); err != nil {
+		return fmt.Errorf("device %s not found under %s", addr, s.pciDevicesDir)
+	}
+	driver, err := os.Readlink(filepath.Join(dir, "driver"))
+	if err != nil {
+		return fmt.Errorf("device %s is not bound to %s", addr, vfioDriver)
+	}
+	if name := filepath.Base(driver); name != vfioDriver {
+		return fmt.Errorf("device %s is bound to %s, not %s", addr, name, vfioDriver)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "iommu_group")); err != nil {
+		return fmt.Errorf("device %s has no iommu group; is the iommu enabled?", addr)
+	}
+	return nil
+}
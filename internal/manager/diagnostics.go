@@ -0,0 +1,24 @@
+package manager
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/alperreha/mergen-fire/internal/diagnostics"
+	"github.com/alperreha/mergen-fire/internal/model"
+)
+
+func (s *Service) WithDiagnostics(checker *diagnostics.Checker) *Service {
+	s.diagnostics = checker
+	return s
+}
+
+// HostDiagnostics checks the host prerequisites for running VMs.
+func (s *Service) HostDiagnostics(ctx context.Context) (model.HostDiagnostics, error) {
+	if s.diagnostics == nil {
+		return model.HostDiagnostics{}, fmt.Errorf("%w: host diagnostics are not configured", ErrUnavailable)
+	}
+	report := s.diagnostics.Run()
+	s.logger.DebugContext(ctx, "host diagnostics run", "ok", report.OK, "checks", len(report.Checks))
+	return report, nil
+}
@@ -7,4 +7,9 @@ var (
 	ErrNotFound       = errors.New("not found")
 	ErrConflict       = errors.New("state conflict")
 	ErrUnavailable    = errors.New("host dependency unavailable")
+	ErrQuotaExceeded  = errors.New("quota exceeded")
+	ErrNoCapacity     = errors.New("insufficient host capacity")
+
+	ErrPreconditionFailed   = errors.New("precondition failed")
+	ErrPreconditionRequired = errors.New("precondition required")
 )
@@ -0,0 +1,134 @@
+package manager
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/alperreha/mergen-fire/internal/firecracker"
+	"github.com/alperreha/mergen-fire/internal/model"
+	"github.com/alperreha/mergen-fire/internal/systemd"
+	"github.com/alperreha/mergen-fire/internal/tracing"
+)
+
+const (
+	defaultExecTimeout = 60 * time.Second
+	maxExecTimeout     = 10 * time.Minute
+	// execReplyGrace is how long past the command's timeout the guest
+	// gets to kill it and send the result.
+	execReplyGrace = 10 * time.Second
+	// maxExecReply bounds the guest's reply: two MiB of output, which
+	// JSON escaping can grow.
+	maxExecReply = 16 << 20
+)
+
+// guestExecRequest and guestExecResponse are the wire form of
+// mergen-init-snapshot's exec agent.
+type guestExecRequest struct {
+	Argv      []string          `json:"argv"`
+	Env       map[string]string `json:"env,omitempty"`
+	WorkDir   string            `json:"workDir,omitempty"`
+	User      string            `json:"user,omitempty"`
+	Stdin     string            `json:"stdin,omitempty"`
+	TimeoutMs int64             `json:"timeoutMs,omitempty"`
+}
+
+type guestExecResponse struct {
+	ExitCode  int    `json:"exitCode"`
+	Stdout    string `json:"stdout"`
+	Stderr    string `json:"stderr"`
+	Truncated bool   `json:"truncated,omitempty"`
+	TimedOut  bool   `json:"timedOut,omitempty"`
+	Error     string `json:"error,omitempty"`
+}
+
+// ExecVM runs a command in a running VM through the exec agent of its
+// init, over the VM's vsock device, and returns once the command exits or
+// is killed at its timeout. A command that cannot be started, such as a
+// missing binary, is ErrInvalidRequest.
+func (s *Service) ExecVM(ctx context.Context, id string, req model.ExecRequest) (_ model.ExecResult, err error) {
+	ctx, span := tracing.Start(ctx, "manager.ExecVM", "vmID", id)
+	defer func() { span.RecordError(err); span.End() }()
+	s.logger.DebugContext(ctx, "exec vm requested", "vmID", id, "args", len(req.Command))
+	if len(req.Command) == 0 || req.Command[0] == "" {
+		return model.ExecResult{}, fmt.Errorf("%w: command is empty", ErrInvalidRequest)
+	}
+	if req.TimeoutSeconds < 0 || time.Duration(req.TimeoutSeconds)*time.Second > maxExecTimeout {
+		return model.ExecResult{}, fmt.Errorf("%w: timeoutSeconds must be between 0 and %d", ErrInvalidRequest, int(maxExecTimeout.Seconds()))
+	}
+	timeout := defaultExecTimeout
+	if req.TimeoutSeconds > 0 {
+		timeout = time.Duration(req.TimeoutSeconds) * time.Second
+	}
+	meta, err := s.readMeta(id)
+	if err != nil {
+		return model.ExecResult{}, err
+	}
+	if meta.Host != "" && meta.Host != s.host.Name {
+		return model.ExecResult{}, fmt.Errorf("%w: vm runs on host %s, exec there", ErrConflict, meta.Host)
+	}
+	if meta.Unit != "" {
+		return model.ExecResult{}, fmt.Errorf("%w: adopted vm %s runs from its own unit's config", ErrConflict, id)
+	}
+	cfg, err := s.store.ReadVMConfig(id)
+	if err != nil {
+		return model.ExecResult{}, err
+	}
+	if cfg.Vsock == nil {
+		return model.ExecResult{}, fmt.Errorf("%w: vm %s was created without a vsock device, recreate it to get one", ErrConflict, id)
+	}
+	// Without systemd the dial below tells whether the VM runs.
+	active, err := s.systemd.IsActive(ctx, id)
+	if err != nil && !errors.Is(err, systemd.ErrUnavailable) {
+		return model.ExecResult{}, err
+	}
+	if err == nil && !active {
+		return model.ExecResult{}, fmt.Errorf("%w: vm %s is not running", ErrConflict, id)
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, timeout+execReplyGrace)
+	defer cancel()
+	started := time.Now()
+	conn, err := firecracker.DialGuest(ctx, cfg.Vsock.UdsPath, firecracker.GuestExecPort)
+	if err != nil {
+		return model.ExecResult{}, fmt.Errorf("%w: exec agent of vm %s not reachable, its image may boot another init or set mergen.exec=0: %v", ErrUnavailable, id, err)
+	}
+	defer conn.Close()
+	stop := context.AfterFunc(ctx, func() { conn.Close() })
+	defer stop()
+
+	err = json.NewEncoder(conn).Encode(guestExecRequest{
+		Argv:      req.Command,
+		Env:       req.Env,
+		WorkDir:   req.WorkDir,
+		User:      req.User,
+		Stdin:     req.Stdin,
+		TimeoutMs: timeout.Milliseconds(),
+	})
+	if err != nil {
+		return model.ExecResult{}, fmt.Errorf("%w: send command to vm %s: %v", ErrUnavailable, id, err)
+	}
+	var reply guestExecResponse
+	if err := json.NewDecoder(io.LimitReader(conn, maxExecReply)).Decode(&reply); err != nil {
+		if ctx.Err() != nil {
+			err = ctx.Err()
+		}
+		return model.ExecResult{}, fmt.Errorf("%w: no exec result from vm %s: %v", ErrUnavailable, id, err)
+	}
+	if reply.Error != "" {
+		return model.ExecResult{}, fmt.Errorf("%w: %s", ErrInvalidRequest, reply.Error)
+	}
+	result := model.ExecResult{
+		ExitCode:   reply.ExitCode,
+		Stdout:     reply.Stdout,
+		Stderr:     reply.Stderr,
+		Truncated:  reply.Truncated,
+		TimedOut:   reply.TimedOut,
+		DurationMs: time.Since(started).Milliseconds(),
+	}
+	s.logger.InfoContext(ctx, "vm exec finished", "vmID", id, "command", req.Command[0], "exitCode", result.ExitCode, "timedOut", result.TimedOut, "durationMs", result.DurationMs)
+	return result, nil
+}
@@ -0,0 +1,172 @@
+package manager
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/alperreha/mergen-fire/internal/firecracker"
+	"github.com/alperreha/mergen-fire/internal/model"
+)
+
+// maxGuestStatsLine bounds one sample; they are around a hundred bytes.
+const maxGuestStatsLine = 4 << 10
+
+// guestStatsSample is the wire form mergen-init-snapshot sends.
+type guestStatsSample struct {
+	Load            [3]float64 `json:"l"`
+	MemTotalKiB     int64      `json:"mt"`
+	MemAvailableKiB int64      `json:"ma"`
+	WorkloadRSSKiB  int64      `json:"rss"`
+	Processes       int        `json:"p"`
+	UptimeSeconds   float64    `json:"up"`
+}
+
+// RunGuestStats keeps a listener for the resource samples of each VM of this
+// host on the unix socket its VMM forwards guest connections to port
+// GuestStatsPort to, checking for new and deleted VMs each interval until ctx
+// ends.
+func (s *Service) RunGuestStats(ctx context.Context, interval time.Duration) {
+	if interval <= 0 {
+		return
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	defer s.closeGuestStatsListeners()
+	for {
+		s.syncGuestStatsListeners(ctx)
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func (s *Service) syncGuestStatsListeners(ctx context.Context) {
+	metas, err := s.store.ListMetas()
+	if err != nil {
+		s.logger.WarnContext(ctx, "guest stats: list vms failed", "error", err)
+		return
+	}
+	wanted := make(map[string]string, len(metas))
+	for _, meta := range metas {
+		if meta.Paths.RunDir == "" || meta.Deletion != nil || meta.Host != "" && meta.Host != s.host.Name {
+			continue
+		}
+		wanted[meta.ID] = firecracker.VsockHostPath(meta.Paths.RunDir, firecracker.GuestStatsPort)
+	}
+
+	s.guestStatsMu.Lock()
+	defer s.guestStatsMu.Unlock()
+	if s.guestStatsListeners == nil {
+		s.guestStatsListeners = map[string]net.Listener{}
+		s.guestStats = map[string]model.GuestStats{}
+	}
+	for id, ln := range s.guestStatsListeners {
+		if _, ok := wanted[id]; !ok {
+			ln.Close()
+			delete(s.guestStatsListeners, id)
+			delete(s.guestStats, id)
+		}
+	}
+	for id, path := range wanted {
+		if _, ok := s.guestStatsListeners[id]; ok {
+			continue
+		}
+		ln, err := listenUnix(path)
+		if err != nil {
+			s.logger.WarnContext(ctx, "guest stats: listen failed", "vmID", id, "path", path, "error", err)
+			continue
+		}
+		s.guestStatsListeners[id] = ln
+		go s.acceptGuestStats(ctx, id, ln)
+	}
+}
+
+func (s *Service) closeGuestStatsListeners() {
+	s.guestStatsMu.Lock()
+	defer s.guestStatsMu.Unlock()
+	for id, ln := range s.guestStatsListeners {
+		ln.Close()
+		delete(s.guestStatsListeners, id)
+	}
+}
+
+// listenUnix replaces a socket file left by an earlier mergend.
+func listenUnix(path string) (net.Listener, error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return nil, err
+	}
+	if err := os.Remove(path); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return nil, err
+	}
+	return net.Listen("unix", path)
+}
+
+func (s *Service) acceptGuestStats(ctx context.Context, id string, ln net.Listener) {
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			if !errors.Is(err, net.ErrClosed) {
+				s.logger.WarnContext(ctx, "guest stats: accept failed", "vmID", id, "error", err)
+			}
+			return
+		}
+		go s.readGuestStats(ctx, id, ln, conn)
+	}
+}
+
+// readGuestStats keeps the last sample of each line the guest sends until
+// it disconnects or the VM's listener is closed. Lines that do not parse are
+// skipped.
+func (s *Service) readGuestStats(ctx context.Context, id string, ln net.Listener, conn net.Conn) {
+	defer conn.Close()
+	scanner := bufio.NewScanner(conn)
+	scanner.Buffer(make([]byte, 0, 512), maxGuestStatsLine)
+	for scanner.Scan() {
+		var sample guestStatsSample
+		if err := json.Unmarshal(scanner.Bytes(), &sample); err != nil {
+			s.logger.DebugContext(ctx, "guest stats: invalid sample", "vmID", id, "error", err)
+			continue
+		}
+		s.guestStatsMu.Lock()
+		if s.guestStatsListeners[id] != ln {
+			s.guestStatsMu.Unlock()
+			return
+		}
+		s.guestStats[id] = model.GuestStats{
+			At:              time.Now().UTC(),
+			Load:            sample.Load,
+			MemTotalKiB:     sample.MemTotalKiB,
+			MemAvailableKiB: sample.MemAvailableKiB,
+			WorkloadRSSKiB:  sample.WorkloadRSSKiB,
+			Processes:       sample.Processes,
+			UptimeSeconds:   sample.UptimeSeconds,
+		}
+		s.guestStatsMu.Unlock()
+	}
+}
+
+// GuestStats returns the latest sample the VM's init sent. VMs created
+// before guests got a vsock device, and images booting another init, never
+// report one.
+func (s *Service) GuestStats(ctx context.Context, id string) (model.GuestStats, error) {
+	s.logger.DebugContext(ctx, "guest stats requested", "vmID", id)
+	if _, err := s.readMeta(id); err != nil {
+		return model.GuestStats{}, err
+	}
+	s.guestStatsMu.Lock()
+	stats, ok := s.guestStats[id]
+	s.guestStatsMu.Unlock()
+	if !ok {
+		return model.GuestStats{}, fmt.Errorf("%w: vm %s has not reported guest stats", ErrNotFound, id)
+	}
+	return stats, nil
+}
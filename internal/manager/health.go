@@ -0,0 +1,337 @@
+package manager
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/alperreha/mergen-fire/internal/model"
+	"github.com/alperreha/mergen-fire/internal/systemd"
+)
+
+const (
+	defaultProbeInterval     = 10 * time.Second
+	defaultProbeTimeout      = 2 * time.Second
+	defaultFailureThreshold  = 3
+	defaultRestartBackoff    = 10 * time.Second
+	defaultMaxRestartBackoff = 5 * time.Minute
+)
+
+// GuestDialer dials an address inside a VM's network namespace, where its
+// guest IP is reachable; the forwarder's NetNSDialer is one.
+type GuestDialer interface {
+	DialContext(ctx context.Context, network, address, netns string) (net.Conn, error)
+}
+
+// WithGuestDialer sets how health probes reach guests; without one no VM
+// is probed.
+func (s *Service) WithGuestDialer(dialer GuestDialer) *Service {
+	s.guestDialer = dialer
+	return s
+}
+
+// healthProbeState is the health of a VM since its unit's MainPID was first
+// seen, so a restart by anyone starts it over.
+type healthProbeState struct {
+	pid     int
+	next    time.Time
+	probing bool
+	state   model.HealthState
+}
+
+// RunHealthProbes looks every tick for running VMs of this host whose
+// health probe is due and probes them, each in its own goroutine, until ctx
+// ends. An unhealthy VM is restarted as its restart policy allows.
+func (s *Service) RunHealthProbes(ctx context.Context, tick time.Duration) {
+	if tick <= 0 {
+		return
+	}
+	if s.guestDialer == nil {
+		s.logger.WarnContext(ctx, "no guest dialer configured, health probes disabled")
+		return
+	}
+	var probes sync.WaitGroup
+	defer probes.Wait()
+	ticker := time.NewTicker(tick)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		s.startDueProbes(ctx, &probes)
+	}
+}
+
+func (s *Service) startDueProbes(ctx context.Context, probes *sync.WaitGroup) {
+	metas, err := s.store.ListMetas()
+	if err != nil {
+		s.logger.WarnContext(ctx, "health probes: list vms failed", "error", err)
+		return
+	}
+	for _, meta := range metas {
+		if meta.HealthProbe == nil || meta.Deletion != nil || meta.Host != "" && meta.Host != s.host.Name {
+			continue
+		}
+		status, err := s.systemd.Status(ctx, meta.ID)
+		if err != nil {
+			if !errors.Is(err, systemd.ErrUnavailable) {
+				s.logger.WarnContext(ctx, "health probes: unit status failed", "vmID", meta.ID, "error", err)
+			}
+			continue
+		}
+		if !s.probeDue(meta, status) {
+			continue
+		}
+		probes.Add(1)
+		go func(meta model.VMMetadata, pid int) {
+			defer probes.Done()
+			s.recordProbe(ctx, meta, pid, s.probe(ctx, meta))
+		}(meta, status.MainPID)
+	}
+}
+
+// probeDue reports whether the VM's probe should run now and, if so, marks
+// it in flight. A VM that is not running has no health.
+func (s *Service) probeDue(meta model.VMMetadata, status systemd.Status) bool {
+	s.healthMu.Lock()
+	defer s.healthMu.Unlock()
+	if !status.Active {
+		delete(s.health, meta.ID)
+		return false
+	}
+	if s.health == nil {
+		s.health = map[string]*healthProbeState{}
+	}
+	now := time.Now()
+	state, ok := s.health[meta.ID]
+	if !ok || state.pid != status.MainPID {
+		delay := time.Duration(meta.HealthProbe.InitialDelaySeconds) * time.Second
+		state = &healthProbeState{pid: status.MainPID, next: now.Add(delay), state: model.HealthState{Status: model.HealthUnknown}}
+		s.health[meta.ID] = state
+	}
+	if state.probing || now.Before(state.next) {
+		return false
+	}
+	state.probing = true
+	return true
+}
+
+// probe checks meta's health probe once.
+func (s *Service) probe(ctx context.Context, meta model.VMMetadata) error {
+	probe := *meta.HealthProbe
+	timeout := defaultProbeTimeout
+	if probe.TimeoutSeconds > 0 {
+		timeout = time.Duration(probe.TimeoutSeconds) * time.Second
+	}
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	address := net.JoinHostPort(meta.GuestIP, strconv.Itoa(probe.Port))
+	if probe.Type == model.ProbeTCP {
+		conn, err := s.guestDialer.DialContext(ctx, "tcp", address, meta.NetNS)
+		if err != nil {
+			return err
+		}
+		return conn.Close()
+	}
+
+	client := &http.Client{
+		Transport: &http.Transport{
+			DialContext: func(ctx context.Context, network, _ string) (net.Conn, error) {
+				return s.guestDialer.DialContext(ctx, network, address, meta.NetNS)
+			},
+			DisableKeepAlives: true,
+		},
+		CheckRedirect: func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse },
+	}
+	path := probe.Path
+	if path == "" {
+		path = "/"
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, "http://"+address+path, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= 400 {
+		return fmt.Errorf("GET %s answered %d", path, resp.StatusCode)
+	}
+	return nil
+}
+
+// recordProbe records the result of a probe of the unit with MainPID pid.
+// Turning healthy ends the VM's restart backoff; turning unhealthy restarts
+// it as its policy allows.
+func (s *Service) recordProbe(ctx context.Context, meta model.VMMetadata, pid int, probeErr error) {
+	threshold := meta.HealthProbe.FailureThreshold
+	if threshold <= 0 {
+		threshold = defaultFailureThreshold
+	}
+	interval := defaultProbeInterval
+	if meta.HealthProbe.IntervalSeconds > 0 {
+		interval = time.Duration(meta.HealthProbe.IntervalSeconds) * time.Second
+	}
+
+	s.healthMu.Lock()
+	state, ok := s.health[meta.ID]
+	if !ok || state.pid != pid {
+		s.healthMu.Unlock()
+		return
+	}
+	now := time.Now().UTC()
+	previous := state.state.Status
+	state.probing, state.next = false, now.Add(interval)
+	state.state.CheckedAt = &now
+	if probeErr == nil {
+		state.state.Status, state.state.ConsecutiveFailures, state.state.Error = model.HealthHealthy, 0, ""
+	} else {
+		state.state.ConsecutiveFailures++
+		state.state.Error = probeErr.Error()
+		if state.state.ConsecutiveFailures >= threshold {
+			state.state.Status = model.HealthUnhealthy
+		}
+	}
+	current := state.state
+	s.healthMu.Unlock()
+
+	if current.Status == previous {
+		return
+	}
+	s.publish(model.StoreEvent{Type: model.StoreEventHealthChanged, ID: meta.ID, Revision: meta.Revision, Reason: current.Status, At: now})
+	if current.Status == model.HealthHealthy {
+		s.logger.InfoContext(ctx, "vm healthy", "vmID", meta.ID)
+		s.forgetRetry(meta.ID)
+		return
+	}
+	if current.Status != model.HealthUnhealthy {
+		return
+	}
+	s.logger.WarnContext(ctx, "vm unhealthy", "vmID", meta.ID, "failures", current.ConsecutiveFailures, "error", current.Error)
+	s.restartUnhealthy(ctx, meta.ID, current.Error)
+}
+
+// restartUnhealthy restarts a VM that failed its health probe, unless its
+// restart policy is never, its restart is backed off, the breaker is open
+// or it has been stopped meanwhile.
+func (s *Service) restartUnhealthy(ctx context.Context, id, reason string) {
+	if s.AutomationPaused() {
+		s.logger.DebugContext(ctx, "unhealthy vm left alone while automation is paused by circuit breaker", "vmID", id)
+		return
+	}
+	release, err := s.lockVM(ctx, id, "health restart")
+	if err != nil {
+		s.logger.WarnContext(ctx, "unhealthy vm busy, restart skipped", "vmID", id, "error", err)
+		return
+	}
+	defer release()
+	meta, err := s.store.ReadMeta(id)
+	if err != nil || meta.Deletion != nil || meta.DesiredState == model.DesiredStopped || restartMode(meta.RestartPolicy) == model.RestartNever {
+		return
+	}
+	if active, err := s.systemd.IsActive(ctx, id); err != nil || !active {
+		return
+	}
+	first, limit := restartBackoff(meta.RestartPolicy, defaultRestartBackoff)
+	if !s.restartDue(id, first, limit) {
+		s.logger.DebugContext(ctx, "unhealthy vm keeps failing, restart backed off", "vmID", id)
+		return
+	}
+	s.logger.WarnContext(ctx, "restarting unhealthy vm", "vmID", id)
+	if err := s.stopWithin(ctx, id, s.restartTimeout); err != nil {
+		s.logger.WarnContext(ctx, "unhealthy vm: stop failed", "vmID", id, "error", err)
+		return
+	}
+	if err := s.startAs(ctx, id, model.TransitionStarted, "unhealthy: "+reason); err != nil {
+		s.logger.WarnContext(ctx, "unhealthy vm: start failed", "vmID", id, "error", err)
+		s.publishReconciled(meta, model.ReconcileStartFailed)
+		return
+	}
+	s.countRestart(ctx, id, "unhealthy: "+reason)
+	s.publishReconciled(meta, model.ReconcileRestarted)
+}
+
+// healthOf returns the VM's health while it runs with a health probe.
+func (s *Service) healthOf(id string) *model.HealthState {
+	s.healthMu.Lock()
+	defer s.healthMu.Unlock()
+	state, ok := s.health[id]
+	if !ok {
+		return nil
+	}
+	health := state.state
+	return &health
+}
+
+// forgetHealth drops a VM's health, e.g. when it is started or stopped, so
+// its probe starts over after the initial delay.
+func (s *Service) forgetHealth(id string) {
+	s.healthMu.Lock()
+	delete(s.health, id)
+	s.healthMu.Unlock()
+}
+
+// countRestart records a restart mergend did on its own in the VM's
+// metadata. Like the state history, failing to write it never fails the
+// restart.
+func (s *Service) countRestart(ctx context.Context, id, reason string) {
+	meta, err := s.store.ReadMeta(id)
+	if err == nil {
+		_, err = s.store.UpdateMeta(id, meta.Revision, func(meta *model.VMMetadata) error {
+			restarts := model.RestartState{LastAt: time.Now().UTC(), LastReason: reason}
+			if meta.Restarts != nil {
+				restarts.Count = meta.Restarts.Count
+			}
+			restarts.Count++
+			meta.Restarts = &restarts
+			return nil
+		})
+	}
+	if err != nil {
+		s.logger.WarnContext(ctx, "failed to count vm restart", "vmID", id, "error", err)
+	}
+}
+
+func validateRestartPolicy(policy *model.RestartPolicy) error {
+	if policy == nil {
+		return nil
+	}
+	switch policy.Mode {
+	case model.RestartAlways, model.RestartOnFailure, model.RestartNever:
+	default:
+		return fmt.Errorf("restartPolicy: unknown mode %q, expected always, on-failure or never", policy.Mode)
+	}
+	if policy.BackoffSeconds < 0 || policy.MaxBackoffSeconds < 0 {
+		return errors.New("restartPolicy: backoff must not be negative")
+	}
+	return nil
+}
+
+func validateHealthProbe(probe *model.HealthProbe) error {
+	if probe == nil {
+		return nil
+	}
+	if probe.Type != model.ProbeTCP && probe.Type != model.ProbeHTTP {
+		return fmt.Errorf("healthProbe: unknown type %q, expected tcp or http", probe.Type)
+	}
+	if probe.Port <= 0 || probe.Port > 65535 {
+		return fmt.Errorf("healthProbe: invalid port %d", probe.Port)
+	}
+	if probe.Path != "" && (probe.Type != model.ProbeHTTP || !strings.HasPrefix(probe.Path, "/")) {
+		return fmt.Errorf("healthProbe: path %q needs an http probe and a leading /", probe.Path)
+	}
+	if probe.IntervalSeconds < 0 || probe.TimeoutSeconds < 0 || probe.InitialDelaySeconds < 0 || probe.FailureThreshold < 0 {
+		return errors.New("healthProbe: intervals and threshold must not be negative")
+	}
+	return nil
+}
@@ -0,0 +1,84 @@
+package manager
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/alperreha/mergen-fire/internal/model"
+	"github.com/alperreha/mergen-fire/internal/systemd"
+)
+
+// StateHistory returns the VM's recorded state transitions, newest first.
+// A unit that failed since the last start is recorded as a crash first.
+func (s *Service) StateHistory(ctx context.Context, id string, limit int) ([]model.StateTransition, error) {
+	s.logger.DebugContext(ctx, "state history requested", "vmID", id, "limit", limit)
+	if strings.TrimSpace(id) == "" {
+		return nil, fmt.Errorf("%w: id is empty", ErrInvalidRequest)
+	}
+	exists, err := s.store.Exists(id)
+	if err != nil {
+		return nil, err
+	}
+	if !exists {
+		return nil, ErrNotFound
+	}
+
+	status, err := s.systemd.Status(ctx, id)
+	if err != nil && !errors.Is(err, systemd.ErrUnavailable) {
+		return nil, err
+	}
+	s.noteCrash(ctx, id, status)
+
+	history, err := s.store.ReadStateHistory(id)
+	if err != nil {
+		return nil, err
+	}
+	if limit > 0 && len(history) > limit {
+		history = history[len(history)-limit:]
+	}
+	slices.Reverse(history)
+	return history, nil
+}
+
+// recordTransition appends to the VM's state history. The history is for
+// postmortems, so failing to write it never fails the operation.
+func (s *Service) recordTransition(ctx context.Context, id, state, detail string) {
+	s.historyMu.Lock()
+	defer s.historyMu.Unlock()
+	s.appendTransition(ctx, id, state, detail)
+}
+
+func (s *Service) appendTransition(ctx context.Context, id, state, detail string) {
+	transition := model.StateTransition{State: state, At: time.Now().UTC(), Detail: detail}
+	if err := s.store.AppendStateTransition(id, transition); err != nil {
+		s.logger.WarnContext(ctx, "failed to record state transition", "vmID", id, "state", state, "error", err)
+	}
+}
+
+// noteCrash records a crash when systemd reports the unit failed while the
+// history still has the VM running, and raises a StoreEventReconciled for
+// it. Crashes are noticed by the reconciler or the next time the VM's
+// status is read.
+func (s *Service) noteCrash(ctx context.Context, id string, status systemd.Status) {
+	if status.ActiveState != "failed" {
+		return
+	}
+	s.historyMu.Lock()
+	defer s.historyMu.Unlock()
+	history, err := s.store.ReadStateHistory(id)
+	if err != nil || len(history) == 0 {
+		return
+	}
+	switch history[len(history)-1].State {
+	case model.TransitionStarted, model.TransitionRestored:
+	default:
+		return
+	}
+	s.logger.WarnContext(ctx, "vm unit failed, recording crash", "vmID", id, "subState", status.SubState)
+	s.appendTransition(ctx, id, model.TransitionCrashed, "unit "+status.SubState)
+	s.publish(model.StoreEvent{Type: model.StoreEventReconciled, ID: id, Reason: model.ReconcileCrashed, At: time.Now().UTC()})
+}
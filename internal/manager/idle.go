@@ -0,0 +1,195 @@
+package manager
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"time"
+
+	"github.com/alperreha/mergen-fire/internal/model"
+	"github.com/alperreha/mergen-fire/internal/systemd"
+)
+
+const (
+	defaultWakeTimeout = 20 * time.Second
+	maxWakeTimeout     = 5 * time.Minute
+	// wakePollInterval is how often WakeVM dials the guest until it answers.
+	wakePollInterval = 200 * time.Millisecond
+)
+
+// RecordActivity notes traffic the forwarder routed to the VMs of ids,
+// which postpones their idle stop. Unknown ids are kept too; they are
+// dropped with the VM or when mergend restarts.
+func (s *Service) RecordActivity(ctx context.Context, ids []string) {
+	s.logger.DebugContext(ctx, "vm activity reported", "count", len(ids))
+	now := time.Now()
+	for _, id := range ids {
+		s.noteActivity(id, now)
+	}
+}
+
+func (s *Service) noteActivity(id string, at time.Time) {
+	s.activityMu.Lock()
+	defer s.activityMu.Unlock()
+	if s.activity == nil {
+		s.activity = map[string]time.Time{}
+	}
+	if at.After(s.activity[id]) {
+		s.activity[id] = at
+	}
+}
+
+func (s *Service) lastActivity(id string) (time.Time, bool) {
+	s.activityMu.Lock()
+	defer s.activityMu.Unlock()
+	at, ok := s.activity[id]
+	return at, ok
+}
+
+func (s *Service) lastActivityAt(id string) *time.Time {
+	at, ok := s.lastActivity(id)
+	if !ok {
+		return nil
+	}
+	at = at.UTC()
+	return &at
+}
+
+// RunIdleStops stops the running VMs of this host that had no activity for
+// their idle timeout, checking each interval until ctx ends.
+func (s *Service) RunIdleStops(ctx context.Context, interval time.Duration) {
+	if interval <= 0 {
+		return
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		s.stopIdle(ctx)
+	}
+}
+
+// stopIdle stops the VMs whose idle timeout has passed. A VM running when
+// mergend starts, or before its first check, gets a full timeout from then.
+func (s *Service) stopIdle(ctx context.Context) {
+	if s.AutomationPaused() {
+		s.logger.DebugContext(ctx, "idle stops skipped while automation is paused by circuit breaker")
+		return
+	}
+	metas, err := s.store.ListMetas()
+	if err != nil {
+		s.logger.WarnContext(ctx, "idle stops: list vms failed", "error", err)
+		return
+	}
+	seen := make(map[string]bool, len(metas))
+	for _, meta := range metas {
+		if ctx.Err() != nil {
+			return
+		}
+		seen[meta.ID] = true
+		if meta.IdleTimeoutMinutes <= 0 || meta.Deletion != nil || meta.Unit != "" || meta.Host != "" && meta.Host != s.host.Name {
+			continue
+		}
+		active, err := s.systemd.IsActive(ctx, meta.ID)
+		if errors.Is(err, systemd.ErrUnavailable) {
+			s.logger.DebugContext(ctx, "idle stops skipped, systemd unavailable")
+			return
+		}
+		if err != nil || !active {
+			continue
+		}
+		timeout := time.Duration(meta.IdleTimeoutMinutes) * time.Minute
+		last, ok := s.lastActivity(meta.ID)
+		if !ok {
+			s.noteActivity(meta.ID, time.Now())
+			continue
+		}
+		if time.Since(last) >= timeout {
+			s.stopIdleVM(ctx, meta.ID, timeout)
+		}
+	}
+	s.activityMu.Lock()
+	for id := range s.activity {
+		if !seen[id] {
+			delete(s.activity, id)
+		}
+	}
+	s.activityMu.Unlock()
+}
+
+// stopIdleVM stops an idle VM under its lock, unless it was woken or saw
+// traffic meanwhile. A VM busy with another operation is left for the next
+// check.
+func (s *Service) stopIdleVM(ctx context.Context, id string, timeout time.Duration) {
+	release, err := s.lockVM(ctx, id, "idle stop")
+	if err != nil {
+		s.logger.DebugContext(ctx, "idle vm busy, stop left for the next check", "vmID", id, "error", err)
+		return
+	}
+	defer release()
+	if last, _ := s.lastActivity(id); time.Since(last) < timeout {
+		return
+	}
+	if err := s.stopAs(ctx, id, "idle for "+timeout.String()); err != nil {
+		s.logger.WarnContext(ctx, "idle vm: stop failed", "vmID", id, "error", err)
+		return
+	}
+	s.logger.InfoContext(ctx, "vm stopped after idle timeout", "vmID", id, "idleTimeout", timeout.String())
+}
+
+// WakeVM starts a VM with an idle timeout, as the forwarder does when a
+// connection arrives for it while it is stopped. With req.Port it returns
+// once the guest accepts connections on that port, or fails with
+// ErrUnavailable after req.TimeoutSeconds.
+func (s *Service) WakeVM(ctx context.Context, id string, req model.WakeVMRequest) error {
+	s.logger.DebugContext(ctx, "wake vm requested", "vmID", id, "port", req.Port)
+	if req.Port < 0 || req.Port > 65535 {
+		return fmt.Errorf("%w: invalid port %d", ErrInvalidRequest, req.Port)
+	}
+	timeout := defaultWakeTimeout
+	if req.TimeoutSeconds < 0 || time.Duration(req.TimeoutSeconds)*time.Second > maxWakeTimeout {
+		return fmt.Errorf("%w: timeoutSeconds must be between 0 and %d", ErrInvalidRequest, int(maxWakeTimeout.Seconds()))
+	}
+	if req.TimeoutSeconds > 0 {
+		timeout = time.Duration(req.TimeoutSeconds) * time.Second
+	}
+	meta, err := s.readMeta(id)
+	if err != nil {
+		return err
+	}
+	if meta.IdleTimeoutMinutes <= 0 {
+		return fmt.Errorf("%w: vm %s has no idleTimeoutMinutes; start it with POST /v1/vms/%s/start", ErrConflict, id, id)
+	}
+	s.noteActivity(id, time.Now())
+	if err := s.StartVM(ctx, id); err != nil {
+		return err
+	}
+	if req.Port == 0 || s.guestDialer == nil {
+		return nil
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	address := net.JoinHostPort(meta.GuestIP, strconv.Itoa(req.Port))
+	ticker := time.NewTicker(wakePollInterval)
+	defer ticker.Stop()
+	for {
+		conn, err := s.guestDialer.DialContext(ctx, "tcp", address, meta.NetNS)
+		if err == nil {
+			conn.Close()
+			s.logger.InfoContext(ctx, "vm woken", "vmID", id, "port", req.Port)
+			return nil
+		}
+		select {
+		case <-ctx.Done():
+			return fmt.Errorf("%w: vm %s started but port %d did not accept connections within %s: %v", ErrUnavailable, id, req.Port, timeout, err)
+		case <-ticker.C:
+		}
+	}
+}
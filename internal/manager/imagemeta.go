@@ -0,0 +1,99 @@
+package manager
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+
+	"github.com/alperreha/mergen-fire/internal/model"
+)
+
+// imageMetaFile and requiredEnvFile are what mergen-converter writes next
+// to rootfs.ext4.
+const (
+	imageMetaFile   = "image-meta.json"
+	requiredEnvFile = "required-env.json"
+)
+
+type imageMeta struct {
+	SuggestedHTTPPort int `json:"suggestedHTTPPort,omitempty"`
+}
+
+type requiredEnv struct {
+	Variables []struct {
+		Name     string   `json:"name"`
+		Required bool     `json:"required"`
+		Sources  []string `json:"sources"`
+	} `json:"variables"`
+}
+
+// applyImageDefaults fills HTTPPort from the converter's suggestion for a
+// rootfs that has image-meta.json beside it, and publishes that guest port
+// unless the request already binds it. An explicit httpPort wins.
+func (s *Service) applyImageDefaults(ctx context.Context, req *model.CreateVMRequest) {
+	if req.HTTPPort != 0 {
+		return
+	}
+	path := filepath.Join(filepath.Dir(req.RootFS), imageMetaFile)
+	content, err := os.ReadFile(path)
+	if err != nil {
+		if !errors.Is(err, os.ErrNotExist) {
+			s.logger.WarnContext(ctx, "image metadata unreadable, skipping defaults", "path", path, "error", err)
+		}
+		return
+	}
+	var meta imageMeta
+	if err := json.Unmarshal(content, &meta); err != nil {
+		s.logger.WarnContext(ctx, "image metadata invalid, skipping defaults", "path", path, "error", err)
+		return
+	}
+	if meta.SuggestedHTTPPort <= 0 || meta.SuggestedHTTPPort > 65535 {
+		return
+	}
+	req.HTTPPort = meta.SuggestedHTTPPort
+	bound := slices.ContainsFunc(req.Ports, func(p model.PortBindingRequest) bool { return p.Guest == req.HTTPPort })
+	if !bound {
+		req.Ports = append(slices.Clone(req.Ports), model.PortBindingRequest{Guest: req.HTTPPort})
+	}
+	s.logger.DebugContext(ctx, "http port taken from image metadata", "path", path, "httpPort", req.HTTPPort, "addedBinding", !bound)
+}
+
+// ImageEnvWarnings names the variables the converter found the rootfs's
+// image expects that req's guestEnv leaves unset. They are warnings, not
+// errors: the scan is a heuristic, and the guest may get them elsewhere.
+func (s *Service) ImageEnvWarnings(ctx context.Context, req model.CreateVMRequest) []string {
+	path := filepath.Join(filepath.Dir(req.RootFS), requiredEnvFile)
+	content, err := os.ReadFile(path)
+	if err != nil {
+		if !errors.Is(err, os.ErrNotExist) {
+			s.logger.WarnContext(ctx, "required env unreadable, skipping check", "path", path, "error", err)
+		}
+		return nil
+	}
+	var env requiredEnv
+	if err := json.Unmarshal(content, &env); err != nil {
+		s.logger.WarnContext(ctx, "required env invalid, skipping check", "path", path, "error", err)
+		return nil
+	}
+	var warnings []string
+	for _, v := range env.Variables {
+		if _, ok := req.GuestEnv[v.Name]; ok || v.Name == "" {
+			continue
+		}
+		need := "may need"
+		if v.Required {
+			need = "needs"
+		}
+		warning := fmt.Sprintf("guestEnv does not set %s, which the image %s", v.Name, need)
+		if len(v.Sources) > 0 {
+			warning += " (" + strings.Join(v.Sources, ", ") + ")"
+		}
+		warnings = append(warnings, warning)
+	}
+	return warnings
+}
@@ -0,0 +1,284 @@
+package manager
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/alperreha/mergen-fire/internal/model"
+	"github.com/alperreha/mergen-fire/internal/store"
+)
+
+const (
+	defaultJobQueueSize = 64
+	defaultJobRetention = 24 * time.Hour
+	// jobSweepInterval is how often RunJobs fails the jobs of processes that
+	// are gone and drops finished jobs past their retention.
+	jobSweepInterval = time.Minute
+)
+
+// JobFunc does the work of a job and returns the VM it acted on. It may
+// call ReportJobProgress with its ctx.
+type JobFunc func(ctx context.Context) (vmID string, err error)
+
+type queuedJob struct {
+	id   string
+	ctx  context.Context
+	run  JobFunc
+	code func(error) string
+}
+
+// jobQueue holds the jobs waiting for a worker of RunJobs. Records live in
+// the store; the queue itself does not survive a restart, so sweepJobs
+// fails what a previous process left unfinished.
+type jobQueue struct {
+	queue     chan queuedJob
+	retention time.Duration
+	// pending counts queued and running jobs for WaitJobs.
+	pending sync.WaitGroup
+	mu      sync.Mutex
+	stopped bool
+}
+
+func newJobQueue(size int, retention time.Duration) *jobQueue {
+	return &jobQueue{queue: make(chan queuedJob, size), retention: retention}
+}
+
+// WithJobs sizes the queue of asynchronous jobs and sets how long finished
+// jobs are kept; a zero retention keeps them.
+func (s *Service) WithJobs(queueSize int, retention time.Duration) *Service {
+	if queueSize > 0 {
+		s.jobs = newJobQueue(queueSize, retention)
+	}
+	return s
+}
+
+type jobProgressKey struct{}
+
+// ReportJobProgress records what the job running with ctx is doing, and
+// the VM it made once there is one. Outside a job it does nothing.
+func ReportJobProgress(ctx context.Context, stage, vmID string) {
+	if report, ok := ctx.Value(jobProgressKey{}).(func(string, string)); ok {
+		report(stage, vmID)
+	}
+}
+
+// StartJob records a job of kind and queues run for a worker of RunJobs.
+// run gets ctx's values but not its cancellation, as the job outlives the
+// request. code names the error a failed job ends with.
+func (s *Service) StartJob(ctx context.Context, kind, namespace string, code func(error) string, run JobFunc) (model.Job, error) {
+	id, err := newUUIDv4()
+	if err != nil {
+		return model.Job{}, err
+	}
+	job := model.Job{
+		ID:        id,
+		Kind:      kind,
+		Status:    model.JobQueued,
+		Namespace: namespace,
+		Host:      s.host.Name,
+		PID:       os.Getpid(),
+		CreatedAt: time.Now().UTC(),
+	}
+	s.jobs.mu.Lock()
+	defer s.jobs.mu.Unlock()
+	if s.jobs.stopped {
+		return model.Job{}, fmt.Errorf("%w: mergend is shutting down, jobs are not accepted", ErrUnavailable)
+	}
+	if err := s.store.SaveJob(job); err != nil {
+		return model.Job{}, err
+	}
+	s.jobs.pending.Add(1)
+	select {
+	case s.jobs.queue <- queuedJob{id: id, ctx: context.WithoutCancel(ctx), run: run, code: code}:
+	default:
+		s.jobs.pending.Done()
+		if err := s.store.DeleteJob(id); err != nil {
+			s.logger.WarnContext(ctx, "failed to drop refused job", "jobID", id, "error", err)
+		}
+		return model.Job{}, fmt.Errorf("%w: job queue is full (%d jobs)", ErrUnavailable, cap(s.jobs.queue))
+	}
+	s.logger.InfoContext(ctx, "job queued", "jobID", id, "kind", kind)
+	return job, nil
+}
+
+// RunJobs runs queued jobs on workers goroutines until ctx ends. Jobs
+// still queued then fail; running ones finish, see WaitJobs.
+func (s *Service) RunJobs(ctx context.Context, workers int) {
+	if workers <= 0 {
+		workers = 1
+	}
+	s.sweepJobs(ctx)
+	var running sync.WaitGroup
+	for range workers {
+		running.Add(1)
+		go func() {
+			defer running.Done()
+			for {
+				select {
+				case <-ctx.Done():
+					return
+				case queued := <-s.jobs.queue:
+					s.runJob(queued)
+				}
+			}
+		}()
+	}
+	ticker := time.NewTicker(jobSweepInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			running.Wait()
+			s.abandonJobs()
+			return
+		case <-ticker.C:
+			s.sweepJobs(ctx)
+		}
+	}
+}
+
+// WaitJobs waits for the queued and running jobs of this process.
+func (s *Service) WaitJobs(ctx context.Context) error {
+	done := make(chan struct{})
+	go func() {
+		s.jobs.pending.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (s *Service) GetJob(ctx context.Context, id string) (model.Job, error) {
+	s.logger.DebugContext(ctx, "get job requested", "jobID", id)
+	job, err := s.store.ReadJob(id)
+	if errors.Is(err, store.ErrJobNotFound) {
+		return model.Job{}, fmt.Errorf("%w: job %s", ErrNotFound, id)
+	}
+	return job, err
+}
+
+// ListJobs returns the jobs of namespace, or all with an empty one,
+// newest first.
+func (s *Service) ListJobs(ctx context.Context, namespace string) ([]model.Job, error) {
+	s.logger.DebugContext(ctx, "list jobs requested", "namespace", namespace)
+	jobs, err := s.store.ListJobs()
+	if err != nil || namespace == "" {
+		return jobs, err
+	}
+	matching := make([]model.Job, 0, len(jobs))
+	for _, job := range jobs {
+		if job.Namespace == namespace {
+			matching = append(matching, job)
+		}
+	}
+	return matching, nil
+}
+
+func (s *Service) runJob(queued queuedJob) {
+	defer s.jobs.pending.Done()
+	ctx := queued.ctx
+	job, err := s.store.ReadJob(queued.id)
+	if err != nil {
+		s.logger.ErrorContext(ctx, "job record unreadable, dropping job", "jobID", queued.id, "error", err)
+		return
+	}
+	started := time.Now().UTC()
+	job.Status, job.StartedAt = model.JobRunning, &started
+	s.saveJob(ctx, job)
+	ctx = context.WithValue(ctx, jobProgressKey{}, func(stage, vmID string) {
+		job.Stage = stage
+		if vmID != "" {
+			job.VMID = vmID
+		}
+		s.saveJob(ctx, job)
+	})
+
+	vmID, err := queued.run(ctx)
+	finished := time.Now().UTC()
+	job.FinishedAt, job.Stage = &finished, ""
+	if vmID != "" {
+		job.VMID = vmID
+	}
+	if err != nil {
+		job.Status, job.Error, job.Message = model.JobFailed, "internal_error", err.Error()
+		if queued.code != nil {
+			job.Error = queued.code(err)
+		}
+		s.logger.WarnContext(ctx, "job failed", "jobID", job.ID, "kind", job.Kind, "vmID", job.VMID, "error", err)
+	} else {
+		job.Status = model.JobSucceeded
+		s.logger.InfoContext(ctx, "job finished", "jobID", job.ID, "kind", job.Kind, "vmID", job.VMID, "duration", finished.Sub(started).String())
+	}
+	s.saveJob(ctx, job)
+}
+
+// abandonJobs stops accepting jobs and fails the ones no worker took.
+func (s *Service) abandonJobs() {
+	s.jobs.mu.Lock()
+	s.jobs.stopped = true
+	s.jobs.mu.Unlock()
+	for {
+		select {
+		case queued := <-s.jobs.queue:
+			s.failJob(queued.ctx, queued.id, "mergend stopped before the job started")
+			s.jobs.pending.Done()
+		default:
+			return
+		}
+	}
+}
+
+// sweepJobs fails the unfinished jobs of processes that no longer run and
+// deletes finished jobs older than the retention.
+func (s *Service) sweepJobs(ctx context.Context) {
+	jobs, err := s.store.ListJobs()
+	if err != nil {
+		s.logger.WarnContext(ctx, "job sweep: list jobs failed", "error", err)
+		return
+	}
+	now := time.Now()
+	for _, job := range jobs {
+		switch {
+		case job.FinishedAt == nil && job.PID != os.Getpid() && !processAlive(job.PID):
+			s.failJob(ctx, job.ID, "mergend stopped before the job finished")
+		case job.FinishedAt != nil && s.jobs.retention > 0 && now.Sub(*job.FinishedAt) > s.jobs.retention:
+			if err := s.store.DeleteJob(job.ID); err != nil && !errors.Is(err, store.ErrJobNotFound) {
+				s.logger.WarnContext(ctx, "job sweep: delete failed", "jobID", job.ID, "error", err)
+			}
+		}
+	}
+}
+
+func (s *Service) failJob(ctx context.Context, id, message string) {
+	job, err := s.store.ReadJob(id)
+	if err != nil {
+		s.logger.WarnContext(ctx, "failed to read interrupted job", "jobID", id, "error", err)
+		return
+	}
+	finished := time.Now().UTC()
+	job.Status, job.Error, job.Message, job.FinishedAt = model.JobFailed, "interrupted", message, &finished
+	s.logger.WarnContext(ctx, "job interrupted", "jobID", id, "kind", job.Kind, "reason", message)
+	s.saveJob(ctx, job)
+}
+
+// saveJob records job; a job whose record cannot be written still runs.
+func (s *Service) saveJob(ctx context.Context, job model.Job) {
+	if err := s.store.SaveJob(job); err != nil {
+		s.logger.WarnContext(ctx, "failed to record job", "jobID", job.ID, "status", job.Status, "error", err)
+	}
+}
+
+// processAlive reports whether pid runs; PIDs may be reused, so a job of a
+// process that is gone can look alive until that PID exits too.
+func processAlive(pid int) bool {
+	return pid > 0 && syscall.Kill(pid, 0) == nil
+}
@@ -0,0 +1,91 @@
+package manager
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/alperreha/mergen-fire/internal/kernels"
+	"github.com/alperreha/mergen-fire/internal/model"
+)
+
+// WithKernels lets create requests name a kernel from catalog instead of
+// giving its path.
+func (s *Service) WithKernels(catalog *kernels.Catalog) *Service {
+	s.kernels = catalog
+	return s
+}
+
+func (s *Service) ListKernels(ctx context.Context) ([]model.Kernel, error) {
+	if s.kernels == nil {
+		return []model.Kernel{}, nil
+	}
+	list, err := s.kernels.List()
+	return list, kernelError(err)
+}
+
+func (s *Service) GetKernel(ctx context.Context, name string) (model.Kernel, error) {
+	if s.kernels == nil {
+		return model.Kernel{}, fmt.Errorf("%w: kernel %s", ErrNotFound, name)
+	}
+	kernel, err := s.kernels.Get(name)
+	return kernel, kernelError(err)
+}
+
+func (s *Service) PutKernel(ctx context.Context, kernel model.Kernel) (model.Kernel, error) {
+	if s.kernels == nil {
+		return model.Kernel{}, fmt.Errorf("%w: kernel catalog is not configured", ErrConflict)
+	}
+	kernel, err := s.kernels.Put(kernel)
+	return kernel, kernelError(err)
+}
+
+// DeleteKernel removes a catalog entry. VMs created from it keep the path
+// they were resolved to.
+func (s *Service) DeleteKernel(ctx context.Context, name string) error {
+	if s.kernels == nil {
+		return fmt.Errorf("%w: kernel %s", ErrNotFound, name)
+	}
+	return kernelError(s.kernels.Delete(name))
+}
+
+// resolveKernel replaces a kernel name in req with the catalog entry's path
+// and boot args, and returns the name it resolved. Paths are left as given.
+func (s *Service) resolveKernel(req *model.CreateVMRequest) (string, error) {
+	if !kernels.IsName(req.Kernel) {
+		return "", nil
+	}
+	if s.kernels == nil {
+		return "", fmt.Errorf("%w: kernel %q is not a path and no kernel catalog is configured", ErrInvalidRequest, req.Kernel)
+	}
+	kernel, err := s.kernels.Get(req.Kernel)
+	if errors.Is(err, kernels.ErrNotFound) {
+		return "", fmt.Errorf("%w: unknown kernel %q", ErrInvalidRequest, req.Kernel)
+	}
+	if err != nil {
+		return "", err
+	}
+	if host := kernels.HostArch(); kernel.Arch != host {
+		return "", fmt.Errorf("%w: kernel %q is built for %s, this host is %s", ErrConflict, kernel.Name, kernel.Arch, host)
+	}
+	req.Kernel = kernel.Path
+	if req.BootArgs == "" {
+		req.BootArgs = kernel.BootArgs
+	}
+	if req.Initrd == "" {
+		req.Initrd = kernel.Initrd
+	}
+	return kernel.Name, nil
+}
+
+func kernelError(err error) error {
+	switch {
+	case err == nil:
+		return nil
+	case errors.Is(err, kernels.ErrNotFound):
+		return fmt.Errorf("%w: %v", ErrNotFound, err)
+	case errors.Is(err, kernels.ErrInvalid):
+		return fmt.Errorf("%w: %v", ErrInvalidRequest, err)
+	}
+	return err
+}
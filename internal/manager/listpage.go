@@ -0,0 +1,94 @@
+package manager
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/alperreha/mergen-fire/internal/model"
+)
+
+// maxListLimit bounds one page of GET /v1/vms.
+const maxListLimit = 1000
+
+// listCursor is the position after the last VM of a page, encoded as
+// base64url JSON so clients treat it as opaque.
+type listCursor struct {
+	Sort      string    `json:"s"`
+	ID        string    `json:"id"`
+	CreatedAt time.Time `json:"c,omitempty"`
+}
+
+func encodeListCursor(sort string, meta model.VMMetadata) string {
+	cursor := listCursor{Sort: sort, ID: meta.ID}
+	if sort == model.VMSortCreatedAt {
+		cursor.CreatedAt = meta.CreatedAt
+	}
+	raw, _ := json.Marshal(cursor)
+	return base64.RawURLEncoding.EncodeToString(raw)
+}
+
+func decodeListCursor(value, sort string) (model.VMMetadata, error) {
+	raw, err := base64.RawURLEncoding.DecodeString(value)
+	var cursor listCursor
+	if err == nil {
+		err = json.Unmarshal(raw, &cursor)
+	}
+	if err != nil || cursor.ID == "" {
+		return model.VMMetadata{}, fmt.Errorf("%w: invalid cursor", ErrInvalidRequest)
+	}
+	if cursor.Sort != sort {
+		return model.VMMetadata{}, fmt.Errorf("%w: cursor is for sort %q, not %q", ErrInvalidRequest, cursor.Sort, sort)
+	}
+	return model.VMMetadata{ID: cursor.ID, CreatedAt: cursor.CreatedAt}, nil
+}
+
+func normalizeListPage(page model.VMListPage) (model.VMListPage, error) {
+	switch page.Sort {
+	case "":
+		page.Sort = model.VMSortCreatedAt
+	case model.VMSortCreatedAt, model.VMSortID:
+	default:
+		return page, fmt.Errorf("%w: sort must be %s or %s", ErrInvalidRequest, model.VMSortCreatedAt, model.VMSortID)
+	}
+	if page.Limit < 0 || page.Limit > maxListLimit {
+		return page, fmt.Errorf("%w: limit must be between 0 and %d", ErrInvalidRequest, maxListLimit)
+	}
+	return page, nil
+}
+
+// compareMetas orders VMs for sort; ids break ties between VMs created at
+// the same time, so every VM has one place in the list.
+func compareMetas(sort string) func(a, b model.VMMetadata) int {
+	if sort == model.VMSortID {
+		return func(a, b model.VMMetadata) int { return strings.Compare(a.ID, b.ID) }
+	}
+	return func(a, b model.VMMetadata) int {
+		if c := b.CreatedAt.Compare(a.CreatedAt); c != 0 {
+			return c
+		}
+		return strings.Compare(a.ID, b.ID)
+	}
+}
+
+// pageStart sorts metas and returns the index of the first one after the
+// cursor. A VM deleted since the page before does not shift the position.
+func pageStart(metas []model.VMMetadata, page model.VMListPage) (int, error) {
+	compare := compareMetas(page.Sort)
+	slices.SortFunc(metas, compare)
+	if page.Cursor == "" {
+		return 0, nil
+	}
+	after, err := decodeListCursor(page.Cursor, page.Sort)
+	if err != nil {
+		return 0, err
+	}
+	start, _ := slices.BinarySearchFunc(metas, after, compare)
+	if start < len(metas) && metas[start].ID == after.ID {
+		start++
+	}
+	return start, nil
+}
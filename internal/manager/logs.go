@@ -0,0 +1,169 @@
+package manager
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/alperreha/mergen-fire/internal/firecracker"
+	"github.com/alperreha/mergen-fire/internal/model"
+)
+
+const (
+	logPollInterval = 200 * time.Millisecond
+	tailChunk       = 32 << 10
+)
+
+// VMLogs opens a file of the VM's logs dir, serial.log unless req names
+// another, from its last req.Tail lines (all of it when 0). With
+// req.Follow reading waits for more until ctx ends.
+func (s *Service) VMLogs(ctx context.Context, id string, req model.VMLogsRequest) (io.ReadCloser, error) {
+	s.logger.DebugContext(ctx, "vm logs requested", "vmID", id, "file", req.File, "tail", req.Tail, "follow", req.Follow)
+	if req.Tail < 0 {
+		return nil, fmt.Errorf("%w: tail must be >= 0", ErrInvalidRequest)
+	}
+	name := req.File
+	if name == "" {
+		name = firecracker.SerialLogName
+	}
+	if name != filepath.Base(name) || strings.HasPrefix(name, ".") {
+		return nil, fmt.Errorf("%w: file must be a file name in the vm's logs dir", ErrInvalidRequest)
+	}
+	if strings.HasSuffix(name, ".gz") {
+		return nil, fmt.Errorf("%w: %s is compressed, download it from the host instead", ErrInvalidRequest, name)
+	}
+	meta, err := s.readMeta(id)
+	if err != nil {
+		return nil, err
+	}
+	if meta.Paths.LogsDir == "" {
+		return nil, fmt.Errorf("%w: vm %s has no logs dir", ErrConflict, id)
+	}
+
+	follower := &logFollower{ctx: ctx, path: filepath.Join(meta.Paths.LogsDir, name), follow: req.Follow}
+	if err := follower.open(); err != nil {
+		return nil, err
+	}
+	if follower.file == nil && !req.Follow {
+		return nil, fmt.Errorf("%w: vm %s has no log %s", ErrNotFound, id, name)
+	}
+	if follower.file != nil && req.Tail > 0 {
+		if follower.offset, err = tailOffset(follower.file, req.Tail); err != nil {
+			follower.Close()
+			return nil, err
+		}
+	}
+	return follower, nil
+}
+
+// logFollower reads a log file another process writes, waiting for it to
+// appear and, with follow, to grow. Rotation truncates logs in place, so a
+// file shorter than what was read starts over from its beginning.
+type logFollower struct {
+	ctx    context.Context
+	path   string
+	follow bool
+
+	file   *os.File
+	offset int64
+}
+
+// open opens the file once it exists.
+func (f *logFollower) open() error {
+	if f.file != nil {
+		return nil
+	}
+	file, err := os.Open(f.path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	f.file = file
+	return nil
+}
+
+// Read returns io.EOF at the end of the file without follow, and once the
+// context ends with it.
+func (f *logFollower) Read(p []byte) (int, error) {
+	timer := time.NewTimer(0)
+	defer timer.Stop()
+	for {
+		select {
+		case <-f.ctx.Done():
+			return 0, io.EOF
+		case <-timer.C:
+		}
+		if err := f.open(); err != nil {
+			return 0, err
+		}
+		if f.file != nil {
+			if stat, err := f.file.Stat(); err == nil && stat.Size() < f.offset {
+				f.offset = 0
+			}
+			n, err := f.file.ReadAt(p, f.offset)
+			f.offset += int64(n)
+			if n > 0 {
+				return n, nil
+			}
+			if err != nil && !errors.Is(err, io.EOF) {
+				return 0, err
+			}
+		}
+		if !f.follow {
+			return 0, io.EOF
+		}
+		timer.Reset(logPollInterval)
+	}
+}
+
+func (f *logFollower) Close() error {
+	if f.file == nil {
+		return nil
+	}
+	return f.file.Close()
+}
+
+// tailOffset returns where the last lines lines of file start, reading it
+// backwards. A final line without a newline counts as a line.
+func tailOffset(file *os.File, lines int) (int64, error) {
+	stat, err := file.Stat()
+	if err != nil {
+		return 0, err
+	}
+	end := stat.Size()
+	buf := make([]byte, tailChunk)
+	// The newline ending the last line does not start a line of its own.
+	if end > 0 {
+		if _, err := file.ReadAt(buf[:1], end-1); err != nil {
+			return 0, err
+		}
+		if buf[0] == '\n' {
+			end--
+		}
+	}
+	for pos := end; pos > 0; {
+		size := min(int64(tailChunk), pos)
+		pos -= size
+		chunk := buf[:size]
+		if _, err := file.ReadAt(chunk, pos); err != nil && !errors.Is(err, io.EOF) {
+			return 0, err
+		}
+		for i := len(chunk) - 1; i >= 0; i-- {
+			if chunk[i] != '\n' {
+				continue
+			}
+			lines--
+			if lines == 0 {
+				return pos + int64(i) + 1, nil
+			}
+		}
+	}
+	return 0, nil
+}
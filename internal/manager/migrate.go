@@ -0,0 +1,438 @@
+package manager
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/alperreha/mergen-fire/internal/artifact"
+	"github.com/alperreha/mergen-fire/internal/firecracker"
+	"github.com/alperreha/mergen-fire/internal/migration"
+	"github.com/alperreha/mergen-fire/internal/model"
+	"github.com/alperreha/mergen-fire/internal/network"
+	"github.com/alperreha/mergen-fire/internal/scheduler"
+	"github.com/alperreha/mergen-fire/internal/systemd"
+	"github.com/alperreha/mergen-fire/internal/tracing"
+)
+
+// Snapshotter pauses a running microVM and writes the snapshot it is resumed
+// from on the migration target.
+type Snapshotter interface {
+	Pause(ctx context.Context, socketPath string) error
+	Resume(ctx context.Context, socketPath string) error
+	CreateSnapshot(ctx context.Context, socketPath string, files firecracker.SnapshotFiles) error
+}
+
+// migrationStore is implemented by the stores a VM can be migrated out of.
+type migrationStore interface {
+	ReadEnv(id string) (map[string]string, error)
+	ReleaseVM(id string) error
+}
+
+// Streams can take minutes for large disks; the migration timeout bounds
+// them instead.
+var migrationClient = &http.Client{}
+
+// WithSnapshotter enables live migration of running VMs. Without it only
+// stopped VMs can be migrated.
+func (s *Service) WithSnapshotter(snapshotter Snapshotter) *Service {
+	s.snapshotter = snapshotter
+	return s
+}
+
+// WithMigrationTimeout bounds a whole migration, transfer included.
+func (s *Service) WithMigrationTimeout(d time.Duration) *Service {
+	s.migrationTimeout = d
+	return s
+}
+
+// MigrateVM moves a VM to another registered host. A running VM is paused,
+// snapshotted and stopped here, streamed with its disks and resumed from the
+// snapshot on the target; a stopped VM is moved as is. The VM is removed from
+// this host only after the target took it over; if the transfer fails a
+// running VM is resumed here from its snapshot.
+func (s *Service) MigrateVM(ctx context.Context, id string, req model.MigrateVMRequest) (_ model.MigrationResult, err error) {
+	ctx, span := tracing.Start(ctx, "manager.MigrateVM", "vmID", id, "host", req.Host)
+	defer func() { span.RecordError(err); span.End() }()
+	started := time.Now()
+	s.logger.DebugContext(ctx, "migrate vm requested", "vmID", id, "host", req.Host)
+
+	target := strings.TrimSpace(req.Host)
+	if strings.TrimSpace(id) == "" {
+		return model.MigrationResult{}, fmt.Errorf("%w: id is empty", ErrInvalidRequest)
+	}
+	if target == "" {
+		return model.MigrationResult{}, fmt.Errorf("%w: host is required", ErrInvalidRequest)
+	}
+	if target == s.host.Name {
+		return model.MigrationResult{}, fmt.Errorf("%w: vm is already on host %s", ErrInvalidRequest, target)
+	}
+	migrator, ok := s.store.(migrationStore)
+	lister, registry := s.store.(HostLister)
+	if !ok || !registry {
+		return model.MigrationResult{}, fmt.Errorf("%w: migration needs a store with a host registry (etcd)", ErrConflict)
+	}
+	exists, err := s.store.Exists(id)
+	if err != nil {
+		return model.MigrationResult{}, err
+	}
+	if !exists {
+		return model.MigrationResult{}, ErrNotFound
+	}
+	hosts, err := lister.ListHosts()
+	if err != nil {
+		return model.MigrationResult{}, fmt.Errorf("%w: list hosts: %v", ErrUnavailable, err)
+	}
+	idx := slices.IndexFunc(hosts, func(h model.HostInfo) bool { return h.Name == target })
+	if idx < 0 {
+		return model.MigrationResult{}, fmt.Errorf("%w: unknown host %q", ErrInvalidRequest, target)
+	}
+	host := hosts[idx]
+	if host.URL == "" {
+		return model.MigrationResult{}, fmt.Errorf("%w: host %s advertises no API URL", ErrConflict, host.Name)
+	}
+
+	if s.migrationTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, s.migrationTimeout)
+		defer cancel()
+	}
+	release, err := s.lockVM(ctx, id, "migrate")
+	if err != nil {
+		return model.MigrationResult{}, err
+	}
+	defer release()
+
+	meta, err := s.store.ReadMeta(id)
+	if err != nil {
+		return model.MigrationResult{}, err
+	}
+	if meta.Host != "" && meta.Host != s.host.Name {
+		return model.MigrationResult{}, fmt.Errorf("%w: vm runs on host %s, migrate it from there", ErrConflict, meta.Host)
+	}
+	if meta.Unit != "" {
+		return model.MigrationResult{}, fmt.Errorf("%w: adopted vm runs under its own unit %s and cannot be migrated", ErrConflict, meta.Unit)
+	}
+	if meta.Placement != nil {
+		metas, err := s.store.ListMetas()
+		if err != nil {
+			return model.MigrationResult{}, err
+		}
+		if err := scheduler.Fits(host, withoutVM(metas, id), *meta.Placement); err != nil {
+			return model.MigrationResult{}, fmt.Errorf("%w: %v", ErrConflict, err)
+		}
+	}
+	cfg, err := s.store.ReadVMConfig(id)
+	if err != nil {
+		return model.MigrationResult{}, err
+	}
+	vmHooks, err := s.store.ReadHooks(id)
+	if err != nil {
+		return model.MigrationResult{}, err
+	}
+	env, err := migrator.ReadEnv(id)
+	if err != nil {
+		return model.MigrationResult{}, err
+	}
+	active, err := s.systemd.IsActive(ctx, id)
+	if err != nil {
+		return model.MigrationResult{}, fmt.Errorf("%w: %v", ErrUnavailable, err)
+	}
+	if active && s.snapshotter == nil {
+		return model.MigrationResult{}, fmt.Errorf("%w: vm is running and live migration is not available, stop it first", ErrConflict)
+	}
+	if active && hypervisorOf(meta) != model.HypervisorFirecracker {
+		return model.MigrationResult{}, fmt.Errorf("%w: live migration needs firecracker, stop the %s vm first", ErrConflict, meta.Hypervisor)
+	}
+
+	manifest := migration.Manifest{
+		Source:    s.host.Name,
+		CreatedAt: started.UTC(),
+		Meta:      meta,
+		Config:    cfg,
+		Hooks:     vmHooks,
+		Env:       env,
+		Snapshot:  active,
+	}
+	for name, path := range artifact.Paths(meta) {
+		file, err := migration.Stat(name, path)
+		if err != nil {
+			return model.MigrationResult{}, fmt.Errorf("%w: %s: %v", ErrConflict, name, err)
+		}
+		manifest.Files = append(manifest.Files, file)
+	}
+	slices.SortFunc(manifest.Files, func(a, b migration.File) int { return strings.Compare(a.Name, b.Name) })
+
+	paths := s.store.PathsFor(id)
+	snapshotDir := firecracker.SnapshotDir(paths.DataDir)
+	var paused time.Time
+	if active {
+		paused = time.Now()
+		if err := s.snapshotVM(ctx, id, paths.SocketPath, snapshotDir); err != nil {
+			return model.MigrationResult{}, err
+		}
+		files := firecracker.SnapshotFilesIn(snapshotDir)
+		for name, path := range map[string]string{migration.FileSnapshotState: files.StatePath, migration.FileSnapshotMem: files.MemPath} {
+			file, err := migration.Stat(name, path)
+			if err != nil {
+				s.recoverMigration(ctx, id, active)
+				return model.MigrationResult{}, fmt.Errorf("snapshot %s: %w", name, err)
+			}
+			manifest.Files = append(manifest.Files, file)
+		}
+	}
+
+	s.logger.InfoContext(ctx, "streaming vm to target host", "vmID", id, "host", host.Name, "live", active, "files", len(manifest.Files))
+	sendCtx, sendSpan := tracing.StartKind(ctx, tracing.KindClient, "migration.Send", "vmID", id, "host", host.Name)
+	summary, sent, err := migration.Send(sendCtx, migrationClient, host.URL, manifest)
+	sendSpan.RecordError(err)
+	sendSpan.End()
+	if err != nil {
+		s.logger.WarnContext(ctx, "migration failed, keeping vm on this host", "vmID", id, "host", host.Name, "bytes", sent, "error", err)
+		s.recoverMigration(ctx, id, active)
+		var remote *migration.RemoteError
+		if errors.As(err, &remote) && remote.StatusCode < http.StatusInternalServerError {
+			return model.MigrationResult{}, fmt.Errorf("%w: host %s refused vm: %s", ErrConflict, host.Name, remote.Message)
+		}
+		return model.MigrationResult{}, fmt.Errorf("%w: migrate to %s: %v", ErrUnavailable, host.Name, err)
+	}
+
+	if err := migrator.ReleaseVM(id); err != nil {
+		s.logger.WarnContext(ctx, "failed to remove migrated vm files", "vmID", id, "error", err)
+	}
+	result := model.MigrationResult{
+		ID:         id,
+		From:       s.host.Name,
+		To:         host.Name,
+		Live:       active,
+		Bytes:      sent,
+		DurationMs: time.Since(started).Milliseconds(),
+		VM:         summary,
+	}
+	if active {
+		result.DowntimeMs = time.Since(paused).Milliseconds()
+	}
+	s.logger.InfoContext(ctx, "vm migrated", "vmID", id, "host", host.Name, "live", active, "bytes", sent, "durationMs", result.DurationMs, "downtimeMs", result.DowntimeMs)
+	return result, nil
+}
+
+// snapshotVM pauses the VM, snapshots it into dir and stops its unit. The VM
+// is resumed if the snapshot fails.
+func (s *Service) snapshotVM(ctx context.Context, id, socketPath, dir string) error {
+	if err := os.RemoveAll(dir); err != nil {
+		return err
+	}
+	if err := os.MkdirAll(dir, 0o750); err != nil {
+		return err
+	}
+	if err := s.snapshotter.Pause(ctx, socketPath); err != nil {
+		return fmt.Errorf("%w: %v", ErrUnavailable, err)
+	}
+	if err := s.snapshotter.CreateSnapshot(ctx, socketPath, firecracker.SnapshotFilesIn(dir)); err != nil {
+		if resumeErr := s.snapshotter.Resume(ctx, socketPath); resumeErr != nil {
+			s.logger.ErrorContext(ctx, "failed to resume vm after snapshot failure", "vmID", id, "error", resumeErr)
+		}
+		_ = os.RemoveAll(dir)
+		return fmt.Errorf("%w: %v", ErrUnavailable, err)
+	}
+	if err := s.systemd.Stop(ctx, id); err != nil {
+		_ = os.RemoveAll(dir)
+		if resumeErr := s.snapshotter.Resume(ctx, socketPath); resumeErr != nil {
+			s.logger.ErrorContext(ctx, "failed to resume vm after stop failure", "vmID", id, "error", resumeErr)
+		}
+		if errors.Is(err, systemd.ErrUnavailable) || errors.Is(err, systemd.ErrUnitNotFound) {
+			return fmt.Errorf("%w: %v", ErrUnavailable, err)
+		}
+		return err
+	}
+	s.logger.DebugContext(ctx, "vm snapshotted for migration", "vmID", id, "dir", dir)
+	return nil
+}
+
+// recoverMigration puts a VM whose migration failed back on this host: the
+// inventory points here again and a VM that was running is resumed from its
+// snapshot by the unit.
+func (s *Service) recoverMigration(ctx context.Context, id string, wasActive bool) {
+	// The caller's context may be the one that expired.
+	ctx = context.WithoutCancel(ctx)
+	if meta, err := s.store.ReadMeta(id); err == nil && meta.Host != s.host.Name {
+		if _, err := s.store.UpdateMeta(id, meta.Revision, func(meta *model.VMMetadata) error {
+			meta.Host = s.host.Name
+			return nil
+		}); err != nil {
+			s.logger.ErrorContext(ctx, "failed to reclaim vm after migration failure", "vmID", id, "error", err)
+		}
+	}
+	if !wasActive {
+		return
+	}
+	if err := s.systemd.Start(ctx, id); err != nil {
+		s.logger.ErrorContext(ctx, "failed to resume vm after migration failure, its snapshot is kept", "vmID", id, "error", err)
+		return
+	}
+	s.logger.InfoContext(ctx, "vm resumed on this host after migration failure", "vmID", id)
+}
+
+// ReceiveVM takes over a VM streamed by MigrateVM on another host. The
+// source holds the VM's lock for the whole migration. The VM is started
+// again, from its snapshot, if it was running on the source.
+func (s *Service) ReceiveVM(ctx context.Context, stream io.Reader) (_ model.VMSummary, err error) {
+	ctx, span := tracing.Start(ctx, "manager.ReceiveVM")
+	defer func() { span.RecordError(err); span.End() }()
+
+	// The VM's capacity is claimed when its manifest is accepted and held
+	// while its files stream in, until it is saved.
+	releaseCapacity := func() {}
+	defer func() { releaseCapacity() }()
+	manifest, err := migration.Receive(stream, func(m migration.Manifest) (map[string]string, error) {
+		dests, err := s.acceptMigration(ctx, m)
+		if err != nil {
+			return nil, err
+		}
+		usage := model.CapacityUsage{VCPUs: m.Config.MachineConfig.VCPUCount, MemMiB: m.Config.MachineConfig.MemSizeMiB}
+		if releaseCapacity, err = s.admitCapacity(ctx, m.Meta.ID, m.Meta.ID, usage); err != nil {
+			releaseCapacity = func() {}
+			return nil, err
+		}
+		return dests, nil
+	})
+	switch {
+	case errors.Is(err, migration.ErrInvalid):
+		return model.VMSummary{}, fmt.Errorf("%w: %v", ErrInvalidRequest, err)
+	case errors.Is(err, migration.ErrExists):
+		return model.VMSummary{}, fmt.Errorf("%w: %v", ErrConflict, err)
+	case err != nil:
+		return model.VMSummary{}, err
+	}
+
+	meta := manifest.Meta
+	id := meta.ID
+	span.SetAttributes("vmID", id, "source", manifest.Source)
+	paths := s.store.PathsFor(id)
+	meta.Host = s.host.Name
+	meta.Paths = paths
+	meta.Revision++
+	env := manifest.Env
+	if env == nil {
+		env = map[string]string{}
+	}
+	for key, value := range s.baseEnv(meta, paths, nil) {
+		env[key] = value
+	}
+	if _, err := s.store.SaveVM(id, manifest.Config, meta, manifest.Hooks, env); err != nil {
+		return model.VMSummary{}, err
+	}
+	if s.verifyArtifacts {
+		if _, err := s.recordArtifacts(id, artifact.WritableFor(meta)...); err != nil {
+			s.logger.WarnContext(ctx, "failed to re-record artifact checksums", "vmID", id, "error", err)
+		}
+	}
+	s.logger.InfoContext(ctx, "vm received from host", "vmID", id, "source", manifest.Source, "live", manifest.Snapshot)
+
+	if manifest.Snapshot {
+		if err := s.StartVM(ctx, id); err != nil {
+			s.logger.WarnContext(ctx, "failed to resume migrated vm, handing it back", "vmID", id, "error", err)
+			if migrator, ok := s.store.(migrationStore); ok {
+				if releaseErr := migrator.ReleaseVM(id); releaseErr != nil {
+					s.logger.ErrorContext(ctx, "failed to drop migrated vm", "vmID", id, "error", releaseErr)
+				}
+			}
+			return model.VMSummary{}, err
+		}
+	}
+	return s.GetVM(ctx, id)
+}
+
+// acceptMigration checks that this host can take the VM in m and returns
+// where its files go: disks and kernel keep their paths, the snapshot goes
+// to the VM's data dir, where the unit resumes from it.
+func (s *Service) acceptMigration(ctx context.Context, m migration.Manifest) (map[string]string, error) {
+	id := m.Meta.ID
+	if m.Source == "" || m.Source == s.host.Name {
+		return nil, fmt.Errorf("%w: migration source must be another host", ErrInvalidRequest)
+	}
+	exists, err := s.store.Exists(id)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidRequest, err)
+	}
+	paths := s.store.PathsFor(id)
+	if exists {
+		// A shared inventory already lists the VM; it must still belong
+		// to the host sending it and have no files here.
+		current, err := s.store.ReadMeta(id)
+		if err != nil {
+			return nil, err
+		}
+		if current.Host != m.Source {
+			return nil, fmt.Errorf("%w: vm %s belongs to host %q, not %q", ErrConflict, id, current.Host, m.Source)
+		}
+	}
+	if _, err := os.Stat(paths.ConfigDir); err == nil {
+		return nil, fmt.Errorf("%w: vm %s already exists on this host", ErrConflict, id)
+	}
+
+	metas, err := s.store.ListMetas()
+	if err != nil {
+		return nil, err
+	}
+	others := withoutVM(metas, id)
+	if m.Meta.Placement != nil {
+		if err := scheduler.Fits(s.host, others, *m.Meta.Placement); err != nil {
+			return nil, fmt.Errorf("%w: %v", ErrConflict, err)
+		}
+	}
+	if err := networkConflict(others, m.Meta); err != nil {
+		return nil, err
+	}
+
+	expected := artifact.Paths(m.Meta)
+	snapshot := firecracker.SnapshotFilesIn(firecracker.SnapshotDir(paths.DataDir))
+	dests := map[string]string{}
+	for _, file := range m.Files {
+		switch file.Name {
+		case migration.FileSnapshotState:
+			dests[file.Name] = snapshot.StatePath
+		case migration.FileSnapshotMem:
+			dests[file.Name] = snapshot.MemPath
+		default:
+			if expected[file.Name] == "" || expected[file.Name] != file.Path {
+				return nil, fmt.Errorf("%w: unexpected file %s at %s", ErrInvalidRequest, file.Name, file.Path)
+			}
+			dests[file.Name] = file.Path
+		}
+	}
+	s.logger.DebugContext(ctx, "accepting migrated vm", "vmID", id, "source", m.Source, "files", len(m.Files))
+	return dests, nil
+}
+
+// networkConflict reports whether the guest IP or a host port of meta is
+// already used by another VM here. Both are kept on migration: the guest's
+// network config lives in its memory snapshot.
+func networkConflict(metas []model.VMMetadata, meta model.VMMetadata) error {
+	for _, other := range metas {
+		if other.GuestIP == meta.GuestIP {
+			return fmt.Errorf("%w: guest ip %s is used by vm %s", ErrConflict, meta.GuestIP, other.ID)
+		}
+		if network.MACOf(other) == network.MACOf(meta) {
+			return fmt.Errorf("%w: guest mac %s is used by vm %s", ErrConflict, network.MACOf(meta), other.ID)
+		}
+		for _, port := range meta.Ports {
+			for _, taken := range other.Ports {
+				if port.Host == taken.Host && port.Protocol == taken.Protocol {
+					return fmt.Errorf("%w: host port %d/%s is used by vm %s", ErrConflict, port.Host, port.Protocol, other.ID)
+				}
+			}
+		}
+	}
+	return nil
+}
+
+func withoutVM(metas []model.VMMetadata, id string) []model.VMMetadata {
+	return slices.DeleteFunc(slices.Clone(metas), func(meta model.VMMetadata) bool { return meta.ID == id })
+}
@@ -0,0 +1,223 @@
+package manager
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"slices"
+	"sort"
+	"time"
+
+	"github.com/alperreha/mergen-fire/internal/model"
+	"github.com/alperreha/mergen-fire/internal/store"
+)
+
+// ListNamespaces returns the registered namespaces, and DefaultNamespace
+// also when it is not registered, each with what its VMs on this host use.
+func (s *Service) ListNamespaces(ctx context.Context) ([]model.Namespace, error) {
+	s.logger.DebugContext(ctx, "list namespaces requested")
+	namespaces, err := s.store.ListNamespaces()
+	if err != nil {
+		return nil, err
+	}
+	if !slices.ContainsFunc(namespaces, func(ns model.Namespace) bool { return ns.Name == model.DefaultNamespace }) {
+		namespaces = append(namespaces, model.Namespace{Name: model.DefaultNamespace})
+		sort.Slice(namespaces, func(i, j int) bool { return namespaces[i].Name < namespaces[j].Name })
+	}
+	metas, err := s.store.ListMetas()
+	if err != nil {
+		return nil, err
+	}
+	for i := range namespaces {
+		usage := s.namespaceUsage(metas, namespaces[i].Name)
+		namespaces[i].Usage = &usage
+	}
+	return namespaces, nil
+}
+
+func (s *Service) GetNamespace(ctx context.Context, name string) (model.Namespace, error) {
+	s.logger.DebugContext(ctx, "get namespace requested", "namespace", name)
+	namespace, _, err := s.readNamespace(name)
+	if err != nil {
+		return model.Namespace{}, err
+	}
+	metas, err := s.store.ListMetas()
+	if err != nil {
+		return model.Namespace{}, err
+	}
+	usage := s.namespaceUsage(metas, name)
+	namespace.Usage = &usage
+	return namespace, nil
+}
+
+// PutNamespace registers namespace.Name or replaces its description and
+// quota. A quota below what the namespace already uses only refuses new
+// VMs and resizes.
+func (s *Service) PutNamespace(ctx context.Context, namespace model.Namespace) (model.Namespace, error) {
+	s.logger.DebugContext(ctx, "put namespace requested", "namespace", namespace.Name)
+	if !templateNamePattern.MatchString(namespace.Name) {
+		return model.Namespace{}, fmt.Errorf("%w: namespace name must be a lowercase DNS label", ErrInvalidRequest)
+	}
+	quota := namespace.Quota
+	if quota.MaxVMs < 0 || quota.MemMiB < 0 || quota.Ports < 0 {
+		return model.Namespace{}, fmt.Errorf("%w: quota limits must not be negative", ErrInvalidRequest)
+	}
+	s.namespaceMu.Lock()
+	now := time.Now().UTC()
+	namespace.CreatedAt, namespace.UpdatedAt, namespace.Usage = now, now, nil
+	existing, err := s.store.ReadNamespace(namespace.Name)
+	switch {
+	case err == nil:
+		namespace.CreatedAt = existing.CreatedAt
+	case !errors.Is(err, store.ErrNamespaceNotFound):
+		s.namespaceMu.Unlock()
+		return model.Namespace{}, err
+	}
+	err = s.store.SaveNamespace(namespace)
+	s.namespaceMu.Unlock()
+	if err != nil {
+		return model.Namespace{}, err
+	}
+	s.logger.InfoContext(ctx, "namespace saved", "namespace", namespace.Name, "maxVMs", quota.MaxVMs, "memMiB", quota.MemMiB, "ports", quota.Ports)
+	return s.GetNamespace(ctx, namespace.Name)
+}
+
+// DeleteNamespace removes a namespace without VMs on this host. Deleting
+// DefaultNamespace only drops its quota.
+func (s *Service) DeleteNamespace(ctx context.Context, name string) error {
+	s.logger.DebugContext(ctx, "delete namespace requested", "namespace", name)
+	if !templateNamePattern.MatchString(name) {
+		return fmt.Errorf("%w: namespace %s", ErrNotFound, name)
+	}
+	s.namespaceMu.Lock()
+	defer s.namespaceMu.Unlock()
+	if name != model.DefaultNamespace {
+		metas, err := s.store.ListMetas()
+		if err != nil {
+			return err
+		}
+		if usage := s.namespaceUsage(metas, name); usage.VMs > 0 {
+			return fmt.Errorf("%w: namespace %s still has %d vms", ErrConflict, name, usage.VMs)
+		}
+	}
+	if err := s.store.DeleteNamespace(name); err != nil {
+		if errors.Is(err, store.ErrNamespaceNotFound) {
+			return fmt.Errorf("%w: namespace %s", ErrNotFound, name)
+		}
+		return err
+	}
+	s.logger.InfoContext(ctx, "namespace deleted", "namespace", name)
+	return nil
+}
+
+// InNamespace returns ErrNotFound unless VM id belongs to namespace, so
+// that a namespace's routes cannot reach the VMs of another.
+func (s *Service) InNamespace(ctx context.Context, id, namespace string) error {
+	meta, err := s.readMeta(id)
+	if err != nil {
+		return err
+	}
+	if model.NamespaceOf(meta) != namespace {
+		s.logger.DebugContext(ctx, "vm is in another namespace", "vmID", id, "namespace", namespace)
+		return ErrNotFound
+	}
+	return nil
+}
+
+// readNamespace returns name's registration and whether there is one;
+// DefaultNamespace exists without it.
+func (s *Service) readNamespace(name string) (model.Namespace, bool, error) {
+	if !templateNamePattern.MatchString(name) {
+		return model.Namespace{}, false, fmt.Errorf("%w: namespace %s", ErrNotFound, name)
+	}
+	namespace, err := s.store.ReadNamespace(name)
+	switch {
+	case errors.Is(err, store.ErrNamespaceNotFound) && name == model.DefaultNamespace:
+		return model.Namespace{Name: name}, false, nil
+	case errors.Is(err, store.ErrNamespaceNotFound):
+		return model.Namespace{}, false, fmt.Errorf("%w: namespace %s", ErrNotFound, name)
+	case err != nil:
+		return model.Namespace{}, false, err
+	}
+	return namespace, true, nil
+}
+
+// lockNamespace holds namespaceMu while name is registered, so that quota
+// checks and namespace deletes see every VM saved before them. The caller
+// releases it once the VM it admits is saved.
+func (s *Service) lockNamespace(name string) (model.Namespace, func(), error) {
+	if _, registered, err := s.readNamespace(name); err != nil || !registered {
+		return model.Namespace{Name: name}, func() {}, err
+	}
+	s.namespaceMu.Lock()
+	namespace, _, err := s.readNamespace(name)
+	if err != nil {
+		s.namespaceMu.Unlock()
+		return model.Namespace{}, nil, err
+	}
+	return namespace, s.namespaceMu.Unlock, nil
+}
+
+// namespaceUsage adds up what the VMs of metas in name take on this host.
+// VMs being deleted count until they are gone.
+func (s *Service) namespaceUsage(metas []model.VMMetadata, name string) model.NamespaceUsage {
+	var usage model.NamespaceUsage
+	for _, meta := range metas {
+		if model.NamespaceOf(meta) != name || meta.Host != "" && meta.Host != s.host.Name {
+			continue
+		}
+		usage.VMs++
+		usage.Ports += len(meta.Ports)
+		if cfg, err := s.store.ReadVMConfig(meta.ID); err == nil {
+			usage.MemMiB += cfg.MachineConfig.MemSizeMiB
+		}
+	}
+	return usage
+}
+
+// admitNamespace checks that add fits namespace's quota next to the VMs of
+// metas.
+func (s *Service) admitNamespace(namespace model.Namespace, metas []model.VMMetadata, add model.NamespaceUsage) error {
+	quota := namespace.Quota
+	if quota == (model.NamespaceQuota{}) {
+		return nil
+	}
+	usage := s.namespaceUsage(metas, namespace.Name)
+	switch {
+	case quota.MaxVMs > 0 && usage.VMs+add.VMs > quota.MaxVMs:
+		return fmt.Errorf("%w: namespace %s allows %d vms and has %d", ErrQuotaExceeded, namespace.Name, quota.MaxVMs, usage.VMs)
+	case quota.MemMiB > 0 && usage.MemMiB+add.MemMiB > quota.MemMiB:
+		return fmt.Errorf("%w: namespace %s allows %d MiB of memory, %d MiB are used and %d more asked for", ErrQuotaExceeded, namespace.Name, quota.MemMiB, usage.MemMiB, add.MemMiB)
+	case quota.Ports > 0 && usage.Ports+add.Ports > quota.Ports:
+		return fmt.Errorf("%w: namespace %s allows %d host ports, %d are used and %d more asked for", ErrQuotaExceeded, namespace.Name, quota.Ports, usage.Ports, add.Ports)
+	}
+	return nil
+}
+
+// admitResize checks that VM meta can grow to memMiB within its namespace's
+// quota; the returned func releases the namespace once the resize is saved.
+func (s *Service) admitResize(meta model.VMMetadata, memMiB int) (func(), error) {
+	namespace, unlock, err := s.lockNamespace(model.NamespaceOf(meta))
+	if errors.Is(err, ErrNotFound) {
+		// A VM migrated in from a host where its namespace is registered.
+		return func() {}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if namespace.Quota.MemMiB == 0 {
+		return unlock, nil
+	}
+	namespace.Quota = model.NamespaceQuota{MemMiB: namespace.Quota.MemMiB}
+	metas, err := s.store.ListMetas()
+	if err != nil {
+		unlock()
+		return nil, err
+	}
+	metas = slices.DeleteFunc(metas, func(other model.VMMetadata) bool { return other.ID == meta.ID })
+	if err := s.admitNamespace(namespace, metas, model.NamespaceUsage{MemMiB: memMiB}); err != nil {
+		unlock()
+		return nil, err
+	}
+	return unlock, nil
+}
@@ -0,0 +1,46 @@
+package manager
+
+import (
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/alperreha/mergen-fire/internal/model"
+)
+
+// operationSet records the operations this process is running, so an
+// upgrade can tell its successor what is still finishing.
+type operationSet struct {
+	mu   sync.Mutex
+	next uint64
+	ops  map[uint64]model.Operation
+}
+
+func (o *operationSet) begin(vmID, operation string) func() {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if o.ops == nil {
+		o.ops = map[uint64]model.Operation{}
+	}
+	o.next++
+	key := o.next
+	o.ops[key] = model.Operation{VMID: vmID, Operation: operation, StartedAt: time.Now().UTC()}
+	return func() {
+		o.mu.Lock()
+		delete(o.ops, key)
+		o.mu.Unlock()
+	}
+}
+
+// Operations lists the creates and VM-locked operations in progress,
+// oldest first.
+func (s *Service) Operations() []model.Operation {
+	s.operations.mu.Lock()
+	ops := make([]model.Operation, 0, len(s.operations.ops))
+	for _, op := range s.operations.ops {
+		ops = append(ops, op)
+	}
+	s.operations.mu.Unlock()
+	sort.Slice(ops, func(i, j int) bool { return ops[i].StartedAt.Before(ops[j].StartedAt) })
+	return ops
+}
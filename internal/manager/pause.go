@@ -0,0 +1,116 @@
+package manager
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/alperreha/mergen-fire/internal/firecracker"
+	"github.com/alperreha/mergen-fire/internal/model"
+	"github.com/alperreha/mergen-fire/internal/tracing"
+)
+
+// instanceStateTimeout bounds the Firecracker query GetVM makes.
+const instanceStateTimeout = 2 * time.Second
+
+// instanceStater is implemented by snapshotters that can report whether a
+// microVM runs or is paused.
+type instanceStater interface {
+	InstanceState(ctx context.Context, socketPath string) (string, error)
+}
+
+// PauseVM freezes a running VM's vCPUs through the Firecracker API. The
+// guest keeps its memory and devices, and its unit stays active, so
+// ResumeVM carries on where it stopped. Pausing a paused VM is a no-op.
+func (s *Service) PauseVM(ctx context.Context, id string) (err error) {
+	ctx, span := tracing.Start(ctx, "manager.PauseVM", "vmID", id)
+	defer func() { span.RecordError(err); span.End() }()
+	return s.setPaused(ctx, id, true)
+}
+
+// ResumeVM lets a VM paused by PauseVM run again. Resuming a running VM is
+// a no-op.
+func (s *Service) ResumeVM(ctx context.Context, id string) (err error) {
+	ctx, span := tracing.Start(ctx, "manager.ResumeVM", "vmID", id)
+	defer func() { span.RecordError(err); span.End() }()
+	return s.setPaused(ctx, id, false)
+}
+
+func (s *Service) setPaused(ctx context.Context, id string, pause bool) error {
+	operation, want := "resume", firecracker.StateRunning
+	if pause {
+		operation, want = "pause", firecracker.StatePaused
+	}
+	s.logger.DebugContext(ctx, operation+" vm requested", "vmID", id)
+	if strings.TrimSpace(id) == "" {
+		return fmt.Errorf("%w: id is empty", ErrInvalidRequest)
+	}
+	exists, err := s.store.Exists(id)
+	if err != nil {
+		return err
+	}
+	if !exists {
+		return ErrNotFound
+	}
+	if s.snapshotter == nil {
+		return fmt.Errorf("%w: the firecracker api client is not configured", ErrUnavailable)
+	}
+
+	release, err := s.lockVM(ctx, id, operation)
+	if err != nil {
+		return err
+	}
+	defer release()
+
+	meta, err := s.store.ReadMeta(id)
+	if err != nil {
+		return err
+	}
+	if hypervisorOf(meta) != model.HypervisorFirecracker {
+		return fmt.Errorf("%w: %s needs firecracker, vm runs under %s", ErrConflict, operation, meta.Hypervisor)
+	}
+	active, err := s.systemd.IsActive(ctx, id)
+	if err != nil {
+		return fmt.Errorf("%w: %v", ErrUnavailable, err)
+	}
+	if !active {
+		return fmt.Errorf("%w: vm is not running", ErrConflict)
+	}
+	if state := s.instanceState(ctx, meta.Paths.SocketPath); state == want {
+		s.logger.DebugContext(ctx, "vm already in requested state", "vmID", id, "state", state)
+		return nil
+	}
+
+	if pause {
+		err = s.snapshotter.Pause(ctx, meta.Paths.SocketPath)
+	} else {
+		err = s.snapshotter.Resume(ctx, meta.Paths.SocketPath)
+	}
+	if err != nil {
+		return fmt.Errorf("%w: %v", ErrUnavailable, err)
+	}
+	if pause {
+		s.logger.InfoContext(ctx, "vm paused", "vmID", id)
+	} else {
+		s.logger.InfoContext(ctx, "vm resumed", "vmID", id)
+	}
+	return nil
+}
+
+// instanceState asks Firecracker for the VM's run state, or returns ""
+// when it cannot tell.
+func (s *Service) instanceState(ctx context.Context, socketPath string) string {
+	stater, ok := s.snapshotter.(instanceStater)
+	if !ok {
+		return ""
+	}
+	ctx, cancel := context.WithTimeout(ctx, instanceStateTimeout)
+	defer cancel()
+	state, err := stater.InstanceState(ctx, socketPath)
+	if err != nil {
+		s.logger.DebugContext(ctx, "firecracker instance state unavailable", "socketPath", socketPath, "error", err)
+		return ""
+	}
+	return state
+}
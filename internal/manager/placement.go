@@ -0,0 +1,85 @@
+package manager
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/alperreha/mergen-fire/internal/model"
+	"github.com/alperreha/mergen-fire/internal/scheduler"
+)
+
+// ErrScheduledElsewhere is wrapped by *PlacementError when a create request
+// belongs on another host.
+var ErrScheduledElsewhere = errors.New("vm scheduled on another host")
+
+// PlacementError carries the host a create request was scheduled onto; the
+// API forwards the request there.
+type PlacementError struct {
+	Host model.HostInfo
+}
+
+func (e *PlacementError) Error() string {
+	return fmt.Sprintf("%v: %s", ErrScheduledElsewhere, e.Host.Name)
+}
+
+func (e *PlacementError) Unwrap() error {
+	return ErrScheduledElsewhere
+}
+
+// HostLister is implemented by stores that know the hosts of a cluster.
+type HostLister interface {
+	ListHosts() ([]model.HostInfo, error)
+}
+
+type scheduledHostKey struct{}
+
+// WithScheduledHost marks a create request as already scheduled onto host by
+// a peer, so it is created here (if this host still fits) instead of being
+// scheduled again.
+func WithScheduledHost(ctx context.Context, host string) context.Context {
+	return context.WithValue(ctx, scheduledHostKey{}, host)
+}
+
+// WithHost names this mergend instance and its labels for placement.
+func (s *Service) WithHost(host model.HostInfo) *Service {
+	s.host = host
+	return s
+}
+
+// place checks a create request's placement and returns a *PlacementError if
+// another host should create the VM.
+func (s *Service) place(ctx context.Context, metas []model.VMMetadata, placement *model.Placement) error {
+	if placement == nil {
+		return nil
+	}
+	if scheduled, ok := ctx.Value(scheduledHostKey{}).(string); ok {
+		if scheduled != s.host.Name {
+			return fmt.Errorf("%w: request was scheduled onto %q, this is %q", ErrConflict, scheduled, s.host.Name)
+		}
+		if err := scheduler.Fits(s.host, metas, *placement); err != nil {
+			return fmt.Errorf("%w: %v", ErrConflict, err)
+		}
+		return nil
+	}
+
+	hosts := []model.HostInfo{s.host}
+	if lister, ok := s.store.(HostLister); ok {
+		registered, err := lister.ListHosts()
+		if err != nil {
+			return fmt.Errorf("%w: list hosts: %v", ErrUnavailable, err)
+		}
+		if len(registered) > 0 {
+			hosts = registered
+		}
+	}
+	host, err := scheduler.Schedule(hosts, metas, *placement, s.host.Name)
+	if err != nil {
+		return fmt.Errorf("%w: %v", ErrConflict, err)
+	}
+	s.logger.DebugContext(ctx, "vm placement decided", "host", host.Name, "local", host.Name == s.host.Name, "candidates", len(hosts))
+	if host.Name != s.host.Name {
+		return &PlacementError{Host: host}
+	}
+	return nil
+}
@@ -0,0 +1,44 @@
+package manager
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/alperreha/mergen-fire/internal/model"
+	"github.com/alperreha/mergen-fire/internal/network"
+)
+
+func (s *Service) ListPortReservations(ctx context.Context) ([]model.PortReservation, error) {
+	return s.allocator.Reservations()
+}
+
+// ReservePort holds a host port for a VM created later, so names and
+// firewall rules can point at it ahead of time.
+func (s *Service) ReservePort(ctx context.Context, req model.PortReservationRequest) (model.PortReservation, error) {
+	metas, err := s.store.ListMetas()
+	if err != nil {
+		return model.PortReservation{}, err
+	}
+	res, err := s.allocator.Reserve(metas, req)
+	return res, portReservationError(err)
+}
+
+func (s *Service) ReleasePort(ctx context.Context, port int) (model.PortReservation, error) {
+	res, err := s.allocator.Release(port)
+	return res, portReservationError(err)
+}
+
+func portReservationError(err error) error {
+	switch {
+	case err == nil:
+		return nil
+	case errors.Is(err, network.ErrReservationNotFound):
+		return fmt.Errorf("%w: %v", ErrNotFound, err)
+	case errors.Is(err, network.ErrPortTaken), errors.Is(err, network.ErrNoReservations):
+		return fmt.Errorf("%w: %v", ErrConflict, err)
+	case errors.Is(err, network.ErrPortInvalid):
+		return fmt.Errorf("%w: %v", ErrInvalidRequest, err)
+	}
+	return err
+}
@@ -0,0 +1,259 @@
+package manager
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/alperreha/mergen-fire/internal/firecracker"
+	"github.com/alperreha/mergen-fire/internal/model"
+	"github.com/alperreha/mergen-fire/internal/systemd"
+)
+
+// maxReconcileBackoff caps the restarts of a VM without a restart policy
+// that keeps failing at one per 2^maxReconcileBackoff intervals.
+const maxReconcileBackoff = 6
+
+// reconcileRetry counts the restarts of a VM that has not been seen running,
+// or healthy, since.
+type reconcileRetry struct {
+	restarts int
+	next     time.Time
+}
+
+// RunReconciler converges the VMs of this host to their desired state each
+// interval until ctx ends, so a crashed VM is noticed, and started again,
+// without anyone reading it.
+func (s *Service) RunReconciler(ctx context.Context, interval time.Duration) {
+	if interval <= 0 {
+		return
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		s.reconcile(ctx, interval)
+	}
+}
+
+// reconcile checks every VM of this host once. A VM that should run but
+// does not is started, one that runs but should not is stopped, and an API
+// socket left by a dead VMM is removed. VMs without a desired state,
+// adopted VMs and VMs being deleted are only checked for crashes.
+func (s *Service) reconcile(ctx context.Context, interval time.Duration) {
+	metas, err := s.store.ListMetas()
+	if err != nil {
+		s.logger.WarnContext(ctx, "reconcile: list vms failed", "error", err)
+		return
+	}
+	seen := make(map[string]bool, len(metas))
+	for _, meta := range metas {
+		if ctx.Err() != nil {
+			return
+		}
+		if meta.Host != "" && meta.Host != s.host.Name {
+			continue
+		}
+		seen[meta.ID] = true
+		status, err := s.systemd.Status(ctx, meta.ID)
+		if errors.Is(err, systemd.ErrUnavailable) {
+			s.logger.DebugContext(ctx, "reconcile skipped, systemd unavailable")
+			return
+		}
+		if err != nil {
+			s.logger.WarnContext(ctx, "reconcile: unit status failed", "vmID", meta.ID, "error", err)
+			continue
+		}
+		s.noteCrash(ctx, meta.ID, status)
+		if meta.Deletion != nil || meta.Unit != "" {
+			continue
+		}
+		// A probed VM has recovered once its probe passes; see recordProbe.
+		if status.Active && meta.HealthProbe == nil || meta.DesiredState != model.DesiredRunning {
+			s.forgetRetry(meta.ID)
+		}
+		stale := false
+		if !status.Active {
+			stale, _ = firecracker.SocketStale(meta.Paths.SocketPath)
+		}
+		if stale || drifted(meta, status) {
+			s.reconcileVM(ctx, meta.ID, interval)
+		}
+	}
+	s.reconcileMu.Lock()
+	for id := range s.reconcileRetries {
+		if !seen[id] {
+			delete(s.reconcileRetries, id)
+		}
+	}
+	s.reconcileMu.Unlock()
+}
+
+func drifted(meta model.VMMetadata, status systemd.Status) bool {
+	switch meta.DesiredState {
+	case model.DesiredRunning:
+		return !status.Active
+	case model.DesiredStopped:
+		return status.Active
+	}
+	return false
+}
+
+// reconcileVM converges one VM under its lock. A VM busy with another
+// operation is left for the next pass, and starts and stops wait while the
+// breaker is open.
+func (s *Service) reconcileVM(ctx context.Context, id string, interval time.Duration) {
+	release, err := s.lockVM(ctx, id, "reconcile")
+	if err != nil {
+		s.logger.DebugContext(ctx, "reconcile: vm busy, left for the next pass", "vmID", id, "error", err)
+		return
+	}
+	defer release()
+	// The VM may have been started, stopped or deleted since it was listed.
+	meta, err := s.store.ReadMeta(id)
+	if err != nil || meta.Deletion != nil {
+		return
+	}
+	status, err := s.systemd.Status(ctx, id)
+	if err != nil {
+		return
+	}
+	if !status.Active {
+		removed, err := firecracker.RemoveStaleSocket(meta.Paths.SocketPath)
+		if err != nil {
+			s.logger.WarnContext(ctx, "reconcile: remove stale socket failed", "vmID", id, "socketPath", meta.Paths.SocketPath, "error", err)
+		}
+		if removed {
+			s.logger.WarnContext(ctx, "reconcile: removed stale vmm socket", "vmID", id, "socketPath", meta.Paths.SocketPath)
+			s.publishReconciled(meta, model.ReconcileSocketRemoved)
+		}
+	}
+	if !drifted(meta, status) {
+		return
+	}
+	if s.AutomationPaused() {
+		s.logger.DebugContext(ctx, "reconcile: vm drifted, left alone while automation is paused by circuit breaker", "vmID", id, "desiredState", meta.DesiredState)
+		return
+	}
+
+	if meta.DesiredState == model.DesiredStopped {
+		s.logger.WarnContext(ctx, "reconcile: vm running but desired stopped, stopping it", "vmID", id)
+		if err := s.stopLocked(ctx, id); err != nil {
+			s.logger.WarnContext(ctx, "reconcile: stop failed", "vmID", id, "error", err)
+			return
+		}
+		s.publishReconciled(meta, model.ReconcileStopped)
+		return
+	}
+	if !restartWanted(meta.RestartPolicy, status) {
+		s.logger.DebugContext(ctx, "reconcile: vm not running, restart policy leaves it", "vmID", id, "activeState", status.ActiveState, "restartPolicy", restartMode(meta.RestartPolicy))
+		return
+	}
+	first, limit := restartBackoff(meta.RestartPolicy, interval)
+	if !s.restartDue(id, first, limit) {
+		s.logger.DebugContext(ctx, "reconcile: vm keeps failing, restart backed off", "vmID", id)
+		return
+	}
+	s.logger.WarnContext(ctx, "reconcile: vm not running but desired running, starting it", "vmID", id, "activeState", status.ActiveState)
+	if err := s.startAs(ctx, id, model.TransitionStarted, "reconciler"); err != nil {
+		s.logger.WarnContext(ctx, "reconcile: start failed", "vmID", id, "error", err)
+		s.publishReconciled(meta, model.ReconcileStartFailed)
+		return
+	}
+	s.countRestart(ctx, id, "unit "+status.ActiveState)
+	s.publishReconciled(meta, model.ReconcileStarted)
+}
+
+func restartMode(policy *model.RestartPolicy) string {
+	if policy == nil || policy.Mode == "" {
+		return model.RestartAlways
+	}
+	return policy.Mode
+}
+
+// restartWanted reports whether policy restarts a VM that should run but
+// whose unit is in status.
+func restartWanted(policy *model.RestartPolicy, status systemd.Status) bool {
+	switch restartMode(policy) {
+	case model.RestartNever:
+		return false
+	case model.RestartOnFailure:
+		return status.ActiveState == "failed"
+	}
+	return true
+}
+
+// restartBackoff returns the wait after a first restart and its limit:
+// the policy's, or for VMs without one two and 64 reconcile intervals.
+func restartBackoff(policy *model.RestartPolicy, interval time.Duration) (time.Duration, time.Duration) {
+	if policy == nil {
+		return 2 * interval, interval << maxReconcileBackoff
+	}
+	first, limit := defaultRestartBackoff, defaultMaxRestartBackoff
+	if policy.BackoffSeconds > 0 {
+		first = time.Duration(policy.BackoffSeconds) * time.Second
+	}
+	if policy.MaxBackoffSeconds > 0 {
+		limit = time.Duration(policy.MaxBackoffSeconds) * time.Second
+	}
+	return first, max(first, limit)
+}
+
+// restartDue reports whether the VM may be restarted now and, if so,
+// counts the restart: each one the VM does not recover from doubles the
+// wait before the next, from first up to limit.
+func (s *Service) restartDue(id string, first, limit time.Duration) bool {
+	s.reconcileMu.Lock()
+	defer s.reconcileMu.Unlock()
+	if s.reconcileRetries == nil {
+		s.reconcileRetries = map[string]*reconcileRetry{}
+	}
+	retry, ok := s.reconcileRetries[id]
+	if !ok {
+		retry = &reconcileRetry{}
+		s.reconcileRetries[id] = retry
+	}
+	now := time.Now()
+	if now.Before(retry.next) {
+		return false
+	}
+	wait := first << min(retry.restarts, maxReconcileBackoff)
+	if wait > limit || wait <= 0 {
+		wait = limit
+	}
+	retry.restarts++
+	retry.next = now.Add(wait)
+	return true
+}
+
+func (s *Service) forgetRetry(id string) {
+	s.reconcileMu.Lock()
+	delete(s.reconcileRetries, id)
+	s.reconcileMu.Unlock()
+}
+
+func (s *Service) publishReconciled(meta model.VMMetadata, reason string) {
+	s.publish(model.StoreEvent{Type: model.StoreEventReconciled, ID: meta.ID, Revision: meta.Revision, Reason: reason, At: time.Now().UTC()})
+}
+
+// setDesiredState records what the last start or stop of the VM asked for.
+// Like the state history, failing to write it never fails the operation.
+func (s *Service) setDesiredState(ctx context.Context, id, state string) {
+	meta, err := s.store.ReadMeta(id)
+	if err == nil && meta.DesiredState == state {
+		return
+	}
+	if err == nil {
+		_, err = s.store.UpdateMeta(id, meta.Revision, func(meta *model.VMMetadata) error {
+			meta.DesiredState = state
+			return nil
+		})
+	}
+	if err != nil {
+		s.logger.WarnContext(ctx, "failed to record desired state", "vmID", id, "desiredState", state, "error", err)
+	}
+}
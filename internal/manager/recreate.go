@@ -0,0 +1,186 @@
+package manager
+
+import (
+	"context"
+	"fmt"
+	"path/filepath"
+	"strings"
+
+	"github.com/alperreha/mergen-fire/internal/firecracker"
+	"github.com/alperreha/mergen-fire/internal/model"
+	"github.com/alperreha/mergen-fire/internal/tracing"
+)
+
+// RecreateVM replaces a VM with a new one created from its stored spec and
+// the images in req, then deletes the old one. The old VM keeps running
+// until the new one is saved, so a spec the new images fail on leaves it
+// untouched. Snapshots and the old data dir go with the old VM.
+func (s *Service) RecreateVM(ctx context.Context, id string, req model.RecreateVMRequest) (_ model.VMSummary, err error) {
+	ctx, span := tracing.Start(ctx, "manager.RecreateVM", "vmID", id, "preserveAllocations", req.PreserveAllocations)
+	defer func() { span.RecordError(err); span.End() }()
+	s.logger.DebugContext(ctx, "recreate vm requested", "vmID", id, "rootfs", req.RootFS, "kernel", req.Kernel, "preserveAllocations", req.PreserveAllocations)
+	if _, err := s.readMeta(id); err != nil {
+		return model.VMSummary{}, err
+	}
+	release, err := s.lockVM(ctx, id, "recreate")
+	if err != nil {
+		return model.VMSummary{}, err
+	}
+	defer release()
+
+	meta, err := s.store.ReadMeta(id)
+	if err != nil {
+		return model.VMSummary{}, err
+	}
+	if meta.Unit != "" {
+		return model.VMSummary{}, fmt.Errorf("%w: adopted vm %s runs from its own unit's config", ErrConflict, id)
+	}
+	if meta.Deletion != nil {
+		return model.VMSummary{}, fmt.Errorf("%w: vm %s is being deleted", ErrConflict, id)
+	}
+	createReq, err := s.recreateRequest(meta, req)
+	if err != nil {
+		return model.VMSummary{}, err
+	}
+	active, err := s.systemd.IsActive(ctx, id)
+	if err != nil {
+		return model.VMSummary{}, fmt.Errorf("%w: %v", ErrUnavailable, err)
+	}
+
+	opts := createOptions{replacing: id, detail: "recreated from " + id}
+	if req.PreserveAllocations {
+		opts.prior = &meta
+	}
+	newID, err := s.createVM(ctx, createReq, opts)
+	if err != nil {
+		return model.VMSummary{}, err
+	}
+	if err := s.deleteLocked(ctx, id, false); err != nil {
+		s.logger.WarnContext(ctx, "deleting replaced vm failed, removing its replacement", "vmID", id, "newVMID", newID, "error", err)
+		if rollbackErr := s.store.DeleteVM(newID, false); rollbackErr != nil {
+			s.logger.ErrorContext(ctx, "removing replacement vm failed", "vmID", newID, "error", rollbackErr)
+		}
+		return model.VMSummary{}, err
+	}
+	if active || req.AutoStart {
+		if err := s.StartVM(ctx, newID); err != nil {
+			return model.VMSummary{}, err
+		}
+	}
+	s.logger.InfoContext(ctx, "vm recreated", "vmID", id, "newVMID", newID, "preserveAllocations", req.PreserveAllocations, "started", active || req.AutoStart)
+	return s.GetVM(ctx, newID)
+}
+
+// recreateRequest rebuilds the create request of meta from its stored
+// config and env. The ip= boot argument is left for createVM to add, since
+// the guest IP may change.
+func (s *Service) recreateRequest(meta model.VMMetadata, req model.RecreateVMRequest) (model.CreateVMRequest, error) {
+	cfg, err := s.store.ReadVMConfig(meta.ID)
+	if err != nil {
+		return model.CreateVMRequest{}, err
+	}
+	reader, ok := s.store.(migrationStore)
+	if !ok {
+		return model.CreateVMRequest{}, fmt.Errorf("%w: store cannot read vm environments", ErrUnavailable)
+	}
+	env, err := reader.ReadEnv(meta.ID)
+	if err != nil {
+		return model.CreateVMRequest{}, err
+	}
+
+	out := model.CreateVMRequest{
+		RootFS:        meta.RootFS,
+		Kernel:        meta.Kernel,
+		Initrd:        meta.Initrd,
+		DataDisk:      meta.DataDisk,
+		VCPU:          cfg.MachineConfig.VCPUCount,
+		MemMiB:        cfg.MachineConfig.MemSizeMiB,
+		HTTPPort:      meta.HTTPPort,
+		Metadata:      meta.Metadata,
+		BootArgs:      firecracker.WithoutGuestIP(cfg.BootSource.BootArgs),
+		Tags:          meta.Tags,
+		Hooks:         meta.Hooks,
+		LogPolicy:     meta.LogPolicy,
+		Placement:     meta.Placement,
+		RootReadOnly:  meta.RootReadOnly,
+		RootFSSizeMiB: meta.RootFSSizeMiB,
+		Hypervisor:    hypervisorOf(meta),
+		SharedDirs:    meta.SharedDirs,
+		Devices:       meta.Devices,
+		Domains:       meta.Domains,
+		Schedule:      meta.Schedule,
+		RestartPolicy: meta.RestartPolicy,
+		HealthProbe:   meta.HealthProbe,
+		Namespace:     meta.Namespace,
+
+		IdleTimeoutMinutes: meta.IdleTimeoutMinutes,
+	}
+	if meta.RootFSImage != "" {
+		out.RootFS = meta.RootFSImage
+	}
+	if meta.KernelName != "" {
+		out.Kernel = meta.KernelName
+	}
+	if req.RootFS != "" {
+		out.RootFS = req.RootFS
+	}
+	if req.Kernel != "" {
+		out.Kernel, out.Initrd = req.Kernel, req.Initrd
+	} else if req.Initrd != "" {
+		out.Initrd = req.Initrd
+	}
+	for _, drive := range cfg.Drives {
+		if drive.IsRootDevice {
+			out.RootDevice = drive.DriveID
+		}
+	}
+	// A cmdline environment is carried in the boot args; one served over
+	// MMDS has to be handed over again.
+	if vars := mmdsGuestEnv(cfg); len(vars) > 0 {
+		out.GuestEnv, out.GuestEnvVia = vars, firecracker.GuestEnvMMDS
+	}
+	for _, port := range meta.Ports {
+		binding := model.PortBindingRequest{Guest: port.Guest, Protocol: port.Protocol}
+		if req.PreserveAllocations {
+			binding.Host = port.Host
+		}
+		out.Ports = append(out.Ports, binding)
+	}
+	generated := s.baseEnv(meta, meta.Paths, nil)
+	for key, value := range env {
+		if _, ok := generated[key]; ok {
+			continue
+		}
+		if out.ExtraEnv == nil {
+			out.ExtraEnv = map[string]string{}
+		}
+		out.ExtraEnv[key] = value
+	}
+
+	for name, path := range map[string]string{"rootfs": out.RootFS, "dataDisk": out.DataDisk} {
+		if path != "" && meta.Paths.DataDir != "" && withinDir(meta.Paths.DataDir, path) {
+			return model.CreateVMRequest{}, fmt.Errorf("%w: %s %s is in the vm's data dir and is removed with it", ErrConflict, name, path)
+		}
+	}
+	return out, nil
+}
+
+func mmdsGuestEnv(cfg model.VMConfig) map[string]string {
+	doc, _ := cfg.MMDS["mergen"].(map[string]any)
+	raw, _ := doc["env"].(map[string]any)
+	if len(raw) == 0 {
+		return nil
+	}
+	vars := make(map[string]string, len(raw))
+	for key, value := range raw {
+		if str, ok := value.(string); ok {
+			vars[key] = str
+		}
+	}
+	return vars
+}
+
+func withinDir(dir, path string) bool {
+	rel, err := filepath.Rel(dir, path)
+	return err == nil && rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator))
+}
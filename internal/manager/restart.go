@@ -0,0 +1,91 @@
+package manager
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/alperreha/mergen-fire/internal/model"
+	"github.com/alperreha/mergen-fire/internal/systemd"
+	"github.com/alperreha/mergen-fire/internal/tracing"
+)
+
+// WithRestartTimeout sets how long RestartVM waits for a graceful stop
+// before killing the VM when the caller gives no timeout; 0 leaves it to
+// the unit's TimeoutStopSec.
+func (s *Service) WithRestartTimeout(d time.Duration) *Service {
+	if d >= 0 {
+		s.restartTimeout = d
+	}
+	return s
+}
+
+// RestartVM stops and starts the VM under one hold of its lock, so no other
+// operation sees it in between. The stop is graceful for up to timeout (or
+// the default from WithRestartTimeout when it is 0); after that the unit's
+// processes are killed. A stopped VM is just started.
+func (s *Service) RestartVM(ctx context.Context, id string, timeout time.Duration) (_ model.SystemdState, err error) {
+	ctx, span := tracing.Start(ctx, "manager.RestartVM", "vmID", id, "timeout", timeout.String())
+	defer func() { span.RecordError(err); span.End() }()
+	s.logger.DebugContext(ctx, "restart vm requested", "vmID", id, "timeout", timeout)
+	if strings.TrimSpace(id) == "" {
+		return model.SystemdState{}, fmt.Errorf("%w: id is empty", ErrInvalidRequest)
+	}
+	if timeout < 0 {
+		return model.SystemdState{}, fmt.Errorf("%w: timeout must not be negative", ErrInvalidRequest)
+	}
+	if timeout == 0 {
+		timeout = s.restartTimeout
+	}
+	exists, err := s.store.Exists(id)
+	if err != nil {
+		return model.SystemdState{}, err
+	}
+	if !exists {
+		return model.SystemdState{}, ErrNotFound
+	}
+
+	release, err := s.lockVM(ctx, id, "restart")
+	if err != nil {
+		return model.SystemdState{}, err
+	}
+	defer release()
+	if err := s.stopWithin(ctx, id, timeout); err != nil {
+		return model.SystemdState{}, err
+	}
+	if err := s.startLocked(ctx, id); err != nil {
+		return model.SystemdState{}, err
+	}
+	status, err := s.systemd.Status(ctx, id)
+	if err != nil && !errors.Is(err, systemd.ErrUnavailable) {
+		return model.SystemdState{}, err
+	}
+	s.logger.InfoContext(ctx, "vm restarted", "vmID", id, "mainPID", status.MainPID)
+	return systemdState(status), nil
+}
+
+// stopWithin stops a VM whose lock the caller holds, killing it when the
+// graceful stop has not finished after timeout.
+func (s *Service) stopWithin(ctx context.Context, id string, timeout time.Duration) error {
+	if timeout <= 0 {
+		return s.stopLocked(ctx, id)
+	}
+	stopCtx, cancel := context.WithTimeout(ctx, timeout)
+	err := s.stopLocked(stopCtx, id)
+	expired := errors.Is(stopCtx.Err(), context.DeadlineExceeded)
+	cancel()
+	if err == nil || ctx.Err() != nil || !expired {
+		return err
+	}
+	s.logger.WarnContext(ctx, "graceful stop timed out, killing vm", "vmID", id, "timeout", timeout)
+	if err := s.systemd.Kill(ctx, id); err != nil {
+		if errors.Is(err, systemd.ErrUnavailable) || errors.Is(err, systemd.ErrUnitNotFound) {
+			return fmt.Errorf("%w: %v", ErrUnavailable, err)
+		}
+		return err
+	}
+	s.recordTransition(ctx, id, model.TransitionStopped, fmt.Sprintf("killed after %s", timeout))
+	return s.stopLocked(ctx, id)
+}
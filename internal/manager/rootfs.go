@@ -0,0 +1,51 @@
+package manager
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+)
+
+const grownRootFSName = "rootfs.ext4"
+
+// growRootFS copies image into dataDir and extends the copy to sizeMiB. The
+// extension is sparse; the guest init grows the filesystem into it.
+func growRootFS(image, dataDir string, sizeMiB int) (string, error) {
+	size := int64(sizeMiB) << 20
+	info, err := os.Stat(image)
+	if err != nil {
+		return "", fmt.Errorf("%w: rootfs %v", ErrInvalidRequest, err)
+	}
+	if info.Size() > size {
+		return "", fmt.Errorf("%w: rootfsSizeMiB %d is smaller than the %d MiB image", ErrInvalidRequest, sizeMiB, (info.Size()+(1<<20)-1)>>20)
+	}
+
+	if err := os.MkdirAll(dataDir, 0o750); err != nil {
+		return "", err
+	}
+	dest := filepath.Join(dataDir, grownRootFSName)
+	src, err := os.Open(image)
+	if err != nil {
+		return "", err
+	}
+	defer src.Close()
+	out, err := os.OpenFile(dest, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0o640)
+	if err != nil {
+		return "", err
+	}
+	// io.Copy between files uses copy_file_range, which reflinks where the
+	// filesystem supports it.
+	_, err = io.Copy(out, src)
+	if err == nil {
+		err = out.Truncate(size)
+	}
+	if closeErr := out.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		_ = os.Remove(dest)
+		return "", fmt.Errorf("copy rootfs: %w", err)
+	}
+	return dest, nil
+}
@@ -0,0 +1,155 @@
+package manager
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/alperreha/mergen-fire/internal/model"
+)
+
+var scheduleDays = map[string]time.Weekday{
+	"sun": time.Sunday,
+	"mon": time.Monday,
+	"tue": time.Tuesday,
+	"wed": time.Wednesday,
+	"thu": time.Thursday,
+	"fri": time.Friday,
+	"sat": time.Saturday,
+}
+
+// RunSchedules starts and stops VMs with a schedule each interval until ctx
+// ends. Only edges are acted on: a window that opened since the last check
+// starts its VM, one that closed stops it, so a VM started by hand at night
+// keeps running until the next closing edge.
+func (s *Service) RunSchedules(ctx context.Context, interval time.Duration) {
+	if interval <= 0 {
+		return
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	last := time.Now()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		now := time.Now()
+		s.applySchedules(ctx, last, now)
+		last = now
+	}
+}
+
+// applySchedules acts on every schedule of this host that opened or closed
+// between last and now. Edges passed while the breaker is open are skipped.
+func (s *Service) applySchedules(ctx context.Context, last, now time.Time) {
+	if s.AutomationPaused() {
+		s.logger.DebugContext(ctx, "schedule check skipped, automation paused by circuit breaker")
+		return
+	}
+	metas, err := s.store.ListMetas()
+	if err != nil {
+		s.logger.WarnContext(ctx, "schedule check: list vms failed", "error", err)
+		return
+	}
+	for _, meta := range metas {
+		if ctx.Err() != nil {
+			return
+		}
+		if meta.Schedule == nil || meta.Deletion != nil || meta.Host != "" && meta.Host != s.host.Name {
+			continue
+		}
+		open := scheduleOpen(*meta.Schedule, now)
+		if open == scheduleOpen(*meta.Schedule, last) {
+			continue
+		}
+		if open {
+			s.logger.InfoContext(ctx, "schedule window opened, starting vm", "vmID", meta.ID)
+			err = s.StartVM(ctx, meta.ID)
+		} else {
+			s.logger.InfoContext(ctx, "schedule window closed, stopping vm", "vmID", meta.ID)
+			err = s.StopVM(ctx, meta.ID)
+		}
+		if err != nil && !errors.Is(err, ErrNotFound) {
+			s.logger.WarnContext(ctx, "scheduled start or stop failed", "vmID", meta.ID, "open", open, "error", err)
+		}
+	}
+}
+
+// scheduleOpen reports whether any window of schedule is open at t, in the
+// schedule's timezone. Schedules are validated on create, so a timezone
+// that no longer loads keeps the VM's schedule closed.
+func scheduleOpen(schedule model.Schedule, t time.Time) bool {
+	loc, err := time.LoadLocation(schedule.Timezone)
+	if err != nil {
+		return false
+	}
+	t = t.In(loc)
+	minute := t.Hour()*60 + t.Minute()
+	today := t.Weekday()
+	yesterday := (today + 6) % 7
+	for _, window := range schedule.Windows {
+		start, _ := parseClock(window.Start)
+		stop, _ := parseClock(window.Stop)
+		if stop > start {
+			if onDay(window.Days, today) && minute >= start && minute < stop {
+				return true
+			}
+			continue
+		}
+		if onDay(window.Days, today) && minute >= start || onDay(window.Days, yesterday) && minute < stop {
+			return true
+		}
+	}
+	return false
+}
+
+func onDay(days []string, day time.Weekday) bool {
+	if len(days) == 0 {
+		return true
+	}
+	for _, name := range days {
+		if scheduleDays[strings.ToLower(name)] == day {
+			return true
+		}
+	}
+	return false
+}
+
+// parseClock returns "HH:MM" as minutes after midnight.
+func parseClock(value string) (int, error) {
+	t, err := time.Parse("15:04", value)
+	if err != nil {
+		return 0, fmt.Errorf("invalid time %q: expected HH:MM", value)
+	}
+	return t.Hour()*60 + t.Minute(), nil
+}
+
+func validateSchedule(schedule *model.Schedule) error {
+	if schedule == nil {
+		return nil
+	}
+	if _, err := time.LoadLocation(schedule.Timezone); err != nil {
+		return fmt.Errorf("schedule: unknown timezone %q", schedule.Timezone)
+	}
+	if len(schedule.Windows) == 0 {
+		return errors.New("schedule: at least one window is required")
+	}
+	for idx, window := range schedule.Windows {
+		if _, err := parseClock(window.Start); err != nil {
+			return fmt.Errorf("schedule window %d start: %v", idx, err)
+		}
+		if _, err := parseClock(window.Stop); err != nil {
+			return fmt.Errorf("schedule window %d stop: %v", idx, err)
+		}
+		for _, day := range window.Days {
+			if _, ok := scheduleDays[strings.ToLower(day)]; !ok {
+				return fmt.Errorf("schedule window %d: unknown day %q, expected mon..sun", idx, day)
+			}
+		}
+	}
+	return nil
+}
@@ -5,20 +5,31 @@ import (
 	"crypto/rand"
 	"errors"
 	"fmt"
+	"io"
 	"log/slog"
+	"net"
 	"os"
+	"regexp"
 	"slices"
 	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
+	"github.com/alperreha/mergen-fire/internal/artifact"
+	"github.com/alperreha/mergen-fire/internal/certs"
+	"github.com/alperreha/mergen-fire/internal/diagnostics"
 	"github.com/alperreha/mergen-fire/internal/firecracker"
 	"github.com/alperreha/mergen-fire/internal/hooks"
+	"github.com/alperreha/mergen-fire/internal/kernels"
 	"github.com/alperreha/mergen-fire/internal/lock"
 	"github.com/alperreha/mergen-fire/internal/model"
 	"github.com/alperreha/mergen-fire/internal/network"
 	"github.com/alperreha/mergen-fire/internal/store"
 	"github.com/alperreha/mergen-fire/internal/systemd"
+	"github.com/alperreha/mergen-fire/internal/tracing"
+	"github.com/alperreha/mergen-fire/internal/usage"
 )
 
 type Store interface {
@@ -28,10 +39,33 @@ type Store interface {
 	ReadVMConfig(id string) (model.VMConfig, error)
 	ReadHooks(id string) (model.HooksConfig, error)
 	ReadGlobalHooks() (model.HooksConfig, error)
+	ReadHookHistory(id string) ([]model.HookExecution, error)
+	AppendStateTransition(id string, transition model.StateTransition) error
+	ReadStateHistory(id string) ([]model.StateTransition, error)
+	UpdateMeta(id string, expected int64, mutate func(*model.VMMetadata) error) (model.VMMetadata, error)
+	UpdateConfig(id string, expected int64, mutate func(*model.VMConfig, *model.VMMetadata) error) (model.VMConfig, model.VMMetadata, error)
+	Watch(ctx context.Context) (<-chan model.StoreEvent, error)
+	Backup(w io.Writer, includeData bool) error
+	Fsck(dryRun bool) (model.FsckReport, error)
+	RenderRuntimeEnv(id string) error
+	RemoveRuntimeEnv(id string) error
 	ListVMIDs() ([]string, error)
 	ListMetas() ([]model.VMMetadata, error)
+	ListMetasMatching(filter model.VMFilter) ([]model.VMMetadata, error)
 	DeleteVM(id string, retainData bool) error
 	PathsFor(id string) model.VMPaths
+	ListTemplates() ([]model.VMTemplate, error)
+	ReadTemplate(name string) (model.VMTemplate, error)
+	SaveTemplate(template model.VMTemplate) error
+	DeleteTemplate(name string) error
+	ListNamespaces() ([]model.Namespace, error)
+	ReadNamespace(name string) (model.Namespace, error)
+	SaveNamespace(namespace model.Namespace) error
+	DeleteNamespace(name string) error
+	ListJobs() ([]model.Job, error)
+	ReadJob(id string) (model.Job, error)
+	SaveJob(job model.Job) error
+	DeleteJob(id string) error
 }
 
 type Service struct {
@@ -39,7 +73,92 @@ type Service struct {
 	systemd   systemd.Client
 	hooks     *hooks.Runner
 	allocator *network.Allocator
+	namer     *network.Namer
+	locker    lock.Locker
 	logger    *slog.Logger
+
+	verifyArtifacts bool
+	lockWait        time.Duration
+	lockStats       lockCounters
+	host            model.HostInfo
+
+	snapshotter      Snapshotter
+	migrationTimeout time.Duration
+	kernels          *kernels.Catalog
+	diagnostics      *diagnostics.Checker
+	usage            *usage.Meter
+	stackMu          sync.Mutex
+	deleteDrain      time.Duration
+	restartTimeout   time.Duration
+	netCleanup       string
+	hypervisor       string
+	pciDevicesDir    string
+	deviceMu         sync.Mutex
+	certIssuer       CertificateIssuer
+	certDir          *certs.Dir
+	certRenewBefore  time.Duration
+	certKick         chan struct{}
+	breaker          *Breaker
+	operations       operationSet
+	jobs             *jobQueue
+
+	bootMu    sync.Mutex
+	bootFiles map[string]*bootBaseline
+	// historyMu keeps two readers of a failed unit from both recording
+	// the crash.
+	historyMu sync.Mutex
+	eventMu   sync.Mutex
+	eventSubs map[chan model.StoreEvent]struct{}
+
+	guestStatsMu        sync.Mutex
+	guestStatsListeners map[string]net.Listener
+	guestStats          map[string]model.GuestStats
+
+	// templateMu keeps two writers of a template from losing its
+	// creation time.
+	templateMu sync.Mutex
+	// namespaceMu serializes quota checks with the saves they admit, and
+	// namespace writes with both.
+	namespaceMu sync.Mutex
+
+	capacity CapacityPolicy
+	// capacityMu serializes capacity checks with the claims they make.
+	capacityMu     sync.Mutex
+	capacityClaims map[*capacityClaim]struct{}
+
+	reconcileMu      sync.Mutex
+	reconcileRetries map[string]*reconcileRetry
+
+	guestDialer GuestDialer
+	healthMu    sync.Mutex
+	health      map[string]*healthProbeState
+
+	activityMu sync.Mutex
+	activity   map[string]time.Time
+
+	vmMetricsMu      sync.Mutex
+	vmMetricsReaders map[string]*vmMetricsReader
+	vmMetrics        map[string]model.VMMetrics
+}
+
+// LockStats describes per-VM lock contention since startup.
+type LockStats struct {
+	WaitTimeout int64 `json:"waitTimeoutMs"`
+	Acquired    int64 `json:"acquired"`
+	Contended   int64 `json:"contended"`
+	TimedOut    int64 `json:"timedOut"`
+	Waiting     int64 `json:"waiting"`
+	WaitTotalMs int64 `json:"waitTotalMs"`
+	WaitMaxMs   int64 `json:"waitMaxMs"`
+}
+
+type lockCounters struct {
+	acquired  atomic.Int64
+	contended atomic.Int64
+	timedOut  atomic.Int64
+	waiting   atomic.Int64
+	waitTotal atomic.Int64
+	waitMax   atomic.Int64
 }
 
 func NewService(store Store, systemdClient systemd.Client, hookRunner *hooks.Runner, allocator *network.Allocator, logger *slog.Logger) *Service {
@@ -47,16 +166,121 @@ func NewService(store Store, systemdClient systemd.Client, hookRunner *hooks.Run
 		logger = slog.Default()
 	}
 	return &Service{
-		store:     store,
-		systemd:   systemdClient,
-		hooks:     hookRunner,
-		allocator: allocator,
-		logger:    logger,
+		store:         store,
+		systemd:       systemdClient,
+		hooks:         hookRunner,
+		allocator:     allocator,
+		namer:         network.NewNamer(),
+		netCleanup:    defaultNetCleanup,
+		hypervisor:    model.HypervisorFirecracker,
+		pciDevicesDir: firecracker.PCIDevicesDir,
+		certKick:      make(chan struct{}, 1),
+		jobs:          newJobQueue(defaultJobQueueSize, defaultJobRetention),
+		locker: lock.NewFileLocker(func(id string) string {
+			return store.PathsFor(id).LockPath
+		}),
+		logger: logger,
+	}
+}
+
+// WithNamer replaces the default tap and netns naming.
+func (s *Service) WithNamer(namer *network.Namer) *Service {
+	if namer != nil {
+		s.namer = namer
+	}
+	return s
+}
+
+// WithHypervisor sets the hypervisor VMs run under unless their create
+// request names one.
+func (s *Service) WithHypervisor(hypervisor string) *Service {
+	if hypervisor != "" {
+		s.hypervisor = hypervisor
+	}
+	return s
+}
+
+// WithDeleteDrain sets how long a delete waits after taking the VM out of
+// forwarder routing before stopping it, so open connections can finish.
+func (s *Service) WithDeleteDrain(drain time.Duration) *Service {
+	if drain >= 0 {
+		s.deleteDrain = drain
+	}
+	return s
+}
+
+// WithNetworkCleanup sets the command a delete runs with the VM ID when the
+// VM's netns outlived its unit; empty leaves a leftover netns an error.
+func (s *Service) WithNetworkCleanup(command string) *Service {
+	s.netCleanup = strings.TrimSpace(command)
+	return s
+}
+
+// WithLocker replaces the default flock-based per-VM lock, e.g. with lease
+// locks shared by several mergend instances.
+func (s *Service) WithLocker(locker lock.Locker) *Service {
+	if locker != nil {
+		s.locker = locker
+	}
+	return s
+}
+
+// WithArtifactVerification re-hashes the rootfs, kernel and data disk before
+// every start and refuses to boot on drift. Writable disks are re-recorded
+// after each clean stop, so the check covers the time the VM was down.
+func (s *Service) WithArtifactVerification(enabled bool) *Service {
+	s.verifyArtifacts = enabled
+	return s
+}
+
+// WithLockWait lets operations on a busy VM wait up to d for its lock before
+// failing with ErrConflict, so brief overlaps queue instead of bouncing.
+func (s *Service) WithLockWait(d time.Duration) *Service {
+	if d >= 0 {
+		s.lockWait = d
+	}
+	return s
+}
+
+func (s *Service) LockStats() LockStats {
+	return LockStats{
+		WaitTimeout: s.lockWait.Milliseconds(),
+		Acquired:    s.lockStats.acquired.Load(),
+		Contended:   s.lockStats.contended.Load(),
+		TimedOut:    s.lockStats.timedOut.Load(),
+		Waiting:     s.lockStats.waiting.Load(),
+		WaitTotalMs: s.lockStats.waitTotal.Load() / int64(time.Millisecond),
+		WaitMaxMs:   s.lockStats.waitMax.Load() / int64(time.Millisecond),
 	}
 }
 
+// CreateVM creates a VM from req, or from the template it names.
 func (s *Service) CreateVM(ctx context.Context, req model.CreateVMRequest) (string, error) {
-	s.logger.Debug(
+	req, err := s.ApplyTemplate(ctx, req)
+	if err != nil {
+		return "", err
+	}
+	return s.createVM(ctx, req, createOptions{})
+}
+
+// createOptions let RecreateVM create a VM in place of another one.
+type createOptions struct {
+	// replacing is the VM being replaced: its devices, domains and
+	// allocations do not count as taken.
+	replacing string
+	// prior, when set, hands its guest IP, MAC, host ports, tap and netns
+	// names to the new VM instead of allocating new ones.
+	prior *model.VMMetadata
+	// detail goes with the created transition in the VM's history.
+	detail string
+}
+
+func (s *Service) createVM(ctx context.Context, req model.CreateVMRequest, opts createOptions) (_ string, err error) {
+	ctx, span := tracing.Start(ctx, "manager.CreateVM", "vcpu", req.VCPU, "memMiB", req.MemMiB, "autoStart", req.AutoStart)
+	defer func() { span.RecordError(err); span.End() }()
+	defer func() { s.breaker.RecordCreate(err) }()
+	defer s.operations.begin("", "create")()
+	s.logger.DebugContext(ctx,
 		"create vm request received",
 		"rootfs", req.RootFS,
 		"kernel", req.Kernel,
@@ -66,41 +290,186 @@ func (s *Service) CreateVM(ctx context.Context, req model.CreateVMRequest) (stri
 		"autoStart", req.AutoStart,
 	)
 
+	ReportJobProgress(ctx, "validating", "")
+	if req.Hypervisor == "" {
+		req.Hypervisor = s.hypervisor
+	}
+	if req.Namespace == "" {
+		req.Namespace = model.DefaultNamespace
+	}
+	devices, err := firecracker.ValidateDevices(req.Devices, req.Hypervisor)
+	if err != nil {
+		s.logger.DebugContext(ctx, "create vm device validation failed", "devices", req.Devices, "error", err)
+		return "", fmt.Errorf("%w: %v", ErrInvalidRequest, err)
+	}
+	req.Devices = devices
+	domains, err := certs.NormalizeDomains(req.Domains)
+	if err != nil {
+		s.logger.DebugContext(ctx, "create vm domain validation failed", "domains", req.Domains, "error", err)
+		return "", fmt.Errorf("%w: %v", ErrInvalidRequest, err)
+	}
+	req.Domains = domains
 	if err := validateCreate(req); err != nil {
-		s.logger.Debug("create vm validation failed", "error", err)
+		s.logger.DebugContext(ctx, "create vm validation failed", "error", err)
+		return "", fmt.Errorf("%w: %v", ErrInvalidRequest, err)
+	}
+	kernelName, err := s.resolveKernel(&req)
+	if err != nil {
+		s.logger.DebugContext(ctx, "create vm kernel resolution failed", "kernel", req.Kernel, "error", err)
+		return "", err
+	}
+	// The guest IP only adds ip= when missing, so checking without it catches
+	// every boot args error before anything is allocated.
+	if _, err := firecracker.BuildBootArgs(req.BootArgs, firecracker.BootOptionsFor(req), ""); err != nil {
+		s.logger.DebugContext(ctx, "create vm boot args validation failed", "bootArgs", req.BootArgs, "error", err)
+		if len(req.GuestEnv) > 0 && req.GuestEnvVia != firecracker.GuestEnvMMDS {
+			return "", fmt.Errorf("%w: %v (guestEnv is in the boot args, use guestEnvVia=mmds for larger environments)", ErrInvalidRequest, err)
+		}
 		return "", fmt.Errorf("%w: %v", ErrInvalidRequest, err)
 	}
 	if err := validatePathExists(req.RootFS); err != nil {
-		s.logger.Debug("create vm rootfs validation failed", "path", req.RootFS, "error", err)
+		s.logger.DebugContext(ctx, "create vm rootfs validation failed", "path", req.RootFS, "error", err)
 		return "", fmt.Errorf("%w: rootfs %v", ErrInvalidRequest, err)
 	}
+	s.applyImageDefaults(ctx, &req)
+	if warnings := s.ImageEnvWarnings(ctx, req); len(warnings) > 0 {
+		s.logger.WarnContext(ctx, "image environment incomplete", "rootfs", req.RootFS, "warnings", warnings)
+	}
 	if err := validatePathExists(req.Kernel); err != nil {
-		s.logger.Debug("create vm kernel validation failed", "path", req.Kernel, "error", err)
+		s.logger.DebugContext(ctx, "create vm kernel validation failed", "path", req.Kernel, "error", err)
 		return "", fmt.Errorf("%w: kernel %v", ErrInvalidRequest, err)
 	}
+	if strings.TrimSpace(req.Initrd) != "" {
+		if err := validatePathExists(req.Initrd); err != nil {
+			s.logger.DebugContext(ctx, "create vm initrd validation failed", "path", req.Initrd, "error", err)
+			return "", fmt.Errorf("%w: initrd %v", ErrInvalidRequest, err)
+		}
+	}
 	if strings.TrimSpace(req.DataDisk) != "" {
 		if err := validatePathExists(req.DataDisk); err != nil {
-			s.logger.Debug("create vm data disk validation failed", "path", req.DataDisk, "error", err)
+			s.logger.DebugContext(ctx, "create vm data disk validation failed", "path", req.DataDisk, "error", err)
 			return "", fmt.Errorf("%w: dataDisk %v", ErrInvalidRequest, err)
 		}
 	}
+	for _, dir := range req.SharedDirs {
+		if stat, err := os.Stat(dir.HostPath); err != nil || !stat.IsDir() {
+			s.logger.DebugContext(ctx, "create vm shared dir validation failed", "path", dir.HostPath, "error", err)
+			return "", fmt.Errorf("%w: sharedDirs %s: %s is not a directory", ErrInvalidRequest, dir.Tag, dir.HostPath)
+		}
+	}
 
+	ReportJobProgress(ctx, "allocating", "")
+	// Devices and domains are owned through metas, so claims are serialized
+	// from the check until the VM is saved.
+	if len(req.Devices) > 0 || len(req.Domains) > 0 {
+		s.deviceMu.Lock()
+		defer s.deviceMu.Unlock()
+	}
 	metas, err := s.store.ListMetas()
 	if err != nil {
 		return "", err
 	}
-
-	guestIP, ports, err := s.allocator.Allocate(metas, req.Ports)
+	if opts.replacing != "" {
+		metas = slices.DeleteFunc(metas, func(meta model.VMMetadata) bool { return meta.ID == opts.replacing })
+	}
+	if err := s.claimDevices(metas, req.Devices); err != nil {
+		s.logger.DebugContext(ctx, "create vm device claim failed", "devices", req.Devices, "error", err)
+		return "", err
+	}
+	if err := claimDomains(metas, req.Domains); err != nil {
+		s.logger.DebugContext(ctx, "create vm domain claim failed", "domains", req.Domains, "error", err)
+		return "", err
+	}
+	if err := s.place(ctx, metas, req.Placement); err != nil {
+		return "", err
+	}
+	namespace, unlockNamespace, err := s.lockNamespace(req.Namespace)
+	if errors.Is(err, ErrNotFound) {
+		return "", fmt.Errorf("%w: unknown namespace %q", ErrInvalidRequest, req.Namespace)
+	}
 	if err != nil {
-		s.logger.Debug("resource allocation failed", "error", err)
-		return "", fmt.Errorf("%w: %v", ErrInvalidRequest, err)
+		return "", err
+	}
+	defer unlockNamespace()
+	if namespace.Quota != (model.NamespaceQuota{}) {
+		// Other creates may have been saved while this one waited.
+		if metas, err = s.store.ListMetas(); err != nil {
+			return "", err
+		}
+		if opts.replacing != "" {
+			metas = slices.DeleteFunc(metas, func(meta model.VMMetadata) bool { return meta.ID == opts.replacing })
+		}
+		add := model.NamespaceUsage{VMs: 1, MemMiB: req.MemMiB, Ports: len(req.Ports)}
+		if opts.prior != nil {
+			add.Ports = len(opts.prior.Ports)
+		}
+		if err := s.admitNamespace(namespace, metas, add); err != nil {
+			s.logger.DebugContext(ctx, "create vm refused by namespace quota", "namespace", namespace.Name, "error", err)
+			return "", err
+		}
 	}
-	s.logger.Debug("resource allocation completed", "guestIP", guestIP, "allocatedPorts", len(ports))
-
 	vmID, err := newUUIDv4()
 	if err != nil {
 		return "", err
 	}
+	releaseCapacity, err := s.admitCapacity(ctx, vmID, opts.replacing, model.CapacityUsage{VCPUs: req.VCPU, MemMiB: req.MemMiB})
+	if err != nil {
+		return "", err
+	}
+	defer releaseCapacity()
+
+	var (
+		guestIP, guestMAC, tapName, netnsName string
+		ports                                 []model.PortBinding
+	)
+	if opts.prior != nil {
+		guestIP, guestMAC, ports = opts.prior.GuestIP, network.MACOf(*opts.prior), opts.prior.Ports
+		tapName, netnsName = opts.prior.TapName, opts.prior.NetNS
+		s.logger.DebugContext(ctx, "allocations taken over", "from", opts.prior.ID, "guestIP", guestIP, "guestMAC", guestMAC, "ports", len(ports))
+	} else {
+		_, allocSpan := tracing.Start(ctx, "allocator.Allocate", "portRequests", len(req.Ports))
+		guestIP, ports, err = s.allocator.Allocate(metas, req.Ports)
+		allocSpan.RecordError(err)
+		allocSpan.End()
+		if err != nil {
+			s.logger.DebugContext(ctx, "resource allocation failed", "error", err)
+			return "", fmt.Errorf("%w: %v", ErrInvalidRequest, err)
+		}
+		guestMAC, err = s.allocator.AllocateMAC(metas)
+		if err != nil {
+			s.logger.DebugContext(ctx, "guest mac allocation failed", "error", err)
+			return "", fmt.Errorf("%w: %v", ErrInvalidRequest, err)
+		}
+		s.logger.DebugContext(ctx, "resource allocation completed", "guestIP", guestIP, "guestMAC", guestMAC, "allocatedPorts", len(ports))
+	}
+
+	if opts.prior == nil {
+		tapName, netnsName, err = s.namer.Names(vmID, metas)
+		if err != nil {
+			s.logger.WarnContext(ctx, "generated vm names collide", "vmID", vmID, "error", err)
+			return "", fmt.Errorf("%w: %v", ErrConflict, err)
+		}
+	}
+
+	var rootfsImage string
+	if req.RootFSSizeMiB > 0 {
+		ReportJobProgress(ctx, "copying rootfs", "")
+		_, growSpan := tracing.Start(ctx, "manager.growRootFS", "vmID", vmID, "sizeMiB", req.RootFSSizeMiB)
+		var grown string
+		grown, err = growRootFS(req.RootFS, s.store.PathsFor(vmID).DataDir, req.RootFSSizeMiB)
+		growSpan.RecordError(err)
+		growSpan.End()
+		if err != nil {
+			return "", err
+		}
+		defer func() {
+			if err != nil {
+				_ = os.Remove(grown)
+			}
+		}()
+		s.logger.DebugContext(ctx, "rootfs copied and grown", "vmID", vmID, "image", req.RootFS, "path", grown, "sizeMiB", req.RootFSSizeMiB)
+		rootfsImage, req.RootFS = req.RootFS, grown
+	}
 
 	meta := model.VMMetadata{
 		ID:        vmID,
@@ -111,39 +480,92 @@ func (s *Service) CreateVM(ctx context.Context, req model.CreateVMRequest) (stri
 		Ports:     ports,
 		HTTPPort:  req.HTTPPort,
 		GuestIP:   guestIP,
-		TapName:   network.TapName(vmID),
-		NetNS:     network.NetNSName(vmID),
+		GuestMAC:  guestMAC,
+		TapName:   tapName,
+		NetNS:     netnsName,
 		Metadata:  req.Metadata,
 		Tags:      req.Tags,
 		Hooks:     req.Hooks,
+		LogPolicy: req.LogPolicy,
+		Host:      s.host.Name,
+		Placement: req.Placement,
+
+		KernelName:    kernelName,
+		Initrd:        req.Initrd,
+		RootReadOnly:  req.RootReadOnly,
+		RootFSImage:   rootfsImage,
+		RootFSSizeMiB: req.RootFSSizeMiB,
+		Hypervisor:    req.Hypervisor,
+		SharedDirs:    req.SharedDirs,
+		Devices:       req.Devices,
+		Domains:       req.Domains,
+		Schedule:      req.Schedule,
+		Namespace:     req.Namespace,
+		DesiredState:  model.DesiredStopped,
+		RestartPolicy: req.RestartPolicy,
+		HealthProbe:   req.HealthProbe,
+
+		IdleTimeoutMinutes: req.IdleTimeoutMinutes,
+	}
+	if req.AutoStart {
+		meta.DesiredState = model.DesiredRunning
 	}
 
-	vmCfg := firecracker.RenderVMConfig(req, meta)
-	hooksCfg := hooksFromMap(req.Hooks)
+	_, artifactSpan := tracing.Start(ctx, "artifact.Record", "vmID", vmID)
+	artifacts, err := artifact.Record(meta)
+	artifactSpan.RecordError(err)
+	artifactSpan.End()
+	if err != nil {
+		return "", fmt.Errorf("%w: checksum artifacts: %v", ErrInvalidRequest, err)
+	}
+	meta.Artifacts = artifacts
+	s.logger.DebugContext(ctx, "artifact checksums recorded", "vmID", vmID, "count", len(artifacts))
+
 	paths := s.store.PathsFor(vmID)
 	meta.Paths = paths
+	vmCfg, err := firecracker.RenderVMConfig(req, meta)
+	if err != nil {
+		return "", fmt.Errorf("%w: %v", ErrInvalidRequest, err)
+	}
+	hooksCfg := hooksFromMap(req.Hooks)
 	env := s.baseEnv(meta, paths, req.ExtraEnv)
-	if _, err := s.store.SaveVM(vmID, vmCfg, meta, hooksCfg, env); err != nil {
-		s.logger.Error("failed to persist vm files", "vmID", vmID, "error", err)
+	ReportJobProgress(ctx, "saving", "")
+	_, saveSpan := tracing.Start(ctx, "store.SaveVM", "vmID", vmID)
+	_, err = s.store.SaveVM(vmID, vmCfg, meta, hooksCfg, env)
+	saveSpan.RecordError(err)
+	saveSpan.End()
+	if err != nil {
+		s.logger.ErrorContext(ctx, "failed to persist vm files", "vmID", vmID, "error", err)
 		return "", err
 	}
-	s.logger.Debug("vm files persisted", "vmID", vmID, "configDir", paths.ConfigDir)
+	s.logger.DebugContext(ctx, "vm files persisted", "vmID", vmID, "configDir", paths.ConfigDir)
+	s.recordTransition(ctx, vmID, model.TransitionCreated, opts.detail)
+	if err := s.allocator.ConsumeReservations(ports); err != nil {
+		s.logger.WarnContext(ctx, "failed to drop consumed port reservations", "vmID", vmID, "error", err)
+	}
 
-	s.triggerHooks(model.HookOnCreate, meta, nil)
+	s.triggerHooks(ctx, model.HookOnCreate, meta, nil)
+	if len(meta.Domains) > 0 {
+		s.kickCertificates()
+	}
 
 	if req.AutoStart {
-		s.logger.Debug("auto-start enabled, starting vm", "vmID", vmID)
+		s.logger.DebugContext(ctx, "auto-start enabled, starting vm", "vmID", vmID)
+		ReportJobProgress(ctx, "starting", vmID)
 		if err := s.StartVM(ctx, vmID); err != nil {
 			return "", err
 		}
 	}
 
-	s.logger.Info("vm created", "vmID", vmID, "guestIP", guestIP, "publishedPorts", len(ports))
+	span.SetAttributes("vmID", vmID)
+	s.logger.InfoContext(ctx, "vm created", "vmID", vmID, "guestIP", guestIP, "publishedPorts", len(ports))
 	return vmID, nil
 }
 
-func (s *Service) StartVM(ctx context.Context, id string) error {
-	s.logger.Debug("start vm requested", "vmID", id)
+func (s *Service) StartVM(ctx context.Context, id string) (err error) {
+	ctx, span := tracing.Start(ctx, "manager.StartVM", "vmID", id)
+	defer func() { span.RecordError(err); span.End() }()
+	s.logger.DebugContext(ctx, "start vm requested", "vmID", id)
 	if strings.TrimSpace(id) == "" {
 		return fmt.Errorf("%w: id is empty", ErrInvalidRequest)
 	}
@@ -155,29 +577,90 @@ func (s *Service) StartVM(ctx context.Context, id string) error {
 		return ErrNotFound
 	}
 
-	release, err := s.lockVM(id)
+	release, err := s.lockVM(ctx, id, "start")
 	if err != nil {
 		return err
 	}
 	defer release()
+	return s.startLocked(ctx, id)
+}
+
+// startLocked starts a VM whose lock the caller holds.
+func (s *Service) startLocked(ctx context.Context, id string) error {
+	return s.startAs(ctx, id, model.TransitionStarted, "")
+}
+
+// startAs is startLocked recording transition in the VM's history, so a
+// restore is not also listed as a plain start.
+func (s *Service) startAs(ctx context.Context, id, transition, detail string) error {
+	active, err := s.systemd.IsActive(ctx, id)
+	if err != nil && !errors.Is(err, systemd.ErrUnavailable) {
+		return err
+	}
+	if active {
+		s.logger.DebugContext(ctx, "vm already running, start skipped", "vmID", id)
+		s.setDesiredState(ctx, id, model.DesiredRunning)
+		return nil
+	}
+	meta, err := s.store.ReadMeta(id)
+	if err != nil {
+		return err
+	}
+	if meta.Deletion != nil {
+		return fmt.Errorf("%w: vm %s is being deleted; delete it again to finish", ErrConflict, id)
+	}
+	// A socket left by a crashed Firecracker makes the new one fail to bind,
+	// so it goes before the unit starts; one a live process holds stays.
+	removed, err := firecracker.RemoveStaleSocket(meta.Paths.SocketPath)
+	if err != nil {
+		return fmt.Errorf("remove stale socket: %w", err)
+	}
+	if removed {
+		s.logger.WarnContext(ctx, "removed stale firecracker socket", "vmID", id, "socketPath", meta.Paths.SocketPath)
+	}
+
+	// A device can be rebound to a host driver while its VM is stopped.
+	for _, addr := range meta.Devices {
+		if err := s.deviceReady(addr); err != nil {
+			return fmt.Errorf("%w: %v", ErrPreconditionFailed, err)
+		}
+	}
 
+	if s.verifyArtifacts {
+		_, verifySpan := tracing.Start(ctx, "artifact.Verify", "vmID", id)
+		report := artifact.Verify(meta)
+		verifySpan.SetAttributes("ok", report.OK)
+		verifySpan.End()
+		if !report.OK {
+			failed := artifact.Failed(report)
+			s.logger.WarnContext(ctx, "artifact verification failed, refusing to start", "vmID", id, "failed", failed)
+			return fmt.Errorf("%w: artifact verification failed: %s", ErrConflict, strings.Join(failed, ", "))
+		}
+	}
+	if err := s.store.RenderRuntimeEnv(id); err != nil {
+		return fmt.Errorf("render runtime env: %w", err)
+	}
 	if err := s.systemd.Start(ctx, id); err != nil {
 		if errors.Is(err, systemd.ErrUnavailable) || errors.Is(err, systemd.ErrUnitNotFound) {
 			return fmt.Errorf("%w: %v", ErrUnavailable, err)
 		}
 		return err
 	}
+	s.forgetBootFiles(id)
+	s.forgetHealth(id)
+	s.noteActivity(id, time.Now())
+	s.recordTransition(ctx, id, transition, detail)
+	s.setDesiredState(ctx, id, model.DesiredRunning)
 
-	meta, err := s.store.ReadMeta(id)
-	if err == nil {
-		s.triggerHooks(model.HookOnStart, meta, nil)
-	}
-	s.logger.Info("vm started", "vmID", id)
+	s.triggerHooks(ctx, model.HookOnStart, meta, nil)
+	s.logger.InfoContext(ctx, "vm started", "vmID", id)
 	return nil
 }
 
-func (s *Service) StopVM(ctx context.Context, id string) error {
-	s.logger.Debug("stop vm requested", "vmID", id)
+func (s *Service) StopVM(ctx context.Context, id string) (err error) {
+	ctx, span := tracing.Start(ctx, "manager.StopVM", "vmID", id)
+	defer func() { span.RecordError(err); span.End() }()
+	s.logger.DebugContext(ctx, "stop vm requested", "vmID", id)
 	if strings.TrimSpace(id) == "" {
 		return fmt.Errorf("%w: id is empty", ErrInvalidRequest)
 	}
@@ -189,29 +672,57 @@ func (s *Service) StopVM(ctx context.Context, id string) error {
 		return ErrNotFound
 	}
 
-	release, err := s.lockVM(id)
+	release, err := s.lockVM(ctx, id, "stop")
 	if err != nil {
 		return err
 	}
 	defer release()
+	return s.stopLocked(ctx, id)
+}
 
+// stopLocked stops a VM whose lock the caller holds.
+func (s *Service) stopLocked(ctx context.Context, id string) error {
+	return s.stopAs(ctx, id, "")
+}
+
+// stopAs is stopLocked with a detail for the VM's history, such as why
+// mergend stopped it on its own.
+func (s *Service) stopAs(ctx context.Context, id, detail string) error {
+	if active, err := s.systemd.IsActive(ctx, id); err == nil && !active {
+		s.logger.DebugContext(ctx, "vm not running, stop skipped", "vmID", id)
+		s.setDesiredState(ctx, id, model.DesiredStopped)
+		return nil
+	}
 	if err := s.systemd.Stop(ctx, id); err != nil {
 		if errors.Is(err, systemd.ErrUnavailable) || errors.Is(err, systemd.ErrUnitNotFound) {
 			return fmt.Errorf("%w: %v", ErrUnavailable, err)
 		}
 		return err
 	}
-
+	s.forgetBootFiles(id)
+	s.forgetHealth(id)
+	s.recordTransition(ctx, id, model.TransitionStopped, detail)
+	s.setDesiredState(ctx, id, model.DesiredStopped)
+	if err := s.store.RemoveRuntimeEnv(id); err != nil {
+		s.logger.WarnContext(ctx, "failed to remove runtime env", "vmID", id, "error", err)
+	}
 	meta, err := s.store.ReadMeta(id)
+	if err == nil && s.verifyArtifacts {
+		if _, err := s.recordArtifacts(id, artifact.WritableFor(meta)...); err != nil {
+			s.logger.WarnContext(ctx, "failed to re-record artifact checksums", "vmID", id, "error", err)
+		}
+	}
 	if err == nil {
-		s.triggerHooks(model.HookOnStop, meta, nil)
+		s.triggerHooks(ctx, model.HookOnStop, meta, nil)
 	}
-	s.logger.Info("vm stopped", "vmID", id)
+	s.logger.InfoContext(ctx, "vm stopped", "vmID", id)
 	return nil
 }
 
-func (s *Service) DeleteVM(ctx context.Context, id string, retainData bool) error {
-	s.logger.Debug("delete vm requested", "vmID", id, "retainData", retainData)
+func (s *Service) DeleteVM(ctx context.Context, id string, retainData bool) (err error) {
+	ctx, span := tracing.Start(ctx, "manager.DeleteVM", "vmID", id, "retainData", retainData)
+	defer func() { span.RecordError(err); span.End() }()
+	s.logger.DebugContext(ctx, "delete vm requested", "vmID", id, "retainData", retainData)
 	if strings.TrimSpace(id) == "" {
 		return fmt.Errorf("%w: id is empty", ErrInvalidRequest)
 	}
@@ -223,12 +734,16 @@ func (s *Service) DeleteVM(ctx context.Context, id string, retainData bool) erro
 		return ErrNotFound
 	}
 
-	release, err := s.lockVM(id)
+	release, err := s.lockVM(ctx, id, "delete")
 	if err != nil {
 		return err
 	}
 	defer release()
+	return s.deleteLocked(ctx, id, retainData)
+}
 
+// deleteLocked deletes a VM whose lock the caller holds.
+func (s *Service) deleteLocked(ctx context.Context, id string, retainData bool) error {
 	meta, err := s.store.ReadMeta(id)
 	if err != nil {
 		if errors.Is(err, store.ErrNotFound) {
@@ -238,30 +753,27 @@ func (s *Service) DeleteVM(ctx context.Context, id string, retainData bool) erro
 	}
 	vmHooks, err := s.store.ReadHooks(id)
 	if err != nil && !errors.Is(err, store.ErrNotFound) {
-		s.logger.Warn("read vm hooks before delete failed", "vmID", id, "error", err)
+		s.logger.WarnContext(ctx, "read vm hooks before delete failed", "vmID", id, "error", err)
 	}
 
-	if err := s.systemd.Stop(ctx, id); err != nil && !errors.Is(err, systemd.ErrUnavailable) {
-		s.logger.Warn("stop unit before delete failed", "vmID", id, "error", err)
-	}
-	if err := s.systemd.Disable(ctx, id); err != nil && !errors.Is(err, systemd.ErrUnavailable) {
-		s.logger.Warn("disable unit before delete failed", "vmID", id, "error", err)
-	}
-
-	if err := s.store.DeleteVM(id, retainData); err != nil {
-		if errors.Is(err, store.ErrNotFound) {
-			return ErrNotFound
-		}
+	if err := s.runDelete(ctx, meta, retainData); err != nil {
 		return err
 	}
 
-	s.triggerHooks(model.HookOnDelete, meta, &vmHooks)
-	s.logger.Info("vm deleted", "vmID", id, "retainData", retainData)
+	s.forgetBootFiles(id)
+	s.triggerHooks(ctx, model.HookOnDelete, meta, &vmHooks)
+	s.logger.InfoContext(ctx, "vm deleted", "vmID", id, "retainData", retainData)
 	return nil
 }
 
+// GetVM also asks a running Firecracker VM for its run state, which
+// ListVMs leaves out to keep lists from waiting on every VM's socket.
 func (s *Service) GetVM(ctx context.Context, id string) (model.VMSummary, error) {
-	s.logger.Debug("get vm requested", "vmID", id)
+	s.logger.DebugContext(ctx, "get vm requested", "vmID", id)
+	return s.summary(ctx, id, true)
+}
+
+func (s *Service) summary(ctx context.Context, id string, liveState bool) (model.VMSummary, error) {
 	if strings.TrimSpace(id) == "" {
 		return model.VMSummary{}, fmt.Errorf("%w: id is empty", ErrInvalidRequest)
 	}
@@ -282,57 +794,493 @@ func (s *Service) GetVM(ctx context.Context, id string) (model.VMSummary, error)
 	if err != nil {
 		return model.VMSummary{}, err
 	}
-	s.logger.Debug("vm status collected", "vmID", id, "systemdActive", systemdStatus.Active, "socketPresent", socketPresent)
+	socketStale := false
+	if socketPresent && !systemdStatus.Active {
+		if socketStale, err = firecracker.SocketStale(meta.Paths.SocketPath); err != nil {
+			return model.VMSummary{}, err
+		}
+		socketPresent = !socketStale
+	}
+	s.logger.DebugContext(ctx, "vm status collected", "vmID", id, "systemdActive", systemdStatus.Active, "socketPresent", socketPresent, "socketStale", socketStale)
+	s.noteCrash(ctx, id, systemdStatus)
+	bootFiles := s.checkBootFiles(ctx, meta, systemdStatus)
+	var health *model.HealthState
+	if meta.HealthProbe != nil && systemdStatus.Active {
+		health = s.healthOf(id)
+	}
+	instanceState := ""
+	if liveState && socketPresent && systemdStatus.Active && hypervisorOf(meta) == model.HypervisorFirecracker {
+		instanceState = s.instanceState(ctx, meta.Paths.SocketPath)
+	}
 
 	return model.VMSummary{
 		ID:        meta.ID,
+		Namespace: model.NamespaceOf(meta),
+		Revision:  meta.Revision,
 		CreatedAt: meta.CreatedAt,
-		Systemd: model.SystemdState{
-			Available:   systemdStatus.Available,
-			Unit:        systemdStatus.Unit,
-			Active:      systemdStatus.Active,
-			ActiveState: systemdStatus.ActiveState,
-			SubState:    systemdStatus.SubState,
-			MainPID:     systemdStatus.MainPID,
-		},
+		Systemd:   systemdState(systemdStatus),
 		Firecracker: model.FirecrackerState{
 			SocketPath:    meta.Paths.SocketPath,
 			SocketPresent: socketPresent,
+			SocketStale:   socketStale,
+			State:         instanceState,
+			Paused:        instanceState == firecracker.StatePaused,
 		},
 		Network: model.NetworkState{
-			GuestIP: meta.GuestIP,
-			Ports:   meta.Ports,
-			TapName: meta.TapName,
-			NetNS:   meta.NetNS,
+			GuestIP:  meta.GuestIP,
+			GuestMAC: network.MACOf(meta),
+			Ports:    meta.Ports,
+			HTTPPort: meta.HTTPPort,
+			TapName:  meta.TapName,
+			NetNS:    meta.NetNS,
 		},
-		Paths:    meta.Paths,
-		Metadata: meta.Metadata,
+		Paths:       meta.Paths,
+		Metadata:    meta.Metadata,
+		Tags:        meta.Tags,
+		Host:        meta.Host,
+		BootFiles:   bootFiles,
+		Deletion:    meta.Deletion,
+		Hypervisor:  hypervisorOf(meta),
+		Devices:     meta.Devices,
+		Domains:     meta.Domains,
+		Certificate: meta.Certificate,
+		Snapshots:   meta.Snapshots,
+		Schedule:    meta.Schedule,
+
+		DesiredState:  meta.DesiredState,
+		RestartPolicy: meta.RestartPolicy,
+		HealthProbe:   meta.HealthProbe,
+		Restarts:      meta.Restarts,
+		Health:        health,
+
+		IdleTimeoutMinutes: meta.IdleTimeoutMinutes,
+		LastActivityAt:     s.lastActivityAt(id),
 	}, nil
 }
 
-func (s *Service) ListVMs(ctx context.Context) ([]model.VMSummary, error) {
-	s.logger.Debug("list vms requested")
-	ids, err := s.store.ListVMIDs()
+// ListVMs returns one page of the VMs filter selects, and the cursor of the
+// next page if there is one; the zero filter selects all of them. VMs are
+// sorted by their metadata, so only the VMs on the page are read from
+// systemd.
+func (s *Service) ListVMs(ctx context.Context, filter model.VMFilter, page model.VMListPage) ([]model.VMSummary, string, error) {
+	s.logger.DebugContext(ctx, "list vms requested", "tags", len(filter.Tags), "metadata", len(filter.Metadata), "limit", page.Limit, "sort", page.Sort, "cursor", page.Cursor != "")
+	page, err := normalizeListPage(page)
 	if err != nil {
-		return nil, err
+		return nil, "", err
+	}
+	metas, err := s.store.ListMetasMatching(filter)
+	if err != nil {
+		return nil, "", err
+	}
+	start, err := pageStart(metas, page)
+	if err != nil {
+		return nil, "", err
 	}
 
-	result := make([]model.VMSummary, 0, len(ids))
-	for _, id := range ids {
-		vm, getErr := s.GetVM(ctx, id)
+	size := len(metas) - start
+	if page.Limit > 0 {
+		size = min(size, page.Limit)
+	}
+	result := make([]model.VMSummary, 0, size)
+	next := ""
+	for idx := start; idx < len(metas); idx++ {
+		if page.Limit > 0 && len(result) == page.Limit {
+			next = encodeListCursor(page.Sort, metas[idx-1])
+			break
+		}
+		vm, getErr := s.summary(ctx, metas[idx].ID, false)
 		if getErr != nil {
 			if errors.Is(getErr, ErrNotFound) {
 				continue
 			}
-			return nil, getErr
+			return nil, "", getErr
 		}
 		result = append(result, vm)
 	}
+	s.logger.DebugContext(ctx, "list vms completed", "count", len(result), "more", next != "")
+	return result, next, nil
+}
+
+// UpdateVM requires the caller's last seen revision; a nil revision is
+// rejected so concurrent writers cannot silently overwrite each other.
+func (s *Service) UpdateVM(ctx context.Context, id string, revision *int64, req model.UpdateVMRequest) (_ model.VMSummary, err error) {
+	ctx, span := tracing.Start(ctx, "manager.UpdateVM", "vmID", id)
+	defer func() { span.RecordError(err); span.End() }()
+	s.logger.DebugContext(ctx, "update vm requested", "vmID", id, "hasRevision", revision != nil, "tags", req.Tags != nil, "metadata", req.Metadata != nil, "vcpu", req.VCPU, "memMiB", req.MemMiB, "bootArgs", req.BootArgs != "", "restart", req.Restart)
+	if strings.TrimSpace(id) == "" {
+		return model.VMSummary{}, fmt.Errorf("%w: id is empty", ErrInvalidRequest)
+	}
+	if revision == nil {
+		return model.VMSummary{}, fmt.Errorf("%w: If-Match revision is required", ErrPreconditionRequired)
+	}
+	if err := validateLogPolicy(req.LogPolicy); err != nil {
+		return model.VMSummary{}, fmt.Errorf("%w: %v", ErrInvalidRequest, err)
+	}
+	if err := validateResize(req); err != nil {
+		return model.VMSummary{}, fmt.Errorf("%w: %v", ErrInvalidRequest, err)
+	}
+	exists, err := s.store.Exists(id)
+	if err != nil {
+		return model.VMSummary{}, err
+	}
+	if !exists {
+		return model.VMSummary{}, ErrNotFound
+	}
+
+	release, err := s.lockVM(ctx, id, "update")
+	if err != nil {
+		return model.VMSummary{}, err
+	}
+	defer release()
+	if req.MemMiB > 0 {
+		current, err := s.store.ReadMeta(id)
+		if err != nil {
+			return model.VMSummary{}, err
+		}
+		unlockNamespace, err := s.admitResize(current, req.MemMiB)
+		if err != nil {
+			return model.VMSummary{}, err
+		}
+		defer unlockNamespace()
+	}
+	if req.VCPU > 0 || req.MemMiB > 0 {
+		cfg, err := s.store.ReadVMConfig(id)
+		if err != nil {
+			return model.VMSummary{}, err
+		}
+		resize := model.CapacityUsage{VCPUs: cfg.MachineConfig.VCPUCount, MemMiB: cfg.MachineConfig.MemSizeMiB}
+		if req.VCPU > 0 {
+			resize.VCPUs = req.VCPU
+		}
+		if req.MemMiB > 0 {
+			resize.MemMiB = req.MemMiB
+		}
+		releaseCapacity, err := s.admitCapacity(ctx, id, id, resize)
+		if err != nil {
+			return model.VMSummary{}, err
+		}
+		defer releaseCapacity()
+	}
+	updateMeta := func(meta *model.VMMetadata) error {
+		if req.Tags != nil {
+			meta.Tags = withStackTags(req.Tags, meta.Tags)
+		}
+		if req.Metadata != nil {
+			meta.Metadata = req.Metadata
+		}
+		if req.LogPolicy != nil {
+			meta.LogPolicy = req.LogPolicy
+		}
+		return nil
+	}
+	var meta model.VMMetadata
+	resized := req.VCPU > 0 || req.MemMiB > 0 || req.BootArgs != ""
+	if resized {
+		_, meta, err = s.store.UpdateConfig(id, *revision, func(cfg *model.VMConfig, meta *model.VMMetadata) error {
+			if meta.Unit != "" {
+				return fmt.Errorf("%w: adopted vm %s runs from its own unit's config", ErrConflict, id)
+			}
+			if req.VCPU > 0 {
+				cfg.MachineConfig.VCPUCount = req.VCPU
+			}
+			if req.MemMiB > 0 {
+				cfg.MachineConfig.MemSizeMiB = req.MemMiB
+			}
+			if req.BootArgs != "" {
+				bootArgs, err := firecracker.ReplaceBootArgs(cfg.BootSource.BootArgs, req.BootArgs, *meta)
+				if err != nil {
+					return fmt.Errorf("%w: %v", ErrInvalidRequest, err)
+				}
+				cfg.BootSource.BootArgs = bootArgs
+			}
+			return updateMeta(meta)
+		})
+	} else {
+		meta, err = s.store.UpdateMeta(id, *revision, updateMeta)
+	}
+	if err != nil {
+		switch {
+		case errors.Is(err, store.ErrNotFound):
+			return model.VMSummary{}, ErrNotFound
+		case errors.Is(err, store.ErrRevisionConflict):
+			return model.VMSummary{}, fmt.Errorf("%w: %v", ErrPreconditionFailed, err)
+		}
+		return model.VMSummary{}, err
+	}
+	s.logger.InfoContext(ctx, "vm updated", "vmID", id, "revision", meta.Revision, "resized", resized)
+
+	if resized {
+		active, err := s.systemd.IsActive(ctx, id)
+		if err != nil && !errors.Is(err, systemd.ErrUnavailable) {
+			return model.VMSummary{}, err
+		}
+		switch {
+		case active && req.Restart:
+			s.logger.InfoContext(ctx, "restarting vm to apply its new config", "vmID", id)
+			if err := s.stopWithin(ctx, id, s.restartTimeout); err != nil {
+				return model.VMSummary{}, err
+			}
+			if err := s.startLocked(ctx, id); err != nil {
+				return model.VMSummary{}, err
+			}
+		case active:
+			s.logger.InfoContext(ctx, "vm config changed, applies on next start", "vmID", id)
+		}
+	}
+	return s.GetVM(ctx, id)
+}
+
+// Watch streams store changes merged with events the service raises
+// itself, such as boot file changes.
+func (s *Service) Watch(ctx context.Context) (<-chan model.StoreEvent, error) {
+	events, err := s.store.Watch(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("%w: store watch: %v", ErrUnavailable, err)
+	}
+	local := make(chan model.StoreEvent, 16)
+	s.eventMu.Lock()
+	if s.eventSubs == nil {
+		s.eventSubs = map[chan model.StoreEvent]struct{}{}
+	}
+	s.eventSubs[local] = struct{}{}
+	s.eventMu.Unlock()
+
+	out := make(chan model.StoreEvent)
+	go func() {
+		defer close(out)
+		defer func() {
+			s.eventMu.Lock()
+			delete(s.eventSubs, local)
+			s.eventMu.Unlock()
+		}()
+		for {
+			var event model.StoreEvent
+			select {
+			case <-ctx.Done():
+				return
+			case next, ok := <-events:
+				if !ok {
+					return
+				}
+				event = next
+			case event = <-local:
+			}
+			select {
+			case out <- event:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	return out, nil
+}
+
+// publish hands event to every watcher without blocking; a watcher too slow
+// to keep 16 events buffered misses it.
+func (s *Service) publish(event model.StoreEvent) {
+	s.eventMu.Lock()
+	defer s.eventMu.Unlock()
+	for sub := range s.eventSubs {
+		select {
+		case sub <- event:
+		default:
+		}
+	}
+}
+
+func (s *Service) Backup(ctx context.Context, w io.Writer, includeData bool) error {
+	s.logger.DebugContext(ctx, "backup requested", "includeData", includeData)
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	if err := s.store.Backup(w, includeData); err != nil {
+		return err
+	}
+	s.logger.InfoContext(ctx, "backup written", "includeData", includeData)
+	return nil
+}
+
+func (s *Service) Fsck(ctx context.Context, dryRun bool) (model.FsckReport, error) {
+	s.logger.DebugContext(ctx, "fsck requested", "dryRun", dryRun)
+	if err := ctx.Err(); err != nil {
+		return model.FsckReport{}, err
+	}
+	return s.store.Fsck(dryRun)
+}
+
+// VerifyArtifacts compares the VM's disks and kernel with the checksums
+// recorded at create time. With record set, the current content is accepted
+// as the new baseline instead, which requires the VM to be stopped.
+func (s *Service) VerifyArtifacts(ctx context.Context, id string, record bool) (model.ArtifactReport, error) {
+	s.logger.DebugContext(ctx, "artifact verification requested", "vmID", id, "record", record)
+	if strings.TrimSpace(id) == "" {
+		return model.ArtifactReport{}, fmt.Errorf("%w: id is empty", ErrInvalidRequest)
+	}
+	if !record {
+		meta, err := s.store.ReadMeta(id)
+		if err != nil {
+			if errors.Is(err, store.ErrNotFound) {
+				return model.ArtifactReport{}, ErrNotFound
+			}
+			return model.ArtifactReport{}, err
+		}
+		report := artifact.Verify(meta)
+		s.logger.InfoContext(ctx, "artifacts verified", "vmID", id, "ok", report.OK)
+		return report, nil
+	}
+
+	active, err := s.systemd.IsActive(ctx, id)
+	if err != nil && !errors.Is(err, systemd.ErrUnavailable) {
+		return model.ArtifactReport{}, err
+	}
+	if active {
+		return model.ArtifactReport{}, fmt.Errorf("%w: vm must be stopped to record artifact checksums", ErrConflict)
+	}
+	release, err := s.lockVM(ctx, id, "record-artifacts")
+	if err != nil {
+		return model.ArtifactReport{}, err
+	}
+	defer release()
+
+	meta, err := s.recordArtifacts(id)
+	if err != nil {
+		if errors.Is(err, store.ErrNotFound) {
+			return model.ArtifactReport{}, ErrNotFound
+		}
+		return model.ArtifactReport{}, err
+	}
+	report := artifact.Verify(meta)
+	report.Recorded = true
+	s.logger.InfoContext(ctx, "artifact checksums recorded", "vmID", id, "revision", meta.Revision)
+	return report, nil
+}
 
-	slices.SortFunc(result, func(a, b model.VMSummary) int {
-		return b.CreatedAt.Compare(a.CreatedAt)
+// recordArtifacts stores fresh checksums for the named artifacts (all when
+// none are given). Callers hold the VM lock.
+func (s *Service) recordArtifacts(id string, names ...string) (model.VMMetadata, error) {
+	meta, err := s.store.ReadMeta(id)
+	if err != nil {
+		return model.VMMetadata{}, err
+	}
+	recorded, err := artifact.Record(meta, names...)
+	if err != nil {
+		return model.VMMetadata{}, err
+	}
+	return s.store.UpdateMeta(id, meta.Revision, func(meta *model.VMMetadata) error {
+		if meta.Artifacts == nil {
+			meta.Artifacts = map[string]model.Artifact{}
+		}
+		for name, sum := range recorded {
+			meta.Artifacts[name] = sum
+		}
+		return nil
 	})
-	s.logger.Debug("list vms completed", "count", len(result))
+}
+
+// UnlockVM breaks the VM's lock. Without force only locks whose holder
+// process is gone are broken; force also breaks live holders, e.g. a hung
+// operation, at the risk of two operations overlapping.
+func (s *Service) UnlockVM(ctx context.Context, id string, force bool) (model.LockStatus, error) {
+	s.logger.DebugContext(ctx, "unlock vm requested", "vmID", id, "force", force)
+	if strings.TrimSpace(id) == "" {
+		return model.LockStatus{}, fmt.Errorf("%w: id is empty", ErrInvalidRequest)
+	}
+	if err := ctx.Err(); err != nil {
+		return model.LockStatus{}, err
+	}
+	exists, err := s.store.Exists(id)
+	if err != nil {
+		return model.LockStatus{}, err
+	}
+	if !exists {
+		return model.LockStatus{}, ErrNotFound
+	}
+
+	status, err := s.locker.Break(id, force)
+	if err != nil {
+		if errors.Is(err, lock.ErrAlreadyLocked) {
+			return status, fmt.Errorf("%w: %v; pass force=true to break a live lock", ErrConflict, err)
+		}
+		return status, err
+	}
+	if status.Broken {
+		s.logger.WarnContext(ctx, "vm lock broken", "vmID", id, "holder", status.Holder, "stale", status.Stale, "force", force)
+	}
+	return status, nil
+}
+
+func (s *Service) HookHistory(ctx context.Context, id string, limit int) ([]model.HookExecution, error) {
+	s.logger.DebugContext(ctx, "hook history requested", "vmID", id, "limit", limit)
+	if strings.TrimSpace(id) == "" {
+		return nil, fmt.Errorf("%w: id is empty", ErrInvalidRequest)
+	}
+	exists, err := s.store.Exists(id)
+	if err != nil {
+		return nil, err
+	}
+	if !exists {
+		return nil, ErrNotFound
+	}
+
+	history, err := s.store.ReadHookHistory(id)
+	if err != nil {
+		return nil, err
+	}
+	if limit > 0 && len(history) > limit {
+		history = history[len(history)-limit:]
+	}
+	slices.Reverse(history)
+	return history, nil
+}
+
+func (s *Service) TestHook(ctx context.Context, id string, req model.HookTestRequest) (model.HookTestResult, error) {
+	s.logger.DebugContext(ctx, "hook test requested", "vmID", id, "event", req.Event, "index", req.Index, "inline", req.Hook != nil, "dryRun", req.DryRun)
+	if strings.TrimSpace(id) == "" {
+		return model.HookTestResult{}, fmt.Errorf("%w: id is empty", ErrInvalidRequest)
+	}
+	if !validHookEvent(req.Event) {
+		return model.HookTestResult{}, fmt.Errorf("%w: unknown hook event %q", ErrInvalidRequest, req.Event)
+	}
+	if s.hooks == nil {
+		return model.HookTestResult{}, fmt.Errorf("%w: hook runner unavailable", ErrUnavailable)
+	}
+
+	meta, err := s.store.ReadMeta(id)
+	if err != nil {
+		if errors.Is(err, store.ErrNotFound) {
+			return model.HookTestResult{}, ErrNotFound
+		}
+		return model.HookTestResult{}, err
+	}
+
+	var hook model.HookEntry
+	if req.Hook != nil {
+		hook = *req.Hook
+	} else {
+		vmHooks, err := s.store.ReadHooks(id)
+		if err != nil && !errors.Is(err, store.ErrNotFound) {
+			return model.HookTestResult{}, err
+		}
+		candidates := s.eventHooks(id, req.Event, vmHooks)
+		if req.Index < 0 || req.Index >= len(candidates) {
+			return model.HookTestResult{}, fmt.Errorf("%w: %s has %d hooks, index %d out of range", ErrInvalidRequest, req.Event, len(candidates), req.Index)
+		}
+		hook = candidates[req.Index]
+	}
+
+	payload := hookContext(meta)
+	rendered, err := s.hooks.Render(req.Event, hook, payload)
+	if err != nil {
+		return model.HookTestResult{}, fmt.Errorf("%w: %v", ErrInvalidRequest, err)
+	}
+	result := model.HookTestResult{Event: req.Event, DryRun: req.DryRun, Hook: hook, Rendered: rendered}
+	if req.DryRun {
+		return result, nil
+	}
+
+	execution := s.hooks.Fire(ctx, req.Event, req.Index, hook, payload)
+	result.Execution = &execution
+	s.logger.InfoContext(ctx, "hook test executed", "vmID", id, "event", req.Event, "type", hook.Type, "status", execution.Status)
 	return result, nil
 }
 
@@ -350,6 +1298,7 @@ func (s *Service) baseEnv(meta model.VMMetadata, paths model.VMPaths, extra map[
 		"MGN_GUEST_IP":    meta.GuestIP,
 		"MGN_DATA_DIR":    paths.DataDir,
 		"MGN_LOG_DIR":     paths.LogsDir,
+		"MGN_HYPERVISOR":  hypervisorOf(meta),
 	}
 	if meta.HTTPPort > 0 {
 		env["MGN_HTTP_PORT"] = strconv.Itoa(meta.HTTPPort)
@@ -367,9 +1316,9 @@ func (s *Service) baseEnv(meta model.VMMetadata, paths model.VMPaths, extra map[
 	return env
 }
 
-func (s *Service) triggerHooks(event string, meta model.VMMetadata, vmHooksOverride *model.HooksConfig) {
+func (s *Service) triggerHooks(ctx context.Context, event string, meta model.VMMetadata, vmHooksOverride *model.HooksConfig) {
 	if s.hooks == nil {
-		s.logger.Debug("hook runner unavailable, skipping event", "vmID", meta.ID, "event", event)
+		s.logger.DebugContext(ctx, "hook runner unavailable, skipping event", "vmID", meta.ID, "event", event)
 		return
 	}
 
@@ -379,20 +1328,23 @@ func (s *Service) triggerHooks(event string, meta model.VMMetadata, vmHooksOverr
 	} else {
 		readHooks, err := s.store.ReadHooks(meta.ID)
 		if err != nil && !errors.Is(err, store.ErrNotFound) {
-			s.logger.Warn("read vm hooks failed", "vmID", meta.ID, "error", err)
+			s.logger.WarnContext(ctx, "read vm hooks failed", "vmID", meta.ID, "error", err)
 		} else {
 			vmHooks = readHooks
 		}
 	}
 
+	eventHooks := s.eventHooks(meta.ID, event, vmHooks)
+	s.logger.DebugContext(ctx, "triggering hooks", "vmID", meta.ID, "event", event, "hookCount", len(eventHooks))
+	s.hooks.RunAsync(ctx, event, eventHooks, hookContext(meta))
+}
+
+func (s *Service) eventHooks(id, event string, vmHooks model.HooksConfig) []model.HookEntry {
 	globalHooks, err := s.store.ReadGlobalHooks()
 	if err != nil {
-		s.logger.Warn("read global hooks failed", "vmID", meta.ID, "error", err)
+		s.logger.Warn("read global hooks failed", "vmID", id, "error", err)
 	}
-
-	eventHooks := append(hooksForEvent(globalHooks, event), hooksForEvent(vmHooks, event)...)
-	s.logger.Debug("triggering hooks", "vmID", meta.ID, "event", event, "hookCount", len(eventHooks))
-	s.hooks.RunAsync(event, eventHooks, hookContext(meta))
+	return append(hooksForEvent(globalHooks, event), hooksForEvent(vmHooks, event)...)
 }
 
 func hookContext(meta model.VMMetadata) model.HookContext {
@@ -425,6 +1377,15 @@ func hooksFromMap(hookMap map[string][]model.HookEntry) model.HooksConfig {
 	}
 }
 
+func validHookEvent(event string) bool {
+	switch event {
+	case model.HookOnCreate, model.HookOnDelete, model.HookOnStart, model.HookOnStop:
+		return true
+	default:
+		return false
+	}
+}
+
 func hooksForEvent(cfg model.HooksConfig, event string) []model.HookEntry {
 	switch event {
 	case model.HookOnCreate:
@@ -440,27 +1401,70 @@ func hooksForEvent(cfg model.HooksConfig, event string) []model.HookEntry {
 	}
 }
 
-func (s *Service) lockVM(id string) (func(), error) {
-	lockPath := s.store.PathsFor(id).LockPath
-	s.logger.Debug("acquiring vm lock", "vmID", id, "lockPath", lockPath)
-	lockHandle, err := lock.Acquire(lockPath)
+func (s *Service) lockVM(ctx context.Context, id, operation string) (func(), error) {
+	s.logger.DebugContext(ctx, "acquiring vm lock", "vmID", id, "operation", operation)
+	_, span := tracing.Start(ctx, "lock.Acquire", "vmID", id, "operation", operation)
+	started := time.Now()
+	s.lockStats.waiting.Add(1)
+	lockHandle, err := s.locker.Lock(id, operation, s.lockWait)
+	s.lockStats.waiting.Add(-1)
+	s.recordLockWait(id, time.Since(started), err)
+	span.RecordError(err)
+	span.End()
 	if err != nil {
 		if errors.Is(err, lock.ErrAlreadyLocked) {
-			s.logger.Debug("vm lock already held", "vmID", id, "lockPath", lockPath)
-			return nil, ErrConflict
+			status, inspectErr := s.locker.Inspect(id)
+			if inspectErr != nil || !status.Held {
+				s.logger.Debug("vm lock already held", "vmID", id)
+				return nil, ErrConflict
+			}
+			s.logger.Debug("vm lock already held", "vmID", id, "holder", status.Holder, "stale", status.Stale)
+			if status.Stale {
+				return nil, fmt.Errorf("%w: vm lock is stale (%s); break it with POST /v1/vms/%s/unlock", ErrConflict, lock.Describe(status.Holder), id)
+			}
+			return nil, fmt.Errorf("%w: vm lock %s", ErrConflict, lock.Describe(status.Holder))
 		}
 		return nil, err
 	}
-	s.logger.Debug("vm lock acquired", "vmID", id, "lockPath", lockPath)
+	s.logger.Debug("vm lock acquired", "vmID", id)
+	done := s.operations.begin(id, operation)
 	return func() {
+		done()
 		if releaseErr := lockHandle.Release(); releaseErr != nil {
-			s.logger.Warn("failed to release lock", "lockPath", lockPath, "error", releaseErr)
+			s.logger.Warn("failed to release lock", "vmID", id, "error", releaseErr)
 			return
 		}
-		s.logger.Debug("vm lock released", "vmID", id, "lockPath", lockPath)
+		s.logger.Debug("vm lock released", "vmID", id)
 	}, nil
 }
 
+func (s *Service) recordLockWait(id string, waited time.Duration, err error) {
+	switch {
+	case errors.Is(err, lock.ErrAlreadyLocked):
+		s.lockStats.timedOut.Add(1)
+	case err != nil:
+		return
+	default:
+		s.lockStats.acquired.Add(1)
+	}
+	// Anything past a few polls means another operation held the lock.
+	if waited > 5*time.Millisecond {
+		s.lockStats.contended.Add(1)
+	}
+	s.lockStats.waitTotal.Add(int64(waited))
+	for {
+		current := s.lockStats.waitMax.Load()
+		if int64(waited) <= current || s.lockStats.waitMax.CompareAndSwap(current, int64(waited)) {
+			break
+		}
+	}
+	if waited > time.Second {
+		s.logger.Info("vm lock wait was long", "vmID", id, "waited", waited, "acquired", err == nil)
+	}
+}
+
+var driveIDPattern = regexp.MustCompile(`^[A-Za-z0-9_-]{1,64}$`)
+
 func validateCreate(req model.CreateVMRequest) error {
 	if strings.TrimSpace(req.RootFS) == "" {
 		return errors.New("rootfs is required")
@@ -485,6 +1489,79 @@ func validateCreate(req model.CreateVMRequest) error {
 	if req.HTTPPort < 0 || req.HTTPPort > 65535 {
 		return fmt.Errorf("invalid httpPort: %d", req.HTTPPort)
 	}
+	if req.RootFSSizeMiB < 0 {
+		return fmt.Errorf("invalid rootfsSizeMiB: %d", req.RootFSSizeMiB)
+	}
+	if req.RootFSSizeMiB > 0 && req.RootReadOnly {
+		return errors.New("rootfsSizeMiB cannot grow a read-only root")
+	}
+	if req.RootDevice != "" && (!driveIDPattern.MatchString(req.RootDevice) || req.RootDevice == firecracker.DataDriveID) {
+		return fmt.Errorf("invalid rootDevice %q: expected letters, digits, '-' or '_' and not %q", req.RootDevice, firecracker.DataDriveID)
+	}
+	if err := firecracker.ValidateGuestEnv(req.GuestEnv, req.GuestEnvVia); err != nil {
+		return err
+	}
+	if err := firecracker.ValidateHypervisor(req.Hypervisor); err != nil {
+		return err
+	}
+	if err := firecracker.ValidateSharedDirs(req.SharedDirs, req.Hypervisor); err != nil {
+		return err
+	}
+	if req.Hypervisor == model.HypervisorCloudHypervisor && len(req.GuestEnv) > 0 && req.GuestEnvVia == firecracker.GuestEnvMMDS {
+		return errors.New("guestEnvVia=mmds needs firecracker; cloud-hypervisor has no metadata service")
+	}
+	if err := validateSchedule(req.Schedule); err != nil {
+		return err
+	}
+	if err := validateRestartPolicy(req.RestartPolicy); err != nil {
+		return err
+	}
+	if err := validateHealthProbe(req.HealthProbe); err != nil {
+		return err
+	}
+	if req.IdleTimeoutMinutes < 0 {
+		return fmt.Errorf("invalid idleTimeoutMinutes: %d", req.IdleTimeoutMinutes)
+	}
+	return validateLogPolicy(req.LogPolicy)
+}
+
+func systemdState(status systemd.Status) model.SystemdState {
+	return model.SystemdState{
+		Available:   status.Available,
+		Unit:        status.Unit,
+		Active:      status.Active,
+		ActiveState: status.ActiveState,
+		SubState:    status.SubState,
+		MainPID:     status.MainPID,
+	}
+}
+
+// hypervisorOf returns the hypervisor meta's VM runs under; VMs created
+// before it was selectable run under Firecracker.
+func hypervisorOf(meta model.VMMetadata) string {
+	if meta.Hypervisor == "" {
+		return model.HypervisorFirecracker
+	}
+	return meta.Hypervisor
+}
+
+func validateResize(req model.UpdateVMRequest) error {
+	if req.VCPU < 0 {
+		return errors.New("vcpu must be > 0")
+	}
+	if req.MemMiB != 0 && req.MemMiB < 128 {
+		return errors.New("memMiB must be >= 128")
+	}
+	return nil
+}
+
+func validateLogPolicy(policy *model.LogPolicy) error {
+	if policy == nil {
+		return nil
+	}
+	if policy.MaxSizeMiB < 0 || policy.MaxAgeDays < 0 || policy.MaxFiles < 0 {
+		return errors.New("logPolicy values must be >= 0")
+	}
 	return nil
 }
 
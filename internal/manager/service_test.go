@@ -1,14 +1,32 @@
 package manager
 
 import (
+	"bufio"
 	"context"
+	"crypto"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"encoding/pem"
 	"errors"
+	"fmt"
+	"io"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
 	"os"
 	"path/filepath"
+	"slices"
 	"strings"
+	"sync"
 	"testing"
+	"time"
 
+	"github.com/alperreha/mergen-fire/internal/certs"
 	"github.com/alperreha/mergen-fire/internal/hooks"
+	"github.com/alperreha/mergen-fire/internal/kernels"
 	"github.com/alperreha/mergen-fire/internal/model"
 	"github.com/alperreha/mergen-fire/internal/network"
 	"github.com/alperreha/mergen-fire/internal/store"
@@ -19,11 +37,19 @@ type fakeSystemd struct {
 	active    map[string]bool
 	startCall int
 	stopCall  int
+	killCall  int
+	stopErr   error
+	// stopHang makes Stop block until its context ends, like a guest that
+	// ignores SIGTERM.
+	stopHang bool
+	// failed makes Status report the unit failed, like a crashed guest.
+	failed map[string]bool
 }
 
 func newFakeSystemd() *fakeSystemd {
 	return &fakeSystemd{
 		active: map[string]bool{},
+		failed: map[string]bool{},
 	}
 }
 
@@ -33,8 +59,21 @@ func (f *fakeSystemd) Start(_ context.Context, id string) error {
 	return nil
 }
 
-func (f *fakeSystemd) Stop(_ context.Context, id string) error {
+func (f *fakeSystemd) Stop(ctx context.Context, id string) error {
 	f.stopCall++
+	if f.stopHang {
+		<-ctx.Done()
+		return ctx.Err()
+	}
+	if f.stopErr != nil {
+		return f.stopErr
+	}
+	f.active[id] = false
+	return nil
+}
+
+func (f *fakeSystemd) Kill(_ context.Context, id string) error {
+	f.killCall++
 	f.active[id] = false
 	return nil
 }
@@ -48,6 +87,9 @@ func (f *fakeSystemd) IsActive(_ context.Context, id string) (bool, error) {
 }
 
 func (f *fakeSystemd) Status(_ context.Context, id string) (systemd.Status, error) {
+	if f.failed[id] {
+		return systemd.Status{Available: true, Unit: "mergen@" + id + ".service", ActiveState: "failed", SubState: "failed"}, nil
+	}
 	return systemd.Status{
 		Available:   true,
 		Unit:        "mergen@" + id + ".service",
@@ -59,39 +101,11 @@ func (f *fakeSystemd) Status(_ context.Context, id string) (systemd.Status, erro
 }
 
 func TestServiceLifecycle_IdempotentStartStop(t *testing.T) {
-	base := t.TempDir()
-
-	fsStore := store.NewFSStore(
-		filepath.Join(base, "etc", "mergen", "vm.d"),
-		filepath.Join(base, "var", "lib", "mergen"),
-		filepath.Join(base, "run", "mergen"),
-		filepath.Join(base, "etc", "mergen", "hooks.d"),
-	)
-	if err := fsStore.EnsureBaseDirs(); err != nil {
-		t.Fatalf("ensure dirs: %v", err)
-	}
-
-	kernelPath := filepath.Join(base, "vmlinux")
-	rootfsPath := filepath.Join(base, "rootfs.ext4")
-	if err := osWrite(kernelPath); err != nil {
-		t.Fatalf("write kernel: %v", err)
-	}
-	if err := osWrite(rootfsPath); err != nil {
-		t.Fatalf("write rootfs: %v", err)
-	}
-
-	fake := newFakeSystemd()
-	service := NewService(
-		fsStore,
-		fake,
-		hooks.NewRunner(nil),
-		network.NewAllocator(20000, 20010, "172.30.0.0/24"),
-		nil,
-	)
+	service, env := newTestService(t, testServiceOptions{})
 
 	id, err := service.CreateVM(context.Background(), model.CreateVMRequest{
-		RootFS: rootfsPath,
-		Kernel: kernelPath,
+		RootFS: env.rootfs,
+		Kernel: env.kernel,
 		VCPU:   1,
 		MemMiB: 512,
 		Ports: []model.PortBindingRequest{
@@ -108,8 +122,8 @@ func TestServiceLifecycle_IdempotentStartStop(t *testing.T) {
 	if err := service.StartVM(context.Background(), id); err != nil {
 		t.Fatalf("start vm second call: %v", err)
 	}
-	if fake.startCall != 1 {
-		t.Fatalf("expected start call 1, got %d", fake.startCall)
+	if env.systemd.startCall != 1 {
+		t.Fatalf("expected start call 1, got %d", env.systemd.startCall)
 	}
 
 	if err := service.StopVM(context.Background(), id); err != nil {
@@ -118,8 +132,8 @@ func TestServiceLifecycle_IdempotentStartStop(t *testing.T) {
 	if err := service.StopVM(context.Background(), id); err != nil {
 		t.Fatalf("stop vm second call: %v", err)
 	}
-	if fake.stopCall != 1 {
-		t.Fatalf("expected stop call 1, got %d", fake.stopCall)
+	if env.systemd.stopCall != 1 {
+		t.Fatalf("expected stop call 1, got %d", env.systemd.stopCall)
 	}
 
 	if err := service.DeleteVM(context.Background(), id, false); err != nil {
@@ -128,38 +142,11 @@ func TestServiceLifecycle_IdempotentStartStop(t *testing.T) {
 }
 
 func TestServiceCreateVM_HTTPPortPersisted(t *testing.T) {
-	base := t.TempDir()
-
-	fsStore := store.NewFSStore(
-		filepath.Join(base, "etc", "mergen", "vm.d"),
-		filepath.Join(base, "var", "lib", "mergen"),
-		filepath.Join(base, "run", "mergen"),
-		filepath.Join(base, "etc", "mergen", "hooks.d"),
-	)
-	if err := fsStore.EnsureBaseDirs(); err != nil {
-		t.Fatalf("ensure dirs: %v", err)
-	}
-
-	kernelPath := filepath.Join(base, "vmlinux")
-	rootfsPath := filepath.Join(base, "rootfs.ext4")
-	if err := osWrite(kernelPath); err != nil {
-		t.Fatalf("write kernel: %v", err)
-	}
-	if err := osWrite(rootfsPath); err != nil {
-		t.Fatalf("write rootfs: %v", err)
-	}
-
-	service := NewService(
-		fsStore,
-		newFakeSystemd(),
-		hooks.NewRunner(nil),
-		network.NewAllocator(20000, 20010, "172.30.0.0/24"),
-		nil,
-	)
+	service, env := newTestService(t, testServiceOptions{})
 
 	id, err := service.CreateVM(context.Background(), model.CreateVMRequest{
-		RootFS:   rootfsPath,
-		Kernel:   kernelPath,
+		RootFS:   env.rootfs,
+		Kernel:   env.kernel,
 		VCPU:     1,
 		MemMiB:   512,
 		HTTPPort: 80,
@@ -171,7 +158,7 @@ func TestServiceCreateVM_HTTPPortPersisted(t *testing.T) {
 		t.Fatalf("create vm: %v", err)
 	}
 
-	meta, err := fsStore.ReadMeta(id)
+	meta, err := env.store.ReadMeta(id)
 	if err != nil {
 		t.Fatalf("read meta: %v", err)
 	}
@@ -188,39 +175,71 @@ func TestServiceCreateVM_HTTPPortPersisted(t *testing.T) {
 	}
 }
 
-func TestServiceCreateVM_HTTPPortRangeValidation(t *testing.T) {
-	base := t.TempDir()
+func TestServiceCreateVM_HTTPPortFromImageMeta(t *testing.T) {
+	service, env := newTestService(t, testServiceOptions{})
+	rootfsPath := filepath.Join(env.base, "nginx", "rootfs.ext4")
+	if err := os.MkdirAll(filepath.Dir(rootfsPath), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	if err := osWrite(rootfsPath); err != nil {
+		t.Fatalf("write rootfs: %v", err)
+	}
+	if err := os.WriteFile(filepath.Join(env.base, "nginx", "image-meta.json"), []byte(`{"image":"nginx:alpine","suggestedHTTPPort":8080}`), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
 
-	fsStore := store.NewFSStore(
-		filepath.Join(base, "etc", "mergen", "vm.d"),
-		filepath.Join(base, "var", "lib", "mergen"),
-		filepath.Join(base, "run", "mergen"),
-		filepath.Join(base, "etc", "mergen", "hooks.d"),
-	)
-	if err := fsStore.EnsureBaseDirs(); err != nil {
-		t.Fatalf("ensure dirs: %v", err)
+	id, err := service.CreateVM(ctx, model.CreateVMRequest{RootFS: rootfsPath, Kernel: env.kernel, VCPU: 1, MemMiB: 128})
+	if err != nil {
+		t.Fatalf("create vm: %v", err)
+	}
+	meta, err := env.store.ReadMeta(id)
+	if err != nil {
+		t.Fatalf("read meta: %v", err)
+	}
+	if meta.HTTPPort != 8080 || len(meta.Ports) != 1 || meta.Ports[0].Guest != 8080 {
+		t.Fatalf("expected httpPort and binding from image metadata, got %d %+v", meta.HTTPPort, meta.Ports)
 	}
 
-	kernelPath := filepath.Join(base, "vmlinux")
-	rootfsPath := filepath.Join(base, "rootfs.ext4")
-	if err := osWrite(kernelPath); err != nil {
-		t.Fatalf("write kernel: %v", err)
+	id, err = service.CreateVM(ctx, model.CreateVMRequest{RootFS: rootfsPath, Kernel: env.kernel, VCPU: 1, MemMiB: 128, HTTPPort: 80})
+	if err != nil {
+		t.Fatalf("create vm: %v", err)
 	}
-	if err := osWrite(rootfsPath); err != nil {
-		t.Fatalf("write rootfs: %v", err)
+	if meta, err = env.store.ReadMeta(id); err != nil || meta.HTTPPort != 80 || len(meta.Ports) != 0 {
+		t.Fatalf("expected the request's httpPort to win, got %d %+v err=%v", meta.HTTPPort, meta.Ports, err)
+	}
+}
+
+func TestServiceImageEnvWarnings(t *testing.T) {
+	base := t.TempDir()
+	rootfsPath := filepath.Join(base, "postgres", "rootfs.ext4")
+	if err := os.MkdirAll(filepath.Dir(rootfsPath), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	required := `{"image":"postgres:16","variables":[
+		{"name":"POSTGRES_PASSWORD","required":true,"sources":["/usr/local/bin/docker-entrypoint.sh"]},
+		{"name":"POSTGRES_USER","required":false,"sources":["/usr/local/bin/docker-entrypoint.sh"]}]}`
+	if err := os.WriteFile(filepath.Join(base, "postgres", "required-env.json"), []byte(required), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	service := NewService(nil, newFakeSystemd(), hooks.NewRunner(nil), nil, nil)
+	ctx := context.Background()
+
+	warnings := service.ImageEnvWarnings(ctx, model.CreateVMRequest{RootFS: rootfsPath, GuestEnv: map[string]string{"POSTGRES_USER": "app"}})
+	if len(warnings) != 1 || !strings.Contains(warnings[0], "POSTGRES_PASSWORD") || !strings.Contains(warnings[0], "needs") {
+		t.Fatalf("ImageEnvWarnings() = %q, want one for POSTGRES_PASSWORD", warnings)
 	}
+	if warnings := service.ImageEnvWarnings(ctx, model.CreateVMRequest{RootFS: filepath.Join(base, "rootfs.ext4")}); warnings != nil {
+		t.Fatalf("ImageEnvWarnings() without required-env.json = %q, want none", warnings)
+	}
+}
 
-	service := NewService(
-		fsStore,
-		newFakeSystemd(),
-		hooks.NewRunner(nil),
-		network.NewAllocator(20000, 20010, "172.30.0.0/24"),
-		nil,
-	)
+func TestServiceCreateVM_HTTPPortRangeValidation(t *testing.T) {
+	service, env := newTestService(t, testServiceOptions{})
 
 	_, err := service.CreateVM(context.Background(), model.CreateVMRequest{
-		RootFS:   rootfsPath,
-		Kernel:   kernelPath,
+		RootFS:   env.rootfs,
+		Kernel:   env.kernel,
 		VCPU:     1,
 		MemMiB:   512,
 		HTTPPort: 70000,
@@ -236,3 +255,1770 @@ func TestServiceCreateVM_HTTPPortRangeValidation(t *testing.T) {
 func osWrite(path string) error {
 	return os.WriteFile(path, []byte("x"), 0o600)
 }
+
+type testServiceOptions struct {
+	hooks *hooks.Runner
+	// store wraps the VM store, e.g. to report other hosts.
+	store func(*store.FSStore) Store
+}
+
+type testServiceEnv struct {
+	base    string
+	store   *store.FSStore
+	systemd *fakeSystemd
+	kernel  string
+	rootfs  string
+}
+
+// newTestService builds a service over a fresh store, a fake systemd and
+// stub kernel and rootfs files. The store lives under a short temp dir
+// because t.TempDir paths overflow the unix socket path limit.
+func newTestService(t *testing.T, opts testServiceOptions) (*Service, testServiceEnv) {
+	t.Helper()
+	base, err := os.MkdirTemp("", "mergen-")
+	if err != nil {
+		t.Fatalf("temp dir: %v", err)
+	}
+	t.Cleanup(func() { os.RemoveAll(base) })
+
+	env := testServiceEnv{
+		base: base,
+		store: store.NewFSStore(
+			filepath.Join(base, "etc", "mergen", "vm.d"),
+			filepath.Join(base, "var", "lib", "mergen"),
+			filepath.Join(base, "run", "mergen"),
+			filepath.Join(base, "etc", "mergen", "hooks.d"),
+		),
+		systemd: newFakeSystemd(),
+		kernel:  filepath.Join(base, "vmlinux"),
+		rootfs:  filepath.Join(base, "rootfs.ext4"),
+	}
+	if err := env.store.EnsureBaseDirs(); err != nil {
+		t.Fatalf("ensure dirs: %v", err)
+	}
+	for _, path := range []string{env.kernel, env.rootfs} {
+		if err := osWrite(path); err != nil {
+			t.Fatalf("write %s: %v", path, err)
+		}
+	}
+
+	runner := opts.hooks
+	if runner == nil {
+		runner = hooks.NewRunner(nil)
+	}
+	var vmStore Store = env.store
+	if opts.store != nil {
+		vmStore = opts.store(env.store)
+	}
+	return NewService(vmStore, env.systemd, runner, network.NewAllocator(20000, 20010, "172.30.0.0/24"), nil), env
+}
+
+func TestServiceTestHook_DryRunRendersSelectedHook(t *testing.T) {
+	service, env := newTestService(t, testServiceOptions{})
+
+	id, err := service.CreateVM(context.Background(), model.CreateVMRequest{
+		RootFS: env.rootfs,
+		Kernel: env.kernel,
+		VCPU:   1,
+		MemMiB: 512,
+		Ports: []model.PortBindingRequest{
+			{Guest: 80, Host: 20005},
+		},
+		Hooks: map[string][]model.HookEntry{
+			model.HookOnStart: {{Type: "http", URL: "http://127.0.0.1:1/register?port={{ hostPort 80 }}"}},
+		},
+	})
+	if err != nil {
+		t.Fatalf("create vm: %v", err)
+	}
+
+	result, err := service.TestHook(context.Background(), id, model.HookTestRequest{Event: model.HookOnStart, DryRun: true})
+	if err != nil {
+		t.Fatalf("test hook: %v", err)
+	}
+	if result.Rendered.URL != "http://127.0.0.1:1/register?port=20005" {
+		t.Fatalf("unexpected rendered url: %q", result.Rendered.URL)
+	}
+	if result.Execution != nil {
+		t.Fatalf("dry run must not execute the hook")
+	}
+
+	_, err = service.TestHook(context.Background(), id, model.HookTestRequest{Event: model.HookOnStart, Index: 3})
+	if !errors.Is(err, ErrInvalidRequest) {
+		t.Fatalf("expected invalid request for out of range index, got %v", err)
+	}
+}
+
+func TestServiceUpdateVM_RequiresMatchingRevision(t *testing.T) {
+	service, env := newTestService(t, testServiceOptions{})
+
+	id, err := service.CreateVM(context.Background(), model.CreateVMRequest{
+		RootFS: env.rootfs,
+		Kernel: env.kernel,
+		VCPU:   1,
+		MemMiB: 512,
+		Tags:   map[string]string{"app": "web"},
+	})
+	if err != nil {
+		t.Fatalf("create vm: %v", err)
+	}
+
+	update := model.UpdateVMRequest{Tags: map[string]string{"app": "api"}}
+	if _, err := service.UpdateVM(context.Background(), id, nil, update); !errors.Is(err, ErrPreconditionRequired) {
+		t.Fatalf("expected precondition required, got %v", err)
+	}
+
+	stale := int64(7)
+	if _, err := service.UpdateVM(context.Background(), id, &stale, update); !errors.Is(err, ErrPreconditionFailed) {
+		t.Fatalf("expected precondition failed, got %v", err)
+	}
+
+	current := int64(1)
+	vm, err := service.UpdateVM(context.Background(), id, &current, update)
+	if err != nil {
+		t.Fatalf("update vm: %v", err)
+	}
+	if vm.Revision != 2 || vm.Tags["app"] != "api" {
+		t.Fatalf("unexpected vm after update: revision=%d tags=%v", vm.Revision, vm.Tags)
+	}
+
+	if _, err := service.UpdateVM(context.Background(), id, &current, update); !errors.Is(err, ErrPreconditionFailed) {
+		t.Fatalf("expected second writer with old revision to fail, got %v", err)
+	}
+}
+
+func TestServiceUpdateVM_Resize(t *testing.T) {
+	service, env := newTestService(t, testServiceOptions{})
+	ctx := context.Background()
+
+	id, err := service.CreateVM(ctx, model.CreateVMRequest{RootFS: env.rootfs, Kernel: env.kernel, VCPU: 1, MemMiB: 128, AutoStart: true})
+	if err != nil {
+		t.Fatalf("create: %v", err)
+	}
+	before, err := env.store.ReadMeta(id)
+	if err != nil {
+		t.Fatalf("read meta: %v", err)
+	}
+
+	if _, err := service.UpdateVM(ctx, id, &before.Revision, model.UpdateVMRequest{MemMiB: 64}); !errors.Is(err, ErrInvalidRequest) {
+		t.Fatalf("expected too little memory to be rejected, got %v", err)
+	}
+	vm, err := service.UpdateVM(ctx, id, &before.Revision, model.UpdateVMRequest{VCPU: 2, MemMiB: 1024, BootArgs: "console=ttyS0 quiet"})
+	if err != nil {
+		t.Fatalf("resize: %v", err)
+	}
+	cfg, err := env.store.ReadVMConfig(id)
+	if err != nil {
+		t.Fatalf("read vm config: %v", err)
+	}
+	if cfg.MachineConfig.VCPUCount != 2 || cfg.MachineConfig.MemSizeMiB != 1024 {
+		t.Fatalf("machine config not rewritten: %+v", cfg.MachineConfig)
+	}
+	if want := "console=ttyS0 quiet ip=" + before.GuestIP; !strings.HasPrefix(cfg.BootSource.BootArgs, want) {
+		t.Fatalf("boot args %q, want prefix %q", cfg.BootSource.BootArgs, want)
+	}
+	if vm.Revision != before.Revision+1 || vm.Network.GuestIP != before.GuestIP || env.systemd.startCall != 1 {
+		t.Fatalf("resize without restart: revision %d ip %s starts %d", vm.Revision, vm.Network.GuestIP, env.systemd.startCall)
+	}
+
+	vm, err = service.UpdateVM(ctx, id, &vm.Revision, model.UpdateVMRequest{VCPU: 4, Restart: true})
+	if err != nil {
+		t.Fatalf("resize with restart: %v", err)
+	}
+	if env.systemd.stopCall != 1 || env.systemd.startCall != 2 || !vm.Systemd.Active {
+		t.Fatalf("expected restart, stops %d starts %d active %v", env.systemd.stopCall, env.systemd.startCall, vm.Systemd.Active)
+	}
+}
+
+func TestServiceCreateVM_HostCapacity(t *testing.T) {
+	service, env := newTestService(t, testServiceOptions{})
+	service.WithCapacity(CapacityPolicy{VCPUs: 2, MemMiB: 2048, CPUOvercommit: 2, MemoryOvercommit: 1})
+	ctx := context.Background()
+
+	// Eight creates race for four vCPUs; exactly four may pass.
+	var wg sync.WaitGroup
+	errs := make([]error, 8)
+	for i := range errs {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			_, errs[i] = service.CreateVM(ctx, model.CreateVMRequest{RootFS: env.rootfs, Kernel: env.kernel, VCPU: 1, MemMiB: 128})
+		}(i)
+	}
+	wg.Wait()
+	created, refused := 0, 0
+	for _, err := range errs {
+		switch {
+		case err == nil:
+			created++
+		case errors.Is(err, ErrNoCapacity):
+			refused++
+		default:
+			t.Fatalf("create: %v", err)
+		}
+	}
+	if created != 4 || refused != 4 {
+		t.Fatalf("created %d and refused %d of 8 creates, want 4 and 4", created, refused)
+	}
+
+	capacity, err := service.HostCapacity(ctx)
+	if err != nil {
+		t.Fatalf("host capacity: %v", err)
+	}
+	want := model.CapacityUsage{VCPUs: 4, MemMiB: 512}
+	if capacity.Committed != want || capacity.Allocatable != (model.CapacityUsage{VCPUs: 4, MemMiB: 2048}) || capacity.VMs != 4 {
+		t.Fatalf("unexpected capacity %+v", capacity)
+	}
+
+	vms, err := env.store.ListMetas()
+	if err != nil {
+		t.Fatalf("list metas: %v", err)
+	}
+	meta := vms[0]
+	if _, err := service.UpdateVM(ctx, meta.ID, &meta.Revision, model.UpdateVMRequest{MemMiB: 2048}); !errors.Is(err, ErrNoCapacity) {
+		t.Fatalf("expected a resize past host memory to be refused, got %v", err)
+	}
+	if _, err := service.UpdateVM(ctx, meta.ID, &meta.Revision, model.UpdateVMRequest{MemMiB: 1024}); err != nil {
+		t.Fatalf("resize within host memory: %v", err)
+	}
+}
+
+func TestServiceRecreateVM_PreservesAllocations(t *testing.T) {
+	service, env := newTestService(t, testServiceOptions{})
+	upgradedPath := filepath.Join(env.base, "rootfs-v2.ext4")
+	if err := osWrite(upgradedPath); err != nil {
+		t.Fatalf("write rootfs: %v", err)
+	}
+	ctx := context.Background()
+
+	id, err := service.CreateVM(ctx, model.CreateVMRequest{
+		RootFS:      env.rootfs,
+		Kernel:      env.kernel,
+		VCPU:        2,
+		MemMiB:      256,
+		Ports:       []model.PortBindingRequest{{Guest: 80}},
+		ExtraEnv:    map[string]string{"APP_MODE": "prod"},
+		GuestEnv:    map[string]string{"DATABASE_URL": "postgres://db"},
+		GuestEnvVia: "mmds",
+		Tags:        map[string]string{"app": "web"},
+		AutoStart:   true,
+	})
+	if err != nil {
+		t.Fatalf("create: %v", err)
+	}
+	if _, err := service.CreateVM(ctx, model.CreateVMRequest{RootFS: env.rootfs, Kernel: env.kernel, VCPU: 1, MemMiB: 128, Ports: []model.PortBindingRequest{{Guest: 80}}}); err != nil {
+		t.Fatalf("create neighbour: %v", err)
+	}
+	before, err := env.store.ReadMeta(id)
+	if err != nil {
+		t.Fatalf("read meta: %v", err)
+	}
+
+	vm, err := service.RecreateVM(ctx, id, model.RecreateVMRequest{RootFS: upgradedPath, PreserveAllocations: true})
+	if err != nil {
+		t.Fatalf("recreate: %v", err)
+	}
+	if vm.ID == id {
+		t.Fatalf("expected a new vm id, got the old one")
+	}
+	if _, err := env.store.ReadMeta(id); !errors.Is(err, store.ErrNotFound) {
+		t.Fatalf("expected the old vm to be deleted, got %v", err)
+	}
+	after, err := env.store.ReadMeta(vm.ID)
+	if err != nil {
+		t.Fatalf("read new meta: %v", err)
+	}
+	if after.GuestIP != before.GuestIP || network.MACOf(after) != network.MACOf(before) || after.TapName != before.TapName || after.NetNS != before.NetNS {
+		t.Fatalf("allocations not kept: before %+v after %+v", before, after)
+	}
+	if len(after.Ports) != 1 || after.Ports[0] != before.Ports[0] {
+		t.Fatalf("ports %+v, want %+v", after.Ports, before.Ports)
+	}
+	if after.RootFS != upgradedPath || after.Tags["app"] != "web" {
+		t.Fatalf("spec not carried over: rootfs %s tags %v", after.RootFS, after.Tags)
+	}
+	cfg, err := env.store.ReadVMConfig(vm.ID)
+	if err != nil {
+		t.Fatalf("read vm config: %v", err)
+	}
+	if cfg.MachineConfig.VCPUCount != 2 || cfg.MachineConfig.MemSizeMiB != 256 || strings.Count(cfg.BootSource.BootArgs, "ip=") != 1 {
+		t.Fatalf("config not carried over: %+v %q", cfg.MachineConfig, cfg.BootSource.BootArgs)
+	}
+	if vars := mmdsGuestEnv(cfg); vars["DATABASE_URL"] != "postgres://db" {
+		t.Fatalf("guest env not carried over: %v", cfg.MMDS)
+	}
+	vmEnv, err := env.store.ReadEnv(vm.ID)
+	if err != nil || vmEnv["APP_MODE"] != "prod" || vmEnv["MGN_VM_ID"] != vm.ID {
+		t.Fatalf("env %v, err %v", vmEnv, err)
+	}
+	if !vm.Systemd.Active {
+		t.Fatalf("expected the new vm to be started like the old one")
+	}
+	history, err := service.StateHistory(ctx, vm.ID, 0)
+	if err != nil || len(history) == 0 || history[len(history)-1].Detail != "recreated from "+id {
+		t.Fatalf("history %+v, err %v", history, err)
+	}
+}
+
+type clusterStore struct {
+	*store.FSStore
+	hosts []model.HostInfo
+}
+
+func (s clusterStore) ListHosts() ([]model.HostInfo, error) {
+	return s.hosts, nil
+}
+
+func TestServiceCreateVM_Placement(t *testing.T) {
+	local := model.HostInfo{Name: "cpu-1", Labels: map[string]string{"zone": "a"}}
+	gpuHost := model.HostInfo{Name: "gpu-1", Labels: map[string]string{"zone": "a", "gpu": "true"}, URL: "http://gpu-1:8080"}
+	service, env := newTestService(t, testServiceOptions{
+		store: func(fsStore *store.FSStore) Store {
+			return clusterStore{FSStore: fsStore, hosts: []model.HostInfo{local, gpuHost}}
+		},
+	})
+	service.WithHost(local)
+	req := model.CreateVMRequest{RootFS: env.rootfs, Kernel: env.kernel, VCPU: 1, MemMiB: 128}
+
+	req.Placement = &model.Placement{HostLabels: map[string]string{"gpu": "true"}}
+	_, err := service.CreateVM(context.Background(), req)
+	var placed *PlacementError
+	if !errors.As(err, &placed) || placed.Host.Name != "gpu-1" {
+		t.Fatalf("expected placement on gpu-1, got %v", err)
+	}
+	if _, err := service.CreateVM(WithScheduledHost(context.Background(), "cpu-1"), req); !errors.Is(err, ErrConflict) {
+		t.Fatalf("expected conflict when forwarded here without the label, got %v", err)
+	}
+
+	req.Placement = &model.Placement{HostLabels: map[string]string{"zone": "a"}}
+	id, err := service.CreateVM(context.Background(), req)
+	if err != nil {
+		t.Fatalf("create: %v", err)
+	}
+	meta, err := env.store.ReadMeta(id)
+	if err != nil || meta.Host != "cpu-1" {
+		t.Fatalf("expected vm recorded on cpu-1, got %q err=%v", meta.Host, err)
+	}
+
+	req.Placement = &model.Placement{HostLabels: map[string]string{"kvm": "nested"}}
+	if _, err := service.CreateVM(context.Background(), req); !errors.Is(err, ErrConflict) {
+		t.Fatalf("expected conflict for unsatisfiable placement, got %v", err)
+	}
+}
+
+func TestServiceCreateVM_KernelByName(t *testing.T) {
+	service, env := newTestService(t, testServiceOptions{})
+	kernelPath := filepath.Join(env.base, "vmlinux-5.10")
+	initrdPath := filepath.Join(env.base, "initrd-5.10.img")
+	for _, path := range []string{kernelPath, initrdPath} {
+		if err := osWrite(path); err != nil {
+			t.Fatalf("write %s: %v", path, err)
+		}
+	}
+	service.WithKernels(kernels.NewCatalog(filepath.Join(env.base, "etc", "mergen", "kernels.json")))
+	ctx := context.Background()
+	if _, err := service.PutKernel(ctx, model.Kernel{Name: "5.10-minimal", Path: kernelPath, Initrd: initrdPath, BootArgs: "console=ttyS0 quiet"}); err != nil {
+		t.Fatalf("put kernel: %v", err)
+	}
+
+	id, err := service.CreateVM(ctx, model.CreateVMRequest{RootFS: env.rootfs, Kernel: "5.10-minimal", VCPU: 1, MemMiB: 128})
+	if err != nil {
+		t.Fatalf("create vm: %v", err)
+	}
+	meta, err := env.store.ReadMeta(id)
+	if err != nil || meta.Kernel != kernelPath || meta.KernelName != "5.10-minimal" {
+		t.Fatalf("expected kernel resolved from the catalog, got %q (%q) err=%v", meta.Kernel, meta.KernelName, err)
+	}
+	cfg, err := env.store.ReadVMConfig(id)
+	if err != nil || !strings.HasPrefix(cfg.BootSource.BootArgs, "console=ttyS0 quiet") {
+		t.Fatalf("expected catalog boot args, got %q err=%v", cfg.BootSource.BootArgs, err)
+	}
+	if cfg.BootSource.InitrdPath != initrdPath || meta.Initrd != initrdPath || meta.Artifacts[model.ArtifactInitrd].SHA256 == "" {
+		t.Fatalf("expected the catalog initrd recorded and in the boot source, got %q %q", cfg.BootSource.InitrdPath, meta.Initrd)
+	}
+	if _, err := service.CreateVM(ctx, model.CreateVMRequest{RootFS: env.rootfs, Kernel: kernelPath, Initrd: filepath.Join(env.base, "missing.img"), VCPU: 1, MemMiB: 128}); !errors.Is(err, ErrInvalidRequest) {
+		t.Fatalf("expected invalid request for a missing initrd, got %v", err)
+	}
+
+	if _, err := service.CreateVM(ctx, model.CreateVMRequest{RootFS: env.rootfs, Kernel: "6.1", VCPU: 1, MemMiB: 128}); !errors.Is(err, ErrInvalidRequest) {
+		t.Fatalf("expected invalid request for an unknown kernel, got %v", err)
+	}
+	foreign := kernels.ArchAarch64
+	if kernels.HostArch() == foreign {
+		foreign = kernels.ArchX86_64
+	}
+	if _, err := service.PutKernel(ctx, model.Kernel{Name: "foreign", Path: kernelPath, Arch: foreign}); err != nil {
+		t.Fatalf("put kernel: %v", err)
+	}
+	if _, err := service.CreateVM(ctx, model.CreateVMRequest{RootFS: env.rootfs, Kernel: "foreign", VCPU: 1, MemMiB: 128}); !errors.Is(err, ErrConflict) {
+		t.Fatalf("expected conflict for a kernel of another arch, got %v", err)
+	}
+}
+
+func TestServiceCreateVM_RootFSGrownToSize(t *testing.T) {
+	service, env := newTestService(t, testServiceOptions{})
+	imagePath := filepath.Join(env.base, "image.ext4")
+	if err := os.WriteFile(imagePath, make([]byte, 2<<20), 0o600); err != nil {
+		t.Fatalf("write image: %v", err)
+	}
+	req := model.CreateVMRequest{RootFS: imagePath, Kernel: env.kernel, VCPU: 1, MemMiB: 128, RootFSSizeMiB: 64}
+
+	id, err := service.CreateVM(context.Background(), req)
+	if err != nil {
+		t.Fatalf("create vm: %v", err)
+	}
+	meta, err := env.store.ReadMeta(id)
+	if err != nil {
+		t.Fatalf("read meta: %v", err)
+	}
+	if meta.RootFSImage != imagePath || filepath.Dir(meta.RootFS) != meta.Paths.DataDir {
+		t.Fatalf("expected rootfs copied into the data dir, got rootfs=%q image=%q", meta.RootFS, meta.RootFSImage)
+	}
+	if info, err := os.Stat(meta.RootFS); err != nil || info.Size() != 64<<20 {
+		t.Fatalf("expected 64 MiB rootfs, got %v %v", info, err)
+	}
+	if info, _ := os.Stat(imagePath); info.Size() != 2<<20 {
+		t.Fatalf("expected image untouched, got %d bytes", info.Size())
+	}
+	cfg, err := env.store.ReadVMConfig(id)
+	if err != nil || cfg.Drives[0].PathOnHost != meta.RootFS || !strings.Contains(cfg.BootSource.BootArgs, "mergen.growroot=1") {
+		t.Fatalf("expected grown rootfs attached with growroot, got %+v %v", cfg, err)
+	}
+
+	req.RootFSSizeMiB = 1
+	if _, err := service.CreateVM(context.Background(), req); !errors.Is(err, ErrInvalidRequest) {
+		t.Fatalf("expected invalid request below the image size, got %v", err)
+	}
+	req.RootFSSizeMiB, req.RootReadOnly = 64, true
+	if _, err := service.CreateVM(context.Background(), req); !errors.Is(err, ErrInvalidRequest) {
+		t.Fatalf("expected invalid request for a read-only root, got %v", err)
+	}
+}
+
+func TestServiceStackLifecycle(t *testing.T) {
+	service, env := newTestService(t, testServiceOptions{})
+	ctx := context.Background()
+	vm := model.CreateVMRequest{RootFS: env.rootfs, Kernel: env.kernel, VCPU: 1, MemMiB: 128}
+
+	// app is listed first but links to db, so db is created first.
+	manifest := model.StackManifest{Name: "shop", Members: []model.StackMember{
+		{Name: "app", VM: vm, Links: map[string]string{"DB_HOST": "db"}},
+		{Name: "db", VM: vm},
+	}}
+	stack, err := service.CreateStack(ctx, manifest)
+	if err != nil {
+		t.Fatalf("create stack: %v", err)
+	}
+	if len(stack.Members) != 2 || stack.Members[0].Name != "db" || stack.Members[1].Name != "app" || stack.Status != model.StackStopped {
+		t.Fatalf("unexpected stack: %+v", stack)
+	}
+	cfg, err := env.store.ReadVMConfig(stack.Members[1].VMID)
+	if err != nil {
+		t.Fatalf("read app config: %v", err)
+	}
+	if !strings.Contains(cfg.BootSource.BootArgs, "mergen.env=") {
+		t.Fatalf("expected DB_HOST in the app's guest env, got %q", cfg.BootSource.BootArgs)
+	}
+	if _, err := service.CreateStack(ctx, manifest); !errors.Is(err, ErrConflict) {
+		t.Fatalf("expected conflict for an existing stack, got %v", err)
+	}
+
+	stack, err = service.StartStack(ctx, "shop")
+	if err != nil || stack.Status != model.StackRunning {
+		t.Fatalf("start stack: %+v %v", stack, err)
+	}
+	if err := env.systemd.Stop(ctx, stack.Members[1].VMID); err != nil {
+		t.Fatal(err)
+	}
+	if stack, err = service.GetStack(ctx, "shop"); err != nil || stack.Status != model.StackDegraded {
+		t.Fatalf("expected degraded stack, got %+v %v", stack, err)
+	}
+	if err := service.DeleteStack(ctx, "shop", false); err != nil {
+		t.Fatalf("delete stack: %v", err)
+	}
+	if _, err := service.GetStack(ctx, "shop"); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("expected deleted stack to be gone, got %v", err)
+	}
+
+	cyclic := model.StackManifest{Name: "loop", Members: []model.StackMember{
+		{Name: "a", VM: vm, Links: map[string]string{"B_HOST": "b"}},
+		{Name: "b", VM: vm, Links: map[string]string{"A_HOST": "a"}},
+	}}
+	if _, err := service.CreateStack(ctx, cyclic); !errors.Is(err, ErrInvalidRequest) {
+		t.Fatalf("expected cyclic links to be rejected, got %v", err)
+	}
+}
+
+func TestServiceAdoptVM(t *testing.T) {
+	service, env := newTestService(t, testServiceOptions{})
+	socketPath := filepath.Join(env.base, "legacy.sock")
+	listener, err := net.Listen("unix", socketPath)
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	defer listener.Close()
+	ctx := context.Background()
+
+	req := model.AdoptVMRequest{
+		Unit:       "legacy-web.service",
+		SocketPath: socketPath,
+		TapName:    "tap-legacy",
+		GuestIP:    "172.30.0.2",
+		Ports:      []model.PortBinding{{Guest: 80, Host: 20000}},
+		VCPU:       2,
+		MemMiB:     256,
+	}
+	missing := req
+	missing.SocketPath = filepath.Join(env.base, "missing.sock")
+	if _, err := service.AdoptVM(ctx, missing); !errors.Is(err, ErrInvalidRequest) {
+		t.Fatalf("AdoptVM() without a socket error = %v, want ErrInvalidRequest", err)
+	}
+
+	id, err := service.AdoptVM(ctx, req)
+	if err != nil {
+		t.Fatalf("AdoptVM() error = %v", err)
+	}
+	meta, err := env.store.ReadMeta(id)
+	if err != nil {
+		t.Fatalf("read meta: %v", err)
+	}
+	if meta.Unit != req.Unit || meta.Paths.SocketPath != socketPath || meta.Ports[0].Protocol != "tcp" {
+		t.Fatalf("unexpected adopted meta: %+v", meta)
+	}
+	vm, err := service.GetVM(ctx, id)
+	if err != nil || !vm.Firecracker.SocketPresent {
+		t.Fatalf("GetVM() = %+v, %v; want the adopted socket present", vm.Firecracker, err)
+	}
+
+	again := req
+	again.Unit = "legacy-api.service"
+	again.SocketPath = filepath.Join(env.base, "other.sock")
+	other, err := net.Listen("unix", again.SocketPath)
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	defer other.Close()
+	again.TapName = ""
+	again.Ports = nil
+	if _, err := service.AdoptVM(ctx, again); !errors.Is(err, ErrConflict) {
+		t.Fatalf("AdoptVM() with a taken guest ip error = %v, want ErrConflict", err)
+	}
+
+	// The allocator skips what the adopted VM holds.
+	created, err := service.CreateVM(ctx, model.CreateVMRequest{
+		RootFS: env.rootfs, Kernel: env.kernel, VCPU: 1, MemMiB: 128,
+		Ports: []model.PortBindingRequest{{Guest: 80}},
+	})
+	if err != nil {
+		t.Fatalf("CreateVM() error = %v", err)
+	}
+	createdMeta, err := env.store.ReadMeta(created)
+	if err != nil {
+		t.Fatalf("read meta: %v", err)
+	}
+	if createdMeta.GuestIP == req.GuestIP || createdMeta.Ports[0].Host == 20000 {
+		t.Fatalf("allocator reused adopted resources: %+v", createdMeta)
+	}
+	createdCfg, err := env.store.ReadVMConfig(created)
+	if err != nil || createdMeta.GuestMAC != "02:FC:00:00:00:01" || createdCfg.NetworkInterfaces[0].GuestMAC != createdMeta.GuestMAC {
+		t.Fatalf("expected the first mac under the default prefix, got %q / %+v err=%v", createdMeta.GuestMAC, createdCfg.NetworkInterfaces, err)
+	}
+}
+
+func TestServiceStartVM_RemovesStaleSocket(t *testing.T) {
+	service, env := newTestService(t, testServiceOptions{})
+	ctx := context.Background()
+
+	id, err := service.CreateVM(ctx, model.CreateVMRequest{RootFS: env.rootfs, Kernel: env.kernel, VCPU: 1, MemMiB: 128})
+	if err != nil {
+		t.Fatalf("create vm: %v", err)
+	}
+	meta, err := env.store.ReadMeta(id)
+	if err != nil {
+		t.Fatalf("read meta: %v", err)
+	}
+	// Closing without unlinking leaves the file behind the way a crashed
+	// Firecracker does.
+	listener, err := net.Listen("unix", meta.Paths.SocketPath)
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	listener.(*net.UnixListener).SetUnlinkOnClose(false)
+	listener.Close()
+
+	vm, err := service.GetVM(ctx, id)
+	if err != nil {
+		t.Fatalf("GetVM() error = %v", err)
+	}
+	if !vm.Firecracker.SocketStale || vm.Firecracker.SocketPresent {
+		t.Fatalf("GetVM() firecracker = %+v, want a stale socket reported as not present", vm.Firecracker)
+	}
+
+	if err := service.StartVM(ctx, id); err != nil {
+		t.Fatalf("StartVM() error = %v", err)
+	}
+	if _, err := os.Stat(meta.Paths.SocketPath); !errors.Is(err, os.ErrNotExist) {
+		t.Fatalf("stale socket still present after start: %v", err)
+	}
+	if env.systemd.startCall != 1 {
+		t.Fatalf("expected start call 1, got %d", env.systemd.startCall)
+	}
+}
+
+func TestServiceGetVM_ReportsReplacedBootFiles(t *testing.T) {
+	service, env := newTestService(t, testServiceOptions{})
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	id, err := service.CreateVM(ctx, model.CreateVMRequest{RootFS: env.rootfs, Kernel: env.kernel, VCPU: 1, MemMiB: 128})
+	if err != nil {
+		t.Fatalf("create vm: %v", err)
+	}
+	vm, err := service.GetVM(ctx, id)
+	if err != nil {
+		t.Fatalf("GetVM() error = %v", err)
+	}
+	if len(vm.BootFiles) != 0 {
+		t.Fatalf("stopped vm boot files = %+v, want none", vm.BootFiles)
+	}
+	if err := service.StartVM(ctx, id); err != nil {
+		t.Fatalf("start vm: %v", err)
+	}
+	vm, err = service.GetVM(ctx, id)
+	if err != nil {
+		t.Fatalf("GetVM() error = %v", err)
+	}
+	if len(vm.BootFiles) != 2 || vm.BootFiles[0].Status != model.BootFileUnchanged || vm.BootFiles[1].Status != model.BootFileUnchanged {
+		t.Fatalf("boot files after start = %+v, want rootfs and kernel unchanged", vm.BootFiles)
+	}
+
+	events, err := service.Watch(ctx)
+	if err != nil {
+		t.Fatalf("watch: %v", err)
+	}
+	replacement := env.rootfs + ".new"
+	if err := osWrite(replacement); err != nil {
+		t.Fatalf("write replacement: %v", err)
+	}
+	if err := os.Rename(replacement, env.rootfs); err != nil {
+		t.Fatalf("replace rootfs: %v", err)
+	}
+	vm, err = service.GetVM(ctx, id)
+	if err != nil {
+		t.Fatalf("GetVM() error = %v", err)
+	}
+	if vm.BootFiles[0].Role != "rootfs" || vm.BootFiles[0].Status != model.BootFileReplaced || vm.BootFiles[0].Since == nil {
+		t.Fatalf("rootfs boot file = %+v, want replaced", vm.BootFiles[0])
+	}
+	if vm.BootFiles[1].Status != model.BootFileUnchanged {
+		t.Fatalf("kernel boot file = %+v, want unchanged", vm.BootFiles[1])
+	}
+
+	timeout := time.After(2 * time.Second)
+	for {
+		select {
+		case event := <-events:
+			if event.Type == model.StoreEventBootFileChanged && event.ID == id {
+				return
+			}
+		case <-timeout:
+			t.Fatal("no bootFileChanged event")
+		}
+	}
+}
+
+func TestServiceDeleteVM_ResumesFromFailedStep(t *testing.T) {
+	service, env := newTestService(t, testServiceOptions{})
+	ctx := context.Background()
+
+	id, err := service.CreateVM(ctx, model.CreateVMRequest{RootFS: env.rootfs, Kernel: env.kernel, VCPU: 1, MemMiB: 128})
+	if err != nil {
+		t.Fatalf("create vm: %v", err)
+	}
+	if err := service.StartVM(ctx, id); err != nil {
+		t.Fatalf("start vm: %v", err)
+	}
+
+	env.systemd.stopErr = errors.New("unit stuck")
+	err = service.DeleteVM(ctx, id, false)
+	if err == nil || !strings.Contains(err.Error(), "delete step stop") {
+		t.Fatalf("DeleteVM() error = %v, want stop step failure", err)
+	}
+	vm, err := service.GetVM(ctx, id)
+	if err != nil {
+		t.Fatalf("GetVM() after failed delete error = %v", err)
+	}
+	if vm.Deletion == nil || vm.Deletion.FailedStep != model.DeleteStepStop || !slices.Equal(vm.Deletion.Completed, []string{model.DeleteStepDrain}) {
+		t.Fatalf("deletion = %+v, want drain done and stop failed", vm.Deletion)
+	}
+	env.systemd.active[id] = false
+	if err := service.StartVM(ctx, id); !errors.Is(err, ErrConflict) {
+		t.Fatalf("StartVM() on a deleting vm error = %v, want conflict", err)
+	}
+
+	env.systemd.stopErr = nil
+	if err := service.DeleteVM(ctx, id, false); err != nil {
+		t.Fatalf("resumed DeleteVM() error = %v", err)
+	}
+	if exists, err := env.store.Exists(id); err != nil || exists {
+		t.Fatalf("vm still in store after delete: exists=%v err=%v", exists, err)
+	}
+}
+
+func TestServiceDeleteVM_OnDeleteHookLeavesNoDataDir(t *testing.T) {
+	runner := hooks.NewRunner(nil)
+	service, env := newTestService(t, testServiceOptions{hooks: runner})
+	runner.WithRecorder(env.store)
+	ctx := context.Background()
+
+	id, err := service.CreateVM(ctx, model.CreateVMRequest{
+		RootFS: env.rootfs,
+		Kernel: env.kernel,
+		VCPU:   1,
+		MemMiB: 128,
+		Hooks:  map[string][]model.HookEntry{model.HookOnDelete: {{Type: "exec", Cmd: []string{"true"}}}},
+	})
+	if err != nil {
+		t.Fatalf("create vm: %v", err)
+	}
+	dataDir := env.store.PathsFor(id).DataDir
+	if err := service.DeleteVM(ctx, id, false); err != nil {
+		t.Fatalf("delete vm: %v", err)
+	}
+	if err := runner.Shutdown(ctx); err != nil {
+		t.Fatalf("shutdown hook runner: %v", err)
+	}
+	if _, err := os.Stat(dataDir); !os.IsNotExist(err) {
+		t.Fatalf("data dir recreated after delete: stat err=%v", err)
+	}
+}
+
+func TestServiceCreateVM_DeviceOwnership(t *testing.T) {
+	service, env := newTestService(t, testServiceOptions{})
+	// Fake sysfs: 01:00.0 is bound to vfio-pci, 02:00.0 to a host driver.
+	pciDir := filepath.Join(env.base, "sys", "bus", "pci", "devices")
+	for addr, driver := range map[string]string{"0000:01:00.0": "vfio-pci", "0000:02:00.0": "nvidia"} {
+		dir := filepath.Join(pciDir, addr)
+		if err := os.MkdirAll(dir, 0o755); err != nil {
+			t.Fatalf("mkdir: %v", err)
+		}
+		if err := os.Symlink("../../../../bus/pci/drivers/"+driver, filepath.Join(dir, "driver")); err != nil {
+			t.Fatalf("symlink driver: %v", err)
+		}
+		if err := os.Symlink("../../../../kernel/iommu_groups/1", filepath.Join(dir, "iommu_group")); err != nil {
+			t.Fatalf("symlink iommu group: %v", err)
+		}
+	}
+	if err := os.MkdirAll(filepath.Join(env.base, "sys", "kernel", "iommu_groups", "1"), 0o755); err != nil {
+		t.Fatalf("mkdir iommu group: %v", err)
+	}
+	service.WithHypervisor(model.HypervisorCloudHypervisor).
+		WithPCIDevicesDir(pciDir)
+	req := model.CreateVMRequest{RootFS: env.rootfs, Kernel: env.kernel, VCPU: 1, MemMiB: 128, Devices: []string{"01:00.0"}}
+
+	id, err := service.CreateVM(context.Background(), req)
+	if err != nil {
+		t.Fatalf("create: %v", err)
+	}
+	meta, err := env.store.ReadMeta(id)
+	if err != nil || !slices.Equal(meta.Devices, []string{"0000:01:00.0"}) {
+		t.Fatalf("expected device recorded on vm, got %v err=%v", meta.Devices, err)
+	}
+	cfg, err := env.store.ReadVMConfig(id)
+	if err != nil || len(cfg.Devices) != 1 || cfg.Devices[0].Path != "/sys/bus/pci/devices/0000:01:00.0/" {
+		t.Fatalf("expected device in vm config, got %+v err=%v", cfg.Devices, err)
+	}
+
+	if _, err := service.CreateVM(context.Background(), req); !errors.Is(err, ErrConflict) {
+		t.Fatalf("expected conflict for a claimed device, got %v", err)
+	}
+	req.Devices = []string{"0000:02:00.0"}
+	if _, err := service.CreateVM(context.Background(), req); !errors.Is(err, ErrInvalidRequest) {
+		t.Fatalf("expected device on a host driver to be rejected, got %v", err)
+	}
+	req.Devices = []string{"0000:03:00.0"}
+	if _, err := service.CreateVM(context.Background(), req); !errors.Is(err, ErrInvalidRequest) {
+		t.Fatalf("expected missing device to be rejected, got %v", err)
+	}
+
+	if err := service.DeleteVM(context.Background(), id, false); err != nil {
+		t.Fatalf("delete: %v", err)
+	}
+	req.Devices = []string{"0000:01:00.0"}
+	if _, err := service.CreateVM(context.Background(), req); err != nil {
+		t.Fatalf("expected device free after delete, got %v", err)
+	}
+}
+
+type fakeIssuer struct {
+	issued  [][]string
+	revoked int
+	err     error
+}
+
+func (f *fakeIssuer) Issue(_ context.Context, domains []string, key crypto.Signer) ([]byte, error) {
+	f.issued = append(f.issued, domains)
+	if f.err != nil {
+		return nil, f.err
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(int64(len(f.issued))),
+		Subject:      pkix.Name{CommonName: domains[0]},
+		DNSNames:     domains,
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(90 * 24 * time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, key.Public(), key)
+	if err != nil {
+		return nil, err
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), nil
+}
+
+func (f *fakeIssuer) Revoke(context.Context, []byte) error {
+	f.revoked++
+	return nil
+}
+
+func TestServiceCertificates(t *testing.T) {
+	service, env := newTestService(t, testServiceOptions{})
+	issuer := &fakeIssuer{}
+	certDir := certs.NewDir(filepath.Join(env.base, "certs"))
+	service.WithCertificates(issuer, certDir, 30*24*time.Hour)
+	req := model.CreateVMRequest{RootFS: env.rootfs, Kernel: env.kernel, VCPU: 1, MemMiB: 128, Domains: []string{"App.Example.com"}}
+
+	id, err := service.CreateVM(context.Background(), req)
+	if err != nil {
+		t.Fatalf("create: %v", err)
+	}
+	if _, err := service.CreateVM(context.Background(), req); !errors.Is(err, ErrConflict) {
+		t.Fatalf("expected conflict for a claimed domain, got %v", err)
+	}
+	req.Domains = []string{"*.example.com"}
+	if _, err := service.CreateVM(context.Background(), req); !errors.Is(err, ErrInvalidRequest) {
+		t.Fatalf("expected wildcard domain to be rejected, got %v", err)
+	}
+
+	service.syncCertificates(context.Background())
+	if len(issuer.issued) != 1 || !slices.Equal(issuer.issued[0], []string{"app.example.com"}) {
+		t.Fatalf("expected one issue for the normalized domain, got %v", issuer.issued)
+	}
+	meta, err := env.store.ReadMeta(id)
+	if err != nil || meta.Certificate == nil || meta.Certificate.Status != model.CertificateIssued || meta.Certificate.NotAfter == nil {
+		t.Fatalf("expected issued certificate state, got %+v err=%v", meta.Certificate, err)
+	}
+	// A valid certificate is not reissued.
+	service.syncCertificates(context.Background())
+	if len(issuer.issued) != 1 {
+		t.Fatalf("expected no reissue, got %d issues", len(issuer.issued))
+	}
+
+	if err := service.DeleteVM(context.Background(), id, false); err != nil {
+		t.Fatalf("delete: %v", err)
+	}
+	if issuer.revoked != 1 {
+		t.Fatalf("expected certificate revoked on delete, got %d", issuer.revoked)
+	}
+	if _, err := certDir.Leaf(id); !os.IsNotExist(err) {
+		t.Fatalf("expected certificate files removed, got %v", err)
+	}
+}
+
+func TestServiceCertificateFailureRecorded(t *testing.T) {
+	service, env := newTestService(t, testServiceOptions{})
+	issuer := &fakeIssuer{err: errors.New("acme: rate limited")}
+	service.WithCertificates(issuer, certs.NewDir(filepath.Join(env.base, "certs")), 30*24*time.Hour)
+	id, err := service.CreateVM(context.Background(), model.CreateVMRequest{RootFS: env.rootfs, Kernel: env.kernel, VCPU: 1, MemMiB: 128, Domains: []string{"app.example.com"}})
+	if err != nil {
+		t.Fatalf("create: %v", err)
+	}
+
+	service.syncCertificates(context.Background())
+	meta, err := env.store.ReadMeta(id)
+	if err != nil || meta.Certificate == nil || meta.Certificate.Status != model.CertificateFailed || !strings.Contains(meta.Certificate.Error, "rate limited") {
+		t.Fatalf("expected failed certificate state, got %+v err=%v", meta.Certificate, err)
+	}
+	// The failed attempt is not retried before certRetryAfter.
+	service.syncCertificates(context.Background())
+	if len(issuer.issued) != 1 {
+		t.Fatalf("expected retry to wait, got %d attempts", len(issuer.issued))
+	}
+}
+
+func TestBreakerTripsOnConsecutiveCreateFailures(t *testing.T) {
+	breaker := NewBreaker(BreakerPolicy{CreateFailures: 3}, nil)
+	service := &Service{}
+	service.WithBreaker(breaker)
+
+	hostErr := errors.New("disk full")
+	breaker.RecordCreate(hostErr)
+	breaker.RecordCreate(hostErr)
+	breaker.RecordCreate(fmt.Errorf("%w: bad vcpu", ErrInvalidRequest))
+	breaker.RecordCreate(fmt.Errorf("%w: quota", ErrConflict))
+	if service.AutomationPaused() {
+		t.Fatalf("caller errors must not count towards the breaker")
+	}
+	breaker.RecordCreate(nil)
+	breaker.RecordCreate(hostErr)
+	breaker.RecordCreate(hostErr)
+	if service.AutomationPaused() {
+		t.Fatalf("a success should reset the failure streak")
+	}
+	breaker.RecordCreate(hostErr)
+	state := service.BreakerState()
+	if !state.Tripped || state.Trips != 1 || state.CreateFailures != 3 || state.ResumesAt != nil {
+		t.Fatalf("unexpected breaker state after trip: %+v", state)
+	}
+	if !strings.Contains(state.Reason, "disk full") {
+		t.Fatalf("reason %q should name the last failure", state.Reason)
+	}
+
+	state = service.ResetBreaker("fixed")
+	if state.Tripped || state.CreateFailures != 0 || state.Trips != 1 || service.AutomationPaused() {
+		t.Fatalf("unexpected breaker state after reset: %+v", state)
+	}
+}
+
+func TestBreakerHookWindowAndCooldown(t *testing.T) {
+	breaker := NewBreaker(BreakerPolicy{HookFailures: 2, HookWindow: time.Minute, Cooldown: 50 * time.Millisecond, CreateFailures: 5}, nil)
+	breaker.ObserveHook(model.HookOnStart, nil)
+	breaker.ObserveHook(model.HookOnStart, errors.New("connection refused"))
+	if !breaker.Allow() {
+		t.Fatalf("one hook failure should not trip the breaker")
+	}
+	breaker.ObserveHook(model.HookOnStart, errors.New("connection refused"))
+	state := breaker.State()
+	if !state.Tripped || state.ResumesAt == nil {
+		t.Fatalf("expected breaker tripped with a cooldown, got %+v", state)
+	}
+
+	time.Sleep(80 * time.Millisecond)
+	if !breaker.Allow() {
+		t.Fatalf("breaker should resume after its cooldown")
+	}
+	breaker.RecordCreate(errors.New("firecracker missing"))
+	if breaker.Allow() {
+		t.Fatalf("a create failure on probation should trip the breaker again")
+	}
+	if got := breaker.State().Trips; got != 2 {
+		t.Fatalf("expected 2 trips, got %d", got)
+	}
+}
+
+func TestNilBreakerAllows(t *testing.T) {
+	service := &Service{}
+	service.breaker.RecordCreate(errors.New("boom"))
+	service.breaker.ObserveHook(model.HookOnCreate, errors.New("boom"))
+	if service.AutomationPaused() || service.BreakerState().Tripped {
+		t.Fatalf("a service without a breaker must never pause automation")
+	}
+}
+
+func TestServiceOperationsTracksInFlightWork(t *testing.T) {
+	service := &Service{}
+	doneCreate := service.operations.begin("", "create")
+	doneDelete := service.operations.begin("vm-1", "delete")
+	ops := service.Operations()
+	if len(ops) != 2 || ops[0].Operation != "create" || ops[1].VMID != "vm-1" {
+		t.Fatalf("unexpected operations: %+v", ops)
+	}
+	doneCreate()
+	doneDelete()
+	if ops := service.Operations(); len(ops) != 0 {
+		t.Fatalf("expected no operations after they finish, got %+v", ops)
+	}
+}
+
+func TestScheduleOpen(t *testing.T) {
+	weekdays := model.Schedule{Windows: []model.ScheduleWindow{{Days: []string{"mon", "tue", "wed", "thu", "fri"}, Start: "08:00", Stop: "20:00"}}}
+	overnight := model.Schedule{Timezone: "Europe/Istanbul", Windows: []model.ScheduleWindow{{Days: []string{"fri"}, Start: "22:00", Stop: "02:00"}}}
+	cases := []struct {
+		name     string
+		schedule model.Schedule
+		at       string
+		open     bool
+	}{
+		{name: "weekday inside", schedule: weekdays, at: "2026-10-14T12:00:00Z", open: true},
+		{name: "weekday at start", schedule: weekdays, at: "2026-10-14T08:00:00Z", open: true},
+		{name: "weekday at stop", schedule: weekdays, at: "2026-10-14T20:00:00Z"},
+		{name: "weekend", schedule: weekdays, at: "2026-10-17T12:00:00Z"},
+		{name: "overnight before midnight", schedule: overnight, at: "2026-10-16T19:30:00Z", open: true},
+		{name: "overnight after midnight", schedule: overnight, at: "2026-10-16T22:30:00Z", open: true},
+		{name: "overnight closed", schedule: overnight, at: "2026-10-16T23:30:00Z"},
+		{name: "overnight other day", schedule: overnight, at: "2026-10-15T19:30:00Z"},
+	}
+	for _, tc := range cases {
+		at, err := time.Parse(time.RFC3339, tc.at)
+		if err != nil {
+			t.Fatalf("%s: parse: %v", tc.name, err)
+		}
+		if got := scheduleOpen(tc.schedule, at); got != tc.open {
+			t.Fatalf("%s: open = %v, want %v", tc.name, got, tc.open)
+		}
+	}
+
+	for _, invalid := range []model.Schedule{
+		{},
+		{Timezone: "Mars/Olympus", Windows: weekdays.Windows},
+		{Windows: []model.ScheduleWindow{{Start: "8am", Stop: "20:00"}}},
+		{Windows: []model.ScheduleWindow{{Days: []string{"someday"}, Start: "08:00", Stop: "20:00"}}},
+	} {
+		if err := validateSchedule(&invalid); err == nil {
+			t.Fatalf("expected %+v to be rejected", invalid)
+		}
+	}
+}
+
+func TestServiceApplySchedules(t *testing.T) {
+	service, env := newTestService(t, testServiceOptions{})
+	ctx := context.Background()
+
+	req := model.CreateVMRequest{RootFS: env.rootfs, Kernel: env.kernel, VCPU: 1, MemMiB: 128}
+	unscheduled, err := service.CreateVM(ctx, req)
+	if err != nil {
+		t.Fatalf("create unscheduled: %v", err)
+	}
+	req.Schedule = &model.Schedule{Windows: []model.ScheduleWindow{{Start: "08:00", Stop: "20:00"}}}
+	id, err := service.CreateVM(ctx, req)
+	if err != nil {
+		t.Fatalf("create scheduled: %v", err)
+	}
+	req.Schedule = &model.Schedule{Windows: []model.ScheduleWindow{{Start: "25:00", Stop: "20:00"}}}
+	if _, err := service.CreateVM(ctx, req); !errors.Is(err, ErrInvalidRequest) {
+		t.Fatalf("expected invalid schedule to be rejected, got %v", err)
+	}
+
+	at := func(clock string) time.Time {
+		parsed, _ := time.Parse(time.RFC3339, "2026-10-14T"+clock+":00Z")
+		return parsed
+	}
+	service.applySchedules(ctx, at("07:59"), at("08:00"))
+	if !env.systemd.active[id] || env.systemd.active[unscheduled] {
+		t.Fatalf("expected only the scheduled vm started, got %v", env.systemd.active)
+	}
+	// Inside the window nothing is enforced, so a manual stop sticks.
+	if err := service.StopVM(ctx, id); err != nil {
+		t.Fatalf("stop: %v", err)
+	}
+	service.applySchedules(ctx, at("12:00"), at("12:01"))
+	if env.systemd.active[id] {
+		t.Fatal("expected a manual stop inside the window to be kept")
+	}
+	if err := service.StartVM(ctx, id); err != nil {
+		t.Fatalf("start: %v", err)
+	}
+	service.applySchedules(ctx, at("19:59"), at("20:00"))
+	if env.systemd.active[id] {
+		t.Fatal("expected vm stopped when its window closed")
+	}
+}
+
+func TestServiceRestartVM_KillsAfterTimeout(t *testing.T) {
+	service, env := newTestService(t, testServiceOptions{})
+	service.WithRestartTimeout(time.Hour)
+	ctx := context.Background()
+
+	id, err := service.CreateVM(ctx, model.CreateVMRequest{RootFS: env.rootfs, Kernel: env.kernel, VCPU: 1, MemMiB: 128})
+	if err != nil {
+		t.Fatalf("create: %v", err)
+	}
+	// A stopped VM is just started.
+	state, err := service.RestartVM(ctx, id, 0)
+	if err != nil || !state.Active || env.systemd.startCall != 1 || env.systemd.stopCall != 0 {
+		t.Fatalf("restart stopped vm: state %+v starts %d stops %d err=%v", state, env.systemd.startCall, env.systemd.stopCall, err)
+	}
+	state, err = service.RestartVM(ctx, id, 0)
+	if err != nil || !state.Active || env.systemd.startCall != 2 || env.systemd.stopCall != 1 || env.systemd.killCall != 0 {
+		t.Fatalf("graceful restart: state %+v starts %d stops %d kills %d err=%v", state, env.systemd.startCall, env.systemd.stopCall, env.systemd.killCall, err)
+	}
+
+	env.systemd.stopHang = true
+	started := time.Now()
+	state, err = service.RestartVM(ctx, id, 50*time.Millisecond)
+	if err != nil || !state.Active || env.systemd.killCall != 1 || env.systemd.startCall != 3 {
+		t.Fatalf("forced restart: state %+v starts %d kills %d err=%v", state, env.systemd.startCall, env.systemd.killCall, err)
+	}
+	if elapsed := time.Since(started); elapsed > 10*time.Second {
+		t.Fatalf("forced restart waited %s, not the given timeout", elapsed)
+	}
+	if _, err := service.RestartVM(ctx, "missing", 0); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("expected not found, got %v", err)
+	}
+}
+
+func TestServiceStateHistory(t *testing.T) {
+	service, env := newTestService(t, testServiceOptions{})
+	ctx := context.Background()
+
+	id, err := service.CreateVM(ctx, model.CreateVMRequest{RootFS: env.rootfs, Kernel: env.kernel, VCPU: 1, MemMiB: 128, AutoStart: true})
+	if err != nil {
+		t.Fatalf("create: %v", err)
+	}
+	if err := service.StopVM(ctx, id); err != nil {
+		t.Fatalf("stop: %v", err)
+	}
+	// Stopping a stopped VM changes nothing and records nothing.
+	if err := service.StopVM(ctx, id); err != nil {
+		t.Fatalf("stop again: %v", err)
+	}
+	if err := service.StartVM(ctx, id); err != nil {
+		t.Fatalf("start: %v", err)
+	}
+
+	env.systemd.active[id] = false
+	env.systemd.failed[id] = true
+	for i := 0; i < 2; i++ {
+		if _, err := service.GetVM(ctx, id); err != nil {
+			t.Fatalf("get: %v", err)
+		}
+	}
+
+	history, err := service.StateHistory(ctx, id, 0)
+	if err != nil {
+		t.Fatalf("history: %v", err)
+	}
+	var states []string
+	for _, transition := range history {
+		if transition.At.IsZero() {
+			t.Fatalf("transition without timestamp: %+v", transition)
+		}
+		states = append(states, transition.State)
+	}
+	want := []string{model.TransitionCrashed, model.TransitionStarted, model.TransitionStopped, model.TransitionStarted, model.TransitionCreated}
+	if strings.Join(states, ",") != strings.Join(want, ",") {
+		t.Fatalf("history %v, want newest first %v", states, want)
+	}
+	if limited, err := service.StateHistory(ctx, id, 2); err != nil || len(limited) != 2 || limited[0].State != model.TransitionCrashed {
+		t.Fatalf("limited history %+v err=%v", limited, err)
+	}
+	if _, err := service.StateHistory(ctx, "missing", 0); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("expected not found, got %v", err)
+	}
+}
+
+func TestServiceReconcile(t *testing.T) {
+	service, env := newTestService(t, testServiceOptions{})
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	running, err := service.CreateVM(ctx, model.CreateVMRequest{RootFS: env.rootfs, Kernel: env.kernel, VCPU: 1, MemMiB: 128, AutoStart: true})
+	if err != nil {
+		t.Fatalf("create running: %v", err)
+	}
+	stopped, err := service.CreateVM(ctx, model.CreateVMRequest{RootFS: env.rootfs, Kernel: env.kernel, VCPU: 1, MemMiB: 128})
+	if err != nil {
+		t.Fatalf("create stopped: %v", err)
+	}
+	for id, want := range map[string]string{running: model.DesiredRunning, stopped: model.DesiredStopped} {
+		if vm, err := service.GetVM(ctx, id); err != nil || vm.DesiredState != want {
+			t.Fatalf("vm %s desired state %q, want %q (err=%v)", id, vm.DesiredState, want, err)
+		}
+	}
+	events, err := service.Watch(ctx)
+	if err != nil {
+		t.Fatalf("watch: %v", err)
+	}
+
+	// A crash is restarted, and a stopped VM started behind mergend's back
+	// is stopped again.
+	env.systemd.active[running] = false
+	env.systemd.failed[running] = true
+	env.systemd.active[stopped] = true
+	starts, stops := env.systemd.startCall, env.systemd.stopCall
+	service.reconcile(ctx, time.Hour)
+	if env.systemd.startCall != starts+1 || !env.systemd.active[running] {
+		t.Fatalf("crashed vm not restarted: starts %d, active %v", env.systemd.startCall-starts, env.systemd.active[running])
+	}
+	if env.systemd.stopCall != stops+1 || env.systemd.active[stopped] {
+		t.Fatalf("stray vm not stopped: stops %d, active %v", env.systemd.stopCall-stops, env.systemd.active[stopped])
+	}
+	env.systemd.failed[running] = false
+	history, err := service.StateHistory(ctx, running, 2)
+	if err != nil || len(history) != 2 || history[0].State != model.TransitionStarted || history[0].Detail != "reconciler" || history[1].State != model.TransitionCrashed {
+		t.Fatalf("history after reconcile = %+v err=%v, want crashed then started by reconciler", history, err)
+	}
+
+	// A VM that fails again right away waits out the backoff.
+	env.systemd.active[running] = false
+	env.systemd.failed[running] = true
+	service.reconcile(ctx, time.Hour)
+	if env.systemd.startCall != starts+1 {
+		t.Fatalf("restart not backed off: starts %d", env.systemd.startCall-starts)
+	}
+
+	// Stopping through the API is the desired state, so it is kept.
+	env.systemd.failed[running] = false
+	if err := service.StopVM(ctx, running); err != nil {
+		t.Fatalf("stop: %v", err)
+	}
+	meta, err := env.store.ReadMeta(running)
+	if err != nil || meta.DesiredState != model.DesiredStopped {
+		t.Fatalf("desired state after stop %q err=%v", meta.DesiredState, err)
+	}
+	listener, err := net.Listen("unix", meta.Paths.SocketPath)
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	listener.(*net.UnixListener).SetUnlinkOnClose(false)
+	listener.Close()
+	starts = env.systemd.startCall
+	service.reconcile(ctx, time.Hour)
+	if env.systemd.startCall != starts {
+		t.Fatal("expected a vm stopped through the api to stay stopped")
+	}
+	if _, err := os.Stat(meta.Paths.SocketPath); !errors.Is(err, os.ErrNotExist) {
+		t.Fatalf("stale socket still present after reconcile: %v", err)
+	}
+
+	want := map[string]string{
+		model.ReconcileCrashed:       running,
+		model.ReconcileStarted:       running,
+		model.ReconcileStopped:       stopped,
+		model.ReconcileSocketRemoved: running,
+	}
+	timeout := time.After(2 * time.Second)
+	for len(want) > 0 {
+		select {
+		case event := <-events:
+			if event.Type == model.StoreEventReconciled && want[event.Reason] == event.ID {
+				delete(want, event.Reason)
+			}
+		case <-timeout:
+			t.Fatalf("missing reconciled events %v", want)
+		}
+	}
+}
+
+// guestDialerFunc dials a test server wherever the probe points.
+type guestDialerFunc func(ctx context.Context, network string) (net.Conn, error)
+
+func (f guestDialerFunc) DialContext(ctx context.Context, network, _, _ string) (net.Conn, error) {
+	return f(ctx, network)
+}
+
+func TestServiceHealthProbes(t *testing.T) {
+	service, env := newTestService(t, testServiceOptions{})
+	status := http.StatusOK
+	guest := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/healthz" {
+			http.NotFound(w, r)
+			return
+		}
+		w.WriteHeader(status)
+	}))
+	defer guest.Close()
+	var dialer net.Dialer
+	service.WithGuestDialer(guestDialerFunc(func(ctx context.Context, network string) (net.Conn, error) {
+		return dialer.DialContext(ctx, network, guest.Listener.Addr().String())
+	}))
+	ctx := context.Background()
+	probeNow := func() {
+		service.healthMu.Lock()
+		for _, state := range service.health {
+			state.next = time.Time{}
+		}
+		service.healthMu.Unlock()
+		var probes sync.WaitGroup
+		service.startDueProbes(ctx, &probes)
+		probes.Wait()
+	}
+
+	req := model.CreateVMRequest{
+		RootFS:        env.rootfs,
+		Kernel:        env.kernel,
+		VCPU:          1,
+		MemMiB:        128,
+		AutoStart:     true,
+		RestartPolicy: &model.RestartPolicy{Mode: model.RestartOnFailure},
+		HealthProbe:   &model.HealthProbe{Type: model.ProbeHTTP, Port: 8080, Path: "/healthz", FailureThreshold: 2},
+	}
+	id, err := service.CreateVM(ctx, req)
+	if err != nil {
+		t.Fatalf("create: %v", err)
+	}
+	probeNow()
+	vm, err := service.GetVM(ctx, id)
+	if err != nil || vm.Health == nil || vm.Health.Status != model.HealthHealthy || vm.Restarts != nil {
+		t.Fatalf("vm after passing probe: health %+v restarts %+v err=%v", vm.Health, vm.Restarts, err)
+	}
+
+	status = http.StatusServiceUnavailable
+	starts, stops := env.systemd.startCall, env.systemd.stopCall
+	probeNow()
+	if vm, _ := service.GetVM(ctx, id); vm.Health.Status != model.HealthHealthy || vm.Health.ConsecutiveFailures != 1 {
+		t.Fatalf("health after one failure %+v, want still healthy", vm.Health)
+	}
+	probeNow()
+	if env.systemd.stopCall != stops+1 || env.systemd.startCall != starts+1 {
+		t.Fatalf("unhealthy vm not restarted: stops %d starts %d", env.systemd.stopCall-stops, env.systemd.startCall-starts)
+	}
+	vm, err = service.GetVM(ctx, id)
+	if err != nil || vm.Restarts == nil || vm.Restarts.Count != 1 || !strings.HasPrefix(vm.Restarts.LastReason, "unhealthy: ") {
+		t.Fatalf("restarts after health restart %+v err=%v", vm.Restarts, err)
+	}
+	// Another failing streak right away waits out the backoff.
+	probeNow()
+	probeNow()
+	if env.systemd.startCall != starts+1 {
+		t.Fatalf("health restart not backed off: starts %d", env.systemd.startCall-starts)
+	}
+
+	// on-failure leaves a guest that powered itself off alone.
+	env.systemd.active[id] = false
+	service.reconcile(ctx, time.Hour)
+	if env.systemd.active[id] {
+		t.Fatal("expected an on-failure vm that exited cleanly to stay stopped")
+	}
+
+	req.RestartPolicy = &model.RestartPolicy{Mode: model.RestartNever}
+	never, err := service.CreateVM(ctx, req)
+	if err != nil {
+		t.Fatalf("create never: %v", err)
+	}
+	starts = env.systemd.startCall
+	for range 3 {
+		probeNow()
+	}
+	if vm, _ := service.GetVM(ctx, never); env.systemd.startCall != starts || vm.Health.Status != model.HealthUnhealthy {
+		t.Fatalf("never policy: starts %d health %+v, want unhealthy and not restarted", env.systemd.startCall-starts, vm.Health)
+	}
+
+	req.HealthProbe = &model.HealthProbe{Type: "icmp", Port: 80}
+	if _, err := service.CreateVM(ctx, req); !errors.Is(err, ErrInvalidRequest) {
+		t.Fatalf("expected unknown probe type rejected, got %v", err)
+	}
+	req.HealthProbe, req.RestartPolicy = nil, &model.RestartPolicy{Mode: "sometimes"}
+	if _, err := service.CreateVM(ctx, req); !errors.Is(err, ErrInvalidRequest) {
+		t.Fatalf("expected unknown restart mode rejected, got %v", err)
+	}
+}
+
+func TestServiceIdleStopAndWake(t *testing.T) {
+	service, env := newTestService(t, testServiceOptions{})
+	guest, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	defer guest.Close()
+	go func() {
+		for {
+			conn, err := guest.Accept()
+			if err != nil {
+				return
+			}
+			conn.Close()
+		}
+	}()
+	guestUp := true
+	var dialer net.Dialer
+	service.WithGuestDialer(guestDialerFunc(func(ctx context.Context, network string) (net.Conn, error) {
+		if !guestUp {
+			return nil, errors.New("connection refused")
+		}
+		return dialer.DialContext(ctx, network, guest.Addr().String())
+	}))
+	ctx := context.Background()
+	idleFor := func(id string, idle time.Duration) {
+		service.activityMu.Lock()
+		service.activity[id] = time.Now().Add(-idle)
+		service.activityMu.Unlock()
+	}
+
+	req := model.CreateVMRequest{RootFS: env.rootfs, Kernel: env.kernel, VCPU: 1, MemMiB: 128, AutoStart: true, IdleTimeoutMinutes: 1}
+	id, err := service.CreateVM(ctx, req)
+	if err != nil {
+		t.Fatalf("create: %v", err)
+	}
+	service.stopIdle(ctx)
+	if !env.systemd.active[id] {
+		t.Fatal("expected a vm started just now to keep running")
+	}
+	idleFor(id, 30*time.Second)
+	service.RecordActivity(ctx, []string{id})
+	service.stopIdle(ctx)
+	if !env.systemd.active[id] {
+		t.Fatal("expected reported activity to postpone the idle stop")
+	}
+
+	idleFor(id, 2*time.Minute)
+	service.stopIdle(ctx)
+	if env.systemd.active[id] {
+		t.Fatal("expected the idle vm stopped")
+	}
+	vm, err := service.GetVM(ctx, id)
+	if err != nil || vm.DesiredState != model.DesiredStopped || vm.IdleTimeoutMinutes != 1 || vm.LastActivityAt == nil {
+		t.Fatalf("vm after idle stop: desired %q idle %d lastActivity %v err=%v", vm.DesiredState, vm.IdleTimeoutMinutes, vm.LastActivityAt, err)
+	}
+	history, err := service.StateHistory(ctx, id, 1)
+	if err != nil || len(history) != 1 || history[0].State != model.TransitionStopped || history[0].Detail != "idle for 1m0s" {
+		t.Fatalf("history after idle stop %+v err=%v", history, err)
+	}
+
+	if err := service.WakeVM(ctx, id, model.WakeVMRequest{Port: 8080}); err != nil {
+		t.Fatalf("wake: %v", err)
+	}
+	if vm, _ := service.GetVM(ctx, id); !env.systemd.active[id] || vm.DesiredState != model.DesiredRunning {
+		t.Fatalf("woken vm: active %t desired %q", env.systemd.active[id], vm.DesiredState)
+	}
+	env.systemd.active[id], guestUp = false, false
+	if err := service.WakeVM(ctx, id, model.WakeVMRequest{Port: 8080, TimeoutSeconds: 1}); !errors.Is(err, ErrUnavailable) {
+		t.Fatalf("expected a guest that never answers to fail the wake, got %v", err)
+	}
+
+	req.IdleTimeoutMinutes = 0
+	always, err := service.CreateVM(ctx, req)
+	if err != nil {
+		t.Fatalf("create without idle timeout: %v", err)
+	}
+	if err := service.WakeVM(ctx, always, model.WakeVMRequest{}); !errors.Is(err, ErrConflict) {
+		t.Fatalf("expected wake of a vm without idle timeout to conflict, got %v", err)
+	}
+	idleFor(always, 24*time.Hour)
+	service.stopIdle(ctx)
+	if !env.systemd.active[always] {
+		t.Fatal("expected a vm without idle timeout to keep running")
+	}
+	req.IdleTimeoutMinutes = -1
+	if _, err := service.CreateVM(ctx, req); !errors.Is(err, ErrInvalidRequest) {
+		t.Fatalf("expected negative idleTimeoutMinutes rejected, got %v", err)
+	}
+}
+
+func TestServiceGuestStats(t *testing.T) {
+	service, env := newTestService(t, testServiceOptions{})
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	id, err := service.CreateVM(ctx, model.CreateVMRequest{RootFS: env.rootfs, Kernel: env.kernel, VCPU: 1, MemMiB: 128})
+	if err != nil {
+		t.Fatalf("create: %v", err)
+	}
+	cfg, err := env.store.ReadVMConfig(id)
+	if err != nil || cfg.Vsock == nil {
+		t.Fatalf("expected a vsock device, got %+v (%v)", cfg.Vsock, err)
+	}
+	if _, err := service.GuestStats(ctx, id); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("expected not found before a sample, got %v", err)
+	}
+
+	service.syncGuestStatsListeners(ctx)
+	defer service.closeGuestStatsListeners()
+	conn, err := net.Dial("unix", cfg.Vsock.UdsPath+"_1027")
+	if err != nil {
+		t.Fatalf("dial guest stats socket: %v", err)
+	}
+	defer conn.Close()
+	if _, err := conn.Write([]byte("not json\n" + `{"l":[0.5,0.25,0.1],"mt":509000,"ma":300000,"rss":4096,"p":3,"up":42}` + "\n")); err != nil {
+		t.Fatalf("write sample: %v", err)
+	}
+	var stats model.GuestStats
+	for deadline := time.Now().Add(2 * time.Second); ; {
+		if stats, err = service.GuestStats(ctx, id); err == nil || time.Now().After(deadline) {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if err != nil {
+		t.Fatalf("guest stats: %v", err)
+	}
+	if stats.Load[0] != 0.5 || stats.MemAvailableKiB != 300000 || stats.WorkloadRSSKiB != 4096 || stats.Processes != 3 || stats.At.IsZero() {
+		t.Fatalf("unexpected stats: %+v", stats)
+	}
+
+	if err := service.DeleteVM(ctx, id, false); err != nil {
+		t.Fatalf("delete: %v", err)
+	}
+	service.syncGuestStatsListeners(ctx)
+	if _, err := service.GuestStats(ctx, id); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("expected not found after delete, got %v", err)
+	}
+}
+
+func TestServiceExecVM(t *testing.T) {
+	service, env := newTestService(t, testServiceOptions{})
+	ctx := context.Background()
+
+	id, err := service.CreateVM(ctx, model.CreateVMRequest{RootFS: env.rootfs, Kernel: env.kernel, VCPU: 1, MemMiB: 128, AutoStart: true})
+	if err != nil {
+		t.Fatalf("create: %v", err)
+	}
+	cfg, err := env.store.ReadVMConfig(id)
+	if err != nil || cfg.Vsock == nil {
+		t.Fatalf("expected a vsock device, got %+v (%v)", cfg.Vsock, err)
+	}
+	if _, err := service.ExecVM(ctx, id, model.ExecRequest{Command: []string{"true"}}); !errors.Is(err, ErrUnavailable) {
+		t.Fatalf("expected exec without an agent unavailable, got %v", err)
+	}
+
+	// The fake agent stands in for the VMM's vsock socket and the init's
+	// exec agent behind it.
+	agent, err := net.Listen("unix", cfg.Vsock.UdsPath)
+	if err != nil {
+		t.Fatalf("listen vsock socket: %v", err)
+	}
+	defer agent.Close()
+	requests := make(chan guestExecRequest, 4)
+	go func() {
+		for {
+			conn, err := agent.Accept()
+			if err != nil {
+				return
+			}
+			reader := bufio.NewReader(conn)
+			if line, _ := reader.ReadString('\n'); line != "CONNECT 1028\n" {
+				conn.Close()
+				continue
+			}
+			conn.Write([]byte("OK 1073741824\n"))
+			var req guestExecRequest
+			if err := json.NewDecoder(reader).Decode(&req); err != nil {
+				conn.Close()
+				continue
+			}
+			requests <- req
+			reply := guestExecResponse{ExitCode: 3, Stdout: req.Stdin, Stderr: "warn\n"}
+			if req.Argv[0] == "missing" {
+				reply = guestExecResponse{Error: `exec: "missing": executable file not found in $PATH`}
+			}
+			json.NewEncoder(conn).Encode(reply)
+			conn.Close()
+		}
+	}()
+
+	result, err := service.ExecVM(ctx, id, model.ExecRequest{Command: []string{"cat"}, Stdin: "hello", User: "app", Env: map[string]string{"A": "1"}})
+	if err != nil {
+		t.Fatalf("exec: %v", err)
+	}
+	if result.ExitCode != 3 || result.Stdout != "hello" || result.Stderr != "warn\n" || result.TimedOut {
+		t.Fatalf("unexpected exec result: %+v", result)
+	}
+	req := <-requests
+	if !slices.Equal(req.Argv, []string{"cat"}) || req.User != "app" || req.Env["A"] != "1" || req.TimeoutMs != 60000 {
+		t.Fatalf("unexpected request to the guest: %+v", req)
+	}
+	if _, err := service.ExecVM(ctx, id, model.ExecRequest{Command: []string{"missing"}}); !errors.Is(err, ErrInvalidRequest) {
+		t.Fatalf("expected a command the guest cannot start to be invalid, got %v", err)
+	}
+	for _, bad := range []model.ExecRequest{{}, {Command: []string{"true"}, TimeoutSeconds: -1}, {Command: []string{"true"}, TimeoutSeconds: 601}} {
+		if _, err := service.ExecVM(ctx, id, bad); !errors.Is(err, ErrInvalidRequest) {
+			t.Fatalf("expected %+v rejected, got %v", bad, err)
+		}
+	}
+	if err := service.StopVM(ctx, id); err != nil {
+		t.Fatalf("stop: %v", err)
+	}
+	if _, err := service.ExecVM(ctx, id, model.ExecRequest{Command: []string{"true"}}); !errors.Is(err, ErrConflict) {
+		t.Fatalf("expected exec in a stopped vm to conflict, got %v", err)
+	}
+}
+
+func TestServiceVMMetrics(t *testing.T) {
+	service, env := newTestService(t, testServiceOptions{})
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	id, err := service.CreateVM(ctx, model.CreateVMRequest{RootFS: env.rootfs, Kernel: env.kernel, VCPU: 1, MemMiB: 128})
+	if err != nil {
+		t.Fatalf("create: %v", err)
+	}
+	cfg, err := env.store.ReadVMConfig(id)
+	if err != nil || cfg.Metrics == nil {
+		t.Fatalf("expected a metrics fifo, got %+v (%v)", cfg.Metrics, err)
+	}
+	if _, err := service.VMMetrics(ctx, id); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("expected not found before a flush, got %v", err)
+	}
+
+	service.syncVMMetricsReaders(ctx)
+	defer service.closeVMMetricsReaders()
+	fifo, err := os.OpenFile(cfg.Metrics.MetricsPath, os.O_WRONLY, 0)
+	if err != nil {
+		t.Fatalf("open metrics fifo: %v", err)
+	}
+	defer fifo.Close()
+	flushes := "not json\n" +
+		`{"utc_timestamp_ms":1,"block_rootfs":{"read_count":3,"read_bytes":4096},"vcpu":{"exit_io_in_agg":{"min_us":5,"max_us":9,"sum_us":14}},"latencies_us":{"pause_vm":10}}` + "\n" +
+		`{"utc_timestamp_ms":2,"block_rootfs":{"read_count":2,"read_bytes":1024},"vcpu":{"exit_io_in_agg":{"min_us":3,"max_us":7,"sum_us":10}},"latencies_us":{"pause_vm":20}}` + "\n"
+	if _, err := fifo.WriteString(flushes); err != nil {
+		t.Fatalf("write flushes: %v", err)
+	}
+	var metrics model.VMMetrics
+	for deadline := time.Now().Add(2 * time.Second); ; {
+		if metrics, err = service.VMMetrics(ctx, id); err == nil && metrics.Flushes == 2 || time.Now().After(deadline) {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if err != nil || metrics.Flushes != 2 {
+		t.Fatalf("vm metrics: %+v (%v)", metrics, err)
+	}
+	if got := metrics.Counters["block_rootfs"]; got["read_count"] != 5 || got["read_bytes"] != 5120 {
+		t.Fatalf("unexpected block counters: %+v", got)
+	}
+	if got := metrics.Counters["vcpu"]; got["exit_io_in_agg.min_us"] != 3 || got["exit_io_in_agg.max_us"] != 9 || got["exit_io_in_agg.sum_us"] != 24 {
+		t.Fatalf("unexpected vcpu counters: %+v", got)
+	}
+	if got := metrics.Counters["latencies_us"]["pause_vm"]; got != 20 {
+		t.Fatalf("expected the last latency, got %v", got)
+	}
+	if _, ok := metrics.Counters["utc_timestamp_ms"]; ok {
+		t.Fatalf("flush timestamp counted: %+v", metrics.Counters)
+	}
+
+	totals := service.VMMetricsTotals(ctx)
+	if totals.VMs != 1 || totals.Flushes != 2 || totals.Counters["block_rootfs"]["read_count"] != 5 {
+		t.Fatalf("unexpected totals: %+v", totals)
+	}
+	if _, ok := totals.Counters["latencies_us"]; ok {
+		t.Fatalf("totals include latencies: %+v", totals.Counters)
+	}
+
+	if err := service.DeleteVM(ctx, id, false); err != nil {
+		t.Fatalf("delete: %v", err)
+	}
+	service.syncVMMetricsReaders(ctx)
+	if totals := service.VMMetricsTotals(ctx); totals.VMs != 0 {
+		t.Fatalf("expected no vms after delete, got %+v", totals)
+	}
+}
+
+func TestServiceListVMsPages(t *testing.T) {
+	service, env := newTestService(t, testServiceOptions{})
+	ctx := context.Background()
+
+	var ids []string
+	for i := 0; i < 5; i++ {
+		id, err := service.CreateVM(ctx, model.CreateVMRequest{RootFS: env.rootfs, Kernel: env.kernel, VCPU: 1, MemMiB: 128})
+		if err != nil {
+			t.Fatalf("create: %v", err)
+		}
+		ids = append(ids, id)
+	}
+
+	for _, sort := range []string{model.VMSortID, model.VMSortCreatedAt} {
+		all, next, err := service.ListVMs(ctx, model.VMFilter{}, model.VMListPage{Sort: sort})
+		if err != nil || len(all) != len(ids) || next != "" {
+			t.Fatalf("sort %s: expected every vm and no cursor, got %d %q (%v)", sort, len(all), next, err)
+		}
+		var paged []string
+		page := model.VMListPage{Limit: 2, Sort: sort}
+		for pages := 0; ; pages++ {
+			if pages > len(ids) {
+				t.Fatalf("sort %s: cursor does not advance", sort)
+			}
+			vms, next, err := service.ListVMs(ctx, model.VMFilter{}, page)
+			if err != nil {
+				t.Fatalf("sort %s: list page: %v", sort, err)
+			}
+			for _, vm := range vms {
+				paged = append(paged, vm.ID)
+			}
+			if next == "" {
+				break
+			}
+			page.Cursor = next
+		}
+		for i, vm := range all {
+			if i >= len(paged) || paged[i] != vm.ID {
+				t.Fatalf("sort %s: pages %v differ from the full list", sort, paged)
+			}
+		}
+		if len(paged) != len(all) {
+			t.Fatalf("sort %s: pages %v differ from the full list", sort, paged)
+		}
+		if sort == model.VMSortID && !slices.IsSorted(paged) {
+			t.Fatalf("expected ids in order, got %v", paged)
+		}
+	}
+
+	_, next, err := service.ListVMs(ctx, model.VMFilter{}, model.VMListPage{Limit: 1, Sort: model.VMSortID})
+	if err != nil {
+		t.Fatalf("first page: %v", err)
+	}
+	if _, _, err := service.ListVMs(ctx, model.VMFilter{}, model.VMListPage{Limit: 1, Cursor: next}); !errors.Is(err, ErrInvalidRequest) {
+		t.Fatalf("expected a cursor of another sort to be rejected, got %v", err)
+	}
+	for _, page := range []model.VMListPage{{Cursor: "not-a-cursor"}, {Sort: "name"}, {Limit: -1}, {Limit: 1001}} {
+		if _, _, err := service.ListVMs(ctx, model.VMFilter{}, page); !errors.Is(err, ErrInvalidRequest) {
+			t.Fatalf("page %+v: expected invalid request, got %v", page, err)
+		}
+	}
+}
+
+func TestServiceVMLogs(t *testing.T) {
+	service, env := newTestService(t, testServiceOptions{})
+	ctx := context.Background()
+	id, err := service.CreateVM(ctx, model.CreateVMRequest{RootFS: env.rootfs, Kernel: env.kernel, VCPU: 1, MemMiB: 128})
+	if err != nil {
+		t.Fatalf("create: %v", err)
+	}
+	meta, err := env.store.ReadMeta(id)
+	if err != nil {
+		t.Fatalf("read meta: %v", err)
+	}
+	if _, err := service.VMLogs(ctx, id, model.VMLogsRequest{}); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("expected a missing serial log to be not found, got %v", err)
+	}
+	if err := os.MkdirAll(meta.Paths.LogsDir, 0o755); err != nil {
+		t.Fatalf("create logs dir: %v", err)
+	}
+	serial := filepath.Join(meta.Paths.LogsDir, "serial.log")
+	var content strings.Builder
+	for i := 1; i <= 5000; i++ {
+		fmt.Fprintf(&content, "line %d\n", i)
+	}
+	if err := os.WriteFile(serial, []byte(content.String()), 0o644); err != nil {
+		t.Fatalf("write serial log: %v", err)
+	}
+
+	read := func(req model.VMLogsRequest) string {
+		t.Helper()
+		logs, err := service.VMLogs(ctx, id, req)
+		if err != nil {
+			t.Fatalf("logs %+v: %v", req, err)
+		}
+		defer logs.Close()
+		out, err := io.ReadAll(logs)
+		if err != nil {
+			t.Fatalf("read logs: %v", err)
+		}
+		return string(out)
+	}
+	if got := read(model.VMLogsRequest{Tail: 2}); got != "line 4999\nline 5000\n" {
+		t.Fatalf("tail 2: %q", got)
+	}
+	if got := read(model.VMLogsRequest{Tail: 4990}); !strings.HasPrefix(got, "line 11\n") {
+		t.Fatalf("tail across chunks starts with %q", got[:min(len(got), 20)])
+	}
+	if got := read(model.VMLogsRequest{Tail: 10000}); got != content.String() {
+		t.Fatalf("tail longer than the file returned %d bytes", len(got))
+	}
+	for _, file := range []string{"../meta.json", "serial.log.1.gz", ".hidden"} {
+		if _, err := service.VMLogs(ctx, id, model.VMLogsRequest{File: file}); !errors.Is(err, ErrInvalidRequest) {
+			t.Fatalf("file %q: expected invalid request, got %v", file, err)
+		}
+	}
+
+	followCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	logs, err := service.VMLogs(followCtx, id, model.VMLogsRequest{Tail: 1, Follow: true})
+	if err != nil {
+		t.Fatalf("follow: %v", err)
+	}
+	defer logs.Close()
+	buf := make([]byte, 64)
+	if n, err := logs.Read(buf); err != nil || string(buf[:n]) != "line 5000\n" {
+		t.Fatalf("first read %q, err %v", buf[:n], err)
+	}
+	// Rotation truncates in place; the follower starts over.
+	if err := os.WriteFile(serial, []byte("rotated\n"), 0o644); err != nil {
+		t.Fatalf("truncate serial log: %v", err)
+	}
+	if n, err := logs.Read(buf); err != nil || string(buf[:n]) != "rotated\n" {
+		t.Fatalf("read after rotation %q, err %v", buf[:n], err)
+	}
+	cancel()
+	if _, err := logs.Read(buf); !errors.Is(err, io.EOF) {
+		t.Fatalf("expected EOF once the context ends, got %v", err)
+	}
+}
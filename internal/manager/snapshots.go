@@ -0,0 +1,360 @@
+package manager
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/alperreha/mergen-fire/internal/artifact"
+	"github.com/alperreha/mergen-fire/internal/firecracker"
+	"github.com/alperreha/mergen-fire/internal/model"
+	"github.com/alperreha/mergen-fire/internal/tracing"
+)
+
+var snapshotNamePattern = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9._-]{0,63}$`)
+
+// snapshotsDir holds a VM's saved snapshots, one directory per snapshot ID.
+// It is separate from firecracker.SnapshotDir, the pending snapshot the
+// unit resumes from once and removes.
+func snapshotsDir(dataDir string) string {
+	return filepath.Join(dataDir, "snapshots")
+}
+
+// CreateSnapshot saves a running Firecracker VM: it is paused, its memory
+// and device state are written through the Firecracker API, its writable
+// disks are copied, and it is resumed, or stopped with req.Stop. The VM
+// stays paused while the disks copy.
+func (s *Service) CreateSnapshot(ctx context.Context, id string, req model.CreateSnapshotRequest) (_ model.Snapshot, err error) {
+	ctx, span := tracing.Start(ctx, "manager.CreateSnapshot", "vmID", id, "stop", req.Stop)
+	defer func() { span.RecordError(err); span.End() }()
+	s.logger.DebugContext(ctx, "create snapshot requested", "vmID", id, "name", req.Name, "stop", req.Stop)
+	req.Name = strings.TrimSpace(req.Name)
+	if req.Name != "" && !snapshotNamePattern.MatchString(req.Name) {
+		return model.Snapshot{}, fmt.Errorf("%w: snapshot name must be 1-64 letters, digits, '.', '_' or '-'", ErrInvalidRequest)
+	}
+	meta, release, err := s.lockFirecrackerVM(ctx, id, "snapshot")
+	if err != nil {
+		return model.Snapshot{}, err
+	}
+	defer release()
+	if s.snapshotter == nil {
+		return model.Snapshot{}, fmt.Errorf("%w: the firecracker api client is not configured", ErrUnavailable)
+	}
+	if req.Name != "" && slices.ContainsFunc(meta.Snapshots, func(snap model.Snapshot) bool { return snap.Name == req.Name }) {
+		return model.Snapshot{}, fmt.Errorf("%w: vm already has a snapshot named %q", ErrConflict, req.Name)
+	}
+	active, err := s.systemd.IsActive(ctx, id)
+	if err != nil {
+		return model.Snapshot{}, fmt.Errorf("%w: %v", ErrUnavailable, err)
+	}
+	if !active {
+		return model.Snapshot{}, fmt.Errorf("%w: vm is not running", ErrConflict)
+	}
+
+	snapID, err := newUUIDv4()
+	if err != nil {
+		return model.Snapshot{}, err
+	}
+	dir := filepath.Join(snapshotsDir(meta.Paths.DataDir), snapID)
+	if err := os.MkdirAll(dir, 0o750); err != nil {
+		return model.Snapshot{}, err
+	}
+	defer func() {
+		if err != nil {
+			_ = os.RemoveAll(dir)
+		}
+	}()
+
+	socketPath := meta.Paths.SocketPath
+	wasPaused := s.instanceState(ctx, socketPath) == firecracker.StatePaused
+	if !wasPaused {
+		if err := s.snapshotter.Pause(ctx, socketPath); err != nil {
+			return model.Snapshot{}, fmt.Errorf("%w: %v", ErrUnavailable, err)
+		}
+	}
+	snap, err := s.writeSnapshot(ctx, meta, dir)
+	if !wasPaused && (err != nil || !req.Stop) {
+		// The VM runs on when the snapshot failed, even if it was to stop.
+		if resumeErr := s.snapshotter.Resume(context.WithoutCancel(ctx), socketPath); resumeErr != nil {
+			s.logger.ErrorContext(ctx, "failed to resume vm after snapshot", "vmID", id, "error", resumeErr)
+		}
+	}
+	if err != nil {
+		return model.Snapshot{}, err
+	}
+	snap.ID, snap.Name = snapID, req.Name
+
+	if _, err := s.updateSnapshots(id, func(snaps []model.Snapshot) []model.Snapshot {
+		return append(snaps, snap)
+	}); err != nil {
+		return model.Snapshot{}, err
+	}
+	s.logger.InfoContext(ctx, "vm snapshot created", "vmID", id, "snapshot", snap.ID, "name", snap.Name, "sizeBytes", snap.SizeBytes, "disks", snap.Disks)
+	if req.Stop {
+		if err := s.stopLocked(ctx, id); err != nil {
+			return snap, fmt.Errorf("snapshot %s created, but stopping the vm failed: %w", snap.ID, err)
+		}
+	}
+	return snap, nil
+}
+
+// writeSnapshot writes the paused VM's state, memory and writable disks
+// into dir.
+func (s *Service) writeSnapshot(ctx context.Context, meta model.VMMetadata, dir string) (model.Snapshot, error) {
+	files := firecracker.SnapshotFilesIn(dir)
+	if err := s.snapshotter.CreateSnapshot(ctx, meta.Paths.SocketPath, files); err != nil {
+		return model.Snapshot{}, fmt.Errorf("%w: %v", ErrUnavailable, err)
+	}
+	snap := model.Snapshot{CreatedAt: time.Now().UTC(), Dir: dir, Disks: []string{}}
+	paths := artifact.Paths(meta)
+	for _, name := range artifact.WritableFor(meta) {
+		path, ok := paths[name]
+		if !ok {
+			continue
+		}
+		if err := copyFileContents(path, filepath.Join(dir, name), 0o640); err != nil {
+			return model.Snapshot{}, fmt.Errorf("copy %s: %w", name, err)
+		}
+		snap.Disks = append(snap.Disks, name)
+	}
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return model.Snapshot{}, err
+	}
+	for _, entry := range entries {
+		if info, err := entry.Info(); err == nil {
+			snap.SizeBytes += info.Size()
+		}
+	}
+	return snap, nil
+}
+
+// RestoreSnapshot puts a VM back to a snapshot: the VM is stopped, its
+// writable disks are overwritten with the snapshot's copies, and it is
+// started again from the snapshot's memory and device state. The snapshot
+// is kept, so it can be restored again.
+func (s *Service) RestoreSnapshot(ctx context.Context, id string, req model.RestoreSnapshotRequest) (_ model.Snapshot, err error) {
+	ctx, span := tracing.Start(ctx, "manager.RestoreSnapshot", "vmID", id, "snapshot", req.Snapshot)
+	defer func() { span.RecordError(err); span.End() }()
+	s.logger.DebugContext(ctx, "restore snapshot requested", "vmID", id, "snapshot", req.Snapshot)
+	if strings.TrimSpace(req.Snapshot) == "" {
+		return model.Snapshot{}, fmt.Errorf("%w: snapshot is required", ErrInvalidRequest)
+	}
+	meta, release, err := s.lockFirecrackerVM(ctx, id, "restore")
+	if err != nil {
+		return model.Snapshot{}, err
+	}
+	defer release()
+	snap, err := findSnapshot(meta, req.Snapshot)
+	if err != nil {
+		return model.Snapshot{}, err
+	}
+	files := firecracker.SnapshotFilesIn(snap.Dir)
+	for _, path := range []string{files.StatePath, files.MemPath} {
+		if _, err := os.Stat(path); err != nil {
+			return model.Snapshot{}, fmt.Errorf("%w: snapshot %s is incomplete: %v", ErrConflict, snap.ID, err)
+		}
+	}
+
+	if err := s.stopLocked(ctx, id); err != nil {
+		return model.Snapshot{}, err
+	}
+	paths := artifact.Paths(meta)
+	for _, name := range snap.Disks {
+		path, ok := paths[name]
+		if !ok {
+			return model.Snapshot{}, fmt.Errorf("%w: vm no longer has the %s the snapshot holds", ErrConflict, name)
+		}
+		if err := overwriteFile(filepath.Join(snap.Dir, name), path); err != nil {
+			return model.Snapshot{}, fmt.Errorf("restore %s: %w", name, err)
+		}
+	}
+	if s.verifyArtifacts && len(snap.Disks) > 0 {
+		if _, err := s.recordArtifacts(id, snap.Disks...); err != nil {
+			return model.Snapshot{}, fmt.Errorf("record restored disk checksums: %w", err)
+		}
+	}
+
+	// The unit resumes from the pending snapshot instead of booting, and
+	// removes it. Links leave the saved snapshot in place.
+	pending := firecracker.SnapshotDir(meta.Paths.DataDir)
+	if err := os.RemoveAll(pending); err != nil {
+		return model.Snapshot{}, err
+	}
+	if err := os.MkdirAll(pending, 0o750); err != nil {
+		return model.Snapshot{}, err
+	}
+	pendingFiles := firecracker.SnapshotFilesIn(pending)
+	for src, dst := range map[string]string{files.StatePath: pendingFiles.StatePath, files.MemPath: pendingFiles.MemPath} {
+		if err := linkOrCopy(src, dst); err != nil {
+			_ = os.RemoveAll(pending)
+			return model.Snapshot{}, err
+		}
+	}
+	if err := s.startAs(ctx, id, model.TransitionRestored, "snapshot "+snap.ID); err != nil {
+		_ = os.RemoveAll(pending)
+		return model.Snapshot{}, err
+	}
+	s.logger.InfoContext(ctx, "vm restored from snapshot", "vmID", id, "snapshot", snap.ID, "name", snap.Name, "disks", snap.Disks)
+	return snap, nil
+}
+
+func (s *Service) ListSnapshots(ctx context.Context, id string) ([]model.Snapshot, error) {
+	s.logger.DebugContext(ctx, "list snapshots requested", "vmID", id)
+	meta, err := s.readMeta(id)
+	if err != nil {
+		return nil, err
+	}
+	if meta.Snapshots == nil {
+		return []model.Snapshot{}, nil
+	}
+	return meta.Snapshots, nil
+}
+
+// DeleteSnapshot removes a snapshot's files and its record.
+func (s *Service) DeleteSnapshot(ctx context.Context, id, snapshot string) (err error) {
+	ctx, span := tracing.Start(ctx, "manager.DeleteSnapshot", "vmID", id, "snapshot", snapshot)
+	defer func() { span.RecordError(err); span.End() }()
+	if _, err := s.readMeta(id); err != nil {
+		return err
+	}
+	release, err := s.lockVM(ctx, id, "delete-snapshot")
+	if err != nil {
+		return err
+	}
+	defer release()
+	meta, err := s.readMeta(id)
+	if err != nil {
+		return err
+	}
+	snap, err := findSnapshot(meta, snapshot)
+	if err != nil {
+		return err
+	}
+	if err := os.RemoveAll(snap.Dir); err != nil {
+		return err
+	}
+	if _, err := s.updateSnapshots(id, func(snaps []model.Snapshot) []model.Snapshot {
+		return slices.DeleteFunc(snaps, func(candidate model.Snapshot) bool { return candidate.ID == snap.ID })
+	}); err != nil {
+		return err
+	}
+	s.logger.InfoContext(ctx, "vm snapshot deleted", "vmID", id, "snapshot", snap.ID, "name", snap.Name)
+	return nil
+}
+
+// lockFirecrackerVM locks a VM that exists, is not being deleted and runs
+// under Firecracker, and returns its metadata as read under the lock.
+func (s *Service) lockFirecrackerVM(ctx context.Context, id, operation string) (model.VMMetadata, func(), error) {
+	if _, err := s.readMeta(id); err != nil {
+		return model.VMMetadata{}, nil, err
+	}
+	release, err := s.lockVM(ctx, id, operation)
+	if err != nil {
+		return model.VMMetadata{}, nil, err
+	}
+	meta, err := s.readMeta(id)
+	if err == nil && meta.Deletion != nil {
+		err = fmt.Errorf("%w: vm %s is being deleted", ErrConflict, id)
+	}
+	if err == nil && hypervisorOf(meta) != model.HypervisorFirecracker {
+		err = fmt.Errorf("%w: %s needs firecracker, vm runs under %s", ErrConflict, operation, meta.Hypervisor)
+	}
+	if err != nil {
+		release()
+		return model.VMMetadata{}, nil, err
+	}
+	return meta, release, nil
+}
+
+// readMeta reads a VM's metadata, mapping a missing VM to ErrNotFound.
+func (s *Service) readMeta(id string) (model.VMMetadata, error) {
+	if strings.TrimSpace(id) == "" {
+		return model.VMMetadata{}, fmt.Errorf("%w: id is empty", ErrInvalidRequest)
+	}
+	exists, err := s.store.Exists(id)
+	if err != nil {
+		return model.VMMetadata{}, err
+	}
+	if !exists {
+		return model.VMMetadata{}, ErrNotFound
+	}
+	return s.store.ReadMeta(id)
+}
+
+func (s *Service) updateSnapshots(id string, mutate func([]model.Snapshot) []model.Snapshot) (model.VMMetadata, error) {
+	meta, err := s.store.ReadMeta(id)
+	if err != nil {
+		return model.VMMetadata{}, err
+	}
+	return s.store.UpdateMeta(id, meta.Revision, func(meta *model.VMMetadata) error {
+		meta.Snapshots = mutate(meta.Snapshots)
+		return nil
+	})
+}
+
+func findSnapshot(meta model.VMMetadata, ref string) (model.Snapshot, error) {
+	for _, snap := range meta.Snapshots {
+		if snap.ID == ref || (snap.Name != "" && snap.Name == ref) {
+			return snap, nil
+		}
+	}
+	return model.Snapshot{}, fmt.Errorf("%w: vm has no snapshot %q", ErrNotFound, ref)
+}
+
+// copyFileContents copies src to a new file dst.
+func copyFileContents(src, dst string, perm os.FileMode) (err error) {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.OpenFile(dst, os.O_CREATE|os.O_EXCL|os.O_WRONLY, perm)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if closeErr := out.Close(); err == nil {
+			err = closeErr
+		}
+	}()
+	_, err = io.Copy(out, in)
+	return err
+}
+
+// overwriteFile replaces dst's contents with src's in place, keeping dst's
+// inode, owner and mode, which the VM's unit and jailer rely on.
+func overwriteFile(src, dst string) (err error) {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.OpenFile(dst, os.O_WRONLY|os.O_TRUNC, 0)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if closeErr := out.Close(); err == nil {
+			err = closeErr
+		}
+	}()
+	if _, err := io.Copy(out, in); err != nil {
+		return err
+	}
+	return out.Sync()
+}
+
+// linkOrCopy hard-links src to dst, copying across filesystems.
+func linkOrCopy(src, dst string) error {
+	if err := os.Link(src, dst); err == nil {
+		return nil
+	}
+	return copyFileContents(src, dst, 0o640)
+}
@@ -0,0 +1,333 @@
+package manager
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"maps"
+	"regexp"
+	"slices"
+	"sort"
+	"strconv"
+
+	"github.com/alperreha/mergen-fire/internal/firecracker"
+	"github.com/alperreha/mergen-fire/internal/model"
+	"github.com/alperreha/mergen-fire/internal/systemd"
+)
+
+// A stack is the set of VMs carrying its name in TagStack; there is no
+// separate stack record. TagStackOrder is the member's position in
+// dependency order, so start walks it up and stop and delete walk it down.
+const (
+	TagStack       = "mergen.stack"
+	TagStackMember = "mergen.stackMember"
+	TagStackOrder  = "mergen.stackOrder"
+)
+
+var stackNamePattern = regexp.MustCompile(`^[a-z0-9]([a-z0-9-]{0,61}[a-z0-9])?$`)
+
+// CreateStack creates every member of manifest in dependency order, filling
+// each member's links with the guest IPs of the members they name. If one
+// member fails, the members created before it are deleted again.
+func (s *Service) CreateStack(ctx context.Context, manifest model.StackManifest) (_ model.Stack, err error) {
+	order, err := stackOrder(manifest)
+	if err != nil {
+		return model.Stack{}, fmt.Errorf("%w: %v", ErrInvalidRequest, err)
+	}
+	s.stackMu.Lock()
+	defer s.stackMu.Unlock()
+	existing, err := s.stackMetas(manifest.Name)
+	if err != nil {
+		return model.Stack{}, err
+	}
+	if len(existing) > 0 {
+		return model.Stack{}, fmt.Errorf("%w: stack %s already exists", ErrConflict, manifest.Name)
+	}
+
+	var created []string
+	defer func() {
+		if err == nil {
+			return
+		}
+		cleanupCtx := context.WithoutCancel(ctx)
+		for _, id := range slices.Backward(created) {
+			if delErr := s.DeleteVM(cleanupCtx, id, false); delErr != nil {
+				s.logger.WarnContext(ctx, "stack rollback failed to delete vm", "stack", manifest.Name, "vmID", id, "error", delErr)
+			}
+		}
+	}()
+
+	guestIPs := make(map[string]string, len(order))
+	for pos, idx := range order {
+		member := manifest.Members[idx]
+		req, applyErr := s.ApplyTemplate(ctx, member.VM)
+		if applyErr != nil {
+			err = fmt.Errorf("stack member %s: %w", member.Name, applyErr)
+			return model.Stack{}, err
+		}
+		if req.Placement != nil {
+			err = fmt.Errorf("%w: stack member %s: template %s sets a placement", ErrInvalidRequest, member.Name, member.VM.Template)
+			return model.Stack{}, err
+		}
+		req.Tags = maps.Clone(req.Tags)
+		if req.Tags == nil {
+			req.Tags = map[string]string{}
+		}
+		req.Tags[TagStack] = manifest.Name
+		req.Tags[TagStackMember] = member.Name
+		req.Tags[TagStackOrder] = strconv.Itoa(pos)
+		if len(member.Links) > 0 {
+			req.GuestEnv = maps.Clone(req.GuestEnv)
+			if req.GuestEnv == nil {
+				req.GuestEnv = map[string]string{}
+			}
+			for name, target := range member.Links {
+				req.GuestEnv[name] = guestIPs[target]
+			}
+		}
+
+		id, createErr := s.CreateVM(ctx, req)
+		if createErr != nil {
+			err = fmt.Errorf("stack member %s: %w", member.Name, createErr)
+			return model.Stack{}, err
+		}
+		created = append(created, id)
+		meta, readErr := s.store.ReadMeta(id)
+		if readErr != nil {
+			err = readErr
+			return model.Stack{}, err
+		}
+		guestIPs[member.Name] = meta.GuestIP
+		s.logger.DebugContext(ctx, "stack member created", "stack", manifest.Name, "member", member.Name, "vmID", id, "guestIP", meta.GuestIP)
+	}
+	s.logger.InfoContext(ctx, "stack created", "stack", manifest.Name, "members", len(created))
+	return s.GetStack(ctx, manifest.Name)
+}
+
+func (s *Service) ListStacks(ctx context.Context) ([]model.Stack, error) {
+	metas, err := s.store.ListMetas()
+	if err != nil {
+		return nil, err
+	}
+	groups := map[string][]model.VMMetadata{}
+	for _, meta := range metas {
+		if name := meta.Tags[TagStack]; name != "" {
+			groups[name] = append(groups[name], meta)
+		}
+	}
+	stacks := make([]model.Stack, 0, len(groups))
+	for name, members := range groups {
+		sortStackMembers(members)
+		stack, err := s.stackStatus(ctx, name, members)
+		if err != nil {
+			return nil, err
+		}
+		stacks = append(stacks, stack)
+	}
+	sort.Slice(stacks, func(i, j int) bool { return stacks[i].Name < stacks[j].Name })
+	return stacks, nil
+}
+
+func (s *Service) GetStack(ctx context.Context, name string) (model.Stack, error) {
+	members, err := s.stackMetas(name)
+	if err != nil {
+		return model.Stack{}, err
+	}
+	if len(members) == 0 {
+		return model.Stack{}, fmt.Errorf("%w: stack %s", ErrNotFound, name)
+	}
+	return s.stackStatus(ctx, name, members)
+}
+
+// StartStack starts members in dependency order and stops at the first
+// failure; members already started stay running.
+func (s *Service) StartStack(ctx context.Context, name string) (model.Stack, error) {
+	members, err := s.stackMetas(name)
+	if err != nil {
+		return model.Stack{}, err
+	}
+	if len(members) == 0 {
+		return model.Stack{}, fmt.Errorf("%w: stack %s", ErrNotFound, name)
+	}
+	for _, meta := range members {
+		if err := s.StartVM(ctx, meta.ID); err != nil {
+			return model.Stack{}, fmt.Errorf("stack member %s: %w", meta.Tags[TagStackMember], err)
+		}
+	}
+	return s.stackStatus(ctx, name, members)
+}
+
+// StopStack stops members in reverse dependency order.
+func (s *Service) StopStack(ctx context.Context, name string) (model.Stack, error) {
+	members, err := s.stackMetas(name)
+	if err != nil {
+		return model.Stack{}, err
+	}
+	if len(members) == 0 {
+		return model.Stack{}, fmt.Errorf("%w: stack %s", ErrNotFound, name)
+	}
+	for _, meta := range slices.Backward(members) {
+		if err := s.StopVM(ctx, meta.ID); err != nil {
+			return model.Stack{}, fmt.Errorf("stack member %s: %w", meta.Tags[TagStackMember], err)
+		}
+	}
+	return s.stackStatus(ctx, name, members)
+}
+
+// DeleteStack deletes members in reverse dependency order. A failure leaves
+// the remaining members in place, so the call can be repeated.
+func (s *Service) DeleteStack(ctx context.Context, name string, retainData bool) error {
+	members, err := s.stackMetas(name)
+	if err != nil {
+		return err
+	}
+	if len(members) == 0 {
+		return fmt.Errorf("%w: stack %s", ErrNotFound, name)
+	}
+	for _, meta := range slices.Backward(members) {
+		if err := s.DeleteVM(ctx, meta.ID, retainData); err != nil && !errors.Is(err, ErrNotFound) {
+			return fmt.Errorf("stack member %s: %w", meta.Tags[TagStackMember], err)
+		}
+	}
+	s.logger.InfoContext(ctx, "stack deleted", "stack", name, "members", len(members), "retainData", retainData)
+	return nil
+}
+
+// stackMetas returns the members of the named stack in dependency order.
+func (s *Service) stackMetas(name string) ([]model.VMMetadata, error) {
+	if !stackNamePattern.MatchString(name) {
+		return nil, fmt.Errorf("%w: invalid stack name %q", ErrInvalidRequest, name)
+	}
+	metas, err := s.store.ListMetas()
+	if err != nil {
+		return nil, err
+	}
+	var members []model.VMMetadata
+	for _, meta := range metas {
+		if meta.Tags[TagStack] == name {
+			members = append(members, meta)
+		}
+	}
+	sortStackMembers(members)
+	return members, nil
+}
+
+// withStackTags returns tags with the stack tags of current, so replacing a
+// member's tags does not take it out of its stack.
+func withStackTags(tags, current map[string]string) map[string]string {
+	out := maps.Clone(tags)
+	for _, key := range []string{TagStack, TagStackMember, TagStackOrder} {
+		delete(out, key)
+		if value, ok := current[key]; ok {
+			out[key] = value
+		}
+	}
+	return out
+}
+
+func sortStackMembers(members []model.VMMetadata) {
+	sort.SliceStable(members, func(i, j int) bool {
+		a, _ := strconv.Atoi(members[i].Tags[TagStackOrder])
+		b, _ := strconv.Atoi(members[j].Tags[TagStackOrder])
+		return a < b
+	})
+}
+
+func (s *Service) stackStatus(ctx context.Context, name string, members []model.VMMetadata) (model.Stack, error) {
+	stack := model.Stack{Name: name, Members: make([]model.StackMemberState, 0, len(members))}
+	active := 0
+	for _, meta := range members {
+		status, err := s.systemd.Status(ctx, meta.ID)
+		if err != nil && !errors.Is(err, systemd.ErrUnavailable) {
+			return model.Stack{}, err
+		}
+		if status.Active {
+			active++
+		}
+		stack.Members = append(stack.Members, model.StackMemberState{
+			Name:    meta.Tags[TagStackMember],
+			VMID:    meta.ID,
+			GuestIP: meta.GuestIP,
+			Active:  status.Active,
+			State:   status.ActiveState,
+		})
+	}
+	switch active {
+	case len(members):
+		stack.Status = model.StackRunning
+	case 0:
+		stack.Status = model.StackStopped
+	default:
+		stack.Status = model.StackDegraded
+	}
+	return stack, nil
+}
+
+// stackOrder validates manifest and returns member indexes with every
+// member after the members it links to, keeping manifest order otherwise.
+func stackOrder(manifest model.StackManifest) ([]int, error) {
+	if !stackNamePattern.MatchString(manifest.Name) {
+		return nil, fmt.Errorf("invalid stack name %q: expected lowercase letters, digits and '-'", manifest.Name)
+	}
+	if len(manifest.Members) == 0 {
+		return nil, errors.New("a stack needs at least one member")
+	}
+	index := make(map[string]int, len(manifest.Members))
+	for i, member := range manifest.Members {
+		if !stackNamePattern.MatchString(member.Name) {
+			return nil, fmt.Errorf("invalid member name %q: expected lowercase letters, digits and '-'", member.Name)
+		}
+		if _, dup := index[member.Name]; dup {
+			return nil, fmt.Errorf("duplicate member %q", member.Name)
+		}
+		index[member.Name] = i
+	}
+	for _, member := range manifest.Members {
+		if member.VM.Placement != nil {
+			return nil, fmt.Errorf("member %s: placement is not supported, stack members run on this host", member.Name)
+		}
+		for _, tag := range []string{TagStack, TagStackMember, TagStackOrder} {
+			if _, ok := member.VM.Tags[tag]; ok {
+				return nil, fmt.Errorf("member %s: tag %s is reserved", member.Name, tag)
+			}
+		}
+		if err := firecracker.ValidateGuestEnv(member.Links, ""); err != nil {
+			return nil, fmt.Errorf("member %s links: %v", member.Name, err)
+		}
+		for env, target := range member.Links {
+			if _, ok := index[target]; !ok || target == member.Name {
+				return nil, fmt.Errorf("member %s: link %s names unknown member %q", member.Name, env, target)
+			}
+			if _, ok := member.VM.GuestEnv[env]; ok {
+				return nil, fmt.Errorf("member %s: %s is set in both links and guestEnv", member.Name, env)
+			}
+		}
+	}
+
+	order := make([]int, 0, len(manifest.Members))
+	placed := make([]bool, len(manifest.Members))
+	for len(order) < len(manifest.Members) {
+		progressed := false
+		for i, member := range manifest.Members {
+			if placed[i] {
+				continue
+			}
+			ready := true
+			for _, target := range member.Links {
+				if !placed[index[target]] {
+					ready = false
+					break
+				}
+			}
+			if ready {
+				placed[i] = true
+				order = append(order, i)
+				progressed = true
+			}
+		}
+		if !progressed {
+			return nil, errors.New("links form a cycle")
+		}
+	}
+	return order, nil
+}
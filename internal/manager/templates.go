@@ -0,0 +1,134 @@
+package manager
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"maps"
+	"reflect"
+	"regexp"
+	"time"
+
+	"github.com/alperreha/mergen-fire/internal/model"
+	"github.com/alperreha/mergen-fire/internal/store"
+)
+
+// TagTemplate records the template a VM was created from.
+const TagTemplate = "mergen.template"
+
+var templateNamePattern = regexp.MustCompile(`^[a-z0-9]([a-z0-9-]{0,61}[a-z0-9])?$`)
+
+func (s *Service) ListTemplates(ctx context.Context) ([]model.VMTemplate, error) {
+	s.logger.DebugContext(ctx, "list templates requested")
+	return s.store.ListTemplates()
+}
+
+func (s *Service) GetTemplate(ctx context.Context, name string) (model.VMTemplate, error) {
+	s.logger.DebugContext(ctx, "get template requested", "template", name)
+	if !templateNamePattern.MatchString(name) {
+		return model.VMTemplate{}, fmt.Errorf("%w: template %s", ErrNotFound, name)
+	}
+	template, err := s.store.ReadTemplate(name)
+	return template, templateError(name, err)
+}
+
+// PutTemplate registers or replaces template.Name. VMs already created from
+// it are not changed.
+func (s *Service) PutTemplate(ctx context.Context, template model.VMTemplate) (model.VMTemplate, error) {
+	s.logger.DebugContext(ctx, "put template requested", "template", template.Name)
+	if !templateNamePattern.MatchString(template.Name) {
+		return model.VMTemplate{}, fmt.Errorf("%w: template name must be a lowercase DNS label", ErrInvalidRequest)
+	}
+	if template.Spec.Template != "" || template.Spec.Overrides != nil {
+		return model.VMTemplate{}, fmt.Errorf("%w: a template spec cannot use another template", ErrInvalidRequest)
+	}
+	s.templateMu.Lock()
+	defer s.templateMu.Unlock()
+	now := time.Now().UTC()
+	template.CreatedAt, template.UpdatedAt = now, now
+	existing, err := s.store.ReadTemplate(template.Name)
+	switch {
+	case err == nil:
+		template.CreatedAt = existing.CreatedAt
+	case !errors.Is(err, store.ErrTemplateNotFound):
+		return model.VMTemplate{}, err
+	}
+	if err := s.store.SaveTemplate(template); err != nil {
+		return model.VMTemplate{}, err
+	}
+	s.logger.InfoContext(ctx, "template saved", "template", template.Name)
+	return template, nil
+}
+
+func (s *Service) DeleteTemplate(ctx context.Context, name string) error {
+	s.logger.DebugContext(ctx, "delete template requested", "template", name)
+	if !templateNamePattern.MatchString(name) {
+		return fmt.Errorf("%w: template %s", ErrNotFound, name)
+	}
+	s.templateMu.Lock()
+	defer s.templateMu.Unlock()
+	if err := s.store.DeleteTemplate(name); err != nil {
+		return templateError(name, err)
+	}
+	s.logger.InfoContext(ctx, "template deleted", "template", name)
+	return nil
+}
+
+// ApplyTemplate returns the request a create from a template stands for:
+// the template's spec with req.Overrides applied and TagTemplate set, in
+// req.Namespace if it names one. A request without a template is returned
+// as it is.
+func (s *Service) ApplyTemplate(ctx context.Context, req model.CreateVMRequest) (model.CreateVMRequest, error) {
+	if req.Template == "" {
+		if req.Overrides != nil {
+			return model.CreateVMRequest{}, fmt.Errorf("%w: overrides need a template", ErrInvalidRequest)
+		}
+		return req, nil
+	}
+	rest := req
+	rest.Template, rest.Overrides, rest.Namespace = "", nil, ""
+	if !reflect.ValueOf(rest).IsZero() {
+		return model.CreateVMRequest{}, fmt.Errorf("%w: a create from a template sets its fields in overrides", ErrInvalidRequest)
+	}
+	if !templateNamePattern.MatchString(req.Template) {
+		return model.CreateVMRequest{}, fmt.Errorf("%w: unknown template %q", ErrInvalidRequest, req.Template)
+	}
+	template, err := s.store.ReadTemplate(req.Template)
+	if errors.Is(err, store.ErrTemplateNotFound) {
+		return model.CreateVMRequest{}, fmt.Errorf("%w: unknown template %q", ErrInvalidRequest, req.Template)
+	}
+	if err != nil {
+		return model.CreateVMRequest{}, err
+	}
+
+	out := template.Spec
+	if len(req.Overrides) > 0 {
+		decoder := json.NewDecoder(bytes.NewReader(req.Overrides))
+		decoder.DisallowUnknownFields()
+		if err := decoder.Decode(&out); err != nil {
+			return model.CreateVMRequest{}, fmt.Errorf("%w: overrides: %v", ErrInvalidRequest, err)
+		}
+		if out.Template != "" || out.Overrides != nil {
+			return model.CreateVMRequest{}, fmt.Errorf("%w: overrides cannot name a template", ErrInvalidRequest)
+		}
+	}
+	if req.Namespace != "" {
+		out.Namespace = req.Namespace
+	}
+	out.Tags = maps.Clone(out.Tags)
+	if out.Tags == nil {
+		out.Tags = map[string]string{}
+	}
+	out.Tags[TagTemplate] = template.Name
+	s.logger.DebugContext(ctx, "template applied", "template", template.Name, "overrides", len(req.Overrides) > 0)
+	return out, nil
+}
+
+func templateError(name string, err error) error {
+	if errors.Is(err, store.ErrTemplateNotFound) {
+		return fmt.Errorf("%w: template %s", ErrNotFound, name)
+	}
+	return err
+}
@@ -0,0 +1,33 @@
+package manager
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/alperreha/mergen-fire/internal/model"
+	"github.com/alperreha/mergen-fire/internal/usage"
+)
+
+func (s *Service) WithUsage(meter *usage.Meter) *Service {
+	s.usage = meter
+	return s
+}
+
+// Usage aggregates the usage records that ended in [from, to) by the groupBy
+// tag, or by the tenant tag when groupBy is empty.
+func (s *Service) Usage(ctx context.Context, from, to time.Time, groupBy string) (model.UsageReport, error) {
+	if s.usage == nil {
+		return model.UsageReport{}, fmt.Errorf("%w: usage metering is not enabled", ErrUnavailable)
+	}
+	report, err := s.usage.Report(from, to, groupBy)
+	if err != nil {
+		if errors.Is(err, usage.ErrInvalid) {
+			return model.UsageReport{}, fmt.Errorf("%w: %v", ErrInvalidRequest, err)
+		}
+		return model.UsageReport{}, err
+	}
+	s.logger.DebugContext(ctx, "usage report built", "from", report.From, "to", report.To, "groupBy", report.GroupBy, "groups", len(report.Groups))
+	return report, nil
+}
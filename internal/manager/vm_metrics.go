@@ -0,0 +1,252 @@
+package manager
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"maps"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/alperreha/mergen-fire/internal/model"
+)
+
+// maxVMMetricsLine bounds one flush; Firecracker's are around 10 KiB.
+const maxVMMetricsLine = 1 << 20
+
+// latencyMetricsGroup holds gauges rather than per-flush counts.
+const latencyMetricsGroup = "latencies_us"
+
+type vmMetricsReader struct {
+	file *os.File
+	info os.FileInfo
+}
+
+// RunVMMetrics keeps the metrics FIFO of each Firecracker VM of this host
+// open and adds up what the VMM flushes to it, checking for new and deleted
+// VMs each interval until ctx ends.
+func (s *Service) RunVMMetrics(ctx context.Context, interval time.Duration) {
+	if interval <= 0 {
+		return
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	defer s.closeVMMetricsReaders()
+	for {
+		s.syncVMMetricsReaders(ctx)
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func (s *Service) syncVMMetricsReaders(ctx context.Context) {
+	metas, err := s.store.ListMetas()
+	if err != nil {
+		s.logger.WarnContext(ctx, "vm metrics: list vms failed", "error", err)
+		return
+	}
+	local := make(map[string]bool, len(metas))
+	for _, meta := range metas {
+		if meta.Paths.RunDir == "" || meta.Unit != "" || meta.Deletion != nil || meta.Host != "" && meta.Host != s.host.Name {
+			continue
+		}
+		local[meta.ID] = true
+	}
+
+	s.vmMetricsMu.Lock()
+	defer s.vmMetricsMu.Unlock()
+	if s.vmMetricsReaders == nil {
+		s.vmMetricsReaders = map[string]*vmMetricsReader{}
+		s.vmMetrics = map[string]model.VMMetrics{}
+	}
+	for id, reader := range s.vmMetricsReaders {
+		if !local[id] {
+			reader.file.Close()
+			delete(s.vmMetricsReaders, id)
+			delete(s.vmMetrics, id)
+			continue
+		}
+		// A FIFO replaced under the reader no longer gets the VMM's flushes.
+		if info, err := os.Stat(reader.file.Name()); err != nil || !os.SameFile(info, reader.info) {
+			reader.file.Close()
+			delete(s.vmMetricsReaders, id)
+		}
+	}
+	for id := range local {
+		if _, ok := s.vmMetricsReaders[id]; ok {
+			continue
+		}
+		cfg, err := s.store.ReadVMConfig(id)
+		if err != nil || cfg.Metrics == nil {
+			continue
+		}
+		reader, err := openMetricsFIFO(cfg.Metrics.MetricsPath)
+		if err != nil {
+			s.logger.WarnContext(ctx, "vm metrics: open fifo failed", "vmID", id, "path", cfg.Metrics.MetricsPath, "error", err)
+			continue
+		}
+		s.vmMetricsReaders[id] = reader
+		go s.readVMMetrics(ctx, id, reader)
+	}
+}
+
+func (s *Service) closeVMMetricsReaders() {
+	s.vmMetricsMu.Lock()
+	defer s.vmMetricsMu.Unlock()
+	for id, reader := range s.vmMetricsReaders {
+		reader.file.Close()
+		delete(s.vmMetricsReaders, id)
+	}
+}
+
+// openMetricsFIFO creates the FIFO if the VM has not started yet. It is
+// opened read-write so that neither the open nor reads wait for, or end
+// with, a VMM holding the other end.
+func openMetricsFIFO(path string) (*vmMetricsReader, error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return nil, err
+	}
+	if err := syscall.Mkfifo(path, 0o600); err != nil && !errors.Is(err, os.ErrExist) {
+		return nil, err
+	}
+	file, err := os.OpenFile(path, os.O_RDWR, 0)
+	if err != nil {
+		return nil, err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+	if info.Mode()&os.ModeNamedPipe == 0 {
+		file.Close()
+		return nil, fmt.Errorf("%s is not a fifo", path)
+	}
+	return &vmMetricsReader{file: file, info: info}, nil
+}
+
+// readVMMetrics adds each flush to the VM's metrics until the reader is
+// closed. Lines that do not parse are skipped.
+func (s *Service) readVMMetrics(ctx context.Context, id string, reader *vmMetricsReader) {
+	scanner := bufio.NewScanner(reader.file)
+	scanner.Buffer(make([]byte, 0, 16<<10), maxVMMetricsLine)
+	for scanner.Scan() {
+		var flush map[string]any
+		if err := json.Unmarshal(scanner.Bytes(), &flush); err != nil {
+			s.logger.DebugContext(ctx, "vm metrics: invalid flush", "vmID", id, "error", err)
+			continue
+		}
+		now := time.Now().UTC()
+		s.vmMetricsMu.Lock()
+		if s.vmMetricsReaders[id] != reader {
+			s.vmMetricsMu.Unlock()
+			return
+		}
+		metrics, ok := s.vmMetrics[id]
+		if !ok {
+			metrics = model.VMMetrics{Since: now, Counters: map[string]map[string]float64{}}
+		}
+		metrics.At = now
+		metrics.Flushes++
+		for group, value := range flush {
+			// Top-level numbers, such as utc_timestamp_ms, describe the flush.
+			if values, ok := value.(map[string]any); ok {
+				addMetrics(metrics.Counters, group, "", values)
+			}
+		}
+		s.vmMetrics[id] = metrics
+		s.vmMetricsMu.Unlock()
+	}
+	if err := scanner.Err(); err != nil && !errors.Is(err, os.ErrClosed) {
+		s.logger.WarnContext(ctx, "vm metrics: read failed", "vmID", id, "error", err)
+	}
+}
+
+func addMetrics(counters map[string]map[string]float64, group, prefix string, values map[string]any) {
+	for name, value := range values {
+		switch value := value.(type) {
+		case float64:
+			addMetric(counters, group, prefix+name, value, group == latencyMetricsGroup)
+		case map[string]any:
+			addMetrics(counters, group, prefix+name+".", value)
+		}
+	}
+}
+
+// addMetric merges one value into counters. Firecracker writes counts as
+// the change since its last flush; a zero minimum means no samples.
+func addMetric(counters map[string]map[string]float64, group, name string, value float64, last bool) {
+	values := counters[group]
+	if values == nil {
+		values = map[string]float64{}
+		counters[group] = values
+	}
+	have, seen := values[name]
+	switch {
+	case !seen || last:
+		values[name] = value
+	case strings.HasSuffix(name, "min_us"):
+		if value != 0 && (have == 0 || value < have) {
+			values[name] = value
+		}
+	case strings.HasSuffix(name, "max_us"):
+		values[name] = max(have, value)
+	default:
+		values[name] = have + value
+	}
+}
+
+// VMMetrics returns the metrics collected for a Firecracker VM. The VMM
+// flushes them once a minute, so a VM returns ErrNotFound until its first
+// flush, also after a mergend restart.
+func (s *Service) VMMetrics(ctx context.Context, id string) (model.VMMetrics, error) {
+	s.logger.DebugContext(ctx, "vm metrics requested", "vmID", id)
+	if _, err := s.readMeta(id); err != nil {
+		return model.VMMetrics{}, err
+	}
+	s.vmMetricsMu.Lock()
+	defer s.vmMetricsMu.Unlock()
+	metrics, ok := s.vmMetrics[id]
+	if !ok {
+		return model.VMMetrics{}, fmt.Errorf("%w: vm %s has not flushed metrics", ErrNotFound, id)
+	}
+	return copyVMMetrics(metrics), nil
+}
+
+// VMMetricsTotals adds up the metrics of every VM of this host.
+func (s *Service) VMMetricsTotals(ctx context.Context) model.VMMetricsTotals {
+	s.logger.DebugContext(ctx, "vm metrics totals requested")
+	totals := model.VMMetricsTotals{At: time.Now().UTC(), Counters: map[string]map[string]float64{}}
+	s.vmMetricsMu.Lock()
+	defer s.vmMetricsMu.Unlock()
+	for _, metrics := range s.vmMetrics {
+		totals.VMs++
+		totals.Flushes += metrics.Flushes
+		for group, values := range metrics.Counters {
+			if group == latencyMetricsGroup {
+				continue
+			}
+			for name, value := range values {
+				addMetric(totals.Counters, group, name, value, false)
+			}
+		}
+	}
+	return totals
+}
+
+func copyVMMetrics(metrics model.VMMetrics) model.VMMetrics {
+	counters := make(map[string]map[string]float64, len(metrics.Counters))
+	for group, values := range metrics.Counters {
+		counters[group] = maps.Clone(values)
+	}
+	metrics.Counters = counters
+	return metrics
+}
@@ -0,0 +1,96 @@
+package migration
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"sync/atomic"
+
+	"github.com/alperreha/mergen-fire/internal/model"
+	"github.com/alperreha/mergen-fire/internal/tracing"
+)
+
+// ContentType is the media type of a migration stream.
+const ContentType = "application/x-tar"
+
+// RemoteError is a non-2xx answer from the target host.
+type RemoteError struct {
+	StatusCode int
+	Message    string
+}
+
+func (e *RemoteError) Error() string {
+	return fmt.Sprintf("target answered %d: %s", e.StatusCode, e.Message)
+}
+
+type headerKey struct{}
+
+// WithHeader attaches headers, e.g. the caller's Authorization, that Send
+// passes on to the target host.
+func WithHeader(ctx context.Context, header http.Header) context.Context {
+	return context.WithValue(ctx, headerKey{}, header)
+}
+
+// Send streams m to POST <baseURL>/v1/migrations and returns the VM as the
+// target reports it after taking it over, plus the bytes sent.
+func Send(ctx context.Context, client *http.Client, baseURL string, m Manifest) (model.VMSummary, int64, error) {
+	reader, writer := io.Pipe()
+	counter := &countingWriter{w: writer}
+	go func() {
+		writer.CloseWithError(Write(counter, m))
+	}()
+	defer reader.Close()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, strings.TrimRight(baseURL, "/")+"/v1/migrations", reader)
+	if err != nil {
+		return model.VMSummary{}, 0, err
+	}
+	if header, ok := ctx.Value(headerKey{}).(http.Header); ok {
+		for key, values := range header {
+			req.Header[key] = values
+		}
+	}
+	req.Header.Set("Content-Type", ContentType)
+	if traceparent := tracing.Traceparent(ctx); traceparent != "" {
+		req.Header.Set("traceparent", traceparent)
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return model.VMSummary{}, counter.n.Load(), err
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	if err != nil {
+		return model.VMSummary{}, counter.n.Load(), err
+	}
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		var payload struct {
+			Message string `json:"message"`
+		}
+		message := strings.TrimSpace(string(body))
+		if json.Unmarshal(body, &payload) == nil && payload.Message != "" {
+			message = payload.Message
+		}
+		return model.VMSummary{}, counter.n.Load(), &RemoteError{StatusCode: resp.StatusCode, Message: message}
+	}
+	var summary model.VMSummary
+	if err := json.Unmarshal(body, &summary); err != nil {
+		return model.VMSummary{}, counter.n.Load(), fmt.Errorf("decode target response: %w", err)
+	}
+	return summary, counter.n.Load(), nil
+}
+
+type countingWriter struct {
+	w io.Writer
+	n atomic.Int64
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	c.n.Add(int64(n))
+	return n, err
+}
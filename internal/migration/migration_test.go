@@ -0,0 +1,131 @@
+package migration_test
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/alperreha/mergen-fire/internal/migration"
+	"github.com/alperreha/mergen-fire/internal/model"
+	"github.com/alperreha/mergen-fire/internal/testsupport"
+)
+
+func TestStream_RoundTripAndExistingFiles(t *testing.T) {
+	src := t.TempDir()
+	disk := filepath.Join(src, "disk.ext4")
+	if err := os.WriteFile(disk, bytes.Repeat([]byte("d"), 4096), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	file, err := migration.Stat("rootfs", disk)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var stream bytes.Buffer
+	if err := migration.Write(&stream, migration.Manifest{Source: "a", Meta: model.VMMetadata{ID: "vm"}, Files: []migration.File{file}}); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+
+	dest := filepath.Join(t.TempDir(), "nested", "disk.ext4")
+	accept := func(migration.Manifest) (map[string]string, error) { return map[string]string{"rootfs": dest}, nil }
+	m, err := migration.Receive(bytes.NewReader(stream.Bytes()), accept)
+	if err != nil || m.Meta.ID != "vm" {
+		t.Fatalf("receive: %+v %v", m, err)
+	}
+	if got, _ := os.ReadFile(dest); len(got) != 4096 {
+		t.Fatalf("expected disk copied, got %d bytes", len(got))
+	}
+
+	if _, err := migration.Receive(bytes.NewReader(stream.Bytes()), accept); err != nil {
+		t.Fatalf("identical destination should be accepted: %v", err)
+	}
+	if err := os.WriteFile(dest, []byte("other"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := migration.Receive(bytes.NewReader(stream.Bytes()), accept); !errors.Is(err, migration.ErrExists) {
+		t.Fatalf("expected ErrExists for a different destination, got %v", err)
+	}
+	if _, err := os.Stat(dest + ".migrating"); !os.IsNotExist(err) {
+		t.Fatalf("expected partial file cleaned up, got %v", err)
+	}
+
+	corrupt := bytes.Replace(stream.Bytes(), []byte("dddd"), []byte("xxxx"), 1)
+	if _, err := migration.Receive(bytes.NewReader(corrupt), func(migration.Manifest) (map[string]string, error) {
+		return map[string]string{"rootfs": filepath.Join(t.TempDir(), "disk")}, nil
+	}); !errors.Is(err, migration.ErrInvalid) {
+		t.Fatalf("expected checksum mismatch, got %v", err)
+	}
+}
+
+func TestMigrateVM_LiveBetweenHosts(t *testing.T) {
+	hosts := testsupport.NewCluster(t, "a", "b")
+	a, b := hosts["a"], hosts["b"]
+	req := a.Artifacts.CreateRequest()
+	req.AutoStart = true
+	id := a.CreateVM(t, req)
+
+	status, body := a.Request(t, http.MethodPost, "/v1/vms/"+id+"/migrate", model.MigrateVMRequest{Host: "b"})
+	if status != http.StatusOK {
+		t.Fatalf("migrate: status %d: %s", status, body)
+	}
+	var result model.MigrationResult
+	if err := json.Unmarshal(body, &result); err != nil {
+		t.Fatal(err)
+	}
+	if !result.Live || result.To != "b" || result.VM.Host != "b" || !result.VM.Systemd.Active || result.Bytes == 0 {
+		t.Fatalf("unexpected result: %+v", result)
+	}
+
+	fc := b.Units.Firecracker(id)
+	if fc == nil || fc.State() != testsupport.StateRunning {
+		t.Fatal("expected vm running on b")
+	}
+	if requests := fc.Requests(); len(requests) != 1 || requests[0].Path != "/snapshot/load" {
+		t.Fatalf("expected b to resume from the snapshot, got %+v", requests)
+	}
+	if fc.Config().MachineConfig.MemSizeMiB != 128 {
+		t.Fatalf("expected restored machine config, got %+v", fc.Config())
+	}
+	if status, _ := a.Request(t, http.MethodGet, "/v1/vms/"+id, nil); status != http.StatusNotFound {
+		t.Fatalf("expected vm gone from a, got %d", status)
+	}
+	if a.Units.Firecracker(id) != nil {
+		t.Fatal("expected vm stopped on a")
+	}
+	if _, err := os.Stat(filepath.Join(b.Store.PathsFor(id).DataDir, "snapshot")); !os.IsNotExist(err) {
+		t.Fatalf("expected snapshot consumed on b, got %v", err)
+	}
+}
+
+func TestMigrateVM_RefusedTargetResumesOnSource(t *testing.T) {
+	hosts := testsupport.NewCluster(t, "a", "b")
+	a, b := hosts["a"], hosts["b"]
+	// Both hosts allocate from the same range, so b's first VM takes the
+	// guest IP and host port a's VM needs.
+	b.CreateVM(t, b.Artifacts.CreateRequest())
+	req := a.Artifacts.CreateRequest()
+	req.AutoStart = true
+	id := a.CreateVM(t, req)
+
+	status, body := a.Request(t, http.MethodPost, "/v1/vms/"+id+"/migrate", model.MigrateVMRequest{Host: "b"})
+	if status != http.StatusConflict || !bytes.Contains(body, []byte("guest ip")) {
+		t.Fatalf("expected 409 for the address clash, got %d: %s", status, body)
+	}
+	fc := a.Units.Firecracker(id)
+	if fc == nil || fc.State() != testsupport.StateRunning {
+		t.Fatal("expected vm resumed on a")
+	}
+	if starts, stops := a.Units.Calls(id); starts != 2 || stops != 1 {
+		t.Fatalf("expected one stop and a restart, got starts=%d stops=%d", starts, stops)
+	}
+	if requests := fc.Requests(); requests[0].Path != "/snapshot/load" {
+		t.Fatalf("expected a to resume from its snapshot, got %s", requests[0].Path)
+	}
+
+	if status, _ := a.Request(t, http.MethodPost, "/v1/vms/"+id+"/migrate", model.MigrateVMRequest{Host: "c"}); status != http.StatusBadRequest {
+		t.Fatalf("expected 400 for an unknown host, got %d", status)
+	}
+}
@@ -0,0 +1,266 @@
+// Package migration moves a VM between mergend hosts as a single tar stream:
+// its inventory records and env, its disks and, for a running VM, the
+// Firecracker snapshot it is resumed from on the target.
+package migration
+
+import (
+	"archive/tar"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/alperreha/mergen-fire/internal/model"
+)
+
+const (
+	formatVersion    = 1
+	manifestName     = "manifest.json"
+	checksumsName    = "checksums.json"
+	filePrefix       = "files/"
+	maxManifestBytes = 16 << 20
+	partialSuffix    = ".migrating"
+)
+
+// Names of the files a manifest can carry.
+const (
+	FileRootFS        = model.ArtifactRootFS
+	FileKernel        = model.ArtifactKernel
+	FileInitrd        = model.ArtifactInitrd
+	FileDataDisk      = model.ArtifactDataDisk
+	FileSnapshotState = "vmstate"
+	FileSnapshotMem   = "mem"
+)
+
+var (
+	ErrInvalid = errors.New("invalid migration stream")
+	// ErrExists is returned when a destination file already exists with
+	// different content.
+	ErrExists = errors.New("migration destination exists")
+)
+
+// File is a host file shipped with the VM; Path is where it lives on the
+// source host.
+type File struct {
+	Name string      `json:"name"`
+	Path string      `json:"path"`
+	Size int64       `json:"size"`
+	Mode os.FileMode `json:"mode"`
+}
+
+type Manifest struct {
+	FormatVersion int               `json:"formatVersion"`
+	Source        string            `json:"source"`
+	CreatedAt     time.Time         `json:"createdAt"`
+	Meta          model.VMMetadata  `json:"meta"`
+	Config        model.VMConfig    `json:"config"`
+	Hooks         model.HooksConfig `json:"hooks"`
+	Env           map[string]string `json:"env,omitempty"`
+	Snapshot      bool              `json:"snapshot"`
+	Files         []File            `json:"files"`
+}
+
+// Stat fills Size and Mode of a file about to be shipped.
+func Stat(name, filePath string) (File, error) {
+	info, err := os.Stat(filePath)
+	if err != nil {
+		return File{}, err
+	}
+	if !info.Mode().IsRegular() {
+		return File{}, fmt.Errorf("%s is not a regular file", filePath)
+	}
+	return File{Name: name, Path: filePath, Size: info.Size(), Mode: info.Mode().Perm()}, nil
+}
+
+// Write streams m followed by the content of each of m.Files. Checksums are
+// taken while streaming and sent last, so every file is read only once.
+func Write(w io.Writer, m Manifest) error {
+	m.FormatVersion = formatVersion
+	tw := tar.NewWriter(w)
+	encoded, err := json.Marshal(m)
+	if err != nil {
+		return err
+	}
+	if err := writeEntry(tw, manifestName, int64(len(encoded)), 0o640, bytes.NewReader(encoded)); err != nil {
+		return err
+	}
+
+	sums := make(map[string]string, len(m.Files))
+	for _, file := range m.Files {
+		f, err := os.Open(file.Path)
+		if err != nil {
+			return err
+		}
+		hash := sha256.New()
+		err = writeEntry(tw, filePrefix+file.Name, file.Size, file.Mode, io.TeeReader(f, hash))
+		f.Close()
+		if err != nil {
+			return fmt.Errorf("stream %s: %w", file.Name, err)
+		}
+		sums[file.Name] = hex.EncodeToString(hash.Sum(nil))
+	}
+
+	encoded, err = json.Marshal(sums)
+	if err != nil {
+		return err
+	}
+	if err := writeEntry(tw, checksumsName, int64(len(encoded)), 0o640, bytes.NewReader(encoded)); err != nil {
+		return err
+	}
+	return tw.Close()
+}
+
+func writeEntry(tw *tar.Writer, name string, size int64, mode os.FileMode, r io.Reader) error {
+	if err := tw.WriteHeader(&tar.Header{
+		Name:     name,
+		Mode:     int64(mode),
+		Size:     size,
+		ModTime:  time.Now(),
+		Typeflag: tar.TypeReg,
+	}); err != nil {
+		return err
+	}
+	// A file that changed size since Stat fails the copy instead of
+	// corrupting the stream.
+	n, err := io.Copy(tw, io.LimitReader(r, size))
+	if err == nil && n != size {
+		err = fmt.Errorf("short read: %d of %d bytes", n, size)
+	}
+	return err
+}
+
+// Receive reads a stream produced by Write. accept is called with the
+// manifest before any file is written and returns the destination of each
+// file on this host. Files are written next to their destination and moved
+// into place only after every checksum matched; a destination that already
+// exists is kept if it has the same content and is an error otherwise.
+func Receive(r io.Reader, accept func(Manifest) (map[string]string, error)) (Manifest, error) {
+	tr := tar.NewReader(r)
+	header, err := tr.Next()
+	if err != nil {
+		return Manifest{}, fmt.Errorf("%w: %v", ErrInvalid, err)
+	}
+	if path.Clean(header.Name) != manifestName || header.Size > maxManifestBytes {
+		return Manifest{}, fmt.Errorf("%w: stream does not start with a manifest", ErrInvalid)
+	}
+	var m Manifest
+	if err := json.NewDecoder(io.LimitReader(tr, maxManifestBytes)).Decode(&m); err != nil {
+		return Manifest{}, fmt.Errorf("%w: manifest: %v", ErrInvalid, err)
+	}
+	if m.FormatVersion != formatVersion {
+		return Manifest{}, fmt.Errorf("%w: unsupported format %d", ErrInvalid, m.FormatVersion)
+	}
+	dests, err := accept(m)
+	if err != nil {
+		return Manifest{}, err
+	}
+	expected := map[string]File{}
+	for _, file := range m.Files {
+		if dests[file.Name] == "" {
+			return Manifest{}, fmt.Errorf("%w: no destination for %s", ErrInvalid, file.Name)
+		}
+		expected[file.Name] = file
+	}
+
+	var partial []string
+	defer func() {
+		for _, p := range partial {
+			_ = os.Remove(p)
+		}
+	}()
+	sums := map[string]string{}
+	var remote map[string]string
+	for {
+		header, err := tr.Next()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return Manifest{}, fmt.Errorf("%w: %v", ErrInvalid, err)
+		}
+		name := path.Clean(header.Name)
+		if name == checksumsName {
+			if err := json.NewDecoder(io.LimitReader(tr, maxManifestBytes)).Decode(&remote); err != nil {
+				return Manifest{}, fmt.Errorf("%w: checksums: %v", ErrInvalid, err)
+			}
+			continue
+		}
+		fileName, ok := strings.CutPrefix(name, filePrefix)
+		file, known := expected[fileName]
+		if !ok || !known || header.Size != file.Size {
+			return Manifest{}, fmt.Errorf("%w: unexpected entry %s", ErrInvalid, header.Name)
+		}
+		tmp := dests[fileName] + partialSuffix
+		partial = append(partial, tmp)
+		sum, err := receiveFile(tmp, tr, file)
+		if err != nil {
+			return Manifest{}, fmt.Errorf("receive %s: %w", fileName, err)
+		}
+		sums[fileName] = sum
+	}
+	for name := range expected {
+		if sums[name] == "" || sums[name] != remote[name] {
+			return Manifest{}, fmt.Errorf("%w: checksum mismatch for %s", ErrInvalid, name)
+		}
+	}
+
+	for _, file := range m.Files {
+		dest := dests[file.Name]
+		existing, err := fileSHA256(dest)
+		switch {
+		case err == nil && existing == sums[file.Name]:
+			continue
+		case err == nil:
+			return Manifest{}, fmt.Errorf("%w: %s differs from the migrated %s", ErrExists, dest, file.Name)
+		case !errors.Is(err, os.ErrNotExist):
+			return Manifest{}, err
+		}
+		if err := os.Rename(dest+partialSuffix, dest); err != nil {
+			return Manifest{}, err
+		}
+	}
+	return m, nil
+}
+
+func receiveFile(tmp string, r io.Reader, file File) (string, error) {
+	if err := os.MkdirAll(filepath.Dir(tmp), 0o750); err != nil {
+		return "", err
+	}
+	f, err := os.OpenFile(tmp, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, file.Mode.Perm()|0o600)
+	if err != nil {
+		return "", err
+	}
+	hash := sha256.New()
+	_, err = io.Copy(io.MultiWriter(f, hash), r)
+	if syncErr := f.Sync(); err == nil {
+		err = syncErr
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(hash.Sum(nil)), nil
+}
+
+func fileSHA256(filePath string) (string, error) {
+	f, err := os.Open(filePath)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	hash := sha256.New()
+	if _, err := io.Copy(hash, f); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(hash.Sum(nil)), nil
+}
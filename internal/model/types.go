@@ -1,6 +1,9 @@
 package model
 
-import "time"
+import (
+	"encoding/json"
+	"time"
+)
 
 const (
 	HookOnCreate = "onCreate"
@@ -9,6 +12,86 @@ const (
 	HookOnStop   = "onStop"
 )
 
+// UpdateVMRequest replaces the given maps wholesale; omitted fields are kept.
+type UpdateVMRequest struct {
+	Tags      map[string]string `json:"tags,omitempty"`
+	Metadata  map[string]any    `json:"metadata,omitempty"`
+	LogPolicy *LogPolicy        `json:"logPolicy,omitempty"`
+	// VCPU, MemMiB and BootArgs change vm.json. A running VM keeps its old
+	// resources until its next start unless Restart is set.
+	VCPU     int    `json:"vcpu,omitempty"`
+	MemMiB   int    `json:"memMiB,omitempty"`
+	BootArgs string `json:"bootArgs,omitempty"`
+	Restart  bool   `json:"restart,omitempty"`
+}
+
+// VMLogsRequest picks a file of a VM's logs dir, serial.log by default, and
+// how much of it to return: the last Tail lines, or all of it when 0, and
+// with Follow whatever is written to it afterwards.
+type VMLogsRequest struct {
+	File   string `json:"file,omitempty"`
+	Tail   int    `json:"tail,omitempty"`
+	Follow bool   `json:"follow,omitempty"`
+}
+
+// RecreateVMRequest replaces a VM with a new one built from its stored
+// spec. RootFS and Kernel swap the images, empty ones are kept; a new
+// Kernel takes Initrd (or its catalog initrd) instead of the old one.
+// PreserveAllocations gives the new VM the old one's guest IP, MAC, host
+// ports, tap and netns names, so DNS and firewall entries pointing at it
+// stay valid. The new VM is started when the old one was running or
+// AutoStart is set.
+type RecreateVMRequest struct {
+	RootFS              string `json:"rootfs,omitempty"`
+	Kernel              string `json:"kernel,omitempty"`
+	Initrd              string `json:"initrd,omitempty"`
+	PreserveAllocations bool   `json:"preserveAllocations,omitempty"`
+	AutoStart           bool   `json:"autoStart,omitempty"`
+}
+
+// Actions of POST /v1/vms:batch.
+const (
+	BatchStart   = "start"
+	BatchStop    = "stop"
+	BatchRestart = "restart"
+	BatchDelete  = "delete"
+)
+
+// BatchVMRequest runs one action on many VMs. RetainData keeps the data
+// dirs of deleted VMs.
+type BatchVMRequest struct {
+	Action     string   `json:"action"`
+	IDs        []string `json:"ids"`
+	RetainData bool     `json:"retainData,omitempty"`
+}
+
+// BatchVMResult is the outcome of the action on one VM. Status is the HTTP
+// status the single-VM endpoint would have answered with, and Error and
+// Message its error body.
+type BatchVMResult struct {
+	ID      string `json:"id"`
+	Status  int    `json:"status"`
+	Error   string `json:"error,omitempty"`
+	Message string `json:"message,omitempty"`
+}
+
+// BatchVMResponse lists a result per requested ID, in request order.
+type BatchVMResponse struct {
+	Action    string          `json:"action"`
+	Succeeded int             `json:"succeeded"`
+	Failed    int             `json:"failed"`
+	Results   []BatchVMResult `json:"results"`
+}
+
+// LogPolicy overrides the daemon-wide rotation settings for a VM's LogsDir.
+// Zero fields inherit the global value.
+type LogPolicy struct {
+	MaxSizeMiB int   `json:"maxSizeMiB,omitempty"`
+	MaxAgeDays int   `json:"maxAgeDays,omitempty"`
+	MaxFiles   int   `json:"maxFiles,omitempty"`
+	Compress   *bool `json:"compress,omitempty"`
+}
+
 type CreateVMRequest struct {
 	RootFS    string                 `json:"rootfs"`
 	Kernel    string                 `json:"kernel"`
@@ -20,9 +103,236 @@ type CreateVMRequest struct {
 	Metadata  map[string]any         `json:"metadata,omitempty"`
 	AutoStart bool                   `json:"autoStart,omitempty"`
 	BootArgs  string                 `json:"bootArgs,omitempty"`
+	Boot      *BootOptions           `json:"boot,omitempty"`
 	ExtraEnv  map[string]string      `json:"extraEnv,omitempty"`
 	Tags      map[string]string      `json:"tags,omitempty"`
 	Hooks     map[string][]HookEntry `json:"hooks,omitempty"`
+	LogPolicy *LogPolicy             `json:"logPolicy,omitempty"`
+	Placement *Placement             `json:"placement,omitempty"`
+	// RootReadOnly attaches the rootfs read-only; the guest init then keeps
+	// its writes in an overlay on the data disk, or in memory without one.
+	RootReadOnly bool `json:"rootReadOnly,omitempty"`
+	// RootDevice names the root drive in the Firecracker config; default
+	// "rootfs".
+	RootDevice string `json:"rootDevice,omitempty"`
+	// RootFSSizeMiB copies RootFS into the VM's data dir, grown to this
+	// size; the guest init grows the filesystem to match on boot.
+	RootFSSizeMiB int `json:"rootfsSizeMiB,omitempty"`
+	// GuestEnv is merged over the image's environment by the guest init.
+	// GuestEnvVia picks the delivery: "cmdline" (default) encodes it into
+	// the boot args, "mmds" serves it from the Firecracker metadata service,
+	// which has room for larger values.
+	GuestEnv    map[string]string `json:"guestEnv,omitempty"`
+	GuestEnvVia string            `json:"guestEnvVia,omitempty"`
+	// Initrd is an initramfs image loaded with the kernel, for kernels that
+	// need modules to find the virtio root disk. A catalog kernel's initrd
+	// is used when this is empty.
+	Initrd string `json:"initrd,omitempty"`
+	// Hypervisor is the VMM the VM runs under, HypervisorFirecracker or
+	// HypervisorCloudHypervisor; empty uses the host default.
+	Hypervisor string `json:"hypervisor,omitempty"`
+	// SharedDirs are host directories shared with the guest over virtio-fs,
+	// which needs HypervisorCloudHypervisor.
+	SharedDirs []SharedDir `json:"sharedDirs,omitempty"`
+	// Devices are host PCI devices, e.g. "0000:01:00.0", passed through
+	// over VFIO. They must be bound to vfio-pci and not held by another VM;
+	// passthrough needs HypervisorCloudHypervisor.
+	Devices []string `json:"devices,omitempty"`
+	// Domains are custom hostnames the forwarder routes to the VM. With
+	// certificates configured, mergend obtains one covering them over ACME.
+	Domains []string `json:"domains,omitempty"`
+	// Schedule starts and stops the VM at fixed times of day.
+	Schedule *Schedule `json:"schedule,omitempty"`
+	// RestartPolicy says when mergend restarts the VM; default always.
+	RestartPolicy *RestartPolicy `json:"restartPolicy,omitempty"`
+	// HealthProbe is checked inside the guest while the VM runs; a VM
+	// failing it is restarted as its RestartPolicy allows.
+	HealthProbe *HealthProbe `json:"healthProbe,omitempty"`
+	// IdleTimeoutMinutes stops the VM once the forwarder has routed no
+	// traffic to it for that long, and lets the forwarder start it again
+	// when a connection for it arrives; 0 keeps it running.
+	IdleTimeoutMinutes int `json:"idleTimeoutMinutes,omitempty"`
+	// Template names a VMTemplate the VM is created from; the request then
+	// sets nothing else. Each key of Overrides replaces the template's,
+	// except that maps such as tags are merged key by key.
+	Template  string          `json:"template,omitempty"`
+	Overrides json.RawMessage `json:"overrides,omitempty"`
+	// Namespace is the registered namespace the VM belongs to and counts
+	// against; empty means DefaultNamespace.
+	Namespace string `json:"namespace,omitempty"`
+}
+
+// Schedule runs a VM inside its windows: mergend starts it when a window
+// opens and stops it when the last open window closes. Between those edges
+// a manual start or stop is left alone.
+type Schedule struct {
+	// Timezone is an IANA name such as "Europe/Istanbul"; default UTC.
+	Timezone string           `json:"timezone,omitempty"`
+	Windows  []ScheduleWindow `json:"windows"`
+}
+
+const (
+	RestartAlways    = "always"
+	RestartOnFailure = "on-failure"
+	RestartNever     = "never"
+)
+
+// RestartPolicy says which VMs that should run but do not, or fail their
+// health probe, mergend restarts: RestartAlways restarts any of them,
+// RestartOnFailure only those whose unit failed or whose probe fails, so a
+// guest that powers itself off stays off, and RestartNever none. Each
+// restart the VM does not recover from doubles the wait before the next,
+// from BackoffSeconds up to MaxBackoffSeconds.
+type RestartPolicy struct {
+	Mode              string `json:"mode"`
+	BackoffSeconds    int    `json:"backoffSeconds,omitempty"`
+	MaxBackoffSeconds int    `json:"maxBackoffSeconds,omitempty"`
+}
+
+const (
+	ProbeTCP  = "tcp"
+	ProbeHTTP = "http"
+)
+
+// HealthProbe connects to Port on the guest IP, from inside the VM's
+// network namespace, every IntervalSeconds once InitialDelaySeconds have
+// passed since the VM was seen running. A ProbeHTTP probe also needs a 2xx
+// or 3xx answer to a GET of Path. FailureThreshold failures in a row make
+// the VM unhealthy.
+type HealthProbe struct {
+	Type                string `json:"type"`
+	Port                int    `json:"port"`
+	Path                string `json:"path,omitempty"`
+	IntervalSeconds     int    `json:"intervalSeconds,omitempty"`
+	TimeoutSeconds      int    `json:"timeoutSeconds,omitempty"`
+	InitialDelaySeconds int    `json:"initialDelaySeconds,omitempty"`
+	FailureThreshold    int    `json:"failureThreshold,omitempty"`
+}
+
+const (
+	HealthUnknown   = "unknown"
+	HealthHealthy   = "healthy"
+	HealthUnhealthy = "unhealthy"
+)
+
+// HealthState is the result of a running VM's health probe so far.
+type HealthState struct {
+	Status              string     `json:"status"`
+	ConsecutiveFailures int        `json:"consecutiveFailures"`
+	CheckedAt           *time.Time `json:"checkedAt,omitempty"`
+	Error               string     `json:"error,omitempty"`
+}
+
+// RestartState counts the restarts mergend did on its own, after a crash
+// or a failing health probe; restarts asked for through the API are not
+// counted.
+type RestartState struct {
+	Count      int       `json:"count"`
+	LastAt     time.Time `json:"lastAt"`
+	LastReason string    `json:"lastReason"`
+}
+
+// ScheduleWindow is open from Start to Stop, both "HH:MM", on each of Days
+// ("mon" to "sun", or every day when empty). A Stop at or before Start runs
+// past midnight into the next day.
+type ScheduleWindow struct {
+	Days  []string `json:"days,omitempty"`
+	Start string   `json:"start"`
+	Stop  string   `json:"stop"`
+}
+
+// SharedDir is a host directory a virtiofsd serves to the guest under Tag;
+// the guest init mounts it at GuestPath.
+type SharedDir struct {
+	Tag       string `json:"tag"`
+	HostPath  string `json:"hostPath"`
+	GuestPath string `json:"guestPath"`
+	ReadOnly  bool   `json:"readOnly,omitempty"`
+}
+
+// Hypervisors a VM can run under. VMs without one run under Firecracker.
+const (
+	HypervisorFirecracker     = "firecracker"
+	HypervisorCloudHypervisor = "cloud-hypervisor"
+)
+
+// StackManifest creates a named group of VMs in one call. Links maps an env
+// var to the member whose guest IP it should hold, e.g. {"DB_HOST": "db"};
+// linked members are created and started first.
+type StackManifest struct {
+	Name    string        `json:"name"`
+	Members []StackMember `json:"members"`
+}
+
+type StackMember struct {
+	Name  string            `json:"name"`
+	VM    CreateVMRequest   `json:"vm"`
+	Links map[string]string `json:"links,omitempty"`
+}
+
+// Stack status values: every member running, none running, or a mix.
+const (
+	StackRunning  = "running"
+	StackStopped  = "stopped"
+	StackDegraded = "degraded"
+)
+
+type Stack struct {
+	Name    string             `json:"name"`
+	Status  string             `json:"status"`
+	Members []StackMemberState `json:"members"`
+}
+
+type StackMemberState struct {
+	Name    string `json:"name"`
+	VMID    string `json:"vmID"`
+	GuestIP string `json:"guestIP"`
+	Active  bool   `json:"active"`
+	State   string `json:"state,omitempty"`
+}
+
+// BootOptions are kernel command line fields merged into the default boot
+// args, or into BootArgs when that is set. Extra values may be empty for bare
+// flags such as "quiet".
+type BootOptions struct {
+	Console string            `json:"console,omitempty"`
+	Init    string            `json:"init,omitempty"`
+	Extra   map[string]string `json:"extra,omitempty"`
+}
+
+// Placement constrains which host in a cluster a VM is created on.
+// HostLabels and AntiAffinity are hard requirements; Affinity only ranks
+// hosts that already run VMs carrying all of those tags first.
+type Placement struct {
+	HostLabels   map[string]string `json:"hostLabels,omitempty"`
+	Affinity     map[string]string `json:"affinity,omitempty"`
+	AntiAffinity map[string]string `json:"antiAffinity,omitempty"`
+}
+
+// HostInfo describes a mergend instance. URL is where peers forward create
+// requests scheduled onto it.
+type HostInfo struct {
+	Name   string            `json:"name"`
+	Labels map[string]string `json:"labels,omitempty"`
+	URL    string            `json:"url,omitempty"`
+}
+
+type MigrateVMRequest struct {
+	Host string `json:"host"`
+}
+
+// MigrationResult reports a finished migration. Live is set when the VM was
+// running and resumed on the target from a snapshot; DowntimeMs then spans
+// pause on the source to resume on the target.
+type MigrationResult struct {
+	ID         string    `json:"id"`
+	From       string    `json:"from"`
+	To         string    `json:"to"`
+	Live       bool      `json:"live"`
+	Bytes      int64     `json:"bytes"`
+	DurationMs int64     `json:"durationMs"`
+	DowntimeMs int64     `json:"downtimeMs,omitempty"`
+	VM         VMSummary `json:"vm"`
 }
 
 type PortBindingRequest struct {
@@ -31,6 +341,50 @@ type PortBindingRequest struct {
 	Protocol string `json:"protocol,omitempty"`
 }
 
+// AdoptVMRequest registers a Firecracker VM that was started outside
+// mergen. Nothing about the VM is changed; the fields only describe it.
+type AdoptVMRequest struct {
+	// ID defaults to a new UUID.
+	ID         string            `json:"id,omitempty"`
+	Unit       string            `json:"unit"`
+	SocketPath string            `json:"socketPath"`
+	TapName    string            `json:"tapName,omitempty"`
+	NetNS      string            `json:"netns,omitempty"`
+	GuestIP    string            `json:"guestIP,omitempty"`
+	GuestMAC   string            `json:"guestMAC,omitempty"`
+	Ports      []PortBinding     `json:"ports,omitempty"`
+	HTTPPort   int               `json:"httpPort,omitempty"`
+	RootFS     string            `json:"rootfs,omitempty"`
+	Kernel     string            `json:"kernel,omitempty"`
+	Initrd     string            `json:"initrd,omitempty"`
+	DataDisk   string            `json:"dataDisk,omitempty"`
+	VCPU       int               `json:"vcpu,omitempty"`
+	MemMiB     int               `json:"memMiB,omitempty"`
+	Metadata   map[string]any    `json:"metadata,omitempty"`
+	Tags       map[string]string `json:"tags,omitempty"`
+}
+
+// PortReservation holds a host port for a VM that is not created yet; a
+// create naming the port in ports[].host consumes it.
+type PortReservation struct {
+	Port       int       `json:"port"`
+	Owner      string    `json:"owner,omitempty"`
+	Note       string    `json:"note,omitempty"`
+	ReservedAt time.Time `json:"reservedAt"`
+}
+
+// PortReservationRequest reserves Port, or the next free port in the
+// allocator's range when Port is 0.
+type PortReservationRequest struct {
+	Port  int    `json:"port,omitempty"`
+	Owner string `json:"owner,omitempty"`
+	Note  string `json:"note,omitempty"`
+}
+
+type PortReleaseRequest struct {
+	Port int `json:"port"`
+}
+
 type PortBinding struct {
 	Guest    int    `json:"guest"`
 	Host     int    `json:"host"`
@@ -38,20 +392,27 @@ type PortBinding struct {
 }
 
 type VMPaths struct {
-	ConfigDir    string `json:"configDir"`
-	VMConfigPath string `json:"vmConfigPath"`
-	MetaPath     string `json:"metaPath"`
-	HooksPath    string `json:"hooksPath"`
-	EnvPath      string `json:"envPath"`
-	RunDir       string `json:"runDir"`
-	SocketPath   string `json:"socketPath"`
-	LockPath     string `json:"lockPath"`
-	DataDir      string `json:"dataDir"`
-	LogsDir      string `json:"logsDir"`
+	ConfigDir      string `json:"configDir"`
+	VMConfigPath   string `json:"vmConfigPath"`
+	MetaPath       string `json:"metaPath"`
+	HooksPath      string `json:"hooksPath"`
+	EnvPath        string `json:"envPath"`
+	SealedEnvPath  string `json:"sealedEnvPath"`
+	RuntimeEnvPath string `json:"runtimeEnvPath"`
+	RunDir         string `json:"runDir"`
+	SocketPath     string `json:"socketPath"`
+	LockPath       string `json:"lockPath"`
+	DataDir        string `json:"dataDir"`
+	LogsDir        string `json:"logsDir"`
+	HookHistory    string `json:"hookHistory"`
+	StateHistory   string `json:"stateHistory"`
 }
 
 type VMMetadata struct {
+	SchemaVersion int `json:"schemaVersion,omitempty"`
+
 	ID        string                 `json:"id"`
+	Revision  int64                  `json:"revision"`
 	CreatedAt time.Time              `json:"createdAt"`
 	RootFS    string                 `json:"rootfs"`
 	Kernel    string                 `json:"kernel"`
@@ -59,24 +420,260 @@ type VMMetadata struct {
 	Ports     []PortBinding          `json:"ports"`
 	HTTPPort  int                    `json:"httpPort,omitempty"`
 	GuestIP   string                 `json:"guestIP"`
+	GuestMAC  string                 `json:"guestMAC,omitempty"`
 	TapName   string                 `json:"tapName"`
 	NetNS     string                 `json:"netns"`
 	Metadata  map[string]any         `json:"metadata,omitempty"`
 	Tags      map[string]string      `json:"tags,omitempty"`
 	Paths     VMPaths                `json:"paths"`
 	Hooks     map[string][]HookEntry `json:"hooks,omitempty"`
+	LogPolicy *LogPolicy             `json:"logPolicy,omitempty"`
+	Artifacts map[string]Artifact    `json:"artifacts,omitempty"`
+	Host      string                 `json:"host,omitempty"`
+	Placement *Placement             `json:"placement,omitempty"`
+	// KernelName is the catalog entry Kernel was resolved from, if any.
+	KernelName   string `json:"kernelName,omitempty"`
+	Initrd       string `json:"initrd,omitempty"`
+	RootReadOnly bool   `json:"rootReadOnly,omitempty"`
+	// RootFSImage is the image RootFS was copied from when it was grown to
+	// RootFSSizeMiB.
+	RootFSImage   string `json:"rootfsImage,omitempty"`
+	RootFSSizeMiB int    `json:"rootfsSizeMiB,omitempty"`
+	// Unit and SocketPath are set for adopted VMs, which keep running under
+	// their own systemd unit and API socket instead of the
+	// <prefix>@<id>.service template and the VM's run dir.
+	Unit       string `json:"unit,omitempty"`
+	SocketPath string `json:"socketPath,omitempty"`
+	// Deletion is set once a delete has started; see DeleteProgress.
+	Deletion *DeleteProgress `json:"deletion,omitempty"`
+	// Hypervisor is empty for VMs created before it was selectable, which
+	// run under Firecracker.
+	Hypervisor string      `json:"hypervisor,omitempty"`
+	SharedDirs []SharedDir `json:"sharedDirs,omitempty"`
+	// Devices are the PCI addresses the VM owns; no other VM can claim
+	// them until it is deleted.
+	Devices []string `json:"devices,omitempty"`
+	// Domains are owned the same way.
+	Domains     []string          `json:"domains,omitempty"`
+	Certificate *CertificateState `json:"certificate,omitempty"`
+	// Snapshots are the saved run states of the VM, oldest first.
+	Snapshots []Snapshot `json:"snapshots,omitempty"`
+	Schedule  *Schedule  `json:"schedule,omitempty"`
+	// Namespace is empty for VMs created before namespaces, which belong
+	// to DefaultNamespace; see NamespaceOf.
+	Namespace string `json:"namespace,omitempty"`
+	// DesiredState is DesiredRunning or DesiredStopped, whichever the last
+	// start or stop asked for; the reconciler converges the unit to it.
+	// It is empty for VMs not started or stopped since it was added.
+	DesiredState  string         `json:"desiredState,omitempty"`
+	RestartPolicy *RestartPolicy `json:"restartPolicy,omitempty"`
+	HealthProbe   *HealthProbe   `json:"healthProbe,omitempty"`
+	Restarts      *RestartState  `json:"restarts,omitempty"`
+
+	IdleTimeoutMinutes int `json:"idleTimeoutMinutes,omitempty"`
+}
+
+const (
+	DesiredRunning = "running"
+	DesiredStopped = "stopped"
+)
+
+// Snapshot is a saved run state of a Firecracker VM: guest memory, device
+// state and a copy of each writable disk, all under Dir.
+type Snapshot struct {
+	ID        string    `json:"id"`
+	Name      string    `json:"name,omitempty"`
+	CreatedAt time.Time `json:"createdAt"`
+	Dir       string    `json:"dir"`
+	SizeBytes int64     `json:"sizeBytes"`
+	// Disks are the artifact names (rootfs, dataDisk) whose contents the
+	// snapshot holds; restoring writes them back.
+	Disks []string `json:"disks"`
+}
+
+type CreateSnapshotRequest struct {
+	Name string `json:"name,omitempty"`
+	// Stop leaves the VM stopped instead of resuming it after the snapshot.
+	Stop bool `json:"stop,omitempty"`
+}
+
+// RestoreSnapshotRequest names the snapshot by ID or name.
+type RestoreSnapshotRequest struct {
+	Snapshot string `json:"snapshot"`
+}
+
+// Certificate states.
+const (
+	CertificatePending = "pending"
+	CertificateIssued  = "issued"
+	CertificateFailed  = "failed"
+)
+
+// CertificateState tracks the certificate of a VM's domains. The chain and
+// key live in mergend's certificate dir, not in the metadata.
+type CertificateState struct {
+	Status   string     `json:"status"`
+	Serial   string     `json:"serial,omitempty"`
+	IssuedAt *time.Time `json:"issuedAt,omitempty"`
+	NotAfter *time.Time `json:"notAfter,omitempty"`
+	// LastAttempt and Error are set by a failed issue or renewal, which is
+	// retried later; an issued certificate stays in use meanwhile.
+	LastAttempt *time.Time `json:"lastAttempt,omitempty"`
+	Error       string     `json:"error,omitempty"`
+}
+
+// Delete steps, in the order a delete runs them.
+const (
+	DeleteStepDrain   = "drain"
+	DeleteStepStop    = "stop"
+	DeleteStepVolumes = "volumes"
+	DeleteStepNetwork = "network"
+	DeleteStepCerts   = "certificate"
+	DeleteStepStore   = "store"
+)
+
+// DeleteProgress records how far a delete got, so one that failed part way
+// is resumed from the failed step by deleting again. A VM carrying it is no
+// longer routed by the forwarder and cannot be started.
+type DeleteProgress struct {
+	StartedAt  time.Time `json:"startedAt"`
+	Completed  []string  `json:"completed,omitempty"`
+	FailedStep string    `json:"failedStep,omitempty"`
+	Error      string    `json:"error,omitempty"`
+}
+
+// Kernel is a named entry in the host's kernel catalog.
+type Kernel struct {
+	Name     string `json:"name"`
+	Path     string `json:"path"`
+	Arch     string `json:"arch"`
+	BootArgs string `json:"bootArgs,omitempty"`
+	// Initrd is the initramfs VMs booting this kernel get by default.
+	Initrd       string    `json:"initrd,omitempty"`
+	Description  string    `json:"description,omitempty"`
+	SHA256       string    `json:"sha256"`
+	Size         int64     `json:"size"`
+	RegisteredAt time.Time `json:"registeredAt"`
+}
+
+// VMTemplate is a named create request stored next to vm.d. Spec may leave
+// out fields a create from it has to set in its overrides.
+type VMTemplate struct {
+	Name        string          `json:"name"`
+	Description string          `json:"description,omitempty"`
+	Spec        CreateVMRequest `json:"spec"`
+	CreatedAt   time.Time       `json:"createdAt"`
+	UpdatedAt   time.Time       `json:"updatedAt"`
+}
+
+// DefaultNamespace holds VMs created without a namespace. It always exists;
+// registering it only sets its quota.
+const DefaultNamespace = "default"
+
+// NamespaceOf returns the namespace meta belongs to.
+func NamespaceOf(meta VMMetadata) string {
+	if meta.Namespace == "" {
+		return DefaultNamespace
+	}
+	return meta.Namespace
+}
+
+// Namespace is a named group of VMs with its own quota, stored next to
+// vm.d. Usage is filled in by reads only.
+type Namespace struct {
+	Name        string          `json:"name"`
+	Description string          `json:"description,omitempty"`
+	Quota       NamespaceQuota  `json:"quota"`
+	Usage       *NamespaceUsage `json:"usage,omitempty"`
+	CreatedAt   time.Time       `json:"createdAt"`
+	UpdatedAt   time.Time       `json:"updatedAt"`
+}
+
+// NamespaceQuota bounds a namespace's VMs, their memory in total and the
+// host ports published for them. Zero leaves a limit off.
+type NamespaceQuota struct {
+	MaxVMs int `json:"maxVMs,omitempty"`
+	MemMiB int `json:"memMiB,omitempty"`
+	Ports  int `json:"ports,omitempty"`
+}
+
+// NamespaceUsage is what a namespace's VMs take of its quota.
+type NamespaceUsage struct {
+	VMs    int `json:"vms"`
+	MemMiB int `json:"memMiB"`
+	Ports  int `json:"ports"`
+}
+
+// Artifact keys in VMMetadata.Artifacts.
+const (
+	ArtifactRootFS   = "rootfs"
+	ArtifactKernel   = "kernel"
+	ArtifactInitrd   = "initrd"
+	ArtifactDataDisk = "dataDisk"
+)
+
+// Artifact pins the content of a disk or kernel image by SHA-256.
+type Artifact struct {
+	Path       string    `json:"path"`
+	SHA256     string    `json:"sha256"`
+	Size       int64     `json:"size"`
+	RecordedAt time.Time `json:"recordedAt"`
+}
+
+const (
+	ArtifactOK         = "ok"
+	ArtifactModified   = "modified"
+	ArtifactMissing    = "missing"
+	ArtifactUnrecorded = "unrecorded"
+)
+
+type ArtifactStatus struct {
+	Name     string `json:"name"`
+	Path     string `json:"path"`
+	Status   string `json:"status"`
+	Expected string `json:"expected,omitempty"`
+	Actual   string `json:"actual,omitempty"`
+	Size     int64  `json:"size,omitempty"`
+	Error    string `json:"error,omitempty"`
+}
+
+type ArtifactReport struct {
+	ID        string           `json:"id"`
+	CheckedAt time.Time        `json:"checkedAt"`
+	OK        bool             `json:"ok"`
+	Recorded  bool             `json:"recorded,omitempty"`
+	Artifacts []ArtifactStatus `json:"artifacts"`
 }
 
 type HookEntry struct {
-	Type      string            `json:"type"`
-	URL       string            `json:"url,omitempty"`
-	Cmd       []string          `json:"cmd,omitempty"`
-	TimeoutMs int               `json:"timeoutMs,omitempty"`
-	Headers   map[string]string `json:"headers,omitempty"`
-	Strict    bool              `json:"strict,omitempty"`
+	Type          string            `json:"type"`
+	URL           string            `json:"url,omitempty"`
+	Cmd           []string          `json:"cmd,omitempty"`
+	TimeoutMs     int               `json:"timeoutMs,omitempty"`
+	Headers       map[string]string `json:"headers,omitempty"`
+	Body          string            `json:"body,omitempty"`
+	WorkDir       string            `json:"workDir,omitempty"`
+	Strict        bool              `json:"strict,omitempty"`
+	SecretRef     string            `json:"secretRef,omitempty"`
+	HMACSecretRef string            `json:"hmacSecretRef,omitempty"`
+	Message       string            `json:"message,omitempty"`
+	Channel       string            `json:"channel,omitempty"`
+	DNS           *DNSHook          `json:"dns,omitempty"`
+}
+
+type DNSHook struct {
+	Provider string `json:"provider"`
+	Endpoint string `json:"endpoint,omitempty"`
+	Zone     string `json:"zone,omitempty"`
+	Name     string `json:"name"`
+	Value    string `json:"value,omitempty"`
+	TTL      int    `json:"ttl,omitempty"`
+	Action   string `json:"action,omitempty"`
 }
 
 type HooksConfig struct {
+	SchemaVersion int `json:"schemaVersion,omitempty"`
+
 	OnCreate []HookEntry `json:"onCreate,omitempty"`
 	OnDelete []HookEntry `json:"onDelete,omitempty"`
 	OnStart  []HookEntry `json:"onStart,omitempty"`
@@ -85,6 +682,7 @@ type HooksConfig struct {
 
 type HookContext struct {
 	ID         string         `json:"id"`
+	Event      string         `json:"event,omitempty"`
 	HostPorts  []int          `json:"hostPorts"`
 	GuestPorts []int          `json:"guestPorts"`
 	GuestIP    string         `json:"guestIP"`
@@ -93,14 +691,484 @@ type HookContext struct {
 	Metadata   map[string]any `json:"metadata,omitempty"`
 }
 
+const (
+	StoreEventCreated = "created"
+	StoreEventUpdated = "updated"
+	StoreEventDeleted = "deleted"
+	// StoreEventBootFileChanged is raised by mergend, not the store, when a
+	// running VM's rootfs, kernel or initrd changes under it.
+	StoreEventBootFileChanged = "bootFileChanged"
+	// StoreEventReconciled is raised when a VM is found drifted from its
+	// desired state and when the reconciler acts on it; Reason says which.
+	StoreEventReconciled = "reconciled"
+	// StoreEventHealthChanged is raised when a VM's health probe turns it
+	// healthy or unhealthy; Reason is the new HealthState status.
+	StoreEventHealthChanged = "healthChanged"
+)
+
+// Reasons of a StoreEventReconciled.
+const (
+	ReconcileCrashed       = "crashed"
+	ReconcileStarted       = "started"
+	ReconcileRestarted     = "restarted"
+	ReconcileStartFailed   = "startFailed"
+	ReconcileStopped       = "stopped"
+	ReconcileSocketRemoved = "socketRemoved"
+)
+
+type StoreEvent struct {
+	Type     string    `json:"type"`
+	ID       string    `json:"id"`
+	Revision int64     `json:"revision,omitempty"`
+	Reason   string    `json:"reason,omitempty"`
+	At       time.Time `json:"at"`
+}
+
+const (
+	FsckCorrupt  = "corrupt"
+	FsckInvalid  = "invalid"
+	FsckConflict = "conflict"
+	FsckOrphan   = "orphan"
+)
+
+type FsckIssue struct {
+	VMID        string `json:"vmID"`
+	File        string `json:"file,omitempty"`
+	Kind        string `json:"kind"`
+	Message     string `json:"message"`
+	Quarantined bool   `json:"quarantined,omitempty"`
+}
+
+type FsckReport struct {
+	CheckedAt     time.Time   `json:"checkedAt"`
+	DryRun        bool        `json:"dryRun"`
+	Checked       int         `json:"checked"`
+	Issues        []FsckIssue `json:"issues"`
+	Quarantined   []string    `json:"quarantined,omitempty"`
+	QuarantineDir string      `json:"quarantineDir,omitempty"`
+}
+
+// UsageRecord is one VM's consumption over [Start, End). CPU and network are
+// measured; VCPU and MemMiB are what the VM was given, so allocation-based
+// charges are RuntimeSeconds times those.
+type UsageRecord struct {
+	VMID            string            `json:"vmID"`
+	Tenant          string            `json:"tenant,omitempty"`
+	Tags            map[string]string `json:"tags,omitempty"`
+	Start           time.Time         `json:"start"`
+	End             time.Time         `json:"end"`
+	RuntimeSeconds  float64           `json:"runtimeSeconds"`
+	CPUSeconds      float64           `json:"cpuSeconds"`
+	VCPU            int               `json:"vcpu"`
+	MemMiB          int               `json:"memMiB"`
+	MemoryPeakBytes int64             `json:"memoryPeakBytes"`
+	RxBytes         int64             `json:"rxBytes"`
+	TxBytes         int64             `json:"txBytes"`
+}
+
+type UsageReport struct {
+	From    time.Time    `json:"from"`
+	To      time.Time    `json:"to"`
+	GroupBy string       `json:"groupBy"`
+	Groups  []UsageGroup `json:"groups"`
+}
+
+// UsageGroup sums the records of every VM whose GroupBy tag had Key; VMs
+// without the tag are grouped under "".
+type UsageGroup struct {
+	Key              string  `json:"key"`
+	VMs              int     `json:"vms"`
+	RuntimeSeconds   float64 `json:"runtimeSeconds"`
+	CPUSeconds       float64 `json:"cpuSeconds"`
+	VCPUSeconds      float64 `json:"vcpuSeconds"`
+	MemoryMiBSeconds float64 `json:"memoryMiBSeconds"`
+	MemoryPeakBytes  int64   `json:"memoryPeakBytes"`
+	RxBytes          int64   `json:"rxBytes"`
+	TxBytes          int64   `json:"txBytes"`
+}
+
+// Diagnostic check statuses. Failed checks keep VMs from starting; warnings
+// only affect optional features.
+const (
+	DiagnosticOK   = "ok"
+	DiagnosticWarn = "warn"
+	DiagnosticFail = "fail"
+)
+
+// HostCapacity is what the VMs of a host commit against what it admits: its
+// CPUs and memory times their overcommit factor. A zero allocatable value
+// means that resource is not checked.
+type HostCapacity struct {
+	Host             string        `json:"host"`
+	VCPUs            int           `json:"vcpus"`
+	MemMiB           int           `json:"memMiB"`
+	CPUOvercommit    float64       `json:"cpuOvercommit"`
+	MemoryOvercommit float64       `json:"memoryOvercommit"`
+	Allocatable      CapacityUsage `json:"allocatable"`
+	Committed        CapacityUsage `json:"committed"`
+	VMs              int           `json:"vms"`
+}
+
+// CapacityUsage counts vCPUs and memory as VM configs declare them.
+type CapacityUsage struct {
+	VCPUs  int `json:"vcpus"`
+	MemMiB int `json:"memMiB"`
+}
+
+type HostDiagnostics struct {
+	CheckedAt time.Time         `json:"checkedAt"`
+	OK        bool              `json:"ok"`
+	Checks    []DiagnosticCheck `json:"checks"`
+}
+
+type DiagnosticCheck struct {
+	Name        string `json:"name"`
+	Status      string `json:"status"`
+	Message     string `json:"message"`
+	Remediation string `json:"remediation,omitempty"`
+}
+
+// LockHolder is written into a VM lock by whoever holds it.
+type LockHolder struct {
+	PID        int       `json:"pid"`
+	Host       string    `json:"host"`
+	Operation  string    `json:"operation,omitempty"`
+	AcquiredAt time.Time `json:"acquiredAt"`
+}
+
+type LockStatus struct {
+	ID     string      `json:"id"`
+	Held   bool        `json:"held"`
+	Stale  bool        `json:"stale,omitempty"`
+	Holder *LockHolder `json:"holder,omitempty"`
+	Broken bool        `json:"broken,omitempty"`
+}
+
+// LogLevelRequest changes runtime log levels. An empty Level keeps the
+// default; an empty component value drops that component's override.
+type LogLevelRequest struct {
+	Level      string            `json:"level,omitempty"`
+	Components map[string]string `json:"components,omitempty"`
+}
+
+// MaintenanceState is mergend's read-only switch. While ReadOnly is set
+// mutating endpoints answer 503 and reads keep working.
+type MaintenanceState struct {
+	ReadOnly bool       `json:"readOnly"`
+	Reason   string     `json:"reason,omitempty"`
+	Since    *time.Time `json:"since,omitempty"`
+}
+
+// BreakerState is mergend's automation circuit breaker. While Tripped is
+// set background automation is paused; API requests keep working.
+type BreakerState struct {
+	Tripped        bool       `json:"tripped"`
+	Reason         string     `json:"reason,omitempty"`
+	Since          *time.Time `json:"since,omitempty"`
+	ResumesAt      *time.Time `json:"resumesAt,omitempty"`
+	Trips          int        `json:"trips"`
+	CreateFailures int        `json:"consecutiveCreateFailures"`
+	HookFailures   int        `json:"recentHookFailures"`
+}
+
+// Operation is a create or VM-locked operation in progress. VMID is
+// empty for a create that has not picked its ID yet.
+type Operation struct {
+	VMID      string    `json:"vmID,omitempty"`
+	Operation string    `json:"operation"`
+	StartedAt time.Time `json:"startedAt"`
+}
+
+// Job statuses: a job is queued until a worker takes it, then running
+// until it succeeded or failed.
+const (
+	JobQueued    = "queued"
+	JobRunning   = "running"
+	JobSucceeded = "succeeded"
+	JobFailed    = "failed"
+)
+
+// Job is an asynchronous operation, polled at /v1/operations/:id. Stage
+// says what a running job is doing; VMID is set once the job's VM exists,
+// which may also be the case for a failed job. Host and PID name the
+// process that runs it.
+type Job struct {
+	ID         string     `json:"id"`
+	Kind       string     `json:"kind"`
+	Status     string     `json:"status"`
+	Stage      string     `json:"stage,omitempty"`
+	Namespace  string     `json:"namespace,omitempty"`
+	VMID       string     `json:"vmID,omitempty"`
+	Error      string     `json:"error,omitempty"`
+	Message    string     `json:"message,omitempty"`
+	Host       string     `json:"host,omitempty"`
+	PID        int        `json:"pid"`
+	CreatedAt  time.Time  `json:"createdAt"`
+	StartedAt  *time.Time `json:"startedAt,omitempty"`
+	FinishedAt *time.Time `json:"finishedAt,omitempty"`
+}
+
+// AuditEntry records one mutating API call: who made it (the API token's
+// name and the client address), what it did and when, and how it ended.
+// PayloadDigest is the sha256 of the first PayloadBytes bytes of the
+// request body, the ones mergend read.
+type AuditEntry struct {
+	At            time.Time `json:"at"`
+	RequestID     string    `json:"requestID,omitempty"`
+	Token         string    `json:"token,omitempty"`
+	RemoteAddr    string    `json:"remoteAddr"`
+	Method        string    `json:"method"`
+	Path          string    `json:"path"`
+	Route         string    `json:"route"`
+	Action        string    `json:"action"`
+	Namespace     string    `json:"namespace,omitempty"`
+	VMID          string    `json:"vmID,omitempty"`
+	PayloadDigest string    `json:"payloadDigest,omitempty"`
+	PayloadBytes  int64     `json:"payloadBytes,omitempty"`
+	Status        int       `json:"status"`
+}
+
+// AuditFilter selects audit entries; empty fields match every entry, and
+// a zero Limit returns the default number of the newest.
+type AuditFilter struct {
+	VMID      string
+	Token     string
+	Action    string
+	Namespace string
+	Since     time.Time
+	Until     time.Time
+	Limit     int
+}
+
+// UpgradeStatus describes in-place upgrades of mergend. Previous is the
+// process this one took over from, which may still be finishing requests.
+type UpgradeStatus struct {
+	PID        int              `json:"pid"`
+	Upgrading  bool             `json:"upgrading"`
+	Operations []Operation      `json:"operations"`
+	Previous   *PreviousProcess `json:"previous,omitempty"`
+}
+
+type PreviousProcess struct {
+	PID          int         `json:"pid"`
+	Running      bool        `json:"running"`
+	HandedOverAt time.Time   `json:"handedOverAt"`
+	Operations   []Operation `json:"operations"`
+}
+
+type BreakerResetRequest struct {
+	Reason string `json:"reason,omitempty"`
+}
+
+type MaintenanceRequest struct {
+	ReadOnly bool   `json:"readOnly"`
+	Reason   string `json:"reason,omitempty"`
+}
+
+type HookTestRequest struct {
+	Event  string     `json:"event"`
+	Index  int        `json:"index,omitempty"`
+	Hook   *HookEntry `json:"hook,omitempty"`
+	DryRun bool       `json:"dryRun,omitempty"`
+}
+
+type HookTestResult struct {
+	Event     string         `json:"event"`
+	DryRun    bool           `json:"dryRun"`
+	Hook      HookEntry      `json:"hook"`
+	Rendered  RenderedHook   `json:"rendered"`
+	Execution *HookExecution `json:"execution,omitempty"`
+}
+
+type RenderedHook struct {
+	URL      string            `json:"url,omitempty"`
+	Headers  map[string]string `json:"headers,omitempty"`
+	Body     string            `json:"body,omitempty"`
+	Cmd      []string          `json:"cmd,omitempty"`
+	WorkDir  string            `json:"workDir,omitempty"`
+	Message  string            `json:"message,omitempty"`
+	DNSName  string            `json:"dnsName,omitempty"`
+	DNSValue string            `json:"dnsValue,omitempty"`
+}
+
+type HookExecution struct {
+	Event      string    `json:"event"`
+	Index      int       `json:"index"`
+	Type       string    `json:"type"`
+	Target     string    `json:"target,omitempty"`
+	StartedAt  time.Time `json:"startedAt"`
+	DurationMs int64     `json:"durationMs"`
+	Status     string    `json:"status"`
+	Error      string    `json:"error,omitempty"`
+	Output     string    `json:"output,omitempty"`
+	Truncated  bool      `json:"truncated,omitempty"`
+}
+
+const (
+	TransitionCreated  = "created"
+	TransitionStarted  = "started"
+	TransitionStopped  = "stopped"
+	TransitionCrashed  = "crashed"
+	TransitionRestored = "restored"
+)
+
+// VMFilter selects VMs in a list: a VM matches when it carries every tag
+// and every metadata value. Metadata keys are dotted paths into nested
+// objects; values are compared as text, so "3" matches the number 3.
+type VMFilter struct {
+	Tags      map[string]string `json:"tags,omitempty"`
+	Metadata  map[string]string `json:"metadata,omitempty"`
+	Namespace string            `json:"namespace,omitempty"`
+}
+
+// Sort orders of a VM list.
+const (
+	VMSortCreatedAt = "createdAt"
+	VMSortID        = "id"
+)
+
+// VMListPage selects one page of a VM list. Sort is VMSortCreatedAt, newest
+// first and the default, or VMSortID; Cursor is the NextCursor of the page
+// before. A zero Limit returns every VM after the cursor.
+type VMListPage struct {
+	Limit  int    `json:"limit,omitempty"`
+	Cursor string `json:"cursor,omitempty"`
+	Sort   string `json:"sort,omitempty"`
+}
+
+// StateTransition is one entry of a VM's state history.
+type StateTransition struct {
+	State  string    `json:"state"`
+	At     time.Time `json:"at"`
+	Detail string    `json:"detail,omitempty"`
+}
+
+// GuestStats is the latest resource sample the init of a VM sent over
+// vsock. At is when mergend received it, so a stale sample shows.
+type GuestStats struct {
+	At              time.Time  `json:"at"`
+	Load            [3]float64 `json:"load"`
+	MemTotalKiB     int64      `json:"memTotalKiB"`
+	MemAvailableKiB int64      `json:"memAvailableKiB"`
+	// WorkloadRSSKiB adds up the resident memory of the workload's
+	// process group.
+	WorkloadRSSKiB int64   `json:"workloadRSSKiB"`
+	Processes      int     `json:"processes"`
+	UptimeSeconds  float64 `json:"uptimeSeconds"`
+}
+
+// VMMetrics adds up the metrics Firecracker flushed for a VM since mergend
+// began reading them. Counters holds each group of the flushes, such as
+// "block_rootfs", "net_eth0" or "vcpu", by metric; nested metrics are named
+// with dots, as in "exit_io_in_agg.sum_us". Counts are summed over the
+// flushes, "min_us" and "max_us" metrics keep the lowest and highest value,
+// and the "latencies_us" group keeps the last one.
+type VMMetrics struct {
+	Since    time.Time                     `json:"since"`
+	At       time.Time                     `json:"at"`
+	Flushes  int64                         `json:"flushes"`
+	Counters map[string]map[string]float64 `json:"counters"`
+}
+
+// VMMetricsTotals adds up the VMMetrics of every VM of the host the same
+// way, leaving out the per-VM "latencies_us" group.
+type VMMetricsTotals struct {
+	At       time.Time                     `json:"at"`
+	VMs      int                           `json:"vms"`
+	Flushes  int64                         `json:"flushes"`
+	Counters map[string]map[string]float64 `json:"counters"`
+}
+
 type VMSummary struct {
-	ID          string           `json:"id"`
-	CreatedAt   time.Time        `json:"createdAt"`
-	Systemd     SystemdState     `json:"systemd"`
-	Firecracker FirecrackerState `json:"firecracker"`
-	Network     NetworkState     `json:"network"`
-	Paths       VMPaths          `json:"paths"`
-	Metadata    map[string]any   `json:"metadata,omitempty"`
+	ID          string            `json:"id"`
+	Namespace   string            `json:"namespace"`
+	Revision    int64             `json:"revision"`
+	CreatedAt   time.Time         `json:"createdAt"`
+	Systemd     SystemdState      `json:"systemd"`
+	Firecracker FirecrackerState  `json:"firecracker"`
+	Network     NetworkState      `json:"network"`
+	Paths       VMPaths           `json:"paths"`
+	Metadata    map[string]any    `json:"metadata,omitempty"`
+	Tags        map[string]string `json:"tags,omitempty"`
+	Host        string            `json:"host,omitempty"`
+	// BootFiles is set while the VM runs and says whether the files it
+	// booted from are still the ones on disk.
+	BootFiles []BootFileState `json:"bootFiles,omitempty"`
+	Deletion  *DeleteProgress `json:"deletion,omitempty"`
+	// Hypervisor is the VMM the VM runs under.
+	Hypervisor string `json:"hypervisor,omitempty"`
+	// Devices are the PCI addresses passed through to the VM.
+	Devices     []string          `json:"devices,omitempty"`
+	Domains     []string          `json:"domains,omitempty"`
+	Certificate *CertificateState `json:"certificate,omitempty"`
+	Snapshots   []Snapshot        `json:"snapshots,omitempty"`
+	Schedule    *Schedule         `json:"schedule,omitempty"`
+	// DesiredState is what the reconciler keeps the unit at; see
+	// VMMetadata.DesiredState.
+	DesiredState  string         `json:"desiredState,omitempty"`
+	RestartPolicy *RestartPolicy `json:"restartPolicy,omitempty"`
+	HealthProbe   *HealthProbe   `json:"healthProbe,omitempty"`
+	Restarts      *RestartState  `json:"restarts,omitempty"`
+	// Health is set while a VM with a health probe runs.
+	Health *HealthState `json:"health,omitempty"`
+
+	IdleTimeoutMinutes int `json:"idleTimeoutMinutes,omitempty"`
+	// LastActivityAt is when the forwarder last reported traffic for the
+	// VM, or it was last started, since mergend started.
+	LastActivityAt *time.Time `json:"lastActivityAt,omitempty"`
+}
+
+// WakeVMRequest starts a VM stopped for idleness. With a Port, the wake
+// also waits, up to TimeoutSeconds, until the guest accepts connections on
+// it.
+type WakeVMRequest struct {
+	Port           int `json:"port,omitempty"`
+	TimeoutSeconds int `json:"timeoutSeconds,omitempty"`
+}
+
+// ExecRequest runs Command inside a running guest, as User (the workload's
+// by default) in WorkDir, with Env added to the workload's environment.
+type ExecRequest struct {
+	Command        []string          `json:"command"`
+	Env            map[string]string `json:"env,omitempty"`
+	WorkDir        string            `json:"workDir,omitempty"`
+	User           string            `json:"user,omitempty"`
+	Stdin          string            `json:"stdin,omitempty"`
+	TimeoutSeconds int               `json:"timeoutSeconds,omitempty"`
+}
+
+// ExecResult is how a command run in a guest ended. Stdout and Stderr keep
+// the first MiB each; Truncated says more was written. A command killed at
+// its timeout has TimedOut set and exit code 137.
+type ExecResult struct {
+	ExitCode   int    `json:"exitCode"`
+	Stdout     string `json:"stdout"`
+	Stderr     string `json:"stderr"`
+	Truncated  bool   `json:"truncated,omitempty"`
+	TimedOut   bool   `json:"timedOut,omitempty"`
+	DurationMs int64  `json:"durationMs"`
+}
+
+// ActivityReport lists the VMs the forwarder routed traffic to, or still
+// holds connections to, since its last report.
+type ActivityReport struct {
+	IDs []string `json:"ids"`
+}
+
+const (
+	BootFileUnchanged = "unchanged"
+	BootFileModified  = "modified"
+	BootFileReplaced  = "replaced"
+	BootFileDeleted   = "deleted"
+)
+
+// BootFileState compares a running VM's boot file with what was on disk
+// when the VM was first seen running. Since is when a change was noticed.
+type BootFileState struct {
+	Role   string     `json:"role"`
+	Path   string     `json:"path"`
+	Status string     `json:"status"`
+	Since  *time.Time `json:"since,omitempty"`
 }
 
 type SystemdState struct {
@@ -115,25 +1183,72 @@ type SystemdState struct {
 type FirecrackerState struct {
 	SocketPath    string `json:"socketPath"`
 	SocketPresent bool   `json:"socketPresent"`
+	// SocketStale marks a socket file nothing listens on, left behind by a
+	// Firecracker process that died; SocketPresent is false then.
+	SocketStale bool `json:"socketStale"`
+	// State is the microVM's run state as Firecracker reports it, e.g.
+	// "Running" or "Paused"; empty when the VM is not running, and in
+	// VM lists, which do not query each VM.
+	State string `json:"state,omitempty"`
+	// Paused is set while the VM is frozen by POST /v1/vms/:id/pause.
+	Paused bool `json:"paused"`
 }
 
 type NetworkState struct {
-	GuestIP string        `json:"guestIP"`
-	Ports   []PortBinding `json:"ports"`
-	TapName string        `json:"tapName"`
-	NetNS   string        `json:"netns"`
+	GuestIP  string        `json:"guestIP"`
+	GuestMAC string        `json:"guestMAC"`
+	Ports    []PortBinding `json:"ports"`
+	HTTPPort int           `json:"httpPort,omitempty"`
+	TapName  string        `json:"tapName"`
+	NetNS    string        `json:"netns"`
 }
 
 type VMConfig struct {
+	SchemaVersion int `json:"schemaVersion,omitempty"`
+
 	BootSource        BootSource         `json:"boot-source"`
 	Drives            []Drive            `json:"drives"`
 	MachineConfig     MachineConfig      `json:"machine-config"`
 	NetworkInterfaces []NetworkInterface `json:"network-interfaces"`
 	Vsock             *Vsock             `json:"vsock,omitempty"`
+	Console           *Console           `json:"console,omitempty"`
+	Metrics           *Metrics           `json:"metrics,omitempty"`
+	MMDSConfig        *MMDSConfig        `json:"mmds-config,omitempty"`
+	// MMDS is the metadata document mergen-configure-start puts into the
+	// metadata service; it is not part of Firecracker's config format.
+	MMDS map[string]any `json:"mmds,omitempty"`
+	// FS lists virtio-fs devices. Firecracker has none; they are set for
+	// Cloud Hypervisor VMs only.
+	FS []FSDevice `json:"fs,omitempty"`
+	// Devices lists VFIO passthrough devices, which Firecracker does not
+	// support either.
+	Devices []PCIDevice `json:"devices,omitempty"`
+}
+
+// FSDevice is a virtio-fs device and the virtiofsd mergen-jailer-start runs
+// to serve SharedDir on SocketPath.
+type FSDevice struct {
+	Tag        string `json:"tag"`
+	SocketPath string `json:"socket_path"`
+	SharedDir  string `json:"shared_dir"`
+	ReadOnly   bool   `json:"read_only,omitempty"`
+}
+
+// PCIDevice is a host PCI device passed through over VFIO; Path is its
+// sysfs directory.
+type PCIDevice struct {
+	ID   string `json:"id"`
+	Path string `json:"path"`
+}
+
+type MMDSConfig struct {
+	Version           string   `json:"version"`
+	NetworkInterfaces []string `json:"network_interfaces"`
 }
 
 type BootSource struct {
 	KernelImagePath string `json:"kernel_image_path"`
+	InitrdPath      string `json:"initrd_path,omitempty"`
 	BootArgs        string `json:"boot_args"`
 }
 
@@ -156,6 +1271,20 @@ type NetworkInterface struct {
 	GuestMAC    string `json:"guest_mac,omitempty"`
 }
 
+// Console is where mergen-jailer-start connects the VMM's serial port: its
+// input is read from the InputPath FIFO and its output appended to
+// OutputPath. It is not part of Firecracker's config format.
+type Console struct {
+	InputPath  string `json:"input_path"`
+	OutputPath string `json:"output_path,omitempty"`
+}
+
+// Metrics is the FIFO Firecracker flushes its metrics to, one JSON line a
+// minute; Cloud Hypervisor VMs have none.
+type Metrics struct {
+	MetricsPath string `json:"metrics_path"`
+}
+
 type Vsock struct {
 	VsockID  string `json:"vsock_id"`
 	GuestCID int    `json:"guest_cid"`
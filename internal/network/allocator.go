@@ -6,27 +6,47 @@ import (
 	"log/slog"
 	"net/netip"
 	"sort"
+	"strconv"
 	"strings"
+	"sync"
 
 	"github.com/alperreha/mergen-fire/internal/model"
 )
 
+// DefaultMACPrefix is the locally administered OUI guest MACs are taken
+// from unless configured otherwise.
+const DefaultMACPrefix = "02:FC:00"
+
 type Allocator struct {
+	mu        sync.RWMutex
 	portStart int
 	portEnd   int
 	guestCIDR string
+	macPrefix [3]byte
+	held      *Reservations
 	logger    *slog.Logger
 }
 
 func NewAllocator(portStart, portEnd int, guestCIDR string) *Allocator {
+	prefix, _ := ParseMACPrefix(DefaultMACPrefix)
 	return &Allocator{
 		portStart: portStart,
 		portEnd:   portEnd,
 		guestCIDR: guestCIDR,
+		macPrefix: prefix,
 		logger:    slog.Default(),
 	}
 }
 
+// WithMACPrefix sets the OUI of allocated guest MACs; prefix must pass
+// ParseMACPrefix, an invalid one keeps the current prefix.
+func (a *Allocator) WithMACPrefix(prefix string) *Allocator {
+	if parsed, err := ParseMACPrefix(prefix); err == nil {
+		a.macPrefix = parsed
+	}
+	return a
+}
+
 func (a *Allocator) WithLogger(logger *slog.Logger) *Allocator {
 	if logger != nil {
 		a.logger = logger
@@ -34,6 +54,14 @@ func (a *Allocator) WithLogger(logger *slog.Logger) *Allocator {
 	return a
 }
 
+// SetPortRange changes the range new host ports are taken from. Existing
+// bindings outside the new range are left alone.
+func (a *Allocator) SetPortRange(start, end int) {
+	a.mu.Lock()
+	a.portStart, a.portEnd = start, end
+	a.mu.Unlock()
+}
+
 func (a *Allocator) Allocate(existing []model.VMMetadata, requests []model.PortBindingRequest) (string, []model.PortBinding, error) {
 	a.logger.Debug("allocation started", "existingVMs", len(existing), "requestedPorts", len(requests), "guestCIDR", a.guestCIDR)
 	guestIP, err := a.allocateGuestIP(existing)
@@ -58,6 +86,11 @@ func (a *Allocator) allocatePorts(existing []model.VMMetadata, requests []model.
 		}
 	}
 
+	held, err := a.heldPorts()
+	if err != nil {
+		return nil, err
+	}
+
 	bindings := make([]model.PortBinding, 0, len(requests))
 	reserved := map[int]struct{}{}
 
@@ -79,7 +112,7 @@ func (a *Allocator) allocatePorts(existing []model.VMMetadata, requests []model.
 
 		hostPort := req.Host
 		if hostPort == 0 {
-			hostPort = a.nextFreePort(used, reserved)
+			hostPort = a.nextFreePort(used, reserved, held)
 			if hostPort == 0 {
 				return nil, errors.New("no available host port in configured range")
 			}
@@ -108,13 +141,17 @@ func (a *Allocator) allocatePorts(existing []model.VMMetadata, requests []model.
 	return bindings, nil
 }
 
-func (a *Allocator) nextFreePort(used, reserved map[int]struct{}) int {
-	for port := a.portStart; port <= a.portEnd; port++ {
-		if _, exists := used[port]; exists {
-			continue
-		}
-		if _, exists := reserved[port]; exists {
-			continue
+// nextFreePort returns the lowest port in range that is in none of taken.
+func (a *Allocator) nextFreePort(taken ...map[int]struct{}) int {
+	a.mu.RLock()
+	start, end := a.portStart, a.portEnd
+	a.mu.RUnlock()
+next:
+	for port := start; port <= end; port++ {
+		for _, set := range taken {
+			if _, exists := set[port]; exists {
+				continue next
+			}
 		}
 		return port
 	}
@@ -158,23 +195,68 @@ func (a *Allocator) allocateGuestIP(existing []model.VMMetadata) (string, error)
 	return "", errors.New("no available guest IP address in CIDR")
 }
 
-func TapName(id string) string {
-	shortID := id
-	if len(shortID) > 8 {
-		shortID = shortID[:8]
+// AllocateMAC returns the lowest guest MAC under the allocator's prefix that
+// no VM in existing holds.
+func (a *Allocator) AllocateMAC(existing []model.VMMetadata) (string, error) {
+	used := make(map[string]struct{}, len(existing))
+	for _, vm := range existing {
+		used[MACOf(vm)] = struct{}{}
 	}
-	return "tap-" + shortID
+	for suffix := uint32(1); suffix < 1<<24; suffix++ {
+		mac := formatMAC(a.macPrefix, suffix)
+		if _, ok := used[mac]; !ok {
+			a.logger.Debug("guest mac allocated", "mac", mac)
+			return mac, nil
+		}
+	}
+	return "", errors.New("no available guest MAC address under prefix")
 }
 
-func NetNSName(id string) string {
-	shortID := id
-	if len(shortID) > 8 {
-		shortID = shortID[:8]
+// ParseMACPrefix parses a three-octet OUI such as "02:FC:00". It must be
+// locally administered and unicast so it cannot clash with vendor MACs.
+func ParseMACPrefix(prefix string) ([3]byte, error) {
+	var out [3]byte
+	parts := strings.Split(strings.TrimSpace(prefix), ":")
+	if len(parts) != 3 {
+		return out, fmt.Errorf("mac prefix %q must have three octets", prefix)
+	}
+	for i, part := range parts {
+		value, err := strconv.ParseUint(part, 16, 8)
+		if err != nil || len(part) != 2 {
+			return out, fmt.Errorf("mac prefix %q has an invalid octet %q", prefix, part)
+		}
+		out[i] = byte(value)
+	}
+	if out[0]&0x02 == 0 || out[0]&0x01 != 0 {
+		return out, fmt.Errorf("mac prefix %q must be locally administered unicast (second-lowest bit of the first octet set, lowest clear)", prefix)
+	}
+	return out, nil
+}
+
+// MACOf returns the guest MAC of vm. VMs created before MACs were
+// allocated carry none in their metadata and use the one derived from
+// their ID.
+func MACOf(vm model.VMMetadata) string {
+	if vm.GuestMAC != "" {
+		return strings.ToUpper(vm.GuestMAC)
 	}
-	return "mergen-" + shortID
+	return legacyGuestMAC(vm.ID)
+}
+
+func formatMAC(prefix [3]byte, suffix uint32) string {
+	return fmt.Sprintf("%02X:%02X:%02X:%02X:%02X:%02X", prefix[0], prefix[1], prefix[2], byte(suffix>>16), byte(suffix>>8), byte(suffix))
+}
+
+// TapName and NetNSName use the default naming; see Namer.
+func TapName(id string) string {
+	return NewNamer().TapName(id)
+}
+
+func NetNSName(id string) string {
+	return NewNamer().NetNSName(id)
 }
 
-func GuestMAC(id string) string {
+func legacyGuestMAC(id string) string {
 	hexOnly := strings.ReplaceAll(id, "-", "")
 	if len(hexOnly) < 6 {
 		return "02:FC:00:00:00:01"
@@ -1,6 +1,9 @@
 package network
 
 import (
+	"errors"
+	"os"
+	"path/filepath"
 	"testing"
 
 	"github.com/alperreha/mergen-fire/internal/model"
@@ -39,3 +42,111 @@ func TestAllocator_Allocate(t *testing.T) {
 		t.Fatalf("expected fixed host port 20005, got %d", ports[1].Host)
 	}
 }
+
+func TestAllocator_AllocateMAC(t *testing.T) {
+	a := NewAllocator(20000, 20010, "172.30.0.0/24").WithMACPrefix("02:fc:ab")
+
+	// The VM without a recorded MAC still holds the one derived from its ID,
+	// 02:FC:AB:00:00:01.
+	existing := []model.VMMetadata{
+		{ID: "ab000000-0001-4000-8000-000000000001"},
+		{ID: "ab000000-0002-4000-8000-000000000002", GuestMAC: "02:fc:ab:00:00:02"},
+	}
+	mac, err := a.AllocateMAC(existing)
+	if err != nil {
+		t.Fatalf("allocate mac: %v", err)
+	}
+	if mac != "02:FC:AB:00:00:03" {
+		t.Fatalf("unexpected mac: %s", mac)
+	}
+
+	for _, prefix := range []string{"02:FC", "03:00:5E", "00:1B:21", "02:FC:0G"} {
+		if _, err := ParseMACPrefix(prefix); err == nil {
+			t.Fatalf("ParseMACPrefix(%q) should fail", prefix)
+		}
+	}
+}
+
+func TestAllocator_Reservations(t *testing.T) {
+	a := NewAllocator(20000, 20003, "172.30.0.0/24").WithReservations(NewReservations(filepath.Join(t.TempDir(), "ports.json")))
+	existing := []model.VMMetadata{{GuestIP: "172.30.0.2", Ports: []model.PortBinding{{Host: 20000, Guest: 80, Protocol: "tcp"}}}}
+
+	res, err := a.Reserve(existing, model.PortReservationRequest{Owner: "dns"})
+	if err != nil || res.Port != 20001 {
+		t.Fatalf("Reserve() = %+v, %v; want 20001", res, err)
+	}
+	if _, err := a.Reserve(existing, model.PortReservationRequest{Port: 20001}); !errors.Is(err, ErrPortTaken) {
+		t.Fatalf("Reserve() of a reserved port error = %v, want ErrPortTaken", err)
+	}
+	if _, err := a.Reserve(existing, model.PortReservationRequest{Port: 20000}); !errors.Is(err, ErrPortTaken) {
+		t.Fatalf("Reserve() of a bound port error = %v, want ErrPortTaken", err)
+	}
+
+	// Picked ports skip the reservation; naming it takes it.
+	_, ports, err := a.Allocate(existing, []model.PortBindingRequest{{Guest: 80}, {Guest: 443, Host: 20001}})
+	if err != nil {
+		t.Fatalf("allocate: %v", err)
+	}
+	if ports[0].Guest != 443 || ports[0].Host != 20001 || ports[1].Host != 20002 {
+		t.Fatalf("unexpected ports: %+v", ports)
+	}
+	if err := a.ConsumeReservations(ports); err != nil {
+		t.Fatalf("consume: %v", err)
+	}
+	if list, err := a.Reservations(); err != nil || len(list) != 0 {
+		t.Fatalf("Reservations() after consume = %+v, %v", list, err)
+	}
+	if _, err := a.Release(20001); !errors.Is(err, ErrReservationNotFound) {
+		t.Fatalf("Release() of a consumed reservation error = %v", err)
+	}
+}
+
+func TestNamer_Names(t *testing.T) {
+	root := t.TempDir()
+	namer := NewNamer().WithNaming("tap-", "mg-", 11).WithNetNSRoot(root)
+	namer.ifaceExists = func(name string) bool { return name == "tap-aaaaaaaabbb" }
+
+	tap, netns, err := namer.Names("6f008233-68f7-47b8-b2d1-6a9f0632b30b", nil)
+	if err != nil {
+		t.Fatalf("names: %v", err)
+	}
+	if tap != "tap-6f00823368f" || netns != "mg-6f00823368f" {
+		t.Fatalf("unexpected names %q %q", tap, netns)
+	}
+	if NewNamer().TapName("6f008233-68f7") != "tap-6f008233" || NetNSName("6f008233-68f7") != "mergen-6f008233" {
+		t.Fatal("default naming must match names of existing vms")
+	}
+
+	existing := []model.VMMetadata{{ID: "other", TapName: "tap-6f00823368f"}}
+	if _, _, err := namer.Names("6f008233-68f7-0000-0000-000000000000", existing); !errors.Is(err, ErrNameCollision) {
+		t.Fatalf("expected collision with existing vm, got %v", err)
+	}
+	if _, _, err := namer.Names("aaaaaaaa-bbbb-cccc-dddd-eeeeeeeeeeee", nil); !errors.Is(err, ErrNameCollision) {
+		t.Fatalf("expected collision with host interface, got %v", err)
+	}
+	if err := os.WriteFile(filepath.Join(root, "mg-12345678901"), nil, 0o644); err != nil {
+		t.Fatalf("write netns file: %v", err)
+	}
+	if _, _, err := namer.Names("12345678-9012-3456-7890-123456789012", nil); !errors.Is(err, ErrNameCollision) {
+		t.Fatalf("expected collision with host netns, got %v", err)
+	}
+}
+
+func TestValidateNaming(t *testing.T) {
+	if err := ValidateNaming(DefaultTapPrefix, DefaultNetNSPrefix, DefaultNameIDChars); err != nil {
+		t.Fatalf("defaults must be valid: %v", err)
+	}
+	for _, tc := range []struct {
+		tap, netns string
+		chars      int
+	}{
+		{"tap-", "mergen-", 12},
+		{"tap-", "mergen-", 3},
+		{"", "mergen-", 8},
+		{"tap/", "mergen-", 8},
+	} {
+		if err := ValidateNaming(tc.tap, tc.netns, tc.chars); err == nil {
+			t.Fatalf("expected %q/%q/%d to be rejected", tc.tap, tc.netns, tc.chars)
+		}
+	}
+}
@@ -0,0 +1,250 @@
+package network
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/netip"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+)
+
+const (
+	// DefaultBridge is the host bridge the guest CIDR's gateway lives on.
+	DefaultBridge = "mergen0"
+	// NFTTable is the nftables table (family ip) holding mergen's chains.
+	NFTTable = "mergen"
+)
+
+// ErrRouteConflict means the guest CIDR overlaps a route the host already
+// has on another interface.
+var ErrRouteConflict = errors.New("guest cidr conflicts with a host route")
+
+// SetupStep is one thing HostSetup.Apply checked; Changed is set when it
+// had to change the host.
+type SetupStep struct {
+	Name    string `json:"name"`
+	Changed bool   `json:"changed"`
+	Detail  string `json:"detail"`
+}
+
+// HostSetup prepares the network every VM on a host shares: a bridge with
+// the first address of the guest CIDR, IP forwarding, and the nftables
+// table the per-VM rules go in. Apply only changes what is missing, so it
+// can run on every daemon start.
+type HostSetup struct {
+	bridge    string
+	guestCIDR string
+	root      string
+	// run is swapped out by tests.
+	run func(ctx context.Context, stdin, name string, args ...string) ([]byte, error)
+}
+
+func NewHostSetup(bridge, guestCIDR string) *HostSetup {
+	if bridge == "" {
+		bridge = DefaultBridge
+	}
+	return &HostSetup{bridge: bridge, guestCIDR: guestCIDR, root: "/", run: runCommand}
+}
+
+// WithRoot resolves /proc below root, so tests can use a fake one.
+func (h *HostSetup) WithRoot(root string) *HostSetup {
+	h.root = root
+	return h
+}
+
+// WithRunner replaces running ip and nft.
+func (h *HostSetup) WithRunner(run func(ctx context.Context, stdin, name string, args ...string) ([]byte, error)) *HostSetup {
+	if run != nil {
+		h.run = run
+	}
+	return h
+}
+
+// Apply checks the guest CIDR against the host routes, then brings the
+// bridge, IP forwarding and the nftables table in place. It stops at the
+// first step that fails; the steps done so far are returned with the error.
+func (h *HostSetup) Apply(ctx context.Context) ([]SetupStep, error) {
+	prefix, err := netip.ParsePrefix(h.guestCIDR)
+	if err != nil || !prefix.Addr().Is4() {
+		return nil, fmt.Errorf("invalid guest cidr %q", h.guestCIDR)
+	}
+	prefix = prefix.Masked()
+	var steps []SetupStep
+	for _, step := range []func(context.Context, netip.Prefix) (SetupStep, error){
+		h.checkRoutes,
+		h.ensureBridge,
+		h.ensureForwarding,
+		h.ensureTable,
+	} {
+		done, err := step(ctx, prefix)
+		if err != nil {
+			return steps, err
+		}
+		steps = append(steps, done)
+	}
+	return steps, nil
+}
+
+func (h *HostSetup) checkRoutes(_ context.Context, prefix netip.Prefix) (SetupStep, error) {
+	step := SetupStep{Name: "routes"}
+	routes, err := h.hostRoutes()
+	if err != nil {
+		return step, fmt.Errorf("read host routes: %w", err)
+	}
+	for _, route := range routes {
+		if route.iface == h.bridge || route.dst.Bits() == 0 {
+			continue
+		}
+		if route.dst.Overlaps(prefix) {
+			return step, fmt.Errorf("%w: %s overlaps %s on %s", ErrRouteConflict, prefix, route.dst, route.iface)
+		}
+	}
+	step.Detail = fmt.Sprintf("%s does not overlap host routes", prefix)
+	return step, nil
+}
+
+func (h *HostSetup) ensureBridge(ctx context.Context, prefix netip.Prefix) (SetupStep, error) {
+	step := SetupStep{Name: "bridge"}
+	if _, err := h.run(ctx, "", "ip", "link", "show", "dev", h.bridge); err != nil {
+		if out, err := h.run(ctx, "", "ip", "link", "add", "name", h.bridge, "type", "bridge"); err != nil {
+			return step, fmt.Errorf("create bridge %s: %w: %s", h.bridge, err, strings.TrimSpace(string(out)))
+		}
+		step.Changed = true
+	}
+	gateway := netip.PrefixFrom(prefix.Addr().Next(), prefix.Bits()).String()
+	out, err := h.run(ctx, "", "ip", "-o", "addr", "show", "dev", h.bridge)
+	if err != nil {
+		return step, fmt.Errorf("read bridge %s addresses: %w: %s", h.bridge, err, strings.TrimSpace(string(out)))
+	}
+	if !strings.Contains(string(out), " "+gateway+" ") {
+		if out, err := h.run(ctx, "", "ip", "addr", "replace", gateway, "dev", h.bridge); err != nil {
+			return step, fmt.Errorf("address bridge %s: %w: %s", h.bridge, err, strings.TrimSpace(string(out)))
+		}
+		step.Changed = true
+	}
+	if out, err := h.run(ctx, "", "ip", "link", "set", "dev", h.bridge, "up"); err != nil {
+		return step, fmt.Errorf("bring up bridge %s: %w: %s", h.bridge, err, strings.TrimSpace(string(out)))
+	}
+	step.Detail = fmt.Sprintf("%s up with %s", h.bridge, gateway)
+	return step, nil
+}
+
+func (h *HostSetup) ensureForwarding(_ context.Context, _ netip.Prefix) (SetupStep, error) {
+	step := SetupStep{Name: "ip-forward", Detail: "net.ipv4.ip_forward=1"}
+	path := filepath.Join(h.root, "proc/sys/net/ipv4/ip_forward")
+	raw, err := os.ReadFile(path)
+	if err != nil {
+		return step, fmt.Errorf("read net.ipv4.ip_forward: %w", err)
+	}
+	if strings.TrimSpace(string(raw)) == "1" {
+		return step, nil
+	}
+	if err := os.WriteFile(path, []byte("1\n"), 0o644); err != nil {
+		return step, fmt.Errorf("enable net.ipv4.ip_forward: %w", err)
+	}
+	step.Changed = true
+	return step, nil
+}
+
+// ensureTable creates the table with its base chains and the masquerade
+// rule only when it is missing: the per-VM rules live in it, so it is
+// never replaced.
+func (h *HostSetup) ensureTable(ctx context.Context, prefix netip.Prefix) (SetupStep, error) {
+	step := SetupStep{Name: "nftables", Detail: "table ip " + NFTTable}
+	if _, err := h.run(ctx, "", "nft", "list", "table", "ip", NFTTable); err == nil {
+		return step, nil
+	}
+	if out, err := h.run(ctx, BaseRuleset(prefix.String(), h.bridge), "nft", "-f", "-"); err != nil {
+		return step, fmt.Errorf("install nftables table %s: %w: %s", NFTTable, err, strings.TrimSpace(string(out)))
+	}
+	step.Changed = true
+	return step, nil
+}
+
+// BaseRuleset is the nftables table HostSetup installs: NAT chains for the
+// per-VM DNAT rules, masquerading of guest traffic leaving the host, and a
+// forward chain.
+func BaseRuleset(guestCIDR, bridge string) string {
+	return fmt.Sprintf(`table ip %[1]s {
+	chain prerouting {
+		type nat hook prerouting priority dstnat; policy accept;
+	}
+	chain output {
+		type nat hook output priority -100; policy accept;
+	}
+	chain postrouting {
+		type nat hook postrouting priority srcnat; policy accept;
+		ip saddr %[2]s oifname != "%[3]s" masquerade
+	}
+	chain forward {
+		type filter hook forward priority filter; policy accept;
+	}
+}
+`, NFTTable, guestCIDR, bridge)
+}
+
+type hostRoute struct {
+	iface string
+	dst   netip.Prefix
+}
+
+// hostRoutes reads the IPv4 routing table from /proc/net/route, whose
+// addresses are hex in host (little-endian) byte order.
+func (h *HostSetup) hostRoutes() ([]hostRoute, error) {
+	f, err := os.Open(filepath.Join(h.root, "proc/net/route"))
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	var routes []hostRoute
+	scanner := bufio.NewScanner(f)
+	scanner.Scan() // header
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 8 {
+			continue
+		}
+		dst, errDst := routeAddr(fields[1])
+		mask, errMask := routeAddr(fields[7])
+		if errDst != nil || errMask != nil {
+			continue
+		}
+		routes = append(routes, hostRoute{iface: fields[0], dst: netip.PrefixFrom(dst, maskBits(mask)).Masked()})
+	}
+	return routes, scanner.Err()
+}
+
+func routeAddr(field string) (netip.Addr, error) {
+	raw, err := hex.DecodeString(field)
+	if err != nil || len(raw) != 4 {
+		return netip.Addr{}, fmt.Errorf("invalid route address %q", field)
+	}
+	var addr [4]byte
+	binary.BigEndian.PutUint32(addr[:], binary.LittleEndian.Uint32(raw))
+	return netip.AddrFrom4(addr), nil
+}
+
+// maskBits counts the leading ones of a netmask.
+func maskBits(mask netip.Addr) int {
+	value := binary.BigEndian.Uint32(mask.AsSlice())
+	bits := 0
+	for value&(1<<31) != 0 {
+		bits++
+		value <<= 1
+	}
+	return bits
+}
+
+func runCommand(ctx context.Context, stdin, name string, args ...string) ([]byte, error) {
+	cmd := exec.CommandContext(ctx, name, args...)
+	if stdin != "" {
+		cmd.Stdin = strings.NewReader(stdin)
+	}
+	return cmd.CombinedOutput()
+}
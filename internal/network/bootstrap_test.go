@@ -0,0 +1,109 @@
+package network
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+const routeHeader = "Iface\tDestination\tGateway \tFlags\tRefCnt\tUse\tMetric\tMask\t\tMTU\tWindow\tIRTT\n"
+
+func TestHostSetup_Apply(t *testing.T) {
+	root := t.TempDir()
+	write := func(path, content string) {
+		t.Helper()
+		full := filepath.Join(root, path)
+		if err := os.MkdirAll(filepath.Dir(full), 0o755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(full, []byte(content), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// A default route and 192.168.0.0/24 on eth0.
+	write("proc/net/route", routeHeader+
+		"eth0\t00000000\t0100A8C0\t0003\t0\t0\t100\t00000000\t0\t0\t0\n"+
+		"eth0\t0000A8C0\t00000000\t0001\t0\t0\t100\t00FFFFFF\t0\t0\t0\n")
+	write("proc/sys/net/ipv4/ip_forward", "0\n")
+
+	var bridge, addr, ruleset string
+	var commands []string
+	run := func(_ context.Context, stdin, name string, args ...string) ([]byte, error) {
+		line := name + " " + strings.Join(args, " ")
+		commands = append(commands, line)
+		switch {
+		case line == "ip link show dev mergen0":
+			if bridge == "" {
+				return []byte("Device does not exist"), errors.New("exit status 1")
+			}
+		case line == "ip link add name mergen0 type bridge":
+			bridge = "mergen0"
+		case line == "ip -o addr show dev mergen0":
+			if addr != "" {
+				return []byte("5: mergen0    inet " + addr + " scope global mergen0\n"), nil
+			}
+		case strings.HasPrefix(line, "ip addr replace "):
+			addr = args[2]
+		case line == "nft list table ip mergen":
+			if ruleset == "" {
+				return nil, errors.New("exit status 1")
+			}
+		case line == "nft -f -":
+			ruleset = stdin
+		}
+		return nil, nil
+	}
+	setup := NewHostSetup("", "172.30.0.0/24").WithRoot(root).WithRunner(run)
+
+	steps, err := setup.Apply(context.Background())
+	if err != nil {
+		t.Fatalf("apply: %v", err)
+	}
+	changed := map[string]bool{}
+	for _, step := range steps {
+		changed[step.Name] = step.Changed
+	}
+	if len(steps) != 4 || changed["routes"] || !changed["bridge"] || !changed["ip-forward"] || !changed["nftables"] {
+		t.Fatalf("unexpected first run steps: %+v", steps)
+	}
+	if addr != "172.30.0.1/24" {
+		t.Fatalf("expected bridge gateway 172.30.0.1/24, got %q", addr)
+	}
+	if raw, _ := os.ReadFile(filepath.Join(root, "proc/sys/net/ipv4/ip_forward")); strings.TrimSpace(string(raw)) != "1" {
+		t.Fatalf("expected ip_forward enabled, got %q", raw)
+	}
+	if !strings.Contains(ruleset, "ip saddr 172.30.0.0/24 oifname != \"mergen0\" masquerade") {
+		t.Fatalf("unexpected ruleset:\n%s", ruleset)
+	}
+
+	// A second run finds everything in place and changes nothing.
+	commands = nil
+	steps, err = setup.Apply(context.Background())
+	if err != nil {
+		t.Fatalf("second apply: %v", err)
+	}
+	for _, step := range steps {
+		if step.Changed {
+			t.Fatalf("expected no changes on second run, got %+v", step)
+		}
+	}
+	for _, command := range commands {
+		if strings.HasPrefix(command, "ip link add") || strings.HasPrefix(command, "ip addr replace") || command == "nft -f -" {
+			t.Fatalf("second run changed the host: %s", command)
+		}
+	}
+
+	// A docker-style 172.30.0.0/16 route on another interface is a conflict.
+	write("proc/net/route", routeHeader+"docker0\t00001EAC\t00000000\t0001\t0\t0\t0\t0000FFFF\t0\t0\t0\n")
+	if _, err := setup.Apply(context.Background()); !errors.Is(err, ErrRouteConflict) {
+		t.Fatalf("expected route conflict, got %v", err)
+	}
+	// The guest CIDR's own route on the bridge is not.
+	write("proc/net/route", routeHeader+"mergen0\t00001EAC\t00000000\t0001\t0\t0\t0\t00FFFFFF\t0\t0\t0\n")
+	if _, err := setup.Apply(context.Background()); err != nil {
+		t.Fatalf("expected the bridge route to be ignored, got %v", err)
+	}
+}
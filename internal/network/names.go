@@ -0,0 +1,137 @@
+package network
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/alperreha/mergen-fire/internal/model"
+)
+
+const (
+	DefaultTapPrefix   = "tap-"
+	DefaultNetNSPrefix = "mergen-"
+	// DefaultNameIDChars keeps the names of VMs created before naming was
+	// configurable.
+	DefaultNameIDChars = 8
+	// maxIfaceName is IFNAMSIZ without the terminating NUL.
+	maxIfaceName = 15
+)
+
+// ErrNameCollision means a generated tap or netns name is already taken.
+var ErrNameCollision = errors.New("name collision")
+
+// Namer derives a VM's tap device and network namespace names from a prefix
+// and the first hex characters of its ID, and checks them against existing
+// VMs and the host before they are used.
+type Namer struct {
+	tapPrefix   string
+	netnsPrefix string
+	idChars     int
+	netnsRoot   string
+	// ifaceExists is swapped out by tests.
+	ifaceExists func(name string) bool
+}
+
+func NewNamer() *Namer {
+	return &Namer{
+		tapPrefix:   DefaultTapPrefix,
+		netnsPrefix: DefaultNetNSPrefix,
+		idChars:     DefaultNameIDChars,
+		netnsRoot:   "/run/netns",
+		ifaceExists: func(name string) bool {
+			_, err := net.InterfaceByName(name)
+			return err == nil
+		},
+	}
+}
+
+// WithNaming sets the prefixes and ID length; values must pass
+// ValidateNaming, invalid ones keep the current naming.
+func (n *Namer) WithNaming(tapPrefix, netnsPrefix string, idChars int) *Namer {
+	if ValidateNaming(tapPrefix, netnsPrefix, idChars) == nil {
+		n.tapPrefix, n.netnsPrefix, n.idChars = tapPrefix, netnsPrefix, idChars
+	}
+	return n
+}
+
+// WithNetNSRoot sets where named network namespaces are mounted.
+func (n *Namer) WithNetNSRoot(root string) *Namer {
+	if strings.TrimSpace(root) != "" {
+		n.netnsRoot = root
+	}
+	return n
+}
+
+// ValidateNaming checks that prefixes are safe in interface and file names
+// and that tap names fit the kernel's 15-character limit.
+func ValidateNaming(tapPrefix, netnsPrefix string, idChars int) error {
+	if idChars < 4 || idChars > 32 {
+		return fmt.Errorf("id characters must be between 4 and 32, got %d", idChars)
+	}
+	for _, prefix := range []string{tapPrefix, netnsPrefix} {
+		if prefix == "" {
+			return errors.New("name prefixes must not be empty")
+		}
+		for _, r := range prefix {
+			if !(r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || r == '-' || r == '_' || r == '.') {
+				return fmt.Errorf("name prefix %q may only contain letters, digits, '-', '_' and '.'", prefix)
+			}
+		}
+	}
+	if len(tapPrefix)+idChars > maxIfaceName {
+		return fmt.Errorf("tap names of prefix %q plus %d id characters exceed %d characters", tapPrefix, idChars, maxIfaceName)
+	}
+	return nil
+}
+
+func (n *Namer) TapName(id string) string {
+	return n.tapPrefix + n.shortID(id)
+}
+
+func (n *Namer) NetNSName(id string) string {
+	return n.netnsPrefix + n.shortID(id)
+}
+
+// shortID takes the first idChars of the ID without dashes, so a 12-char
+// name does not end in one. The default 8 chars match the historical id[:8].
+func (n *Namer) shortID(id string) string {
+	hexOnly := strings.ReplaceAll(id, "-", "")
+	if len(hexOnly) > n.idChars {
+		hexOnly = hexOnly[:n.idChars]
+	}
+	return hexOnly
+}
+
+// NetNSPresent reports whether the named network namespace is mounted.
+func (n *Namer) NetNSPresent(name string) bool {
+	if name == "" {
+		return false
+	}
+	_, err := os.Lstat(filepath.Join(n.netnsRoot, name))
+	return err == nil
+}
+
+// Names returns id's tap and netns names, or an ErrNameCollision naming the
+// holder when a VM in existing or something on the host already uses one.
+func (n *Namer) Names(id string, existing []model.VMMetadata) (string, string, error) {
+	tap, netns := n.TapName(id), n.NetNSName(id)
+	for _, meta := range existing {
+		switch {
+		case meta.TapName == tap:
+			return "", "", fmt.Errorf("%w: tap %s belongs to vm %s; raise the id characters of generated names", ErrNameCollision, tap, meta.ID)
+		case meta.NetNS == netns:
+			return "", "", fmt.Errorf("%w: netns %s belongs to vm %s; raise the id characters of generated names", ErrNameCollision, netns, meta.ID)
+		}
+	}
+	if n.ifaceExists(tap) {
+		return "", "", fmt.Errorf("%w: interface %s already exists on the host", ErrNameCollision, tap)
+	}
+	if n.NetNSPresent(netns) {
+		return "", "", fmt.Errorf("%w: netns %s already exists under %s", ErrNameCollision, netns, n.netnsRoot)
+	}
+	return tap, netns, nil
+}
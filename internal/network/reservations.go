@@ -0,0 +1,224 @@
+package network
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"slices"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/alperreha/mergen-fire/internal/model"
+)
+
+var (
+	ErrReservationNotFound = errors.New("port reservation not found")
+	ErrPortTaken           = errors.New("host port is taken")
+	ErrNoReservations      = errors.New("port reservations are not configured")
+	ErrPortInvalid         = errors.New("invalid host port")
+)
+
+type reservationsFile struct {
+	Reservations []model.PortReservation `json:"reservations"`
+}
+
+// Reservations is a JSON file of host ports held for VMs not created yet.
+// Like the kernel catalog, every call reads the file.
+type Reservations struct {
+	path   string
+	logger *slog.Logger
+	mu     sync.Mutex
+}
+
+func NewReservations(path string) *Reservations {
+	return &Reservations{path: path, logger: slog.Default()}
+}
+
+func (r *Reservations) WithLogger(logger *slog.Logger) *Reservations {
+	if logger != nil {
+		r.logger = logger
+	}
+	return r
+}
+
+// List returns the reservations sorted by port.
+func (r *Reservations) List() ([]model.PortReservation, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.read()
+}
+
+// update applies fn to the reservations under the lock and writes the
+// result back unless fn fails.
+func (r *Reservations) update(fn func([]model.PortReservation) ([]model.PortReservation, error)) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	current, err := r.read()
+	if err != nil {
+		return err
+	}
+	next, err := fn(current)
+	if err != nil {
+		return err
+	}
+	return r.write(next)
+}
+
+func (r *Reservations) read() ([]model.PortReservation, error) {
+	content, err := os.ReadFile(r.path)
+	if errors.Is(err, os.ErrNotExist) {
+		return []model.PortReservation{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var file reservationsFile
+	if err := json.Unmarshal(content, &file); err != nil {
+		return nil, fmt.Errorf("parse port reservations %s: %w", r.path, err)
+	}
+	if file.Reservations == nil {
+		file.Reservations = []model.PortReservation{}
+	}
+	sort.Slice(file.Reservations, func(i, j int) bool { return file.Reservations[i].Port < file.Reservations[j].Port })
+	return file.Reservations, nil
+}
+
+func (r *Reservations) write(reservations []model.PortReservation) error {
+	content, err := json.MarshalIndent(reservationsFile{Reservations: reservations}, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(r.path), 0o755); err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(r.path), ".tmp-ports-")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(content); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Chmod(0o644); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), r.path)
+}
+
+func reservedPorts(reservations []model.PortReservation) map[int]struct{} {
+	ports := make(map[int]struct{}, len(reservations))
+	for _, res := range reservations {
+		ports[res.Port] = struct{}{}
+	}
+	return ports
+}
+
+// WithReservations makes the allocator leave reserved ports out when it
+// picks host ports; a request naming a reserved port still gets it.
+func (a *Allocator) WithReservations(r *Reservations) *Allocator {
+	a.held = r
+	return a
+}
+
+func (a *Allocator) Reservations() ([]model.PortReservation, error) {
+	if a.held == nil {
+		return []model.PortReservation{}, nil
+	}
+	return a.held.List()
+}
+
+// Reserve holds req.Port, or the lowest port in range that neither a VM in
+// existing nor another reservation holds when it is 0.
+func (a *Allocator) Reserve(existing []model.VMMetadata, req model.PortReservationRequest) (model.PortReservation, error) {
+	if a.held == nil {
+		return model.PortReservation{}, ErrNoReservations
+	}
+	if req.Port < 0 || req.Port > 65535 {
+		return model.PortReservation{}, fmt.Errorf("%w: %d", ErrPortInvalid, req.Port)
+	}
+	used := map[int]struct{}{}
+	for _, vm := range existing {
+		for _, port := range vm.Ports {
+			used[port.Host] = struct{}{}
+		}
+	}
+	res := model.PortReservation{Port: req.Port, Owner: req.Owner, Note: req.Note, ReservedAt: time.Now().UTC()}
+	err := a.held.update(func(current []model.PortReservation) ([]model.PortReservation, error) {
+		held := reservedPorts(current)
+		if res.Port == 0 {
+			if res.Port = a.nextFreePort(used, held); res.Port == 0 {
+				return nil, fmt.Errorf("%w: no available host port in configured range", ErrPortTaken)
+			}
+		}
+		if _, ok := used[res.Port]; ok {
+			return nil, fmt.Errorf("%w: %d is bound by a vm", ErrPortTaken, res.Port)
+		}
+		if _, ok := held[res.Port]; ok {
+			return nil, fmt.Errorf("%w: %d is already reserved", ErrPortTaken, res.Port)
+		}
+		return append(current, res), nil
+	})
+	if err != nil {
+		return model.PortReservation{}, err
+	}
+	a.logger.Info("host port reserved", "port", res.Port, "owner", res.Owner)
+	return res, nil
+}
+
+func (a *Allocator) Release(port int) (model.PortReservation, error) {
+	if a.held == nil {
+		return model.PortReservation{}, fmt.Errorf("%w: %d", ErrReservationNotFound, port)
+	}
+	var released model.PortReservation
+	err := a.held.update(func(current []model.PortReservation) ([]model.PortReservation, error) {
+		idx := slices.IndexFunc(current, func(res model.PortReservation) bool { return res.Port == port })
+		if idx < 0 {
+			return nil, fmt.Errorf("%w: %d", ErrReservationNotFound, port)
+		}
+		released = current[idx]
+		return slices.Delete(current, idx, idx+1), nil
+	})
+	if err != nil {
+		return model.PortReservation{}, err
+	}
+	a.logger.Info("host port reservation released", "port", port, "owner", released.Owner)
+	return released, nil
+}
+
+// ConsumeReservations drops the reservations of ports a VM now binds, since
+// the VM holds them from here on.
+func (a *Allocator) ConsumeReservations(bindings []model.PortBinding) error {
+	if a.held == nil || len(bindings) == 0 {
+		return nil
+	}
+	bound := map[int]struct{}{}
+	for _, binding := range bindings {
+		bound[binding.Host] = struct{}{}
+	}
+	return a.held.update(func(current []model.PortReservation) ([]model.PortReservation, error) {
+		return slices.DeleteFunc(current, func(res model.PortReservation) bool {
+			_, ok := bound[res.Port]
+			return ok
+		}), nil
+	})
+}
+
+func (a *Allocator) heldPorts() (map[int]struct{}, error) {
+	if a.held == nil {
+		return nil, nil
+	}
+	current, err := a.held.List()
+	if err != nil {
+		return nil, err
+	}
+	return reservedPorts(current), nil
+}
@@ -0,0 +1,136 @@
+// Package redact masks secret-looking values before they leave mergend in
+// API responses or logs. A value is secret when its key (a map key, header
+// or query parameter name) contains one of a few words like "token" or
+// "password", unless the key is on the allowlist.
+package redact
+
+import (
+	"net/url"
+	"strings"
+)
+
+// Placeholder replaces redacted values.
+const Placeholder = "[redacted]"
+
+// sensitiveWords are matched case-insensitively anywhere in a key, so
+// DB_PASSWORD, apiKey and Authorization are all caught.
+var sensitiveWords = []string{"token", "secret", "password", "passwd", "key", "auth", "credential", "cookie", "signature", "private"}
+
+type Redactor struct {
+	allow map[string]bool
+}
+
+// New returns a Redactor that leaves the keys in allow alone; they are
+// compared case-insensitively.
+func New(allow []string) *Redactor {
+	r := &Redactor{allow: map[string]bool{}}
+	for _, key := range allow {
+		if key = strings.ToLower(strings.TrimSpace(key)); key != "" {
+			r.allow[key] = true
+		}
+	}
+	return r
+}
+
+// Sensitive reports whether values under key are redacted. A nil Redactor
+// redacts by the sensitive words only.
+func (r *Redactor) Sensitive(key string) bool {
+	key = strings.ToLower(key)
+	if r != nil && r.allow[key] {
+		return false
+	}
+	for _, word := range sensitiveWords {
+		if strings.Contains(key, word) {
+			return true
+		}
+	}
+	return false
+}
+
+// Strings returns a copy of values with sensitive entries redacted, e.g. an
+// environment or HTTP headers.
+func (r *Redactor) Strings(values map[string]string) map[string]string {
+	if values == nil {
+		return nil
+	}
+	out := make(map[string]string, len(values))
+	for key, value := range values {
+		if r.Sensitive(key) && value != "" {
+			value = Placeholder
+		}
+		out[key] = value
+	}
+	return out
+}
+
+// Map returns a copy of a JSON-like document with sensitive entries
+// redacted at any depth, e.g. VM metadata or an MMDS payload.
+func (r *Redactor) Map(values map[string]any) map[string]any {
+	if values == nil {
+		return nil
+	}
+	out := make(map[string]any, len(values))
+	for key, value := range values {
+		if r.Sensitive(key) && value != nil {
+			out[key] = Placeholder
+			continue
+		}
+		out[key] = r.value(value)
+	}
+	return out
+}
+
+func (r *Redactor) value(value any) any {
+	switch v := value.(type) {
+	case map[string]any:
+		return r.Map(v)
+	case map[string]string:
+		return r.Strings(v)
+	case []any:
+		out := make([]any, len(v))
+		for i, item := range v {
+			out[i] = r.value(item)
+		}
+		return out
+	}
+	return value
+}
+
+// Query redacts sensitive parameters of a raw query string. One that does
+// not parse is dropped whole, since its secrets cannot be told apart.
+func (r *Redactor) Query(raw string) string {
+	if raw == "" {
+		return ""
+	}
+	values, err := url.ParseQuery(raw)
+	if err != nil {
+		return Placeholder
+	}
+	changed := false
+	for key, items := range values {
+		if !r.Sensitive(key) {
+			continue
+		}
+		for i := range items {
+			items[i] = Placeholder
+		}
+		changed = true
+	}
+	if !changed {
+		return raw
+	}
+	return values.Encode()
+}
+
+// URL redacts the user info and sensitive query parameters of rawURL.
+func (r *Redactor) URL(rawURL string) string {
+	parsed, err := url.Parse(rawURL)
+	if err != nil || (parsed.User == nil && parsed.RawQuery == "") {
+		return rawURL
+	}
+	if parsed.User != nil {
+		parsed.User = url.User(Placeholder)
+	}
+	parsed.RawQuery = r.Query(parsed.RawQuery)
+	return parsed.String()
+}
@@ -0,0 +1,53 @@
+package redact
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestRedactorMap(t *testing.T) {
+	r := New([]string{"publicKey"})
+	in := map[string]any{
+		"name":      "web",
+		"apiToken":  "t0k3n",
+		"publicKey": "ssh-ed25519 AAAA",
+		"db": map[string]any{
+			"host":     "db.internal",
+			"Password": "hunter2",
+		},
+		"backends": []any{map[string]any{"url": "http://a", "secret": "s"}},
+	}
+	out := r.Map(in)
+	if out["name"] != "web" || out["publicKey"] != "ssh-ed25519 AAAA" || out["apiToken"] != Placeholder {
+		t.Fatalf("unexpected top level: %+v", out)
+	}
+	db := out["db"].(map[string]any)
+	if db["host"] != "db.internal" || db["Password"] != Placeholder {
+		t.Fatalf("unexpected nested map: %+v", db)
+	}
+	backend := out["backends"].([]any)[0].(map[string]any)
+	if backend["url"] != "http://a" || backend["secret"] != Placeholder {
+		t.Fatalf("unexpected list item: %+v", backend)
+	}
+	if in["apiToken"] != "t0k3n" || in["db"].(map[string]any)["Password"] != "hunter2" {
+		t.Fatal("input was modified")
+	}
+}
+
+func TestRedactorStringsQueryURL(t *testing.T) {
+	var r *Redactor
+	headers := r.Strings(map[string]string{"Authorization": "Bearer x", "Content-Type": "application/json", "X-Api-Key": "k"})
+	if headers["Authorization"] != Placeholder || headers["X-Api-Key"] != Placeholder || headers["Content-Type"] != "application/json" {
+		t.Fatalf("unexpected headers: %+v", headers)
+	}
+	if got := r.Query("limit=5&access_token=abc"); strings.Contains(got, "abc") || !strings.Contains(got, "limit=5") {
+		t.Fatalf("unexpected query: %q", got)
+	}
+	if got := r.Query("limit=5"); got != "limit=5" {
+		t.Fatalf("expected query untouched, got %q", got)
+	}
+	got := r.URL("https://user:pw@hooks.example.com/notify?sig=1&signature=abc")
+	if strings.Contains(got, "pw") || strings.Contains(got, "abc") || !strings.Contains(got, "sig=1") {
+		t.Fatalf("unexpected url: %q", got)
+	}
+}
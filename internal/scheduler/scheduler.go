@@ -0,0 +1,116 @@
+// Package scheduler picks the host a new VM is created on from the hosts
+// registered in the cluster and the VMs they already run.
+package scheduler
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/alperreha/mergen-fire/internal/model"
+)
+
+var ErrUnschedulable = errors.New("no host satisfies placement")
+
+// Schedule returns the best host for placement. Hosts missing a required
+// label or running a VM that matches AntiAffinity are excluded; the rest are
+// ranked by Affinity matches, then by fewest VMs, preferring local on a tie
+// so a single-host setup never forwards.
+func Schedule(hosts []model.HostInfo, metas []model.VMMetadata, placement model.Placement, local string) (model.HostInfo, error) {
+	byHost := map[string][]model.VMMetadata{}
+	for _, meta := range metas {
+		if meta.Host != "" {
+			byHost[meta.Host] = append(byHost[meta.Host], meta)
+		}
+	}
+
+	type candidate struct {
+		host     model.HostInfo
+		affinity int
+		vms      int
+	}
+	var candidates []candidate
+	var reasons []string
+	for _, host := range hosts {
+		if missing := missingLabels(host.Labels, placement.HostLabels); len(missing) > 0 {
+			reasons = append(reasons, fmt.Sprintf("%s: missing labels %s", host.Name, strings.Join(missing, ",")))
+			continue
+		}
+		vms := byHost[host.Name]
+		if conflict := firstMatch(vms, placement.AntiAffinity); conflict != "" {
+			reasons = append(reasons, fmt.Sprintf("%s: anti-affinity with vm %s", host.Name, conflict))
+			continue
+		}
+		c := candidate{host: host, vms: len(vms)}
+		if len(placement.Affinity) > 0 {
+			for _, vm := range vms {
+				if matches(vm.Tags, placement.Affinity) {
+					c.affinity++
+				}
+			}
+		}
+		candidates = append(candidates, c)
+	}
+	if len(candidates) == 0 {
+		if len(reasons) == 0 {
+			reasons = append(reasons, "no hosts registered")
+		}
+		sort.Strings(reasons)
+		return model.HostInfo{}, fmt.Errorf("%w: %s", ErrUnschedulable, strings.Join(reasons, "; "))
+	}
+
+	sort.SliceStable(candidates, func(i, j int) bool {
+		a, b := candidates[i], candidates[j]
+		if a.affinity != b.affinity {
+			return a.affinity > b.affinity
+		}
+		if a.vms != b.vms {
+			return a.vms < b.vms
+		}
+		if (a.host.Name == local) != (b.host.Name == local) {
+			return a.host.Name == local
+		}
+		return a.host.Name < b.host.Name
+	})
+	return candidates[0].host, nil
+}
+
+// Fits reports whether host satisfies placement's hard requirements.
+func Fits(host model.HostInfo, metas []model.VMMetadata, placement model.Placement) error {
+	_, err := Schedule([]model.HostInfo{host}, metas, placement, host.Name)
+	return err
+}
+
+func missingLabels(labels, required map[string]string) []string {
+	var missing []string
+	for key, value := range required {
+		if labels[key] != value {
+			missing = append(missing, key+"="+value)
+		}
+	}
+	sort.Strings(missing)
+	return missing
+}
+
+func firstMatch(vms []model.VMMetadata, tags map[string]string) string {
+	if len(tags) == 0 {
+		return ""
+	}
+	for _, vm := range vms {
+		if matches(vm.Tags, tags) {
+			return vm.ID
+		}
+	}
+	return ""
+}
+
+// matches reports whether tags contain every pair in want.
+func matches(tags, want map[string]string) bool {
+	for key, value := range want {
+		if tags[key] != value {
+			return false
+		}
+	}
+	return true
+}
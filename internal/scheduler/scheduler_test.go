@@ -0,0 +1,63 @@
+package scheduler
+
+import (
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/alperreha/mergen-fire/internal/model"
+)
+
+var hosts = []model.HostInfo{
+	{Name: "a", Labels: map[string]string{"zone": "a"}},
+	{Name: "b", Labels: map[string]string{"zone": "b", "gpu": "true"}},
+	{Name: "c", Labels: map[string]string{"zone": "b", "gpu": "true"}},
+}
+
+func TestSchedule_RequiredLabels(t *testing.T) {
+	host, err := Schedule(hosts, nil, model.Placement{HostLabels: map[string]string{"gpu": "true"}}, "a")
+	if err != nil || host.Name != "b" {
+		t.Fatalf("expected host b, got %q err=%v", host.Name, err)
+	}
+
+	_, err = Schedule(hosts, nil, model.Placement{HostLabels: map[string]string{"kvm": "nested"}}, "a")
+	if !errors.Is(err, ErrUnschedulable) || !strings.Contains(err.Error(), "missing labels kvm=nested") {
+		t.Fatalf("expected unschedulable with reason, got %v", err)
+	}
+}
+
+func TestSchedule_AffinityAndAntiAffinity(t *testing.T) {
+	metas := []model.VMMetadata{
+		{ID: "db1", Host: "b", Tags: map[string]string{"app": "db"}},
+		{ID: "web1", Host: "c", Tags: map[string]string{"app": "web"}},
+		{ID: "web2", Host: "c", Tags: map[string]string{"app": "web"}},
+	}
+	gpu := map[string]string{"gpu": "true"}
+
+	host, err := Schedule(hosts, metas, model.Placement{HostLabels: gpu, Affinity: map[string]string{"app": "web"}}, "a")
+	if err != nil || host.Name != "c" {
+		t.Fatalf("expected affinity to pick c, got %q err=%v", host.Name, err)
+	}
+
+	host, err = Schedule(hosts, metas, model.Placement{HostLabels: gpu, AntiAffinity: map[string]string{"app": "db"}}, "a")
+	if err != nil || host.Name != "c" {
+		t.Fatalf("expected anti-affinity to avoid b, got %q err=%v", host.Name, err)
+	}
+
+	_, err = Schedule(hosts, metas, model.Placement{HostLabels: gpu, AntiAffinity: map[string]string{"app": "db"}, Affinity: map[string]string{"app": "db"}}, "a")
+	if err != nil {
+		t.Fatalf("affinity is only a preference, got %v", err)
+	}
+}
+
+func TestSchedule_SpreadsAndPrefersLocal(t *testing.T) {
+	host, err := Schedule(hosts, nil, model.Placement{}, "c")
+	if err != nil || host.Name != "c" {
+		t.Fatalf("expected local host on a tie, got %q err=%v", host.Name, err)
+	}
+	metas := []model.VMMetadata{{ID: "x", Host: "c"}}
+	host, _ = Schedule(hosts, metas, model.Placement{}, "c")
+	if host.Name != "a" {
+		t.Fatalf("expected the emptiest host, got %q", host.Name)
+	}
+}
@@ -0,0 +1,181 @@
+package sealing
+
+import (
+	"bytes"
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+	"time"
+)
+
+const (
+	KeySize = 32
+
+	sealedPrefix      = "mergen-sealed:v1:"
+	keyCommandTimeout = 10 * time.Second
+)
+
+var (
+	ErrNoKey      = errors.New("content is sealed but no host key is configured")
+	ErrInvalidKey = errors.New("invalid host key")
+)
+
+// Sealer encrypts small host files (VM env files, hook secrets) with
+// AES-256-GCM under a host key. A nil *Sealer passes plaintext through and
+// refuses to open sealed content.
+type Sealer struct {
+	aead cipher.AEAD
+}
+
+func NewSealer(key []byte) (*Sealer, error) {
+	if len(key) != KeySize {
+		return nil, fmt.Errorf("%w: expected %d bytes, got %d", ErrInvalidKey, KeySize, len(key))
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	return &Sealer{aead: aead}, nil
+}
+
+// Load builds a Sealer from a key file or, when keyCommand is set, from the
+// stdout of that command (e.g. `systemd-creds decrypt ...` or `tpm2_unseal ...`
+// for TPM-backed keys). Returns nil when neither is configured.
+func Load(keyFile, keyCommand string) (*Sealer, error) {
+	keyFile = strings.TrimSpace(keyFile)
+	keyCommand = strings.TrimSpace(keyCommand)
+
+	var (
+		raw []byte
+		err error
+	)
+	switch {
+	case keyCommand != "":
+		raw, err = runKeyCommand(keyCommand)
+		if err != nil {
+			return nil, err
+		}
+	case keyFile != "":
+		raw, err = os.ReadFile(keyFile)
+		if err != nil {
+			return nil, fmt.Errorf("read host key: %w", err)
+		}
+	default:
+		return nil, nil
+	}
+
+	key, err := decodeKey(raw)
+	if err != nil {
+		return nil, err
+	}
+	return NewSealer(key)
+}
+
+// GenerateKey returns a new random key, hex encoded for writing to a key file.
+func GenerateKey() (string, error) {
+	key := make([]byte, KeySize)
+	if _, err := rand.Read(key); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(key), nil
+}
+
+func IsSealed(content []byte) bool {
+	return bytes.HasPrefix(content, []byte(sealedPrefix))
+}
+
+func (s *Sealer) Seal(plaintext []byte) ([]byte, error) {
+	if s == nil {
+		return nil, ErrNoKey
+	}
+	nonce := make([]byte, s.aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	sealed := s.aead.Seal(nonce, nonce, plaintext, []byte(sealedPrefix))
+
+	out := make([]byte, 0, len(sealedPrefix)+base64.StdEncoding.EncodedLen(len(sealed))+1)
+	out = append(out, sealedPrefix...)
+	out = base64.StdEncoding.AppendEncode(out, sealed)
+	return append(out, '\n'), nil
+}
+
+// Open decrypts sealed content and returns anything else unchanged, so files
+// written before sealing was enabled keep working.
+func (s *Sealer) Open(content []byte) ([]byte, error) {
+	if !IsSealed(content) {
+		return content, nil
+	}
+	if s == nil {
+		return nil, ErrNoKey
+	}
+
+	encoded := bytes.TrimSpace(content[len(sealedPrefix):])
+	sealed := make([]byte, base64.StdEncoding.DecodedLen(len(encoded)))
+	n, err := base64.StdEncoding.Decode(sealed, encoded)
+	if err != nil {
+		return nil, fmt.Errorf("decode sealed content: %w", err)
+	}
+	sealed = sealed[:n]
+
+	nonceSize := s.aead.NonceSize()
+	if len(sealed) < nonceSize {
+		return nil, errors.New("sealed content is truncated")
+	}
+	plaintext, err := s.aead.Open(nil, sealed[:nonceSize], sealed[nonceSize:], []byte(sealedPrefix))
+	if err != nil {
+		return nil, fmt.Errorf("open sealed content (wrong host key?): %w", err)
+	}
+	return plaintext, nil
+}
+
+// ReadFile reads path and opens it when sealed.
+func (s *Sealer) ReadFile(path string) ([]byte, error) {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return s.Open(content)
+}
+
+func runKeyCommand(command string) ([]byte, error) {
+	args := strings.Fields(command)
+	ctx, cancel := context.WithTimeout(context.Background(), keyCommandTimeout)
+	defer cancel()
+
+	var stderr bytes.Buffer
+	cmd := exec.CommandContext(ctx, args[0], args[1:]...)
+	cmd.Stderr = &stderr
+	out, err := cmd.Output()
+	if err != nil {
+		return nil, fmt.Errorf("host key command failed: %w: %s", err, strings.TrimSpace(stderr.String()))
+	}
+	return out, nil
+}
+
+// decodeKey accepts 32 raw bytes, 64 hex characters or base64 of 32 bytes.
+func decodeKey(raw []byte) ([]byte, error) {
+	if len(raw) == KeySize {
+		return raw, nil
+	}
+	text := strings.TrimSpace(string(raw))
+	if decoded, err := hex.DecodeString(text); err == nil && len(decoded) == KeySize {
+		return decoded, nil
+	}
+	if decoded, err := base64.StdEncoding.DecodeString(text); err == nil && len(decoded) == KeySize {
+		return decoded, nil
+	}
+	return nil, fmt.Errorf("%w: expected %d raw bytes, hex or base64", ErrInvalidKey, KeySize)
+}
@@ -0,0 +1,65 @@
+package sealing
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestSealOpenRoundTrip(t *testing.T) {
+	key, err := GenerateKey()
+	if err != nil {
+		t.Fatalf("generate key: %v", err)
+	}
+	keyPath := filepath.Join(t.TempDir(), "host.key")
+	if err := os.WriteFile(keyPath, []byte(key+"\n"), 0o400); err != nil {
+		t.Fatalf("write key: %v", err)
+	}
+	sealer, err := Load(keyPath, "")
+	if err != nil {
+		t.Fatalf("load: %v", err)
+	}
+
+	plaintext := []byte("TOKEN=secret\n")
+	sealed, err := sealer.Seal(plaintext)
+	if err != nil {
+		t.Fatalf("seal: %v", err)
+	}
+	if !IsSealed(sealed) || bytes.Contains(sealed, []byte("secret")) {
+		t.Fatalf("unexpected sealed content: %s", sealed)
+	}
+	opened, err := sealer.Open(sealed)
+	if err != nil {
+		t.Fatalf("open: %v", err)
+	}
+	if !bytes.Equal(opened, plaintext) {
+		t.Fatalf("expected %q, got %q", plaintext, opened)
+	}
+
+	other, _ := NewSealer(bytes.Repeat([]byte{1}, KeySize))
+	if _, err := other.Open(sealed); err == nil {
+		t.Fatalf("expected wrong key to fail")
+	}
+	var none *Sealer
+	if _, err := none.Open(sealed); !errors.Is(err, ErrNoKey) {
+		t.Fatalf("expected ErrNoKey, got %v", err)
+	}
+	if out, err := none.Open(plaintext); err != nil || !bytes.Equal(out, plaintext) {
+		t.Fatalf("expected plaintext passthrough, got %q err=%v", out, err)
+	}
+}
+
+func TestLoadRejectsShortKey(t *testing.T) {
+	keyPath := filepath.Join(t.TempDir(), "host.key")
+	if err := os.WriteFile(keyPath, []byte("too-short"), 0o400); err != nil {
+		t.Fatalf("write key: %v", err)
+	}
+	if _, err := Load(keyPath, ""); !errors.Is(err, ErrInvalidKey) {
+		t.Fatalf("expected ErrInvalidKey, got %v", err)
+	}
+	if sealer, err := Load("", ""); sealer != nil || err != nil {
+		t.Fatalf("expected nil sealer without key, got %v %v", sealer, err)
+	}
+}
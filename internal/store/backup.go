@@ -0,0 +1,283 @@
+package store
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/alperreha/mergen-fire/internal/model"
+)
+
+const (
+	backupFormatVersion = 1
+	backupManifestName  = "manifest.json"
+	backupConfigPrefix  = "config/"
+	backupDataPrefix    = "data/"
+	maxBackupEntryBytes = 64 << 20
+)
+
+var ErrBackupInvalid = errors.New("invalid backup")
+
+type BackupManifest struct {
+	FormatVersion int       `json:"formatVersion"`
+	SchemaVersion int       `json:"schemaVersion"`
+	CreatedAt     time.Time `json:"createdAt"`
+	VMIDs         []string  `json:"vmIDs"`
+	IncludesData  bool      `json:"includesData"`
+}
+
+type RestoreOptions struct {
+	Overwrite bool
+}
+
+type RestoreResult struct {
+	Manifest BackupManifest `json:"manifest"`
+	Restored []string       `json:"restored"`
+	Skipped  []string       `json:"skipped"`
+}
+
+// Backup writes a tar.gz with every VM config directory and, when
+// includeData is set, the hook history kept under the data root.
+func (s *FSStore) Backup(w io.Writer, includeData bool) error {
+	return writeBackup(w, s, includeData, func(id string) ([]model.HookExecution, error) {
+		return s.ReadHookHistory(id)
+	})
+}
+
+func (s *SQLiteStore) Backup(w io.Writer, includeData bool) error {
+	return writeBackup(w, s.files, includeData, s.ReadHookHistory)
+}
+
+func writeBackup(w io.Writer, files *FSStore, includeData bool, history func(id string) ([]model.HookExecution, error)) error {
+	ids, err := files.ListVMIDs()
+	if err != nil {
+		return err
+	}
+	if ids == nil {
+		ids = []string{}
+	}
+
+	gz := gzip.NewWriter(w)
+	tw := tar.NewWriter(gz)
+
+	manifest := BackupManifest{
+		FormatVersion: backupFormatVersion,
+		SchemaVersion: SchemaVersion,
+		CreatedAt:     time.Now().UTC(),
+		VMIDs:         ids,
+		IncludesData:  includeData,
+	}
+	manifestJSON, err := json.MarshalIndent(manifest, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := writeTarFile(tw, backupManifestName, manifestJSON, 0o640, manifest.CreatedAt); err != nil {
+		return err
+	}
+
+	for _, id := range ids {
+		configDir := files.PathsFor(id).ConfigDir
+		entries, err := os.ReadDir(configDir)
+		if err != nil {
+			return fmt.Errorf("read config dir %s: %w", id, err)
+		}
+		for _, entry := range entries {
+			if !entry.Type().IsRegular() || strings.HasPrefix(entry.Name(), ".tmp-") {
+				continue
+			}
+			info, err := entry.Info()
+			if err != nil {
+				return err
+			}
+			content, err := os.ReadFile(filepath.Join(configDir, entry.Name()))
+			if err != nil {
+				return err
+			}
+			if err := writeTarFile(tw, backupConfigPrefix+id+"/"+entry.Name(), content, info.Mode().Perm(), info.ModTime()); err != nil {
+				return err
+			}
+		}
+
+		if includeData {
+			records, err := history(id)
+			if err != nil {
+				return fmt.Errorf("read hook history %s: %w", id, err)
+			}
+			if len(records) > 0 {
+				content, err := json.MarshalIndent(records, "", "  ")
+				if err != nil {
+					return err
+				}
+				if err := writeTarFile(tw, backupDataPrefix+id+"/"+filepath.Base(files.PathsFor(id).HookHistory), content, 0o640, manifest.CreatedAt); err != nil {
+					return err
+				}
+			}
+		}
+	}
+
+	if err := tw.Close(); err != nil {
+		return err
+	}
+	return gz.Close()
+}
+
+func writeTarFile(tw *tar.Writer, name string, content []byte, mode os.FileMode, modTime time.Time) error {
+	if err := tw.WriteHeader(&tar.Header{
+		Name:     name,
+		Mode:     int64(mode),
+		Size:     int64(len(content)),
+		ModTime:  modTime,
+		Typeflag: tar.TypeReg,
+	}); err != nil {
+		return err
+	}
+	_, err := tw.Write(content)
+	return err
+}
+
+// Restore unpacks a backup produced by Backup into the store layout. VMs that
+// already exist are skipped unless opts.Overwrite is set. Run and data
+// directories are recreated so the systemd unit can start the VM again.
+func (s *FSStore) Restore(r io.Reader, opts RestoreOptions) (RestoreResult, error) {
+	gz, err := gzip.NewReader(r)
+	if err != nil {
+		return RestoreResult{}, fmt.Errorf("%w: %v", ErrBackupInvalid, err)
+	}
+	defer gz.Close()
+	tr := tar.NewReader(gz)
+
+	var (
+		result      RestoreResult
+		hasManifest bool
+		files       = map[string]map[string][]byte{}
+		history     = map[string][]byte{}
+	)
+	for {
+		header, err := tr.Next()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return RestoreResult{}, fmt.Errorf("%w: %v", ErrBackupInvalid, err)
+		}
+		if header.Typeflag != tar.TypeReg {
+			continue
+		}
+		if header.Size > maxBackupEntryBytes {
+			return RestoreResult{}, fmt.Errorf("%w: entry %s too large", ErrBackupInvalid, header.Name)
+		}
+		content, err := io.ReadAll(io.LimitReader(tr, maxBackupEntryBytes))
+		if err != nil {
+			return RestoreResult{}, err
+		}
+
+		name := path.Clean(header.Name)
+		switch {
+		case name == backupManifestName:
+			if err := json.Unmarshal(content, &result.Manifest); err != nil {
+				return RestoreResult{}, fmt.Errorf("%w: manifest: %v", ErrBackupInvalid, err)
+			}
+			hasManifest = true
+		case strings.HasPrefix(name, backupConfigPrefix):
+			id, file, err := splitBackupEntry(strings.TrimPrefix(name, backupConfigPrefix))
+			if err != nil {
+				return RestoreResult{}, err
+			}
+			if files[id] == nil {
+				files[id] = map[string][]byte{}
+			}
+			files[id][file] = content
+		case strings.HasPrefix(name, backupDataPrefix):
+			id, file, err := splitBackupEntry(strings.TrimPrefix(name, backupDataPrefix))
+			if err != nil {
+				return RestoreResult{}, err
+			}
+			if file != filepath.Base(s.PathsFor(id).HookHistory) {
+				return RestoreResult{}, fmt.Errorf("%w: unexpected data entry %s", ErrBackupInvalid, name)
+			}
+			history[id] = content
+		default:
+			return RestoreResult{}, fmt.Errorf("%w: unexpected entry %s", ErrBackupInvalid, name)
+		}
+	}
+
+	if !hasManifest {
+		return RestoreResult{}, fmt.Errorf("%w: manifest missing", ErrBackupInvalid)
+	}
+	if result.Manifest.FormatVersion != backupFormatVersion {
+		return RestoreResult{}, fmt.Errorf("%w: unsupported backup format %d", ErrBackupInvalid, result.Manifest.FormatVersion)
+	}
+	if result.Manifest.SchemaVersion > SchemaVersion {
+		return RestoreResult{}, fmt.Errorf("%w: backup schema version %d is newer than supported %d", ErrBackupInvalid, result.Manifest.SchemaVersion, SchemaVersion)
+	}
+
+	for _, id := range result.Manifest.VMIDs {
+		vmFiles, ok := files[id]
+		if !ok || vmFiles["meta.json"] == nil || vmFiles["vm.json"] == nil {
+			return RestoreResult{}, fmt.Errorf("%w: vm %s is missing meta.json or vm.json", ErrBackupInvalid, id)
+		}
+		var meta model.VMMetadata
+		if err := json.Unmarshal(vmFiles["meta.json"], &meta); err != nil || meta.ID != id {
+			return RestoreResult{}, fmt.Errorf("%w: vm %s has invalid meta.json", ErrBackupInvalid, id)
+		}
+	}
+
+	for _, id := range result.Manifest.VMIDs {
+		exists, err := s.Exists(id)
+		if err != nil {
+			return result, err
+		}
+		if exists && !opts.Overwrite {
+			result.Skipped = append(result.Skipped, id)
+			continue
+		}
+
+		paths := s.PathsFor(id)
+		for _, dir := range []string{paths.ConfigDir, paths.RunDir, paths.DataDir, paths.LogsDir} {
+			if err := os.MkdirAll(dir, 0o750); err != nil {
+				return result, err
+			}
+		}
+		for file, content := range files[id] {
+			if file == "meta.json" {
+				// Paths are host specific; point them at this store's roots.
+				var meta model.VMMetadata
+				if err := json.Unmarshal(content, &meta); err != nil {
+					return result, err
+				}
+				meta.Paths = paths
+				if err := writeJSONAtomic(paths.MetaPath, meta, 0o640); err != nil {
+					return result, err
+				}
+				continue
+			}
+			if err := writeAtomic(filepath.Join(paths.ConfigDir, file), content, 0o640); err != nil {
+				return result, err
+			}
+		}
+		if content, ok := history[id]; ok {
+			if err := writeAtomic(paths.HookHistory, content, 0o640); err != nil {
+				return result, err
+			}
+		}
+		result.Restored = append(result.Restored, id)
+		s.logger.Debug("vm restored from backup", "vmID", id)
+	}
+	return result, nil
+}
+
+func splitBackupEntry(rel string) (string, string, error) {
+	id, file, ok := strings.Cut(rel, "/")
+	if !ok || file == "" || strings.Contains(file, "/") || validateID(id) != nil || file == ".." {
+		return "", "", fmt.Errorf("%w: invalid entry %s", ErrBackupInvalid, rel)
+	}
+	return id, file, nil
+}
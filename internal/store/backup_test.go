@@ -0,0 +1,104 @@
+package store
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"errors"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/alperreha/mergen-fire/internal/model"
+)
+
+func newTestFSStore(t *testing.T) *FSStore {
+	t.Helper()
+	base := t.TempDir()
+	s := NewFSStore(
+		filepath.Join(base, "etc", "mergen", "vm.d"),
+		filepath.Join(base, "var", "lib", "mergen"),
+		filepath.Join(base, "run", "mergen"),
+		"",
+	)
+	if err := s.EnsureBaseDirs(); err != nil {
+		t.Fatalf("ensure base dirs: %v", err)
+	}
+	return s
+}
+
+func TestBackupRestoreRoundTrip(t *testing.T) {
+	src := newTestFSStore(t)
+	meta := model.VMMetadata{ID: "vm-a", CreatedAt: time.Now().UTC(), Tags: map[string]string{"env": "prod"}}
+	cfg := model.VMConfig{BootSource: model.BootSource{KernelImagePath: "/tmp/vmlinux"}}
+	hooks := model.HooksConfig{OnStart: []model.HookEntry{{Type: "http", URL: "http://127.0.0.1/hook"}}}
+	if _, err := src.SaveVM("vm-a", cfg, meta, hooks, map[string]string{"A": "B"}); err != nil {
+		t.Fatalf("save vm: %v", err)
+	}
+	if err := src.AppendHookExecution("vm-a", model.HookExecution{Event: "onStart", Type: "http", Status: "success"}); err != nil {
+		t.Fatalf("append history: %v", err)
+	}
+
+	var buf bytes.Buffer
+	if err := src.Backup(&buf, true); err != nil {
+		t.Fatalf("backup: %v", err)
+	}
+
+	dst := newTestFSStore(t)
+	result, err := dst.Restore(bytes.NewReader(buf.Bytes()), RestoreOptions{})
+	if err != nil {
+		t.Fatalf("restore: %v", err)
+	}
+	if len(result.Restored) != 1 || result.Restored[0] != "vm-a" {
+		t.Fatalf("unexpected restored list: %+v", result)
+	}
+
+	restored, err := dst.ReadMeta("vm-a")
+	if err != nil {
+		t.Fatalf("read restored meta: %v", err)
+	}
+	if restored.Tags["env"] != "prod" {
+		t.Fatalf("expected tags to survive restore, got %v", restored.Tags)
+	}
+	if restored.Paths.ConfigDir != dst.PathsFor("vm-a").ConfigDir {
+		t.Fatalf("expected paths rewritten to destination store, got %s", restored.Paths.ConfigDir)
+	}
+	restoredHooks, err := dst.ReadHooks("vm-a")
+	if err != nil || len(restoredHooks.OnStart) != 1 {
+		t.Fatalf("expected hooks restored, got %+v err=%v", restoredHooks, err)
+	}
+	env, err := dst.ReadEnv("vm-a")
+	if err != nil || env["A"] != "B" {
+		t.Fatalf("expected env restored, got %v err=%v", env, err)
+	}
+	history, err := dst.ReadHookHistory("vm-a")
+	if err != nil || len(history) != 1 {
+		t.Fatalf("expected hook history restored, got %d err=%v", len(history), err)
+	}
+
+	again, err := dst.Restore(bytes.NewReader(buf.Bytes()), RestoreOptions{})
+	if err != nil {
+		t.Fatalf("second restore: %v", err)
+	}
+	if len(again.Skipped) != 1 || len(again.Restored) != 0 {
+		t.Fatalf("expected existing vm to be skipped, got %+v", again)
+	}
+}
+
+func TestRestoreRejectsNewerSchema(t *testing.T) {
+	var buf bytes.Buffer
+	gz := gzip.NewWriter(&buf)
+	tw := tar.NewWriter(gz)
+	manifest, _ := json.Marshal(BackupManifest{FormatVersion: backupFormatVersion, SchemaVersion: SchemaVersion + 1})
+	if err := writeTarFile(tw, backupManifestName, manifest, 0o640, time.Now()); err != nil {
+		t.Fatalf("write manifest: %v", err)
+	}
+	_ = tw.Close()
+	_ = gz.Close()
+
+	_, err := newTestFSStore(t).Restore(&buf, RestoreOptions{})
+	if !errors.Is(err, ErrBackupInvalid) {
+		t.Fatalf("expected ErrBackupInvalid, got %v", err)
+	}
+}
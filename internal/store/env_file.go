@@ -0,0 +1,186 @@
+package store
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/alperreha/mergen-fire/internal/model"
+	"github.com/alperreha/mergen-fire/internal/sealing"
+)
+
+// ReadEnvFile parses the KEY=VALUE files written by SaveVM. Single and double
+// quoted values are unquoted the way systemd's EnvironmentFile= reads them.
+func ReadEnvFile(path string) (map[string]string, error) {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return parseEnv(content)
+}
+
+func (s *FSStore) ReadEnv(id string) (map[string]string, error) {
+	if err := validateID(id); err != nil {
+		return nil, err
+	}
+	env, err := ReadVMEnv(s.PathsFor(id), s.sealer)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return map[string]string{}, nil
+		}
+		return nil, err
+	}
+	return env, nil
+}
+
+// ReadVMEnv reads the sealed env file when present and the plaintext one
+// otherwise.
+func ReadVMEnv(paths model.VMPaths, sealer *sealing.Sealer) (map[string]string, error) {
+	if paths.SealedEnvPath != "" {
+		content, err := sealer.ReadFile(paths.SealedEnvPath)
+		if err == nil {
+			return parseEnv(content)
+		}
+		if !errors.Is(err, os.ErrNotExist) {
+			return nil, err
+		}
+	}
+	return ReadEnvFile(paths.EnvPath)
+}
+
+// writeEnv seals the env file when a host key is configured and removes any
+// plaintext copy left from before sealing was enabled.
+func (s *FSStore) writeEnv(paths model.VMPaths, env map[string]string) error {
+	if s.sealer == nil {
+		if err := os.Remove(paths.SealedEnvPath); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+		return writeEnvAtomic(paths.EnvPath, env, 0o640)
+	}
+	sealed, err := s.sealer.Seal(renderEnv(env))
+	if err != nil {
+		return err
+	}
+	if err := writeAtomic(paths.SealedEnvPath, sealed, 0o600); err != nil {
+		return err
+	}
+	if err := os.Remove(paths.EnvPath); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	return nil
+}
+
+// RenderRuntimeEnv decrypts a sealed env file into the run directory (tmpfs)
+// for the systemd unit to read. VMs with a plaintext env file need nothing.
+func (s *FSStore) RenderRuntimeEnv(id string) error {
+	if err := validateID(id); err != nil {
+		return err
+	}
+	paths := s.PathsFor(id)
+	content, err := s.sealer.ReadFile(paths.SealedEnvPath)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return nil
+		}
+		return fmt.Errorf("open sealed env: %w", err)
+	}
+	if err := os.MkdirAll(paths.RunDir, 0o750); err != nil {
+		return err
+	}
+	s.logger.Debug("rendering runtime env", "vmID", id, "path", paths.RuntimeEnvPath)
+	return writeAtomic(paths.RuntimeEnvPath, content, 0o600)
+}
+
+func (s *FSStore) RemoveRuntimeEnv(id string) error {
+	if err := validateID(id); err != nil {
+		return err
+	}
+	if err := os.Remove(s.PathsFor(id).RuntimeEnvPath); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	return nil
+}
+
+// SealEnvFiles converts every plaintext env file to its sealed form and
+// returns the ids that were converted.
+func (s *FSStore) SealEnvFiles() ([]string, error) {
+	if s.sealer == nil {
+		return nil, sealing.ErrNoKey
+	}
+	ids, err := s.ListVMIDs()
+	if err != nil {
+		return nil, err
+	}
+	sealed := make([]string, 0, len(ids))
+	for _, id := range ids {
+		paths := s.PathsFor(id)
+		env, err := ReadEnvFile(paths.EnvPath)
+		if err != nil {
+			if errors.Is(err, os.ErrNotExist) {
+				continue
+			}
+			return sealed, fmt.Errorf("read env %s: %w", id, err)
+		}
+		if err := s.writeEnv(paths, env); err != nil {
+			return sealed, fmt.Errorf("seal env %s: %w", id, err)
+		}
+		sealed = append(sealed, id)
+	}
+	return sealed, nil
+}
+
+func parseEnv(content []byte) (map[string]string, error) {
+	env := map[string]string{}
+	scanner := bufio.NewScanner(bytes.NewReader(content))
+	lineNo := 0
+	for scanner.Scan() {
+		lineNo++
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") || strings.HasPrefix(line, ";") {
+			continue
+		}
+		key, raw, ok := strings.Cut(line, "=")
+		key = strings.TrimSpace(strings.TrimPrefix(key, "export "))
+		if !ok || key == "" {
+			return nil, fmt.Errorf("invalid env line %d", lineNo)
+		}
+		value, err := unquoteEnvValue(strings.TrimSpace(raw))
+		if err != nil {
+			return nil, fmt.Errorf("env line %d: %w", lineNo, err)
+		}
+		env[key] = value
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return env, nil
+}
+
+func unquoteEnvValue(raw string) (string, error) {
+	var (
+		out   strings.Builder
+		quote rune
+	)
+	runes := []rune(raw)
+	for i := 0; i < len(runes); i++ {
+		r := runes[i]
+		switch {
+		case quote == 0 && (r == '\'' || r == '"'):
+			quote = r
+		case quote != 0 && r == quote:
+			quote = 0
+		case r == '\\' && quote != '\'' && i+1 < len(runes):
+			i++
+			out.WriteRune(runes[i])
+		default:
+			out.WriteRune(r)
+		}
+	}
+	if quote != 0 {
+		return "", errors.New("unterminated quote")
+	}
+	return out.String(), nil
+}
@@ -0,0 +1,89 @@
+package store
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/alperreha/mergen-fire/internal/model"
+)
+
+func (s *EtcdStore) hostsPrefix() string {
+	return s.prefix + "/hosts/"
+}
+
+// RegisterHost publishes host under <prefix>/hosts/<name>, bound to a lease
+// that is kept alive until ctx ends, so a host that dies drops out of
+// scheduling after ttl. The key is rewritten on every refresh, which also
+// recovers from a lease that expired while etcd was unreachable.
+func (s *EtcdStore) RegisterHost(ctx context.Context, host model.HostInfo, ttl time.Duration) error {
+	value, err := json.Marshal(host)
+	if err != nil {
+		return err
+	}
+	key := s.hostsPrefix() + host.Name
+	var lease int64
+	register := func() error {
+		callCtx, cancel := context.WithTimeout(ctx, ttl)
+		defer cancel()
+		if lease != 0 {
+			if err := s.client.KeepAlive(callCtx, lease); err == nil {
+				if err := s.client.Put(callCtx, key, value, lease); err == nil {
+					return nil
+				}
+			}
+		}
+		granted, err := s.client.Grant(callCtx, ttl)
+		if err != nil {
+			return err
+		}
+		lease = granted
+		return s.client.Put(callCtx, key, value, lease)
+	}
+	if err := register(); err != nil {
+		return fmt.Errorf("register host %s: %w", host.Name, err)
+	}
+	s.logger.Info("host registered", "host", host.Name, "labels", host.Labels)
+
+	go func() {
+		ticker := time.NewTicker(ttl / 3)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				revokeCtx, cancel := context.WithTimeout(context.Background(), ttl)
+				_ = s.client.Revoke(revokeCtx, lease)
+				cancel()
+				return
+			case <-ticker.C:
+				if err := register(); err != nil {
+					s.logger.Warn("host registration refresh failed", "host", host.Name, "error", err)
+				}
+			}
+		}
+	}()
+	return nil
+}
+
+// ListHosts returns the registered hosts sorted by name.
+func (s *EtcdStore) ListHosts() ([]model.HostInfo, error) {
+	ctx, cancel := s.context()
+	defer cancel()
+	kvs, _, err := s.client.Prefix(ctx, s.hostsPrefix())
+	if err != nil {
+		return nil, err
+	}
+	hosts := make([]model.HostInfo, 0, len(kvs))
+	for _, kv := range kvs {
+		var host model.HostInfo
+		if err := json.Unmarshal(kv.Value, &host); err != nil {
+			s.logger.Warn("skipping undecodable host entry", "key", kv.Key, "error", err)
+			continue
+		}
+		hosts = append(hosts, host)
+	}
+	sort.Slice(hosts, func(i, j int) bool { return hosts[i].Name < hosts[j].Name })
+	return hosts, nil
+}
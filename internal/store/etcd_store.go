@@ -0,0 +1,522 @@
+package store
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/alperreha/mergen-fire/internal/etcd"
+	"github.com/alperreha/mergen-fire/internal/model"
+)
+
+const (
+	etcdMetaKey  = "meta"
+	etcdVMKey    = "vm"
+	etcdHooksKey = "hooks"
+)
+
+// EtcdStore keeps the VM inventory (meta, vm config, hooks) in etcd under
+// <prefix>/vms/<id>/ so several mergend instances share it. Env files, hook
+// history and the files the systemd unit reads are materialized through the
+// wrapped FSStore on the host that created the VM.
+type EtcdStore struct {
+	client  *etcd.Client
+	prefix  string
+	files   *FSStore
+	timeout time.Duration
+	logger  *slog.Logger
+}
+
+func NewEtcdStore(client *etcd.Client, prefix string, files *FSStore) *EtcdStore {
+	prefix = "/" + strings.Trim(prefix, "/")
+	return &EtcdStore{
+		client:  client,
+		prefix:  prefix,
+		files:   files,
+		timeout: 5 * time.Second,
+		logger:  slog.Default(),
+	}
+}
+
+func (s *EtcdStore) WithLogger(logger *slog.Logger) *EtcdStore {
+	if logger != nil {
+		s.logger = logger
+	}
+	return s
+}
+
+func (s *EtcdStore) EnsureBaseDirs() error {
+	return s.files.EnsureBaseDirs()
+}
+
+func (s *EtcdStore) vmPrefix() string {
+	return s.prefix + "/vms/"
+}
+
+func (s *EtcdStore) key(id, doc string) string {
+	return s.vmPrefix() + id + "/" + doc
+}
+
+func (s *EtcdStore) context() (context.Context, context.CancelFunc) {
+	return context.WithTimeout(context.Background(), s.timeout)
+}
+
+func (s *EtcdStore) SaveVM(id string, cfg model.VMConfig, meta model.VMMetadata, hooks model.HooksConfig, env map[string]string) (model.VMPaths, error) {
+	if err := validateID(id); err != nil {
+		return model.VMPaths{}, err
+	}
+	s.logger.Debug("saving vm to etcd", "vmID", id, "ports", len(meta.Ports), "hasHooks", hasHooks(hooks))
+
+	meta.Paths = s.files.PathsFor(id)
+	if meta.Revision == 0 {
+		meta.Revision = 1
+	}
+	meta.SchemaVersion = SchemaVersion
+	cfg.SchemaVersion = SchemaVersion
+	hooks.SchemaVersion = SchemaVersion
+
+	ops, err := s.putOps(id, meta, cfg, hooks)
+	if err != nil {
+		return model.VMPaths{}, err
+	}
+	ctx, cancel := s.context()
+	defer cancel()
+	if _, err := s.client.Txn(ctx, nil, ops); err != nil {
+		return model.VMPaths{}, err
+	}
+	return s.files.SaveVM(id, cfg, meta, hooks, env)
+}
+
+func (s *EtcdStore) putOps(id string, meta model.VMMetadata, cfg model.VMConfig, hooks model.HooksConfig) ([]etcd.Op, error) {
+	docs := []struct {
+		name  string
+		value any
+	}{
+		{etcdMetaKey, meta},
+		{etcdVMKey, cfg},
+		{etcdHooksKey, hooks},
+	}
+	ops := make([]etcd.Op, 0, len(docs))
+	for _, doc := range docs {
+		encoded, err := json.Marshal(doc.value)
+		if err != nil {
+			return nil, err
+		}
+		ops = append(ops, etcd.Op{Key: s.key(id, doc.name), Value: encoded})
+	}
+	return ops, nil
+}
+
+func (s *EtcdStore) Exists(id string) (bool, error) {
+	if err := validateID(id); err != nil {
+		return false, err
+	}
+	ctx, cancel := s.context()
+	defer cancel()
+	kv, err := s.client.Get(ctx, s.key(id, etcdMetaKey))
+	if err != nil {
+		return false, err
+	}
+	return kv != nil, nil
+}
+
+func (s *EtcdStore) readDoc(id, doc string, out any) (*etcd.KeyValue, error) {
+	if err := validateID(id); err != nil {
+		return nil, err
+	}
+	ctx, cancel := s.context()
+	defer cancel()
+	kv, err := s.client.Get(ctx, s.key(id, doc))
+	if err != nil {
+		return nil, err
+	}
+	if kv == nil {
+		return nil, ErrNotFound
+	}
+	if err := json.Unmarshal(kv.Value, out); err != nil {
+		return nil, fmt.Errorf("decode %s of %s: %w", doc, id, err)
+	}
+	return kv, nil
+}
+
+func (s *EtcdStore) ReadMeta(id string) (model.VMMetadata, error) {
+	var meta model.VMMetadata
+	if _, err := s.readDoc(id, etcdMetaKey, &meta); err != nil {
+		return model.VMMetadata{}, err
+	}
+	meta.Paths = s.files.PathsFor(id)
+	return meta, nil
+}
+
+// UpdateMeta relies on etcd's mod_revision compare so two hosts updating the
+// same VM cannot both win.
+func (s *EtcdStore) UpdateMeta(id string, expected int64, mutate func(*model.VMMetadata) error) (model.VMMetadata, error) {
+	var meta model.VMMetadata
+	kv, err := s.readDoc(id, etcdMetaKey, &meta)
+	if err != nil {
+		return model.VMMetadata{}, err
+	}
+	if err := applyMetaUpdate(&meta, expected, mutate); err != nil {
+		return model.VMMetadata{}, err
+	}
+	meta.Paths = s.files.PathsFor(id)
+
+	encoded, err := json.Marshal(meta)
+	if err != nil {
+		return model.VMMetadata{}, err
+	}
+	ctx, cancel := s.context()
+	defer cancel()
+	key := s.key(id, etcdMetaKey)
+	applied, err := s.client.Txn(ctx,
+		[]etcd.Compare{{Key: key, Target: "MOD", Revision: kv.ModRevision}},
+		[]etcd.Op{{Key: key, Value: encoded}},
+	)
+	if err != nil {
+		return model.VMMetadata{}, err
+	}
+	if !applied {
+		return model.VMMetadata{}, fmt.Errorf("%w: modified concurrently", ErrRevisionConflict)
+	}
+
+	if exists, _ := s.files.Exists(id); exists {
+		if err := writeJSONAtomic(meta.Paths.MetaPath, meta, 0o640); err != nil {
+			return model.VMMetadata{}, err
+		}
+	}
+	return meta, nil
+}
+
+// UpdateConfig writes the VM config and metadata in one transaction,
+// guarded by the metadata's mod revision like UpdateMeta.
+func (s *EtcdStore) UpdateConfig(id string, expected int64, mutate func(*model.VMConfig, *model.VMMetadata) error) (model.VMConfig, model.VMMetadata, error) {
+	var meta model.VMMetadata
+	kv, err := s.readDoc(id, etcdMetaKey, &meta)
+	if err != nil {
+		return model.VMConfig{}, model.VMMetadata{}, err
+	}
+	var cfg model.VMConfig
+	if _, err := s.readDoc(id, etcdVMKey, &cfg); err != nil {
+		return model.VMConfig{}, model.VMMetadata{}, err
+	}
+	if err := applyMetaUpdate(&meta, expected, func(meta *model.VMMetadata) error { return mutate(&cfg, meta) }); err != nil {
+		return model.VMConfig{}, model.VMMetadata{}, err
+	}
+	meta.Paths = s.files.PathsFor(id)
+
+	encodedMeta, err := json.Marshal(meta)
+	if err != nil {
+		return model.VMConfig{}, model.VMMetadata{}, err
+	}
+	encodedCfg, err := json.Marshal(cfg)
+	if err != nil {
+		return model.VMConfig{}, model.VMMetadata{}, err
+	}
+	ctx, cancel := s.context()
+	defer cancel()
+	key := s.key(id, etcdMetaKey)
+	applied, err := s.client.Txn(ctx,
+		[]etcd.Compare{{Key: key, Target: "MOD", Revision: kv.ModRevision}},
+		[]etcd.Op{{Key: key, Value: encodedMeta}, {Key: s.key(id, etcdVMKey), Value: encodedCfg}},
+	)
+	if err != nil {
+		return model.VMConfig{}, model.VMMetadata{}, err
+	}
+	if !applied {
+		return model.VMConfig{}, model.VMMetadata{}, fmt.Errorf("%w: modified concurrently", ErrRevisionConflict)
+	}
+
+	if exists, _ := s.files.Exists(id); exists {
+		if err := writeJSONAtomic(meta.Paths.VMConfigPath, cfg, 0o640); err != nil {
+			return model.VMConfig{}, model.VMMetadata{}, err
+		}
+		if err := writeJSONAtomic(meta.Paths.MetaPath, meta, 0o640); err != nil {
+			return model.VMConfig{}, model.VMMetadata{}, err
+		}
+	}
+	return cfg, meta, nil
+}
+
+func (s *EtcdStore) ReadVMConfig(id string) (model.VMConfig, error) {
+	var cfg model.VMConfig
+	if _, err := s.readDoc(id, etcdVMKey, &cfg); err != nil {
+		return model.VMConfig{}, err
+	}
+	return cfg, nil
+}
+
+func (s *EtcdStore) ReadHooks(id string) (model.HooksConfig, error) {
+	var hooks model.HooksConfig
+	if _, err := s.readDoc(id, etcdHooksKey, &hooks); err != nil {
+		if errors.Is(err, ErrNotFound) {
+			return model.HooksConfig{}, nil
+		}
+		return model.HooksConfig{}, err
+	}
+	return hooks, nil
+}
+
+func (s *EtcdStore) ReadGlobalHooks() (model.HooksConfig, error) {
+	return s.files.ReadGlobalHooks()
+}
+
+func (s *EtcdStore) ReadEnv(id string) (map[string]string, error) {
+	return s.files.ReadEnv(id)
+}
+
+func (s *EtcdStore) RenderRuntimeEnv(id string) error {
+	return s.files.RenderRuntimeEnv(id)
+}
+
+func (s *EtcdStore) RemoveRuntimeEnv(id string) error {
+	return s.files.RemoveRuntimeEnv(id)
+}
+
+func (s *EtcdStore) metaKVs() ([]etcd.KeyValue, int64, error) {
+	ctx, cancel := s.context()
+	defer cancel()
+	kvs, revision, err := s.client.Prefix(ctx, s.vmPrefix())
+	if err != nil {
+		return nil, 0, err
+	}
+	metas := kvs[:0]
+	for _, kv := range kvs {
+		if strings.HasSuffix(kv.Key, "/"+etcdMetaKey) {
+			metas = append(metas, kv)
+		}
+	}
+	return metas, revision, nil
+}
+
+func (s *EtcdStore) idFromKey(key string) string {
+	return strings.TrimSuffix(strings.TrimPrefix(key, s.vmPrefix()), "/"+etcdMetaKey)
+}
+
+func (s *EtcdStore) ListVMIDs() ([]string, error) {
+	kvs, _, err := s.metaKVs()
+	if err != nil {
+		return nil, err
+	}
+	ids := make([]string, 0, len(kvs))
+	for _, kv := range kvs {
+		ids = append(ids, s.idFromKey(kv.Key))
+	}
+	sort.Strings(ids)
+	return ids, nil
+}
+
+func (s *EtcdStore) ListMetas() ([]model.VMMetadata, error) {
+	kvs, _, err := s.metaKVs()
+	if err != nil {
+		return nil, err
+	}
+	metas := make([]model.VMMetadata, 0, len(kvs))
+	for _, kv := range kvs {
+		var meta model.VMMetadata
+		if err := json.Unmarshal(kv.Value, &meta); err != nil {
+			return nil, fmt.Errorf("decode %s: %w", kv.Key, err)
+		}
+		meta.Paths = s.files.PathsFor(meta.ID)
+		metas = append(metas, meta)
+	}
+	sort.Slice(metas, func(i, j int) bool { return metas[i].ID < metas[j].ID })
+	return metas, nil
+}
+
+func (s *EtcdStore) ListMetasMatching(filter model.VMFilter) ([]model.VMMetadata, error) {
+	metas, err := s.ListMetas()
+	if err != nil {
+		return nil, err
+	}
+	return filterMetas(metas, filter), nil
+}
+
+func (s *EtcdStore) DeleteVM(id string, retainData bool) error {
+	exists, err := s.Exists(id)
+	if err != nil {
+		return err
+	}
+	if !exists {
+		return ErrNotFound
+	}
+	ctx, cancel := s.context()
+	defer cancel()
+	if err := s.client.DeletePrefix(ctx, s.vmPrefix()+id+"/"); err != nil {
+		return err
+	}
+	if err := s.files.DeleteVM(id, retainData); err != nil && !errors.Is(err, ErrNotFound) {
+		return err
+	}
+	return nil
+}
+
+// ReleaseVM removes only this host's copy of the VM's files; the etcd
+// records already belong to the host that took the VM over.
+func (s *EtcdStore) ReleaseVM(id string) error {
+	if err := s.files.DeleteVM(id, false); err != nil && !errors.Is(err, ErrNotFound) {
+		return err
+	}
+	return nil
+}
+
+func (s *EtcdStore) PathsFor(id string) model.VMPaths {
+	return s.files.PathsFor(id)
+}
+
+func (s *EtcdStore) AppendHookExecution(id string, record model.HookExecution) error {
+	return s.files.AppendHookExecution(id, record)
+}
+
+func (s *EtcdStore) ReadHookHistory(id string) ([]model.HookExecution, error) {
+	return s.files.ReadHookHistory(id)
+}
+
+func (s *EtcdStore) AppendStateTransition(id string, transition model.StateTransition) error {
+	return s.files.AppendStateTransition(id, transition)
+}
+
+func (s *EtcdStore) ReadStateHistory(id string) ([]model.StateTransition, error) {
+	return s.files.ReadStateHistory(id)
+}
+
+// Backup archives the VMs materialized on this host.
+func (s *EtcdStore) Backup(w io.Writer, includeData bool) error {
+	return s.files.Backup(w, includeData)
+}
+
+// Fsck only reports on the local files; etcd holds the authoritative copy.
+func (s *EtcdStore) Fsck(bool) (model.FsckReport, error) {
+	return s.files.Fsck(true)
+}
+
+// MigrateSchema migrates the local files and republishes the migrated VMs.
+func (s *EtcdStore) MigrateSchema(backupDir string) (SchemaMigrationResult, error) {
+	result, err := s.files.MigrateSchema(backupDir)
+	if err != nil || len(result.Migrated) == 0 {
+		return result, err
+	}
+	for _, id := range result.Migrated {
+		if err := s.publish(id); err != nil {
+			return result, fmt.Errorf("refresh %s: %w", id, err)
+		}
+	}
+	return result, nil
+}
+
+// ImportFS publishes every VM of an FS layout into etcd and returns the count.
+func (s *EtcdStore) ImportFS(src *FSStore) (int, error) {
+	ids, err := src.ListVMIDs()
+	if err != nil {
+		return 0, err
+	}
+	imported := 0
+	for _, id := range ids {
+		if exists, err := src.Exists(id); err != nil || !exists {
+			continue
+		}
+		if err := s.publishFrom(src, id); err != nil {
+			return imported, fmt.Errorf("import %s: %w", id, err)
+		}
+		imported++
+		s.logger.Debug("vm imported into etcd", "vmID", id)
+	}
+	return imported, nil
+}
+
+func (s *EtcdStore) publish(id string) error {
+	return s.publishFrom(s.files, id)
+}
+
+func (s *EtcdStore) publishFrom(src *FSStore, id string) error {
+	meta, err := src.ReadMeta(id)
+	if err != nil {
+		return err
+	}
+	cfg, err := src.ReadVMConfig(id)
+	if err != nil {
+		return err
+	}
+	hooks, err := src.ReadHooks(id)
+	if err != nil {
+		return err
+	}
+	ops, err := s.putOps(id, meta, cfg, hooks)
+	if err != nil {
+		return err
+	}
+	ctx, cancel := s.context()
+	defer cancel()
+	_, err = s.client.Txn(ctx, nil, ops)
+	return err
+}
+
+// Watch polls the meta keys and diffs their mod revisions, which also picks
+// up changes made by other mergend instances.
+func (s *EtcdStore) Watch(ctx context.Context) (<-chan model.StoreEvent, error) {
+	known, err := s.metaRevisions()
+	if err != nil {
+		return nil, err
+	}
+	out := make(chan model.StoreEvent, watchBufferSize)
+	go pollLoop(ctx, watchPollInterval, out, func() []model.StoreEvent {
+		current, err := s.metaRevisions()
+		if err != nil {
+			if ctx.Err() == nil {
+				s.logger.Warn("etcd store watch poll failed", "error", err)
+			}
+			return nil
+		}
+		events := diffRevisions(known, current)
+		known = current
+		return events
+	})
+	return out, nil
+}
+
+type etcdMetaState struct {
+	modRevision int64
+	revision    int64
+}
+
+func (s *EtcdStore) metaRevisions() (map[string]etcdMetaState, error) {
+	kvs, _, err := s.metaKVs()
+	if err != nil {
+		return nil, err
+	}
+	states := make(map[string]etcdMetaState, len(kvs))
+	for _, kv := range kvs {
+		var meta struct {
+			Revision int64 `json:"revision"`
+		}
+		_ = json.Unmarshal(kv.Value, &meta)
+		states[s.idFromKey(kv.Key)] = etcdMetaState{modRevision: kv.ModRevision, revision: meta.Revision}
+	}
+	return states, nil
+}
+
+func diffRevisions(previous, current map[string]etcdMetaState) []model.StoreEvent {
+	now := time.Now().UTC()
+	var events []model.StoreEvent
+	for id, state := range current {
+		old, ok := previous[id]
+		switch {
+		case !ok:
+			events = append(events, model.StoreEvent{Type: model.StoreEventCreated, ID: id, Revision: state.revision, At: now})
+		case old.modRevision != state.modRevision:
+			events = append(events, model.StoreEvent{Type: model.StoreEventUpdated, ID: id, Revision: state.revision, At: now})
+		}
+	}
+	for id, state := range previous {
+		if _, ok := current[id]; !ok {
+			events = append(events, model.StoreEvent{Type: model.StoreEventDeleted, ID: id, Revision: state.revision, At: now})
+		}
+	}
+	sort.Slice(events, func(i, j int) bool { return events[i].ID < events[j].ID })
+	return events
+}
@@ -0,0 +1,97 @@
+package store
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/alperreha/mergen-fire/internal/etcd"
+	"github.com/alperreha/mergen-fire/internal/etcd/etcdtest"
+	"github.com/alperreha/mergen-fire/internal/model"
+)
+
+func TestEtcdStoreHostRegistry(t *testing.T) {
+	server := etcdtest.NewServer()
+	defer server.Close()
+	client := etcd.NewClient([]string{server.URL}, time.Second)
+	hostA := NewEtcdStore(client, "/mergen", newTestFSStore(t))
+	hostB := NewEtcdStore(client, "/mergen", newTestFSStore(t))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	info := model.HostInfo{Name: "gpu-1", Labels: map[string]string{"gpu": "true"}, URL: "http://gpu-1:8080"}
+	if err := hostA.RegisterHost(ctx, info, time.Second); err != nil {
+		t.Fatalf("register host: %v", err)
+	}
+	hosts, err := hostB.ListHosts()
+	if err != nil || len(hosts) != 1 || hosts[0].Name != "gpu-1" || hosts[0].Labels["gpu"] != "true" {
+		t.Fatalf("expected registered host visible from peer, got %+v err=%v", hosts, err)
+	}
+
+	cancel()
+	deadline := time.Now().Add(2 * time.Second)
+	for time.Now().Before(deadline) {
+		if hosts, _ := hostB.ListHosts(); len(hosts) == 0 {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatal("expected host to deregister when its context ends")
+}
+
+func TestEtcdStoreSharesInventory(t *testing.T) {
+	server := etcdtest.NewServer()
+	defer server.Close()
+	client := etcd.NewClient([]string{server.URL}, time.Second)
+
+	hostA := NewEtcdStore(client, "/mergen", newTestFSStore(t))
+	hostB := NewEtcdStore(client, "/mergen", newTestFSStore(t))
+
+	meta := model.VMMetadata{ID: "vm-1", CreatedAt: time.Now().UTC(), Tags: map[string]string{"env": "prod"}}
+	if _, err := hostA.SaveVM("vm-1", model.VMConfig{}, meta, model.HooksConfig{}, nil); err != nil {
+		t.Fatalf("save vm: %v", err)
+	}
+
+	metas, err := hostB.ListMetas()
+	if err != nil {
+		t.Fatalf("list metas: %v", err)
+	}
+	if len(metas) != 1 || metas[0].ID != "vm-1" || metas[0].Tags["env"] != "prod" {
+		t.Fatalf("expected vm visible from second host, got %+v", metas)
+	}
+
+	updated, err := hostB.UpdateMeta("vm-1", 1, func(m *model.VMMetadata) error {
+		m.Tags = map[string]string{"env": "staging"}
+		return nil
+	})
+	if err != nil || updated.Revision != 2 {
+		t.Fatalf("update meta: revision=%d err=%v", updated.Revision, err)
+	}
+	if _, err := hostA.UpdateMeta("vm-1", 1, func(*model.VMMetadata) error { return nil }); !errors.Is(err, ErrRevisionConflict) {
+		t.Fatalf("expected revision conflict, got %v", err)
+	}
+
+	if err := hostA.DeleteVM("vm-1", false); err != nil {
+		t.Fatalf("delete vm: %v", err)
+	}
+	if exists, err := hostB.Exists("vm-1"); err != nil || exists {
+		t.Fatalf("expected vm gone, exists=%v err=%v", exists, err)
+	}
+}
+
+func TestDiffRevisions(t *testing.T) {
+	previous := map[string]etcdMetaState{"a": {modRevision: 1, revision: 1}, "b": {modRevision: 2, revision: 1}}
+	current := map[string]etcdMetaState{"a": {modRevision: 5, revision: 2}, "c": {modRevision: 6, revision: 1}}
+
+	events := diffRevisions(previous, current)
+	if len(events) != 3 {
+		t.Fatalf("expected 3 events, got %+v", events)
+	}
+	want := map[string]string{"a": model.StoreEventUpdated, "b": model.StoreEventDeleted, "c": model.StoreEventCreated}
+	for _, event := range events {
+		if want[event.ID] != event.Type {
+			t.Fatalf("unexpected event %+v", event)
+		}
+	}
+}
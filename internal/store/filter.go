@@ -0,0 +1,71 @@
+package store
+
+import (
+	"strconv"
+	"strings"
+
+	"github.com/alperreha/mergen-fire/internal/model"
+)
+
+// MatchFilter reports whether meta is in filter's namespace, if it names
+// one, and carries every tag and metadata value of filter. Objects and
+// arrays in metadata never match a value.
+func MatchFilter(meta model.VMMetadata, filter model.VMFilter) bool {
+	if filter.Namespace != "" && model.NamespaceOf(meta) != filter.Namespace {
+		return false
+	}
+	for key, want := range filter.Tags {
+		if got, ok := meta.Tags[key]; !ok || got != want {
+			return false
+		}
+	}
+	for path, want := range filter.Metadata {
+		if got, ok := metadataText(meta.Metadata, path); !ok || got != want {
+			return false
+		}
+	}
+	return true
+}
+
+func metadataText(doc map[string]any, path string) (string, bool) {
+	var value any = doc
+	for _, key := range strings.Split(path, ".") {
+		object, ok := value.(map[string]any)
+		if !ok {
+			return "", false
+		}
+		if value, ok = object[key]; !ok {
+			return "", false
+		}
+	}
+	switch v := value.(type) {
+	case string:
+		return v, true
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 64), true
+	case bool:
+		return strconv.FormatBool(v), true
+	case nil:
+		return "null", true
+	}
+	return "", false
+}
+
+func filterMetas(metas []model.VMMetadata, filter model.VMFilter) []model.VMMetadata {
+	matched := metas[:0]
+	for _, meta := range metas {
+		if MatchFilter(meta, filter) {
+			matched = append(matched, meta)
+		}
+	}
+	return matched
+}
+
+// ListMetasMatching returns the metadata of the VMs filter selects.
+func (s *FSStore) ListMetasMatching(filter model.VMFilter) ([]model.VMMetadata, error) {
+	metas, err := s.ListMetas()
+	if err != nil {
+		return nil, err
+	}
+	return filterMetas(metas, filter), nil
+}
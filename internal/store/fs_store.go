@@ -9,8 +9,10 @@ import (
 	"path/filepath"
 	"sort"
 	"strings"
+	"sync"
 
 	"github.com/alperreha/mergen-fire/internal/model"
+	"github.com/alperreha/mergen-fire/internal/sealing"
 )
 
 var ErrNotFound = errors.New("vm not found")
@@ -20,7 +22,11 @@ type FSStore struct {
 	dataRoot   string
 	runRoot    string
 	hooksRoot  string
+	sealer     *sealing.Sealer
 	logger     *slog.Logger
+
+	historyMu sync.Mutex
+	metaMu    sync.Mutex
 }
 
 func NewFSStore(configRoot, dataRoot, runRoot, hooksRoot string) *FSStore {
@@ -40,6 +46,12 @@ func (s *FSStore) WithLogger(logger *slog.Logger) *FSStore {
 	return s
 }
 
+// WithSealer makes the store write env files encrypted under the host key.
+func (s *FSStore) WithSealer(sealer *sealing.Sealer) *FSStore {
+	s.sealer = sealer
+	return s
+}
+
 func (s *FSStore) EnsureBaseDirs() error {
 	s.logger.Debug("ensuring store base directories", "configRoot", s.configRoot, "dataRoot", s.dataRoot, "runRoot", s.runRoot)
 	dirs := []string{s.configRoot, s.dataRoot, s.runRoot}
@@ -58,7 +70,16 @@ func (s *FSStore) SaveVM(id string, cfg model.VMConfig, meta model.VMMetadata, h
 	s.logger.Debug("saving vm artifacts", "vmID", id, "ports", len(meta.Ports), "hasHooks", hasHooks(hooks), "envCount", len(env))
 
 	paths := s.PathsFor(id)
+	if meta.SocketPath != "" {
+		paths.SocketPath = meta.SocketPath
+	}
 	meta.Paths = paths
+	if meta.Revision == 0 {
+		meta.Revision = 1
+	}
+	meta.SchemaVersion = SchemaVersion
+	cfg.SchemaVersion = SchemaVersion
+	hooks.SchemaVersion = SchemaVersion
 
 	dirs := []string{
 		paths.ConfigDir,
@@ -86,7 +107,7 @@ func (s *FSStore) SaveVM(id string, cfg model.VMConfig, meta model.VMMetadata, h
 	}
 
 	if len(env) > 0 {
-		if err := writeEnvAtomic(paths.EnvPath, env, 0o640); err != nil {
+		if err := s.writeEnv(paths, env); err != nil {
 			return model.VMPaths{}, err
 		}
 	}
@@ -256,6 +277,8 @@ func (s *FSStore) DeleteVM(id string, retainData bool) error {
 		return ErrNotFound
 	}
 
+	s.historyMu.Lock()
+	defer s.historyMu.Unlock()
 	paths := s.PathsFor(id)
 	if err := os.RemoveAll(paths.ConfigDir); err != nil {
 		return err
@@ -272,22 +295,31 @@ func (s *FSStore) DeleteVM(id string, retainData bool) error {
 	return nil
 }
 
+// ReleaseVM drops a VM that another host took over.
+func (s *FSStore) ReleaseVM(id string) error {
+	return s.DeleteVM(id, false)
+}
+
 func (s *FSStore) PathsFor(id string) model.VMPaths {
 	configDir := filepath.Join(s.configRoot, id)
 	dataDir := filepath.Join(s.dataRoot, id)
 	runDir := filepath.Join(s.runRoot, id)
 
 	return model.VMPaths{
-		ConfigDir:    configDir,
-		VMConfigPath: filepath.Join(configDir, "vm.json"),
-		MetaPath:     filepath.Join(configDir, "meta.json"),
-		HooksPath:    filepath.Join(configDir, "hooks.json"),
-		EnvPath:      filepath.Join(configDir, "env"),
-		RunDir:       runDir,
-		SocketPath:   filepath.Join(runDir, "mergen.socket"),
-		LockPath:     filepath.Join(s.runRoot, id+".lock"),
-		DataDir:      dataDir,
-		LogsDir:      filepath.Join(dataDir, "logs"),
+		ConfigDir:      configDir,
+		VMConfigPath:   filepath.Join(configDir, "vm.json"),
+		MetaPath:       filepath.Join(configDir, "meta.json"),
+		HooksPath:      filepath.Join(configDir, "hooks.json"),
+		EnvPath:        filepath.Join(configDir, "env"),
+		SealedEnvPath:  filepath.Join(configDir, "env.sealed"),
+		RuntimeEnvPath: filepath.Join(runDir, "env"),
+		RunDir:         runDir,
+		SocketPath:     filepath.Join(runDir, "mergen.socket"),
+		LockPath:       filepath.Join(s.runRoot, id+".lock"),
+		DataDir:        dataDir,
+		LogsDir:        filepath.Join(dataDir, "logs"),
+		HookHistory:    filepath.Join(dataDir, "hooks-history.json"),
+		StateHistory:   filepath.Join(dataDir, "state-history.json"),
 	}
 }
 
@@ -305,6 +337,10 @@ func writeJSONAtomic(path string, payload any, mode os.FileMode) error {
 }
 
 func writeEnvAtomic(path string, env map[string]string, mode os.FileMode) error {
+	return writeAtomic(path, renderEnv(env), mode)
+}
+
+func renderEnv(env map[string]string) []byte {
 	keys := make([]string, 0, len(env))
 	for key := range env {
 		keys = append(keys, key)
@@ -315,8 +351,7 @@ func writeEnvAtomic(path string, env map[string]string, mode os.FileMode) error
 	for _, key := range keys {
 		lines = append(lines, fmt.Sprintf("%s=%s", key, shellEscape(env[key])))
 	}
-	content := []byte(strings.Join(lines, "\n") + "\n")
-	return writeAtomic(path, content, mode)
+	return []byte(strings.Join(lines, "\n") + "\n")
 }
 
 func writeAtomic(path string, content []byte, mode os.FileMode) error {
@@ -371,7 +406,23 @@ func validateID(id string) error {
 	return nil
 }
 
+// shellEscape leaves plain values bare so env files read as KEY=VALUE.
+// Files from before that quoted every value still parse the same.
 func shellEscape(value string) string {
+	if value != "" && strings.IndexFunc(value, needsEnvQuoting) < 0 {
+		return value
+	}
 	escaped := strings.ReplaceAll(value, "'", "'\\''")
 	return fmt.Sprintf("'%s'", escaped)
 }
+
+func needsEnvQuoting(r rune) bool {
+	switch {
+	case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z', r >= '0' && r <= '9':
+		return false
+	case strings.ContainsRune("-_./:,@%+=", r):
+		return false
+	default:
+		return true
+	}
+}
@@ -1,12 +1,16 @@
 package store
 
 import (
+	"bytes"
+	"context"
 	"os"
 	"path/filepath"
+	"strings"
 	"testing"
 	"time"
 
 	"github.com/alperreha/mergen-fire/internal/model"
+	"github.com/alperreha/mergen-fire/internal/sealing"
 )
 
 func TestSaveReadDeleteVM(t *testing.T) {
@@ -88,3 +92,189 @@ func TestSaveReadDeleteVM(t *testing.T) {
 		t.Fatalf("vm should be deleted")
 	}
 }
+
+func TestHookHistoryIsBounded(t *testing.T) {
+	s := newTestFSStore(t)
+
+	id := "test-vm-1"
+	if _, err := s.SaveVM(id, model.VMConfig{}, model.VMMetadata{ID: id}, model.HooksConfig{}, nil); err != nil {
+		t.Fatalf("save vm: %v", err)
+	}
+	for i := 0; i < maxHookHistoryEntries+5; i++ {
+		if err := s.AppendHookExecution(id, model.HookExecution{Event: model.HookOnStart, Index: i, Status: "succeeded"}); err != nil {
+			t.Fatalf("append hook execution %d: %v", i, err)
+		}
+	}
+
+	history, err := s.ReadHookHistory(id)
+	if err != nil {
+		t.Fatalf("read hook history: %v", err)
+	}
+	if len(history) != maxHookHistoryEntries {
+		t.Fatalf("expected %d entries, got %d", maxHookHistoryEntries, len(history))
+	}
+	if history[0].Index != 5 {
+		t.Fatalf("expected oldest entries to be dropped, first index=%d", history[0].Index)
+	}
+}
+
+func TestHookHistoryNotRecordedAfterDelete(t *testing.T) {
+	s := newTestFSStore(t)
+
+	id := "test-vm-1"
+	paths, err := s.SaveVM(id, model.VMConfig{}, model.VMMetadata{ID: id}, model.HooksConfig{}, nil)
+	if err != nil {
+		t.Fatalf("save vm: %v", err)
+	}
+	if err := s.DeleteVM(id, false); err != nil {
+		t.Fatalf("delete vm: %v", err)
+	}
+	if err := s.AppendHookExecution(id, model.HookExecution{Event: model.HookOnDelete, Status: "succeeded"}); err != nil {
+		t.Fatalf("append hook execution: %v", err)
+	}
+	if _, err := os.Stat(paths.DataDir); !os.IsNotExist(err) {
+		t.Fatalf("expected data dir to stay removed, stat err=%v", err)
+	}
+}
+
+func TestEnvFileRoundTrip(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "env")
+	env := map[string]string{
+		"PLAIN":  "80",
+		"SPACED": "hello world",
+		"QUOTE":  "it's",
+		"EMPTY":  "",
+	}
+	if err := writeEnvAtomic(path, env, 0o640); err != nil {
+		t.Fatalf("write env: %v", err)
+	}
+
+	content, _ := os.ReadFile(path)
+	if !strings.Contains(string(content), "PLAIN=80\n") {
+		t.Fatalf("expected plain value unquoted, got: %s", content)
+	}
+
+	parsed, err := ReadEnvFile(path)
+	if err != nil {
+		t.Fatalf("read env: %v", err)
+	}
+	for key, want := range env {
+		if parsed[key] != want {
+			t.Fatalf("%s: expected %q, got %q", key, want, parsed[key])
+		}
+	}
+}
+
+func TestEnvFileReadsFullyQuotedValues(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "env")
+	legacy := "EMPTY=''\nPLAIN='80'\nQUOTE='it'\\''s'\nSPACED='hello world'\n"
+	if err := os.WriteFile(path, []byte(legacy), 0o640); err != nil {
+		t.Fatalf("write env: %v", err)
+	}
+
+	parsed, err := ReadEnvFile(path)
+	if err != nil {
+		t.Fatalf("read env: %v", err)
+	}
+	for key, want := range map[string]string{"EMPTY": "", "PLAIN": "80", "QUOTE": "it's", "SPACED": "hello world"} {
+		if parsed[key] != want {
+			t.Fatalf("%s: expected %q, got %q", key, want, parsed[key])
+		}
+	}
+}
+
+func TestWatchEmitsLifecycleEvents(t *testing.T) {
+	base := t.TempDir()
+	s := NewFSStore(
+		filepath.Join(base, "etc", "mergen", "vm.d"),
+		filepath.Join(base, "var", "lib", "mergen"),
+		filepath.Join(base, "run", "mergen"),
+		filepath.Join(base, "etc", "mergen", "hooks.d"),
+	)
+	if err := s.EnsureBaseDirs(); err != nil {
+		t.Fatalf("ensure dirs: %v", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	events, err := s.Watch(ctx)
+	if err != nil {
+		t.Fatalf("watch: %v", err)
+	}
+
+	id := "vm-watch"
+	if _, err := s.SaveVM(id, model.VMConfig{}, model.VMMetadata{ID: id}, model.HooksConfig{}, nil); err != nil {
+		t.Fatalf("save vm: %v", err)
+	}
+	expectEvent(t, events, model.StoreEventCreated, id)
+
+	if _, err := s.UpdateMeta(id, 1, func(meta *model.VMMetadata) error {
+		meta.Tags = map[string]string{"app": "web"}
+		return nil
+	}); err != nil {
+		t.Fatalf("update meta: %v", err)
+	}
+	expectEvent(t, events, model.StoreEventUpdated, id)
+
+	if err := s.DeleteVM(id, false); err != nil {
+		t.Fatalf("delete vm: %v", err)
+	}
+	expectEvent(t, events, model.StoreEventDeleted, id)
+}
+
+func expectEvent(t *testing.T, events <-chan model.StoreEvent, eventType, id string) {
+	t.Helper()
+	timeout := time.After(5 * time.Second)
+	for {
+		select {
+		case event := <-events:
+			if event.ID == id && event.Type == eventType {
+				return
+			}
+		case <-timeout:
+			t.Fatalf("timed out waiting for %s event for %s", eventType, id)
+		}
+	}
+}
+
+func TestSealedEnvFile(t *testing.T) {
+	sealer, err := sealing.NewSealer(bytes.Repeat([]byte{7}, sealing.KeySize))
+	if err != nil {
+		t.Fatalf("new sealer: %v", err)
+	}
+	s := newTestFSStore(t).WithSealer(sealer)
+
+	paths, err := s.SaveVM("sealed-vm", model.VMConfig{}, model.VMMetadata{ID: "sealed-vm"}, model.HooksConfig{}, map[string]string{"TOKEN": "hunter2"})
+	if err != nil {
+		t.Fatalf("save vm: %v", err)
+	}
+	if _, err := os.Stat(paths.EnvPath); !os.IsNotExist(err) {
+		t.Fatalf("expected no plaintext env file, stat err=%v", err)
+	}
+	raw, err := os.ReadFile(paths.SealedEnvPath)
+	if err != nil {
+		t.Fatalf("read sealed env: %v", err)
+	}
+	if strings.Contains(string(raw), "hunter2") {
+		t.Fatalf("sealed env contains plaintext")
+	}
+
+	env, err := s.ReadEnv("sealed-vm")
+	if err != nil || env["TOKEN"] != "hunter2" {
+		t.Fatalf("expected decrypted env, got %v err=%v", env, err)
+	}
+
+	if err := s.RenderRuntimeEnv("sealed-vm"); err != nil {
+		t.Fatalf("render runtime env: %v", err)
+	}
+	runtimeEnv, err := ReadEnvFile(paths.RuntimeEnvPath)
+	if err != nil || runtimeEnv["TOKEN"] != "hunter2" {
+		t.Fatalf("expected runtime env, got %v err=%v", runtimeEnv, err)
+	}
+	if err := s.RemoveRuntimeEnv("sealed-vm"); err != nil {
+		t.Fatalf("remove runtime env: %v", err)
+	}
+	if _, err := os.Stat(paths.RuntimeEnvPath); !os.IsNotExist(err) {
+		t.Fatalf("expected runtime env removed, stat err=%v", err)
+	}
+}
@@ -0,0 +1,217 @@
+package store
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/alperreha/mergen-fire/internal/model"
+)
+
+// Fsck validates every VM directory under the config root and cross-checks
+// guest IP and host port uniqueness. Unless dryRun is set, VMs with corrupt
+// or invalid documents are moved whole into
+// <dataRoot>/quarantine/<timestamp>/<id> next to a report.json, so one bad
+// file no longer breaks listing. Conflicts and orphans are only reported.
+func (s *FSStore) Fsck(dryRun bool) (model.FsckReport, error) {
+	report := model.FsckReport{CheckedAt: time.Now().UTC(), DryRun: dryRun, Issues: []model.FsckIssue{}}
+
+	entries, err := os.ReadDir(s.configRoot)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return report, nil
+		}
+		return report, err
+	}
+
+	metas := make([]model.VMMetadata, 0, len(entries))
+	broken := map[string]bool{}
+	for _, entry := range entries {
+		if !entry.IsDir() {
+			continue
+		}
+		id := entry.Name()
+		report.Checked++
+		meta, issues := s.checkVM(id)
+		for _, issue := range issues {
+			if issue.Kind == model.FsckCorrupt || issue.Kind == model.FsckInvalid {
+				broken[id] = true
+			}
+		}
+		report.Issues = append(report.Issues, issues...)
+		if meta != nil && !broken[id] {
+			metas = append(metas, *meta)
+		}
+	}
+	report.Issues = append(report.Issues, checkAllocations(metas)...)
+
+	if !dryRun && len(broken) > 0 {
+		if err := s.quarantine(&report, broken); err != nil {
+			return report, err
+		}
+	}
+	if len(report.Issues) > 0 {
+		s.logger.Warn("store fsck found issues", "checked", report.Checked, "issues", len(report.Issues), "quarantined", len(report.Quarantined), "dryRun", dryRun)
+	} else {
+		s.logger.Debug("store fsck clean", "checked", report.Checked)
+	}
+	return report, nil
+}
+
+func (s *FSStore) checkVM(id string) (*model.VMMetadata, []model.FsckIssue) {
+	var issues []model.FsckIssue
+	add := func(file, kind, format string, args ...any) {
+		issues = append(issues, model.FsckIssue{VMID: id, File: file, Kind: kind, Message: fmt.Sprintf(format, args...)})
+	}
+	if err := validateID(id); err != nil {
+		add("", model.FsckInvalid, "%v", err)
+		return nil, issues
+	}
+	paths := s.PathsFor(id)
+
+	var meta model.VMMetadata
+	metaErr := readStrictJSON(paths.MetaPath, &meta)
+	switch {
+	case errors.Is(metaErr, os.ErrNotExist):
+		add("meta.json", model.FsckOrphan, "config directory has no meta.json")
+	case metaErr != nil:
+		add("meta.json", model.FsckCorrupt, "%v", metaErr)
+	default:
+		for _, problem := range validateMeta(id, meta) {
+			add("meta.json", model.FsckInvalid, "%s", problem)
+		}
+	}
+
+	var cfg model.VMConfig
+	switch err := readStrictJSON(paths.VMConfigPath, &cfg); {
+	case errors.Is(err, os.ErrNotExist):
+		if metaErr == nil {
+			add("vm.json", model.FsckInvalid, "vm.json is missing")
+		}
+	case err != nil:
+		add("vm.json", model.FsckCorrupt, "%v", err)
+	case cfg.SchemaVersion > SchemaVersion:
+		add("vm.json", model.FsckInvalid, "schemaVersion %d is newer than supported %d", cfg.SchemaVersion, SchemaVersion)
+	case strings.TrimSpace(cfg.BootSource.KernelImagePath) == "":
+		add("vm.json", model.FsckInvalid, "boot-source.kernel_image_path is empty")
+	}
+
+	var hooks model.HooksConfig
+	if err := readStrictJSON(paths.HooksPath, &hooks); err != nil && !errors.Is(err, os.ErrNotExist) {
+		add("hooks.json", model.FsckCorrupt, "%v", err)
+	}
+	if _, err := ReadEnvFile(paths.EnvPath); err != nil && !errors.Is(err, os.ErrNotExist) {
+		add("env", model.FsckCorrupt, "%v", err)
+	}
+
+	if metaErr != nil {
+		return nil, issues
+	}
+	return &meta, issues
+}
+
+func validateMeta(id string, meta model.VMMetadata) []string {
+	var problems []string
+	if meta.ID != id {
+		problems = append(problems, fmt.Sprintf("id %q does not match directory %q", meta.ID, id))
+	}
+	if meta.SchemaVersion > SchemaVersion {
+		problems = append(problems, fmt.Sprintf("schemaVersion %d is newer than supported %d", meta.SchemaVersion, SchemaVersion))
+	}
+	if meta.GuestIP != "" && net.ParseIP(meta.GuestIP) == nil {
+		problems = append(problems, fmt.Sprintf("guestIP %q is not an IP address", meta.GuestIP))
+	}
+	for _, port := range meta.Ports {
+		if port.Guest <= 0 || port.Guest > 65535 || port.Host <= 0 || port.Host > 65535 {
+			problems = append(problems, fmt.Sprintf("port binding %d->%d is out of range", port.Host, port.Guest))
+		}
+	}
+	if meta.HTTPPort < 0 || meta.HTTPPort > 65535 {
+		problems = append(problems, fmt.Sprintf("httpPort %d is out of range", meta.HTTPPort))
+	}
+	return problems
+}
+
+func checkAllocations(metas []model.VMMetadata) []model.FsckIssue {
+	sort.Slice(metas, func(i, j int) bool { return metas[i].ID < metas[j].ID })
+	var issues []model.FsckIssue
+	ips := map[string]string{}
+	ports := map[string]string{}
+	for _, meta := range metas {
+		if meta.GuestIP != "" {
+			if owner, ok := ips[meta.GuestIP]; ok {
+				issues = append(issues, model.FsckIssue{VMID: meta.ID, File: "meta.json", Kind: model.FsckConflict, Message: fmt.Sprintf("guestIP %s is also used by %s", meta.GuestIP, owner)})
+			} else {
+				ips[meta.GuestIP] = meta.ID
+			}
+		}
+		for _, port := range meta.Ports {
+			protocol := port.Protocol
+			if protocol == "" {
+				protocol = "tcp"
+			}
+			key := fmt.Sprintf("%d/%s", port.Host, protocol)
+			if owner, ok := ports[key]; ok && owner != meta.ID {
+				issues = append(issues, model.FsckIssue{VMID: meta.ID, File: "meta.json", Kind: model.FsckConflict, Message: fmt.Sprintf("host port %s is also used by %s", key, owner)})
+			} else {
+				ports[key] = meta.ID
+			}
+		}
+	}
+	return issues
+}
+
+func (s *FSStore) quarantine(report *model.FsckReport, broken map[string]bool) error {
+	dir := filepath.Join(s.dataRoot, "quarantine", report.CheckedAt.Format("20060102T150405Z"))
+	if err := os.MkdirAll(dir, 0o750); err != nil {
+		return err
+	}
+	report.QuarantineDir = dir
+
+	ids := make([]string, 0, len(broken))
+	for id := range broken {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	for _, id := range ids {
+		if validateID(id) != nil {
+			continue
+		}
+		if err := os.Rename(s.PathsFor(id).ConfigDir, filepath.Join(dir, id)); err != nil {
+			return fmt.Errorf("quarantine %s: %w", id, err)
+		}
+		report.Quarantined = append(report.Quarantined, id)
+		for i := range report.Issues {
+			if report.Issues[i].VMID == id {
+				report.Issues[i].Quarantined = true
+			}
+		}
+		s.logger.Warn("vm quarantined", "vmID", id, "dir", filepath.Join(dir, id))
+	}
+	return writeJSONAtomic(filepath.Join(dir, "report.json"), report, 0o640)
+}
+
+// readStrictJSON is readJSON that also rejects empty files and trailing data.
+func readStrictJSON(path string, out any) error {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	if len(strings.TrimSpace(string(content))) == 0 {
+		return errors.New("file is empty")
+	}
+	decoder := json.NewDecoder(strings.NewReader(string(content)))
+	if err := decoder.Decode(out); err != nil {
+		return err
+	}
+	if decoder.More() {
+		return errors.New("unexpected data after JSON document")
+	}
+	return nil
+}
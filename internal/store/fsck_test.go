@@ -0,0 +1,64 @@
+package store
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/alperreha/mergen-fire/internal/model"
+)
+
+func TestFsckQuarantinesCorruptVM(t *testing.T) {
+	s := newTestFSStore(t)
+	cfg := model.VMConfig{BootSource: model.BootSource{KernelImagePath: "/tmp/vmlinux"}}
+	for _, id := range []string{"vm-good", "vm-dup"} {
+		meta := model.VMMetadata{ID: id, CreatedAt: time.Now().UTC(), GuestIP: "172.30.0.2", Ports: []model.PortBinding{{Guest: 80, Host: 20000, Protocol: "tcp"}}}
+		if _, err := s.SaveVM(id, cfg, meta, model.HooksConfig{}, nil); err != nil {
+			t.Fatalf("save %s: %v", id, err)
+		}
+	}
+	badPaths := s.PathsFor("vm-bad")
+	if err := os.MkdirAll(badPaths.ConfigDir, 0o750); err != nil {
+		t.Fatalf("mkdir: %v", err)
+	}
+	if err := os.WriteFile(badPaths.MetaPath, []byte(`{"id":"vm-bad",`), 0o640); err != nil {
+		t.Fatalf("write meta: %v", err)
+	}
+	if _, err := s.ListMetas(); err == nil {
+		t.Fatalf("expected corrupt meta to break ListMetas before fsck")
+	}
+
+	dry, err := s.Fsck(true)
+	if err != nil {
+		t.Fatalf("dry-run fsck: %v", err)
+	}
+	if dry.Checked != 3 || len(dry.Quarantined) != 0 {
+		t.Fatalf("unexpected dry-run report: %+v", dry)
+	}
+	kinds := map[string]int{}
+	for _, issue := range dry.Issues {
+		kinds[issue.Kind]++
+	}
+	if kinds[model.FsckCorrupt] != 1 || kinds[model.FsckConflict] != 2 {
+		t.Fatalf("expected one corrupt and two conflict issues, got %+v", dry.Issues)
+	}
+
+	report, err := s.Fsck(false)
+	if err != nil {
+		t.Fatalf("fsck: %v", err)
+	}
+	if len(report.Quarantined) != 1 || report.Quarantined[0] != "vm-bad" {
+		t.Fatalf("expected vm-bad quarantined, got %+v", report)
+	}
+	if _, err := os.Stat(filepath.Join(report.QuarantineDir, "vm-bad", "meta.json")); err != nil {
+		t.Fatalf("quarantined meta missing: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(report.QuarantineDir, "report.json")); err != nil {
+		t.Fatalf("report missing: %v", err)
+	}
+	metas, err := s.ListMetas()
+	if err != nil || len(metas) != 2 {
+		t.Fatalf("expected listing to recover with 2 vms, got %d err=%v", len(metas), err)
+	}
+}
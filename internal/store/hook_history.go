@@ -0,0 +1,62 @@
+package store
+
+import (
+	"errors"
+	"os"
+
+	"github.com/alperreha/mergen-fire/internal/model"
+)
+
+const maxHookHistoryEntries = 200
+
+func (s *FSStore) AppendHookExecution(id string, record model.HookExecution) error {
+	if err := validateID(id); err != nil {
+		return err
+	}
+
+	s.historyMu.Lock()
+	defer s.historyMu.Unlock()
+
+	// onDelete hooks finish after the VM's directories are gone; writing
+	// their history would bring its data dir back.
+	exists, err := s.Exists(id)
+	if err != nil {
+		return err
+	}
+	if !exists {
+		s.logger.Debug("vm deleted, hook execution not recorded", "vmID", id, "event", record.Event)
+		return nil
+	}
+
+	path := s.PathsFor(id).HookHistory
+	var history []model.HookExecution
+	if err := readJSON(path, &history); err != nil && !errors.Is(err, os.ErrNotExist) {
+		s.logger.Warn("hook history unreadable, starting fresh", "vmID", id, "error", err)
+		history = nil
+	}
+
+	history = append(history, record)
+	if len(history) > maxHookHistoryEntries {
+		history = history[len(history)-maxHookHistoryEntries:]
+	}
+	return writeJSONAtomic(path, history, 0o640)
+}
+
+func (s *FSStore) ReadHookHistory(id string) ([]model.HookExecution, error) {
+	if err := validateID(id); err != nil {
+		return nil, err
+	}
+	s.logger.Debug("reading hook history", "vmID", id)
+
+	s.historyMu.Lock()
+	defer s.historyMu.Unlock()
+
+	var history []model.HookExecution
+	if err := readJSON(s.PathsFor(id).HookHistory, &history); err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return []model.HookExecution{}, nil
+		}
+		return nil, err
+	}
+	return history, nil
+}
@@ -0,0 +1,129 @@
+package store
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/alperreha/mergen-fire/internal/model"
+)
+
+var ErrJobNotFound = errors.New("job not found")
+
+// jobsDir holds one JSON record per asynchronous job, e.g.
+// /var/lib/mergen/jobs.
+func (s *FSStore) jobsDir() string {
+	return filepath.Join(s.dataRoot, "jobs")
+}
+
+func (s *FSStore) jobPath(id string) (string, error) {
+	if strings.TrimSpace(id) == "" || strings.ContainsAny(id, `/\`) || strings.HasPrefix(id, ".") {
+		return "", ErrJobNotFound
+	}
+	return filepath.Join(s.jobsDir(), id+".json"), nil
+}
+
+// ListJobs returns every job record, newest first.
+func (s *FSStore) ListJobs() ([]model.Job, error) {
+	entries, err := os.ReadDir(s.jobsDir())
+	if errors.Is(err, os.ErrNotExist) {
+		return []model.Job{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	jobs := make([]model.Job, 0, len(entries))
+	for _, entry := range entries {
+		id, ok := strings.CutSuffix(entry.Name(), ".json")
+		if !ok || entry.IsDir() {
+			continue
+		}
+		job, err := s.ReadJob(id)
+		if errors.Is(err, ErrJobNotFound) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		jobs = append(jobs, job)
+	}
+	sort.Slice(jobs, func(i, j int) bool { return jobs[i].CreatedAt.After(jobs[j].CreatedAt) })
+	return jobs, nil
+}
+
+func (s *FSStore) ReadJob(id string) (model.Job, error) {
+	path, err := s.jobPath(id)
+	if err != nil {
+		return model.Job{}, err
+	}
+	var job model.Job
+	if err := readJSON(path, &job); err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return model.Job{}, ErrJobNotFound
+		}
+		return model.Job{}, err
+	}
+	return job, nil
+}
+
+func (s *FSStore) SaveJob(job model.Job) error {
+	path, err := s.jobPath(job.ID)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(s.jobsDir(), 0o750); err != nil {
+		return err
+	}
+	return writeJSONAtomic(path, job, 0o640)
+}
+
+func (s *FSStore) DeleteJob(id string) error {
+	path, err := s.jobPath(id)
+	if err != nil {
+		return err
+	}
+	if err := os.Remove(path); err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return ErrJobNotFound
+		}
+		return err
+	}
+	return nil
+}
+
+// Jobs run in the process that queued them, so the other backends keep
+// their records on the host's file store.
+
+func (s *SQLiteStore) ListJobs() ([]model.Job, error) {
+	return s.files.ListJobs()
+}
+
+func (s *SQLiteStore) ReadJob(id string) (model.Job, error) {
+	return s.files.ReadJob(id)
+}
+
+func (s *SQLiteStore) SaveJob(job model.Job) error {
+	return s.files.SaveJob(job)
+}
+
+func (s *SQLiteStore) DeleteJob(id string) error {
+	return s.files.DeleteJob(id)
+}
+
+func (s *EtcdStore) ListJobs() ([]model.Job, error) {
+	return s.files.ListJobs()
+}
+
+func (s *EtcdStore) ReadJob(id string) (model.Job, error) {
+	return s.files.ReadJob(id)
+}
+
+func (s *EtcdStore) SaveJob(job model.Job) error {
+	return s.files.SaveJob(job)
+}
+
+func (s *EtcdStore) DeleteJob(id string) error {
+	return s.files.DeleteJob(id)
+}
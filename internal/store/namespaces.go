@@ -0,0 +1,132 @@
+package store
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/alperreha/mergen-fire/internal/model"
+)
+
+var ErrNamespaceNotFound = errors.New("namespace not found")
+
+// namespacesDir sits next to vm.d, e.g. /etc/mergen/namespaces.d, one JSON
+// file per namespace.
+func (s *FSStore) namespacesDir() string {
+	return filepath.Join(filepath.Dir(s.configRoot), "namespaces.d")
+}
+
+func (s *FSStore) namespacePath(name string) (string, error) {
+	if strings.TrimSpace(name) == "" || strings.ContainsAny(name, `/\`) || strings.HasPrefix(name, ".") {
+		return "", errors.New("namespace name is invalid")
+	}
+	return filepath.Join(s.namespacesDir(), name+".json"), nil
+}
+
+func (s *FSStore) ListNamespaces() ([]model.Namespace, error) {
+	entries, err := os.ReadDir(s.namespacesDir())
+	if errors.Is(err, os.ErrNotExist) {
+		return []model.Namespace{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	namespaces := make([]model.Namespace, 0, len(entries))
+	for _, entry := range entries {
+		name, ok := strings.CutSuffix(entry.Name(), ".json")
+		if !ok || entry.IsDir() {
+			continue
+		}
+		namespace, err := s.ReadNamespace(name)
+		if errors.Is(err, ErrNamespaceNotFound) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		namespaces = append(namespaces, namespace)
+	}
+	sort.Slice(namespaces, func(i, j int) bool { return namespaces[i].Name < namespaces[j].Name })
+	return namespaces, nil
+}
+
+func (s *FSStore) ReadNamespace(name string) (model.Namespace, error) {
+	path, err := s.namespacePath(name)
+	if err != nil {
+		return model.Namespace{}, err
+	}
+	var namespace model.Namespace
+	if err := readJSON(path, &namespace); err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return model.Namespace{}, ErrNamespaceNotFound
+		}
+		return model.Namespace{}, err
+	}
+	namespace.Name = name
+	return namespace, nil
+}
+
+func (s *FSStore) SaveNamespace(namespace model.Namespace) error {
+	path, err := s.namespacePath(namespace.Name)
+	if err != nil {
+		return err
+	}
+	s.logger.Debug("saving namespace", "namespace", namespace.Name)
+	if err := os.MkdirAll(s.namespacesDir(), 0o750); err != nil {
+		return err
+	}
+	namespace.Usage = nil
+	return writeJSONAtomic(path, namespace, 0o640)
+}
+
+func (s *FSStore) DeleteNamespace(name string) error {
+	path, err := s.namespacePath(name)
+	if err != nil {
+		return err
+	}
+	s.logger.Debug("deleting namespace", "namespace", name)
+	if err := os.Remove(path); err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return ErrNamespaceNotFound
+		}
+		return err
+	}
+	return nil
+}
+
+// Namespaces of the other backends stay on the host's file store, as
+// templates do.
+
+func (s *SQLiteStore) ListNamespaces() ([]model.Namespace, error) {
+	return s.files.ListNamespaces()
+}
+
+func (s *SQLiteStore) ReadNamespace(name string) (model.Namespace, error) {
+	return s.files.ReadNamespace(name)
+}
+
+func (s *SQLiteStore) SaveNamespace(namespace model.Namespace) error {
+	return s.files.SaveNamespace(namespace)
+}
+
+func (s *SQLiteStore) DeleteNamespace(name string) error {
+	return s.files.DeleteNamespace(name)
+}
+
+func (s *EtcdStore) ListNamespaces() ([]model.Namespace, error) {
+	return s.files.ListNamespaces()
+}
+
+func (s *EtcdStore) ReadNamespace(name string) (model.Namespace, error) {
+	return s.files.ReadNamespace(name)
+}
+
+func (s *EtcdStore) SaveNamespace(namespace model.Namespace) error {
+	return s.files.SaveNamespace(namespace)
+}
+
+func (s *EtcdStore) DeleteNamespace(name string) error {
+	return s.files.DeleteNamespace(name)
+}
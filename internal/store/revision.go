@@ -0,0 +1,79 @@
+package store
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/alperreha/mergen-fire/internal/model"
+)
+
+var ErrRevisionConflict = errors.New("revision conflict")
+
+// UpdateMeta applies mutate to the stored metadata when its revision equals
+// expected and persists it with the revision incremented.
+func (s *FSStore) UpdateMeta(id string, expected int64, mutate func(*model.VMMetadata) error) (model.VMMetadata, error) {
+	if err := validateID(id); err != nil {
+		return model.VMMetadata{}, err
+	}
+	s.metaMu.Lock()
+	defer s.metaMu.Unlock()
+
+	meta, err := s.ReadMeta(id)
+	if err != nil {
+		return model.VMMetadata{}, err
+	}
+	if err := applyMetaUpdate(&meta, expected, mutate); err != nil {
+		return model.VMMetadata{}, err
+	}
+	meta.Paths = s.PathsFor(id)
+	if err := writeJSONAtomic(meta.Paths.MetaPath, meta, 0o640); err != nil {
+		return model.VMMetadata{}, err
+	}
+	s.logger.Debug("vm metadata updated", "vmID", id, "revision", meta.Revision)
+	return meta, nil
+}
+
+// UpdateConfig is UpdateMeta for changes that also touch the VM config:
+// vm.json is written before meta.json, whose new revision commits the
+// change.
+func (s *FSStore) UpdateConfig(id string, expected int64, mutate func(*model.VMConfig, *model.VMMetadata) error) (model.VMConfig, model.VMMetadata, error) {
+	if err := validateID(id); err != nil {
+		return model.VMConfig{}, model.VMMetadata{}, err
+	}
+	s.metaMu.Lock()
+	defer s.metaMu.Unlock()
+
+	meta, err := s.ReadMeta(id)
+	if err != nil {
+		return model.VMConfig{}, model.VMMetadata{}, err
+	}
+	cfg, err := s.ReadVMConfig(id)
+	if err != nil {
+		return model.VMConfig{}, model.VMMetadata{}, err
+	}
+	if err := applyMetaUpdate(&meta, expected, func(meta *model.VMMetadata) error { return mutate(&cfg, meta) }); err != nil {
+		return model.VMConfig{}, model.VMMetadata{}, err
+	}
+	meta.Paths = s.PathsFor(id)
+	if err := writeJSONAtomic(meta.Paths.VMConfigPath, cfg, 0o640); err != nil {
+		return model.VMConfig{}, model.VMMetadata{}, err
+	}
+	if err := writeJSONAtomic(meta.Paths.MetaPath, meta, 0o640); err != nil {
+		return model.VMConfig{}, model.VMMetadata{}, err
+	}
+	s.logger.Debug("vm config updated", "vmID", id, "revision", meta.Revision)
+	return cfg, meta, nil
+}
+
+func applyMetaUpdate(meta *model.VMMetadata, expected int64, mutate func(*model.VMMetadata) error) error {
+	if meta.Revision != expected {
+		return fmt.Errorf("%w: current revision is %d, got %d", ErrRevisionConflict, meta.Revision, expected)
+	}
+	id := meta.ID
+	if err := mutate(meta); err != nil {
+		return err
+	}
+	meta.ID = id
+	meta.Revision = expected + 1
+	return nil
+}
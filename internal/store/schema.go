@@ -0,0 +1,218 @@
+package store
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/alperreha/mergen-fire/internal/model"
+)
+
+// SchemaVersion is the layout version stamped into meta.json, vm.json and
+// hooks.json. Documents without a schemaVersion field are version 1.
+const SchemaVersion = 2
+
+var ErrSchemaTooNew = errors.New("schema version is newer than supported")
+
+type schemaMigration struct {
+	to    int
+	name  string
+	meta  func(doc map[string]any) error
+	vm    func(doc map[string]any) error
+	hooks func(doc map[string]any) error
+}
+
+// schemaMigrations must stay ordered by target version. Each step receives
+// the raw JSON document so fields that no longer exist in the model types can
+// still be read and rewritten.
+var schemaMigrations = []schemaMigration{
+	{to: 2, name: "default revision and httpPort", meta: migrateMetaV2},
+}
+
+type SchemaMigrationResult struct {
+	Migrated   []string `json:"migrated"`
+	BackupPath string   `json:"backupPath,omitempty"`
+}
+
+type schemaDoc struct {
+	path    string
+	version int
+	content map[string]any
+	migrate func(schemaMigration) func(map[string]any) error
+}
+
+// MigrateSchema upgrades every per-VM document older than SchemaVersion.
+// When anything needs rewriting, a full backup is written to backupDir first.
+// Documents newer than SchemaVersion abort the migration with ErrSchemaTooNew
+// so an older daemon never rewrites them.
+func (s *FSStore) MigrateSchema(backupDir string) (SchemaMigrationResult, error) {
+	ids, err := s.ListVMIDs()
+	if err != nil {
+		return SchemaMigrationResult{}, err
+	}
+
+	pending := map[string][]schemaDoc{}
+	order := make([]string, 0, len(ids))
+	for _, id := range ids {
+		docs, err := s.outdatedDocs(id)
+		if err != nil {
+			return SchemaMigrationResult{}, fmt.Errorf("vm %s: %w", id, err)
+		}
+		if len(docs) > 0 {
+			pending[id] = docs
+			order = append(order, id)
+		}
+	}
+	if len(order) == 0 {
+		s.logger.Debug("store schema up to date", "schemaVersion", SchemaVersion, "vms", len(ids))
+		return SchemaMigrationResult{}, nil
+	}
+
+	var result SchemaMigrationResult
+	backupPath, err := s.writeMigrationBackup(backupDir)
+	if err != nil {
+		return result, fmt.Errorf("backup before schema migration: %w", err)
+	}
+	result.BackupPath = backupPath
+	s.logger.Info("store schema migration starting", "vms", len(order), "schemaVersion", SchemaVersion, "backup", backupPath)
+
+	s.metaMu.Lock()
+	defer s.metaMu.Unlock()
+	for _, id := range order {
+		for _, doc := range pending[id] {
+			for _, step := range schemaMigrations {
+				if step.to <= doc.version {
+					continue
+				}
+				if fn := doc.migrate(step); fn != nil {
+					if err := fn(doc.content); err != nil {
+						return result, fmt.Errorf("vm %s: migrate %s to v%d (%s): %w", id, filepath.Base(doc.path), step.to, step.name, err)
+					}
+				}
+			}
+			doc.content["schemaVersion"] = SchemaVersion
+			if err := writeJSONAtomic(doc.path, doc.content, 0o640); err != nil {
+				return result, err
+			}
+		}
+		result.Migrated = append(result.Migrated, id)
+		s.logger.Debug("vm schema migrated", "vmID", id, "documents", len(pending[id]))
+	}
+	s.logger.Info("store schema migration finished", "vms", len(result.Migrated))
+	return result, nil
+}
+
+func (s *FSStore) outdatedDocs(id string) ([]schemaDoc, error) {
+	paths := s.PathsFor(id)
+	candidates := []struct {
+		path    string
+		migrate func(schemaMigration) func(map[string]any) error
+	}{
+		{paths.MetaPath, func(m schemaMigration) func(map[string]any) error { return m.meta }},
+		{paths.VMConfigPath, func(m schemaMigration) func(map[string]any) error { return m.vm }},
+		{paths.HooksPath, func(m schemaMigration) func(map[string]any) error { return m.hooks }},
+	}
+
+	docs := make([]schemaDoc, 0, len(candidates))
+	for _, candidate := range candidates {
+		var content map[string]any
+		if err := readJSON(candidate.path, &content); err != nil {
+			if errors.Is(err, os.ErrNotExist) {
+				continue
+			}
+			return nil, fmt.Errorf("read %s: %w", filepath.Base(candidate.path), err)
+		}
+		if content == nil {
+			continue
+		}
+		version := documentVersion(content)
+		if version > SchemaVersion {
+			return nil, fmt.Errorf("%w: %s has version %d, supported %d", ErrSchemaTooNew, filepath.Base(candidate.path), version, SchemaVersion)
+		}
+		if version == SchemaVersion {
+			continue
+		}
+		docs = append(docs, schemaDoc{path: candidate.path, version: version, content: content, migrate: candidate.migrate})
+	}
+	return docs, nil
+}
+
+func (s *FSStore) writeMigrationBackup(backupDir string) (string, error) {
+	if backupDir == "" {
+		backupDir = filepath.Join(s.dataRoot, "backups")
+	}
+	if err := os.MkdirAll(backupDir, 0o750); err != nil {
+		return "", err
+	}
+	name := fmt.Sprintf("pre-schema-v%d-%s.tar.gz", SchemaVersion, time.Now().UTC().Format("20060102T150405Z"))
+	backupPath := filepath.Join(backupDir, name)
+
+	file, err := os.OpenFile(backupPath, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0o600)
+	if err != nil {
+		return "", err
+	}
+	if err := s.Backup(file, true); err != nil {
+		_ = file.Close()
+		_ = os.Remove(backupPath)
+		return "", err
+	}
+	if err := file.Close(); err != nil {
+		_ = os.Remove(backupPath)
+		return "", err
+	}
+	return backupPath, nil
+}
+
+func documentVersion(doc map[string]any) int {
+	switch v := doc["schemaVersion"].(type) {
+	case float64:
+		return int(v)
+	case json.Number:
+		n, _ := v.Int64()
+		return int(n)
+	default:
+		return 1
+	}
+}
+
+// migrateMetaV2 gives pre-revision documents revision 1 and fills httpPort
+// for VMs created before it existed: guest port 80, then 8080, then the only
+// tcp binding. Without it the forwarder cannot route to those VMs.
+func migrateMetaV2(doc map[string]any) error {
+	if rev, _ := doc["revision"].(float64); rev < 1 {
+		doc["revision"] = 1
+	}
+	if port, _ := doc["httpPort"].(float64); port > 0 {
+		return nil
+	}
+
+	raw, err := json.Marshal(doc["ports"])
+	if err != nil {
+		return err
+	}
+	var ports []model.PortBinding
+	if err := json.Unmarshal(raw, &ports); err != nil {
+		return fmt.Errorf("decode ports: %w", err)
+	}
+	tcp := make([]int, 0, len(ports))
+	for _, binding := range ports {
+		if binding.Protocol == "" || binding.Protocol == "tcp" {
+			tcp = append(tcp, binding.Guest)
+		}
+	}
+	for _, preferred := range []int{80, 8080} {
+		for _, guest := range tcp {
+			if guest == preferred {
+				doc["httpPort"] = guest
+				return nil
+			}
+		}
+	}
+	if len(tcp) == 1 {
+		doc["httpPort"] = tcp[0]
+	}
+	return nil
+}
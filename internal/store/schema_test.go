@@ -0,0 +1,77 @@
+package store
+
+import (
+	"errors"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestMigrateSchemaUpgradesLegacyMeta(t *testing.T) {
+	s := newTestFSStore(t)
+	paths := s.PathsFor("legacy-vm")
+	if err := os.MkdirAll(paths.ConfigDir, 0o750); err != nil {
+		t.Fatalf("mkdir: %v", err)
+	}
+	legacyMeta := `{"id":"legacy-vm","createdAt":"2024-01-01T00:00:00Z","ports":[{"guest":22,"host":20000,"protocol":"tcp"},{"guest":8080,"host":20001,"protocol":"tcp"}]}`
+	if err := os.WriteFile(paths.MetaPath, []byte(legacyMeta), 0o640); err != nil {
+		t.Fatalf("write meta: %v", err)
+	}
+	if err := os.WriteFile(paths.VMConfigPath, []byte(`{"boot-source":{"kernel_image_path":"/tmp/vmlinux"},"logger":{"level":"Info"}}`), 0o640); err != nil {
+		t.Fatalf("write vm.json: %v", err)
+	}
+
+	result, err := s.MigrateSchema("")
+	if err != nil {
+		t.Fatalf("migrate: %v", err)
+	}
+	if len(result.Migrated) != 1 || result.BackupPath == "" {
+		t.Fatalf("unexpected result: %+v", result)
+	}
+	if _, err := os.Stat(result.BackupPath); err != nil {
+		t.Fatalf("backup missing: %v", err)
+	}
+
+	meta, err := s.ReadMeta("legacy-vm")
+	if err != nil {
+		t.Fatalf("read meta: %v", err)
+	}
+	if meta.SchemaVersion != SchemaVersion || meta.Revision != 1 || meta.HTTPPort != 8080 {
+		t.Fatalf("unexpected migrated meta: schema=%d revision=%d httpPort=%d", meta.SchemaVersion, meta.Revision, meta.HTTPPort)
+	}
+	raw, err := os.ReadFile(paths.VMConfigPath)
+	if err != nil {
+		t.Fatalf("read vm.json: %v", err)
+	}
+	if !containsAll(string(raw), `"schemaVersion": 2`, `"logger"`) {
+		t.Fatalf("expected vm.json stamped with unknown fields kept, got %s", raw)
+	}
+
+	again, err := s.MigrateSchema("")
+	if err != nil || len(again.Migrated) != 0 || again.BackupPath != "" {
+		t.Fatalf("expected second run to be a no-op, got %+v err=%v", again, err)
+	}
+}
+
+func TestMigrateSchemaRejectsNewerDocuments(t *testing.T) {
+	s := newTestFSStore(t)
+	paths := s.PathsFor("future-vm")
+	if err := os.MkdirAll(paths.ConfigDir, 0o750); err != nil {
+		t.Fatalf("mkdir: %v", err)
+	}
+	if err := os.WriteFile(paths.MetaPath, []byte(`{"schemaVersion":99,"id":"future-vm"}`), 0o640); err != nil {
+		t.Fatalf("write meta: %v", err)
+	}
+	if _, err := s.MigrateSchema(""); !errors.Is(err, ErrSchemaTooNew) {
+		t.Fatalf("expected ErrSchemaTooNew, got %v", err)
+	}
+}
+
+func containsAll(s string, parts ...string) bool {
+	for _, part := range parts {
+		if !strings.Contains(s, part) {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,706 @@
+package store
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"strings"
+	"time"
+
+	"github.com/alperreha/mergen-fire/internal/model"
+)
+
+const sqliteDriverName = "sqlite3"
+
+var sqliteSchema = []string{
+	`CREATE TABLE IF NOT EXISTS vms (
+		id         TEXT PRIMARY KEY,
+		name       TEXT NOT NULL DEFAULT '',
+		created_at TEXT NOT NULL,
+		meta       TEXT NOT NULL,
+		vm_config  TEXT NOT NULL,
+		hooks      TEXT NOT NULL DEFAULT '{}'
+	)`,
+	`CREATE INDEX IF NOT EXISTS idx_vms_name ON vms(name)`,
+	`CREATE TABLE IF NOT EXISTS vm_tags (
+		vm_id TEXT NOT NULL REFERENCES vms(id) ON DELETE CASCADE,
+		key   TEXT NOT NULL,
+		value TEXT NOT NULL,
+		PRIMARY KEY (vm_id, key)
+	)`,
+	`CREATE INDEX IF NOT EXISTS idx_vm_tags_kv ON vm_tags(key, value)`,
+	`CREATE TABLE IF NOT EXISTS hook_history (
+		seq    INTEGER PRIMARY KEY AUTOINCREMENT,
+		vm_id  TEXT NOT NULL,
+		record TEXT NOT NULL
+	)`,
+	`CREATE INDEX IF NOT EXISTS idx_hook_history_vm ON hook_history(vm_id, seq)`,
+	`CREATE TABLE IF NOT EXISTS state_history (
+		seq    INTEGER PRIMARY KEY AUTOINCREMENT,
+		vm_id  TEXT NOT NULL,
+		record TEXT NOT NULL
+	)`,
+	`CREATE INDEX IF NOT EXISTS idx_state_history_vm ON state_history(vm_id, seq)`,
+	`CREATE TABLE IF NOT EXISTS vm_changes (
+		seq   INTEGER PRIMARY KEY AUTOINCREMENT,
+		vm_id TEXT NOT NULL,
+		op    TEXT NOT NULL
+	)`,
+	`CREATE TRIGGER IF NOT EXISTS vms_changes_insert AFTER INSERT ON vms
+		BEGIN INSERT INTO vm_changes (vm_id, op) VALUES (NEW.id, 'created'); END`,
+	`CREATE TRIGGER IF NOT EXISTS vms_changes_update AFTER UPDATE ON vms
+		BEGIN INSERT INTO vm_changes (vm_id, op) VALUES (NEW.id, 'updated'); END`,
+	`CREATE TRIGGER IF NOT EXISTS vms_changes_delete AFTER DELETE ON vms
+		BEGIN INSERT INTO vm_changes (vm_id, op) VALUES (OLD.id, 'deleted'); END`,
+}
+
+// SQLiteStore keeps metadata, hooks and history in one database file. The
+// per-VM files the systemd unit and hook scripts read (vm.json, env, ...) are
+// still materialized through the wrapped FSStore.
+type SQLiteStore struct {
+	db     *sql.DB
+	files  *FSStore
+	logger *slog.Logger
+}
+
+func NewSQLiteStore(dbPath string, files *FSStore) (*SQLiteStore, error) {
+	if strings.TrimSpace(dbPath) == "" {
+		return nil, errors.New("sqlite path is empty")
+	}
+
+	db, err := sql.Open(sqliteDriverName, dbPath)
+	if err != nil {
+		return nil, fmt.Errorf("open sqlite store: %w", err)
+	}
+	db.SetMaxOpenConns(1)
+
+	pragmas := []string{"PRAGMA journal_mode=WAL", "PRAGMA busy_timeout=5000", "PRAGMA foreign_keys=ON"}
+	for _, stmt := range append(pragmas, sqliteSchema...) {
+		if _, err := db.Exec(stmt); err != nil {
+			_ = db.Close()
+			return nil, fmt.Errorf("init sqlite store: %w", err)
+		}
+	}
+
+	return &SQLiteStore{db: db, files: files, logger: slog.Default()}, nil
+}
+
+func (s *SQLiteStore) WithLogger(logger *slog.Logger) *SQLiteStore {
+	if logger != nil {
+		s.logger = logger
+	}
+	return s
+}
+
+func (s *SQLiteStore) Close() error {
+	return s.db.Close()
+}
+
+func (s *SQLiteStore) EnsureBaseDirs() error {
+	return s.files.EnsureBaseDirs()
+}
+
+func (s *SQLiteStore) SaveVM(id string, cfg model.VMConfig, meta model.VMMetadata, hooks model.HooksConfig, env map[string]string) (model.VMPaths, error) {
+	if err := validateID(id); err != nil {
+		return model.VMPaths{}, err
+	}
+	s.logger.Debug("saving vm to sqlite", "vmID", id, "ports", len(meta.Ports), "hasHooks", hasHooks(hooks))
+
+	meta.Paths = s.files.PathsFor(id)
+	if meta.Revision == 0 {
+		meta.Revision = 1
+	}
+	meta.SchemaVersion = SchemaVersion
+	cfg.SchemaVersion = SchemaVersion
+	hooks.SchemaVersion = SchemaVersion
+
+	tx, err := s.db.Begin()
+	if err != nil {
+		return model.VMPaths{}, err
+	}
+	defer func() { _ = tx.Rollback() }()
+
+	if err := upsertVM(tx, id, cfg, meta, hooks); err != nil {
+		return model.VMPaths{}, err
+	}
+
+	paths, err := s.files.SaveVM(id, cfg, meta, hooks, env)
+	if err != nil {
+		return model.VMPaths{}, err
+	}
+	if err := tx.Commit(); err != nil {
+		return model.VMPaths{}, err
+	}
+	return paths, nil
+}
+
+func upsertVM(tx *sql.Tx, id string, cfg model.VMConfig, meta model.VMMetadata, hooks model.HooksConfig) error {
+	metaJSON, err := json.Marshal(meta)
+	if err != nil {
+		return err
+	}
+	cfgJSON, err := json.Marshal(cfg)
+	if err != nil {
+		return err
+	}
+	hooksJSON, err := json.Marshal(hooks)
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.Exec(
+		`INSERT INTO vms (id, name, created_at, meta, vm_config, hooks) VALUES (?, ?, ?, ?, ?, ?)
+		 ON CONFLICT(id) DO UPDATE SET name = excluded.name, meta = excluded.meta, vm_config = excluded.vm_config, hooks = excluded.hooks`,
+		id, vmName(meta), meta.CreatedAt.UTC().Format(time.RFC3339Nano), string(metaJSON), string(cfgJSON), string(hooksJSON),
+	)
+	if err != nil {
+		return fmt.Errorf("upsert vm: %w", err)
+	}
+
+	if _, err := tx.Exec(`DELETE FROM vm_tags WHERE vm_id = ?`, id); err != nil {
+		return fmt.Errorf("reset vm tags: %w", err)
+	}
+	for key, value := range meta.Tags {
+		if _, err := tx.Exec(`INSERT INTO vm_tags (vm_id, key, value) VALUES (?, ?, ?)`, id, key, value); err != nil {
+			return fmt.Errorf("insert vm tag: %w", err)
+		}
+	}
+	return nil
+}
+
+func vmName(meta model.VMMetadata) string {
+	if name, ok := meta.Metadata["name"].(string); ok && name != "" {
+		return name
+	}
+	return meta.Tags["name"]
+}
+
+func (s *SQLiteStore) Exists(id string) (bool, error) {
+	if err := validateID(id); err != nil {
+		return false, err
+	}
+	var one int
+	err := s.db.QueryRow(`SELECT 1 FROM vms WHERE id = ?`, id).Scan(&one)
+	if errors.Is(err, sql.ErrNoRows) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+func (s *SQLiteStore) ReadMeta(id string) (model.VMMetadata, error) {
+	if err := validateID(id); err != nil {
+		return model.VMMetadata{}, err
+	}
+	var meta model.VMMetadata
+	if err := s.readColumn(id, "meta", &meta); err != nil {
+		return model.VMMetadata{}, err
+	}
+	meta.Paths = s.files.PathsFor(id)
+	return meta, nil
+}
+
+func (s *SQLiteStore) UpdateMeta(id string, expected int64, mutate func(*model.VMMetadata) error) (model.VMMetadata, error) {
+	if err := validateID(id); err != nil {
+		return model.VMMetadata{}, err
+	}
+
+	tx, err := s.db.Begin()
+	if err != nil {
+		return model.VMMetadata{}, err
+	}
+	defer func() { _ = tx.Rollback() }()
+
+	var raw, cfgRaw, hooksRaw string
+	err = tx.QueryRow(`SELECT meta, vm_config, hooks FROM vms WHERE id = ?`, id).Scan(&raw, &cfgRaw, &hooksRaw)
+	if errors.Is(err, sql.ErrNoRows) {
+		return model.VMMetadata{}, ErrNotFound
+	}
+	if err != nil {
+		return model.VMMetadata{}, err
+	}
+	var (
+		meta  model.VMMetadata
+		cfg   model.VMConfig
+		hooks model.HooksConfig
+	)
+	if err := json.Unmarshal([]byte(raw), &meta); err != nil {
+		return model.VMMetadata{}, err
+	}
+	if err := json.Unmarshal([]byte(cfgRaw), &cfg); err != nil {
+		return model.VMMetadata{}, err
+	}
+	if err := json.Unmarshal([]byte(hooksRaw), &hooks); err != nil {
+		return model.VMMetadata{}, err
+	}
+
+	// Read, check and write share one transaction on the single connection,
+	// so concurrent writers cannot interleave between check and write.
+	if err := applyMetaUpdate(&meta, expected, mutate); err != nil {
+		return model.VMMetadata{}, err
+	}
+	meta.Paths = s.files.PathsFor(id)
+	if err := upsertVM(tx, id, cfg, meta, hooks); err != nil {
+		return model.VMMetadata{}, err
+	}
+	if err := writeJSONAtomic(meta.Paths.MetaPath, meta, 0o640); err != nil {
+		return model.VMMetadata{}, err
+	}
+	if err := tx.Commit(); err != nil {
+		return model.VMMetadata{}, err
+	}
+	return meta, nil
+}
+
+func (s *SQLiteStore) UpdateConfig(id string, expected int64, mutate func(*model.VMConfig, *model.VMMetadata) error) (model.VMConfig, model.VMMetadata, error) {
+	if err := validateID(id); err != nil {
+		return model.VMConfig{}, model.VMMetadata{}, err
+	}
+
+	tx, err := s.db.Begin()
+	if err != nil {
+		return model.VMConfig{}, model.VMMetadata{}, err
+	}
+	defer func() { _ = tx.Rollback() }()
+
+	var raw, cfgRaw, hooksRaw string
+	err = tx.QueryRow(`SELECT meta, vm_config, hooks FROM vms WHERE id = ?`, id).Scan(&raw, &cfgRaw, &hooksRaw)
+	if errors.Is(err, sql.ErrNoRows) {
+		return model.VMConfig{}, model.VMMetadata{}, ErrNotFound
+	}
+	if err != nil {
+		return model.VMConfig{}, model.VMMetadata{}, err
+	}
+	var (
+		meta  model.VMMetadata
+		cfg   model.VMConfig
+		hooks model.HooksConfig
+	)
+	if err := json.Unmarshal([]byte(raw), &meta); err != nil {
+		return model.VMConfig{}, model.VMMetadata{}, err
+	}
+	if err := json.Unmarshal([]byte(cfgRaw), &cfg); err != nil {
+		return model.VMConfig{}, model.VMMetadata{}, err
+	}
+	if err := json.Unmarshal([]byte(hooksRaw), &hooks); err != nil {
+		return model.VMConfig{}, model.VMMetadata{}, err
+	}
+
+	if err := applyMetaUpdate(&meta, expected, func(meta *model.VMMetadata) error { return mutate(&cfg, meta) }); err != nil {
+		return model.VMConfig{}, model.VMMetadata{}, err
+	}
+	meta.Paths = s.files.PathsFor(id)
+	if err := upsertVM(tx, id, cfg, meta, hooks); err != nil {
+		return model.VMConfig{}, model.VMMetadata{}, err
+	}
+	if err := writeJSONAtomic(meta.Paths.VMConfigPath, cfg, 0o640); err != nil {
+		return model.VMConfig{}, model.VMMetadata{}, err
+	}
+	if err := writeJSONAtomic(meta.Paths.MetaPath, meta, 0o640); err != nil {
+		return model.VMConfig{}, model.VMMetadata{}, err
+	}
+	if err := tx.Commit(); err != nil {
+		return model.VMConfig{}, model.VMMetadata{}, err
+	}
+	return cfg, meta, nil
+}
+
+func (s *SQLiteStore) ReadVMConfig(id string) (model.VMConfig, error) {
+	if err := validateID(id); err != nil {
+		return model.VMConfig{}, err
+	}
+	var cfg model.VMConfig
+	if err := s.readColumn(id, "vm_config", &cfg); err != nil {
+		return model.VMConfig{}, err
+	}
+	return cfg, nil
+}
+
+func (s *SQLiteStore) ReadHooks(id string) (model.HooksConfig, error) {
+	if err := validateID(id); err != nil {
+		return model.HooksConfig{}, err
+	}
+	var hooks model.HooksConfig
+	if err := s.readColumn(id, "hooks", &hooks); err != nil {
+		if errors.Is(err, ErrNotFound) {
+			return model.HooksConfig{}, nil
+		}
+		return model.HooksConfig{}, err
+	}
+	return hooks, nil
+}
+
+// column is always one of the fixed names above, never user input.
+func (s *SQLiteStore) readColumn(id, column string, out any) error {
+	var raw string
+	err := s.db.QueryRow(`SELECT `+column+` FROM vms WHERE id = ?`, id).Scan(&raw)
+	if errors.Is(err, sql.ErrNoRows) {
+		return ErrNotFound
+	}
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal([]byte(raw), out)
+}
+
+func (s *SQLiteStore) ReadGlobalHooks() (model.HooksConfig, error) {
+	return s.files.ReadGlobalHooks()
+}
+
+func (s *SQLiteStore) ReadEnv(id string) (map[string]string, error) {
+	return s.files.ReadEnv(id)
+}
+
+func (s *SQLiteStore) RenderRuntimeEnv(id string) error {
+	return s.files.RenderRuntimeEnv(id)
+}
+
+func (s *SQLiteStore) RemoveRuntimeEnv(id string) error {
+	return s.files.RemoveRuntimeEnv(id)
+}
+
+func (s *SQLiteStore) ListVMIDs() ([]string, error) {
+	rows, err := s.db.Query(`SELECT id FROM vms ORDER BY id`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var ids []string
+	for rows.Next() {
+		var id string
+		if err := rows.Scan(&id); err != nil {
+			return nil, err
+		}
+		ids = append(ids, id)
+	}
+	return ids, rows.Err()
+}
+
+func (s *SQLiteStore) ListMetas() ([]model.VMMetadata, error) {
+	return s.queryMetas(`SELECT id, meta FROM vms ORDER BY id`)
+}
+
+func (s *SQLiteStore) ListMetasByTag(key, value string) ([]model.VMMetadata, error) {
+	return s.queryMetas(
+		`SELECT v.id, v.meta FROM vms v JOIN vm_tags t ON t.vm_id = v.id WHERE t.key = ? AND t.value = ? ORDER BY v.id`,
+		key, value,
+	)
+}
+
+// ListMetasMatching narrows by tag in the query, through the tag index,
+// and by metadata afterwards.
+func (s *SQLiteStore) ListMetasMatching(filter model.VMFilter) ([]model.VMMetadata, error) {
+	query := `SELECT v.id, v.meta FROM vms v`
+	var (
+		where []string
+		args  []any
+	)
+	for key, value := range filter.Tags {
+		where = append(where, `EXISTS (SELECT 1 FROM vm_tags t WHERE t.vm_id = v.id AND t.key = ? AND t.value = ?)`)
+		args = append(args, key, value)
+	}
+	if len(where) > 0 {
+		query += ` WHERE ` + strings.Join(where, ` AND `)
+	}
+	metas, err := s.queryMetas(query+` ORDER BY v.id`, args...)
+	if err != nil {
+		return nil, err
+	}
+	return filterMetas(metas, filter), nil
+}
+
+func (s *SQLiteStore) ListMetasByName(name string) ([]model.VMMetadata, error) {
+	return s.queryMetas(`SELECT id, meta FROM vms WHERE name = ? ORDER BY id`, name)
+}
+
+func (s *SQLiteStore) queryMetas(query string, args ...any) ([]model.VMMetadata, error) {
+	rows, err := s.db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	metas := []model.VMMetadata{}
+	for rows.Next() {
+		var (
+			id  string
+			raw string
+		)
+		if err := rows.Scan(&id, &raw); err != nil {
+			return nil, err
+		}
+		var meta model.VMMetadata
+		if err := json.Unmarshal([]byte(raw), &meta); err != nil {
+			return nil, fmt.Errorf("decode meta %s: %w", id, err)
+		}
+		meta.Paths = s.files.PathsFor(id)
+		metas = append(metas, meta)
+	}
+	return metas, rows.Err()
+}
+
+func (s *SQLiteStore) DeleteVM(id string, retainData bool) error {
+	if err := validateID(id); err != nil {
+		return err
+	}
+	s.logger.Debug("deleting vm from sqlite", "vmID", id, "retainData", retainData)
+
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer func() { _ = tx.Rollback() }()
+
+	result, err := tx.Exec(`DELETE FROM vms WHERE id = ?`, id)
+	if err != nil {
+		return err
+	}
+	if affected, _ := result.RowsAffected(); affected == 0 {
+		return ErrNotFound
+	}
+	if _, err := tx.Exec(`DELETE FROM vm_tags WHERE vm_id = ?`, id); err != nil {
+		return err
+	}
+	if !retainData {
+		if _, err := tx.Exec(`DELETE FROM hook_history WHERE vm_id = ?`, id); err != nil {
+			return err
+		}
+		if _, err := tx.Exec(`DELETE FROM state_history WHERE vm_id = ?`, id); err != nil {
+			return err
+		}
+	}
+
+	if err := s.files.DeleteVM(id, retainData); err != nil && !errors.Is(err, ErrNotFound) {
+		return err
+	}
+	return tx.Commit()
+}
+
+func (s *SQLiteStore) ReleaseVM(id string) error {
+	return s.DeleteVM(id, false)
+}
+
+func (s *SQLiteStore) PathsFor(id string) model.VMPaths {
+	return s.files.PathsFor(id)
+}
+
+func (s *SQLiteStore) AppendHookExecution(id string, record model.HookExecution) error {
+	if err := validateID(id); err != nil {
+		return err
+	}
+	encoded, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer func() { _ = tx.Rollback() }()
+
+	// A deleted VM's onDelete hooks are not recorded, so a VM created
+	// later with its ID starts with an empty history.
+	result, err := tx.Exec(`INSERT INTO hook_history (vm_id, record) SELECT ?, ? WHERE EXISTS (SELECT 1 FROM vms WHERE id = ?)`, id, string(encoded), id)
+	if err != nil {
+		return err
+	}
+	if affected, _ := result.RowsAffected(); affected == 0 {
+		return nil
+	}
+	if _, err := tx.Exec(
+		`DELETE FROM hook_history WHERE vm_id = ? AND seq NOT IN (SELECT seq FROM hook_history WHERE vm_id = ? ORDER BY seq DESC LIMIT ?)`,
+		id, id, maxHookHistoryEntries,
+	); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func (s *SQLiteStore) ReadHookHistory(id string) ([]model.HookExecution, error) {
+	if err := validateID(id); err != nil {
+		return nil, err
+	}
+	rows, err := s.db.Query(`SELECT record FROM hook_history WHERE vm_id = ? ORDER BY seq`, id)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	history := []model.HookExecution{}
+	for rows.Next() {
+		var raw string
+		if err := rows.Scan(&raw); err != nil {
+			return nil, err
+		}
+		var record model.HookExecution
+		if err := json.Unmarshal([]byte(raw), &record); err != nil {
+			return nil, err
+		}
+		history = append(history, record)
+	}
+	return history, rows.Err()
+}
+
+func (s *SQLiteStore) AppendStateTransition(id string, transition model.StateTransition) error {
+	if err := validateID(id); err != nil {
+		return err
+	}
+	encoded, err := json.Marshal(transition)
+	if err != nil {
+		return err
+	}
+
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer func() { _ = tx.Rollback() }()
+
+	if _, err := tx.Exec(`INSERT INTO state_history (vm_id, record) VALUES (?, ?)`, id, string(encoded)); err != nil {
+		return err
+	}
+	if _, err := tx.Exec(
+		`DELETE FROM state_history WHERE vm_id = ? AND seq NOT IN (SELECT seq FROM state_history WHERE vm_id = ? ORDER BY seq DESC LIMIT ?)`,
+		id, id, maxStateHistoryEntries,
+	); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func (s *SQLiteStore) ReadStateHistory(id string) ([]model.StateTransition, error) {
+	if err := validateID(id); err != nil {
+		return nil, err
+	}
+	rows, err := s.db.Query(`SELECT record FROM state_history WHERE vm_id = ? ORDER BY seq`, id)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	history := []model.StateTransition{}
+	for rows.Next() {
+		var raw string
+		if err := rows.Scan(&raw); err != nil {
+			return nil, err
+		}
+		var transition model.StateTransition
+		if err := json.Unmarshal([]byte(raw), &transition); err != nil {
+			return nil, err
+		}
+		history = append(history, transition)
+	}
+	return history, rows.Err()
+}
+
+// Fsck only reports on the materialized files: the database holds the
+// authoritative copy, so nothing is quarantined.
+func (s *SQLiteStore) Fsck(bool) (model.FsckReport, error) {
+	return s.files.Fsck(true)
+}
+
+// MigrateSchema migrates the materialized files and refreshes the rows of
+// every migrated VM from them. Hook history stays in the database.
+func (s *SQLiteStore) MigrateSchema(backupDir string) (SchemaMigrationResult, error) {
+	result, err := s.files.MigrateSchema(backupDir)
+	if err != nil || len(result.Migrated) == 0 {
+		return result, err
+	}
+
+	tx, err := s.db.Begin()
+	if err != nil {
+		return result, err
+	}
+	defer func() { _ = tx.Rollback() }()
+	for _, id := range result.Migrated {
+		meta, err := s.files.ReadMeta(id)
+		if err != nil {
+			return result, err
+		}
+		cfg, err := s.files.ReadVMConfig(id)
+		if err != nil {
+			return result, err
+		}
+		hooks, err := s.files.ReadHooks(id)
+		if err != nil {
+			return result, err
+		}
+		if err := upsertVM(tx, id, cfg, meta, hooks); err != nil {
+			return result, fmt.Errorf("refresh %s: %w", id, err)
+		}
+	}
+	return result, tx.Commit()
+}
+
+// ImportFS copies every VM of an FS layout into the database. Files stay in
+// place since the SQLite store keeps materializing them. Returns the number of
+// imported VMs.
+func (s *SQLiteStore) ImportFS(src *FSStore) (int, error) {
+	metas, err := src.ListMetas()
+	if err != nil {
+		return 0, err
+	}
+
+	tx, err := s.db.Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer func() { _ = tx.Rollback() }()
+
+	for _, meta := range metas {
+		cfg, err := src.ReadVMConfig(meta.ID)
+		if err != nil {
+			return 0, fmt.Errorf("read vm config %s: %w", meta.ID, err)
+		}
+		hooks, err := src.ReadHooks(meta.ID)
+		if err != nil {
+			return 0, fmt.Errorf("read hooks %s: %w", meta.ID, err)
+		}
+		if err := upsertVM(tx, meta.ID, cfg, meta, hooks); err != nil {
+			return 0, fmt.Errorf("import %s: %w", meta.ID, err)
+		}
+
+		history, err := src.ReadHookHistory(meta.ID)
+		if err != nil {
+			return 0, fmt.Errorf("read hook history %s: %w", meta.ID, err)
+		}
+		if _, err := tx.Exec(`DELETE FROM hook_history WHERE vm_id = ?`, meta.ID); err != nil {
+			return 0, err
+		}
+		for _, record := range history {
+			encoded, err := json.Marshal(record)
+			if err != nil {
+				return 0, err
+			}
+			if _, err := tx.Exec(`INSERT INTO hook_history (vm_id, record) VALUES (?, ?)`, meta.ID, string(encoded)); err != nil {
+				return 0, err
+			}
+		}
+
+		transitions, err := src.ReadStateHistory(meta.ID)
+		if err != nil {
+			return 0, fmt.Errorf("read state history %s: %w", meta.ID, err)
+		}
+		if _, err := tx.Exec(`DELETE FROM state_history WHERE vm_id = ?`, meta.ID); err != nil {
+			return 0, err
+		}
+		for _, transition := range transitions {
+			encoded, err := json.Marshal(transition)
+			if err != nil {
+				return 0, err
+			}
+			if _, err := tx.Exec(`INSERT INTO state_history (vm_id, record) VALUES (?, ?)`, meta.ID, string(encoded)); err != nil {
+				return 0, err
+			}
+		}
+		s.logger.Debug("vm imported into sqlite", "vmID", meta.ID, "hookHistory", len(history), "stateHistory", len(transitions))
+	}
+
+	if err := tx.Commit(); err != nil {
+		return 0, err
+	}
+	return len(metas), nil
+}
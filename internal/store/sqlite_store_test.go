@@ -0,0 +1,77 @@
+package store
+
+import (
+	"errors"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/alperreha/mergen-fire/internal/model"
+)
+
+func TestSQLiteStoreRoundTripAndTagIndex(t *testing.T) {
+	base := t.TempDir()
+	files := NewFSStore(
+		filepath.Join(base, "etc", "mergen", "vm.d"),
+		filepath.Join(base, "var", "lib", "mergen"),
+		filepath.Join(base, "run", "mergen"),
+		filepath.Join(base, "etc", "mergen", "hooks.d"),
+	)
+	s, err := NewSQLiteStore(filepath.Join(base, "mergen.db"), files)
+	if err != nil {
+		t.Fatalf("open sqlite store: %v", err)
+	}
+	defer s.Close()
+
+	id := "vm-1"
+	meta := model.VMMetadata{
+		ID:        id,
+		CreatedAt: time.Now().UTC(),
+		Tags:      map[string]string{"env": "prod"},
+		Metadata:  map[string]any{"image": map[string]any{"name": "nginx", "layers": float64(3)}},
+	}
+	if _, err := s.SaveVM(id, model.VMConfig{}, meta, model.HooksConfig{}, map[string]string{"MGN_VM_ID": id}); err != nil {
+		t.Fatalf("save vm: %v", err)
+	}
+
+	got, err := s.ReadMeta(id)
+	if err != nil {
+		t.Fatalf("read meta: %v", err)
+	}
+	if got.Paths.VMConfigPath != files.PathsFor(id).VMConfigPath {
+		t.Fatalf("unexpected paths: %+v", got.Paths)
+	}
+
+	byTag, err := s.ListMetasByTag("env", "prod")
+	if err != nil || len(byTag) != 1 {
+		t.Fatalf("expected one vm by tag, got %d (%v)", len(byTag), err)
+	}
+
+	for _, tc := range []struct {
+		filter model.VMFilter
+		want   int
+	}{
+		{model.VMFilter{Tags: map[string]string{"env": "prod"}, Metadata: map[string]string{"image.name": "nginx", "image.layers": "3"}}, 1},
+		{model.VMFilter{Tags: map[string]string{"env": "dev"}}, 0},
+		{model.VMFilter{Metadata: map[string]string{"image.name": "redis"}}, 0},
+		{model.VMFilter{Metadata: map[string]string{"image": "nginx"}}, 0},
+	} {
+		matched, err := s.ListMetasMatching(tc.filter)
+		if err != nil || len(matched) != tc.want {
+			t.Fatalf("filter %+v: expected %d vms, got %d (%v)", tc.filter, tc.want, len(matched), err)
+		}
+	}
+
+	if err := s.DeleteVM(id, false); err != nil {
+		t.Fatalf("delete vm: %v", err)
+	}
+	if _, err := s.ReadMeta(id); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("expected not found after delete, got %v", err)
+	}
+	if err := s.AppendHookExecution(id, model.HookExecution{Event: model.HookOnDelete, Status: "succeeded"}); err != nil {
+		t.Fatalf("append hook execution: %v", err)
+	}
+	if history, err := s.ReadHookHistory(id); err != nil || len(history) != 0 {
+		t.Fatalf("expected no history for deleted vm, got %d (%v)", len(history), err)
+	}
+}
@@ -0,0 +1,72 @@
+package store
+
+import (
+	"context"
+	"time"
+
+	"github.com/alperreha/mergen-fire/internal/model"
+)
+
+const sqliteChangeRetention = 1000
+
+// Watch tails the vm_changes table filled by triggers, so changes made by
+// other processes sharing the database file are seen too.
+func (s *SQLiteStore) Watch(ctx context.Context) (<-chan model.StoreEvent, error) {
+	var last int64
+	if err := s.db.QueryRowContext(ctx, `SELECT COALESCE(MAX(seq), 0) FROM vm_changes`).Scan(&last); err != nil {
+		return nil, err
+	}
+
+	out := make(chan model.StoreEvent, watchBufferSize)
+	go pollLoop(ctx, watchPollInterval/2, out, func() []model.StoreEvent {
+		events, next, err := s.changesSince(ctx, last)
+		if err != nil {
+			if ctx.Err() == nil {
+				s.logger.Warn("sqlite store watch poll failed", "error", err)
+			}
+			return nil
+		}
+		last = next
+		return events
+	})
+	return out, nil
+}
+
+func (s *SQLiteStore) changesSince(ctx context.Context, after int64) ([]model.StoreEvent, int64, error) {
+	rows, err := s.db.QueryContext(ctx, `SELECT seq, vm_id, op FROM vm_changes WHERE seq > ? ORDER BY seq`, after)
+	if err != nil {
+		return nil, after, err
+	}
+	defer rows.Close()
+
+	var events []model.StoreEvent
+	for rows.Next() {
+		var (
+			event model.StoreEvent
+			seq   int64
+		)
+		if err := rows.Scan(&seq, &event.ID, &event.Type); err != nil {
+			return nil, after, err
+		}
+		event.At = time.Now().UTC()
+		events = append(events, event)
+		after = seq
+	}
+	if err := rows.Err(); err != nil {
+		return nil, after, err
+	}
+	rows.Close()
+
+	for i := range events {
+		if events[i].Type == model.StoreEventDeleted {
+			continue
+		}
+		if meta, err := s.ReadMeta(events[i].ID); err == nil {
+			events[i].Revision = meta.Revision
+		}
+	}
+	if len(events) > 0 {
+		_, _ = s.db.ExecContext(ctx, `DELETE FROM vm_changes WHERE seq <= ?`, after-sqliteChangeRetention)
+	}
+	return events, after, nil
+}
@@ -0,0 +1,51 @@
+package store
+
+import (
+	"errors"
+	"os"
+
+	"github.com/alperreha/mergen-fire/internal/model"
+)
+
+const maxStateHistoryEntries = 200
+
+func (s *FSStore) AppendStateTransition(id string, transition model.StateTransition) error {
+	if err := validateID(id); err != nil {
+		return err
+	}
+
+	s.historyMu.Lock()
+	defer s.historyMu.Unlock()
+
+	path := s.PathsFor(id).StateHistory
+	var history []model.StateTransition
+	if err := readJSON(path, &history); err != nil && !errors.Is(err, os.ErrNotExist) {
+		s.logger.Warn("state history unreadable, starting fresh", "vmID", id, "error", err)
+		history = nil
+	}
+
+	history = append(history, transition)
+	if len(history) > maxStateHistoryEntries {
+		history = history[len(history)-maxStateHistoryEntries:]
+	}
+	return writeJSONAtomic(path, history, 0o640)
+}
+
+func (s *FSStore) ReadStateHistory(id string) ([]model.StateTransition, error) {
+	if err := validateID(id); err != nil {
+		return nil, err
+	}
+	s.logger.Debug("reading state history", "vmID", id)
+
+	s.historyMu.Lock()
+	defer s.historyMu.Unlock()
+
+	var history []model.StateTransition
+	if err := readJSON(s.PathsFor(id).StateHistory, &history); err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return []model.StateTransition{}, nil
+		}
+		return nil, err
+	}
+	return history, nil
+}
@@ -0,0 +1,131 @@
+package store
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/alperreha/mergen-fire/internal/model"
+)
+
+var ErrTemplateNotFound = errors.New("template not found")
+
+// templatesDir sits next to vm.d, e.g. /etc/mergen/templates.d, one JSON
+// file per template.
+func (s *FSStore) templatesDir() string {
+	return filepath.Join(filepath.Dir(s.configRoot), "templates.d")
+}
+
+func (s *FSStore) templatePath(name string) (string, error) {
+	if strings.TrimSpace(name) == "" || strings.ContainsAny(name, `/\`) || strings.HasPrefix(name, ".") {
+		return "", errors.New("template name is invalid")
+	}
+	return filepath.Join(s.templatesDir(), name+".json"), nil
+}
+
+func (s *FSStore) ListTemplates() ([]model.VMTemplate, error) {
+	entries, err := os.ReadDir(s.templatesDir())
+	if errors.Is(err, os.ErrNotExist) {
+		return []model.VMTemplate{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	templates := make([]model.VMTemplate, 0, len(entries))
+	for _, entry := range entries {
+		name, ok := strings.CutSuffix(entry.Name(), ".json")
+		if !ok || entry.IsDir() {
+			continue
+		}
+		template, err := s.ReadTemplate(name)
+		if errors.Is(err, ErrTemplateNotFound) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		templates = append(templates, template)
+	}
+	sort.Slice(templates, func(i, j int) bool { return templates[i].Name < templates[j].Name })
+	return templates, nil
+}
+
+func (s *FSStore) ReadTemplate(name string) (model.VMTemplate, error) {
+	path, err := s.templatePath(name)
+	if err != nil {
+		return model.VMTemplate{}, err
+	}
+	var template model.VMTemplate
+	if err := readJSON(path, &template); err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return model.VMTemplate{}, ErrTemplateNotFound
+		}
+		return model.VMTemplate{}, err
+	}
+	template.Name = name
+	return template, nil
+}
+
+func (s *FSStore) SaveTemplate(template model.VMTemplate) error {
+	path, err := s.templatePath(template.Name)
+	if err != nil {
+		return err
+	}
+	s.logger.Debug("saving vm template", "template", template.Name)
+	if err := os.MkdirAll(s.templatesDir(), 0o750); err != nil {
+		return err
+	}
+	return writeJSONAtomic(path, template, 0o640)
+}
+
+func (s *FSStore) DeleteTemplate(name string) error {
+	path, err := s.templatePath(name)
+	if err != nil {
+		return err
+	}
+	s.logger.Debug("deleting vm template", "template", name)
+	if err := os.Remove(path); err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return ErrTemplateNotFound
+		}
+		return err
+	}
+	return nil
+}
+
+// Templates of the other backends stay on the host's file store, as env
+// files do.
+
+func (s *SQLiteStore) ListTemplates() ([]model.VMTemplate, error) {
+	return s.files.ListTemplates()
+}
+
+func (s *SQLiteStore) ReadTemplate(name string) (model.VMTemplate, error) {
+	return s.files.ReadTemplate(name)
+}
+
+func (s *SQLiteStore) SaveTemplate(template model.VMTemplate) error {
+	return s.files.SaveTemplate(template)
+}
+
+func (s *SQLiteStore) DeleteTemplate(name string) error {
+	return s.files.DeleteTemplate(name)
+}
+
+func (s *EtcdStore) ListTemplates() ([]model.VMTemplate, error) {
+	return s.files.ListTemplates()
+}
+
+func (s *EtcdStore) ReadTemplate(name string) (model.VMTemplate, error) {
+	return s.files.ReadTemplate(name)
+}
+
+func (s *EtcdStore) SaveTemplate(template model.VMTemplate) error {
+	return s.files.SaveTemplate(template)
+}
+
+func (s *EtcdStore) DeleteTemplate(name string) error {
+	return s.files.DeleteTemplate(name)
+}
@@ -0,0 +1,145 @@
+package store
+
+import (
+	"context"
+	"errors"
+	"os"
+	"time"
+
+	"github.com/alperreha/mergen-fire/internal/model"
+)
+
+const (
+	watchBufferSize   = 64
+	watchPollInterval = time.Second
+)
+
+// Watch emits created/updated/deleted events for VMs under the config root.
+// The channel is closed when ctx is done.
+func (s *FSStore) Watch(ctx context.Context) (<-chan model.StoreEvent, error) {
+	if _, err := os.Stat(s.configRoot); err != nil {
+		return nil, err
+	}
+	tracker := newWatchTracker(s)
+	out := make(chan model.StoreEvent, watchBufferSize)
+	if err := s.watchFS(ctx, tracker, out); err != nil {
+		return nil, err
+	}
+	s.logger.Debug("store watch started", "configRoot", s.configRoot)
+	return out, nil
+}
+
+type metaStamp struct {
+	modTime  time.Time
+	size     int64
+	revision int64
+}
+
+// watchTracker turns "something changed for id" notifications into typed
+// events by comparing meta.json against the last seen state.
+type watchTracker struct {
+	store *FSStore
+	known map[string]metaStamp
+}
+
+func newWatchTracker(s *FSStore) *watchTracker {
+	t := &watchTracker{store: s, known: map[string]metaStamp{}}
+	ids, _ := s.ListVMIDs()
+	for _, id := range ids {
+		if stamp, ok := t.stamp(id); ok {
+			t.known[id] = stamp
+		}
+	}
+	return t
+}
+
+func (t *watchTracker) stamp(id string) (metaStamp, bool) {
+	metaPath := t.store.PathsFor(id).MetaPath
+	info, err := os.Stat(metaPath)
+	if err != nil {
+		return metaStamp{}, false
+	}
+	stamp := metaStamp{modTime: info.ModTime(), size: info.Size()}
+	var meta model.VMMetadata
+	if err := readJSON(metaPath, &meta); err == nil {
+		stamp.revision = meta.Revision
+	}
+	return stamp, true
+}
+
+func (t *watchTracker) check(id string) (model.StoreEvent, bool) {
+	if validateID(id) != nil {
+		return model.StoreEvent{}, false
+	}
+	previous, wasKnown := t.known[id]
+	current, exists := t.stamp(id)
+
+	event := model.StoreEvent{ID: id, Revision: current.revision, At: time.Now().UTC()}
+	switch {
+	case exists && !wasKnown:
+		event.Type = model.StoreEventCreated
+	case exists && current != previous:
+		event.Type = model.StoreEventUpdated
+	case !exists && wasKnown:
+		event.Type = model.StoreEventDeleted
+		event.Revision = previous.revision
+	default:
+		return model.StoreEvent{}, false
+	}
+
+	if exists {
+		t.known[id] = current
+	} else {
+		delete(t.known, id)
+	}
+	return event, true
+}
+
+func (t *watchTracker) rescan() []model.StoreEvent {
+	candidates := map[string]struct{}{}
+	for id := range t.known {
+		candidates[id] = struct{}{}
+	}
+	ids, err := t.store.ListVMIDs()
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		t.store.logger.Warn("store watch rescan failed", "error", err)
+	}
+	for _, id := range ids {
+		candidates[id] = struct{}{}
+	}
+
+	var events []model.StoreEvent
+	for id := range candidates {
+		if event, ok := t.check(id); ok {
+			events = append(events, event)
+		}
+	}
+	return events
+}
+
+func emit(ctx context.Context, out chan<- model.StoreEvent, event model.StoreEvent) bool {
+	select {
+	case out <- event:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
+
+func pollLoop(ctx context.Context, interval time.Duration, out chan<- model.StoreEvent, poll func() []model.StoreEvent) {
+	defer close(out)
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			for _, event := range poll() {
+				if !emit(ctx, out, event) {
+					return
+				}
+			}
+		}
+	}
+}
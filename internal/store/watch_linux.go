@@ -0,0 +1,132 @@
+//go:build linux
+
+package store
+
+import (
+	"context"
+	"errors"
+	"path/filepath"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+
+	"github.com/alperreha/mergen-fire/internal/model"
+)
+
+const (
+	inotifyRootMask = unix.IN_CREATE | unix.IN_DELETE | unix.IN_MOVED_FROM | unix.IN_MOVED_TO | unix.IN_ONLYDIR
+	inotifyVMMask   = unix.IN_CLOSE_WRITE | unix.IN_MOVED_TO | unix.IN_DELETE | unix.IN_DELETE_SELF
+)
+
+func (s *FSStore) watchFS(ctx context.Context, tracker *watchTracker, out chan model.StoreEvent) error {
+	fd, err := unix.InotifyInit1(unix.IN_CLOEXEC | unix.IN_NONBLOCK)
+	if err != nil {
+		return err
+	}
+	if _, err := unix.InotifyAddWatch(fd, s.configRoot, inotifyRootMask); err != nil {
+		_ = unix.Close(fd)
+		return err
+	}
+
+	w := &inotifyWatch{store: s, fd: fd, tracker: tracker, vmWatches: map[int32]string{}}
+	for id := range tracker.known {
+		w.addVM(id)
+	}
+	go w.run(ctx, out)
+	return nil
+}
+
+type inotifyWatch struct {
+	store     *FSStore
+	fd        int
+	tracker   *watchTracker
+	vmWatches map[int32]string
+}
+
+func (w *inotifyWatch) addVM(id string) {
+	wd, err := unix.InotifyAddWatch(w.fd, filepath.Join(w.store.configRoot, id), inotifyVMMask)
+	if err != nil {
+		w.store.logger.Debug("store watch add failed", "vmID", id, "error", err)
+		return
+	}
+	w.vmWatches[int32(wd)] = id
+}
+
+func (w *inotifyWatch) run(ctx context.Context, out chan<- model.StoreEvent) {
+	defer close(out)
+	defer unix.Close(w.fd)
+
+	buf := make([]byte, 64*(unix.SizeofInotifyEvent+unix.NAME_MAX+1))
+	pollFDs := []unix.PollFd{{Fd: int32(w.fd), Events: unix.POLLIN}}
+	for ctx.Err() == nil {
+		ready, err := unix.Poll(pollFDs, 500)
+		if err != nil && !errors.Is(err, unix.EINTR) {
+			w.store.logger.Warn("store watch poll failed", "error", err)
+			return
+		}
+		if ready <= 0 {
+			continue
+		}
+
+		n, err := unix.Read(w.fd, buf)
+		if err != nil {
+			if errors.Is(err, unix.EAGAIN) || errors.Is(err, unix.EINTR) {
+				continue
+			}
+			w.store.logger.Warn("store watch read failed", "error", err)
+			return
+		}
+		for _, event := range w.parse(buf[:n]) {
+			if !emit(ctx, out, event) {
+				return
+			}
+		}
+	}
+}
+
+func (w *inotifyWatch) parse(buf []byte) []model.StoreEvent {
+	var events []model.StoreEvent
+	for offset := 0; offset+unix.SizeofInotifyEvent <= len(buf); {
+		raw := (*unix.InotifyEvent)(unsafe.Pointer(&buf[offset]))
+		nameBytes := buf[offset+unix.SizeofInotifyEvent : offset+unix.SizeofInotifyEvent+int(raw.Len)]
+		offset += unix.SizeofInotifyEvent + int(raw.Len)
+		name := string(trimNUL(nameBytes))
+
+		if raw.Mask&unix.IN_Q_OVERFLOW != 0 {
+			events = append(events, w.tracker.rescan()...)
+			continue
+		}
+		if raw.Mask&unix.IN_IGNORED != 0 {
+			delete(w.vmWatches, raw.Wd)
+			continue
+		}
+
+		id, isVMDir := w.vmWatches[raw.Wd]
+		if !isVMDir {
+			// Event on the config root: a VM directory appeared or vanished.
+			if name == "" {
+				continue
+			}
+			id = name
+			if raw.Mask&(unix.IN_CREATE|unix.IN_MOVED_TO) != 0 {
+				w.addVM(id)
+			}
+		} else if name != "" && name != "meta.json" && raw.Mask&unix.IN_DELETE_SELF == 0 {
+			continue
+		}
+
+		if event, ok := w.tracker.check(id); ok {
+			events = append(events, event)
+		}
+	}
+	return events
+}
+
+func trimNUL(b []byte) []byte {
+	for i, c := range b {
+		if c == 0 {
+			return b[:i]
+		}
+	}
+	return b
+}
@@ -0,0 +1,14 @@
+//go:build !linux
+
+package store
+
+import (
+	"context"
+
+	"github.com/alperreha/mergen-fire/internal/model"
+)
+
+func (s *FSStore) watchFS(ctx context.Context, tracker *watchTracker, out chan model.StoreEvent) error {
+	go pollLoop(ctx, watchPollInterval, out, tracker.rescan)
+	return nil
+}
@@ -10,6 +10,8 @@ import (
 	"strconv"
 	"strings"
 	"time"
+
+	"github.com/alperreha/mergen-fire/internal/tracing"
 )
 
 var ErrUnavailable = errors.New("systemd unavailable on this host")
@@ -27,6 +29,9 @@ type Status struct {
 type Client interface {
 	Start(ctx context.Context, id string) error
 	Stop(ctx context.Context, id string) error
+	// Kill sends SIGKILL to every process of the unit, for a stop that
+	// takes too long.
+	Kill(ctx context.Context, id string) error
 	Disable(ctx context.Context, id string) error
 	IsActive(ctx context.Context, id string) (bool, error)
 	Status(ctx context.Context, id string) (Status, error)
@@ -38,6 +43,7 @@ type ExecClient struct {
 	timeout    time.Duration
 	available  bool
 	logger     *slog.Logger
+	unitLookup func(id string) string
 }
 
 func NewExecClient(systemctlPath, unitPrefix string, timeout time.Duration, logger *slog.Logger) *ExecClient {
@@ -66,6 +72,13 @@ func NewExecClient(systemctlPath, unitPrefix string, timeout time.Duration, logg
 	}
 }
 
+// WithUnitLookup sets a function returning the unit of VMs that do not run
+// under the <prefix>@<id>.service template; an empty result falls back to it.
+func (c *ExecClient) WithUnitLookup(lookup func(id string) string) *ExecClient {
+	c.unitLookup = lookup
+	return c
+}
+
 func (c *ExecClient) Start(ctx context.Context, id string) error {
 	c.logger.Debug("systemd start requested", "vmID", id, "unit", c.unitName(id))
 	active, err := c.IsActive(ctx, id)
@@ -100,6 +113,15 @@ func (c *ExecClient) Stop(ctx context.Context, id string) error {
 	return err
 }
 
+func (c *ExecClient) Kill(ctx context.Context, id string) error {
+	c.logger.Debug("systemd kill requested", "vmID", id, "unit", c.unitName(id))
+	_, err := c.run(ctx, "kill", "--signal=SIGKILL", c.unitName(id))
+	if err == nil {
+		c.logger.Debug("systemd kill succeeded", "vmID", id, "unit", c.unitName(id))
+	}
+	return err
+}
+
 func (c *ExecClient) Disable(ctx context.Context, id string) error {
 	c.logger.Debug("systemd disable requested", "vmID", id, "unit", c.unitName(id))
 	_, err := c.run(ctx, "disable", c.unitName(id))
@@ -169,6 +191,11 @@ func (c *ExecClient) Status(ctx context.Context, id string) (Status, error) {
 }
 
 func (c *ExecClient) unitName(id string) string {
+	if c.unitLookup != nil {
+		if unit := c.unitLookup(id); unit != "" {
+			return unit
+		}
+	}
 	return fmt.Sprintf("%s@%s.service", c.unitPrefix, id)
 }
 
@@ -178,6 +205,9 @@ func (c *ExecClient) run(ctx context.Context, args ...string) ([]byte, error) {
 		return nil, ErrUnavailable
 	}
 
+	ctx, span := tracing.StartKind(ctx, tracing.KindClient, "systemctl "+args[0], "args", strings.Join(args, " "))
+	defer span.End()
+
 	runCtx := ctx
 	cancel := func() {}
 	if c.timeout > 0 {
@@ -198,6 +228,7 @@ func (c *ExecClient) run(ctx context.Context, args ...string) ([]byte, error) {
 		return output, nil
 	}
 
+	span.RecordError(err)
 	fullErrText := strings.TrimSpace(stderr.String())
 	if fullErrText == "" {
 		fullErrText = strings.TrimSpace(string(output))
@@ -0,0 +1,53 @@
+package testsupport
+
+import (
+	"sort"
+	"sync"
+	"testing"
+
+	"github.com/alperreha/mergen-fire/internal/manager"
+	"github.com/alperreha/mergen-fire/internal/model"
+	"github.com/alperreha/mergen-fire/internal/store"
+)
+
+// NewCluster starts one Env per name. Each keeps its own file store, but all
+// see each other as registered hosts, the way mergend instances sharing an
+// etcd host registry do, so VMs can be scheduled and migrated between them.
+func NewCluster(t testing.TB, names ...string) map[string]*Env {
+	t.Helper()
+	registry := &hostRegistry{}
+	envs := make(map[string]*Env, len(names))
+	for _, name := range names {
+		env := newEnv(t, func(s *store.FSStore) manager.Store {
+			return &clusterStore{FSStore: s, registry: registry}
+		})
+		host := model.HostInfo{Name: name, URL: env.API.URL}
+		env.Service.WithHost(host)
+		registry.add(host)
+		envs[name] = env
+	}
+	return envs
+}
+
+type hostRegistry struct {
+	mu    sync.Mutex
+	hosts []model.HostInfo
+}
+
+func (r *hostRegistry) add(host model.HostInfo) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.hosts = append(r.hosts, host)
+	sort.Slice(r.hosts, func(i, j int) bool { return r.hosts[i].Name < r.hosts[j].Name })
+}
+
+type clusterStore struct {
+	*store.FSStore
+	registry *hostRegistry
+}
+
+func (s *clusterStore) ListHosts() ([]model.HostInfo, error) {
+	s.registry.mu.Lock()
+	defer s.registry.mu.Unlock()
+	return append([]model.HostInfo(nil), s.registry.hosts...), nil
+}
@@ -0,0 +1,212 @@
+package testsupport
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/alperreha/mergen-fire/internal/api"
+	"github.com/alperreha/mergen-fire/internal/firecracker"
+	"github.com/alperreha/mergen-fire/internal/forwarder"
+	"github.com/alperreha/mergen-fire/internal/hooks"
+	"github.com/alperreha/mergen-fire/internal/manager"
+	"github.com/alperreha/mergen-fire/internal/network"
+	"github.com/alperreha/mergen-fire/internal/store"
+	"github.com/labstack/echo/v4"
+)
+
+// Env is a full mergend stack in one process: a file store under temp dirs,
+// the manager with Units as its systemd client, and the HTTP API on an
+// httptest server.
+type Env struct {
+	Root      string
+	Artifacts Artifacts
+	Store     *store.FSStore
+	Units     *Units
+	Service   *manager.Service
+	API       *httptest.Server
+	Backends  *Backends
+	Logger    *slog.Logger
+}
+
+func NewEnv(t testing.TB) *Env {
+	t.Helper()
+	return newEnv(t, func(s *store.FSStore) manager.Store { return s })
+}
+
+// newEnv builds an Env whose service sees the file store through wrap.
+func newEnv(t testing.TB, wrap func(*store.FSStore) manager.Store) *Env {
+	root := t.TempDir()
+	// Firecracker sockets live under the run root; keep it short so socket
+	// paths stay below the unix socket path limit.
+	runRoot, err := os.MkdirTemp("", "mgn")
+	if err != nil {
+		t.Fatalf("create run root: %v", err)
+	}
+	t.Cleanup(func() { _ = os.RemoveAll(runRoot) })
+
+	fsStore := store.NewFSStore(
+		filepath.Join(root, "etc", "mergen", "vm.d"),
+		filepath.Join(root, "var", "lib", "mergen"),
+		runRoot,
+		filepath.Join(root, "etc", "mergen", "hooks.d"),
+	)
+	if err := fsStore.EnsureBaseDirs(); err != nil {
+		t.Fatalf("ensure dirs: %v", err)
+	}
+	if err := os.MkdirAll(filepath.Join(root, "artifacts"), 0o755); err != nil {
+		t.Fatalf("create artifacts dir: %v", err)
+	}
+
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+	units := NewUnits(t, fsStore)
+	service := manager.NewService(
+		wrap(fsStore),
+		units,
+		hooks.NewRunner(logger),
+		network.NewAllocator(20000, 20100, "172.30.0.0/24"),
+		logger,
+	).WithSnapshotter(firecracker.NewRawConfigurator(5 * time.Second))
+
+	e := echo.New()
+	api.Register(e, service, api.RedactionConfig{}, logger)
+	server := httptest.NewServer(e)
+	t.Cleanup(server.Close)
+
+	return &Env{
+		Root:      root,
+		Artifacts: WriteArtifacts(t, filepath.Join(root, "artifacts")),
+		Store:     fsStore,
+		Units:     units,
+		Service:   service,
+		API:       server,
+		Backends:  NewBackends(),
+		Logger:    logger,
+	}
+}
+
+// Request sends a JSON request to the API and returns the status and body.
+func (e *Env) Request(t testing.TB, method, path string, body any) (int, []byte) {
+	t.Helper()
+	var reader io.Reader
+	if body != nil {
+		payload, err := json.Marshal(body)
+		if err != nil {
+			t.Fatalf("marshal request: %v", err)
+		}
+		reader = bytes.NewReader(payload)
+	}
+	req, err := http.NewRequest(method, e.API.URL+path, reader)
+	if err != nil {
+		t.Fatalf("build request: %v", err)
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	resp, err := e.API.Client().Do(req)
+	if err != nil {
+		t.Fatalf("%s %s: %v", method, path, err)
+	}
+	defer resp.Body.Close()
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatalf("read response: %v", err)
+	}
+	return resp.StatusCode, data
+}
+
+// CreateVM creates a VM through the API and returns its id.
+func (e *Env) CreateVM(t testing.TB, req any) string {
+	t.Helper()
+	status, body := e.Request(t, http.MethodPost, "/v1/vms", req)
+	if status != http.StatusCreated {
+		t.Fatalf("create vm: status %d: %s", status, body)
+	}
+	var created struct {
+		ID string `json:"id"`
+	}
+	if err := json.Unmarshal(body, &created); err != nil || created.ID == "" {
+		t.Fatalf("create vm: unexpected body %s", body)
+	}
+	return created.ID
+}
+
+// ServeGuest routes the VM's guest port to addr, so forwarded traffic reaches
+// a local server playing the guest's service.
+func (e *Env) ServeGuest(t testing.TB, id string, guestPort int, addr string) {
+	t.Helper()
+	meta, err := e.Store.ReadMeta(id)
+	if err != nil {
+		t.Fatalf("read meta: %v", err)
+	}
+	e.Backends.Route(meta.NetNS, net.JoinHostPort(meta.GuestIP, strconv.Itoa(guestPort)), addr)
+}
+
+// Forwarder is a running SNI forwarder for an Env.
+type Forwarder struct {
+	Addr   string
+	Domain string
+	Roots  *x509.CertPool
+}
+
+// StartForwarder serves the forwarder on a loopback port, routing
+// "<vm id>.localhost" through Env.Backends, until the test ends.
+func (e *Env) StartForwarder(t testing.TB) *Forwarder {
+	t.Helper()
+	certDir := filepath.Join(e.Root, "tls")
+	if err := os.MkdirAll(certDir, 0o755); err != nil {
+		t.Fatalf("create cert dir: %v", err)
+	}
+	certFile, keyFile, roots := SelfSignedCert(t, certDir, "*.localhost")
+	resolver := forwarder.NewResolver(e.Store.PathsFor("").ConfigDir, "", "localhost", time.Millisecond, e.Logger)
+	server, err := forwarder.NewServer(forwarder.Config{
+		CertFile:    certFile,
+		KeyFile:     keyFile,
+		DialTimeout: 2 * time.Second,
+	}, resolver, e.Backends, e.Logger)
+	if err != nil {
+		t.Fatalf("create forwarder: %v", err)
+	}
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() { done <- server.Serve(ctx, listener) }()
+	t.Cleanup(func() {
+		cancel()
+		if err := <-done; err != nil && !errors.Is(err, net.ErrClosed) {
+			t.Errorf("forwarder: %v", err)
+		}
+	})
+	return &Forwarder{Addr: listener.Addr().String(), Domain: "localhost", Roots: roots}
+}
+
+// Client returns an HTTP client that sends every request to the forwarder
+// with the URL host as SNI, e.g. https://<vm id>.localhost/.
+func (f *Forwarder) Client() *http.Client {
+	var dialer net.Dialer
+	return &http.Client{
+		Transport: &http.Transport{
+			TLSClientConfig: &tls.Config{RootCAs: f.Roots},
+			DialContext: func(ctx context.Context, network, _ string) (net.Conn, error) {
+				return dialer.DialContext(ctx, network, f.Addr)
+			},
+		},
+		Timeout: 5 * time.Second,
+	}
+}
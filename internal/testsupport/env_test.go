@@ -0,0 +1,245 @@
+package testsupport
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/alperreha/mergen-fire/internal/model"
+	"github.com/alperreha/mergen-fire/internal/systemd"
+)
+
+func TestEnv_CreateStartAndRoute(t *testing.T) {
+	env := NewEnv(t)
+	id := env.CreateVM(t, env.Artifacts.CreateRequest())
+
+	if status, body := env.Request(t, http.MethodPost, "/v1/vms/"+id+"/start", nil); status != http.StatusOK {
+		t.Fatalf("start vm: status %d: %s", status, body)
+	}
+	fc := env.Units.Firecracker(id)
+	if fc == nil || fc.State() != StateRunning {
+		t.Fatalf("expected fake firecracker running for %s", id)
+	}
+	cfg := fc.Config()
+	if cfg.BootSource.KernelImagePath != env.Artifacts.Kernel || cfg.MachineConfig.MemSizeMiB != 128 {
+		t.Fatalf("unexpected machine config: %+v", cfg)
+	}
+	requests := fc.Requests()
+	if last := requests[len(requests)-1]; last.Path != "/actions" || !strings.Contains(string(last.Body), "InstanceStart") {
+		t.Fatalf("expected InstanceStart last, got %s %s", last.Path, last.Body)
+	}
+
+	guest := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = io.WriteString(w, "hello from "+r.Host)
+	}))
+	defer guest.Close()
+	env.ServeGuest(t, id, 8080, guest.Listener.Addr().String())
+
+	fwd := env.StartForwarder(t)
+	resp, err := fwd.Client().Get("https://" + id + "." + fwd.Domain + "/")
+	if err != nil {
+		t.Fatalf("request through forwarder: %v", err)
+	}
+	defer resp.Body.Close()
+	body, _ := io.ReadAll(resp.Body)
+	if resp.StatusCode != http.StatusOK || string(body) != "hello from "+id+".localhost" {
+		t.Fatalf("unexpected response %d: %s", resp.StatusCode, body)
+	}
+
+	if status, body := env.Request(t, http.MethodPost, "/v1/vms/"+id+"/stop", nil); status != http.StatusOK {
+		t.Fatalf("stop vm: status %d: %s", status, body)
+	}
+	if env.Units.Firecracker(id) != nil {
+		t.Fatal("expected fake firecracker gone after stop")
+	}
+}
+
+func TestFakeFirecracker_RejectsConfigAfterStart(t *testing.T) {
+	env := NewEnv(t)
+	id := env.CreateVM(t, env.Artifacts.CreateRequest())
+	if err := env.Units.Start(context.Background(), id); err != nil {
+		t.Fatalf("start: %v", err)
+	}
+	req, _ := http.NewRequest(http.MethodPut, "http://localhost/machine-config", strings.NewReader(`{"vcpu_count":2,"mem_size_mib":256}`))
+	fc := env.Units.Firecracker(id)
+	resp, err := unixClient(fc.SocketPath).Do(req)
+	if err != nil {
+		t.Fatalf("put machine-config: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Fatalf("expected 400 after start, got %d", resp.StatusCode)
+	}
+}
+
+func TestFakeFirecracker_FailOn(t *testing.T) {
+	dir := t.TempDir()
+	fc := StartFakeFirecracker(t, dir+"/fc.sock")
+	fc.FailOn(http.MethodPut, "/boot-source", http.StatusInternalServerError)
+	req, _ := http.NewRequest(http.MethodPut, "http://localhost/boot-source", strings.NewReader(`{}`))
+	resp, err := unixClient(fc.SocketPath).Do(req)
+	if err != nil {
+		t.Fatalf("put boot-source: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusInternalServerError {
+		t.Fatalf("expected injected 500, got %d", resp.StatusCode)
+	}
+}
+
+func TestFakeSystemctl_WithExecClient(t *testing.T) {
+	if _, err := exec.LookPath("sh"); err != nil {
+		t.Skip("no /bin/sh")
+	}
+	fake := NewFakeSystemctl(t)
+	client := systemd.NewExecClient(fake.Path, "mergen", 5*time.Second, nil)
+	ctx := context.Background()
+
+	if err := client.Start(ctx, "vm1"); err != nil {
+		t.Fatalf("start: %v", err)
+	}
+	if active, err := client.IsActive(ctx, "vm1"); err != nil || !active {
+		t.Fatalf("expected active, got %v %v", active, err)
+	}
+	fake.SetActive(t, "mergen@vm1.service", false)
+	if active, _ := client.IsActive(ctx, "vm1"); active {
+		t.Fatal("expected inactive after SetActive(false)")
+	}
+	if len(fake.Calls()) < 3 {
+		t.Fatalf("expected calls to be logged, got %v", fake.Calls())
+	}
+}
+
+func unixClient(socketPath string) *http.Client {
+	return &http.Client{Transport: &http.Transport{
+		DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+			var dialer net.Dialer
+			return dialer.DialContext(ctx, "unix", socketPath)
+		},
+	}}
+}
+
+func TestEnv_PauseAndResume(t *testing.T) {
+	env := NewEnv(t)
+	id := env.CreateVM(t, env.Artifacts.CreateRequest())
+
+	if status, body := env.Request(t, http.MethodPost, "/v1/vms/"+id+"/pause", nil); status != http.StatusConflict {
+		t.Fatalf("pause stopped vm: expected 409, got %d: %s", status, body)
+	}
+	if status, body := env.Request(t, http.MethodPost, "/v1/vms/"+id+"/start", nil); status != http.StatusOK {
+		t.Fatalf("start vm: status %d: %s", status, body)
+	}
+	fc := env.Units.Firecracker(id)
+
+	for range 2 {
+		if status, body := env.Request(t, http.MethodPost, "/v1/vms/"+id+"/pause", nil); status != http.StatusOK {
+			t.Fatalf("pause vm: status %d: %s", status, body)
+		}
+	}
+	if fc.State() != StatePaused {
+		t.Fatalf("expected fake firecracker paused, got %s", fc.State())
+	}
+	status, body := env.Request(t, http.MethodGet, "/v1/vms/"+id, nil)
+	if status != http.StatusOK || !strings.Contains(string(body), `"state":"Paused"`) || !strings.Contains(string(body), `"paused":true`) {
+		t.Fatalf("expected paused vm summary, got %d: %s", status, body)
+	}
+	queried := len(fc.Requests())
+	status, body = env.Request(t, http.MethodGet, "/v1/vms", nil)
+	if status != http.StatusOK || strings.Contains(string(body), `"state":"Paused"`) || len(fc.Requests()) != queried {
+		t.Fatalf("expected list without live state queries, got %d (%d requests): %s", status, len(fc.Requests())-queried, body)
+	}
+	patches := 0
+	for _, req := range fc.Requests() {
+		if req.Method == http.MethodPatch && req.Path == "/vm" {
+			patches++
+		}
+	}
+	if patches != 1 {
+		t.Fatalf("expected one PATCH /vm for two pauses, got %d", patches)
+	}
+
+	if status, body := env.Request(t, http.MethodPost, "/v1/vms/"+id+"/resume", nil); status != http.StatusOK {
+		t.Fatalf("resume vm: status %d: %s", status, body)
+	}
+	if fc.State() != StateRunning {
+		t.Fatalf("expected fake firecracker running, got %s", fc.State())
+	}
+	status, body = env.Request(t, http.MethodGet, "/v1/vms/"+id, nil)
+	if status != http.StatusOK || !strings.Contains(string(body), `"state":"Running"`) || !strings.Contains(string(body), `"paused":false`) {
+		t.Fatalf("expected running vm summary, got %d: %s", status, body)
+	}
+}
+
+func TestEnv_SnapshotAndRestore(t *testing.T) {
+	env := NewEnv(t)
+	id := env.CreateVM(t, env.Artifacts.CreateRequest())
+	if status, body := env.Request(t, http.MethodPost, "/v1/vms/"+id+"/snapshots", nil); status != http.StatusConflict {
+		t.Fatalf("snapshot stopped vm: expected 409, got %d: %s", status, body)
+	}
+	if status, body := env.Request(t, http.MethodPost, "/v1/vms/"+id+"/start", nil); status != http.StatusOK {
+		t.Fatalf("start vm: status %d: %s", status, body)
+	}
+
+	status, body := env.Request(t, http.MethodPost, "/v1/vms/"+id+"/snapshots", map[string]any{"name": "before"})
+	if status != http.StatusCreated {
+		t.Fatalf("create snapshot: status %d: %s", status, body)
+	}
+	var snap model.Snapshot
+	if err := json.Unmarshal(body, &snap); err != nil {
+		t.Fatalf("decode snapshot: %v", err)
+	}
+	if snap.ID == "" || snap.Name != "before" || len(snap.Disks) != 1 || snap.Disks[0] != model.ArtifactRootFS {
+		t.Fatalf("unexpected snapshot: %+v", snap)
+	}
+	if fc := env.Units.Firecracker(id); fc == nil || fc.State() != StateRunning {
+		t.Fatal("expected vm resumed after snapshot")
+	}
+	if status, body := env.Request(t, http.MethodPost, "/v1/vms/"+id+"/snapshots", map[string]any{"name": "before"}); status != http.StatusConflict {
+		t.Fatalf("duplicate snapshot name: expected 409, got %d: %s", status, body)
+	}
+
+	if err := os.WriteFile(env.Artifacts.RootFS, []byte("changed after snapshot"), 0o644); err != nil {
+		t.Fatalf("write rootfs: %v", err)
+	}
+	if status, body := env.Request(t, http.MethodPost, "/v1/vms/"+id+"/restore", map[string]any{"snapshot": "before"}); status != http.StatusOK {
+		t.Fatalf("restore snapshot: status %d: %s", status, body)
+	}
+	if content, _ := os.ReadFile(env.Artifacts.RootFS); string(content) != "fake rootfs.ext4" {
+		t.Fatalf("expected rootfs restored, got %q", content)
+	}
+	fc := env.Units.Firecracker(id)
+	if fc == nil || fc.State() != StateRunning {
+		t.Fatal("expected vm running after restore")
+	}
+	if requests := fc.Requests(); requests[0].Path != "/snapshot/load" {
+		t.Fatalf("expected restored vm to load the snapshot, got %s first", requests[0].Path)
+	}
+	for _, file := range []string{"vmstate", "mem", model.ArtifactRootFS} {
+		if _, err := os.Stat(filepath.Join(snap.Dir, file)); err != nil {
+			t.Fatalf("expected snapshot kept after restore: %v", err)
+		}
+	}
+
+	status, body = env.Request(t, http.MethodGet, "/v1/vms/"+id+"/snapshots", nil)
+	if status != http.StatusOK || !strings.Contains(string(body), snap.ID) {
+		t.Fatalf("list snapshots: status %d: %s", status, body)
+	}
+	if status, body := env.Request(t, http.MethodDelete, "/v1/vms/"+id+"/snapshots/"+snap.ID, nil); status != http.StatusOK {
+		t.Fatalf("delete snapshot: status %d: %s", status, body)
+	}
+	if _, err := os.Stat(snap.Dir); !os.IsNotExist(err) {
+		t.Fatalf("expected snapshot files removed, got %v", err)
+	}
+	if status, _ := env.Request(t, http.MethodPost, "/v1/vms/"+id+"/restore", map[string]any{"snapshot": snap.ID}); status != http.StatusNotFound {
+		t.Fatalf("restore deleted snapshot: expected 404, got %d", status)
+	}
+}
@@ -0,0 +1,345 @@
+// Package testsupport provides fakes and fixtures for end-to-end tests that
+// run without KVM or systemd: a fake Firecracker API server on a unix socket,
+// a fake systemctl, an in-process systemd.Client that "boots" VMs against the
+// fake Firecracker, and an Env wiring them to a real store, manager, API and
+// forwarder.
+package testsupport
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+
+	"github.com/alperreha/mergen-fire/internal/model"
+)
+
+const (
+	StateNotStarted = "Not started"
+	StateRunning    = "Running"
+	StatePaused     = "Paused"
+)
+
+// FirecrackerRequest is one call received by FakeFirecracker.
+type FirecrackerRequest struct {
+	Method string
+	Path   string
+	Body   json.RawMessage
+}
+
+// FakeFirecracker serves the subset of the Firecracker API that mergen uses
+// and keeps the resulting machine config. Like the real VMM it rejects
+// pre-boot configuration once the instance is running.
+type FakeFirecracker struct {
+	SocketPath string
+
+	listener net.Listener
+	server   *http.Server
+
+	mu       sync.Mutex
+	requests []FirecrackerRequest
+	config   model.VMConfig
+	state    string
+	failures map[string]int
+}
+
+// StartFakeFirecracker listens on socketPath and stops when the test ends.
+func StartFakeFirecracker(t testing.TB, socketPath string) *FakeFirecracker {
+	t.Helper()
+	f, err := ListenFakeFirecracker(socketPath)
+	if err != nil {
+		t.Fatalf("start fake firecracker: %v", err)
+	}
+	t.Cleanup(func() { _ = f.Close() })
+	return f
+}
+
+// ListenFakeFirecracker is StartFakeFirecracker for callers without a
+// testing.TB; the caller must Close it.
+func ListenFakeFirecracker(socketPath string) (*FakeFirecracker, error) {
+	if err := os.MkdirAll(filepath.Dir(socketPath), 0o755); err != nil {
+		return nil, err
+	}
+	_ = os.Remove(socketPath)
+	listener, err := net.Listen("unix", socketPath)
+	if err != nil {
+		return nil, err
+	}
+	f := &FakeFirecracker{
+		SocketPath: socketPath,
+		listener:   listener,
+		state:      StateNotStarted,
+		failures:   map[string]int{},
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /{$}", f.instanceInfo)
+	mux.HandleFunc("PUT /boot-source", f.configure(func(body []byte) error {
+		return json.Unmarshal(body, &f.config.BootSource)
+	}))
+	mux.HandleFunc("PUT /machine-config", f.configure(func(body []byte) error {
+		return json.Unmarshal(body, &f.config.MachineConfig)
+	}))
+	mux.HandleFunc("PUT /drives/{id}", f.configure(func(body []byte) error {
+		var drive model.Drive
+		if err := json.Unmarshal(body, &drive); err != nil {
+			return err
+		}
+		f.config.Drives = append(f.config.Drives, drive)
+		return nil
+	}))
+	mux.HandleFunc("PUT /network-interfaces/{id}", f.configure(func(body []byte) error {
+		var nic model.NetworkInterface
+		if err := json.Unmarshal(body, &nic); err != nil {
+			return err
+		}
+		f.config.NetworkInterfaces = append(f.config.NetworkInterfaces, nic)
+		return nil
+	}))
+	mux.HandleFunc("PUT /vsock", f.configure(func(body []byte) error {
+		f.config.Vsock = &model.Vsock{}
+		return json.Unmarshal(body, f.config.Vsock)
+	}))
+	mux.HandleFunc("PUT /metrics", f.configure(func(body []byte) error {
+		f.config.Metrics = &model.Metrics{}
+		return json.Unmarshal(body, f.config.Metrics)
+	}))
+	mux.HandleFunc("PUT /actions", f.action)
+	mux.HandleFunc("PATCH /vm", f.vmState)
+	mux.HandleFunc("PUT /snapshot/create", f.snapshotCreate)
+	mux.HandleFunc("PUT /snapshot/load", f.snapshotLoad)
+	f.server = &http.Server{Handler: mux}
+	go func() { _ = f.server.Serve(listener) }()
+	return f, nil
+}
+
+// FailOn makes every later call to method+path answer with status.
+func (f *FakeFirecracker) FailOn(method, path string, status int) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.failures[method+" "+path] = status
+}
+
+func (f *FakeFirecracker) Requests() []FirecrackerRequest {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return append([]FirecrackerRequest(nil), f.requests...)
+}
+
+// Config returns the machine configuration received so far.
+func (f *FakeFirecracker) Config() model.VMConfig {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.config
+}
+
+func (f *FakeFirecracker) State() string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.state
+}
+
+func (f *FakeFirecracker) Close() error {
+	err := f.server.Close()
+	_ = os.Remove(f.SocketPath)
+	return err
+}
+
+// record logs the call and returns its body, or writes the failure set with
+// FailOn and reports false.
+func (f *FakeFirecracker) record(w http.ResponseWriter, r *http.Request) ([]byte, bool) {
+	body, _ := io.ReadAll(r.Body)
+	f.requests = append(f.requests, FirecrackerRequest{Method: r.Method, Path: r.URL.Path, Body: json.RawMessage(body)})
+	if status, ok := f.failures[r.Method+" "+r.URL.Path]; ok {
+		writeFault(w, status, "injected failure")
+		return nil, false
+	}
+	return body, true
+}
+
+func (f *FakeFirecracker) configure(apply func(body []byte) error) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		f.mu.Lock()
+		defer f.mu.Unlock()
+		body, ok := f.record(w, r)
+		if !ok {
+			return
+		}
+		if f.state != StateNotStarted {
+			writeFault(w, http.StatusBadRequest, "The requested operation is not supported after starting the microVM.")
+			return
+		}
+		if err := apply(body); err != nil {
+			writeFault(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+func (f *FakeFirecracker) action(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	body, ok := f.record(w, r)
+	if !ok {
+		return
+	}
+	var action struct {
+		ActionType string `json:"action_type"`
+	}
+	if err := json.Unmarshal(body, &action); err != nil {
+		writeFault(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	switch action.ActionType {
+	case "InstanceStart":
+		if err := f.bootable(); err != nil {
+			writeFault(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		f.state = StateRunning
+	case "SendCtrlAltDel", "FlushMetrics":
+	default:
+		writeFault(w, http.StatusBadRequest, "unknown action_type "+action.ActionType)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (f *FakeFirecracker) bootable() error {
+	if f.state == StateRunning {
+		return errors.New("microVM is already running")
+	}
+	if f.config.BootSource.KernelImagePath == "" {
+		return errors.New("boot source is not configured")
+	}
+	for _, drive := range f.config.Drives {
+		if drive.IsRootDevice {
+			return nil
+		}
+	}
+	return errors.New("no root drive configured")
+}
+
+func (f *FakeFirecracker) vmState(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	body, ok := f.record(w, r)
+	if !ok {
+		return
+	}
+	var req struct {
+		State string `json:"state"`
+	}
+	if err := json.Unmarshal(body, &req); err != nil {
+		writeFault(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	switch {
+	case f.state == StateNotStarted:
+		writeFault(w, http.StatusBadRequest, "The microVM is not running.")
+		return
+	case req.State == "Paused":
+		f.state = StatePaused
+	case req.State == "Resumed":
+		f.state = StateRunning
+	default:
+		writeFault(w, http.StatusBadRequest, "unknown vm state "+req.State)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// snapshotCreate writes the received machine config as the "state" file and
+// a marker as the "memory" file, so a later load can check what it restores.
+func (f *FakeFirecracker) snapshotCreate(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	body, ok := f.record(w, r)
+	if !ok {
+		return
+	}
+	var req struct {
+		StatePath string `json:"snapshot_path"`
+		MemPath   string `json:"mem_file_path"`
+	}
+	if err := json.Unmarshal(body, &req); err != nil {
+		writeFault(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if f.state != StatePaused {
+		writeFault(w, http.StatusBadRequest, "The microVM must be paused to create a snapshot.")
+		return
+	}
+	state, _ := json.Marshal(f.config)
+	if err := os.WriteFile(req.StatePath, state, 0o600); err != nil {
+		writeFault(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if err := os.WriteFile(req.MemPath, []byte(fakeMemory), 0o600); err != nil {
+		writeFault(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+const fakeMemory = "fake guest memory"
+
+func (f *FakeFirecracker) snapshotLoad(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	body, ok := f.record(w, r)
+	if !ok {
+		return
+	}
+	var req struct {
+		StatePath  string `json:"snapshot_path"`
+		MemBackend struct {
+			BackendPath string `json:"backend_path"`
+		} `json:"mem_backend"`
+		Resume bool `json:"resume_vm"`
+	}
+	if err := json.Unmarshal(body, &req); err != nil {
+		writeFault(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if f.state != StateNotStarted || len(f.requests) > 1 {
+		writeFault(w, http.StatusBadRequest, "Loading a microVM snapshot not allowed after configuring boot-specific resources.")
+		return
+	}
+	state, err := os.ReadFile(req.StatePath)
+	if err == nil {
+		err = json.Unmarshal(state, &f.config)
+	}
+	if err != nil {
+		writeFault(w, http.StatusBadRequest, "load snapshot state: "+err.Error())
+		return
+	}
+	if mem, err := os.ReadFile(req.MemBackend.BackendPath); err != nil || string(mem) != fakeMemory {
+		writeFault(w, http.StatusBadRequest, "load snapshot memory: invalid memory file")
+		return
+	}
+	f.state = StatePaused
+	if req.Resume {
+		f.state = StateRunning
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (f *FakeFirecracker) instanceInfo(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	state := f.state
+	f.mu.Unlock()
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(map[string]string{"id": "fake", "state": state, "vmm_version": "fake"})
+}
+
+func writeFault(w http.ResponseWriter, status int, message string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(map[string]string{"fault_message": message})
+}
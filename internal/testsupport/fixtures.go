@@ -0,0 +1,124 @@
+package testsupport
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"fmt"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/alperreha/mergen-fire/internal/model"
+)
+
+// Artifacts are placeholder boot files; nothing reads their contents.
+type Artifacts struct {
+	Kernel string
+	RootFS string
+}
+
+func WriteArtifacts(t testing.TB, dir string) Artifacts {
+	t.Helper()
+	a := Artifacts{Kernel: filepath.Join(dir, "vmlinux"), RootFS: filepath.Join(dir, "rootfs.ext4")}
+	for _, path := range []string{a.Kernel, a.RootFS} {
+		if err := os.WriteFile(path, []byte("fake "+filepath.Base(path)), 0o644); err != nil {
+			t.Fatalf("write artifact: %v", err)
+		}
+	}
+	return a
+}
+
+// CreateRequest is a minimal valid create request for the artifacts, serving
+// HTTP on guest port 8080.
+func (a Artifacts) CreateRequest() model.CreateVMRequest {
+	return model.CreateVMRequest{
+		RootFS:   a.RootFS,
+		Kernel:   a.Kernel,
+		VCPU:     1,
+		MemMiB:   128,
+		HTTPPort: 8080,
+		Ports:    []model.PortBindingRequest{{Guest: 8080}},
+	}
+}
+
+// SelfSignedCert writes a throwaway certificate for hosts (wildcards allowed)
+// and returns its files plus a pool that trusts it.
+func SelfSignedCert(t testing.TB, dir string, hosts ...string) (certFile, keyFile string, pool *x509.CertPool) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("generate key: %v", err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(time.Now().UnixNano()),
+		Subject:               pkix.Name{CommonName: hosts[0]},
+		DNSNames:              hosts,
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(24 * time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatalf("create certificate: %v", err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatalf("marshal key: %v", err)
+	}
+	certFile, keyFile = filepath.Join(dir, "tls.crt"), filepath.Join(dir, "tls.key")
+	if err := os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0o644); err != nil {
+		t.Fatalf("write cert: %v", err)
+	}
+	if err := os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0o600); err != nil {
+		t.Fatalf("write key: %v", err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatalf("parse certificate: %v", err)
+	}
+	pool = x509.NewCertPool()
+	pool.AddCert(cert)
+	return certFile, keyFile, pool
+}
+
+// Backends is a forwarder.Dialer that stands in for guest network
+// namespaces: each netns/guest address pair is routed to a local listener,
+// typically an httptest server playing the guest's service.
+type Backends struct {
+	mu     sync.Mutex
+	routes map[string]string
+	dialer net.Dialer
+}
+
+func NewBackends() *Backends {
+	return &Backends{routes: map[string]string{}}
+}
+
+// Route sends connections for guestAddr inside netns to localAddr.
+func (b *Backends) Route(netns, guestAddr, localAddr string) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.routes[netns+"/"+guestAddr] = localAddr
+}
+
+func (b *Backends) DialContext(ctx context.Context, network, address, netns string) (net.Conn, error) {
+	b.mu.Lock()
+	target, ok := b.routes[netns+"/"+address]
+	b.mu.Unlock()
+	if !ok {
+		return nil, fmt.Errorf("no backend for %s in netns %s", address, netns)
+	}
+	return b.dialer.DialContext(ctx, network, target)
+}
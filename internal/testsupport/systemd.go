@@ -0,0 +1,231 @@
+package testsupport
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/alperreha/mergen-fire/internal/chaos"
+	"github.com/alperreha/mergen-fire/internal/firecracker"
+	"github.com/alperreha/mergen-fire/internal/model"
+	"github.com/alperreha/mergen-fire/internal/systemd"
+)
+
+// VMReader is the part of a store Units needs to boot a VM.
+type VMReader interface {
+	PathsFor(id string) model.VMPaths
+	ReadVMConfig(id string) (model.VMConfig, error)
+}
+
+// Units is an in-process systemd.Client. Starting a unit does what
+// mergen@.service does on a host: it brings up a (fake) Firecracker on the
+// VM's API socket and configures and boots it with the rendered vm.json.
+type Units struct {
+	store        VMReader
+	configurator *firecracker.RawConfigurator
+
+	mu     sync.Mutex
+	vms    map[string]*FakeFirecracker
+	starts map[string]int
+	stops  map[string]int
+}
+
+var _ systemd.Client = (*Units)(nil)
+
+func NewUnits(t testing.TB, store VMReader) *Units {
+	u := &Units{
+		store:        store,
+		configurator: firecracker.NewRawConfigurator(5 * time.Second),
+		vms:          map[string]*FakeFirecracker{},
+		starts:       map[string]int{},
+		stops:        map[string]int{},
+	}
+	t.Cleanup(u.closeAll)
+	return u
+}
+
+func (u *Units) Start(ctx context.Context, id string) error {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	if _, ok := u.vms[id]; ok {
+		return nil
+	}
+	cfg, err := u.store.ReadVMConfig(id)
+	if err != nil {
+		return fmt.Errorf("%w: %v", systemd.ErrUnitNotFound, err)
+	}
+	fc, err := ListenFakeFirecracker(u.store.PathsFor(id).SocketPath)
+	if err != nil {
+		return err
+	}
+	if err := u.boot(ctx, id, fc, cfg); err != nil {
+		_ = fc.Close()
+		return fmt.Errorf("unit failed to start: %w", err)
+	}
+	u.vms[id] = fc
+	u.starts[id]++
+	return nil
+}
+
+// boot resumes a pending snapshot like mergen-configure-start does, and
+// otherwise configures and boots from vm.json.
+func (u *Units) boot(ctx context.Context, id string, fc *FakeFirecracker, cfg model.VMConfig) error {
+	dir := firecracker.SnapshotDir(u.store.PathsFor(id).DataDir)
+	files := firecracker.SnapshotFilesIn(dir)
+	if _, err := os.Stat(files.StatePath); err == nil {
+		if err := u.configurator.LoadSnapshot(ctx, fc.SocketPath, files, true); err != nil {
+			return err
+		}
+		return os.RemoveAll(dir)
+	}
+	return u.configurator.ConfigureAndStart(ctx, fc.SocketPath, cfg)
+}
+
+func (u *Units) Stop(_ context.Context, id string) error {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	fc, ok := u.vms[id]
+	if !ok {
+		return nil
+	}
+	delete(u.vms, id)
+	u.stops[id]++
+	return fc.Close()
+}
+
+// Kill is Stop: the fake Firecracker has no guest to wait for.
+func (u *Units) Kill(ctx context.Context, id string) error {
+	return u.Stop(ctx, id)
+}
+
+func (u *Units) Disable(context.Context, string) error {
+	return nil
+}
+
+func (u *Units) IsActive(_ context.Context, id string) (bool, error) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	_, ok := u.vms[id]
+	return ok, nil
+}
+
+func (u *Units) Status(_ context.Context, id string) (systemd.Status, error) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	status := systemd.Status{Available: true, Unit: "mergen@" + id + ".service", ActiveState: "inactive", SubState: "dead"}
+	if _, ok := u.vms[id]; ok {
+		status.Active, status.ActiveState, status.SubState, status.MainPID = true, "active", "running", os.Getpid()
+	}
+	return status, nil
+}
+
+// WithChaos delays the Firecracker API calls made when units start.
+func (u *Units) WithChaos(injector *chaos.Injector) *Units {
+	u.configurator.WithChaos(injector)
+	return u
+}
+
+// Firecracker returns the fake VMM of a running VM, or nil.
+func (u *Units) Firecracker(id string) *FakeFirecracker {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	return u.vms[id]
+}
+
+// Calls reports how often the unit was really started and stopped (no-op
+// calls on an already active or inactive unit are not counted).
+func (u *Units) Calls(id string) (starts, stops int) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	return u.starts[id], u.stops[id]
+}
+
+func (u *Units) closeAll() {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	for id, fc := range u.vms {
+		_ = fc.Close()
+		delete(u.vms, id)
+	}
+}
+
+// FakeSystemctl is a shell script standing in for systemctl, for tests of
+// systemd.ExecClient itself. It keeps unit state as files under its directory
+// and logs every invocation.
+type FakeSystemctl struct {
+	Path string
+	dir  string
+}
+
+const fakeSystemctlScript = `#!/bin/sh
+state=%q
+echo "$*" >> "$state/calls.log"
+verb=$1
+shift
+[ "$1" = "--quiet" ] && shift
+unit=$1
+if [ -n "$unit" ] && [ -f "$state/$unit.missing" ]; then
+	echo "Failed to $verb $unit: Unit $unit not found." >&2
+	exit 5
+fi
+case "$verb" in
+	is-active) [ -f "$state/$unit.active" ] || exit 3 ;;
+	start) touch "$state/$unit.active" ;;
+	stop) rm -f "$state/$unit.active" ;;
+	disable) ;;
+	show)
+		if [ -f "$state/$unit.active" ]; then
+			printf 'MainPID=4242\nActiveState=active\nSubState=running\n'
+		else
+			printf 'MainPID=0\nActiveState=inactive\nSubState=dead\n'
+		fi ;;
+	*) echo "Unknown command verb $verb." >&2; exit 1 ;;
+esac
+`
+
+func NewFakeSystemctl(t testing.TB) *FakeSystemctl {
+	t.Helper()
+	dir := t.TempDir()
+	path := filepath.Join(dir, "systemctl")
+	if err := os.WriteFile(path, []byte(fmt.Sprintf(fakeSystemctlScript, dir)), 0o755); err != nil {
+		t.Fatalf("write fake systemctl: %v", err)
+	}
+	return &FakeSystemctl{Path: path, dir: dir}
+}
+
+// SetActive flips a unit's state as if it started or died outside mergend.
+func (f *FakeSystemctl) SetActive(t testing.TB, unit string, active bool) {
+	t.Helper()
+	path := filepath.Join(f.dir, unit+".active")
+	var err error
+	if active {
+		err = os.WriteFile(path, nil, 0o644)
+	} else if err = os.Remove(path); os.IsNotExist(err) {
+		err = nil
+	}
+	if err != nil {
+		t.Fatalf("set unit state: %v", err)
+	}
+}
+
+// SetMissing makes every call for unit fail with "Unit ... not found".
+func (f *FakeSystemctl) SetMissing(t testing.TB, unit string) {
+	t.Helper()
+	if err := os.WriteFile(filepath.Join(f.dir, unit+".missing"), nil, 0o644); err != nil {
+		t.Fatalf("set unit missing: %v", err)
+	}
+}
+
+// Calls returns the argument lists systemctl was invoked with, in order.
+func (f *FakeSystemctl) Calls() []string {
+	data, err := os.ReadFile(filepath.Join(f.dir, "calls.log"))
+	if err != nil {
+		return nil
+	}
+	return strings.Split(strings.TrimSpace(string(data)), "\n")
+}
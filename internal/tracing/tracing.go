@@ -0,0 +1,383 @@
+// Package tracing records OpenTelemetry-compatible spans and exports them to
+// an OTLP/HTTP collector using the JSON encoding. It covers what mergend needs
+// (parent/child spans, W3C traceparent propagation, ratio sampling, batching)
+// without pulling the OTel SDK into the daemon.
+package tracing
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"log/slog"
+	"math"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+type Kind int
+
+const (
+	KindInternal Kind = 1
+	KindServer   Kind = 2
+	KindClient   Kind = 3
+)
+
+// statusError is the OTLP status code for a failed span.
+const statusError = 2
+
+// SpanContext identifies a span across process boundaries.
+type SpanContext struct {
+	TraceID [16]byte
+	SpanID  [8]byte
+	Sampled bool
+}
+
+func (sc SpanContext) IsValid() bool {
+	return sc.TraceID != [16]byte{} && sc.SpanID != [8]byte{}
+}
+
+// Span is one timed operation. A nil *Span is valid and records nothing, so
+// call sites never need to check whether tracing is enabled.
+type Span struct {
+	tracer *Tracer
+	sc     SpanContext
+	parent [8]byte
+	name   string
+	kind   Kind
+	start  time.Time
+
+	mu        sync.Mutex
+	end       time.Time
+	attrs     []attribute
+	status    int
+	statusMsg string
+	ended     bool
+}
+
+type attribute struct {
+	key   string
+	value any
+}
+
+// SetAttributes adds slog-style key/value pairs to the span.
+func (s *Span) SetAttributes(kv ...any) {
+	if s == nil || !s.sc.Sampled {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.attrs = appendAttrs(s.attrs, kv)
+}
+
+// RecordError marks the span as failed. A nil err is ignored.
+func (s *Span) RecordError(err error) {
+	if s == nil || err == nil || !s.sc.Sampled {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.status = statusError
+	s.statusMsg = err.Error()
+}
+
+// End finishes the span and hands it to the exporter. Only the first call
+// counts.
+func (s *Span) End() {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	if s.ended {
+		s.mu.Unlock()
+		return
+	}
+	s.ended = true
+	s.end = time.Now()
+	s.mu.Unlock()
+	if s.sc.Sampled {
+		s.tracer.enqueue(s)
+	}
+}
+
+func (s *Span) SpanContext() SpanContext {
+	if s == nil {
+		return SpanContext{}
+	}
+	return s.sc
+}
+
+type Config struct {
+	// Endpoint is the collector base URL, e.g. http://otel-collector:4318.
+	// Spans are posted to Endpoint + "/v1/traces" unless it already ends in a
+	// path.
+	Endpoint      string
+	ServiceName   string
+	SampleRatio   float64
+	Headers       map[string]string
+	BatchSize     int
+	QueueSize     int
+	FlushInterval time.Duration
+}
+
+type Tracer struct {
+	cfg      Config
+	exporter *exporter
+	logger   *slog.Logger
+
+	queue    chan *Span
+	flush    chan chan struct{}
+	stop     chan struct{}
+	stopped  chan struct{}
+	stopOnce sync.Once
+	dropped  atomic.Int64
+}
+
+func New(cfg Config, logger *slog.Logger) *Tracer {
+	if logger == nil {
+		logger = slog.Default()
+	}
+	if cfg.ServiceName == "" {
+		cfg.ServiceName = "mergend"
+	}
+	if cfg.BatchSize <= 0 {
+		cfg.BatchSize = 512
+	}
+	if cfg.QueueSize <= 0 {
+		cfg.QueueSize = 4096
+	}
+	if cfg.FlushInterval <= 0 {
+		cfg.FlushInterval = 5 * time.Second
+	}
+	if cfg.SampleRatio < 0 || cfg.SampleRatio > 1 || math.IsNaN(cfg.SampleRatio) {
+		cfg.SampleRatio = 1
+	}
+	t := &Tracer{
+		cfg:      cfg,
+		exporter: newExporter(cfg),
+		logger:   logger,
+		queue:    make(chan *Span, cfg.QueueSize),
+		flush:    make(chan chan struct{}),
+		stop:     make(chan struct{}),
+		stopped:  make(chan struct{}),
+	}
+	go t.loop()
+	logger.Debug("tracing enabled", "endpoint", t.exporter.url, "service", cfg.ServiceName, "sampleRatio", cfg.SampleRatio)
+	return t
+}
+
+// Shutdown exports whatever is queued and stops the exporter.
+func (t *Tracer) Shutdown(ctx context.Context) error {
+	if t == nil {
+		return nil
+	}
+	t.stopOnce.Do(func() { close(t.stop) })
+	select {
+	case <-t.stopped:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Flush exports queued spans now; mostly useful in tests.
+func (t *Tracer) Flush(ctx context.Context) {
+	done := make(chan struct{})
+	select {
+	case t.flush <- done:
+	case <-t.stopped:
+		return
+	case <-ctx.Done():
+		return
+	}
+	select {
+	case <-done:
+	case <-ctx.Done():
+	}
+}
+
+func (t *Tracer) Dropped() int64 {
+	return t.dropped.Load()
+}
+
+func (t *Tracer) enqueue(s *Span) {
+	select {
+	case t.queue <- s:
+	default:
+		if t.dropped.Add(1)%1000 == 1 {
+			t.logger.Warn("trace queue full, dropping spans", "dropped", t.dropped.Load())
+		}
+	}
+}
+
+func (t *Tracer) loop() {
+	defer close(t.stopped)
+	ticker := time.NewTicker(t.cfg.FlushInterval)
+	defer ticker.Stop()
+
+	batch := make([]*Span, 0, t.cfg.BatchSize)
+	export := func() {
+		if len(batch) == 0 {
+			return
+		}
+		if err := t.exporter.export(batch); err != nil {
+			t.logger.Warn("trace export failed", "spans", len(batch), "error", err)
+		}
+		batch = batch[:0]
+	}
+	drain := func() {
+		for {
+			select {
+			case s := <-t.queue:
+				batch = append(batch, s)
+				if len(batch) >= t.cfg.BatchSize {
+					export()
+				}
+			default:
+				return
+			}
+		}
+	}
+
+	for {
+		select {
+		case s := <-t.queue:
+			batch = append(batch, s)
+			if len(batch) >= t.cfg.BatchSize {
+				export()
+			}
+		case <-ticker.C:
+			export()
+		case done := <-t.flush:
+			drain()
+			export()
+			close(done)
+		case <-t.stop:
+			drain()
+			export()
+			return
+		}
+	}
+}
+
+func (t *Tracer) sampled() bool {
+	switch {
+	case t.cfg.SampleRatio >= 1:
+		return true
+	case t.cfg.SampleRatio <= 0:
+		return false
+	}
+	var buf [8]byte
+	_, _ = rand.Read(buf[:])
+	var n uint64
+	for _, b := range buf {
+		n = n<<8 | uint64(b)
+	}
+	return float64(n>>11)/float64(1<<53) < t.cfg.SampleRatio
+}
+
+var defaultTracer atomic.Pointer[Tracer]
+
+// SetDefault installs the tracer used by Start. Passing nil disables tracing.
+func SetDefault(t *Tracer) {
+	defaultTracer.Store(t)
+}
+
+type spanKey struct{}
+type remoteKey struct{}
+
+// Start opens an internal span as a child of the span in ctx.
+func Start(ctx context.Context, name string, kv ...any) (context.Context, *Span) {
+	return StartKind(ctx, KindInternal, name, kv...)
+}
+
+// StartKind opens a span of the given kind. Without a default tracer it
+// returns ctx unchanged and a nil span.
+func StartKind(ctx context.Context, kind Kind, name string, kv ...any) (context.Context, *Span) {
+	t := defaultTracer.Load()
+	if t == nil {
+		return ctx, nil
+	}
+	span := &Span{tracer: t, name: name, kind: kind, start: time.Now()}
+	if parent := SpanContextFrom(ctx); parent.IsValid() {
+		span.sc.TraceID = parent.TraceID
+		span.sc.Sampled = parent.Sampled
+		span.parent = parent.SpanID
+	} else {
+		_, _ = rand.Read(span.sc.TraceID[:])
+		span.sc.Sampled = t.sampled()
+	}
+	_, _ = rand.Read(span.sc.SpanID[:])
+	if span.sc.Sampled {
+		span.attrs = appendAttrs(nil, kv)
+	}
+	return context.WithValue(ctx, spanKey{}, span), span
+}
+
+// SpanContextFrom returns the active span in ctx, or the remote parent
+// extracted from an incoming traceparent header.
+func SpanContextFrom(ctx context.Context) SpanContext {
+	if ctx == nil {
+		return SpanContext{}
+	}
+	if span, ok := ctx.Value(spanKey{}).(*Span); ok && span != nil {
+		return span.sc
+	}
+	if sc, ok := ctx.Value(remoteKey{}).(SpanContext); ok {
+		return sc
+	}
+	return SpanContext{}
+}
+
+// Traceparent formats the active span as a W3C traceparent header value, or
+// returns "" when ctx carries no span.
+func Traceparent(ctx context.Context) string {
+	sc := SpanContextFrom(ctx)
+	if !sc.IsValid() {
+		return ""
+	}
+	flags := "00"
+	if sc.Sampled {
+		flags = "01"
+	}
+	return "00-" + hex.EncodeToString(sc.TraceID[:]) + "-" + hex.EncodeToString(sc.SpanID[:]) + "-" + flags
+}
+
+// Extract attaches a remote parent parsed from a traceparent header value.
+// Malformed values are ignored.
+func Extract(ctx context.Context, traceparent string) context.Context {
+	parts := strings.Split(strings.TrimSpace(traceparent), "-")
+	if len(parts) < 4 || len(parts[0]) != 2 || parts[0] == "ff" || len(parts[1]) != 32 || len(parts[2]) != 16 || len(parts[3]) != 2 {
+		return ctx
+	}
+	if parts[0] == "00" && len(parts) != 4 {
+		return ctx
+	}
+	var sc SpanContext
+	if _, err := hex.Decode(sc.TraceID[:], []byte(parts[1])); err != nil {
+		return ctx
+	}
+	if _, err := hex.Decode(sc.SpanID[:], []byte(parts[2])); err != nil {
+		return ctx
+	}
+	flags, err := hex.DecodeString(parts[3])
+	if err != nil || !sc.IsValid() {
+		return ctx
+	}
+	sc.Sampled = flags[0]&0x01 == 1
+	return context.WithValue(ctx, remoteKey{}, sc)
+}
+
+func appendAttrs(attrs []attribute, kv []any) []attribute {
+	for i := 0; i < len(kv); i += 2 {
+		key := fmt.Sprint(kv[i])
+		var value any
+		if i+1 < len(kv) {
+			value = kv[i+1]
+		}
+		attrs = append(attrs, attribute{key: key, value: value})
+	}
+	return attrs
+}
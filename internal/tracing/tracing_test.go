@@ -0,0 +1,89 @@
+package tracing
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+)
+
+func TestSpansExportWithParentLinks(t *testing.T) {
+	var (
+		mu       sync.Mutex
+		received []otlpSpan
+		header   string
+	)
+	collector := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/v1/traces" {
+			t.Errorf("unexpected path %s", r.URL.Path)
+		}
+		var req otlpRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			t.Errorf("decode: %v", err)
+		}
+		mu.Lock()
+		header = r.Header.Get("X-Tenant")
+		for _, rs := range req.ResourceSpans {
+			for _, ss := range rs.ScopeSpans {
+				received = append(received, ss.Spans...)
+			}
+		}
+		mu.Unlock()
+	}))
+	defer collector.Close()
+
+	tracer := New(Config{Endpoint: collector.URL, Headers: map[string]string{"X-Tenant": "mergen"}}, nil)
+	SetDefault(tracer)
+	defer SetDefault(nil)
+
+	ctx := Extract(context.Background(), "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+	ctx, parent := StartKind(ctx, KindServer, "POST /v1/vms", "http.method", "POST")
+	_, child := Start(ctx, "store.SaveVM", "vmID", "vm-1")
+	child.RecordError(errors.New("disk full"))
+	child.End()
+	parent.End()
+	tracer.Flush(context.Background())
+	if err := tracer.Shutdown(context.Background()); err != nil {
+		t.Fatalf("shutdown: %v", err)
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	if len(received) != 2 || header != "mergen" {
+		t.Fatalf("expected 2 spans with tenant header, got %d (%q)", len(received), header)
+	}
+	childSpan, parentSpan := received[0], received[1]
+	if parentSpan.TraceID != "4bf92f3577b34da6a3ce929d0e0e4736" || parentSpan.ParentSpanID != "00f067aa0ba902b7" {
+		t.Fatalf("server span did not continue the remote trace: %+v", parentSpan)
+	}
+	if childSpan.TraceID != parentSpan.TraceID || childSpan.ParentSpanID != parentSpan.SpanID {
+		t.Fatalf("child span not linked to parent: %+v", childSpan)
+	}
+	if childSpan.Status.Code != statusError || childSpan.Status.Message != "disk full" {
+		t.Fatalf("expected error status on child, got %+v", childSpan.Status)
+	}
+}
+
+func TestTraceparentRoundTrip(t *testing.T) {
+	if got := Traceparent(context.Background()); got != "" {
+		t.Fatalf("expected no traceparent without a span, got %q", got)
+	}
+	ctx, span := Start(context.Background(), "disabled")
+	if span != nil || Traceparent(ctx) != "" {
+		t.Fatal("expected nil span when tracing is disabled")
+	}
+	span.End()
+
+	const header = "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-00"
+	if got := Traceparent(Extract(context.Background(), header)); got != header {
+		t.Fatalf("expected %q, got %q", header, got)
+	}
+	for _, bad := range []string{"", "garbage", "00-00000000000000000000000000000000-00f067aa0ba902b7-01", "ff-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01"} {
+		if SpanContextFrom(Extract(context.Background(), bad)).IsValid() {
+			t.Fatalf("expected %q to be rejected", bad)
+		}
+	}
+}
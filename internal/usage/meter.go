@@ -0,0 +1,420 @@
+// Package usage samples the resource counters of running VMs into periodic
+// usage records and aggregates them into billing reports.
+package usage
+
+import (
+	"bufio"
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/alperreha/mergen-fire/internal/model"
+)
+
+const (
+	defaultInterval  = time.Minute
+	defaultTenantTag = "tenant"
+	dayLayout        = "2006-01-02"
+)
+
+var ErrInvalid = errors.New("invalid usage query")
+
+type Store interface {
+	ListMetas() ([]model.VMMetadata, error)
+	ReadVMConfig(id string) (model.VMConfig, error)
+}
+
+// counters is one reading of a VM's cumulative counters. They restart from
+// zero whenever the unit restarts.
+type counters struct {
+	at         time.Time
+	cpuUsec    int64
+	memoryPeak int64
+	rxBytes    int64
+	txBytes    int64
+	hasNetwork bool
+}
+
+// Meter reads each VM unit's cgroup and the network counters of its
+// Firecracker process, and appends one record per running VM per interval to
+// <dir>/usage-YYYY-MM-DD.jsonl (UTC days).
+type Meter struct {
+	store      Store
+	dir        string
+	unitPrefix string
+	tenantTag  string
+	interval   time.Duration
+	cgroupRoot string
+	procRoot   string
+	now        func() time.Time
+	logger     *slog.Logger
+
+	mu   sync.Mutex
+	last map[string]counters
+}
+
+func NewMeter(store Store, dir, unitPrefix string) *Meter {
+	if unitPrefix == "" {
+		unitPrefix = "mergen"
+	}
+	return &Meter{
+		store:      store,
+		dir:        dir,
+		unitPrefix: unitPrefix,
+		tenantTag:  defaultTenantTag,
+		interval:   defaultInterval,
+		cgroupRoot: "/sys/fs/cgroup/system.slice",
+		procRoot:   "/proc",
+		now:        time.Now,
+		logger:     slog.Default(),
+		last:       make(map[string]counters),
+	}
+}
+
+func (m *Meter) WithLogger(logger *slog.Logger) *Meter {
+	if logger != nil {
+		m.logger = logger
+	}
+	return m
+}
+
+func (m *Meter) WithInterval(interval time.Duration) *Meter {
+	if interval > 0 {
+		m.interval = interval
+	}
+	return m
+}
+
+func (m *Meter) WithTenantTag(tag string) *Meter {
+	if tag != "" {
+		m.tenantTag = tag
+	}
+	return m
+}
+
+// WithRoots points the meter at a different cgroup slice and procfs.
+func (m *Meter) WithRoots(cgroupRoot, procRoot string) *Meter {
+	m.cgroupRoot = cgroupRoot
+	m.procRoot = procRoot
+	return m
+}
+
+func (m *Meter) TenantTag() string {
+	return m.tenantTag
+}
+
+func (m *Meter) Run(ctx context.Context) {
+	m.logger.Info("usage metering scheduled", "interval", m.interval, "dir", m.dir, "tenantTag", m.tenantTag)
+	ticker := time.NewTicker(m.interval)
+	defer ticker.Stop()
+	for {
+		if _, err := m.Collect(); err != nil {
+			m.logger.Warn("usage collection failed", "error", err)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// Collect samples every VM and writes a record for each one that was running
+// at both this and the previous sample. A VM seen for the first time only
+// sets its baseline.
+func (m *Meter) Collect() ([]model.UsageRecord, error) {
+	metas, err := m.store.ListMetas()
+	if err != nil {
+		return nil, err
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	now := m.now().UTC()
+	seen := make(map[string]bool, len(metas))
+	var records []model.UsageRecord
+	for _, meta := range metas {
+		seen[meta.ID] = true
+		cur, ok := m.sample(meta, now)
+		if !ok {
+			delete(m.last, meta.ID)
+			continue
+		}
+		prev, hadPrev := m.last[meta.ID]
+		m.last[meta.ID] = cur
+		if !hadPrev {
+			continue
+		}
+		record := model.UsageRecord{
+			VMID:            meta.ID,
+			Tenant:          meta.Tags[m.tenantTag],
+			Tags:            meta.Tags,
+			Start:           prev.at,
+			End:             cur.at,
+			RuntimeSeconds:  cur.at.Sub(prev.at).Seconds(),
+			CPUSeconds:      float64(delta(prev.cpuUsec, cur.cpuUsec)) / 1e6,
+			MemoryPeakBytes: cur.memoryPeak,
+		}
+		if cur.hasNetwork && prev.hasNetwork {
+			record.RxBytes = delta(prev.rxBytes, cur.rxBytes)
+			record.TxBytes = delta(prev.txBytes, cur.txBytes)
+		}
+		if cfg, err := m.store.ReadVMConfig(meta.ID); err == nil {
+			record.VCPU = cfg.MachineConfig.VCPUCount
+			record.MemMiB = cfg.MachineConfig.MemSizeMiB
+		}
+		records = append(records, record)
+	}
+	for id := range m.last {
+		if !seen[id] {
+			delete(m.last, id)
+		}
+	}
+
+	if len(records) == 0 {
+		return nil, nil
+	}
+	if err := m.append(now, records); err != nil {
+		return records, err
+	}
+	m.logger.Debug("usage records written", "count", len(records))
+	return records, nil
+}
+
+// delta treats a counter that went backwards as restarted from zero.
+func delta(prev, cur int64) int64 {
+	if cur < prev {
+		return cur
+	}
+	return cur - prev
+}
+
+func (m *Meter) sample(meta model.VMMetadata, now time.Time) (counters, bool) {
+	unit := meta.Unit
+	if unit == "" {
+		unit = fmt.Sprintf("%s@%s.service", m.unitPrefix, meta.ID)
+	}
+	cgroup := filepath.Join(m.cgroupRoot, unit)
+	cpu, err := readKeyed(filepath.Join(cgroup, "cpu.stat"), "usage_usec")
+	if err != nil {
+		return counters{}, false
+	}
+	cur := counters{at: now, cpuUsec: cpu}
+	for _, name := range []string{"memory.peak", "memory.current"} {
+		if v, err := readInt(filepath.Join(cgroup, name)); err == nil {
+			cur.memoryPeak = v
+			break
+		}
+	}
+	if pid := m.firecrackerPID(cgroup); pid != "" {
+		rx, tx, err := readNetDev(filepath.Join(m.procRoot, pid, "net", "dev"), meta.TapName)
+		if err == nil {
+			cur.rxBytes, cur.txBytes, cur.hasNetwork = rx, tx, true
+		}
+	}
+	return cur, true
+}
+
+// firecrackerPID picks the firecracker process out of the unit's cgroup; it
+// is the one running inside the VM's network namespace.
+func (m *Meter) firecrackerPID(cgroup string) string {
+	raw, err := os.ReadFile(filepath.Join(cgroup, "cgroup.procs"))
+	if err != nil {
+		return ""
+	}
+	for _, pid := range strings.Fields(string(raw)) {
+		comm, err := os.ReadFile(filepath.Join(m.procRoot, pid, "comm"))
+		if err == nil && strings.TrimSpace(string(comm)) == "firecracker" {
+			return pid
+		}
+	}
+	return ""
+}
+
+func readInt(path string) (int64, error) {
+	raw, err := os.ReadFile(path)
+	if err != nil {
+		return 0, err
+	}
+	return strconv.ParseInt(strings.TrimSpace(string(raw)), 10, 64)
+}
+
+func readKeyed(path, key string) (int64, error) {
+	raw, err := os.ReadFile(path)
+	if err != nil {
+		return 0, err
+	}
+	for _, line := range strings.Split(string(raw), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) == 2 && fields[0] == key {
+			return strconv.ParseInt(fields[1], 10, 64)
+		}
+	}
+	return 0, fmt.Errorf("%s: no %s", path, key)
+}
+
+// readNetDev returns the guest's received and transmitted bytes, which are
+// the tap's transmit and receive counters. Without a tap name every
+// interface but loopback is summed.
+func readNetDev(path, tap string) (rx, tx int64, err error) {
+	raw, err := os.ReadFile(path)
+	if err != nil {
+		return 0, 0, err
+	}
+	for _, line := range strings.Split(string(raw), "\n") {
+		name, stats, ok := strings.Cut(line, ":")
+		name = strings.TrimSpace(name)
+		if !ok || name == "lo" || (tap != "" && name != tap) {
+			continue
+		}
+		fields := strings.Fields(stats)
+		if len(fields) < 9 {
+			continue
+		}
+		hostRx, err1 := strconv.ParseInt(fields[0], 10, 64)
+		hostTx, err2 := strconv.ParseInt(fields[8], 10, 64)
+		if err1 != nil || err2 != nil {
+			continue
+		}
+		rx += hostTx
+		tx += hostRx
+	}
+	return rx, tx, nil
+}
+
+func (m *Meter) fileFor(day time.Time) string {
+	return filepath.Join(m.dir, "usage-"+day.Format(dayLayout)+".jsonl")
+}
+
+func (m *Meter) append(now time.Time, records []model.UsageRecord) error {
+	if err := os.MkdirAll(m.dir, 0o750); err != nil {
+		return err
+	}
+	f, err := os.OpenFile(m.fileFor(now), os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0o640)
+	if err != nil {
+		return err
+	}
+	enc := json.NewEncoder(f)
+	for _, record := range records {
+		if err = enc.Encode(record); err != nil {
+			break
+		}
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+// Records returns the records that ended within [from, to).
+func (m *Meter) Records(from, to time.Time) ([]model.UsageRecord, error) {
+	if !to.After(from) {
+		return nil, fmt.Errorf("%w: to must be after from", ErrInvalid)
+	}
+	var records []model.UsageRecord
+	for day := from.UTC().Truncate(24 * time.Hour); day.Before(to); day = day.Add(24 * time.Hour) {
+		f, err := os.Open(m.fileFor(day))
+		if errors.Is(err, os.ErrNotExist) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		scanner := bufio.NewScanner(f)
+		for scanner.Scan() {
+			var record model.UsageRecord
+			if err := json.Unmarshal(scanner.Bytes(), &record); err != nil {
+				// A crash mid-append leaves a partial last line.
+				continue
+			}
+			if !record.End.Before(from) && record.End.Before(to) {
+				records = append(records, record)
+			}
+		}
+		err = scanner.Err()
+		_ = f.Close()
+		if err != nil {
+			return nil, err
+		}
+	}
+	return records, nil
+}
+
+// Report aggregates the records in [from, to) by the value of the groupBy
+// tag; an empty groupBy uses the tenant tag.
+func (m *Meter) Report(from, to time.Time, groupBy string) (model.UsageReport, error) {
+	if groupBy == "" {
+		groupBy = m.tenantTag
+	}
+	records, err := m.Records(from, to)
+	if err != nil {
+		return model.UsageReport{}, err
+	}
+	return Aggregate(records, from, to, groupBy), nil
+}
+
+func Aggregate(records []model.UsageRecord, from, to time.Time, groupBy string) model.UsageReport {
+	groups := make(map[string]*model.UsageGroup)
+	vms := make(map[string]map[string]bool)
+	for _, record := range records {
+		key := record.Tags[groupBy]
+		group, ok := groups[key]
+		if !ok {
+			group = &model.UsageGroup{Key: key}
+			groups[key] = group
+			vms[key] = make(map[string]bool)
+		}
+		vms[key][record.VMID] = true
+		group.RuntimeSeconds += record.RuntimeSeconds
+		group.CPUSeconds += record.CPUSeconds
+		group.VCPUSeconds += record.RuntimeSeconds * float64(record.VCPU)
+		group.MemoryMiBSeconds += record.RuntimeSeconds * float64(record.MemMiB)
+		group.MemoryPeakBytes = max(group.MemoryPeakBytes, record.MemoryPeakBytes)
+		group.RxBytes += record.RxBytes
+		group.TxBytes += record.TxBytes
+	}
+	report := model.UsageReport{From: from.UTC(), To: to.UTC(), GroupBy: groupBy, Groups: []model.UsageGroup{}}
+	for key, group := range groups {
+		group.VMs = len(vms[key])
+		report.Groups = append(report.Groups, *group)
+	}
+	sort.Slice(report.Groups, func(i, j int) bool { return report.Groups[i].Key < report.Groups[j].Key })
+	return report
+}
+
+// WriteCSV writes one row per group with a header row.
+func WriteCSV(w io.Writer, report model.UsageReport) error {
+	out := csv.NewWriter(w)
+	_ = out.Write([]string{report.GroupBy, "from", "to", "vms", "runtime_seconds", "cpu_seconds", "vcpu_seconds", "memory_mib_seconds", "memory_peak_bytes", "rx_bytes", "tx_bytes"})
+	from, to := report.From.Format(time.RFC3339), report.To.Format(time.RFC3339)
+	for _, g := range report.Groups {
+		_ = out.Write([]string{
+			g.Key, from, to,
+			strconv.Itoa(g.VMs),
+			formatFloat(g.RuntimeSeconds),
+			formatFloat(g.CPUSeconds),
+			formatFloat(g.VCPUSeconds),
+			formatFloat(g.MemoryMiBSeconds),
+			strconv.FormatInt(g.MemoryPeakBytes, 10),
+			strconv.FormatInt(g.RxBytes, 10),
+			strconv.FormatInt(g.TxBytes, 10),
+		})
+	}
+	out.Flush()
+	return out.Error()
+}
+
+func formatFloat(v float64) string {
+	return strconv.FormatFloat(v, 'f', 3, 64)
+}
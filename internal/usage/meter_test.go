@@ -0,0 +1,125 @@
+package usage
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/alperreha/mergen-fire/internal/model"
+)
+
+type fakeStore struct {
+	metas []model.VMMetadata
+}
+
+func (f fakeStore) ListMetas() ([]model.VMMetadata, error) {
+	return f.metas, nil
+}
+
+func (f fakeStore) ReadVMConfig(string) (model.VMConfig, error) {
+	return model.VMConfig{MachineConfig: model.MachineConfig{VCPUCount: 2, MemSizeMiB: 512}}, nil
+}
+
+func writeFile(t *testing.T, path, content string) {
+	t.Helper()
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(path, []byte(content), 0o644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// writeCounters fakes vm1's unit cgroup and the net/dev of its firecracker
+// process; hostRx/hostTx are the tap's counters as the host sees them.
+func writeCounters(t *testing.T, cgroupRoot, procRoot string, cpuUsec, hostRx, hostTx int) {
+	t.Helper()
+	cgroup := filepath.Join(cgroupRoot, "mergen@vm1.service")
+	writeFile(t, filepath.Join(cgroup, "cpu.stat"), "usage_usec "+strconv.Itoa(cpuUsec)+"\nuser_usec 1\n")
+	writeFile(t, filepath.Join(cgroup, "memory.peak"), "1048576\n")
+	writeFile(t, filepath.Join(cgroup, "cgroup.procs"), "41\n42\n")
+	writeFile(t, filepath.Join(procRoot, "41", "comm"), "bash\n")
+	writeFile(t, filepath.Join(procRoot, "42", "comm"), "firecracker\n")
+	writeFile(t, filepath.Join(procRoot, "42", "net", "dev"),
+		"Inter-|   Receive |  Transmit\n face |bytes packets errs drop fifo frame compressed multicast|bytes packets\n"+
+			"    lo: 999 1 0 0 0 0 0 0 999 1 0 0 0 0 0 0\n"+
+			"tap-vm1: "+strconv.Itoa(hostRx)+" 1 0 0 0 0 0 0 "+strconv.Itoa(hostTx)+" 1 0 0 0 0 0 0\n")
+}
+
+func TestMeterCollectAndReport(t *testing.T) {
+	root := t.TempDir()
+	cgroupRoot, procRoot := filepath.Join(root, "cgroup"), filepath.Join(root, "proc")
+	store := fakeStore{metas: []model.VMMetadata{
+		{ID: "vm1", TapName: "tap-vm1", Tags: map[string]string{"tenant": "acme"}},
+		{ID: "vm2", Tags: map[string]string{"tenant": "acme"}},
+	}}
+	clock := time.Date(2026, 10, 16, 23, 59, 0, 0, time.UTC)
+	meter := NewMeter(store, filepath.Join(root, "usage"), "mergen").WithRoots(cgroupRoot, procRoot)
+	meter.now = func() time.Time { return clock }
+
+	writeCounters(t, cgroupRoot, procRoot, 1_000_000, 100, 50)
+	records, err := meter.Collect()
+	if err != nil || len(records) != 0 {
+		t.Fatalf("first Collect() = %v, %v; want baseline only", records, err)
+	}
+
+	clock = clock.Add(time.Minute)
+	writeCounters(t, cgroupRoot, procRoot, 4_000_000, 300, 1050)
+	records, err = meter.Collect()
+	if err != nil {
+		t.Fatalf("Collect() error = %v", err)
+	}
+	if len(records) != 1 {
+		t.Fatalf("Collect() wrote %d records, want 1 (vm2 has no cgroup)", len(records))
+	}
+	got := records[0]
+	if got.VMID != "vm1" || got.Tenant != "acme" || got.RuntimeSeconds != 60 || got.CPUSeconds != 3 {
+		t.Fatalf("unexpected record: %+v", got)
+	}
+	if got.RxBytes != 1000 || got.TxBytes != 200 {
+		t.Fatalf("rx/tx = %d/%d, want guest view 1000/200", got.RxBytes, got.TxBytes)
+	}
+	if got.VCPU != 2 || got.MemMiB != 512 || got.MemoryPeakBytes != 1048576 {
+		t.Fatalf("unexpected allocation: %+v", got)
+	}
+	if _, err := os.Stat(filepath.Join(root, "usage", "usage-2026-10-17.jsonl")); err != nil {
+		t.Fatalf("record file for the end day missing: %v", err)
+	}
+
+	// A restarted unit starts its counters from zero again.
+	clock = clock.Add(time.Minute)
+	writeCounters(t, cgroupRoot, procRoot, 500_000, 0, 0)
+	records, err = meter.Collect()
+	if err != nil || len(records) != 1 || records[0].CPUSeconds != 0.5 {
+		t.Fatalf("Collect() after restart = %+v, %v", records, err)
+	}
+
+	report, err := meter.Report(clock.Add(-time.Hour), clock.Add(time.Second), "")
+	if err != nil {
+		t.Fatalf("Report() error = %v", err)
+	}
+	if report.GroupBy != "tenant" || len(report.Groups) != 1 {
+		t.Fatalf("unexpected report: %+v", report)
+	}
+	group := report.Groups[0]
+	if group.Key != "acme" || group.VMs != 1 || group.RuntimeSeconds != 120 || group.VCPUSeconds != 240 || group.MemoryMiBSeconds != 61440 {
+		t.Fatalf("unexpected group: %+v", group)
+	}
+
+	var buf bytes.Buffer
+	if err := WriteCSV(&buf, report); err != nil {
+		t.Fatalf("WriteCSV() error = %v", err)
+	}
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	if len(lines) != 2 || !strings.HasPrefix(lines[0], "tenant,from,to,vms,") || !strings.HasPrefix(lines[1], "acme,") {
+		t.Fatalf("unexpected csv:\n%s", buf.String())
+	}
+
+	if _, err := meter.Report(clock, clock, ""); err == nil {
+		t.Fatalf("Report() with an empty range should fail")
+	}
+}
@@ -0,0 +1,808 @@
+// Package client is a typed Go client for the mergend HTTP API.
+//
+//	c := client.New("http://127.0.0.1:8080")
+//	id, err := c.CreateVM(ctx, client.CreateVMRequest{...})
+//	err = c.StartVM(ctx, id)
+//
+// Idempotent calls are retried on connection errors and 502/503/504
+// responses; CreateVM is sent once.
+package client
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/alperreha/mergen-fire/internal/tracing"
+)
+
+var (
+	ErrInvalidRequest       = errors.New("invalid request")
+	ErrNotFound             = errors.New("not found")
+	ErrConflict             = errors.New("conflict")
+	ErrPreconditionFailed   = errors.New("precondition failed")
+	ErrPreconditionRequired = errors.New("precondition required")
+	ErrUnavailable          = errors.New("dependency unavailable")
+	ErrQuotaExceeded        = errors.New("quota exceeded")
+)
+
+// APIError is a non-2xx response. errors.Is matches it against the Err*
+// values by status code, and ErrQuotaExceeded by error code, since a 403
+// may also be a token's scope.
+type APIError struct {
+	StatusCode int
+	Code       string `json:"error"`
+	Message    string `json:"message"`
+}
+
+func (e *APIError) Error() string {
+	if e.Message == "" {
+		return fmt.Sprintf("mergend: %d %s", e.StatusCode, http.StatusText(e.StatusCode))
+	}
+	return fmt.Sprintf("mergend: %d %s: %s", e.StatusCode, e.Code, e.Message)
+}
+
+func (e *APIError) Is(target error) bool {
+	switch target {
+	case ErrInvalidRequest:
+		return e.StatusCode == http.StatusBadRequest
+	case ErrNotFound:
+		return e.StatusCode == http.StatusNotFound
+	case ErrConflict:
+		return e.StatusCode == http.StatusConflict
+	case ErrPreconditionFailed:
+		return e.StatusCode == http.StatusPreconditionFailed
+	case ErrPreconditionRequired:
+		return e.StatusCode == http.StatusPreconditionRequired
+	case ErrUnavailable:
+		return e.StatusCode == http.StatusServiceUnavailable
+	case ErrQuotaExceeded:
+		return e.StatusCode == http.StatusForbidden && e.Code == "quota_exceeded"
+	}
+	return false
+}
+
+type Client struct {
+	baseURL    string
+	httpClient *http.Client
+	header     http.Header
+	maxRetries int
+	backoff    time.Duration
+}
+
+// New returns a client for the mergend API at baseURL, e.g.
+// "https://mergend.internal:8080".
+func New(baseURL string) *Client {
+	return &Client{
+		baseURL:    strings.TrimRight(baseURL, "/"),
+		httpClient: &http.Client{Timeout: 30 * time.Second},
+		header:     http.Header{},
+		maxRetries: 3,
+		backoff:    200 * time.Millisecond,
+	}
+}
+
+// WithHTTPClient sets the underlying client, e.g. one carrying client
+// certificates for an mTLS API.
+func (c *Client) WithHTTPClient(httpClient *http.Client) *Client {
+	if httpClient != nil {
+		c.httpClient = httpClient
+	}
+	return c
+}
+
+// WithHeader adds a header to every request.
+func (c *Client) WithHeader(key, value string) *Client {
+	c.header.Add(key, value)
+	return c
+}
+
+// WithRetries sets how often an idempotent call is retried and the first
+// backoff, which doubles per attempt. Zero retries disables retrying.
+func (c *Client) WithRetries(maxRetries int, backoff time.Duration) *Client {
+	if maxRetries >= 0 {
+		c.maxRetries = maxRetries
+	}
+	if backoff > 0 {
+		c.backoff = backoff
+	}
+	return c
+}
+
+func (c *Client) CreateVM(ctx context.Context, req CreateVMRequest) (string, error) {
+	var out struct {
+		ID string `json:"id"`
+	}
+	if err := c.do(ctx, http.MethodPost, "/v1/vms", nil, req, &out, false); err != nil {
+		return "", err
+	}
+	return out.ID, nil
+}
+
+// CreateVMAsync queues a create and returns its job at once; poll it with
+// GetJob or WaitJob. The job's VMID names the VM once it exists.
+func (c *Client) CreateVMAsync(ctx context.Context, req CreateVMRequest) (Job, error) {
+	var job Job
+	err := c.do(ctx, http.MethodPost, "/v1/vms", url.Values{"async": {"true"}}, req, &job, false)
+	return job, err
+}
+
+func (c *Client) GetJob(ctx context.Context, id string) (Job, error) {
+	var job Job
+	err := c.do(ctx, http.MethodGet, "/v1/operations/"+url.PathEscape(id), nil, nil, &job, true)
+	return job, err
+}
+
+// WaitJob polls job id every interval until it has finished. A job that
+// failed is returned without an error; see its Status, Error and Message.
+func (c *Client) WaitJob(ctx context.Context, id string, interval time.Duration) (Job, error) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		job, err := c.GetJob(ctx, id)
+		if err != nil || job.FinishedAt != nil {
+			return job, err
+		}
+		select {
+		case <-ctx.Done():
+			return job, ctx.Err()
+		case <-ticker.C:
+		}
+	}
+}
+
+// AdoptVM registers a Firecracker VM started outside mergen and returns
+// its id.
+func (c *Client) AdoptVM(ctx context.Context, req AdoptVMRequest) (string, error) {
+	var out struct {
+		ID string `json:"id"`
+	}
+	if err := c.do(ctx, http.MethodPost, "/v1/vms/adopt", nil, req, &out, false); err != nil {
+		return "", err
+	}
+	return out.ID, nil
+}
+
+func (c *Client) GetVM(ctx context.Context, id string) (VMSummary, error) {
+	var vm VMSummary
+	err := c.do(ctx, http.MethodGet, vmPath(id), nil, nil, &vm, true)
+	return vm, err
+}
+
+// ListVMs lists all VMs. Naming fields, e.g. "network" and "tags", returns
+// only those parts of each summary besides its ID.
+func (c *Client) ListVMs(ctx context.Context, fields ...string) ([]VMSummary, error) {
+	return c.ListVMsMatching(ctx, VMFilter{}, fields...)
+}
+
+// ListVMsMatching lists the VMs carrying every tag and metadata value of
+// filter; fields narrows the summaries like ListVMs.
+func (c *Client) ListVMsMatching(ctx context.Context, filter VMFilter, fields ...string) ([]VMSummary, error) {
+	vms, _, err := c.ListVMPage(ctx, filter, VMListPage{}, fields...)
+	return vms, err
+}
+
+// ListVMPage lists one page of the VMs filter selects and returns the
+// cursor of the next page, empty after the last one. A filter naming a
+// namespace lists through that namespace's routes, which is all a token
+// limited to it may use.
+func (c *Client) ListVMPage(ctx context.Context, filter VMFilter, page VMListPage, fields ...string) ([]VMSummary, string, error) {
+	var out struct {
+		Items      []VMSummary `json:"items"`
+		NextCursor string      `json:"nextCursor"`
+	}
+	query := url.Values{}
+	if page.Limit > 0 {
+		query.Set("limit", strconv.Itoa(page.Limit))
+	}
+	if page.Cursor != "" {
+		query.Set("cursor", page.Cursor)
+	}
+	if page.Sort != "" {
+		query.Set("sort", page.Sort)
+	}
+	if len(fields) > 0 {
+		query.Set("fields", strings.Join(fields, ","))
+	}
+	for key, value := range filter.Tags {
+		query.Add("tag", key+":"+value)
+	}
+	for path, value := range filter.Metadata {
+		query.Set("metadata."+path, value)
+	}
+	path := "/v1/vms"
+	if filter.Namespace != "" {
+		path = namespacePath(filter.Namespace) + "/vms"
+	}
+	err := c.do(ctx, http.MethodGet, path, query, nil, &out, true)
+	return out.Items, out.NextCursor, err
+}
+
+// StartVM and StopVM are no-ops on a VM already in that state, so they are
+// retried like reads.
+func (c *Client) StartVM(ctx context.Context, id string) error {
+	return c.do(ctx, http.MethodPost, vmPath(id)+"/start", nil, nil, nil, true)
+}
+
+func (c *Client) StopVM(ctx context.Context, id string) error {
+	return c.do(ctx, http.MethodPost, vmPath(id)+"/stop", nil, nil, nil, true)
+}
+
+// BatchVMs runs one action on many VMs. Per-VM failures are reported in
+// the results, not as an error.
+func (c *Client) BatchVMs(ctx context.Context, req BatchVMRequest) (BatchVMResponse, error) {
+	var out BatchVMResponse
+	err := c.do(ctx, http.MethodPost, "/v1/vms:batch", nil, req, &out, req.Action != BatchRestart)
+	return out, err
+}
+
+// PauseVM and ResumeVM are likewise no-ops on a VM already paused or
+// running.
+func (c *Client) PauseVM(ctx context.Context, id string) error {
+	return c.do(ctx, http.MethodPost, vmPath(id)+"/pause", nil, nil, nil, true)
+}
+
+func (c *Client) ResumeVM(ctx context.Context, id string) error {
+	return c.do(ctx, http.MethodPost, vmPath(id)+"/resume", nil, nil, nil, true)
+}
+
+// WakeVM starts a VM with an idle timeout and, with a port, waits until the
+// guest accepts connections on it for up to timeout (0 uses the server
+// default). It is not retried: a failed wake has already waited.
+func (c *Client) WakeVM(ctx context.Context, id string, port int, timeout time.Duration) error {
+	req := WakeVMRequest{Port: port, TimeoutSeconds: int(timeout.Round(time.Second) / time.Second)}
+	return c.do(ctx, http.MethodPost, vmPath(id)+"/wake", nil, req, nil, false)
+}
+
+// ExecVM runs a command in the guest and returns its output and exit code;
+// a non-zero exit code is not an error. It is not retried. Commands that
+// may run longer than the HTTP client's timeout need a client set with
+// WithHTTPClient.
+func (c *Client) ExecVM(ctx context.Context, id string, req ExecRequest) (ExecResult, error) {
+	var result ExecResult
+	err := c.do(ctx, http.MethodPost, vmPath(id)+"/exec", nil, req, &result, false)
+	return result, err
+}
+
+// ReportActivity tells mergend the VMs of ids had traffic, which postpones
+// their idle stops.
+func (c *Client) ReportActivity(ctx context.Context, ids []string) error {
+	return c.do(ctx, http.MethodPost, "/v1/vms/activity", nil, ActivityReport{IDs: ids}, nil, true)
+}
+
+// RestartVM stops the VM, killing it when a graceful stop takes longer than
+// timeout (0 uses the server default), and starts it again. It is not
+// retried: a second attempt would restart the VM again.
+func (c *Client) RestartVM(ctx context.Context, id string, timeout time.Duration) (SystemdState, error) {
+	query := url.Values{}
+	if timeout > 0 {
+		query.Set("timeout", strconv.Itoa(int(timeout.Round(time.Second)/time.Second)))
+	}
+	var out struct {
+		Systemd SystemdState `json:"systemd"`
+	}
+	err := c.do(ctx, http.MethodPost, vmPath(id)+"/restart", query, nil, &out, false)
+	return out.Systemd, err
+}
+
+// CreateSnapshot saves the run state of a running VM. It is not retried: a
+// second attempt would take another snapshot.
+func (c *Client) CreateSnapshot(ctx context.Context, id string, req CreateSnapshotRequest) (Snapshot, error) {
+	var snap Snapshot
+	err := c.do(ctx, http.MethodPost, vmPath(id)+"/snapshots", nil, req, &snap, false)
+	return snap, err
+}
+
+func (c *Client) ListSnapshots(ctx context.Context, id string) ([]Snapshot, error) {
+	var out struct {
+		Items []Snapshot `json:"items"`
+	}
+	err := c.do(ctx, http.MethodGet, vmPath(id)+"/snapshots", nil, nil, &out, true)
+	return out.Items, err
+}
+
+// DeleteSnapshot removes the snapshot named by ID or name.
+func (c *Client) DeleteSnapshot(ctx context.Context, id, snapshot string) error {
+	return c.do(ctx, http.MethodDelete, vmPath(id)+"/snapshots/"+url.PathEscape(snapshot), nil, nil, nil, true)
+}
+
+// RestoreSnapshot boots the VM from the snapshot named by ID or name,
+// discarding its current run state. It is not retried.
+func (c *Client) RestoreSnapshot(ctx context.Context, id, snapshot string) (Snapshot, error) {
+	var out struct {
+		Snapshot Snapshot `json:"snapshot"`
+	}
+	err := c.do(ctx, http.MethodPost, vmPath(id)+"/restore", nil, RestoreSnapshotRequest{Snapshot: snapshot}, &out, false)
+	return out.Snapshot, err
+}
+
+func (c *Client) DeleteVM(ctx context.Context, id string, retainData bool) error {
+	query := url.Values{}
+	if retainData {
+		query.Set("retainData", "true")
+	}
+	return c.do(ctx, http.MethodDelete, vmPath(id), query, nil, nil, true)
+}
+
+// UpdateVM patches tags, metadata or log policy. A non-nil revision is sent
+// as If-Match, failing with ErrPreconditionFailed if the VM changed since.
+func (c *Client) UpdateVM(ctx context.Context, id string, revision *int64, req UpdateVMRequest) (VMSummary, error) {
+	var vm VMSummary
+	header := http.Header{}
+	if revision != nil {
+		header.Set("If-Match", `"`+strconv.FormatInt(*revision, 10)+`"`)
+	}
+	err := c.doWithHeader(ctx, http.MethodPatch, vmPath(id), nil, header, req, &vm, revision != nil)
+	return vm, err
+}
+
+// RecreateVM replaces the VM with a new one built from its stored spec and
+// returns the new VM, which has a new ID.
+func (c *Client) RecreateVM(ctx context.Context, id string, req RecreateVMRequest) (VMSummary, error) {
+	var vm VMSummary
+	err := c.do(ctx, http.MethodPost, vmPath(id)+"/recreate", nil, req, &vm, false)
+	return vm, err
+}
+
+// StateHistory returns the VM's state transitions, newest first; limit 0
+// returns all of them.
+func (c *Client) StateHistory(ctx context.Context, id string, limit int) ([]StateTransition, error) {
+	query := url.Values{}
+	if limit > 0 {
+		query.Set("limit", strconv.Itoa(limit))
+	}
+	var out struct {
+		Items []StateTransition `json:"items"`
+	}
+	err := c.do(ctx, http.MethodGet, vmPath(id)+"/history", query, nil, &out, true)
+	return out.Items, err
+}
+
+// GuestStats returns the latest resource sample the VM's init reported.
+func (c *Client) GuestStats(ctx context.Context, id string) (GuestStats, error) {
+	var out GuestStats
+	err := c.do(ctx, http.MethodGet, vmPath(id)+"/stats", nil, nil, &out, true)
+	return out, err
+}
+
+// VMMetrics returns the Firecracker metrics mergend collected for the VM.
+func (c *Client) VMMetrics(ctx context.Context, id string) (VMMetrics, error) {
+	var out VMMetrics
+	err := c.do(ctx, http.MethodGet, vmPath(id)+"/metrics", nil, nil, &out, true)
+	return out, err
+}
+
+// VMMetricsTotals returns the metrics of every VM of the host added up.
+func (c *Client) VMMetricsTotals(ctx context.Context) (VMMetricsTotals, error) {
+	var out VMMetricsTotals
+	err := c.do(ctx, http.MethodGet, "/v1/metrics", nil, nil, &out, true)
+	return out, err
+}
+
+// VMLogs copies a file of the VM's logs dir into w as plain text. With
+// req.Follow it returns only when ctx ends or the server closes the stream.
+func (c *Client) VMLogs(ctx context.Context, id string, req VMLogsRequest, w io.Writer) error {
+	query := url.Values{}
+	if req.File != "" {
+		query.Set("file", req.File)
+	}
+	if req.Tail > 0 {
+		query.Set("tail", strconv.Itoa(req.Tail))
+	}
+	if req.Follow {
+		query.Set("follow", "true")
+	}
+	resp, err := c.sendWithRetry(ctx, http.MethodGet, vmPath(id)+"/logs", query, nil, nil, !req.Follow)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	_, err = io.Copy(w, resp.Body)
+	if req.Follow && ctx.Err() != nil {
+		return nil
+	}
+	return err
+}
+
+func (c *Client) HookHistory(ctx context.Context, id string, limit int) ([]HookExecution, error) {
+	query := url.Values{}
+	if limit > 0 {
+		query.Set("limit", strconv.Itoa(limit))
+	}
+	var out struct {
+		Items []HookExecution `json:"items"`
+	}
+	err := c.do(ctx, http.MethodGet, vmPath(id)+"/hooks/history", query, nil, &out, true)
+	return out.Items, err
+}
+
+func (c *Client) TestHook(ctx context.Context, id string, req HookTestRequest) (HookTestResult, error) {
+	var result HookTestResult
+	err := c.do(ctx, http.MethodPost, vmPath(id)+"/hooks/test", nil, req, &result, false)
+	return result, err
+}
+
+func (c *Client) VerifyArtifacts(ctx context.Context, id string, record bool) (ArtifactReport, error) {
+	query := url.Values{}
+	if record {
+		query.Set("record", "true")
+	}
+	var report ArtifactReport
+	err := c.do(ctx, http.MethodPost, vmPath(id)+"/verify", query, nil, &report, !record)
+	return report, err
+}
+
+func (c *Client) UnlockVM(ctx context.Context, id string, force bool) (LockStatus, error) {
+	query := url.Values{}
+	if force {
+		query.Set("force", "true")
+	}
+	var status LockStatus
+	err := c.do(ctx, http.MethodPost, vmPath(id)+"/unlock", query, nil, &status, true)
+	return status, err
+}
+
+// MigrateVM moves the VM to another host of the cluster; a running VM is
+// migrated live. It is not retried: the VM may already be on its way.
+func (c *Client) MigrateVM(ctx context.Context, id, host string) (MigrationResult, error) {
+	var result MigrationResult
+	err := c.do(ctx, http.MethodPost, vmPath(id)+"/migrate", nil, MigrateVMRequest{Host: host}, &result, false)
+	return result, err
+}
+
+// CreateStack creates every member of the manifest; a stack name that is
+// taken fails with ErrConflict.
+func (c *Client) CreateStack(ctx context.Context, manifest StackManifest) (Stack, error) {
+	var stack Stack
+	err := c.do(ctx, http.MethodPost, "/v1/stacks", nil, manifest, &stack, false)
+	return stack, err
+}
+
+func (c *Client) ListStacks(ctx context.Context) ([]Stack, error) {
+	var out struct {
+		Items []Stack `json:"items"`
+	}
+	err := c.do(ctx, http.MethodGet, "/v1/stacks", nil, nil, &out, true)
+	return out.Items, err
+}
+
+func (c *Client) GetStack(ctx context.Context, name string) (Stack, error) {
+	var stack Stack
+	err := c.do(ctx, http.MethodGet, stackPath(name), nil, nil, &stack, true)
+	return stack, err
+}
+
+func (c *Client) StartStack(ctx context.Context, name string) (Stack, error) {
+	var stack Stack
+	err := c.do(ctx, http.MethodPost, stackPath(name)+"/start", nil, nil, &stack, true)
+	return stack, err
+}
+
+func (c *Client) StopStack(ctx context.Context, name string) (Stack, error) {
+	var stack Stack
+	err := c.do(ctx, http.MethodPost, stackPath(name)+"/stop", nil, nil, &stack, true)
+	return stack, err
+}
+
+func (c *Client) DeleteStack(ctx context.Context, name string, retainData bool) error {
+	query := url.Values{}
+	if retainData {
+		query.Set("retainData", "true")
+	}
+	return c.do(ctx, http.MethodDelete, stackPath(name), query, nil, nil, true)
+}
+
+func (c *Client) ListPortReservations(ctx context.Context) ([]PortReservation, error) {
+	var out struct {
+		Items []PortReservation `json:"items"`
+	}
+	err := c.do(ctx, http.MethodGet, "/v1/ports", nil, nil, &out, true)
+	return out.Items, err
+}
+
+// ReservePort holds req.Port, or the next free host port when it is 0, for
+// a VM created later with that port in ports[].host.
+func (c *Client) ReservePort(ctx context.Context, req PortReservationRequest) (PortReservation, error) {
+	var res PortReservation
+	err := c.do(ctx, http.MethodPost, "/v1/ports/reserve", nil, req, &res, false)
+	return res, err
+}
+
+func (c *Client) ReleasePort(ctx context.Context, port int) error {
+	return c.do(ctx, http.MethodPost, "/v1/ports/release", nil, PortReleaseRequest{Port: port}, nil, false)
+}
+
+func (c *Client) ListKernels(ctx context.Context) ([]Kernel, error) {
+	var out struct {
+		Items []Kernel `json:"items"`
+	}
+	err := c.do(ctx, http.MethodGet, "/v1/kernels", nil, nil, &out, true)
+	return out.Items, err
+}
+
+func (c *Client) GetKernel(ctx context.Context, name string) (Kernel, error) {
+	var kernel Kernel
+	err := c.do(ctx, http.MethodGet, kernelPath(name), nil, nil, &kernel, true)
+	return kernel, err
+}
+
+// PutKernel registers or replaces kernel.Name; the image must already be on
+// the host at kernel.Path.
+func (c *Client) PutKernel(ctx context.Context, kernel Kernel) (Kernel, error) {
+	var out Kernel
+	err := c.do(ctx, http.MethodPut, kernelPath(kernel.Name), nil, kernel, &out, true)
+	return out, err
+}
+
+func (c *Client) DeleteKernel(ctx context.Context, name string) error {
+	return c.do(ctx, http.MethodDelete, kernelPath(name), nil, nil, nil, true)
+}
+
+func (c *Client) ListTemplates(ctx context.Context) ([]VMTemplate, error) {
+	var out struct {
+		Items []VMTemplate `json:"items"`
+	}
+	err := c.do(ctx, http.MethodGet, "/v1/templates", nil, nil, &out, true)
+	return out.Items, err
+}
+
+func (c *Client) GetTemplate(ctx context.Context, name string) (VMTemplate, error) {
+	var template VMTemplate
+	err := c.do(ctx, http.MethodGet, templatePath(name), nil, nil, &template, true)
+	return template, err
+}
+
+// PutTemplate registers or replaces template.Name. Create VMs from it with
+// CreateVMRequest.Template.
+func (c *Client) PutTemplate(ctx context.Context, template VMTemplate) (VMTemplate, error) {
+	var out VMTemplate
+	err := c.do(ctx, http.MethodPut, templatePath(template.Name), nil, template, &out, true)
+	return out, err
+}
+
+func (c *Client) DeleteTemplate(ctx context.Context, name string) error {
+	return c.do(ctx, http.MethodDelete, templatePath(name), nil, nil, nil, true)
+}
+
+// ListNamespaces returns every namespace with what its VMs use.
+func (c *Client) ListNamespaces(ctx context.Context) ([]Namespace, error) {
+	var out struct {
+		Items []Namespace `json:"items"`
+	}
+	err := c.do(ctx, http.MethodGet, "/v1/namespaces", nil, nil, &out, true)
+	return out.Items, err
+}
+
+func (c *Client) GetNamespace(ctx context.Context, name string) (Namespace, error) {
+	var namespace Namespace
+	err := c.do(ctx, http.MethodGet, namespacePath(name), nil, nil, &namespace, true)
+	return namespace, err
+}
+
+// PutNamespace registers namespace.Name or replaces its quota. Create VMs
+// in it with CreateVMRequest.Namespace.
+func (c *Client) PutNamespace(ctx context.Context, namespace Namespace) (Namespace, error) {
+	var out Namespace
+	err := c.do(ctx, http.MethodPut, namespacePath(namespace.Name), nil, namespace, &out, true)
+	return out, err
+}
+
+func (c *Client) DeleteNamespace(ctx context.Context, name string) error {
+	return c.do(ctx, http.MethodDelete, namespacePath(name), nil, nil, nil, true)
+}
+
+func (c *Client) HostDiagnostics(ctx context.Context) (HostDiagnostics, error) {
+	var report HostDiagnostics
+	err := c.do(ctx, http.MethodGet, "/v1/host/diagnostics", nil, nil, &report, true)
+	return report, err
+}
+
+// HostCapacity returns what the host admits and what its VMs commit.
+func (c *Client) HostCapacity(ctx context.Context) (HostCapacity, error) {
+	var capacity HostCapacity
+	err := c.do(ctx, http.MethodGet, "/v1/host/capacity", nil, nil, &capacity, true)
+	return capacity, err
+}
+
+// Usage returns consumption in [from, to) grouped by the groupBy tag; zero
+// times and an empty groupBy leave the server defaults in place.
+func (c *Client) Usage(ctx context.Context, from, to time.Time, groupBy string) (UsageReport, error) {
+	query := url.Values{}
+	if !from.IsZero() {
+		query.Set("from", from.UTC().Format(time.RFC3339))
+	}
+	if !to.IsZero() {
+		query.Set("to", to.UTC().Format(time.RFC3339))
+	}
+	if groupBy != "" {
+		query.Set("groupBy", groupBy)
+	}
+	var report UsageReport
+	err := c.do(ctx, http.MethodGet, "/v1/usage", query, nil, &report, true)
+	return report, err
+}
+
+// Audit lists the mutating API calls recorded by mergend that match
+// filter, newest first. It needs an admin token.
+func (c *Client) Audit(ctx context.Context, filter AuditFilter) ([]AuditEntry, error) {
+	query := url.Values{}
+	for key, value := range map[string]string{"vm": filter.VMID, "token": filter.Token, "action": filter.Action, "namespace": filter.Namespace} {
+		if value != "" {
+			query.Set(key, value)
+		}
+	}
+	if !filter.Since.IsZero() {
+		query.Set("since", filter.Since.UTC().Format(time.RFC3339))
+	}
+	if !filter.Until.IsZero() {
+		query.Set("until", filter.Until.UTC().Format(time.RFC3339))
+	}
+	if filter.Limit > 0 {
+		query.Set("limit", strconv.Itoa(filter.Limit))
+	}
+	var out struct {
+		Items []AuditEntry `json:"items"`
+	}
+	err := c.do(ctx, http.MethodGet, "/v1/audit", query, nil, &out, true)
+	return out.Items, err
+}
+
+func (c *Client) Fsck(ctx context.Context, dryRun bool) (FsckReport, error) {
+	query := url.Values{}
+	if dryRun {
+		query.Set("dryRun", "true")
+	}
+	var report FsckReport
+	err := c.do(ctx, http.MethodPost, "/v1/fsck", query, nil, &report, dryRun)
+	return report, err
+}
+
+// Backup streams a backup archive (tar.gz) into w.
+func (c *Client) Backup(ctx context.Context, w io.Writer, includeData bool) error {
+	query := url.Values{}
+	if includeData {
+		query.Set("includeData", "true")
+	}
+	resp, err := c.sendWithRetry(ctx, http.MethodPost, "/v1/backup", query, nil, nil, true)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	_, err = io.Copy(w, resp.Body)
+	return err
+}
+
+func vmPath(id string) string {
+	return "/v1/vms/" + url.PathEscape(id)
+}
+
+func stackPath(name string) string {
+	return "/v1/stacks/" + url.PathEscape(name)
+}
+
+func kernelPath(name string) string {
+	return "/v1/kernels/" + url.PathEscape(name)
+}
+
+func namespacePath(name string) string {
+	return "/v1/namespaces/" + url.PathEscape(name)
+}
+
+func templatePath(name string) string {
+	return "/v1/templates/" + url.PathEscape(name)
+}
+
+func (c *Client) do(ctx context.Context, method, path string, query url.Values, in, out any, idempotent bool) error {
+	return c.doWithHeader(ctx, method, path, query, nil, in, out, idempotent)
+}
+
+func (c *Client) doWithHeader(ctx context.Context, method, path string, query url.Values, header http.Header, in, out any, idempotent bool) error {
+	var body []byte
+	if in != nil {
+		var err error
+		if body, err = json.Marshal(in); err != nil {
+			return fmt.Errorf("encode request: %w", err)
+		}
+	}
+	if header == nil {
+		header = http.Header{}
+	}
+	if body != nil {
+		header.Set("Content-Type", "application/json")
+	}
+	resp, err := c.sendWithRetry(ctx, method, path, query, header, body, idempotent)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if out == nil {
+		_, _ = io.Copy(io.Discard, resp.Body)
+		return nil
+	}
+	if err := json.NewDecoder(resp.Body).Decode(out); err != nil {
+		return fmt.Errorf("decode response: %w", err)
+	}
+	return nil
+}
+
+// sendWithRetry returns a 2xx response or an error; non-2xx bodies are
+// decoded into *APIError.
+func (c *Client) sendWithRetry(ctx context.Context, method, path string, query url.Values, header http.Header, body []byte, idempotent bool) (*http.Response, error) {
+	attempts := 1
+	if idempotent {
+		attempts += c.maxRetries
+	}
+	var lastErr error
+	for attempt := 0; attempt < attempts; attempt++ {
+		if attempt > 0 && !sleepContext(ctx, c.backoff<<(attempt-1)) {
+			return nil, errors.Join(ctx.Err(), lastErr)
+		}
+		resp, err := c.sendOnce(ctx, method, path, query, header, body)
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil, err
+			}
+			lastErr = err
+			continue
+		}
+		if resp.StatusCode >= 200 && resp.StatusCode < 300 {
+			return resp, nil
+		}
+		lastErr = decodeAPIError(resp)
+		if !retryableStatus(resp.StatusCode) {
+			return nil, lastErr
+		}
+	}
+	return nil, lastErr
+}
+
+func (c *Client) sendOnce(ctx context.Context, method, path string, query url.Values, header http.Header, body []byte) (*http.Response, error) {
+	target := c.baseURL + path
+	if len(query) > 0 {
+		target += "?" + query.Encode()
+	}
+	var reader io.Reader
+	if body != nil {
+		reader = bytes.NewReader(body)
+	}
+	req, err := http.NewRequestWithContext(ctx, method, target, reader)
+	if err != nil {
+		return nil, err
+	}
+	for key, values := range c.header {
+		req.Header[key] = append([]string(nil), values...)
+	}
+	for key, values := range header {
+		req.Header[key] = values
+	}
+	if traceparent := tracing.Traceparent(ctx); traceparent != "" {
+		req.Header.Set("traceparent", traceparent)
+	}
+	return c.httpClient.Do(req)
+}
+
+func decodeAPIError(resp *http.Response) error {
+	defer resp.Body.Close()
+	apiErr := &APIError{StatusCode: resp.StatusCode}
+	data, _ := io.ReadAll(io.LimitReader(resp.Body, 64<<10))
+	if json.Unmarshal(data, apiErr) != nil || apiErr.Message == "" {
+		apiErr.Message = strings.TrimSpace(string(data))
+	}
+	return apiErr
+}
+
+func retryableStatus(status int) bool {
+	switch status {
+	case http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+		return true
+	}
+	return false
+}
@@ -0,0 +1,193 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/alperreha/mergen-fire/internal/testsupport"
+)
+
+func TestClient_Lifecycle(t *testing.T) {
+	env := testsupport.NewEnv(t)
+	c := New(env.API.URL)
+	ctx := context.Background()
+
+	id, err := c.CreateVM(ctx, env.Artifacts.CreateRequest())
+	if err != nil {
+		t.Fatalf("create: %v", err)
+	}
+	if err := c.StartVM(ctx, id); err != nil {
+		t.Fatalf("start: %v", err)
+	}
+	vm, err := c.GetVM(ctx, id)
+	if err != nil || !vm.Systemd.Active {
+		t.Fatalf("expected active vm, got %+v err=%v", vm.Systemd, err)
+	}
+	restarted, err := c.RestartVM(ctx, id, 5*time.Second)
+	if err != nil || !restarted.Active {
+		t.Fatalf("expected active vm after restart, got %+v err=%v", restarted, err)
+	}
+	history, err := c.StateHistory(ctx, id, 1)
+	if err != nil || len(history) != 1 || history[0].State != "started" {
+		t.Fatalf("expected restart start as latest transition, got %+v err=%v", history, err)
+	}
+	vms, err := c.ListVMs(ctx)
+	if err != nil || len(vms) != 1 || vms[0].ID != id {
+		t.Fatalf("unexpected list %+v err=%v", vms, err)
+	}
+	vms, next, err := c.ListVMPage(ctx, VMFilter{}, VMListPage{Limit: 1, Sort: "id"}, "tags")
+	if err != nil || len(vms) != 1 || vms[0].ID != id || next != "" {
+		t.Fatalf("unexpected page %+v next=%q err=%v", vms, next, err)
+	}
+
+	stale := vm.Revision - 1
+	if _, err := c.UpdateVM(ctx, id, &stale, UpdateVMRequest{Tags: map[string]string{"team": "a"}}); !errors.Is(err, ErrPreconditionFailed) {
+		t.Fatalf("expected precondition failed, got %v", err)
+	}
+	if err := c.StopVM(ctx, id); err != nil {
+		t.Fatalf("stop: %v", err)
+	}
+	if err := c.DeleteVM(ctx, id, false); err != nil {
+		t.Fatalf("delete: %v", err)
+	}
+	_, err = c.GetVM(ctx, id)
+	var apiErr *APIError
+	if !errors.Is(err, ErrNotFound) || !errors.As(err, &apiErr) || apiErr.Code != "not_found" {
+		t.Fatalf("expected not_found APIError, got %v", err)
+	}
+}
+
+func TestClient_PauseAndResume(t *testing.T) {
+	env := testsupport.NewEnv(t)
+	c := New(env.API.URL)
+	ctx := context.Background()
+
+	id, err := c.CreateVM(ctx, env.Artifacts.CreateRequest())
+	if err != nil {
+		t.Fatalf("create: %v", err)
+	}
+	if err := c.PauseVM(ctx, id); !errors.Is(err, ErrConflict) {
+		t.Fatalf("pause stopped vm: expected conflict, got %v", err)
+	}
+	if err := c.StartVM(ctx, id); err != nil {
+		t.Fatalf("start: %v", err)
+	}
+	for range 2 {
+		if err := c.PauseVM(ctx, id); err != nil {
+			t.Fatalf("pause: %v", err)
+		}
+	}
+	vm, err := c.GetVM(ctx, id)
+	if err != nil || !vm.Firecracker.Paused {
+		t.Fatalf("expected paused vm, got %+v err=%v", vm, err)
+	}
+	if err := c.ResumeVM(ctx, id); err != nil {
+		t.Fatalf("resume: %v", err)
+	}
+	if vm, err = c.GetVM(ctx, id); err != nil || vm.Firecracker.Paused {
+		t.Fatalf("expected running vm, got %+v err=%v", vm, err)
+	}
+	if err := c.PauseVM(ctx, "missing"); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("pause missing vm: expected not found, got %v", err)
+	}
+}
+
+func TestClient_Snapshots(t *testing.T) {
+	env := testsupport.NewEnv(t)
+	c := New(env.API.URL)
+	ctx := context.Background()
+
+	id, err := c.CreateVM(ctx, env.Artifacts.CreateRequest())
+	if err != nil {
+		t.Fatalf("create: %v", err)
+	}
+	if err := c.StartVM(ctx, id); err != nil {
+		t.Fatalf("start: %v", err)
+	}
+	snap, err := c.CreateSnapshot(ctx, id, CreateSnapshotRequest{Name: "before"})
+	if err != nil || snap.ID == "" || snap.Name != "before" {
+		t.Fatalf("unexpected snapshot %+v err=%v", snap, err)
+	}
+	if _, err := c.CreateSnapshot(ctx, id, CreateSnapshotRequest{Name: "before"}); !errors.Is(err, ErrConflict) {
+		t.Fatalf("duplicate snapshot name: expected conflict, got %v", err)
+	}
+	snaps, err := c.ListSnapshots(ctx, id)
+	if err != nil || len(snaps) != 1 || snaps[0].ID != snap.ID {
+		t.Fatalf("unexpected snapshots %+v err=%v", snaps, err)
+	}
+	restored, err := c.RestoreSnapshot(ctx, id, "before")
+	if err != nil || restored.ID != snap.ID {
+		t.Fatalf("unexpected restore %+v err=%v", restored, err)
+	}
+	if _, err := c.RestoreSnapshot(ctx, id, "missing"); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("restore missing snapshot: expected not found, got %v", err)
+	}
+	if err := c.DeleteSnapshot(ctx, id, snap.ID); err != nil {
+		t.Fatalf("delete snapshot: %v", err)
+	}
+	if snaps, err := c.ListSnapshots(ctx, id); err != nil || len(snaps) != 0 {
+		t.Fatalf("expected no snapshots after delete, got %+v err=%v", snaps, err)
+	}
+}
+
+func TestClient_RetriesIdempotentCalls(t *testing.T) {
+	var calls atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if calls.Add(1) < 3 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		_, _ = w.Write([]byte(`{"items":[]}`))
+	}))
+	defer server.Close()
+
+	c := New(server.URL).WithRetries(3, time.Millisecond)
+	if _, err := c.ListVMs(context.Background()); err != nil {
+		t.Fatalf("expected success after retries, got %v", err)
+	}
+	if calls.Load() != 3 {
+		t.Fatalf("expected 3 attempts, got %d", calls.Load())
+	}
+
+	calls.Store(0)
+	if _, err := c.CreateVM(context.Background(), CreateVMRequest{}); !errors.Is(err, ErrUnavailable) {
+		t.Fatalf("expected unavailable, got %v", err)
+	}
+	if calls.Load() != 1 {
+		t.Fatalf("expected create to be sent once, got %d", calls.Load())
+	}
+}
+
+func TestClient_Watch(t *testing.T) {
+	env := testsupport.NewEnv(t)
+	c := New(env.API.URL)
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	events, err := c.Watch(ctx)
+	if err != nil {
+		t.Fatalf("watch: %v", err)
+	}
+	id, err := c.CreateVM(ctx, env.Artifacts.CreateRequest())
+	if err != nil {
+		t.Fatalf("create: %v", err)
+	}
+	for {
+		select {
+		case event, ok := <-events:
+			if !ok {
+				t.Fatal("event stream closed early")
+			}
+			if event.ID == id {
+				return
+			}
+		case <-ctx.Done():
+			t.Fatal("no event for created vm")
+		}
+	}
+}
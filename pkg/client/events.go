@@ -0,0 +1,84 @@
+package client
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// Watch streams VM change events from GET /v1/events. The connection is
+// re-established with backoff if it drops, until ctx ends and the channel is
+// closed; events emitted while disconnected are not replayed, so callers that
+// need a consistent view should ListVMs after a gap.
+func (c *Client) Watch(ctx context.Context) (<-chan Event, error) {
+	resp, err := c.openEvents(ctx)
+	if err != nil {
+		return nil, err
+	}
+	events := make(chan Event)
+	go func() {
+		defer close(events)
+		for {
+			readEvents(ctx, resp, events)
+			resp = nil
+			for attempt := 0; resp == nil; attempt++ {
+				if !sleepContext(ctx, c.backoff<<min(attempt, 5)) {
+					return
+				}
+				resp, _ = c.openEvents(ctx)
+			}
+		}
+	}()
+	return events, nil
+}
+
+func (c *Client) openEvents(ctx context.Context) (*http.Response, error) {
+	// The stream is long-lived, so the client's overall timeout must not apply.
+	streaming := *c.httpClient
+	streaming.Timeout = 0
+	client := *c
+	client.httpClient = &streaming
+	return client.sendWithRetry(ctx, http.MethodGet, "/v1/events", nil, http.Header{"Accept": {"text/event-stream"}}, nil, true)
+}
+
+func readEvents(ctx context.Context, resp *http.Response, events chan<- Event) {
+	defer resp.Body.Close()
+	scanner := bufio.NewScanner(resp.Body)
+	var data strings.Builder
+	for scanner.Scan() {
+		line := scanner.Text()
+		switch {
+		case line == "":
+			if data.Len() == 0 {
+				continue
+			}
+			var event Event
+			err := json.Unmarshal([]byte(data.String()), &event)
+			data.Reset()
+			if err != nil {
+				continue
+			}
+			select {
+			case events <- event:
+			case <-ctx.Done():
+				return
+			}
+		case strings.HasPrefix(line, "data:"):
+			data.WriteString(strings.TrimSpace(strings.TrimPrefix(line, "data:")))
+		}
+	}
+}
+
+func sleepContext(ctx context.Context, d time.Duration) bool {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return false
+	case <-timer.C:
+		return true
+	}
+}
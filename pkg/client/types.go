@@ -0,0 +1,78 @@
+package client
+
+import "github.com/alperreha/mergen-fire/internal/model"
+
+// Request and response types are the ones mergend itself uses.
+type (
+	CreateVMRequest        = model.CreateVMRequest
+	AdoptVMRequest         = model.AdoptVMRequest
+	PortBindingRequest     = model.PortBindingRequest
+	UpdateVMRequest        = model.UpdateVMRequest
+	HookEntry              = model.HookEntry
+	LogPolicy              = model.LogPolicy
+	Placement              = model.Placement
+	VMSummary              = model.VMSummary
+	VMFilter               = model.VMFilter
+	VMListPage             = model.VMListPage
+	GuestStats             = model.GuestStats
+	VMMetrics              = model.VMMetrics
+	VMMetricsTotals        = model.VMMetricsTotals
+	SystemdState           = model.SystemdState
+	StateTransition        = model.StateTransition
+	HookExecution          = model.HookExecution
+	HookTestRequest        = model.HookTestRequest
+	HookTestResult         = model.HookTestResult
+	ArtifactReport         = model.ArtifactReport
+	LockStatus             = model.LockStatus
+	FsckReport             = model.FsckReport
+	MigrateVMRequest       = model.MigrateVMRequest
+	RecreateVMRequest      = model.RecreateVMRequest
+	VMLogsRequest          = model.VMLogsRequest
+	BatchVMRequest         = model.BatchVMRequest
+	BatchVMResult          = model.BatchVMResult
+	BatchVMResponse        = model.BatchVMResponse
+	MigrationResult        = model.MigrationResult
+	Snapshot               = model.Snapshot
+	CreateSnapshotRequest  = model.CreateSnapshotRequest
+	RestoreSnapshotRequest = model.RestoreSnapshotRequest
+	Kernel                 = model.Kernel
+	VMTemplate             = model.VMTemplate
+	Namespace              = model.Namespace
+	NamespaceQuota         = model.NamespaceQuota
+	NamespaceUsage         = model.NamespaceUsage
+	PortReservation        = model.PortReservation
+	PortReservationRequest = model.PortReservationRequest
+	PortReleaseRequest     = model.PortReleaseRequest
+	StackManifest          = model.StackManifest
+	StackMember            = model.StackMember
+	Stack                  = model.Stack
+	HostDiagnostics        = model.HostDiagnostics
+	HostCapacity           = model.HostCapacity
+	ExecRequest            = model.ExecRequest
+	ExecResult             = model.ExecResult
+	CapacityUsage          = model.CapacityUsage
+	UsageReport            = model.UsageReport
+	UsageGroup             = model.UsageGroup
+	Event                  = model.StoreEvent
+	Job                    = model.Job
+	WakeVMRequest          = model.WakeVMRequest
+	ActivityReport         = model.ActivityReport
+	AuditEntry             = model.AuditEntry
+	AuditFilter            = model.AuditFilter
+)
+
+// Statuses of a Job.
+const (
+	JobQueued    = model.JobQueued
+	JobRunning   = model.JobRunning
+	JobSucceeded = model.JobSucceeded
+	JobFailed    = model.JobFailed
+)
+
+// Actions of BatchVMs.
+const (
+	BatchStart   = model.BatchStart
+	BatchStop    = model.BatchStop
+	BatchRestart = model.BatchRestart
+	BatchDelete  = model.BatchDelete
+)
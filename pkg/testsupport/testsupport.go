@@ -0,0 +1,72 @@
+// Package testsupport exposes mergen's end-to-end test harness to code outside
+// this module: a fake Firecracker API server, a fake systemctl and an
+// in-process mergend + forwarder stack that need neither KVM nor systemd.
+// See internal/testsupport for details.
+package testsupport
+
+import (
+	"crypto/x509"
+	"testing"
+
+	"github.com/alperreha/mergen-fire/internal/testsupport"
+)
+
+type (
+	Env                = testsupport.Env
+	Forwarder          = testsupport.Forwarder
+	Units              = testsupport.Units
+	VMReader           = testsupport.VMReader
+	FakeFirecracker    = testsupport.FakeFirecracker
+	FirecrackerRequest = testsupport.FirecrackerRequest
+	FakeSystemctl      = testsupport.FakeSystemctl
+	Artifacts          = testsupport.Artifacts
+	Backends           = testsupport.Backends
+)
+
+const (
+	StateNotStarted = testsupport.StateNotStarted
+	StateRunning    = testsupport.StateRunning
+	StatePaused     = testsupport.StatePaused
+)
+
+func NewEnv(t testing.TB) *Env {
+	t.Helper()
+	return testsupport.NewEnv(t)
+}
+
+func NewCluster(t testing.TB, names ...string) map[string]*Env {
+	t.Helper()
+	return testsupport.NewCluster(t, names...)
+}
+
+func NewUnits(t testing.TB, store VMReader) *Units {
+	return testsupport.NewUnits(t, store)
+}
+
+func StartFakeFirecracker(t testing.TB, socketPath string) *FakeFirecracker {
+	t.Helper()
+	return testsupport.StartFakeFirecracker(t, socketPath)
+}
+
+func ListenFakeFirecracker(socketPath string) (*FakeFirecracker, error) {
+	return testsupport.ListenFakeFirecracker(socketPath)
+}
+
+func NewFakeSystemctl(t testing.TB) *FakeSystemctl {
+	t.Helper()
+	return testsupport.NewFakeSystemctl(t)
+}
+
+func WriteArtifacts(t testing.TB, dir string) Artifacts {
+	t.Helper()
+	return testsupport.WriteArtifacts(t, dir)
+}
+
+func SelfSignedCert(t testing.TB, dir string, hosts ...string) (certFile, keyFile string, pool *x509.CertPool) {
+	t.Helper()
+	return testsupport.SelfSignedCert(t, dir, hosts...)
+}
+
+func NewBackends() *Backends {
+	return testsupport.NewBackends()
+}
@@ -14,12 +14,56 @@ type MiddlewareFunc func(next HandlerFunc) HandlerFunc
 
 type Context interface {
 	Request() *http.Request
+	SetRequest(*http.Request)
+	Response() *Response
 	Bind(any) error
 	JSON(int, any) error
+	Path() string
 	Param(string) string
 	QueryParam(string) string
 }
 
+type Response struct {
+	Writer    http.ResponseWriter
+	Status    int
+	Size      int64
+	Committed bool
+}
+
+func (r *Response) Header() http.Header {
+	return r.Writer.Header()
+}
+
+func (r *Response) WriteHeader(code int) {
+	if r.Committed {
+		return
+	}
+	r.Status = code
+	r.Writer.WriteHeader(code)
+	r.Committed = true
+}
+
+func (r *Response) Write(b []byte) (int, error) {
+	if !r.Committed {
+		if r.Status == 0 {
+			r.Status = http.StatusOK
+		}
+		r.WriteHeader(r.Status)
+	}
+	n, err := r.Writer.Write(b)
+	r.Size += int64(n)
+	return n, err
+}
+
+func (r *Response) Flush() {
+	if !r.Committed {
+		r.WriteHeader(http.StatusOK)
+	}
+	if flusher, ok := r.Writer.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
 type HTTPError struct {
 	Code    int
 	Message string
@@ -50,10 +94,18 @@ type route struct {
 	handler  HandlerFunc
 }
 
+// Route describes a registered route, as returned by Routes.
+type Route struct {
+	Method string `json:"method"`
+	Path   string `json:"path"`
+	Name   string `json:"name"`
+}
+
 type contextImpl struct {
-	request *http.Request
-	writer  http.ResponseWriter
-	params  map[string]string
+	request  *http.Request
+	response *Response
+	path     string
+	params   map[string]string
 }
 
 func New() *Echo {
@@ -82,6 +134,14 @@ func (e *Echo) POST(path string, h HandlerFunc) {
 	e.add(http.MethodPost, path, h)
 }
 
+func (e *Echo) PUT(path string, h HandlerFunc) {
+	e.add(http.MethodPut, path, h)
+}
+
+func (e *Echo) PATCH(path string, h HandlerFunc) {
+	e.add(http.MethodPatch, path, h)
+}
+
 func (e *Echo) DELETE(path string, h HandlerFunc) {
 	e.add(http.MethodDelete, path, h)
 }
@@ -94,6 +154,14 @@ func (g *Group) POST(path string, h HandlerFunc) {
 	g.echo.add(http.MethodPost, joinPath(g.prefix, path), h)
 }
 
+func (g *Group) PUT(path string, h HandlerFunc) {
+	g.echo.add(http.MethodPut, joinPath(g.prefix, path), h)
+}
+
+func (g *Group) PATCH(path string, h HandlerFunc) {
+	g.echo.add(http.MethodPatch, joinPath(g.prefix, path), h)
+}
+
 func (g *Group) DELETE(path string, h HandlerFunc) {
 	g.echo.add(http.MethodDelete, joinPath(g.prefix, path), h)
 }
@@ -108,34 +176,32 @@ func (e *Echo) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	e.routeMu.RLock()
 	defer e.routeMu.RUnlock()
 
+	ctx := &contextImpl{request: r, response: &Response{Writer: w}}
+	// Like echo, middleware registered with Use also runs for requests no
+	// route matches.
+	status := http.StatusNotFound
+	handler := func(Context) error {
+		return &HTTPError{Code: status, Message: http.StatusText(status)}
+	}
 	for _, rt := range e.routes {
-		if rt.method != r.Method {
-			continue
-		}
-
 		params, ok := matchSegments(rt.segments, splitPath(path))
 		if !ok {
 			continue
 		}
-
-		ctx := &contextImpl{
-			request: r,
-			writer:  w,
-			params:  params,
-		}
-
-		handler := rt.handler
-		for idx := len(e.middlewares) - 1; idx >= 0; idx-- {
-			handler = e.middlewares[idx](handler)
-		}
-
-		if err := handler(ctx); err != nil {
-			writeHTTPError(w, err)
+		if rt.method != r.Method {
+			status = http.StatusMethodNotAllowed
+			continue
 		}
-		return
+		ctx.path, ctx.params, handler = rt.pattern, params, rt.handler
+		break
 	}
 
-	http.NotFound(w, r)
+	for idx := len(e.middlewares) - 1; idx >= 0; idx-- {
+		handler = e.middlewares[idx](handler)
+	}
+	if err := handler(ctx); err != nil {
+		writeHTTPError(w, err)
+	}
 }
 
 func (e *Echo) add(method, path string, h HandlerFunc) {
@@ -151,10 +217,30 @@ func (e *Echo) add(method, path string, h HandlerFunc) {
 	})
 }
 
+// Routes returns the registered routes in registration order.
+func (e *Echo) Routes() []*Route {
+	e.routeMu.RLock()
+	defer e.routeMu.RUnlock()
+
+	routes := make([]*Route, 0, len(e.routes))
+	for _, r := range e.routes {
+		routes = append(routes, &Route{Method: r.method, Path: r.pattern})
+	}
+	return routes
+}
+
 func (c *contextImpl) Request() *http.Request {
 	return c.request
 }
 
+func (c *contextImpl) SetRequest(r *http.Request) {
+	c.request = r
+}
+
+func (c *contextImpl) Response() *Response {
+	return c.response
+}
+
 func (c *contextImpl) Bind(target any) error {
 	if c.request.Body == nil {
 		return errors.New("request body is empty")
@@ -173,12 +259,16 @@ func (c *contextImpl) JSON(status int, payload any) error {
 	if err != nil {
 		return err
 	}
-	c.writer.Header().Set("Content-Type", "application/json")
-	c.writer.WriteHeader(status)
-	_, err = c.writer.Write(data)
+	c.response.Header().Set("Content-Type", "application/json")
+	c.response.WriteHeader(status)
+	_, err = c.response.Write(data)
 	return err
 }
 
+func (c *contextImpl) Path() string {
+	return c.path
+}
+
 func (c *contextImpl) Param(name string) string {
 	return c.params[name]
 }